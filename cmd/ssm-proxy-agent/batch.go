@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
+)
+
+// Limits of a batch of frames written to stdout with one write
+const (
+	maxBatchPackets = 64
+	maxBatchBytes   = 256 << 10
+
+	// maxFlushDelay is the longest a batch waits for more packets. The
+	// delay grows while batches fill up under load and drops back to zero
+	// when packets arrive one at a time, so interactive traffic is not
+	// delayed.
+	maxFlushDelay  = 400 * time.Microsecond
+	minFlushDelay  = 50 * time.Microsecond
+	maxPacketBytes = ssmp.MaxPacketSize
+)
+
+// frameBatch collects packets read from TUN as encapsulated frames. Packets
+// are read directly behind their frame header, so nothing is copied unless
+// they are compressed.
+type frameBatch struct {
+	frames  *ssmp.Writer
+	buf     []byte
+	packets int
+	bytes   int // of the packets, before compression
+}
+
+// newFrameBatch allocates room for a full batch of frames written by frames
+func newFrameBatch(frames *ssmp.Writer) *frameBatch {
+	return &frameBatch{frames: frames, buf: make([]byte, 0, maxBatchBytes+ssmp.HeaderSize+maxPacketBytes)}
+}
+
+// full reports whether the batch cannot take another packet
+func (b *frameBatch) full() bool {
+	return b.packets >= maxBatchPackets || len(b.buf) >= maxBatchBytes
+}
+
+// slot returns the space the next packet is read into
+func (b *frameBatch) slot() []byte {
+	return b.buf[len(b.buf)+ssmp.HeaderSize : len(b.buf)+ssmp.HeaderSize+maxPacketBytes]
+}
+
+// commit frames a packet of n bytes that was read into slot
+func (b *frameBatch) commit(n int) {
+	size := b.frames.Encode(b.buf[len(b.buf):len(b.buf)+ssmp.HeaderSize+n], n)
+	b.buf = b.buf[:len(b.buf)+size]
+	b.packets++
+	b.bytes += n
+}
+
+// reset empties the batch
+func (b *frameBatch) reset() {
+	b.buf = b.buf[:0]
+	b.packets = 0
+	b.bytes = 0
+}
+
+// fill blocks until a packet is read, then adds the packets that are
+// already queued on the device, waiting up to delay for more if the batch
+// is not full
+func (t *TUN) fill(b *frameBatch, delay time.Duration) error {
+	for b.packets == 0 {
+		n, err := t.Read(b.slot())
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			b.commit(n)
+		}
+	}
+
+	if err := t.drain(b); err != nil {
+		return err
+	}
+	if delay > 0 && !b.full() {
+		time.Sleep(delay)
+		return t.drain(b)
+	}
+	return nil
+}
+
+// drain adds queued packets to the batch without blocking
+func (t *TUN) drain(b *frameBatch) error {
+	raw, err := t.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var readErr error
+	err = raw.Read(func(fd uintptr) bool {
+		for !b.full() {
+			n, err := syscall.Read(int(fd), b.slot())
+			if err != nil {
+				if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EINTR) {
+					readErr = fmt.Errorf("read: %w", err)
+				}
+				return true
+			}
+			if n > 0 {
+				b.commit(n)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// nextFlushDelay adapts the flush delay to how full the last batch was
+func nextFlushDelay(delay time.Duration, b *frameBatch) time.Duration {
+	switch {
+	case b.full():
+		return min(max(2*delay, minFlushDelay), maxFlushDelay)
+	case b.packets <= 1:
+		return 0
+	default:
+		return delay / 2
+	}
+}
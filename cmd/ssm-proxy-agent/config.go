@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
+)
+
+// envPrefix plus a flag's name in upper case, with underscores for
+// dashes, is the environment variable setting the flag (e.g.
+// SSM_PROXY_AGENT_TUN_ADDR for --tun-addr); the command line wins
+const envPrefix = "SSM_PROXY_AGENT_"
+
+// Log levels of --log-level
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+var (
+	// compression is how packets sent to the client are compressed
+	// (--compression); by default like the client compresses its packets
+	compression = ssmp.CompressionAuto
+
+	// noNAT leaves IP forwarding and masquerading to the user (--no-nat)
+	noNAT bool
+
+	// tunAddr is the address and subnet of the TUN device (--tun-addr)
+	tunAddr = netip.MustParsePrefix("169.254.100.1/30")
+
+	// tunName is the name of the TUN device; %d is replaced by the kernel
+	// with the first free number (--tun-name)
+	tunName = "tun%d"
+
+	// tunMTU is the MTU of the TUN device, 0 for the kernel's default
+	// (--mtu)
+	tunMTU int
+
+	// statsInterval is how often statistics are logged, 0 for never
+	// (--stats-interval)
+	statsInterval = 30 * time.Second
+
+	// statsJSON logs statistics as a JSON object per line
+	// (--stats-format json)
+	statsJSON bool
+
+	// logLevel is the most verbose level logged (--log-level)
+	logLevel = levelInfo
+)
+
+// parseFlags parses the command line and the environment variables of
+// the flags
+func parseFlags() error {
+	flag.Func("compression", "compress packets sent to the client: auto (like the client), off, lz4 or deflate", func(s string) error {
+		c, err := ssmp.ParseCompression(s)
+		compression = c
+		return err
+	})
+	flag.BoolVar(&noNAT, "no-nat", false, "do not enable IP forwarding or masquerade the client's packets (set them up yourself)")
+	flag.Func("tun-addr", "address and subnet of the TUN device (default 169.254.100.1/30)", func(s string) error {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		if prefix.Bits() == prefix.Addr().BitLen() {
+			return fmt.Errorf("%s leaves no address for the client side", s)
+		}
+		tunAddr = prefix
+		return nil
+	})
+	flag.Func("tun-name", "name of the TUN device; %d is replaced by a free number (default tun%d)", func(s string) error {
+		if s == "" || len(s) > 15 || strings.ContainsAny(s, "/ ") {
+			return fmt.Errorf("invalid interface name %q", s)
+		}
+		tunName = s
+		return nil
+	})
+	flag.IntVar(&tunMTU, "mtu", 0, "MTU of the TUN device (default: the kernel's)")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "how often to log statistics, 0 for never")
+	flag.Func("stats-format", "format of logged statistics: text or json (default text)", func(s string) error {
+		switch s {
+		case "text", "json":
+			statsJSON = s == "json"
+			return nil
+		}
+		return fmt.Errorf("expected text or json")
+	})
+	flag.Func("log-level", "most verbose messages logged: error, warn, info or debug (default info)", func(s string) error {
+		for level, name := range levelNames {
+			if strings.EqualFold(s, name) {
+				logLevel = level
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(levelNames, ", "))
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s %q: %w", name, value, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	flag.Parse()
+	if tunMTU < 0 || tunMTU > 65535 {
+		return fmt.Errorf("invalid --mtu %d", tunMTU)
+	}
+	if statsInterval < 0 {
+		return fmt.Errorf("invalid --stats-interval %s", statsInterval)
+	}
+	return nil
+}
+
+// logf logs a message at level to stderr, the session's log
+func logf(level int, format string, args ...any) {
+	if level > logLevel {
+		return
+	}
+	switch level {
+	case levelWarn:
+		format = "Warning: " + format
+	case levelDebug:
+		format = "Debug: " + format
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// warnf logs a warning
+func warnf(format string, args ...any) { logf(levelWarn, format, args...) }
+
+// infof logs a message about what the agent does
+func infof(format string, args ...any) { logf(levelInfo, format, args...) }
+
+// debugf logs details for troubleshooting
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
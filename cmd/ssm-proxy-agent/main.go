@@ -1,21 +1,21 @@
 package main
 
 import (
-	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe"
-)
 
-const (
-	magicNumber uint32 = 0x53534D50 // "SSMP"
-	headerSize         = 8
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
 )
 
 var (
@@ -30,165 +30,279 @@ var (
 )
 
 func main() {
-	if err := run(); err != nil {
+	if err := parseFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	run := runSupervisor
+	if os.Getenv(workerEnv) != "" {
+		run = runWorker
+	}
+
+	err := run()
+	if errors.Is(err, errHandoff) {
+		os.Exit(exitHandoff)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	// Set up signal handling
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+// runWorker forwards packets between the session (stdin/stdout) and the
+// TUN device inherited from the supervisor, resuming from the state left by
+// the previous worker. On SIGTERM it stops at a frame boundary and hands its
+// state off to the next worker.
+func runWorker() error {
+	statePath := os.Getenv(stateEnv)
+	state, err := loadState(statePath)
+	if err != nil {
+		warnf("ignoring previous worker state: %v", err)
+		state = nil
+	}
 
-	// Create TUN device for packet forwarding
-	tun, err := createTUN()
+	tun, err := inheritTUN()
 	if err != nil {
-		return fmt.Errorf("failed to create TUN device: %w", err)
+		return err
 	}
 	defer tun.Close()
 
-	fmt.Fprintf(os.Stderr, "SSM Proxy Agent started on TUN device: %s\n", tun.Name())
+	stdin, err := pollableFile(0, "stdin")
+	if err != nil {
+		return err
+	}
+	stdout, err := pollableFile(1, "stdout")
+	if err != nil {
+		return err
+	}
+
+	// After a clean handoff the frame streams carry on where the previous
+	// worker stopped; after a crash the reader resynchronizes on the next
+	// frame and the writer starts a new sequence
+	reader, writer := ssmp.NewReader(stdin), ssmp.NewWriter()
+	if state != nil {
+		state.restoreStats()
+		if state.Clean {
+			reader = ssmp.ResumeReader(stdin, state.PendingInput, state.RXSeq)
+			writer = ssmp.ResumeWriter(state.TXSeq)
+		}
+		infof("SSM Proxy Agent worker resumed on TUN device: %s (clean handoff: %v)", tun.Name(), state.Clean)
+	} else {
+		infof("SSM Proxy Agent worker started on TUN device: %s", tun.Name())
+	}
+
+	reader.Logf = warnf
+	writer.SetCompression(compression)
+	writer.Negotiate(reader)
+
+	// Until this worker hands off, the state it leaves is a crash's
+	if err := newState(false, nil).save(statePath); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	// Set up signal handling
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	// Start packet forwarding goroutines
 	errCh := make(chan error, 2)
 
 	// stdin → TUN (receive packets from client, write to TUN)
 	go func() {
-		err := forwardStdinToTUN(os.Stdin, tun)
+		err := forwardStdinToTUN(reader, tun)
 		errCh <- fmt.Errorf("stdin→TUN: %w", err)
 	}()
 
 	// TUN → stdout (read packets from TUN, send to client)
 	go func() {
-		err := forwardTUNToStdout(tun, os.Stdout)
+		err := forwardTUNToStdout(tun, stdout, writer)
 		errCh <- fmt.Errorf("TUN→stdout: %w", err)
 	}()
 
-	// Print stats periodically
-	go printStats()
+	// Log stats and checkpoint them periodically
+	stopCh := make(chan struct{})
+	checkpointDone := make(chan struct{})
+	go func() {
+		defer close(checkpointDone)
+		printStats(statePath, reader, writer, stopCh)
+	}()
+	stopCheckpoints := sync.OnceFunc(func() {
+		close(stopCh)
+		<-checkpointDone
+	})
+	defer stopCheckpoints()
 
 	// Wait for signal or error
 	select {
 	case sig := <-sigCh:
-		fmt.Fprintf(os.Stderr, "Received signal: %v\n", sig)
-		return nil
+		infof("Received signal: %v, handing off", sig)
 	case err := <-errCh:
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.EPIPE) {
+			infof("Session closed")
+			return nil
+		}
 		return err
 	}
-}
-
-// forwardStdinToTUN reads encapsulated packets from stdin and writes to TUN
-func forwardStdinToTUN(reader io.Reader, tun *TUN) error {
-	for {
-		// Read header
-		header := make([]byte, headerSize)
-		if _, err := io.ReadFull(reader, header); err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return fmt.Errorf("read header: %w", err)
-		}
 
-		// Verify magic number
-		magic := binary.BigEndian.Uint32(header[0:4])
-		if magic != magicNumber {
-			return fmt.Errorf("invalid magic number: 0x%x", magic)
+	// Interrupt both loops; the stdin loop keeps the bytes of a partly
+	// read frame, and a frame being written to stdout is completed first
+	stdin.SetReadDeadline(time.Now())
+	tun.SetReadDeadline(time.Now())
+	for range 2 {
+		if err := <-errCh; !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
 		}
+	}
 
-		// Read length
-		length := binary.BigEndian.Uint32(header[4:8])
-		if length > 65535 {
-			return fmt.Errorf("packet too large: %d bytes", length)
-		}
+	stopCheckpoints()
+	handoff := newState(true, reader.Pending())
+	handoff.RXSeq, handoff.TXSeq = reader.Expected(), writer.Sequence()
+	if err := handoff.save(statePath); err != nil {
+		return fmt.Errorf("failed to save handoff state: %w", err)
+	}
+	return errHandoff
+}
 
-		// Read packet data
-		packet := make([]byte, length)
-		if _, err := io.ReadFull(reader, packet); err != nil {
-			return fmt.Errorf("read packet: %w", err)
+// forwardStdinToTUN reads encapsulated packets from the session and writes
+// them to TUN
+func forwardStdinToTUN(reader *ssmp.Reader, tun *TUN) error {
+	for {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			return err
 		}
 
 		// Write to TUN device
 		if _, err := tun.Write(packet); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: TUN write error: %v\n", err)
+			warnf("TUN write error: %v", err)
 			continue
 		}
 
 		// Update stats
 		stats.mu.Lock()
 		stats.packetsRX++
-		stats.bytesRX += uint64(length)
+		stats.bytesRX += uint64(len(packet))
 		stats.mu.Unlock()
 	}
 }
 
-// forwardTUNToStdout reads packets from TUN and writes encapsulated to stdout
-func forwardTUNToStdout(tun *TUN, writer io.Writer) error {
-	buf := make([]byte, 65535)
+// forwardTUNToStdout reads packets from TUN and writes them encapsulated to
+// stdout, coalescing the packets that are ready into one write
+func forwardTUNToStdout(tun *TUN, writer io.Writer, frames *ssmp.Writer) error {
+	batch := newFrameBatch(frames)
+	var delay time.Duration
 
 	for {
-		// Read from TUN device
-		n, err := tun.Read(buf)
-		if err != nil {
-			return fmt.Errorf("TUN read: %w", err)
-		}
+		// Read from TUN device; packets read before an error (such as the
+		// handoff deadline) are still sent
+		batch.reset()
+		readErr := tun.fill(batch, delay)
+
+		if batch.packets > 0 {
+			// Write to stdout
+			if _, err := writer.Write(batch.buf); err != nil {
+				return fmt.Errorf("stdout write: %w", err)
+			}
 
-		if n == 0 {
-			continue
+			// Update stats
+			stats.mu.Lock()
+			stats.packetsTX += uint64(batch.packets)
+			stats.bytesTX += uint64(batch.bytes)
+			stats.mu.Unlock()
 		}
 
-		packet := buf[:n]
-
-		// Encapsulate packet
-		frame := encapsulatePacket(packet)
-
-		// Write to stdout
-		if _, err := writer.Write(frame); err != nil {
-			return fmt.Errorf("stdout write: %w", err)
+		if readErr != nil {
+			return fmt.Errorf("TUN read: %w", readErr)
 		}
-
-		// Update stats
-		stats.mu.Lock()
-		stats.packetsTX++
-		stats.bytesTX += uint64(n)
-		stats.mu.Unlock()
+		delay = nextFlushDelay(delay, batch)
 	}
 }
 
-// encapsulatePacket wraps a packet with protocol framing
-func encapsulatePacket(packet []byte) []byte {
-	header := make([]byte, headerSize)
+// checkpointInterval is how often statistics are saved when they are
+// not logged
+const checkpointInterval = 30 * time.Second
 
-	// Write magic number
-	binary.BigEndian.PutUint32(header[0:4], magicNumber)
+// printStats logs statistics every --stats-interval and checkpoints them
+// to the state file, so they survive a worker crash
+func printStats(statePath string, reader *ssmp.Reader, writer *ssmp.Writer, stopCh <-chan struct{}) {
+	interval := statsInterval
+	if interval == 0 {
+		interval = checkpointInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	// Write length
-	binary.BigEndian.PutUint32(header[4:8], uint32(len(packet)))
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
 
-	// Combine header and packet
-	frame := make([]byte, headerSize+len(packet))
-	copy(frame, header)
-	copy(frame[headerSize:], packet)
+		if statsInterval > 0 && logLevel >= levelInfo {
+			logStats(reader.Stats(), writer.Stats())
+		}
 
-	return frame
+		if err := newState(false, nil).save(statePath); err != nil {
+			warnf("failed to checkpoint state: %v", err)
+		}
+	}
 }
 
-// printStats prints statistics every 30 seconds
-func printStats() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// statsLine is the JSON form of the statistics (--stats-format json)
+type statsLine struct {
+	Time         time.Time `json:"time"`
+	PacketsTX    uint64    `json:"packets_tx"`
+	BytesTX      uint64    `json:"bytes_tx"`
+	PacketsRX    uint64    `json:"packets_rx"`
+	BytesRX      uint64    `json:"bytes_rx"`
+	PayloadBytes uint64    `json:"payload_bytes"` // sent for BytesTX, after compression
+	Corrupt      uint64    `json:"corrupt"`
+	Lost         uint64    `json:"lost"`
+	Duplicates   uint64    `json:"duplicates"`
+	SkippedBytes uint64    `json:"skipped_bytes"`
+}
+
+// logStats writes the statistics to stderr, as text or as a JSON line
+func logStats(dropped ssmp.ReaderStats, sent ssmp.WriterStats) {
+	stats.mu.RLock()
+	line := statsLine{
+		Time:         time.Now().UTC(),
+		PacketsTX:    stats.packetsTX,
+		BytesTX:      stats.bytesTX,
+		PacketsRX:    stats.packetsRX,
+		BytesRX:      stats.bytesRX,
+		PayloadBytes: sent.PayloadBytes,
+		Corrupt:      dropped.Corrupt,
+		Lost:         dropped.Lost,
+		Duplicates:   dropped.Duplicates,
+		SkippedBytes: dropped.SkippedBytes,
+	}
+	stats.mu.RUnlock()
 
-	for range ticker.C {
-		stats.mu.RLock()
-		fmt.Fprintf(os.Stderr, "Stats: TX=%d packets (%d bytes), RX=%d packets (%d bytes)\n",
-			stats.packetsTX, stats.bytesTX, stats.packetsRX, stats.bytesRX)
-		stats.mu.RUnlock()
+	if statsJSON {
+		data, _ := json.Marshal(line)
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Stats: TX=%d packets (%d bytes), RX=%d packets (%d bytes)\n",
+		line.PacketsTX, line.BytesTX, line.PacketsRX, line.BytesRX)
+	if sent.PayloadBytes < sent.PacketBytes {
+		fmt.Fprintf(os.Stderr, "Compression: sent %d bytes for %d bytes of packets (%.0f%%)\n",
+			sent.PayloadBytes, sent.PacketBytes, 100*float64(sent.PayloadBytes)/float64(sent.PacketBytes))
+	}
+	if dropped != (ssmp.ReaderStats{}) {
+		fmt.Fprintf(os.Stderr, "Dropped: corrupt=%d lost=%d duplicate=%d (skipped %d bytes)\n",
+			dropped.Corrupt, dropped.Lost, dropped.Duplicates, dropped.SkippedBytes)
 	}
 }
 
-// TUN represents a Linux TUN device
+// TUN represents a Linux TUN device. It is non-blocking, so reads can be
+// interrupted with a deadline for a handoff.
 type TUN struct {
-	fd   int
+	file *os.File
 	name string
 }
 
@@ -211,8 +325,8 @@ func createTUN() (*TUN, error) {
 		_     [22]byte // padding
 	}
 
-	// Set device name (empty means kernel assigns one)
-	copy(ifr.name[:], []byte("tun%d"))
+	// Set device name (a %d is replaced with a free number)
+	copy(ifr.name[:], []byte(tunName))
 	ifr.flags = IFF_TUN | IFF_NO_PI
 
 	// TUNSETIFF ioctl
@@ -234,8 +348,13 @@ func createTUN() (*TUN, error) {
 		}
 	}
 
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set TUN non-blocking: %w", err)
+	}
+
 	tun := &TUN{
-		fd:   fd,
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
 		name: name,
 	}
 
@@ -252,12 +371,15 @@ func createTUN() (*TUN, error) {
 func (t *TUN) configure() error {
 	// Bring interface up and set IP address
 	// ip link set <name> up
-	// ip addr add 169.254.100.1/30 dev <name>
+	// ip addr add <--tun-addr> dev <name>
 
 	// Use ip command for simplicity
 	cmds := [][]string{
 		{"ip", "link", "set", t.name, "up"},
-		{"ip", "addr", "add", "169.254.100.1/30", "dev", t.name},
+		{"ip", "addr", "add", tunAddr.String(), "dev", t.name},
+	}
+	if tunMTU > 0 {
+		cmds = append(cmds, []string{"ip", "link", "set", t.name, "mtu", strconv.Itoa(tunMTU)})
 	}
 
 	for _, cmd := range cmds {
@@ -271,7 +393,7 @@ func (t *TUN) configure() error {
 
 // Read reads a packet from the TUN device
 func (t *TUN) Read(p []byte) (int, error) {
-	n, err := syscall.Read(t.fd, p)
+	n, err := t.file.Read(p)
 	if err != nil {
 		return 0, fmt.Errorf("read: %w", err)
 	}
@@ -280,16 +402,21 @@ func (t *TUN) Read(p []byte) (int, error) {
 
 // Write writes a packet to the TUN device
 func (t *TUN) Write(p []byte) (int, error) {
-	n, err := syscall.Write(t.fd, p)
+	n, err := t.file.Write(p)
 	if err != nil {
 		return 0, fmt.Errorf("write: %w", err)
 	}
 	return n, nil
 }
 
+// SetReadDeadline interrupts a pending Read at t
+func (t *TUN) SetReadDeadline(deadline time.Time) error {
+	return t.file.SetReadDeadline(deadline)
+}
+
 // Close closes the TUN device
 func (t *TUN) Close() error {
-	return syscall.Close(t.fd)
+	return t.file.Close()
 }
 
 // Name returns the device name
@@ -299,6 +426,7 @@ func (t *TUN) Name() string {
 
 // execCommand executes a shell command
 func execCommand(name string, args ...string) error {
+	debugf("Running %s %s", name, strings.Join(args, " "))
 	cmd := exec.Command(name, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// natDir holds what the agents running at the same time share: the
+// ip_forward value from before the first of them turned it on, and a file
+// for the TUN device of each
+const natDir = "/run/ssm-proxy-agent"
+
+// ipForwardPath is the sysctl that lets the kernel route the client's
+// packets on to the VPC
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// natMarkBase plus a TUN device's index is the connection mark, packet
+// mark and routing table of the connections from that device
+const natMarkBase = 0x53500000
+
+// natComment tags the iptables rules of the agent
+const natComment = "ssm-proxy-agent"
+
+// nat is the forwarding set up for the packets of a TUN device. Packets
+// from the client keep its addresses (such as 169.254.169.1), so besides
+// masquerading them the replies need a route back: their connections are
+// marked, and marked packets are routed to the TUN device by a table of
+// their own.
+type nat struct {
+	tun  string
+	mark uint32
+
+	// undo holds the commands that remove the setup, in the order run
+	undo       [][]string
+	forwarding bool
+}
+
+// setupNAT turns on IP forwarding and masquerades the connections from
+// tun, with iptables if it is installed or else nftables
+func setupNAT(tun *TUN) (*nat, error) {
+	iface, err := net.InterfaceByName(tun.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", tun.Name(), err)
+	}
+	n := &nat{tun: tun.Name(), mark: natMarkBase + uint32(iface.Index)}
+
+	if err := n.setup(); err != nil {
+		n.cleanup()
+		return nil, err
+	}
+	return n, nil
+}
+
+// setup does the work of setupNAT, leaving what it did to cleanup
+func (n *nat) setup() error {
+	if err := enableForwarding(n.tun); err != nil {
+		return err
+	}
+	n.forwarding = true
+
+	// Strict reverse path filtering would drop the client's packets, whose
+	// source addresses are not routed to the device; the device's setting
+	// wins when it is the higher one
+	rpFilter := filepath.Join("/proc/sys/net/ipv4/conf", n.tun, "rp_filter")
+	if err := os.WriteFile(rpFilter, []byte("2"), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %w", rpFilter, err)
+	}
+
+	// Rules in another table cannot override the drop policy of a chain
+	// such as the FORWARD chain Docker sets up, so iptables is preferred
+	var err error
+	if _, lookErr := exec.LookPath("iptables"); lookErr == nil {
+		err = n.setupIPTables()
+	} else if _, lookErr := exec.LookPath("nft"); lookErr == nil {
+		err = n.setupNFTables()
+	} else {
+		err = errors.New("neither iptables nor nft is installed (use --no-nat to set up forwarding yourself)")
+	}
+	if err != nil {
+		return err
+	}
+
+	mark, table := fmt.Sprintf("%#x", n.mark), strconv.FormatUint(uint64(n.mark), 10)
+	if err := execCommand("ip", "route", "replace", "default", "dev", n.tun, "table", table); err != nil {
+		return fmt.Errorf("failed to add the return route: %w", err)
+	}
+	n.undo = append(n.undo, []string{"ip", "route", "flush", "table", table})
+	if err := execCommand("ip", "rule", "add", "fwmark", mark, "table", table); err != nil {
+		return fmt.Errorf("failed to add the return routing rule: %w", err)
+	}
+	n.undo = append(n.undo, []string{"ip", "rule", "del", "fwmark", mark, "table", table})
+	return nil
+}
+
+// setupIPTables adds the marking, masquerading and forwarding rules with
+// iptables
+func (n *nat) setupIPTables() error {
+	mark := fmt.Sprintf("%#x", n.mark)
+	rules := []struct {
+		table, action, chain string
+		spec                 []string
+	}{
+		{"mangle", "-A", "PREROUTING", []string{"-i", n.tun, "-j", "CONNMARK", "--set-mark", mark}},
+		{"mangle", "-A", "PREROUTING", []string{"!", "-i", n.tun, "-m", "connmark", "--mark", mark, "-j", "MARK", "--set-mark", mark}},
+		{"nat", "-A", "POSTROUTING", []string{"-m", "connmark", "--mark", mark, "-j", "MASQUERADE"}},
+		{"filter", "-I", "FORWARD", []string{"-i", n.tun, "-j", "ACCEPT"}},
+		{"filter", "-I", "FORWARD", []string{"-o", n.tun, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+
+	for _, rule := range rules {
+		spec := append(rule.spec, "-m", "comment", "--comment", natComment)
+		args := append([]string{"-w", "-t", rule.table, rule.action, rule.chain}, spec...)
+		if err := execCommand("iptables", args...); err != nil {
+			return fmt.Errorf("failed to add iptables rule: %w", err)
+		}
+		n.undo = append(n.undo, append([]string{"iptables", "-w", "-t", rule.table, "-D", rule.chain}, spec...))
+	}
+	return nil
+}
+
+// setupNFTables adds the marking and masquerading rules as a table of
+// the device's own
+func (n *nat) setupNFTables() error {
+	table := "ssm-proxy-agent-" + n.tun
+	// Adding and deleting the table first replaces one left by an agent
+	// that did not clean up
+	ruleset := fmt.Sprintf(`table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		iifname "%[2]s" ct mark set %#[3]x
+		iifname != "%[2]s" ct mark %#[3]x meta mark set ct mark
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ct mark %#[3]x masquerade
+	}
+}
+`, table, n.tun, n.mark)
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add nftables table %s: %s: %w", table, strings.TrimSpace(string(output)), err)
+	}
+	n.undo = append(n.undo, []string{"nft", "delete", "table", "ip", table})
+	return nil
+}
+
+// cleanup removes the rules and routes of the device, and turns IP
+// forwarding back off if this was the last agent and it was off before
+func (n *nat) cleanup() {
+	for i := len(n.undo) - 1; i >= 0; i-- {
+		if err := execCommand(n.undo[i][0], n.undo[i][1:]...); err != nil {
+			warnf("failed to clean up NAT: %v", err)
+		}
+	}
+	n.undo = nil
+
+	if n.forwarding {
+		if err := disableForwarding(n.tun); err != nil {
+			warnf("failed to restore IP forwarding: %v", err)
+		}
+		n.forwarding = false
+	}
+}
+
+// enableForwarding turns IP forwarding on for the agent of the TUN device
+// tun, remembering the previous value if it was off
+func enableForwarding(tun string) error {
+	unlock, err := lockNATDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(ipForwardPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ipForwardPath, err)
+	}
+	if strings.TrimSpace(string(current)) != "1" {
+		if err := os.WriteFile(filepath.Join(natDir, "ip_forward"), current, 0644); err != nil {
+			return fmt.Errorf("failed to save ip_forward: %w", err)
+		}
+		if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		}
+		infof("Enabled IP forwarding")
+	}
+
+	marker := filepath.Join(natDir, "tun-"+tun)
+	if err := os.WriteFile(marker, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", marker, err)
+	}
+	return nil
+}
+
+// disableForwarding restores the IP forwarding value saved by
+// enableForwarding once no other agent's TUN device is left
+func disableForwarding(tun string) error {
+	unlock, err := lockNATDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	os.Remove(filepath.Join(natDir, "tun-"+tun))
+	markers, err := filepath.Glob(filepath.Join(natDir, "tun-*"))
+	if err != nil {
+		return err
+	}
+	for _, marker := range markers {
+		// The markers of agents that did not clean up are stale once
+		// their devices are gone
+		name := strings.TrimPrefix(filepath.Base(marker), "tun-")
+		if _, err := os.Stat(filepath.Join("/sys/class/net", name)); err == nil {
+			return nil
+		}
+		os.Remove(marker)
+	}
+
+	saved := filepath.Join(natDir, "ip_forward")
+	previous, err := os.ReadFile(saved)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ipForwardPath, previous, 0644); err != nil {
+		return err
+	}
+	infof("Restored IP forwarding setting")
+	return os.Remove(saved)
+}
+
+// lockNATDir creates natDir and locks it against the other agents
+func lockNATDir() (unlock func(), err error) {
+	if err := os.MkdirAll(natDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", natDir, err)
+	}
+	lock, err := os.OpenFile(filepath.Join(natDir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", natDir, err)
+	}
+	return func() { lock.Close() }, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is bumped when agentState changes incompatibly
+const stateVersion = 2
+
+// agentState is what a worker hands off to the next one. The TUN device,
+// its addresses and the kernel's connection tracking belong to the
+// supervisor and survive a restart on their own; the worker only keeps the
+// position in the session's frame streams and its counters.
+type agentState struct {
+	Version int `json:"version"`
+
+	// Clean is set by a worker that stopped at a frame boundary; after a
+	// crash the next worker resynchronizes on the magic number and starts
+	// a new sequence instead
+	Clean bool `json:"clean"`
+
+	// PendingInput holds session input of a frame that was not read
+	// completely
+	PendingInput []byte `json:"pending_input,omitempty"`
+
+	// RXSeq is the next sequence number expected from the client, TXSeq
+	// the next one sent to it
+	RXSeq uint32 `json:"rx_seq"`
+	TXSeq uint32 `json:"tx_seq"`
+
+	PacketsTX uint64    `json:"packets_tx"`
+	PacketsRX uint64    `json:"packets_rx"`
+	BytesTX   uint64    `json:"bytes_tx"`
+	BytesRX   uint64    `json:"bytes_rx"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// newState snapshots the current statistics
+func newState(clean bool, pendingInput []byte) *agentState {
+	stats.mu.RLock()
+	defer stats.mu.RUnlock()
+
+	return &agentState{
+		Version:      stateVersion,
+		Clean:        clean,
+		PendingInput: pendingInput,
+		PacketsTX:    stats.packetsTX,
+		PacketsRX:    stats.packetsRX,
+		BytesTX:      stats.bytesTX,
+		BytesRX:      stats.bytesRX,
+		SavedAt:      time.Now(),
+	}
+}
+
+// restoreStats continues the statistics of the previous worker
+func (s *agentState) restoreStats() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.packetsTX = s.PacketsTX
+	stats.packetsRX = s.PacketsRX
+	stats.bytesTX = s.BytesTX
+	stats.bytesRX = s.BytesRX
+}
+
+// save atomically replaces the state file
+func (s *agentState) save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState reads the state left by the previous worker; it returns nil if
+// there is none
+func loadState(path string) (*agentState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s agentState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d in %s", s.Version, path)
+	}
+	return &s, nil
+}
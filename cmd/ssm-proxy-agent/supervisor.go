@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Environment passed from the supervisor to its worker
+const (
+	workerEnv  = "SSM_PROXY_AGENT_WORKER"
+	stateEnv   = "SSM_PROXY_AGENT_STATE"
+	tunNameEnv = "SSM_PROXY_AGENT_TUN"
+)
+
+// tunFD is the worker's file descriptor of the inherited TUN device (the
+// first of exec.Cmd.ExtraFiles)
+const tunFD = 3
+
+// exitHandoff is the worker's exit code after saving its state for the
+// next worker
+const exitHandoff = 3
+
+// errHandoff ends a worker that handed off its state
+var errHandoff = errors.New("worker handed off")
+
+// Recovery actions for a crashed worker, like a Windows service's: restart
+// at once after the first failure, then after increasing delays, and give
+// up after maxWorkerFailures in a row. A worker that ran for
+// failureResetPeriod resets the count.
+const (
+	maxWorkerFailures  = 5
+	failureResetPeriod = time.Minute
+)
+
+var restartDelays = []time.Duration{0, time.Second, 5 * time.Second}
+
+// runSupervisor owns the TUN device and the session's stdin/stdout and runs
+// the packet forwarding in a worker process. A crashed worker is restarted;
+// SIGHUP (or SIGTERM sent to the worker) restarts it from the binary on
+// disk, for upgrades. Either way the next worker continues from the state
+// the previous one left, so the client does not have to reconnect.
+func runSupervisor() error {
+	// Set up signal handling
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Create TUN device for packet forwarding
+	tun, err := createTUN()
+	if err != nil {
+		return fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	defer tun.Close()
+
+	// The worker only moves packets; forwarding them on belongs to the
+	// supervisor, like the device
+	if !noNAT {
+		nat, err := setupNAT(tun)
+		if err != nil {
+			return fmt.Errorf("failed to set up NAT: %w", err)
+		}
+		defer nat.cleanup()
+		infof("Masquerading packets from %s", tun.Name())
+	}
+
+	stateDir, err := os.MkdirTemp("", "ssm-proxy-agent-")
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	defer os.RemoveAll(stateDir)
+	statePath := filepath.Join(stateDir, "state.json")
+
+	// Workers switch stdin/stdout to non-blocking mode, which is shared
+	// with whoever started the agent
+	defer syscall.SetNonblock(0, false)
+	defer syscall.SetNonblock(1, false)
+
+	infof("SSM Proxy Agent started on TUN device: %s (%s)", tun.Name(), tunAddr)
+
+	failures := 0
+	for {
+		started := time.Now()
+		worker, err := startWorker(tun, statePath)
+		if err != nil {
+			return err
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- worker.Wait() }()
+
+		stopping := false
+		select {
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				infof("Received SIGHUP, restarting worker")
+			} else {
+				infof("Received signal: %v", sig)
+				stopping = true
+			}
+			worker.Process.Signal(syscall.SIGTERM)
+			err = <-exited
+		case err = <-exited:
+		}
+
+		code := worker.ProcessState.ExitCode()
+		switch {
+		case stopping:
+			return nil
+		case code == exitHandoff:
+			continue
+		case err == nil:
+			// The session was closed
+			return nil
+		}
+
+		if time.Since(started) >= failureResetPeriod {
+			failures = 0
+		}
+		failures++
+		if failures >= maxWorkerFailures {
+			return fmt.Errorf("worker failed %d times in a row, last: %w", failures, err)
+		}
+
+		delay := restartDelays[min(failures, len(restartDelays))-1]
+		warnf("worker failed (%v), restarting in %s", err, delay)
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				infof("Received signal: %v", sig)
+				return nil
+			}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// startWorker runs this executable as a worker, passing it the TUN device,
+// the session's stdio and the agent's flags
+func startWorker(tun *TUN, statePath string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate agent executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{tun.file}
+	cmd.Env = append(os.Environ(),
+		workerEnv+"=1",
+		stateEnv+"="+statePath,
+		tunNameEnv+"="+tun.Name(),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start worker: %w", err)
+	}
+	return cmd, nil
+}
+
+// inheritTUN opens the TUN device passed by the supervisor
+func inheritTUN() (*TUN, error) {
+	name := os.Getenv(tunNameEnv)
+	if name == "" {
+		return nil, fmt.Errorf("no TUN device inherited from the supervisor")
+	}
+	if err := syscall.SetNonblock(tunFD, true); err != nil {
+		return nil, fmt.Errorf("failed to use inherited TUN fd %d: %w", tunFD, err)
+	}
+	return &TUN{file: os.NewFile(tunFD, "/dev/net/tun"), name: name}, nil
+}
+
+// pollableFile returns a non-blocking duplicate of a file descriptor, so
+// reads can be interrupted with a deadline. The duplicate is needed because
+// os.Stdin and os.Stdout may already hold the descriptor's poller
+// registration.
+func pollableFile(fd int, name string) (*os.File, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate %s: %w", name, err)
+	}
+	syscall.CloseOnExec(dup)
+	if err := syscall.SetNonblock(dup, true); err != nil {
+		syscall.Close(dup)
+		return nil, fmt.Errorf("failed to set %s non-blocking: %w", name, err)
+	}
+	return os.NewFile(uintptr(dup), name), nil
+}
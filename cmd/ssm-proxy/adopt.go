@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+)
+
+// adoptOrphans takes over the routes and DNS resolver files left by
+// sessions whose process died, instead of failing on them (--adopt)
+var adoptOrphans bool
+
+// staleSessions returns the sessions whose process is gone. Looked up
+// before the session name is reserved, which may end one of them.
+func staleSessions(mgr *session.Manager) []*session.Session {
+	sessions, err := mgr.ListAll()
+	if err != nil {
+		log.Warnf("Failed to list sessions: %v", err)
+		return nil
+	}
+
+	var stale []*session.Session
+	for _, sess := range sessions {
+		if !sess.IsRunning() {
+			stale = append(stale, sess)
+		}
+	}
+	return stale
+}
+
+// orphansOf returns the stale sessions whose routes overlap cidrs: what
+// they installed may still be in the way
+func orphansOf(stale []*session.Session, cidrs []string) []*session.Session {
+	var orphans []*session.Session
+	for _, sess := range stale {
+		if overlapsAny(sessionRoutes(sess), cidrs) {
+			orphans = append(orphans, sess)
+		}
+	}
+	return orphans
+}
+
+// sessionRoutes returns the routes a session installed
+func sessionRoutes(sess *session.Session) []string {
+	if len(sess.Routes) > 0 {
+		return sess.Routes
+	}
+	return sess.CIDRBlocks
+}
+
+// overlapsAny reports whether a CIDR block of a overlaps one of b
+func overlapsAny(a, b []string) bool {
+	for _, x := range a {
+		px, err := netip.ParsePrefix(x)
+		if err != nil {
+			continue
+		}
+		for _, y := range b {
+			if py, err := netip.ParsePrefix(y); err == nil && px.Overlaps(py) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adoptRoutes retries the routes that could not be added because a route
+// of an orphaned session was in the way, replacing it with ours (with
+// --adopt) and verifying that traffic goes to the interface. Without
+// --adopt it explains how to take them over instead.
+func adoptRoutes(ctx context.Context, router *routing.Router, results routing.RouteResults, iface string, orphans []*session.Session) error {
+	var owners []string
+	for i, result := range results {
+		owner := routeOwner(orphans, result.CIDR)
+		if result.Err == nil || !errors.Is(result.Err, routing.ErrRouteExists) || owner == "" {
+			continue
+		}
+		if !adoptOrphans {
+			if !slices.Contains(owners, owner) {
+				owners = append(owners, owner)
+			}
+			continue
+		}
+
+		err := router.AdoptRouteContext(ctx, result.CIDR, iface)
+		if err == nil {
+			if ok, verifyErr := router.VerifyRoute(result.CIDR); verifyErr != nil {
+				err = verifyErr
+			} else if !ok {
+				err = fmt.Errorf("adopted route %s does not lead to %s", result.CIDR, iface)
+			}
+		}
+		results[i].Err = err
+		if err == nil {
+			fmt.Printf("  ├─ Adopted route %s of stopped session %s\n", result.CIDR, owner)
+		}
+	}
+
+	if len(owners) > 0 {
+		return fmt.Errorf("routes are left by stopped session(s) %s; use --adopt to take them over", strings.Join(owners, ", "))
+	}
+	return nil
+}
+
+// routeOwner returns the orphaned session that installed a route, "" if
+// none did
+func routeOwner(orphans []*session.Session, cidr string) string {
+	for _, sess := range orphans {
+		if slices.Contains(sessionRoutes(sess), cidr) {
+			return sess.Name
+		}
+	}
+	return ""
+}
+
+// endOrphans ends the orphaned sessions taken over by a session, so that
+// the state store records where their routes went
+func endOrphans(mgr *session.Manager, orphans []*session.Session, name string) {
+	for _, sess := range orphans {
+		if sess.Name == name {
+			continue
+		}
+		if err := mgr.End(sess.Name, "adopted by "+name); err != nil {
+			log.Warnf("Failed to end session %s: %v", sess.Name, err)
+			continue
+		}
+		fmt.Printf("  └─ Took over stopped session %s\n", sess.Name)
+	}
+}
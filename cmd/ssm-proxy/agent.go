@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/spf13/cobra"
+)
+
+// Where and how the agent is installed on instances
+const (
+	agentInstallPath = "/usr/local/bin/ssm-proxy-agent"
+	agentUnitDir     = "/etc/systemd/system"
+	agentEnvFile     = "/etc/default/ssm-proxy-agent"
+
+	// agentStageTemplate is the mktemp template of the directory the
+	// agent is staged in, created for each deploy, and agentStageName the
+	// staged file in it
+	agentStageTemplate = "/run/ssm-proxy-agent.XXXXXXXXXX"
+	agentStageName     = "agent.gz"
+
+	// defaultAgentPort is the loopback port the agent's socket unit listens
+	// on, reached with an SSM port session
+	defaultAgentPort = 7322
+
+	// agentReleaseURL is where the agent binaries of a release are
+	// downloaded from (version, architecture)
+	agentReleaseURL = "https://github.com/sbkg0002/ssm-proxy/releases/download/%s/ssm-proxy-agent-linux-%s"
+
+	// agentChunkSize is the part of the binary sent in one Run Command, as
+	// raw bytes: a multiple of 3, so every chunk is base64 on its own
+	agentChunkSize = 24 * 1024
+
+	// agentCommandTimeout bounds each Run Command of the deployment
+	agentCommandTimeout = 2 * time.Minute
+)
+
+var (
+	agentInstanceID string
+	agentBinary     string
+	agentSource     string
+	agentS3Bucket   string
+	agentPort       int
+	agentNoVerify   bool
+	agentEnv        []string
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Manage ssm-proxy-agent on instances",
+	Long: `Manage ssm-proxy-agent, the remote end of packet tunnels: it runs on the
+instance, forwarding the packets of a session framed with SSMP to a TUN
+device.`,
+}
+
+var agentDeployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Install ssm-proxy-agent on an instance",
+	Long: `Install ssm-proxy-agent on a Linux instance and check that it answers.
+
+The agent binary for the instance's architecture is, in order of
+preference: --agent-binary; built with 'go build' from --source (by
+default the current directory, if it is an ssm-proxy checkout); or
+downloaded from the GitHub release of this version.
+
+It is copied to the instance with SSM Run Command, in chunks, or through
+--s3-bucket (uploaded and downloaded with a presigned URL, using the aws
+CLI locally and curl or wget on the instance), which is faster for slow
+links. It is installed as ` + agentInstallPath + ` with a systemd socket unit,
+ssm-proxy-agent.socket, that starts an agent for every connection to
+127.0.0.1:PORT; SSM port sessions reach it there. --agent-env settings,
+such as SSM_PROXY_AGENT_MTU=1400 for the agent's --mtu, go to
+` + agentEnvFile + `, which is replaced on every deployment.
+
+Finally a port session to the agent sends a ping through its TUN device
+and waits for the reply, framed with SSMP.
+
+The instance needs the SSM Agent, systemd and a TUN device (/dev/net/tun).
+Deploying again replaces the agent; running sessions keep the old one.
+
+Examples:
+  # Download the agent of this release and install it
+  ssm-proxy agent deploy --instance-id i-xxx
+
+  # Use another TUN subnet on the instance
+  ssm-proxy agent deploy --instance-id i-xxx --agent-env SSM_PROXY_AGENT_TUN_ADDR=10.255.255.1/30
+
+  # Install a binary built elsewhere, copied through S3
+  ssm-proxy agent deploy --instance-id i-xxx --agent-binary ./ssm-proxy-agent --s3-bucket my-bucket`,
+	RunE: runAgentDeploy,
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentDeployCmd)
+
+	agentDeployCmd.Flags().StringVar(&agentInstanceID, "instance-id", "", "Instance to install the agent on (required)")
+	agentDeployCmd.Flags().StringVar(&agentBinary, "agent-binary", "", "Agent binary to install (linux, for the instance's architecture)")
+	agentDeployCmd.Flags().StringVar(&agentSource, "source", "", "ssm-proxy source tree to build the agent from (default: the current directory, if it is one)")
+	agentDeployCmd.Flags().StringVar(&agentS3Bucket, "s3-bucket", "", "Copy the agent through this S3 bucket instead of Run Command (needs the aws CLI)")
+	agentDeployCmd.Flags().IntVar(&agentPort, "port", defaultAgentPort, "Loopback port of the agent's socket unit on the instance")
+	agentDeployCmd.Flags().BoolVar(&agentNoVerify, "no-verify", false, "Do not check that the installed agent answers")
+	agentDeployCmd.Flags().StringArrayVar(&agentEnv, "agent-env", nil, "Setting of the agent as NAME=VALUE, e.g. SSM_PROXY_AGENT_LOG_LEVEL=debug (repeatable)")
+	agentDeployCmd.MarkFlagRequired("instance-id")
+}
+
+func runAgentDeploy(cmd *cobra.Command, args []string) error {
+	if agentPort <= 0 || agentPort > 65535 {
+		return fmt.Errorf("invalid --port %d", agentPort)
+	}
+	for _, setting := range agentEnv {
+		name, _, ok := strings.Cut(setting, "=")
+		if !ok || !strings.HasPrefix(name, "SSM_PROXY_AGENT_") || strings.ContainsAny(setting, "\n\r") {
+			return fmt.Errorf("invalid --agent-env %q (expected SSM_PROXY_AGENT_NAME=VALUE)", setting)
+		}
+	}
+	tunAddr, err := agentTUNPrefix(agentEnv)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create AWS client: %w", err)
+	}
+
+	info, err := client.AgentInfo(ctx, agentInstanceID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.PingStatus != "Online" {
+		return fmt.Errorf("the SSM Agent of %s is not online", agentInstanceID)
+	}
+	if info.PlatformType != "Linux" {
+		return fmt.Errorf("%s runs %s; the agent only runs on Linux", agentInstanceID, info.PlatformType)
+	}
+
+	arch, err := instanceGoArch(ctx, client, agentInstanceID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Instance %s: %s %s, linux/%s\n", agentInstanceID, info.PlatformName, info.PlatformVersion, arch)
+
+	binary, origin, err := agentBinaryFor(ctx, arch)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Agent binary: %s (%s)\n", origin, formatBytes(uint64(len(binary))))
+
+	compressed, err := gzipBytes(binary)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(compressed)
+	checksum := hex.EncodeToString(sum[:])
+
+	stageDir, err := createAgentStage(ctx, client)
+	if err != nil {
+		return err
+	}
+	stage := path.Join(stageDir, agentStageName)
+	if agentS3Bucket != "" {
+		err = copyAgentViaS3(ctx, client, stage, compressed, checksum)
+	} else {
+		err = copyAgentViaRunCommand(ctx, client, stage, compressed)
+	}
+	if err != nil {
+		removeAgentStage(client, stageDir)
+		return err
+	}
+
+	// The install script removes the staging directory
+	if _, err := client.RunShellScript(ctx, agentInstanceID, agentInstallScript(stageDir, checksum, agentPort, agentEnv), agentCommandTimeout); err != nil {
+		return fmt.Errorf("failed to install the agent: %w", err)
+	}
+	fmt.Printf("✓ Installed %s\n", agentInstallPath)
+	if len(agentEnv) > 0 {
+		fmt.Printf("  ├─ Settings: %s\n", strings.Join(agentEnv, " "))
+	}
+	fmt.Printf("  └─ ssm-proxy-agent.socket listening on 127.0.0.1:%d\n", agentPort)
+
+	if agentNoVerify {
+		return nil
+	}
+	rtt, err := verifyAgent(ctx, client, agentInstanceID, agentPort, tunAddr)
+	if err != nil {
+		return fmt.Errorf("the agent was installed but does not answer: %w", err)
+	}
+	fmt.Printf("✓ Agent answers over SSMP (ping through its TUN device: %s)\n", rtt.Round(time.Millisecond))
+	return nil
+}
+
+// instanceGoArch returns the Go architecture of an instance, from uname
+func instanceGoArch(ctx context.Context, client *aws.Client, instanceID string) (string, error) {
+	result, err := client.RunShellScript(ctx, instanceID, []string{"uname -m"}, agentCommandTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the architecture of %s: %w", instanceID, err)
+	}
+	switch machine := strings.TrimSpace(result.Stdout); machine {
+	case "x86_64", "amd64":
+		return "amd64", nil
+	case "aarch64", "arm64":
+		return "arm64", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture %q of %s", machine, instanceID)
+	}
+}
+
+// agentBinaryFor returns the agent binary for linux/arch and where it came
+// from: --agent-binary, built from source, or downloaded
+func agentBinaryFor(ctx context.Context, arch string) ([]byte, string, error) {
+	if agentBinary != "" {
+		binary, err := os.ReadFile(agentBinary)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read agent binary: %w", err)
+		}
+		return binary, agentBinary, nil
+	}
+
+	source := agentSource
+	if source == "" {
+		if _, err := os.Stat(filepath.Join("cmd", "ssm-proxy-agent")); err == nil {
+			source = "."
+		}
+	}
+	if source != "" {
+		binary, err := buildAgent(ctx, source, arch)
+		if err != nil {
+			return nil, "", err
+		}
+		return binary, "built from " + source, nil
+	}
+
+	if version == "dev" {
+		return nil, "", fmt.Errorf("development builds have no released agent; use --agent-binary or --source")
+	}
+	url := fmt.Sprintf(agentReleaseURL, version, arch)
+	binary, err := downloadAgent(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	return binary, url, nil
+}
+
+// buildAgent cross-compiles the agent from the source tree at dir
+func buildAgent(ctx context.Context, dir, arch string) ([]byte, error) {
+	out, err := os.CreateTemp("", "ssm-proxy-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	build := exec.CommandContext(ctx, "go", "build", "-trimpath", "-ldflags=-s -w", "-o", out.Name(), "./cmd/ssm-proxy-agent")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0")
+	if output, err := build.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to build the agent: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return os.ReadFile(out.Name())
+}
+
+// downloadAgent downloads a released agent binary and checks it against
+// the checksum published next to it
+func downloadAgent(ctx context.Context, url string) ([]byte, error) {
+	binary, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the agent: %w", err)
+	}
+	checksum, err := httpGet(ctx, url+".sha256")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the agent's checksum: %w", err)
+	}
+
+	fields := strings.Fields(string(checksum))
+	sum := sha256.Sum256(binary)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+		return nil, fmt.Errorf("the downloaded agent does not match its checksum")
+	}
+	return binary, nil
+}
+
+// httpGet returns the body of url
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// gzipBytes compresses data
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress the agent: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress the agent: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// createAgentStage creates the directory the agent is staged in on the
+// instance, readable by root only, and returns its path. A fresh directory
+// keeps other users of the instance from planting or swapping the file
+// root installs.
+func createAgentStage(ctx context.Context, client *aws.Client) (string, error) {
+	result, err := client.RunShellScript(ctx, agentInstanceID, []string{"mktemp -d " + agentStageTemplate}, agentCommandTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the staging directory: %w", err)
+	}
+	dir := strings.TrimSpace(result.Stdout)
+	prefix := strings.TrimRight(agentStageTemplate, "X")
+	if !strings.HasPrefix(dir, prefix) || strings.ContainsAny(dir[len(prefix):], "/ '\"\n") {
+		return "", fmt.Errorf("unexpected staging directory %q from mktemp", dir)
+	}
+	log.Debugf("Staging the agent in %s", dir)
+	return dir, nil
+}
+
+// removeAgentStage removes the staging directory after a failed copy
+func removeAgentStage(client *aws.Client, dir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentCommandTimeout)
+	defer cancel()
+	if _, err := client.RunShellScript(ctx, agentInstanceID, []string{"rm -rf " + dir}, agentCommandTimeout); err != nil {
+		fmt.Printf("⚠️  Failed to remove %s from %s: %v\n", dir, agentInstanceID, err)
+	}
+}
+
+// copyAgentViaRunCommand writes the compressed agent to stage on the
+// instance, a base64 chunk per Run Command
+func copyAgentViaRunCommand(ctx context.Context, client *aws.Client, stage string, data []byte) error {
+	chunks := (len(data) + agentChunkSize - 1) / agentChunkSize
+	fmt.Printf("✓ Copying the agent with Run Command (%d chunks)...\n", chunks)
+
+	for i := 0; i < chunks; i++ {
+		chunk := data[i*agentChunkSize : min((i+1)*agentChunkSize, len(data))]
+		command := fmt.Sprintf("printf '%%s' '%s' | base64 -d >> %s", base64.StdEncoding.EncodeToString(chunk), stage)
+		if _, err := client.RunShellScript(ctx, agentInstanceID, []string{command}, agentCommandTimeout); err != nil {
+			return fmt.Errorf("failed to copy chunk %d of %d: %w", i+1, chunks, err)
+		}
+		log.Debugf("Copied chunk %d of %d", i+1, chunks)
+	}
+	fmt.Printf("  └─ Copied %s\n", formatBytes(uint64(len(data))))
+	return nil
+}
+
+// copyAgentViaS3 uploads the compressed agent to --s3-bucket with the aws
+// CLI and has the instance download it to stage with a presigned URL, so
+// it needs no S3 permissions of its own
+func copyAgentViaS3(ctx context.Context, client *aws.Client, stage string, data []byte, checksum string) error {
+	file, err := os.CreateTemp("", "ssm-proxy-agent-*.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	file.Close()
+
+	env, err := awsCLIEnv(ctx, client)
+	if err != nil {
+		return err
+	}
+	object := fmt.Sprintf("s3://%s/ssm-proxy-agent/%s.gz", agentS3Bucket, checksum)
+	if _, err := runAWSCLI(ctx, env, "s3", "cp", "--only-show-errors", file.Name(), object); err != nil {
+		return fmt.Errorf("failed to upload the agent to %s: %w", object, err)
+	}
+	defer func() {
+		if _, err := runAWSCLI(context.WithoutCancel(ctx), env, "s3", "rm", "--only-show-errors", object); err != nil {
+			fmt.Printf("⚠️  Failed to delete %s: %v\n", object, err)
+		}
+	}()
+	url, err := runAWSCLI(ctx, env, "s3", "presign", object, "--expires-in", "900")
+	if err != nil {
+		return fmt.Errorf("failed to presign %s: %w", object, err)
+	}
+	fmt.Printf("✓ Uploaded the agent to %s\n", object)
+
+	url = strings.TrimSpace(url)
+	command := fmt.Sprintf("curl -fsSL -o %[1]s '%[2]s' || wget -q -O %[1]s '%[2]s'", stage, url)
+	if _, err := client.RunShellScript(ctx, agentInstanceID, []string{command}, agentCommandTimeout); err != nil {
+		return fmt.Errorf("failed to download the agent on the instance: %w", err)
+	}
+	fmt.Println("  └─ Downloaded on the instance")
+	return nil
+}
+
+// awsCLIEnv returns the environment of aws CLI commands, with the
+// credentials and region of the client (e.g. of an assumed role)
+func awsCLIEnv(ctx context.Context, client *aws.Client) ([]string, error) {
+	creds, err := client.Config().Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	env := append(os.Environ(),
+		"AWS_ACCESS_KEY_ID="+creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY="+creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN="+creds.SessionToken,
+		"AWS_REGION="+client.Region(),
+		"AWS_DEFAULT_REGION="+client.Region(),
+	)
+	// A profile would win over the credentials above
+	return slices.DeleteFunc(env, func(kv string) bool {
+		return strings.HasPrefix(kv, "AWS_PROFILE=")
+	}), nil
+}
+
+// runAWSCLI runs the aws CLI and returns its output
+func runAWSCLI(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("aws %s: %s: %w", args[0], strings.TrimSpace(stderr.String()), err)
+	}
+	return string(output), nil
+}
+
+// agentInstallScript checks the agent staged in stageDir, installs it, its
+// settings (env) and its systemd units, and (re)starts the socket unit.
+// The staging directory is removed whether it succeeds or not.
+func agentInstallScript(stageDir, checksum string, port int, env []string) []string {
+	settings := strings.Join(env, "\n")
+	script := fmt.Sprintf(`set -e
+trap 'rm -rf %[8]s' EXIT
+echo '%[1]s  %[2]s' | sha256sum -c -
+gunzip -c %[2]s > %[3]s.new
+chmod 0755 %[3]s.new
+mv -f %[3]s.new %[3]s
+cat > %[6]s <<'EOF'
+%[7]s
+EOF
+cat > %[4]s/ssm-proxy-agent.socket <<'EOF'
+[Unit]
+Description=ssm-proxy agent: packet tunnels of ssm-proxy sessions
+
+[Socket]
+ListenStream=127.0.0.1:%[5]d
+Accept=yes
+
+[Install]
+WantedBy=sockets.target
+EOF
+cat > %[4]s/ssm-proxy-agent@.service <<'EOF'
+[Unit]
+Description=ssm-proxy agent session
+
+[Service]
+EnvironmentFile=-%[6]s
+ExecStart=%[3]s
+StandardInput=socket
+StandardOutput=socket
+StandardError=journal
+EOF
+systemctl daemon-reload
+systemctl enable ssm-proxy-agent.socket
+systemctl restart ssm-proxy-agent.socket`, checksum, path.Join(stageDir, agentStageName), agentInstallPath, agentUnitDir, port, agentEnvFile, settings, stageDir)
+	return strings.Split(script, "\n")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
+)
+
+// defaultAgentTUNAddr is the address of the agent's TUN device unless
+// SSM_PROXY_AGENT_TUN_ADDR says otherwise
+var defaultAgentTUNAddr = netip.MustParsePrefix("169.254.100.1/30")
+
+// agentVerifyTimeout bounds the check that an installed agent answers
+const agentVerifyTimeout = 30 * time.Second
+
+// errNoPingReply is returned by verifyAgent when the session to the agent
+// opened but the ping was not answered, e.g. because the agent uses
+// another TUN address
+var errNoPingReply = errors.New("no reply to the ping")
+
+// agentTUNPrefix returns the address of the agent's TUN device, given its
+// settings
+func agentTUNPrefix(env []string) (netip.Prefix, error) {
+	prefix := defaultAgentTUNAddr
+	for _, setting := range env {
+		value, ok := strings.CutPrefix(setting, "SSM_PROXY_AGENT_TUN_ADDR=")
+		if !ok {
+			continue
+		}
+		var err error
+		if prefix, err = netip.ParsePrefix(value); err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid SSM_PROXY_AGENT_TUN_ADDR: %w", err)
+		}
+	}
+	return prefix, nil
+}
+
+// agentPeer returns an address of the agent's TUN subnet other than its
+// own, for a ping the instance's kernel answers back through the agent
+func agentPeer(prefix netip.Prefix) (netip.Addr, bool) {
+	if !prefix.Addr().Is4() {
+		return netip.Addr{}, false
+	}
+	subnet := prefix.Masked()
+	for _, peer := range []netip.Addr{prefix.Addr().Next(), prefix.Addr().Prev()} {
+		// Neither the network nor the broadcast address
+		if subnet.Contains(peer) && peer != subnet.Addr() && subnet.Contains(peer.Next()) {
+			return peer, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// verifyAgent connects to the agent at port on the instance with an SSM
+// port session and pings its TUN address, tunAddr, through it. It returns
+// the round trip time of the ping.
+func verifyAgent(ctx context.Context, awsClient *aws.Client, instanceID string, port int, tunAddr netip.Prefix) (time.Duration, error) {
+	peer, ok := agentPeer(tunAddr)
+	if !ok {
+		return 0, fmt.Errorf("cannot ping through TUN address %s (needs an IPv4 subnet with room for a peer; use --no-verify)", tunAddr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, agentVerifyTimeout)
+	defer cancel()
+
+	client, err := ssm.NewClient(ctx, awsClient, instanceID)
+	if err != nil {
+		return 0, err
+	}
+	session, err := client.StartPortSession(ctx, port)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	reader := ssmp.NewReader(session.Reader())
+	writer := ssmp.NewWriter()
+	writer.Negotiate(reader)
+
+	id := uint16(time.Now().UnixNano())
+	sent := time.Now()
+	if _, err := session.Write(writer.Frame(icmpEchoRequest(peer, tunAddr.Addr(), id))); err != nil {
+		return 0, fmt.Errorf("failed to send ping: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	session.SetReadDeadline(deadline)
+	for {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			if errors.Is(err, ssmp.ErrLegacyFraming) {
+				return 0, err
+			}
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("%w within %s", errNoPingReply, agentVerifyTimeout)
+			}
+			return 0, fmt.Errorf("failed to read from the agent: %w", err)
+		}
+		if isEchoReply(packet, tunAddr.Addr(), id) {
+			return time.Since(sent), nil
+		}
+	}
+}
+
+// icmpEchoRequest builds an IPv4 ICMP echo request from src to dst
+func icmpEchoRequest(src, dst netip.Addr, id uint16) []byte {
+	packet := make([]byte, 20+8+16)
+	packet[0] = 0x45 // IPv4, 20-byte header
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64 // TTL
+	packet[9] = 1  // ICMP
+	src4, dst4 := src.As4(), dst.As4()
+	copy(packet[12:16], src4[:])
+	copy(packet[16:20], dst4[:])
+	binary.BigEndian.PutUint16(packet[10:], inetChecksum(packet[:20]))
+
+	icmp := packet[20:]
+	icmp[0] = 8 // echo request
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[6:], 1)
+	copy(icmp[8:], "ssm-proxy-agent?")
+	binary.BigEndian.PutUint16(icmp[2:], inetChecksum(icmp))
+	return packet
+}
+
+// isEchoReply reports whether packet is the ICMP echo reply from src to
+// the request with id
+func isEchoReply(packet []byte, src netip.Addr, id uint16) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 1 {
+		return false
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	if len(packet) < headerLen+8 || netip.AddrFrom4([4]byte(packet[12:16])) != src {
+		return false
+	}
+	icmp := packet[headerLen:]
+	return icmp[0] == 0 && binary.BigEndian.Uint16(icmp[4:]) == id
+}
+
+// inetChecksum computes the Internet checksum of data (RFC 1071)
+func inetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + sum>>16
+	}
+	return ^uint16(sum)
+}
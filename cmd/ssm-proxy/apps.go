@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/procinfo"
+)
+
+var (
+	// onlyApps is --only-app: the applications whose traffic goes through
+	// the tunnel
+	onlyApps []string
+	// selectedApps is parsed from it, nil without --only-app
+	selectedApps *procinfo.Apps
+)
+
+// appSelector selects the flows of the applications: those whose socket
+// one of them owns. Flows whose socket is gone already are left out.
+func appSelector(apps *procinfo.Apps) forwarder.FlowSelector {
+	return func(protocol string, src, dst netip.AddrPort) bool {
+		owner, err := procinfo.Owner(protocol, src, dst)
+		if err != nil {
+			log.Debugf("No owner of %s flow %s -> %s, bypassing the tunnel: %v", protocol, src, dst, err)
+			return false
+		}
+		if !apps.Match(owner) {
+			log.Debugf("%s flow %s -> %s of %s bypasses the tunnel", protocol, src, dst, owner)
+			return false
+		}
+		log.Debugf("%s flow %s -> %s of %s goes through the tunnel", protocol, src, dst, owner)
+		return true
+	}
+}
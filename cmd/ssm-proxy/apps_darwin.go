@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"golang.org/x/sys/unix"
+)
+
+// appRoutingSupported tells whether --only-app works on this platform
+const appRoutingSupported = true
+
+// uplinkTTL is how long the interface of the default route is cached for
+// direct connections; a network change is picked up after it
+const uplinkTTL = 10 * time.Second
+
+// uplink caches the interface of the default routes
+var uplink struct {
+	mu      sync.Mutex
+	index   map[bool]int // by IPv6
+	checked map[bool]time.Time
+}
+
+// uplinkIndex returns the index of the interface of the IPv4 or IPv6
+// default route (0 if there is none)
+func uplinkIndex(ipv6 bool) int {
+	uplink.mu.Lock()
+	defer uplink.mu.Unlock()
+	if uplink.index == nil {
+		uplink.index = make(map[bool]int)
+		uplink.checked = make(map[bool]time.Time)
+	}
+	if time.Since(uplink.checked[ipv6]) < uplinkTTL {
+		return uplink.index[ipv6]
+	}
+
+	uplink.index[ipv6] = 0
+	uplink.checked[ipv6] = time.Now()
+	hop, err := routing.DefaultNextHop(ipv6)
+	if err != nil {
+		log.Debugf("No default route for direct connections (IPv6 %t): %v", ipv6, err)
+		return 0
+	}
+	iface, err := net.InterfaceByName(hop.Interface)
+	if err != nil {
+		log.Debugf("Failed to look up interface %s: %v", hop.Interface, err)
+		return 0
+	}
+	uplink.index[ipv6] = iface.Index
+	return iface.Index
+}
+
+// directDialer returns a dialer for the connections of other applications
+// than those of --only-app. Its sockets are bound to the interface of the
+// default route, so the routes to the tunnel do not apply to them.
+func directDialer() forwarder.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			ipv6 := strings.HasSuffix(network, "6")
+			index := uplinkIndex(ipv6)
+			if index == 0 {
+				// Unbound, the connection would be routed into the tunnel
+				return errors.New("no default route for direct connections")
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if ipv6 {
+					sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, index)
+				} else {
+					sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, index)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "github.com/sbkg0002/ssm-proxy/internal/forwarder"
+
+// appRoutingSupported tells whether --only-app works on this platform
+const appRoutingSupported = false
+
+// directDialer is not needed: Linux has no --only-app
+func directDialer() forwarder.Dialer {
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/user"
+
+	"github.com/sbkg0002/ssm-proxy/internal/audit"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+)
+
+// auditLogPath is --audit-log: the file every connection relayed through
+// the tunnels is logged to
+var auditLogPath string
+
+// auditLog is the audit log shared by the tunnels of the process, nil
+// without --audit-log
+var auditLog *audit.Log
+
+// auditUser returns the local user a session is logged under: the one who
+// ran sudo, else the one running the process
+func auditUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// auditFlows returns the function logging the connections of the session
+// name to the audit log; instanceID returns the instance it goes through
+// (which --failover may change)
+func auditFlows(name string, instanceID func() string) func(forwarder.Flow) {
+	username := auditUser()
+	return func(f forwarder.Flow) {
+		auditLog.Write(audit.Entry{
+			Time:       f.Ended,
+			Started:    f.Started,
+			DurationMS: f.Ended.Sub(f.Started).Milliseconds(),
+			User:       username,
+			Session:    name,
+			InstanceID: instanceID(),
+			Protocol:   f.Protocol,
+			Src:        f.Src,
+			Dst:        f.Dst,
+			Host:       f.Host,
+			BytesTX:    f.BytesTX,
+			BytesRX:    f.BytesRX,
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// discoverVPCCIDRs returns the CIDR blocks of the instance's VPC in the
+// account (and of
+// any of its subnets outside them) for --auto-cidr. IPv6 blocks are left
+// out if the TUN device cannot carry IPv6 (--mtu below 1280).
+func discoverVPCCIDRs(ctx context.Context, account awsAccount, instanceID string) ([]string, error) {
+	fmt.Println("✓ Discovering VPC CIDR blocks...")
+
+	awsClient, err := account.client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+	instance, err := awsClient.GetInstance(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find instance: %w", err)
+	}
+	if instance.VpcID == "" {
+		return nil, fmt.Errorf("instance %s is not in a VPC", instanceID)
+	}
+
+	vpc, err := awsClient.GetVPC(ctx, instance.VpcID)
+	if err != nil {
+		return nil, err
+	}
+	cidrs := vpc.CIDRBlocks
+
+	// Subnets lie within the VPC's blocks; DescribeSubnets only adds
+	// detail, so failing it is not fatal
+	subnets, err := awsClient.ListSubnets(ctx, vpc.VpcID)
+	if err != nil {
+		log.Warnf("Failed to list subnets of %s: %v", vpc.VpcID, err)
+	}
+	for _, subnet := range subnets {
+		for _, cidr := range append([]string{subnet.CIDRBlock}, subnet.IPv6CIDRBlocks...) {
+			if cidr != "" && !coveredBy(cidr, cidrs) {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+
+	var usable []string
+	for _, cidr := range cidrs {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil && mtu < 1280 {
+			fmt.Printf("  ⚠️  Skipping %s (IPv6 needs --mtu 1280 or more)\n", cidr)
+			continue
+		}
+		usable = append(usable, cidr)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("VPC %s has no usable CIDR blocks", vpc.VpcID)
+	}
+
+	fmt.Printf("  ├─ VPC: %s (%d subnets)\n", vpc.VpcID, len(subnets))
+	for i, cidr := range usable {
+		prefix := "├─"
+		if i == len(usable)-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("  %s %s\n", prefix, cidr)
+	}
+	return usable, nil
+}
+
+// coveredBy reports whether cidr lies within one of the blocks
+func coveredBy(cidr string, blocks []string) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	for _, block := range blocks {
+		b, err := netip.ParsePrefix(block)
+		if err == nil && b.Bits() <= prefix.Bits() && b.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeCIDRs appends the CIDR blocks not already covered to cidrs
+func mergeCIDRs(cidrs, more []string) []string {
+	merged := slices.Clone(cidrs)
+	for _, cidr := range more {
+		if !coveredBy(cidr, merged) {
+			merged = append(merged, cidr)
+		}
+	}
+	return merged
+}
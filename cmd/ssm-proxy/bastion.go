@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+)
+
+// On-demand bastion (--launch-bastion)
+var (
+	launchBastion        bool
+	bastionSubnetID      string
+	bastionProfile       string
+	bastionInstanceType  string
+	bastionImageID       string
+	bastionSecurityGroup []string
+	bastionOnExit        string
+	bastionTimeout       time.Duration
+)
+
+// What happens to an on-demand bastion when the session ends
+// (--bastion-on-exit)
+const (
+	bastionTerminate = "terminate"
+	bastionStop      = "stop" // started again by the next --launch-bastion in the subnet
+)
+
+// bastionPollInterval is how often the SSM registration of a new bastion
+// is checked
+const bastionPollInterval = 5 * time.Second
+
+// bastionReleaseTimeout bounds stopping or terminating the bastion on exit
+const bastionReleaseTimeout = 30 * time.Second
+
+// validateBastionFlags checks the --launch-bastion flags
+func validateBastionFlags() error {
+	if !launchBastion {
+		return nil
+	}
+	if instanceID != "" || instanceTag != "" || len(tunnelFlags) > 0 || fromPrewarm != "" {
+		return fmt.Errorf("--launch-bastion cannot be combined with --instance-id, --instance-tag, --tunnel or --from-prewarm")
+	}
+	if failoverEnabled || standbyInstanceID != "" {
+		return fmt.Errorf("--launch-bastion cannot be combined with --failover or --standby-instance-id")
+	}
+	if bastionSubnetID == "" || bastionProfile == "" {
+		return fmt.Errorf("--launch-bastion needs --subnet-id and --instance-profile")
+	}
+	switch bastionOnExit {
+	case bastionTerminate, bastionStop:
+	default:
+		return fmt.Errorf("invalid --bastion-on-exit %q (expected terminate or stop)", bastionOnExit)
+	}
+	return nil
+}
+
+// onDemandBastion is an instance started for the session
+type onDemandBastion struct {
+	client     *aws.Client
+	instanceID string
+}
+
+// startBastion starts the bastion stopped in the subnet by an earlier
+// session with --bastion-on-exit stop, or else launches one, and waits for
+// its SSM Agent to come online. The instance is released (per
+// --bastion-on-exit) if it does not.
+func startBastion(ctx context.Context) (*onDemandBastion, error) {
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+
+	bastion := &onDemandBastion{client: client}
+	stopped, err := client.FindStoppedBastion(ctx, bastionSubnetID)
+	if err != nil {
+		return nil, err
+	}
+	if stopped != nil {
+		fmt.Printf("✓ Starting stopped bastion %s in %s...\n", stopped.InstanceID, bastionSubnetID)
+		if err := client.StartInstance(ctx, stopped.InstanceID); err != nil {
+			return nil, err
+		}
+		bastion.instanceID = stopped.InstanceID
+	} else {
+		fmt.Printf("✓ Launching bastion in %s...\n", bastionSubnetID)
+		id, err := client.LaunchBastion(ctx, aws.BastionConfig{
+			SubnetID:        bastionSubnetID,
+			InstanceProfile: bastionProfile,
+			InstanceType:    bastionInstanceType,
+			ImageID:         bastionImageID,
+			SecurityGroups:  bastionSecurityGroup,
+		})
+		if err != nil {
+			return nil, err
+		}
+		bastion.instanceID = id
+	}
+	fmt.Printf("  ├─ Instance: %s\n", bastion.instanceID)
+
+	fmt.Printf("  ├─ Waiting for the SSM Agent (up to %s)...\n", bastionTimeout)
+	started := time.Now()
+	if _, err := client.WaitForSSM(ctx, bastion.instanceID, bastionTimeout, bastionPollInterval); err != nil {
+		if releaseErr := bastion.release(); releaseErr != nil {
+			log.Warnf("Failed to release bastion %s: %v", bastion.instanceID, releaseErr)
+		}
+		return nil, err
+	}
+	fmt.Printf("  └─ SSM Agent online after %s ✓\n", time.Since(started).Round(time.Second))
+	return bastion, nil
+}
+
+// release stops or terminates the bastion, per --bastion-on-exit
+func (b *onDemandBastion) release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), bastionReleaseTimeout)
+	defer cancel()
+
+	if bastionOnExit == bastionStop {
+		fmt.Printf("✓ Stopping bastion %s\n", b.instanceID)
+		return b.client.StopInstance(ctx, b.instanceID)
+	}
+	fmt.Printf("✓ Terminating bastion %s\n", b.instanceID)
+	return b.client.TerminateInstance(ctx, b.instanceID)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+)
+
+// endpointRecheckInterval is how often the AWS endpoints are resolved
+// again, to follow their addresses as they change
+const endpointRecheckInterval = time.Minute
+
+// endpointBypass keeps the AWS API endpoints ssm-proxy itself calls
+// reachable when the tunnel's routes cover their addresses, e.g. VPC
+// interface endpoints inside a routed VPC or a very wide --cidr. Without it
+// the SSM data channel and credential refreshes would be sent into the
+// tunnel they carry. Each covered address gets a host route via the next
+// hop it had before the tunnel's routes were added.
+type endpointBypass struct {
+	router *routing.Router
+	hosts  []string
+	cidrs  []netip.Prefix
+
+	hops   map[netip.Addr]routing.NextHop // next hop before our routes
+	uplink map[bool]routing.NextHop       // by IPv6, for addresses seen later
+
+	mu     sync.Mutex
+	routes map[string]string // bypass route -> endpoint host
+}
+
+// newEndpointBypass resolves the AWS endpoints of the account's region and
+// records how they are reached. Must be called before the tunnel's routes
+// are added.
+func newEndpointBypass(ctx context.Context, account awsAccount, router *routing.Router, cidrs []string) (*endpointBypass, error) {
+	awsClient, err := account.client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+	hosts, err := awsClient.EndpointHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &endpointBypass{
+		router: router,
+		hosts:  hosts,
+		hops:   make(map[netip.Addr]routing.NextHop),
+		uplink: make(map[bool]routing.NextHop),
+		routes: make(map[string]string),
+	}
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			b.cidrs = append(b.cidrs, prefix.Masked())
+		}
+	}
+
+	addrs, _ := b.resolve(ctx)
+	for addr := range addrs {
+		hop, err := routing.RouteNextHop(addr.String())
+		if err != nil {
+			log.Debugf("No route to AWS endpoint address %s: %v", addr, err)
+			continue
+		}
+		b.hops[addr] = hop
+		if _, ok := b.uplink[addr.Is6()]; !ok {
+			b.uplink[addr.Is6()] = hop
+		}
+	}
+	return b, nil
+}
+
+// resolve returns the current addresses of the endpoints, with the host
+// each belongs to, and the hosts that could not be resolved
+func (b *endpointBypass) resolve(ctx context.Context) (map[netip.Addr]string, map[string]bool) {
+	addrs := make(map[netip.Addr]string)
+	failed := make(map[string]bool)
+	for _, host := range b.hosts {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			log.Debugf("Failed to resolve AWS endpoint %s: %v", host, err)
+			failed[host] = true
+			continue
+		}
+		for _, ip := range ips {
+			addrs[ip.Unmap()] = host
+		}
+	}
+	return addrs, failed
+}
+
+// setCIDRs changes the tunnel's routes after they were added or removed
+// while running; the next update follows them
+func (b *endpointBypass) setCIDRs(cidrs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cidrs = nil
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			b.cidrs = append(b.cidrs, prefix.Masked())
+		}
+	}
+}
+
+// covered reports whether the tunnel's routes include the address
+func (b *endpointBypass) covered(addr netip.Addr) bool {
+	return slices.ContainsFunc(b.cidrs, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// update resolves the endpoints again, adding bypass routes for new
+// addresses covered by the tunnel's routes and removing the ones of
+// addresses no longer in use. With print set the routes added are listed
+// like the tunnel's.
+func (b *endpointBypass) update(ctx context.Context, print bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addrs, failed := b.resolve(ctx)
+	wanted := make(map[string]string)
+	hops := make(map[string]routing.NextHop)
+	for addr, host := range addrs {
+		if !b.covered(addr) {
+			continue
+		}
+		hop, ok := b.hops[addr]
+		if !ok {
+			if hop, ok = b.uplink[addr.Is6()]; !ok {
+				log.Warnf("AWS endpoint %s (%s) is covered by the tunnel's routes, but no route outside it is known", host, addr)
+				continue
+			}
+		}
+		route := netip.PrefixFrom(addr, addr.BitLen()).String()
+		wanted[route] = host
+		hops[route] = hop
+	}
+
+	// A failed lookup keeps the host's routes until it resolves again
+	for route, host := range b.routes {
+		if _, ok := wanted[route]; ok || failed[host] {
+			continue
+		}
+		if err := b.router.DeleteBypassRoute(ctx, route); err != nil {
+			log.Warnf("Failed to remove bypass route %s for %s: %v", route, host, err)
+			continue
+		}
+		log.Infof("Removed bypass route %s for %s (address no longer in use)", route, host)
+		delete(b.routes, route)
+	}
+
+	for _, route := range slices.Sorted(maps.Keys(wanted)) {
+		if _, ok := b.routes[route]; ok || ctx.Err() != nil {
+			continue
+		}
+		host, hop := wanted[route], hops[route]
+		if err := b.router.AddBypassRoute(ctx, route, hop); err != nil {
+			if print {
+				fmt.Printf("  └─ %s ✗ %v\n", route, err)
+			}
+			log.Warnf("Failed to route AWS endpoint %s around the tunnel: %v", host, err)
+			continue
+		}
+		b.routes[route] = host
+		if print {
+			fmt.Printf("  └─ %s → %s (bypass for %s)\n", route, hop, host)
+		} else {
+			log.Infof("Added bypass route %s → %s for %s", route, hop, host)
+		}
+	}
+}
+
+// moveUplink records that what was reached via one next hop now is via
+// another, e.g. after a network change, for the routes added from now on.
+// The routes already added are moved by the router.
+func (b *endpointBypass) moveUplink(from, to routing.NextHop) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for addr, hop := range b.hops {
+		if hop == from {
+			b.hops[addr] = to
+		}
+	}
+	for ipv6, hop := range b.uplink {
+		if hop == from {
+			b.uplink[ipv6] = to
+		}
+	}
+}
+
+// watch re-resolves the endpoints every interval until ctx is done
+func (b *endpointBypass) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.update(ctx, false)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sbkg0002/ssm-proxy/internal/chaos"
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/spf13/cobra"
+)
+
+// chaosSpec is the fault injection of 'start --chaos' (hidden, for
+// testing) and chaosConfig its parsed form
+var (
+	chaosSpec   string
+	chaosConfig *chaos.Config
+)
+
+// chaosSession is the session 'chaos' changes
+var chaosSession string
+
+var chaosCmd = &cobra.Command{
+	Use:    "chaos [SPEC]",
+	Short:  "Show or change the fault injection of a session started with --chaos",
+	Hidden: true,
+	Long: `Show or change the faults injected into a running session that was
+started with the hidden --chaos option, for testing reconnection, TCP
+handling and applications under adverse conditions.
+
+SPEC is a comma-separated list of:
+  latency=DURATION    delay packets back from the tunnel (every round trip)
+  jitter=DURATION     vary the latency by up to this much
+  loss=PERCENT        drop packets in each direction (e.g. 5% or 0.05)
+  disconnect=DURATION drop the transport at random, this often on average
+or "none".
+
+Examples:
+  sudo -E ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/16 --chaos latency=200ms,loss=1%
+  sudo ssm-proxy chaos latency=500ms,jitter=100ms,disconnect=5m
+  sudo ssm-proxy chaos none`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runChaos,
+}
+
+func init() {
+	rootCmd.AddCommand(chaosCmd)
+
+	chaosCmd.Flags().StringVar(&chaosSession, "session-name", "", "Session to change (default: the most recent one)")
+}
+
+// chaosParams are the parameters of the chaos control method
+type chaosParams struct {
+	Spec string `json:"spec,omitempty"`
+}
+
+// chaosResult is the result of the chaos control method
+type chaosResult struct {
+	Chaos string `json:"chaos"`
+}
+
+func runChaos(cmd *cobra.Command, args []string) error {
+	var params chaosParams
+	if len(args) == 1 {
+		// Checked here for a better error than the session's
+		if _, err := chaos.ParseConfig(args[0]); err != nil {
+			return err
+		}
+		params.Spec = args[0]
+	}
+
+	name, err := runningSession(chaosSession)
+	if err != nil {
+		return err
+	}
+
+	var result chaosResult
+	if err := control.Call(control.SocketPath(name), control.MethodChaos, "", params, &result); err != nil {
+		return fmt.Errorf("session %s: %w", name, err)
+	}
+	fmt.Printf("✓ Session %s: injecting %s\n", name, result.Chaos)
+	return nil
+}
+
+// startChaos wraps device with the faults of --chaos and starts the
+// transport disconnects, until ctx is done. Without --chaos device is
+// returned as is, with a nil injector.
+func startChaos(ctx context.Context, device forwarder.Device, t socksTunnel) (forwarder.Device, *chaos.Injector) {
+	if chaosConfig == nil {
+		return device, nil
+	}
+
+	injector := chaos.NewInjector(*chaosConfig)
+	fmt.Printf("⚠️  Injecting faults for testing: %s\n", injector.Config())
+
+	disconnecter, ok := t.(interface{ Disconnect() error })
+	if ok {
+		go injector.RunDisconnects(ctx, disconnecter.Disconnect)
+	} else if chaosConfig.Disconnect > 0 {
+		log.Warn("Chaos: this transport cannot be disconnected, disconnect is ignored")
+	}
+	return injector.Device(ctx, device), injector
+}
+
+// handleChaos registers the control method changing an injector's faults
+func handleChaos(server *control.Server, injector *chaos.Injector) {
+	server.Handle(control.MethodChaos, control.ClassSessionAdmin, func(raw json.RawMessage) (any, error) {
+		var params chaosParams
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, fmt.Errorf("invalid params: %w", err)
+			}
+		}
+		if params.Spec != "" {
+			config, err := chaos.ParseConfig(params.Spec)
+			if err != nil {
+				return nil, err
+			}
+			injector.Set(config)
+		}
+		return &chaosResult{Chaos: injector.Config().String()}, nil
+	})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ciSessionName string
+	ciLogFile     string
+	ciWaitTimeout time.Duration
+	ciMaxLifetime time.Duration
+	ciStopForce   bool
+)
+
+// ciLogTailLines is how many log lines are shown when a CI session fails
+const ciLogTailLines = 50
+
+var ciCmd = &cobra.Command{
+	Use:   "ci",
+	Short: "Start and stop the proxy in CI jobs (GitHub Actions)",
+	Long: `Lifecycle helpers for using ssm-proxy inside CI jobs.
+
+'ci start' launches a headless proxy session in the background, waits until
+the tunnel is up and publishes the session details to later steps. 'ci stop'
+tears it down again and should run even if the job failed or was cancelled.
+
+On GitHub Actions, output is grouped with ::group:: and failures are reported
+as ::error:: annotations. The session name, SOCKS5 address, TUN device and
+log file are written to GITHUB_OUTPUT (session-name, socks-address,
+tun-device, log-file) and GITHUB_ENV (SSM_PROXY_SESSION, SSM_PROXY_SOCKS_ADDR,
+SSM_PROXY_LOG_FILE).
+
+Example workflow:
+  - name: Open tunnel
+    id: proxy
+    run: sudo -E ssm-proxy ci start -- --instance-id i-xxx --cidr 10.0.0.0/16
+
+  - run: psql -h 10.0.1.5 -c 'select 1'
+
+  - name: Close tunnel
+    if: always()
+    run: sudo -E ssm-proxy ci stop`,
+}
+
+var ciStartCmd = &cobra.Command{
+	Use:   "start [-- START_FLAGS...]",
+	Short: "Start a background proxy session and wait until it is ready",
+	Long: `Start a headless proxy session in the background and wait until the tunnel
+is up. Flags after "--" are passed to 'ssm-proxy start'.
+
+The session runs detached from the job step and shuts down cleanly on
+SIGINT, SIGTERM or SIGHUP (as sent when a job is cancelled), and on its own
+after --max-lifetime so that an abandoned tunnel never outlives the job.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		requireRoot()
+
+		for _, arg := range args {
+			name, _, _ := strings.Cut(arg, "=")
+			switch name {
+			case "--session-name", "--daemon", "-d", "--headless", "--max-lifetime":
+				return fmt.Errorf("%s is managed by 'ci start' and cannot be passed to start", name)
+			}
+		}
+
+		if ciSessionName == "" {
+			ciSessionName = defaultCISessionName()
+		}
+		return session.ValidateName(ciSessionName)
+	},
+	RunE: runCIStart,
+}
+
+var ciStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the session started by 'ci start'",
+	Long: `Stop the session started by 'ci start' (from --session-name or
+$SSM_PROXY_SESSION) and remove its routes. Stopping a session that does not
+exist or has already ended is not an error, so this is safe to run in an
+'if: always()' step.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		requireRoot()
+		return nil
+	},
+	RunE: runCIStop,
+}
+
+func init() {
+	rootCmd.AddCommand(ciCmd)
+	ciCmd.AddCommand(ciStartCmd)
+	ciCmd.AddCommand(ciStopCmd)
+
+	ciStartCmd.Flags().StringVar(&ciSessionName, "session-name", "", "Session name (default: derived from the GitHub run and job)")
+	ciStartCmd.Flags().StringVar(&ciLogFile, "log-file", "", "Log file of the background session (default: $RUNNER_TEMP/ssm-proxy-<session>.log)")
+	ciStartCmd.Flags().DurationVar(&ciWaitTimeout, "wait-timeout", 2*time.Minute, "Maximum time to wait for the tunnel to come up")
+	ciStartCmd.Flags().DurationVar(&ciMaxLifetime, "max-lifetime", 6*time.Hour, "Stop the session automatically after this duration")
+
+	ciStopCmd.Flags().StringVar(&ciSessionName, "session-name", "", "Session to stop (default: $SSM_PROXY_SESSION)")
+	ciStopCmd.Flags().BoolVar(&ciStopForce, "force", false, "Kill the session immediately instead of shutting down gracefully")
+}
+
+func runCIStart(cmd *cobra.Command, args []string) error {
+	logFile := ciLogFile
+	if logFile == "" {
+		dir := os.Getenv("RUNNER_TEMP")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		logFile = filepath.Join(dir, fmt.Sprintf("ssm-proxy-%s.log", ciSessionName))
+	}
+
+	ghGroup(fmt.Sprintf("Starting ssm-proxy session %s", ciSessionName))
+
+	child, err := spawnCISession(args, logFile)
+	if err != nil {
+		ghEndGroup()
+		return ciFail(fmt.Sprintf("failed to start ssm-proxy: %v", err), "")
+	}
+	fmt.Printf("✓ Started background session (pid %d)\n", child.Process.Pid)
+	fmt.Printf("  └─ Log: %s\n", logFile)
+
+	sess, err := waitForCISession(child, ciSessionName, ciWaitTimeout)
+	if err != nil {
+		// Make sure a half-started session cleans up after itself
+		child.Process.Signal(syscall.SIGTERM)
+		ghEndGroup()
+		return ciFail(err.Error(), logFile)
+	}
+	child.Process.Release()
+
+	fmt.Println("✓ Tunnel is up")
+	fmt.Printf("  ├─ Session: %s\n", sess.Name)
+	fmt.Printf("  ├─ Device: %s\n", sess.TunDevice)
+	fmt.Printf("  ├─ SOCKS5: %s\n", sess.SOCKSAddr)
+	fmt.Printf("  └─ Routes: %s\n", strings.Join(sess.InstalledRoutes(), ", "))
+
+	outputs := [][2]string{
+		{"session-name", sess.Name},
+		{"socks-address", sess.SOCKSAddr},
+		{"tun-device", sess.TunDevice},
+		{"log-file", logFile},
+	}
+	for _, kv := range outputs {
+		if err := ghWriteFile("GITHUB_OUTPUT", kv[0], kv[1]); err != nil {
+			log.Warnf("Failed to write step output %s: %v", kv[0], err)
+		}
+	}
+
+	env := [][2]string{
+		{"SSM_PROXY_SESSION", sess.Name},
+		{"SSM_PROXY_SOCKS_ADDR", sess.SOCKSAddr},
+		{"SSM_PROXY_LOG_FILE", logFile},
+	}
+	for _, kv := range env {
+		if err := ghWriteFile("GITHUB_ENV", kv[0], kv[1]); err != nil {
+			log.Warnf("Failed to export %s: %v", kv[0], err)
+		}
+	}
+
+	ghEndGroup()
+	return nil
+}
+
+// spawnCISession launches 'ssm-proxy start --headless' detached from the
+// current process group, logging to logFile
+func spawnCISession(startArgs []string, logFile string) (*exec.Cmd, error) {
+	childArgs := append(globalFlagArgs(),
+		"start",
+		"--headless",
+		"--headless-timeout", ciWaitTimeout.String(),
+		"--session-name", ciSessionName,
+		"--max-lifetime", ciMaxLifetime.String(),
+	)
+	childArgs = append(childArgs, startArgs...)
+
+	return spawnDetached(childArgs, logFile)
+}
+
+// waitForCISession waits until the child has registered the session and
+// reported the tunnel as up, the child exits, or the timeout elapses
+func waitForCISession(child *exec.Cmd, name string, timeout time.Duration) (*session.Session, error) {
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	// The child enforces the same timeout itself; allow it time to clean up
+	deadline := time.After(timeout + 15*time.Second)
+
+	for {
+		select {
+		case err := <-exited:
+			if err != nil {
+				return nil, fmt.Errorf("ssm-proxy exited before the tunnel was up: %v", err)
+			}
+			return nil, fmt.Errorf("ssm-proxy exited before the tunnel was up")
+		case <-deadline:
+			return nil, fmt.Errorf("tunnel was not up within %s", timeout)
+		case <-ticker.C:
+			sess, err := sessionMgr.Get(name)
+			if err != nil || sess.PID != child.Process.Pid {
+				continue
+			}
+			if sess.TunnelUp && sess.TunDevice != "" {
+				return sess, nil
+			}
+		}
+	}
+}
+
+func runCIStop(cmd *cobra.Command, args []string) error {
+	name := ciSessionName
+	if name == "" {
+		name = os.Getenv("SSM_PROXY_SESSION")
+	}
+	if name == "" {
+		ghWarning("no ssm-proxy session to stop (use --session-name or set SSM_PROXY_SESSION)")
+		return nil
+	}
+
+	ghGroup(fmt.Sprintf("Stopping ssm-proxy session %s", name))
+	defer ghEndGroup()
+
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+
+	sess, err := sessionMgr.Get(name)
+	if err != nil {
+		fmt.Printf("Session %s is not active, nothing to stop\n", name)
+		return nil
+	}
+
+	if err := stopSession(sess, ciStopForce); err != nil {
+		ghError(fmt.Sprintf("failed to stop session %s: %v", name, err))
+	}
+
+	if !waitForExit(sess, 15*time.Second) {
+		log.Warnf("Session %s (pid %d) did not exit in time, killing it", name, sess.PID)
+		stopSession(sess, true)
+	}
+
+	if err := sessionMgr.Remove(name); err != nil {
+		log.Warnf("Failed to remove session state: %v", err)
+	}
+
+	fmt.Printf("✓ Session %s stopped\n", name)
+
+	if logFile := os.Getenv("SSM_PROXY_LOG_FILE"); logFile != "" {
+		ghEndGroup()
+		ghGroup("ssm-proxy log")
+		printLogTail(logFile, 0)
+	}
+
+	return nil
+}
+
+// ciFail reports a failure as a GitHub annotation, shows the end of the
+// session log and returns an error that exits non-zero without repeating it
+func ciFail(message, logFile string) error {
+	if logFile != "" {
+		ghGroup("ssm-proxy log")
+		printLogTail(logFile, ciLogTailLines)
+		ghEndGroup()
+	}
+	ghError(message)
+	return &exitError{code: 1}
+}
+
+// printLogTail prints the last n lines of a log file (all lines if n is 0)
+func printLogTail(path string, n int) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Debugf("Failed to open log file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if n > 0 && len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+var ciNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// defaultCISessionName derives a session name from the GitHub run, attempt
+// and job so parallel jobs don't collide
+func defaultCISessionName() string {
+	runID := os.Getenv("GITHUB_RUN_ID")
+	if runID == "" {
+		return fmt.Sprintf("ci-%d", time.Now().Unix())
+	}
+
+	name := "ci-" + runID
+	if attempt := os.Getenv("GITHUB_RUN_ATTEMPT"); attempt != "" {
+		name += "-" + attempt
+	}
+	if job := os.Getenv("GITHUB_JOB"); job != "" {
+		name += "-" + job
+	}
+	name = ciNameInvalidChars.ReplaceAllString(name, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// inGitHubActions reports whether we are running inside GitHub Actions
+func inGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// ghGroup starts a collapsible log group
+func ghGroup(title string) {
+	if inGitHubActions() {
+		fmt.Printf("::group::%s\n", ghEscape(title))
+	} else {
+		fmt.Printf("━━━ %s\n", title)
+	}
+}
+
+// ghEndGroup ends the current log group
+func ghEndGroup() {
+	if inGitHubActions() {
+		fmt.Println("::endgroup::")
+	}
+}
+
+// ghError emits an error annotation
+func ghError(message string) {
+	if inGitHubActions() {
+		fmt.Printf("::error title=ssm-proxy::%s\n", ghEscape(message))
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+	}
+}
+
+// ghWarning emits a warning annotation
+func ghWarning(message string) {
+	if inGitHubActions() {
+		fmt.Printf("::warning title=ssm-proxy::%s\n", ghEscape(message))
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+	}
+}
+
+// ghEscape escapes a workflow command value
+func ghEscape(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// ghWriteFile appends key=value to the file named by the given environment
+// variable (GITHUB_OUTPUT or GITHUB_ENV). Outside GitHub Actions the pair is
+// printed instead.
+func ghWriteFile(envVar, key, value string) error {
+	path := os.Getenv(envVar)
+	if path == "" {
+		fmt.Printf("%s=%s\n", key, value)
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s=%s\n", key, value)
+	return err
+}
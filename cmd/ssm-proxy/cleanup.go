@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// cleanupDryRun lists the leftovers without removing them
+var cleanupDryRun bool
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove what sessions that died left behind",
+	Long: `Find and remove what sessions whose process died left behind:
+
+  • ssh processes of their tunnels still running
+  • routes through TUN devices that are gone or no session owns
+  • TUN devices no session owns
+  • /etc/resolver files and their .ssm-proxy-backup backups (macOS)
+  • their session records, and session JSON files of older versions
+
+Running sessions are left alone. TUN devices and routes are skipped while
+a session is starting, and resolver files while any session runs, since
+they cannot be told apart from theirs.
+
+Examples:
+  # See what would be removed
+  ssm-proxy cleanup --dry-run
+
+  # Remove it
+  sudo ssm-proxy cleanup`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if !cleanupDryRun {
+			requireRoot()
+		}
+		return nil
+	},
+	RunE: runCleanup,
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+
+	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "List what would be removed without removing it")
+}
+
+// leftover is something a session that died left behind
+type leftover struct {
+	kind   string
+	name   string
+	remove func() error
+}
+
+// process is an entry of the process table
+type process struct {
+	pid, ppid int
+	args      []string
+}
+
+func runCleanup(cmd *cobra.Command, args []string) error {
+	sessionMgr := session.NewManager()
+	sessions, err := sessionMgr.ListAll()
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	processes, err := listProcesses()
+	if err != nil {
+		return err
+	}
+
+	var running []*session.Session
+	ownDevices := make(map[string]bool)
+	for _, sess := range sessions {
+		if sess.IsRunning() {
+			running = append(running, sess)
+			ownDevices[sess.TunDevice] = true
+		}
+	}
+	// A session still starting up has a TUN device, and maybe routes,
+	// before it is recorded
+	starting := startingSessions(processes, running)
+
+	fmt.Println("✓ Looking for leftovers of sessions that died...")
+	leftovers := lingeringSSH(processes)
+	if starting > 0 {
+		fmt.Printf("  ⚠️  %d session(s) starting, skipping TUN devices and routes\n", starting)
+	} else {
+		devices, err := orphanedDevices(ownDevices)
+		if err != nil {
+			return err
+		}
+		routes, err := orphanedRoutes(devices)
+		if err != nil {
+			return err
+		}
+		leftovers = append(leftovers, routes...)
+		for _, name := range devices {
+			leftovers = append(leftovers, leftover{"TUN device", name, func() error { return tunnel.RemoveDevice(name) }})
+		}
+	}
+	if len(running) > 0 || starting > 0 {
+		fmt.Printf("  ⚠️  %d session(s) running, skipping resolver files\n", len(running)+starting)
+	} else {
+		files, err := dns.LeftoverResolverFiles()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			leftovers = append(leftovers, leftover{"resolver file", file, func() error { return dns.RemoveLeftoverResolverFile(file) }})
+		}
+	}
+	for _, sess := range sessions {
+		if !sess.IsRunning() {
+			leftovers = append(leftovers, leftover{"session", fmt.Sprintf("%s (pid %d)", sess.Name, sess.PID),
+				func() error { return sessionMgr.End(sess.Name, "stale") }})
+		}
+	}
+	for _, file := range sessionMgr.LegacyFiles() {
+		leftovers = append(leftovers, leftover{"session file", file, func() error { return sessionMgr.RemoveLegacyFile(file) }})
+	}
+
+	if len(leftovers) == 0 {
+		fmt.Println("  └─ Nothing to clean up")
+		return nil
+	}
+
+	failed := 0
+	for i, item := range leftovers {
+		branch := "├─"
+		if i == len(leftovers)-1 {
+			branch = "└─"
+		}
+		if cleanupDryRun {
+			fmt.Printf("  %s %s %s\n", branch, item.kind, item.name)
+			continue
+		}
+		if err := item.remove(); err != nil {
+			failed++
+			log.Warnf("Failed to remove %s %s: %v", item.kind, item.name, err)
+			fmt.Printf("  %s ⚠️  %s %s: %v\n", branch, item.kind, item.name, err)
+			continue
+		}
+		fmt.Printf("  %s Removed %s %s\n", branch, item.kind, item.name)
+	}
+
+	switch {
+	case cleanupDryRun:
+		fmt.Printf("\n%d leftover(s) found; run without --dry-run to remove them\n", len(leftovers))
+	case failed > 0:
+		return fmt.Errorf("removed %d of %d leftover(s), %d failed", len(leftovers)-failed, len(leftovers), failed)
+	default:
+		fmt.Printf("\n✓ Removed %d leftover(s)\n", len(leftovers))
+	}
+	return nil
+}
+
+// listProcesses returns the process table
+func listProcesses() ([]process, error) {
+	output, err := exec.Command("ps", "-eo", "pid=,ppid=,args=").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	var processes []process
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		ppid, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil {
+			processes = append(processes, process{pid: pid, ppid: ppid, args: fields[2:]})
+		}
+	}
+	return processes, nil
+}
+
+// isSSMProxy reports whether a process is ssm-proxy, other than this one
+func (p process) isSSMProxy() bool {
+	return p.pid != os.Getpid() && filepath.Base(p.args[0]) == "ssm-proxy"
+}
+
+// startingSessions counts the ssm-proxy start processes that are not
+// (yet) the process of a session
+func startingSessions(processes []process, running []*session.Session) int {
+	n := 0
+	for _, p := range processes {
+		if !p.isSSMProxy() || !slices.Contains(p.args, "start") {
+			continue
+		}
+		if !slices.ContainsFunc(running, func(sess *session.Session) bool { return sess.PID == p.pid }) {
+			n++
+		}
+	}
+	return n
+}
+
+// lingeringSSH returns the ssh processes of ssh transport tunnels whose
+// ssm-proxy process is gone
+func lingeringSSH(processes []process) []leftover {
+	parents := make(map[int]process, len(processes))
+	for _, p := range processes {
+		parents[p.pid] = p
+	}
+
+	var leftovers []leftover
+	for _, p := range processes {
+		if !tunnel.IsSSHProcess(p.args) {
+			continue
+		}
+		if parent, ok := parents[p.ppid]; ok && parent.isSSMProxy() {
+			continue
+		}
+		pid := p.pid
+		name := fmt.Sprintf("%d (%s)", pid, p.args[len(p.args)-1])
+		leftovers = append(leftovers, leftover{"ssh process", name, func() error { return syscall.Kill(pid, syscall.SIGTERM) }})
+	}
+	return leftovers
+}
+
+// orphanedDevices returns the TUN devices that may be ours but that no
+// running session owns
+func orphanedDevices(owned map[string]bool) ([]string, error) {
+	devices, err := tunnel.Devices()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(devices, func(name string) bool { return owned[name] }), nil
+}
+
+// orphanedRoutes returns the routes through orphaned TUN devices, and
+// through devices like ours that no longer exist
+func orphanedRoutes(orphaned []string) ([]leftover, error) {
+	routes, err := routing.SystemRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	var leftovers []leftover
+	for _, route := range routes {
+		iface := route.Interface
+		if !slices.Contains(orphaned, iface) {
+			if !strings.HasPrefix(iface, tunnel.DeviceNamePrefix) {
+				continue
+			}
+			if _, err := net.InterfaceByName(iface); err == nil {
+				continue
+			}
+		}
+		cidr := route.Destination.String()
+		leftovers = append(leftovers, leftover{"route", cidr + " via " + iface, func() error {
+			return routing.DeleteSystemRoute(context.Background(), cidr, iface)
+		}})
+	}
+	return leftovers, nil
+}
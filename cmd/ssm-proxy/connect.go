@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+	"github.com/sbkg0002/ssm-proxy/internal/portforward"
+	"github.com/sbkg0002/ssm-proxy/internal/socks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	connectHost      string
+	connectPort      int
+	connectLocalPort int
+)
+
+// connectClient is a client connect knows: its usual port and the
+// arguments pointing it at a host and port ({host} and {port})
+type connectClient struct {
+	Port int
+	Args []string
+}
+
+// connectClients are the clients connect points at the forwarded port by
+// itself, by executable name
+var connectClients = map[string]connectClient{
+	"psql":              {Port: 5432, Args: []string{"-h", "{host}", "-p", "{port}"}},
+	"pg_dump":           {Port: 5432, Args: []string{"-h", "{host}", "-p", "{port}"}},
+	"pg_restore":        {Port: 5432, Args: []string{"-h", "{host}", "-p", "{port}"}},
+	"mysql":             {Port: 3306, Args: []string{"-h", "{host}", "-P", "{port}", "--protocol=TCP"}},
+	"mysqldump":         {Port: 3306, Args: []string{"-h", "{host}", "-P", "{port}", "--protocol=TCP"}},
+	"mariadb":           {Port: 3306, Args: []string{"-h", "{host}", "-P", "{port}", "--protocol=TCP"}},
+	"redis-cli":         {Port: 6379, Args: []string{"-h", "{host}", "-p", "{port}"}},
+	"valkey-cli":        {Port: 6379, Args: []string{"-h", "{host}", "-p", "{port}"}},
+	"mongosh":           {Port: 27017, Args: []string{"--host", "{host}", "--port", "{port}"}},
+	"clickhouse-client": {Port: 9000, Args: []string{"--host", "{host}", "--port", "{port}"}},
+}
+
+var connectCmd = &cobra.Command{
+	Use:   "connect TOOL [-- ARGS...]",
+	Short: "Run a TCP client against a host behind the instance",
+	Long: `Run a TCP client (psql, mysql, redis-cli, ...) against a host behind the
+instance, for one-off connections where routing whole networks is overkill.
+This does not require root.
+
+connect starts the SSM/SSH tunnel, checks that --host:--port can be reached
+through it (the name is resolved on the instance, e.g. by the VPC's DNS),
+forwards a local port to it and runs TOOL against that port. When TOOL exits,
+the tunnel is stopped and connect exits with TOOL's exit code.
+
+Known clients get the local host and port as their own options, and --port
+defaults to their usual port: ` + strings.Join(connectClientNames(), ", ") + `.
+For other tools, write {host} and {port} in ARGS where they go; TOOL also
+gets them as $SSM_PROXY_HOST and $SSM_PROXY_PORT.
+
+Examples:
+  # psql against a database in the VPC
+  ssm-proxy connect psql --instance-tag Name=bastion --host db.internal -- -U admin mydb
+
+  # redis-cli on a non-default port
+  ssm-proxy connect redis-cli --instance-id i-1234567890abcdef0 --host cache.internal --port 6380
+
+  # Any other client, with placeholders
+  ssm-proxy connect curl --instance-id i-1234567890abcdef0 --host api.internal --port 8080 -- http://{host}:{port}/health`,
+	Args: cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if instanceID == "" && instanceTag == "" {
+			return fmt.Errorf("either --instance-id or --instance-tag is required")
+		}
+		if instanceID != "" && instanceTag != "" {
+			return fmt.Errorf("cannot specify both --instance-id and --instance-tag")
+		}
+		if connectHost == "" {
+			return fmt.Errorf("--host is required")
+		}
+		if connectPort == 0 {
+			client, ok := connectClients[filepath.Base(args[0])]
+			if !ok {
+				return fmt.Errorf("--port is required for %s", args[0])
+			}
+			connectPort = client.Port
+		}
+		if connectPort < 1 || connectPort > 65535 {
+			return fmt.Errorf("invalid --port %d (expected 1-65535)", connectPort)
+		}
+		if connectLocalPort < 0 || connectLocalPort > 65535 {
+			return fmt.Errorf("invalid --local-port %d (expected 1-65535, or 0 for any free port)", connectLocalPort)
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("cannot run %s: %w", args[0], err)
+		}
+		return validateTransport(transport)
+	},
+	RunE: runConnect,
+}
+
+func init() {
+	rootCmd.AddCommand(connectCmd)
+
+	connectCmd.Flags().StringVar(&instanceID, "instance-id", "", "EC2 instance ID (e.g., i-1234567890abcdef0)")
+	connectCmd.Flags().StringVar(&instanceTag, "instance-tag", "", "Find instance by tag (format: Key=Value)")
+	connectCmd.Flags().StringVar(&connectHost, "host", "", "Host to connect to, as seen from the instance")
+	connectCmd.Flags().IntVar(&connectPort, "port", 0, "Port to connect to (default: the client's usual port)")
+	connectCmd.Flags().IntVar(&connectLocalPort, "local-port", 0, "Local port the client connects to (default: any free port)")
+	connectCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Always generate temporary SSH key (ignore existing keys)")
+	connectCmd.Flags().StringVar(&transport, "transport", transportSSH, "How the SSH tunnel is run: ssh or native (in process)")
+	connectCmd.Flags().DurationVar(&keepAlive, "keep-alive", 30*time.Second, "Keep-alive interval: SSH ServerAliveInterval and tunnel health-check period")
+	connectCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Connection timeout: SSH connect and SOCKS5 dials to the host")
+}
+
+func runConnect(cmd *cobra.Command, args []string) error {
+	// Errors from here on (and the client's exit code) are not about usage
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	socksPort, err := netutil.FreeLocalPort()
+	if err != nil {
+		return fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+	}
+
+	sshTunnel, _, err := connectTunnel(ctx, defaultAWSAccount(), instanceID, instanceTag, socksPort, nil)
+	if err != nil {
+		return err
+	}
+	defer sshTunnel.Stop()
+
+	// Fail before starting the client if the host cannot be reached
+	remote := net.JoinHostPort(connectHost, strconv.Itoa(connectPort))
+	dialCtx, dialCancel := context.WithTimeout(ctx, timeout)
+	conn, err := socks.Dial(dialCtx, sshTunnel.SOCKSAddr(), remote)
+	dialCancel()
+	if err != nil {
+		return fmt.Errorf("cannot reach %s through the tunnel: %w", remote, err)
+	}
+	conn.Close()
+
+	fwd := portforward.New(sshTunnel.SOCKSAddr(), timeout)
+	defer fwd.Close()
+	mapping, err := fwd.Listen(portforward.Mapping{
+		BindAddress: portforward.DefaultBindAddress,
+		LocalPort:   connectLocalPort,
+		RemoteHost:  connectHost,
+		RemotePort:  connectPort,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Forwarding %s\n", mapping)
+
+	client := exec.Command(args[0], clientArgs(args[0], args[1:], mapping)...)
+	client.Stdin, client.Stdout, client.Stderr = os.Stdin, os.Stdout, os.Stderr
+	client.Env = append(os.Environ(),
+		"SSM_PROXY_HOST="+mapping.BindAddress,
+		"SSM_PROXY_PORT="+strconv.Itoa(mapping.LocalPort))
+	fmt.Printf("✓ Running %s\n\n", strings.Join(client.Args, " "))
+
+	// Ctrl+C is for the client (e.g. to cancel a query): the tunnel stays
+	// up until the client exits
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	go func() {
+		ticker := time.NewTicker(min(keepAlive, healthCheckInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				restartIfDown(ctx, sshTunnel)
+			}
+		}
+	}()
+
+	err = client.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			code = 1 // killed by a signal
+		}
+		return &exitError{code: code}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// clientArgs returns the arguments a client runs with: a known client's
+// own options for the forwarded address, unless args place {host} or
+// {port} themselves, followed by args with the placeholders replaced
+func clientArgs(tool string, args []string, m portforward.Mapping) []string {
+	placed := slices.ContainsFunc(args, func(arg string) bool {
+		return strings.Contains(arg, "{host}") || strings.Contains(arg, "{port}")
+	})
+
+	var out []string
+	if client, ok := connectClients[filepath.Base(tool)]; ok && !placed {
+		out = append(out, client.Args...)
+	}
+	out = append(out, args...)
+
+	replacer := strings.NewReplacer("{host}", m.BindAddress, "{port}", strconv.Itoa(m.LocalPort))
+	for i, arg := range out {
+		out[i] = replacer.Replace(arg)
+	}
+	return out
+}
+
+// connectClientNames returns the names of the known clients, sorted
+func connectClientNames() []string {
+	names := make([]string, 0, len(connectClients))
+	for name := range connectClients {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/spf13/viper"
+)
+
+// Drain defaults: how long a drained session waits for its connections to
+// close before stopping anyway, and how often it looks
+const (
+	defaultDrainTimeout = 5 * time.Minute
+	drainPollInterval   = 500 * time.Millisecond
+)
+
+// sessionControl is what the control methods of a running session act on
+type sessionControl struct {
+	ctx        context.Context
+	name       string
+	spec       *tunnelSpec
+	sessionMgr *session.Manager
+	updates    sessionUpdates // changes to the session state
+	tun        *tunnel.TunDevice
+	router     *routing.Router
+	forwarder  *forwarder.TunToSOCKS
+	bypass     *endpointBypass           // nil without --bypass-aws-endpoints
+	system     *dns.SystemResolverConfig // nil without system DNS configuration
+	standby    *warmStandby              // nil without --standby
+	stopCh     chan<- string             // why the session is to stop
+
+	mu     sync.Mutex          // serializes route changes
+	routes map[string][]string // routes installed per CIDR block
+}
+
+// routeParams are the parameters of the route control methods: CIDR blocks
+// or @group references
+type routeParams struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// routeResult is the result of the route control methods: the session's
+// CIDR blocks afterwards and the routes added or removed
+type routeResult struct {
+	CIDRs  []string `json:"cidrs"`
+	Routes []string `json:"routes"`
+	Reset  int      `json:"reset,omitempty"` // connections reset by removing routes
+}
+
+// drainParams are the parameters of the drain control method
+type drainParams struct {
+	// Timeout is how long to wait for the connections to close, e.g. "2m"
+	// (default 5m)
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// drainResult is the result of the drain control method
+type drainResult struct {
+	Connections uint64 `json:"connections"` // still open
+}
+
+// dnsReloadResult is the result of the DNS reload control method
+type dnsReloadResult struct {
+	Rewrite []string `json:"rewrite"`
+}
+
+// register adds the session's control methods to server
+func (c *sessionControl) register(server *control.Server) {
+	server.Handle(control.MethodStatus, control.ClassRead, c.status)
+	server.Handle(control.MethodStats, control.ClassRead, func(raw json.RawMessage) (any, error) {
+		var params statsParams
+		if err := decodeParams(raw, &params); err != nil {
+			return nil, err
+		}
+		return newSessionStats(c.forwarder, params.Top), nil
+	})
+	server.Handle(control.MethodCloseFlows, control.ClassFlowAdmin, func(json.RawMessage) (any, error) {
+		closed := c.forwarder.CloseFlows()
+		log.Infof("Closed %d flows on request via the control socket", closed)
+		return map[string]int{"closed": closed}, nil
+	})
+	server.Handle(control.MethodRouteAdd, control.ClassFlowAdmin, c.addRoutes)
+	server.Handle(control.MethodRouteRemove, control.ClassFlowAdmin, c.removeRoutes)
+	server.Handle(control.MethodDNSReload, control.ClassFlowAdmin, c.reloadDNS)
+	server.Handle(control.MethodDrain, control.ClassSessionAdmin, c.drain)
+	server.Handle(control.MethodLogLevel, control.ClassSessionAdmin, changeLogLevel)
+	server.Handle(control.MethodStop, control.ClassSessionAdmin, func(json.RawMessage) (any, error) {
+		c.stop("stopped via control socket")
+		return nil, nil
+	})
+}
+
+// decodeParams decodes a method's params into v, if there are any
+func decodeParams(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	return nil
+}
+
+// stop asks the session to stop, unless it already was
+func (c *sessionControl) stop(reason string) {
+	select {
+	case c.stopCh <- reason:
+	default:
+	}
+}
+
+// status returns the session's state and live traffic counters
+func (c *sessionControl) status(json.RawMessage) (any, error) {
+	current, err := c.sessionMgr.Get(c.name)
+	if err != nil {
+		return nil, err
+	}
+	stats := c.forwarder.GetStats()
+	status := &sharedStatus{Session: current, Traffic: newTrafficCounters(&stats), Draining: c.forwarder.Draining()}
+	if credentialWatcher != nil {
+		status.Credentials = credentialWatcher.status()
+	}
+	if c.standby != nil {
+		status.Standby = standbyDown
+		if c.standby.StandbyReady() {
+			status.Standby = standbyReady
+		}
+	}
+	return status, nil
+}
+
+// addRoutes routes more CIDR blocks through the session. Blocks already
+// routed are skipped; if a route cannot be added, none are.
+func (c *sessionControl) addRoutes(raw json.RawMessage) (any, error) {
+	var params routeParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	cidrs, err := expandCIDRs(params.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if len(cidrs) == 0 {
+		return nil, errors.New("no CIDR blocks given")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var added []string
+	for _, cidr := range cidrs {
+		if err := validateCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %s: %w", cidr, err)
+		}
+		if c.routed(cidr) == "" {
+			added = append(added, cidr)
+		}
+	}
+	if len(added) == 0 {
+		return &routeResult{CIDRs: c.spec.CIDRs, Routes: []string{}}, nil
+	}
+
+	// IPv6 needs an address on the TUN device, which it only has if the
+	// session started with an IPv6 block
+	if hasIPv6CIDR(added) && !hasIPv6CIDR(c.spec.CIDRs) {
+		if err := c.configureIPv6(); err != nil {
+			return nil, err
+		}
+	}
+
+	cidrsAfter := append(slices.Clone(c.spec.CIDRs), added...)
+
+	// The AWS endpoints must stay reachable before the routes cover them
+	if c.bypass != nil {
+		c.bypass.setCIDRs(cidrsAfter)
+		c.bypass.update(c.ctx, false)
+	}
+
+	plans := planRoutes(added, c.tun.Name())
+	installed := c.installedRoutes()
+	var wanted []string
+	for _, plan := range plans {
+		for _, route := range plan.Routes {
+			if !installed[route] && !slices.Contains(wanted, route) {
+				wanted = append(wanted, route)
+			}
+		}
+	}
+
+	results := c.router.AddRoutes(c.ctx, wanted, c.tun.Name())
+	if err := results.Err(); err != nil {
+		c.router.DeleteRoutes(c.ctx, results.Succeeded())
+		if c.bypass != nil {
+			c.bypass.setCIDRs(c.spec.CIDRs)
+			c.bypass.update(c.ctx, false)
+		}
+		return nil, fmt.Errorf("failed to add %d of %d routes: %w", len(results.Failed()), len(results), err)
+	}
+
+	for _, plan := range plans {
+		c.routes[plan.CIDR] = plan.Routes
+	}
+	c.setCIDRs(cidrsAfter)
+	log.Infof("Added routes via the control socket: %s", strings.Join(wanted, ", "))
+	return &routeResult{CIDRs: cidrsAfter, Routes: wanted}, nil
+}
+
+// removeRoutes stops routing CIDR blocks through the session. If a route
+// cannot be removed, the blocks are kept (removing them again retries).
+func (c *sessionControl) removeRoutes(raw json.RawMessage) (any, error) {
+	var params routeParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	cidrs, err := expandCIDRs(params.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if len(cidrs) == 0 {
+		return nil, errors.New("no CIDR blocks given")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := make(map[string]bool)
+	for _, cidr := range cidrs {
+		block := c.routed(cidr)
+		if block == "" {
+			return nil, fmt.Errorf("%s is not routed by session %s", cidr, c.name)
+		}
+		removed[block] = true
+	}
+
+	var cidrsAfter []string
+	for _, cidr := range c.spec.CIDRs {
+		if !removed[cidr] {
+			cidrsAfter = append(cidrsAfter, cidr)
+		}
+	}
+
+	// Routes shared with a remaining block stay
+	kept := make(map[string]bool)
+	for _, cidr := range cidrsAfter {
+		for _, route := range c.routes[cidr] {
+			kept[route] = true
+		}
+	}
+	var unwanted []string
+	for _, cidr := range c.spec.CIDRs {
+		for _, route := range c.routes[cidr] {
+			if removed[cidr] && !kept[route] && !slices.Contains(unwanted, route) {
+				unwanted = append(unwanted, route)
+			}
+		}
+	}
+
+	results := c.router.DeleteRoutes(c.ctx, unwanted)
+	if err := results.Err(); err != nil {
+		return nil, fmt.Errorf("failed to remove %d of %d routes: %w", len(results.Failed()), len(results), err)
+	}
+
+	for cidr := range removed {
+		delete(c.routes, cidr)
+	}
+	c.setCIDRs(cidrsAfter)
+
+	// Connections to the blocks no longer routed would hang: their packets
+	// now go elsewhere
+	var removedBlocks []string
+	for cidr := range removed {
+		removedBlocks = append(removedBlocks, cidr)
+	}
+	reset := c.forwarder.ResetConnections(func(addr netip.Addr) bool {
+		return blocksContain(removedBlocks, addr) && !blocksContain(cidrsAfter, addr)
+	})
+	if c.bypass != nil {
+		c.bypass.setCIDRs(cidrsAfter)
+		c.bypass.update(c.ctx, false)
+	}
+	log.Infof("Removed routes via the control socket: %s (%d connection(s) reset)", strings.Join(unwanted, ", "), reset)
+	return &routeResult{CIDRs: cidrsAfter, Routes: unwanted, Reset: reset}, nil
+}
+
+// blocksContain reports whether one of the CIDR blocks contains addr
+func blocksContain(blocks []string, addr netip.Addr) bool {
+	for _, block := range blocks {
+		if p, err := netip.ParsePrefix(block); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// routed returns the session's CIDR block equal to cidr, or "" if there is
+// none
+func (c *sessionControl) routed(cidr string) string {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return ""
+	}
+	for _, block := range c.spec.CIDRs {
+		if p, err := netip.ParsePrefix(block); err == nil && p.Masked() == prefix.Masked() {
+			return block
+		}
+	}
+	return ""
+}
+
+// installedRoutes returns the routes installed for the session's blocks
+func (c *sessionControl) installedRoutes() map[string]bool {
+	installed := make(map[string]bool)
+	for _, routes := range c.routes {
+		for _, route := range routes {
+			installed[route] = true
+		}
+	}
+	return installed
+}
+
+// configureIPv6 gives the TUN device its IPv6 address (--local-ipv6)
+func (c *sessionControl) configureIPv6() error {
+	if mtu < 1280 {
+		return fmt.Errorf("--mtu must be at least 1280 to route IPv6 CIDR blocks")
+	}
+	if ip, _, err := net.ParseCIDR(c.spec.LocalIPv6); err != nil || ip.To4() != nil {
+		return fmt.Errorf("invalid --local-ipv6 %s (expected x:x::x/y)", c.spec.LocalIPv6)
+	}
+	if err := c.tun.ConfigureIPv6(c.spec.LocalIPv6); err != nil {
+		return fmt.Errorf("failed to configure TUN device: %w", err)
+	}
+	return nil
+}
+
+// setCIDRs records the session's CIDR blocks after a route change: in the
+// forwarder's counters and, through the main loop, the session state
+func (c *sessionControl) setCIDRs(cidrs []string) {
+	c.spec.CIDRs = cidrs
+	c.forwarder.SetCIDRs(cidrs)
+
+	var routes []string
+	for _, cidr := range cidrs {
+		for _, route := range c.routes[cidr] {
+			if !slices.Contains(routes, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	c.updates.update(c.ctx, func(sess *session.Session) {
+		sess.CIDRBlocks = cidrs
+		sess.Routes = routes
+		saveSession(c.sessionMgr, sess)
+	})
+}
+
+// reloadDNS reads the DNS rewrite rules from the config file again (unless
+// --dns-rewrite was given), empties the DNS cache and restores the system
+// resolver configuration if it changed
+func (c *sessionControl) reloadDNS(json.RawMessage) (any, error) {
+	resolver := c.forwarder.DNSResolver()
+	if resolver == nil {
+		return nil, fmt.Errorf("session %s does not answer DNS (see --dns-resolver)", c.name)
+	}
+
+	rules := dnsRewriteRules
+	if !dnsRewriteFlag && viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		rules = nil
+		for _, spec := range viper.GetStringSlice("dns.rewrite") {
+			rule, err := dns.ParseRewriteRule(spec)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	resolver.Reload(rules)
+
+	if err := dns.FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	}
+	if c.system != nil && !c.system.Verify() {
+		if err := c.system.Repair(); err != nil {
+			return nil, fmt.Errorf("failed to restore system DNS resolver: %w", err)
+		}
+	}
+
+	result := &dnsReloadResult{Rewrite: []string{}}
+	for _, rule := range rules {
+		result.Rewrite = append(result.Rewrite, rule.String())
+	}
+	log.Infof("Reloaded DNS configuration via the control socket (%d rewrite rule(s))", len(rules))
+	return result, nil
+}
+
+// drain stops relaying new connections and stops the session once the open
+// ones are closed, or after the timeout
+func (c *sessionControl) drain(raw json.RawMessage) (any, error) {
+	var params drainParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	timeout := defaultDrainTimeout
+	if params.Timeout != "" {
+		d, err := time.ParseDuration(params.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid drain timeout %q", params.Timeout)
+		}
+		timeout = d
+	}
+
+	open := c.forwarder.GetStats().ConnsActive
+	if !c.forwarder.Draining() {
+		c.forwarder.Drain()
+		log.Infof("Draining via the control socket: %d connection(s) open, stopping when they are closed (at most %s)", open, timeout)
+		go c.waitDrained(timeout)
+	}
+	return &drainResult{Connections: open}, nil
+}
+
+// waitDrained stops the session when its connections are closed or the
+// timeout expires
+func (c *sessionControl) waitDrained(timeout time.Duration) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-deadline:
+			log.Warnf("Drain timeout of %s reached with %d connection(s) open, stopping", timeout, c.forwarder.GetStats().ConnsActive)
+			c.stop("drain timed out")
+			return
+		case <-ticker.C:
+			if c.forwarder.GetStats().ConnsActive == 0 {
+				c.stop("drained via control socket")
+				return
+			}
+		}
+	}
+}
+
+// runningSession returns name, or the most recent running session if name
+// is empty, for commands that talk to a session's control socket
+func runningSession(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+	sessions, err := sessionMgr.ListAll()
+	if err != nil {
+		return "", fmt.Errorf("failed to list sessions: %w", err)
+	}
+	for _, sess := range sessions {
+		if isProcessRunning(sess.PID) {
+			return sess.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running sessions found")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+)
+
+// credentialWarning is how long before the AWS credentials (or SSO token)
+// expire a warning is logged (--credential-warning, 0 to disable)
+var credentialWarning time.Duration
+
+// credentialWatcher watches the credentials of the process's tunnels; nil
+// if they could not be loaded
+var credentialWatcher *credentialWatch
+
+// credentialCheckInterval is how often the credentials' expiry is checked
+const credentialCheckInterval = time.Minute
+
+// credentialStatus is what status reports about a session's AWS credentials
+type credentialStatus struct {
+	Source            string     `json:"source,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	SSOTokenExpiresAt *time.Time `json:"sso_token_expires_at,omitempty"`
+	Expiring          bool       `json:"expiring"` // within --credential-warning
+	Error             string     `json:"error,omitempty"`
+}
+
+// credentialWatch checks when the AWS credentials expire and warns ahead of
+// time, so that they can be refreshed before reconnects start failing
+type credentialWatch struct {
+	client     *aws.Client
+	warnBefore time.Duration
+
+	mu     sync.Mutex
+	expiry aws.CredentialExpiry
+	err    error
+	warned time.Time // expiry last warned about
+
+	loginAfter time.Time // no 'aws sso login' before, after one failed
+}
+
+// startCredentialWatch loads the AWS credentials of --profile and checks
+// their expiry until ctx is done
+func startCredentialWatch(ctx context.Context) (*credentialWatch, error) {
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w := &credentialWatch{client: client, warnBefore: credentialWarning}
+	w.check(ctx)
+	go w.run(ctx)
+	return w, nil
+}
+
+// run checks the expiry every credentialCheckInterval until ctx is done
+func (w *credentialWatch) run(ctx context.Context) {
+	ticker := time.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// check retrieves the credentials (refreshing them if due), logging in to
+// SSO again if needed and possible, and warns once per expiry time when it
+// is near
+func (w *credentialWatch) check(ctx context.Context) {
+	// An SSO session that cannot be refreshed is renewed before it ends,
+	// while someone is there to log in
+	if canSSOLogin() && time.Now().After(w.loginAfter) {
+		if err := ensureSSOLogin(ctx, w.client, w.warnBefore); err != nil {
+			log.Warnf("Failed to renew the AWS SSO session: %v", err)
+			w.loginAfter = time.Now().Add(ssoLoginRetry)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	expiry, err := w.client.CredentialExpiry(ctx)
+	if ctx.Err() != nil && err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.expiry, w.err = expiry, err
+	earliest := expiry.Earliest()
+	warn := w.expiringLocked() && !earliest.Equal(w.warned)
+	if warn {
+		w.warned = earliest
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		log.Warnf("Failed to check AWS credentials: %v", err)
+		return
+	}
+	if !warn {
+		return
+	}
+	what := "AWS credentials expire"
+	if earliest.Equal(expiry.SSOToken) {
+		what = "AWS SSO token expires"
+	}
+	if time.Until(earliest) > 0 {
+		log.Warnf("⚠️  %s; refresh the credentials (e.g. 'aws sso login') to keep reconnects working", describeExpiry(what, earliest))
+	} else {
+		log.Warnf("⚠️  %s; reconnects will fail until they are refreshed", describeExpiry(what, earliest))
+	}
+}
+
+// expiringLocked reports whether the credentials expire within the warning
+// window. Caller must hold w.mu.
+func (w *credentialWatch) expiringLocked() bool {
+	earliest := w.expiry.Earliest()
+	return w.warnBefore > 0 && !earliest.IsZero() && time.Until(earliest) < w.warnBefore
+}
+
+// status returns the last expiry seen
+func (w *credentialWatch) status() *credentialStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := &credentialStatus{Source: w.expiry.Source, Expiring: w.expiringLocked()}
+	if !w.expiry.Credentials.IsZero() {
+		status.ExpiresAt = &w.expiry.Credentials
+	}
+	if !w.expiry.SSOToken.IsZero() {
+		status.SSOTokenExpiresAt = &w.expiry.SSOToken
+	}
+	if w.err != nil {
+		status.Error = w.err.Error()
+	}
+	return status
+}
+
+// describe returns a line about the credentials for the status table, ""
+// if they do not expire
+func (s *credentialStatus) describe() string {
+	if s.Error != "" {
+		message, _, _ := strings.Cut(s.Error, "\n")
+		return fmt.Sprintf("⚠️  AWS credentials: %s", message)
+	}
+
+	var line string
+	if s.ExpiresAt != nil {
+		line = describeExpiry("AWS credentials expire", *s.ExpiresAt)
+	}
+	if s.SSOTokenExpiresAt != nil {
+		if line == "" {
+			line = describeExpiry("AWS SSO token expires", *s.SSOTokenExpiresAt)
+		} else {
+			line += ", " + describeExpiry("SSO token expires", *s.SSOTokenExpiresAt)
+		}
+	}
+	if line != "" && s.Expiring {
+		line = "⚠️  " + line
+	}
+	return line
+}
+
+// describeExpiry completes a phrase like "AWS credentials expire" with when
+// they do (or did), e.g. "in 42m (at 2025-01-15T15:04:05+01:00)"
+func describeExpiry(phrase string, t time.Time) string {
+	at := formatTime(t)
+	if remaining := time.Until(t); remaining > 0 {
+		return fmt.Sprintf("%s in %s (at %s)", phrase, formatUptime(remaining), at)
+	}
+	// "expire" -> "expired", "expires" -> "expired"
+	past := strings.TrimSuffix(strings.TrimSuffix(phrase, "s"), "e") + "ed"
+	return fmt.Sprintf("%s %s ago (at %s)", past, formatUptime(-time.Until(t)), at)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/store"
+	"golang.org/x/sys/unix"
+)
+
+// daemonEnv marks the background process started by 'start --daemon'
+const daemonEnv = "SSM_PROXY_DAEMON"
+
+// Daemon defaults
+const (
+	defaultPIDFile       = "/var/run/ssm-proxy.pid"
+	daemonLogName        = "daemon.log"
+	daemonRotateInterval = 30 * time.Second
+	daemonStopTimeout    = 30 * time.Second
+	daemonLogTailLines   = 20
+)
+
+// isDaemonChild reports whether this process is the background process of
+// 'start --daemon'
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonLogPath returns --log-file, or the daemon log next to the state
+// store
+func daemonLogPath() string {
+	if logFile != "" {
+		return logFile
+	}
+	return filepath.Join(filepath.Dir(store.DefaultPath()), daemonLogName)
+}
+
+// startDaemon re-executes 'start' in the background with the same flags and
+// waits until its tunnels are up (it writes the PID file then) or it fails.
+// pickedInstance is passed on if the instance was chosen in the picker.
+func startDaemon(pickedInstance string) error {
+	if pid, err := readPIDFile(pidFile); err == nil && isProcessRunning(pid) {
+		return fmt.Errorf("ssm-proxy is already running in the background (pid %d, %s)", pid, pidFile)
+	}
+
+	// The child removes the PID file when it exits; a leftover one would be
+	// mistaken for readiness
+	if err := os.Remove(pidFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale PID file: %w", err)
+	}
+
+	args := daemonChildArgs(os.Args[1:])
+	if pickedInstance != "" {
+		args = append(args, "--instance-id", pickedInstance)
+	}
+
+	logPath := daemonLogPath()
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	out, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer out.Close()
+
+	child, err := spawnDetachedTo(args, out, daemonEnv+"=1")
+	if err != nil {
+		return fmt.Errorf("failed to start background process: %w", err)
+	}
+	fmt.Printf("✓ Starting in the background (pid %d)...\n", child.Process.Pid)
+
+	if err := waitForDaemon(child, headlessTimeout+10*time.Second); err != nil {
+		child.Process.Signal(syscall.SIGTERM)
+		fmt.Printf("\nLast lines of %s:\n", logPath)
+		printLogTail(logPath, daemonLogTailLines)
+		return err
+	}
+	child.Process.Release()
+
+	fmt.Println("✓ Proxy is running in the background")
+	fmt.Printf("  ├─ PID file: %s\n", pidFile)
+	fmt.Printf("  ├─ Log: %s\n", logPath)
+	if pidFile == defaultPIDFile {
+		fmt.Println("  └─ Stop with: sudo ssm-proxy stop")
+	} else {
+		fmt.Printf("  └─ Stop with: sudo ssm-proxy stop --pid-file %s\n", pidFile)
+	}
+	return nil
+}
+
+// daemonChildArgs returns the arguments of this invocation for the
+// background process: without --daemon, and headless since it has no
+// terminal
+func daemonChildArgs(args []string) []string {
+	var child []string
+	for _, arg := range args {
+		name, _, _ := strings.Cut(arg, "=")
+		if name == "--daemon" || name == "-d" {
+			continue
+		}
+		child = append(child, arg)
+	}
+	return append(child, "--headless")
+}
+
+// waitForDaemon waits until the child has written the PID file, exits, or
+// the timeout elapses
+func waitForDaemon(child *exec.Cmd, timeout time.Duration) error {
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				return fmt.Errorf("background process exited before the tunnel came up")
+			}
+			return fmt.Errorf("background process failed to start: %w", err)
+		case <-deadline:
+			return fmt.Errorf("tunnel did not come up within %s", timeout)
+		case <-ticker.C:
+			if pid, err := readPIDFile(pidFile); err == nil && pid == child.Process.Pid {
+				return nil
+			}
+		}
+	}
+}
+
+// daemonReady writes the PID file once every tunnel is up, which tells the
+// invoking process that startup succeeded
+func daemonReady() {
+	if err := writePIDFile(pidFile, os.Getpid()); err != nil {
+		log.Errorf("Failed to write PID file: %v", err)
+	}
+}
+
+// daemonExit removes the PID file if it is still this process's. After
+// --drop-privileges the PID file remover does it instead.
+func daemonExit() {
+	if pid, err := readPIDFile(pidFile); err != nil || pid != os.Getpid() {
+		return
+	}
+	err := os.Remove(pidFile)
+	switch {
+	case err == nil, errors.Is(err, os.ErrNotExist):
+	case errors.Is(err, os.ErrPermission) && pidFileRemover != nil:
+		log.Debugf("PID file %s is removed by the PID file remover", pidFile)
+	default:
+		log.Errorf("Failed to remove PID file: %v", err)
+	}
+}
+
+// pidFileRemover is the write end of the pipe to the PID file remover,
+// open until the process exits
+var pidFileRemover *os.File
+
+// startPIDFileRemover starts a process of root that removes the PID file
+// at path once this process, pid, has exited, if the file still has its
+// pid: after dropping privileges this process can no longer remove files
+// in the PID file's directory. The remover waits for the end of a pipe
+// from this process, which closes when it exits however it exits.
+func startPIDFileRemover(path string, pid int) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to start PID file remover: %w", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command("/bin/sh", "-c", `cat >/dev/null; [ "$(cat "$1" 2>/dev/null)" = "$2" ] && rm -f "$1"; exit 0`,
+		"ssm-proxy-pidfile", path, strconv.Itoa(pid))
+	cmd.Stdin = r
+	// Not in our process group, so the signal stopping us does not stop it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to start PID file remover: %w", err)
+	}
+	go cmd.Wait()
+
+	pidFileRemover = w
+	log.Debugf("PID file remover started (pid %d)", cmd.Process.Pid)
+	return nil
+}
+
+// readPIDFile reads the process ID from a PID file
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID file %s", path)
+	}
+	return pid, nil
+}
+
+// writePIDFile atomically writes the process ID to a PID file
+func writePIDFile(path string, pid int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stopDaemon stops the background process of a PID file: gracefully with
+// SIGTERM, waiting for it to clean up, or at once with force
+func stopDaemon(path string, force bool) error {
+	pid, err := readPIDFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read PID file: %w", err)
+	}
+	if !isProcessRunning(pid) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("process %d from %s is not running, and removing the stale PID file failed: %w", pid, path, err)
+		}
+		return fmt.Errorf("process %d from %s is not running (removed stale PID file)", pid, path)
+	}
+
+	signal := syscall.SIGTERM
+	if force {
+		signal = syscall.SIGKILL
+	}
+	fmt.Printf("✓ Stopping background process %d (%s)...\n", pid, path)
+	if err := syscall.Kill(pid, signal); err != nil {
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+
+	deadline := time.Now().Add(daemonStopTimeout)
+	for isProcessRunning(pid) && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if isProcessRunning(pid) {
+		return fmt.Errorf("process %d did not exit within %s (use --force)", pid, daemonStopTimeout)
+	}
+	if force {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("process %d stopped, but removing its PID file failed: %w", pid, err)
+		}
+	}
+	fmt.Println("  └─ Stopped")
+	return nil
+}
+
+// rotateDaemonLog keeps the daemon log below maxSize bytes: when it grows
+// past it, it is renamed to .1 (shifting older ones up to keep files) and
+// stdout and stderr continue in a new file. Runs until done is closed.
+func rotateDaemonLog(path string, maxSize int64, keep int, done <-chan struct{}) {
+	ticker := time.NewTicker(daemonRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stdout.Stat()
+		if err != nil || info.Size() < maxSize {
+			continue
+		}
+		if err := rotateLog(path, keep); err != nil {
+			log.Warnf("Failed to rotate log file: %v", err)
+		}
+	}
+}
+
+// rotateLog shifts path to path.1, path.1 to path.2 and so on (dropping
+// the oldest beyond keep), then points stdout and stderr to a new path
+func rotateLog(path string, keep int) error {
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if keep > 0 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())} {
+		if err := unix.Dup2(int(out.Fd()), fd); err != nil {
+			return fmt.Errorf("failed to redirect output: %w", err)
+		}
+	}
+	return nil
+}
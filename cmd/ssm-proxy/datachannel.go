@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// datachannelAgentPort is --agent-port: where ssm-proxy-agent listens on
+// the instance ('ssm-proxy agent deploy --port')
+var datachannelAgentPort int
+
+// datachannelUnsupported are the start flags of features that work on
+// the connections TunToSOCKS relays, which the ssm-datachannel and
+// wireguard transports do not have: they forward whole packets
+var datachannelUnsupported = []string{
+	"from-prewarm", "standby", "standby-instance-id", "failover", "launch-bastion",
+	"nat-map", "route-domain", "dns-listen", "dns-rewrite", "dns-strategy",
+	"ping-ports", "scheduler", "priority-ports", "resume-timeout",
+	"health-endpoint", "health-dns-name", "selftest", "chaos", "record",
+	"audit-log", "only-app", "policy", "policy-default", "metrics-addr",
+	"full-tunnel", "status-group", "status-token-file", "control-grant",
+}
+
+// validateDatachannel rejects settings the ssm-datachannel and wireguard
+// transports cannot honor, from flags or the config file
+func validateDatachannel(cmd *cobra.Command) error {
+	for _, name := range datachannelUnsupported {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--%s is not supported by the %s transport", name, transport)
+		}
+	}
+	switch {
+	case auditLogPath != "":
+		return fmt.Errorf("audit logs are not supported by the %s transport", transport)
+	case destinationPolicy != nil:
+		return fmt.Errorf("destination policies are not supported by the %s transport", transport)
+	case selectedApps != nil:
+		return fmt.Errorf("--only-app is not supported by the %s transport", transport)
+	case len(dnsRewriteRules) > 0:
+		return fmt.Errorf("DNS rewrite rules are not supported by the %s transport", transport)
+	case len(controlAccess.Grants) > 0:
+		return fmt.Errorf("sharing the session status is not supported by the %s transport", transport)
+	case len(dnsResolvers) > 1:
+		return fmt.Errorf("the %s transport supports a single --dns-resolver", transport)
+	}
+	for _, spec := range tunnelSpecs {
+		if !spec.NAT.Empty() {
+			return fmt.Errorf("NAT mappings are not supported by the %s transport", transport)
+		}
+	}
+	if datachannelAgentPort <= 0 || datachannelAgentPort > 65535 {
+		return fmt.Errorf("invalid --agent-port %d", datachannelAgentPort)
+	}
+	return nil
+}
+
+// runDatachannelTunnel is runTunnel for the ssm-datachannel and wireguard
+// transports: the TUN device's packets go to ssm-proxy-agent as they are,
+// or a WireGuard device's datagrams go through it to the instance's
+// WireGuard interface, so the instance's kernel handles TCP, UDP and ICMP.
+// It runs until the process is interrupted (or ctx is cancelled) and
+// cleans up.
+func runDatachannelTunnel(ctx context.Context, spec *tunnelSpec, group *tunnelGroup, out *outputSequencer) (retErr error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Startup and shutdown output of concurrent tunnels is kept apart
+	out.enter()
+	defer out.leave()
+	started := sync.OnceFunc(group.started)
+	defer func() {
+		if retErr != nil {
+			group.cancel()
+		}
+		started()
+	}()
+	if group.multi {
+		fmt.Printf("\n✓ Starting tunnel %s...\n", spec.Name)
+	}
+
+	name := spec.SessionName
+	generatedName := name == ""
+	if generatedName {
+		name = fmt.Sprintf("ssm-proxy-%d", time.Now().Unix())
+	}
+	sessionMgr := session.NewManager()
+	stale := staleSessions(sessionMgr)
+	sess := &session.Session{
+		Name:      name,
+		StartedAt: time.Now(),
+		PID:       os.Getpid(),
+	}
+	if err := reserveSessionName(sessionMgr, sess, generatedName); err != nil {
+		return err
+	}
+	name = sess.Name
+
+	summary := &shutdownSummary{Session: name}
+	defer summary.print(outputFormat)
+
+	endReason := "startup failed"
+	defer func() {
+		if err := sessionMgr.End(name, endReason); err != nil {
+			summary.cleanupFailed("record session end", err)
+		}
+		sessionMgr.Close()
+	}()
+
+	// Step 2: Find the instance and connect to its agent
+	awsClient, instance, err := lookupTarget(ctx, spec.Account, spec.InstanceID, spec.InstanceTag)
+	if err != nil {
+		return err
+	}
+	agentSession, err := connectAgent(ctx, awsClient, instance.InstanceID)
+	if err != nil {
+		return err
+	}
+	// Until the forwarder owns it
+	defer func() {
+		if retErr != nil {
+			agentSession.Close()
+		}
+	}()
+
+	if autoCIDR {
+		discovered, err := discoverVPCCIDRs(ctx, spec.Account, instance.InstanceID)
+		if err != nil {
+			return fmt.Errorf("failed to discover VPC CIDR blocks: %w", err)
+		}
+		spec.CIDRs = mergeCIDRs(spec.CIDRs, discovered)
+		if hasIPv6CIDR(spec.CIDRs) {
+			if ip, _, err := net.ParseCIDR(spec.LocalIPv6); err != nil || ip.To4() != nil {
+				return fmt.Errorf("invalid --local-ipv6 %s (expected x:x::x/y)", spec.LocalIPv6)
+			}
+		}
+	}
+
+	// Step 3: Flush DNS cache to prevent stale entries from interfering
+	fmt.Println("✓ Flushing DNS cache...")
+	if err := dns.FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	}
+
+	// Step 4: Create the device the routes point at: a TUN device whose
+	// packets the forwarder sends to the agent, or a WireGuard device
+	var (
+		dev      routedDevice
+		tun      *tunnel.TunDevice
+		wgTunnel *wireGuardTunnel
+	)
+	if transport == transportWireGuard {
+		if hasIPv6CIDR(spec.CIDRs) {
+			return fmt.Errorf("the %s transport only routes IPv4 CIDR blocks", transport)
+		}
+		fmt.Println("✓ Setting up WireGuard...")
+		wgTunnel, err = setupWireGuard(ctx, awsClient, instance.InstanceID, spec, agentSession)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if retErr != nil {
+				wgTunnel.teardown(awsClient, instance.InstanceID)
+			}
+		}()
+		dev = wgTunnel.device
+		group.addDevice(dev.Name())
+		fmt.Printf("  ├─ Device: %s\n", dev.Name())
+		fmt.Printf("  ├─ IP: %s\n", spec.LocalIP)
+		fmt.Printf("  └─ MTU: %d\n", mtu-wireGuardOverhead)
+	} else {
+		fmt.Println("✓ Creating TUN device...")
+		tun, err = tunnel.CreateTUN()
+		if err != nil {
+			return fmt.Errorf("failed to create TUN device: %w", err)
+		}
+		group.addDevice(tun.Name())
+		defer func() {
+			if retErr != nil {
+				tun.Close()
+			}
+		}()
+		if err := tun.Configure(spec.LocalIP, mtu); err != nil {
+			return fmt.Errorf("failed to configure TUN device: %w", err)
+		}
+		fmt.Printf("  ├─ Device: %s\n", tun.Name())
+		fmt.Printf("  ├─ IP: %s\n", spec.LocalIP)
+		if hasIPv6CIDR(spec.CIDRs) {
+			if err := tun.ConfigureIPv6(spec.LocalIPv6); err != nil {
+				return fmt.Errorf("failed to configure TUN device: %w", err)
+			}
+			fmt.Printf("  ├─ IPv6: %s\n", spec.LocalIPv6)
+		}
+		fmt.Printf("  └─ MTU: %d\n", mtu)
+		dev = tun
+	}
+
+	// Step 5: Add routes
+	routes, err := addTunnelRoutes(ctx, spec, dev, sessionMgr, stale, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		fmt.Println("\n✓ Removing routes...")
+		if err := routes.router.Cleanup(); err != nil {
+			summary.cleanupFailed("remove routes", err)
+		}
+	}()
+
+	// Step 6: Point the system resolver at the DNS server, which the
+	// queries reach through the routes like any other packet
+	var systemResolver *dns.SystemResolverConfig
+	if dnsResolver != "" && spec.DNS {
+		fmt.Printf("✓ DNS resolver configured: %s\n", dnsResolver)
+		if !routedAddr(dnsResolver, spec.CIDRs) {
+			fmt.Printf("  ⚠️  %s is not in a routed CIDR block; its queries do not go through the tunnel\n", dnsResolver)
+		}
+		switch {
+		case len(dnsDomains) == 0:
+			fmt.Printf("  └─ No domains configured, skipping system DNS resolver setup\n")
+		case dnsBackend == dns.BackendNone:
+			fmt.Printf("  └─ Domains: %v (--dns-backend none, leaving the system DNS resolver alone)\n", dnsDomains)
+		default:
+			fmt.Printf("  └─ Domains: %v\n", dnsDomains)
+			fmt.Println("✓ Configuring system DNS resolver...")
+			systemResolver = dns.NewSystemResolverConfig(dnsDomains, dnsResolver)
+			systemResolver.SetBackend(dnsBackend)
+			systemResolver.SetInterface(dev.Name())
+			if adoptOrphans {
+				systemResolver.Adopt()
+			}
+			if err := systemResolver.Setup(); err != nil {
+				log.Warnf("Failed to configure system DNS resolver: %v", err)
+				fmt.Printf("  ⚠️  Could not configure system DNS resolver automatically: %v\n", err)
+				systemResolver = nil
+			}
+		}
+	}
+	if systemResolver != nil {
+		defer func() {
+			if err := systemResolver.Cleanup(); err != nil {
+				summary.cleanupFailed("restore system DNS resolver", err)
+			}
+		}()
+	}
+
+	// Step 7: Forward the packets (or WireGuard's datagrams) to the agent
+	var link agentLink
+	if wgTunnel != nil {
+		fmt.Println("✓ Starting WireGuard relay...")
+		if compression != "off" {
+			fmt.Printf("  ⚠️  --compression does not apply to WireGuard's encrypted packets, sending uncompressed\n")
+		}
+		if err := wgTunnel.waitHandshake(ctx); err != nil {
+			return err
+		}
+		link = wgTunnel.relay
+		fmt.Printf("  └─ WireGuard handshake with %s through ssm-proxy-agent ✓\n", instance.InstanceID)
+	} else {
+		fmt.Println("✓ Starting packet forwarder...")
+		fwd := forwarder.New(tun, agentSession, logPackets)
+		if c, err := ssmp.ParseCompression(compression); err == nil {
+			fwd.SetCompression(c)
+		}
+		if err := fwd.Start(); err != nil {
+			return fmt.Errorf("failed to start packet forwarder: %w", err)
+		}
+		link = fwd
+		fmt.Printf("  └─ Forwarding packets to ssm-proxy-agent on %s ✓\n", instance.InstanceID)
+	}
+
+	// Step 8: Save session state
+	sess.InstanceID = instance.InstanceID
+	sess.Region, sess.RoleARN = spec.Account.Region, spec.Account.RoleARN
+	sess.SessionID = agentSession.SessionID()
+	sess.TunDevice = dev.Name()
+	sess.TunIP = spec.LocalIP
+	sess.CIDRBlocks = spec.CIDRs
+	for _, plan := range routes.plans {
+		sess.Routes = append(sess.Routes, plan.Routes...)
+	}
+	sess.StartedAt = time.Now()
+	if err := sessionMgr.Save(sess); err != nil {
+		log.Warnf("Failed to save session state: %v", err)
+	}
+
+	switch {
+	case headless:
+		fmt.Printf("✓ Proxy active (session: %s, device: %s, transport: %s)\n", name, dev.Name(), transport)
+	case group.multi:
+		fmt.Printf("✓ Tunnel %s active (session: %s, device: %s)\n", spec.Name, name, dev.Name())
+	default:
+		printSuccessBanner(dev.Name(), spec.CIDRs, dnsResolver, dnsDomains)
+	}
+
+	// Startup is complete; the headless deadline no longer applies
+	started()
+	if group.timedOut.Load() {
+		return fmt.Errorf("startup aborted")
+	}
+	if err := group.err(); err != nil {
+		return err
+	}
+	out.leave()
+
+	// Step 9: Wait for interrupt signal
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	var lifetimeCh <-chan time.Time
+	if maxLifetime > 0 {
+		lifetimeCh = time.After(maxLifetime)
+	}
+
+	stopCh := make(chan string, 1)
+	switchCh := make(chan string)
+	var reconnects atomic.Int64
+	go keepAgentSession(ctx, link, awsClient, instance.InstanceID, &reconnects, stopCh, switchCh)
+	if routes.bypass != nil {
+		go routes.bypass.watch(ctx, endpointRecheckInterval)
+	}
+
+	// sess is only touched here: reconnects send the new SSM session's ID
+	for {
+		select {
+		case id := <-switchCh:
+			sess.SessionID = id
+			if err := sessionMgr.Save(sess); err != nil {
+				log.Warnf("Failed to save session state: %v", err)
+			}
+			continue
+		case sig := <-sigCh:
+			endReason = fmt.Sprintf("signal: %v", sig)
+		case <-lifetimeCh:
+			endReason = "max lifetime reached"
+			log.Warnf("Maximum lifetime of %s reached, shutting down", maxLifetime)
+		case endReason = <-stopCh:
+		case <-ctx.Done():
+			endReason = "stopped with another tunnel"
+		}
+		break
+	}
+
+	out.enter()
+	if group.multi {
+		fmt.Printf("\n\n✓ Shutting down tunnel %s gracefully...\n", spec.Name)
+	} else {
+		fmt.Println("\n\n✓ Shutting down gracefully...")
+	}
+	cancel()
+
+	if wgTunnel != nil {
+		fmt.Println("✓ Removing WireGuard...")
+		if err := wgTunnel.teardown(awsClient, instance.InstanceID); err != nil {
+			summary.cleanupFailed("remove WireGuard", err)
+		}
+	} else {
+		// Closing the TUN device first interrupts the forwarder's reads
+		fmt.Println("✓ Closing TUN device...")
+		if err := tun.Close(); err != nil {
+			summary.cleanupFailed("close TUN device", err)
+		}
+		fmt.Println("✓ Stopping packet forwarder...")
+		link.Stop()
+	}
+	if err := link.Session().Close(); err != nil {
+		summary.cleanupFailed("close SSM session", err)
+	}
+
+	finalStats := link.GetStats()
+	summary.begin(endReason, sess.StartedAt, &finalStats, reconnects.Load())
+	recordFinalTraffic(sessionMgr, sess, &finalStats)
+	return nil
+}
+
+// connectAgent checks that ssm-proxy-agent answers on --agent-port of the
+// instance and opens the SSM session the packets are forwarded over
+func connectAgent(ctx context.Context, awsClient *aws.Client, instanceID string) (*ssm.Session, error) {
+	fmt.Printf("✓ Connecting to ssm-proxy-agent on port %d...\n", datachannelAgentPort)
+	rtt, err := verifyAgent(ctx, awsClient, instanceID, datachannelAgentPort, defaultAgentTUNAddr)
+	switch {
+	case errors.Is(err, errNoPingReply):
+		// The session opened, so something is there; it may use
+		// another TUN address
+		fmt.Printf("  ⚠️  The agent did not answer a ping to %s: %v\n", defaultAgentTUNAddr.Addr(), err)
+	case err != nil:
+		return nil, fmt.Errorf("ssm-proxy-agent does not answer on port %d of %s (install it with 'ssm-proxy agent deploy'): %w",
+			datachannelAgentPort, instanceID, err)
+	default:
+		fmt.Printf("  ├─ Agent answers (ping: %s)\n", rtt.Round(time.Millisecond))
+	}
+
+	session, err := openAgentSession(ctx, awsClient, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("  └─ SSM session: %s\n", session.SessionID())
+	return session, nil
+}
+
+// openAgentSession opens an SSM port session to the agent
+func openAgentSession(ctx context.Context, awsClient *aws.Client, instanceID string) (*ssm.Session, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := ssm.NewClient(connectCtx, awsClient, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSM client: %w", err)
+	}
+	client.SetTimeout(timeout)
+	client.SetKeepAlive(keepAlive)
+	session, err := client.StartPortSession(connectCtx, datachannelAgentPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSM session to port %d: %w", datachannelAgentPort, err)
+	}
+	return session, nil
+}
+
+// agentLink carries the traffic to the agent over an SSM session that
+// keepAgentSession replaces when it is lost: the packet forwarder, or the
+// WireGuard relay
+type agentLink interface {
+	Session() *ssm.Session
+	Replace(session *ssm.Session) *ssm.Session
+	Stop()
+	GetStats() forwarder.Stats
+}
+
+// keepAgentSession replaces the link's session when it stops being
+// healthy, with --auto-reconnect, and sends the new one's ID on
+// switchCh. Without --auto-reconnect, or after --max-retries failed attempts in
+// a row, it stops the tunnel through stopCh.
+func keepAgentSession(ctx context.Context, link agentLink, awsClient *aws.Client, instanceID string,
+	reconnects *atomic.Int64, stopCh chan<- string, switchCh chan<- string) {
+	ticker := time.NewTicker(min(keepAlive, healthCheckInterval))
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if link.Session().IsHealthy() {
+			continue
+		}
+		if !autoReconnect {
+			stopCh <- "SSM session to the agent lost"
+			return
+		}
+
+		log.Warn("SSM session to the agent lost, reconnecting...")
+		session, err := openAgentSession(ctx, awsClient, instanceID)
+		if err != nil {
+			failures++
+			log.Errorf("Failed to reconnect to the agent (attempt %d): %v", failures, err)
+			if maxRetries > 0 && failures >= maxRetries {
+				stopCh <- fmt.Sprintf("reconnect failed %d times", failures)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconnectDelay):
+			}
+			continue
+		}
+
+		failures = 0
+		link.Replace(session).Close()
+		reconnects.Add(1)
+		log.Infof("Reconnected to the agent (SSM session %s)", session.SessionID())
+		select {
+		case switchCh <- session.SessionID():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// routedAddr reports whether the host of addr (an address, optionally
+// with a port) is in one of the CIDR blocks
+func routedAddr(addr string, cidrs []string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// spawnDetached re-executes ssm-proxy with args in its own session, so it
+// survives the exit of the invoking shell, with output going to logFile
+func spawnDetached(args []string, logFile string) (*exec.Cmd, error) {
+	out, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %w", err)
+	}
+	defer out.Close()
+
+	return spawnDetachedTo(args, out)
+}
+
+// spawnDetachedTo is spawnDetached writing to an open file, with extra
+// environment variables (KEY=VALUE)
+func spawnDetachedTo(args []string, out *os.File, env ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate ssm-proxy executable: %w", err)
+	}
+
+	child := exec.Command(exe, args...)
+	child.Stdout = out
+	child.Stderr = out
+	child.Env = append(os.Environ(), env...)
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	log.Debugf("Starting: %s %s", exe, strings.Join(args, " "))
+	if err := child.Start(); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// globalFlagArgs returns the global flags of this invocation that a
+// re-executed child needs to behave the same way
+func globalFlagArgs() []string {
+	var args []string
+	if cfgFile != "" {
+		args = append(args, "--config", cfgFile)
+	}
+	if awsProfile != "" {
+		args = append(args, "--profile", awsProfile)
+	}
+	if awsRegion != "" {
+		args = append(args, "--region", awsRegion)
+	}
+	if roleARN != "" {
+		args = append(args, "--role-arn", roleARN)
+	}
+	if externalID != "" {
+		args = append(args, "--external-id", externalID)
+	}
+	if mfaSerial != "" {
+		args = append(args, "--mfa-serial", mfaSerial)
+	}
+	if useUTC {
+		args = append(args, "--utc")
+	}
+	if debug {
+		args = append(args, "--debug")
+	} else if verbose {
+		args = append(args, "--verbose")
+	}
+	return args
+}
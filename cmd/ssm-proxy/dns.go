@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/spf13/cobra"
+)
+
+// dnsSession is the session the dns commands talk to
+var dnsSession string
+
+var dnsCmd = &cobra.Command{
+	Use:   "dns",
+	Short: "Manage the DNS handling of a running session",
+}
+
+var dnsReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the DNS configuration of a running session",
+	Long: `Reload the DNS configuration of a running session without restarting it:
+the rewrite rules are read from the config file again (unless the session
+was started with --dns-rewrite), the session's DNS cache and the system's
+are emptied, and the system resolver configuration is restored if it was
+changed.
+
+Examples:
+  # After editing dns.rewrite in ~/.ssm-proxy/config.yaml
+  sudo ssm-proxy dns reload
+
+  sudo ssm-proxy dns reload --session-name prod-vpc`,
+	Args: cobra.NoArgs,
+	RunE: runDNSReload,
+}
+
+func init() {
+	rootCmd.AddCommand(dnsCmd)
+	dnsCmd.AddCommand(dnsReloadCmd)
+
+	dnsCmd.PersistentFlags().StringVar(&dnsSession, "session-name", "", "Session to manage (default: the most recent one)")
+}
+
+func runDNSReload(cmd *cobra.Command, args []string) error {
+	name, err := runningSession(dnsSession)
+	if err != nil {
+		return err
+	}
+
+	var result dnsReloadResult
+	if err := control.Call(control.SocketPath(name), control.MethodDNSReload, "", nil, &result); err != nil {
+		return fmt.Errorf("session %s: %w", name, err)
+	}
+
+	fmt.Printf("✓ Reloaded DNS configuration of session %s\n", name)
+	if len(result.Rewrite) == 0 {
+		fmt.Println("  └─ Rewrite rules: none")
+	}
+	for i, rule := range result.Rewrite {
+		prefix := "├─"
+		if i == len(result.Rewrite)-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("  %s Rewrite: %s\n", prefix, rule)
+	}
+	return nil
+}
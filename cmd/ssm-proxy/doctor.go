@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/health"
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorInstanceID string
+	doctorSession    string
+	doctorTransport  string
+	doctorTarget     string
+	doctorDNSServer  string
+	doctorDNSName    string
+	doctorTimeout    time.Duration
+	doctorJSON       bool
+)
+
+// doctorCredentialWarning is how soon the credentials may expire before
+// the check warns
+const doctorCredentialWarning = 15 * time.Minute
+
+// Outcomes of a doctor check
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCheck is the outcome of one check of 'ssm-proxy doctor'
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"` // what to do about a failure or warning
+}
+
+// doctorReport collects the checks, printing each as it completes
+type doctorReport struct {
+	Checks []doctorCheck `json:"checks"`
+	Passed bool          `json:"passed"`
+}
+
+// add records a check and prints it (unless --json)
+func (r *doctorReport) add(check doctorCheck) {
+	r.Checks = append(r.Checks, check)
+	if doctorJSON {
+		return
+	}
+
+	icon := map[string]string{doctorPass: "✓", doctorWarn: "⚠️ ", doctorFail: "✗", doctorSkip: "-"}[check.Status]
+	line := fmt.Sprintf("%s %s", icon, check.Name)
+	if check.Detail != "" {
+		line += ": " + check.Detail
+	}
+	fmt.Println(line)
+	if check.Hint != "" {
+		fmt.Printf("  └─ %s\n", check.Hint)
+	}
+}
+
+// failed returns how many checks failed
+func (r *doctorReport) failed() int {
+	n := 0
+	for _, check := range r.Checks {
+		if check.Status == doctorFail {
+			n++
+		}
+	}
+	return n
+}
+
+var doctorCmd = &cobra.Command{
+	Use:     "doctor",
+	Aliases: []string{"health"},
+	Short:   "Check the prerequisites and probe a tunnel end to end",
+	Long: `Check everything 'ssm-proxy start' needs and, with --target or
+--dns-server, probe a running tunnel like an application would.
+
+Prerequisites checked:
+  - root privileges (start creates a TUN device and routes)
+  - AWS credentials, verified with STS
+  - the ssh, aws and session-manager-plugin binaries (ssh transport)
+  - the instance: running, and its SSM Agent online
+  - EC2 Instance Connect support of the instance's operating system
+
+The instance is --instance-id, else that of the running session. The
+end-to-end probe connects to --target and resolves --dns-name through
+--dns-server, over the routes of the running sessions.
+
+Exits with status 1 if any check fails; warnings do not fail.
+
+Examples:
+  # Before the first start
+  ssm-proxy doctor --instance-id i-1234567890abcdef0
+
+  # Probe a running session's tunnel
+  ssm-proxy doctor --target 10.0.1.5:5432 --dns-server 10.0.0.2:53 --dns-name db.internal
+
+  # For scripts
+  ssm-proxy doctor --json`,
+	RunE: runDoctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().StringVar(&doctorInstanceID, "instance-id", "", "Instance to check (default: that of the running session)")
+	doctorCmd.Flags().StringVar(&doctorSession, "session-name", "", "Running session to check (default: the most recent)")
+	doctorCmd.Flags().StringVar(&doctorTransport, "transport", transportSSH, "Transport to check the prerequisites of: ssh or native")
+	doctorCmd.Flags().StringVar(&doctorTarget, "target", "", "host:port to connect to through the tunnel")
+	doctorCmd.Flags().StringVar(&doctorDNSServer, "dns-server", "", "DNS server (host:port) to query through the tunnel")
+	doctorCmd.Flags().StringVar(&doctorDNSName, "dns-name", "amazonaws.com", "Name to resolve with --dns-server")
+	doctorCmd.Flags().DurationVar(&doctorTimeout, "timeout", 30*time.Second, "Time limit for the AWS checks and each probe")
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Output the report in JSON format")
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	if err := validateTransport(doctorTransport); err != nil {
+		return err
+	}
+	for _, addr := range []string{doctorTarget, doctorDNSServer} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q (expected host:port): %w", addr, err)
+		}
+	}
+
+	// A failed check is reported, not a usage error
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+
+	report := &doctorReport{}
+	if !doctorJSON {
+		fmt.Println("✓ Checking prerequisites...")
+	}
+
+	report.add(checkRoot())
+	for _, binary := range []string{"ssh", "aws", "session-manager-plugin"} {
+		report.add(checkBinary(binary))
+	}
+
+	running := runningSessions()
+	instanceID := doctorInstanceID
+	if instanceID == "" && len(running) > 0 {
+		instanceID = running[0].InstanceID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	client, err := newAWSClient(ctx)
+	if err != nil {
+		report.add(doctorCheck{Name: "AWS credentials", Status: doctorFail, Detail: err.Error(),
+			Hint: "configure credentials with 'aws configure' or 'aws sso login', or pass --profile"})
+	} else {
+		report.add(checkCredentials(ctx, client))
+		checks, target := checkInstance(ctx, client, instanceID)
+		for _, check := range checks {
+			report.add(check)
+		}
+		report.add(checkPermissions(ctx, client, target))
+	}
+
+	if !doctorJSON {
+		fmt.Println()
+		fmt.Println("✓ Probing the tunnel...")
+	}
+	for _, check := range probeTunnel(running) {
+		report.add(check)
+	}
+
+	report.Passed = report.failed() == 0
+	if doctorJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println()
+		if report.Passed {
+			fmt.Println("✓ All checks passed")
+		} else {
+			fmt.Printf("✗ %d check(s) failed\n", report.failed())
+		}
+	}
+
+	if !report.Passed {
+		return &exitError{code: 1}
+	}
+	return nil
+}
+
+// runningSessions returns the sessions whose process is running, most
+// recent first, or just --session-name
+func runningSessions() []*session.Session {
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+
+	sessions, err := sessionMgr.ListAll()
+	if err != nil {
+		log.Debugf("Failed to list sessions: %v", err)
+		return nil
+	}
+	var running []*session.Session
+	for _, sess := range sessions {
+		if doctorSession != "" && sess.Name != doctorSession {
+			continue
+		}
+		if isProcessRunning(sess.PID) {
+			running = append(running, sess)
+		}
+	}
+	return running
+}
+
+// checkRoot checks that start would be allowed to create the TUN device
+func checkRoot() doctorCheck {
+	check := doctorCheck{Name: "Root privileges"}
+	if isRoot() {
+		check.Status = doctorPass
+		check.Detail = "running as root"
+		return check
+	}
+	if helperSupported {
+		if _, helperVersion, err := helper.Dial(helper.SocketPath); err == nil {
+			check.Status = doctorPass
+			check.Detail = "privileged helper " + helperVersion + " is running"
+			return check
+		}
+	}
+	check.Status = doctorFail
+	check.Detail = "not running as root"
+	check.Hint = "run 'sudo -E ssm-proxy start' (socks, forward and connect do not need root)"
+	if helperSupported {
+		check.Hint += ", or install the privileged helper once with 'sudo ssm-proxy helper install'"
+	}
+	return check
+}
+
+// checkBinary checks that an external binary of the ssh transport is
+// installed
+func checkBinary(name string) doctorCheck {
+	check := doctorCheck{Name: "Binary " + name}
+	if doctorTransport == transportNative {
+		check.Status = doctorSkip
+		check.Detail = "not needed by the native transport"
+		return check
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = "not found in $PATH"
+		check.Hint = map[string]string{
+			"ssh":                    "install OpenSSH, or use --transport native",
+			"aws":                    "install the AWS CLI (https://aws.amazon.com/cli/), or use --transport native",
+			"session-manager-plugin": "install the Session Manager plugin (https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html), or use --transport native",
+		}[name]
+		return check
+	}
+	check.Status = doctorPass
+	check.Detail = path
+	return check
+}
+
+// checkCredentials verifies the AWS credentials with STS and warns if
+// they expire soon
+func checkCredentials(ctx context.Context, client *aws.Client) doctorCheck {
+	check := doctorCheck{Name: "AWS credentials"}
+	arn, err := client.CallerIdentity(ctx)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "refresh the credentials ('aws sso login' for SSO profiles) or pass --profile"
+		return check
+	}
+
+	check.Status = doctorPass
+	check.Detail = fmt.Sprintf("%s in %s", arn, client.Region())
+	if expiry, err := client.CredentialExpiry(ctx); err == nil {
+		if at := expiry.Earliest(); !at.IsZero() && time.Until(at) < doctorCredentialWarning {
+			check.Status = doctorWarn
+			check.Detail += fmt.Sprintf(", expiring in %s", time.Until(at).Round(time.Minute))
+			check.Hint = "refresh the credentials before starting a long session"
+		}
+	}
+	return check
+}
+
+// checkPermissions simulates the caller's IAM policies for the
+// permissions start needs, for any instance if none is given
+func checkPermissions(ctx context.Context, client *aws.Client, instanceID string) doctorCheck {
+	check := doctorCheck{Name: "IAM permissions"}
+	caller, err := client.CallerIdentity(ctx)
+	if err != nil {
+		check.Status = doctorSkip
+		check.Detail = "no caller identity"
+		return check
+	}
+	if instanceID == "" {
+		instanceID = "*"
+	}
+	results, err := client.CheckPermissions(ctx, caller, client.RequiredPermissions(caller, instanceID))
+	if errors.Is(err, aws.ErrSimulationUnavailable) {
+		check.Status = doctorSkip
+		check.Detail = err.Error()
+		check.Hint = "allow iam:SimulatePrincipalPolicy (and iam:GetRole for roles) to check permissions"
+		return check
+	}
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	var missing, optional []string
+	for _, r := range results {
+		switch {
+		case r.Allowed:
+		case r.Optional:
+			optional = append(optional, fmt.Sprintf("%s (%s)", r.Permission, r.Purpose))
+		default:
+			missing = append(missing, fmt.Sprintf("%s (%s)", r.Permission, r.Purpose))
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		check.Status = doctorFail
+		check.Detail = "missing " + strings.Join(missing, "; ")
+		check.Hint = "ask your AWS administrator to grant them to " + caller
+	case len(optional) > 0:
+		check.Status = doctorWarn
+		check.Detail = "missing " + strings.Join(optional, "; ")
+		check.Hint = "--auto-cidr will not work without them"
+	default:
+		check.Status = doctorPass
+		check.Detail = fmt.Sprintf("all %d allowed for %s", len(results), caller)
+	}
+	return check
+}
+
+// checkInstance checks the instance's state, its SSM Agent and whether its
+// operating system supports EC2 Instance Connect. It also returns the SSM
+// target ID of the instance, "" if not found.
+func checkInstance(ctx context.Context, client *aws.Client, instanceID string) ([]doctorCheck, string) {
+	if instanceID == "" {
+		hint := "pass --instance-id"
+		return []doctorCheck{
+			{Name: "Instance", Status: doctorSkip, Detail: "no instance given and no running session", Hint: hint},
+			{Name: "EC2 Instance Connect", Status: doctorSkip, Detail: "no instance"},
+		}, ""
+	}
+
+	check := doctorCheck{Name: "Instance " + instanceID}
+	instance, err := client.GetInstance(ctx, instanceID)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "check the instance ID and --region"
+		return []doctorCheck{check, {Name: "EC2 Instance Connect", Status: doctorSkip, Detail: "instance not found"}}, ""
+	}
+	if aws.TargetKind(instanceID) == aws.TargetECS {
+		return []doctorCheck{checkECSTarget(instance), checkInstanceConnect(instance.InstanceID, nil)}, instance.InstanceID
+	}
+
+	info, err := client.AgentInfo(ctx, instanceID)
+	switch {
+	case err != nil:
+		check.Status = doctorFail
+		check.Detail = err.Error()
+	case instance.State != "running":
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s is %s", instance.Name, instance.State)
+		check.Hint = fmt.Sprintf("start it with 'aws ec2 start-instances --instance-ids %s'", instanceID)
+	case info == nil:
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s is running but not registered with SSM", instance.Name)
+		check.Hint = "attach an instance profile with the AmazonSSMManagedInstanceCore policy and make sure the SSM Agent can reach the SSM endpoints"
+	case info.PingStatus != "Online":
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s: SSM Agent %s is %s", instance.Name, info.AgentVersion, info.PingStatus)
+		check.Hint = "check that the SSM Agent runs on the instance and can reach the SSM endpoints"
+	default:
+		check.Status = doctorPass
+		check.Detail = fmt.Sprintf("%s running in %s, SSM Agent %s online (%s %s)",
+			instance.Name, instance.AvailabilityZone, info.AgentVersion, info.PlatformName, info.PlatformVersion)
+	}
+	return []doctorCheck{check, checkInstanceConnect(instanceID, info)}, instanceID
+}
+
+// checkECSTarget checks that an ECS task's container runs the ECS Exec
+// agent
+func checkECSTarget(instance *aws.Instance) doctorCheck {
+	check := doctorCheck{Name: "ECS task " + instance.InstanceID}
+	switch {
+	case instance.State != "running":
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("container %s: task is %s", instance.Name, instance.State)
+	case !instance.SSMConnected:
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("container %s: ECS Exec agent not running", instance.Name)
+		check.Hint = "run the task with --enable-execute-command and a task role allowing ssmmessages:*"
+	default:
+		check.Status = doctorPass
+		check.Detail = fmt.Sprintf("container %s running in %s, ECS Exec agent running", instance.Name, instance.AvailabilityZone)
+	}
+	return check
+}
+
+// checkInstanceConnect tells from the instance's operating system whether
+// it accepts keys sent with EC2 Instance Connect, which start uses to log
+// in. The package is preinstalled on Amazon Linux 2 and 2023 and Ubuntu
+// 20.04 and later; other Linux distributions need it installed.
+func checkInstanceConnect(instanceID string, info *aws.AgentInfo) doctorCheck {
+	check := doctorCheck{Name: "EC2 Instance Connect"}
+	if !aws.UsesInstanceConnect(instanceID) {
+		check.Status = doctorSkip
+		check.Detail = "not available on managed instances and ECS tasks"
+		check.Hint = "add a key from ~/.ssh to the SSH user's authorized_keys on the target"
+		return check
+	}
+	if info == nil {
+		check.Status = doctorSkip
+		check.Detail = "the operating system is only known for instances registered with SSM"
+		return check
+	}
+
+	platform := strings.TrimSpace(info.PlatformName + " " + info.PlatformVersion)
+	// Versions like 2023.5.20240805: major and minor are enough
+	fields := strings.SplitN(info.PlatformVersion, ".", 3)
+	version, _ := strconv.ParseFloat(strings.Join(fields[:min(len(fields), 2)], "."), 64)
+	switch {
+	case info.PlatformType != "Linux":
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("not supported on %s (%s)", info.PlatformType, platform)
+		check.Hint = "use a Linux instance"
+	case info.PlatformName == "Amazon Linux" && (version == 2 || version >= 2023):
+		check.Status = doctorPass
+		check.Detail = "preinstalled on " + platform
+	case info.PlatformName == "Ubuntu" && version >= 20.04:
+		check.Status = doctorPass
+		check.Detail = "preinstalled on " + platform
+	default:
+		check.Status = doctorWarn
+		check.Detail = "not preinstalled on " + platform
+		check.Hint = "install the ec2-instance-connect package on the instance"
+	}
+	return check
+}
+
+// probeTunnel connects to --target and resolves --dns-name through
+// --dns-server over the routes, like an application would
+func probeTunnel(running []*session.Session) []doctorCheck {
+	var checks []doctorCheck
+	if len(running) == 0 {
+		checks = append(checks, doctorCheck{Name: "Tunnel", Status: doctorSkip, Detail: "no running session",
+			Hint: "start one with 'sudo -E ssm-proxy start' to probe it"})
+	} else {
+		sess := running[0]
+		check := doctorCheck{Name: "Tunnel", Status: doctorPass, Detail: fmt.Sprintf("session %s via %s", sess.Name, sess.TunDevice)}
+		if !sess.TunnelUp {
+			check.Status = doctorFail
+			check.Detail = fmt.Sprintf("session %s reports its tunnel down", sess.Name)
+			if sess.HealthError != "" {
+				check.Detail += ": " + sess.HealthError
+			}
+			check.Hint = "see 'ssm-proxy status' and the session's log"
+		}
+		checks = append(checks, check)
+	}
+
+	if doctorTarget == "" && doctorDNSServer == "" {
+		return append(checks, doctorCheck{Name: "End-to-end probe", Status: doctorSkip, Detail: "nothing to probe",
+			Hint: "pass --target host:port and/or --dns-server host:port"})
+	}
+
+	var cidrs []string
+	for _, s := range running {
+		cidrs = append(cidrs, s.CIDRBlocks...)
+	}
+	config := health.SelfTestConfig{Endpoint: doctorTarget, Samples: 3, Timeout: doctorTimeout}
+	if doctorDNSServer != "" {
+		config.DNSServer = doctorDNSServer
+		config.DNSName = doctorDNSName
+	}
+	for _, addr := range []string{config.DNSServer, config.Endpoint} {
+		if addr != "" && !routedBy(addr, cidrs) {
+			checks = append(checks, doctorCheck{Name: "Route to " + addr, Status: doctorWarn,
+				Detail: "not in a CIDR block of a running session, so it is not reached through the tunnel"})
+		}
+	}
+
+	report := health.SelfTest(context.Background(), &net.Dialer{}, config)
+	for _, step := range report.Steps {
+		check := doctorCheck{Name: step.Name, Status: doctorPass, Detail: step.Detail}
+		if step.Err != nil {
+			check.Status = doctorFail
+			check.Detail = step.Err.Error()
+			check.Hint = "check the security groups and network ACLs between the instance and the destination"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
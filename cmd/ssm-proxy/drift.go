@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+)
+
+// driftMonitor verifies, on every health check, that the routes and DNS
+// resolver files set up at start are still in place. Other VPN clients,
+// DHCP renewals and network changes can silently replace them.
+type driftMonitor struct {
+	router   *routing.Router
+	resolver *dns.SystemResolverConfig // nil if DNS is not configured
+	repair   bool
+
+	counts     session.DriftCounts
+	drifted    map[string]bool // routes currently drifted
+	dnsDrifted bool
+}
+
+// newDriftMonitor creates a drift monitor; with repair unset it only warns
+func newDriftMonitor(router *routing.Router, resolver *dns.SystemResolverConfig, repair bool) *driftMonitor {
+	return &driftMonitor{
+		router:   router,
+		resolver: resolver,
+		repair:   repair,
+		drifted:  make(map[string]bool),
+	}
+}
+
+// check verifies routes and resolver files, repairing them if enabled. It
+// reports whether the drift counts changed.
+func (d *driftMonitor) check(ctx context.Context) bool {
+	before := d.counts
+
+	stillDrifted := make(map[string]bool)
+	for _, cidr := range d.router.DriftedRoutes() {
+		isNew := !d.drifted[cidr]
+		if isNew {
+			d.counts.RoutesDrifted++
+			log.Warnf("Route drift: %s no longer goes through the tunnel", cidr)
+		}
+
+		if !d.repair {
+			stillDrifted[cidr] = true
+			continue
+		}
+		if err := d.router.RepairRoute(ctx, cidr); err != nil {
+			if isNew {
+				log.Warnf("Failed to repair route %s: %v", cidr, err)
+			} else {
+				log.Debugf("Failed to repair route %s: %v", cidr, err)
+			}
+			stillDrifted[cidr] = true
+			continue
+		}
+		d.counts.RoutesRepaired++
+		log.Infof("Route %s reinstalled", cidr)
+	}
+	d.drifted = stillDrifted
+
+	if d.resolver != nil {
+		if d.resolver.Verify() {
+			d.dnsDrifted = false
+		} else {
+			isNew := !d.dnsDrifted
+			if isNew {
+				d.counts.DNSDrifted++
+				log.Warn("DNS drift: resolver configuration was changed or removed")
+			}
+
+			d.dnsDrifted = true
+			if d.repair {
+				if err := d.resolver.Repair(); err != nil {
+					if isNew {
+						log.Warnf("Failed to repair DNS resolver configuration: %v", err)
+					} else {
+						log.Debugf("Failed to repair DNS resolver configuration: %v", err)
+					}
+				} else {
+					d.counts.DNSRepaired++
+					d.dnsDrifted = false
+				}
+			}
+		}
+	}
+
+	return d.counts != before
+}
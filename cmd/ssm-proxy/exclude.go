@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+)
+
+// exclusion is a CIDR block inside a tunnel's routes kept out of the
+// tunnel, with the next hop it had before they were added
+type exclusion struct {
+	cidr string
+	hop  routing.NextHop
+	note string // what it is, e.g. "excluded"
+}
+
+// validateExclusions checks the --exclude-cidr blocks
+func validateExclusions(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid --exclude-cidr %s: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+// excluded reports whether the network lies within an --exclude-cidr block
+func excluded(network *net.IPNet) bool {
+	ones, _ := network.Mask.Size()
+	for _, cidr := range excludeCIDRs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		blockOnes, _ := block.Mask.Size()
+		if blockOnes <= ones && block.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// planExclusions returns the excluded blocks (of --exclude-cidr, or pinned
+// host routes) inside the tunnel's CIDR blocks with the next hop the system
+// uses for them now. Must be called before the tunnel's routes are added.
+// A block covering a whole routed one is an error: nothing would be left to
+// route.
+func planExclusions(cidrs, excludes []string, note string) ([]exclusion, error) {
+	var routed []netip.Prefix
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			routed = append(routed, prefix.Masked())
+		}
+	}
+
+	var exclusions []exclusion
+	for _, cidr := range excludes {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded block %s: %w", cidr, err)
+		}
+		prefix = prefix.Masked()
+
+		inside := false
+		for _, block := range routed {
+			if block.Overlaps(prefix) && prefix.Bits() <= block.Bits() {
+				return nil, fmt.Errorf("excluded block %s covers all of %s (leave %s out of the routed blocks instead)", cidr, block, block)
+			}
+			inside = inside || block.Contains(prefix.Addr())
+		}
+		if !inside {
+			log.Debugf("Excluded block %s is outside the tunnel's routes, nothing to exclude", cidr)
+			continue
+		}
+
+		hop, err := routing.RouteNextHop(prefix.Addr().String())
+		if err != nil {
+			return nil, fmt.Errorf("no route outside the tunnel for %s: %w", cidr, err)
+		}
+		exclusions = append(exclusions, exclusion{cidr: prefix.String(), hop: hop, note: note})
+	}
+	return exclusions, nil
+}
+
+// addExclusions adds a route for each exclusion via its original next hop,
+// more specific than the tunnel's routes covering it. Like those, the
+// routes are removed by router.Cleanup.
+func addExclusions(ctx context.Context, router *routing.Router, exclusions []exclusion) error {
+	if len(exclusions) == 0 {
+		return nil
+	}
+
+	fmt.Println("✓ Excluding CIDR blocks from the tunnel...")
+	var failed []string
+	for _, ex := range exclusions {
+		if err := router.AddBypassRoute(ctx, ex.cidr, ex.hop); err != nil {
+			fmt.Printf("  └─ %s ✗ %v\n", ex.cidr, err)
+			failed = append(failed, ex.cidr)
+			continue
+		}
+		fmt.Printf("  └─ %s → %s (%s)\n", ex.cidr, ex.hop, ex.note)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to exclude %s from the tunnel", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+)
+
+// failoverEnabled moves a tunnel to another instance matching its tag when
+// its instance goes down (--failover)
+var failoverEnabled bool
+
+// failoverTunnel is a tunnel to an instance found by tag. When restarting
+// it finds its instance stopped, terminated or with its SSM Agent offline,
+// it connects to another SSM-connected instance with the same tag instead,
+// on the same SOCKS5 port so that the forwarder, routes and DNS stay as
+// they are. The SSH key is pushed to the new instance as on start.
+type failoverTunnel struct {
+	account  awsAccount
+	tag      string
+	recorder *record.Writer
+
+	mu         sync.Mutex
+	active     socksTunnel
+	instanceID string
+	onSwitch   func(instanceID string) // called after moving to another instance
+}
+
+// newFailoverTunnel wraps the tunnel to an instance found by tag
+func newFailoverTunnel(active socksTunnel, account awsAccount, instanceID, tag string, recorder *record.Writer) *failoverTunnel {
+	return &failoverTunnel{account: account, tag: tag, recorder: recorder, active: active, instanceID: instanceID}
+}
+
+// setOnSwitch sets the function called with the new instance after a
+// failover
+func (f *failoverTunnel) setOnSwitch(onSwitch func(instanceID string)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onSwitch = onSwitch
+}
+
+// current returns the active tunnel and its instance
+func (f *failoverTunnel) current() (socksTunnel, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.instanceID
+}
+
+// Start restarts the tunnel to its instance if that is still up, or else
+// fails over to another instance with the tag
+func (f *failoverTunnel) Start(ctx context.Context) error {
+	active, instanceID := f.current()
+
+	awsClient, err := f.account.client(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+
+	// Without an answer the instance may well be fine and the network not:
+	// it is retried as usual
+	instance, err := awsClient.GetInstance(ctx, instanceID)
+	switch {
+	case errors.Is(err, aws.ErrInstanceNotFound):
+		log.Warnf("Instance %s is gone, failing over to another instance with tag %s", instanceID, f.tag)
+	case err != nil, instance.State == "running" && instance.SSMConnected:
+		return active.Start(ctx)
+	default:
+		log.Warnf("Instance %s is %s (SSM connected: %t), failing over to another instance with tag %s",
+			instanceID, instance.State, instance.SSMConnected, f.tag)
+	}
+
+	key, value, _ := strings.Cut(f.tag, "=")
+	instances, err := awsClient.FindInstancesByTag(ctx, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to find instances for failover: %w", err)
+	}
+	instances = slices.DeleteFunc(instances, func(candidate *aws.Instance) bool {
+		return candidate.InstanceID == instanceID || !candidate.SSMConnected
+	})
+	if len(instances) == 0 {
+		return fmt.Errorf("no other SSM-connected instance with tag %s to fail over to", f.tag)
+	}
+
+	// Without a strategy any healthy instance will do
+	strategy := selectStrategy
+	if strategy == aws.SelectNone {
+		strategy = aws.SelectRandom
+	}
+	target, reason := instances[0], ""
+	if len(instances) > 1 {
+		if target, reason, err = awsClient.SelectInstance(ctx, instances, strategy, selectTargetAddr()); err != nil {
+			return fmt.Errorf("failed to select an instance for failover: %w", err)
+		}
+	}
+
+	// The new tunnel takes over the SOCKS5 port the forwarder uses
+	if err := active.Stop(); err != nil {
+		log.Warnf("Failed to stop the tunnel to %s: %v", instanceID, err)
+	}
+	_, portText, err := net.SplitHostPort(active.SOCKSAddr())
+	if err != nil {
+		return fmt.Errorf("invalid SOCKS5 address %s: %w", active.SOCKSAddr(), err)
+	}
+	port, _ := strconv.Atoi(portText)
+	replacement, _, err := connectTunnel(ctx, f.account, target.InstanceID, "", port, f.recorder)
+	if err != nil {
+		return fmt.Errorf("failed to fail over to %s: %w", target.InstanceID, err)
+	}
+
+	f.mu.Lock()
+	f.active, f.instanceID = replacement, target.InstanceID
+	onSwitch := f.onSwitch
+	f.mu.Unlock()
+
+	if reason != "" {
+		reason = " (" + reason + ")"
+	}
+	log.Warnf("Failed over from %s to %s%s", instanceID, target.InstanceID, reason)
+	if onSwitch != nil {
+		onSwitch(target.InstanceID)
+	}
+	return nil
+}
+
+// Stop stops the active tunnel
+func (f *failoverTunnel) Stop() error {
+	active, _ := f.current()
+	return active.Stop()
+}
+
+// IsRunning returns whether the active tunnel is up
+func (f *failoverTunnel) IsRunning() bool {
+	active, _ := f.current()
+	return active.IsRunning()
+}
+
+// SOCKSAddr returns the SOCKS5 address, the same across failovers
+func (f *failoverTunnel) SOCKSAddr() string {
+	active, _ := f.current()
+	return active.SOCKSAddr()
+}
+
+// SessionID returns the SSM session of the active tunnel
+func (f *failoverTunnel) SessionID() string {
+	active, _ := f.current()
+	return ssmSessionID(active)
+}
+
+// Disconnect drops the transport of the active tunnel (for --chaos)
+func (f *failoverTunnel) Disconnect() error {
+	active, _ := f.current()
+	disconnecter, ok := active.(interface{ Disconnect() error })
+	if !ok {
+		return fmt.Errorf("this transport cannot be disconnected")
+	}
+	return disconnecter.Disconnect()
+}
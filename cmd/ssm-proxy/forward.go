@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+	"github.com/sbkg0002/ssm-proxy/internal/portforward"
+	"github.com/spf13/cobra"
+)
+
+var forwardSpecs []string
+
+var forwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Forward local TCP ports to hosts behind the instance",
+	Long: `Forward local TCP ports through the SSM/SSH tunnel, like ssh -L, without
+a TUN device or route changes. This does not require root.
+
+Each -L takes [bind_address:]port:host:hostport. Connections to the local
+port (on 127.0.0.1 unless a bind address is given) are forwarded to
+host:hostport as seen from the instance. -L can be repeated.
+
+Examples:
+  # Reach a database in the VPC on localhost:5432
+  ssm-proxy forward --instance-id i-1234567890abcdef0 -L 5432:db.internal:5432
+
+  # Several mappings in one invocation
+  ssm-proxy forward --instance-tag Name=bastion \
+    -L 5432:db.internal:5432 -L 6379:cache.internal:6379
+
+  # Listen on all interfaces
+  ssm-proxy forward --instance-id i-1234567890abcdef0 -L 0.0.0.0:8080:10.0.1.5:80`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if instanceID == "" && instanceTag == "" {
+			return fmt.Errorf("either --instance-id or --instance-tag is required")
+		}
+		if instanceID != "" && instanceTag != "" {
+			return fmt.Errorf("cannot specify both --instance-id and --instance-tag")
+		}
+		if len(forwardSpecs) == 0 {
+			return fmt.Errorf("at least one -L mapping is required")
+		}
+		for _, spec := range forwardSpecs {
+			if _, err := portforward.ParseMapping(spec); err != nil {
+				return err
+			}
+		}
+		return validateTransport(transport)
+	},
+	RunE: runForward,
+}
+
+func init() {
+	rootCmd.AddCommand(forwardCmd)
+
+	forwardCmd.Flags().StringVar(&instanceID, "instance-id", "", "EC2 instance ID (e.g., i-1234567890abcdef0)")
+	forwardCmd.Flags().StringVar(&instanceTag, "instance-tag", "", "Find instance by tag (format: Key=Value)")
+	forwardCmd.Flags().StringArrayVarP(&forwardSpecs, "local", "L", nil, "Forward [bind_address:]port:host:hostport (can be repeated)")
+	forwardCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Always generate temporary SSH key (ignore existing keys)")
+	forwardCmd.Flags().StringVar(&transport, "transport", transportSSH, "How the SSH tunnel is run: ssh or native (in process)")
+	forwardCmd.Flags().DurationVar(&keepAlive, "keep-alive", 30*time.Second, "Keep-alive interval: SSH ServerAliveInterval and tunnel health-check period")
+	forwardCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Connection timeout: SSH connect and SOCKS5 dials to destinations")
+}
+
+func runForward(cmd *cobra.Command, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mappings := make([]portforward.Mapping, 0, len(forwardSpecs))
+	for _, spec := range forwardSpecs {
+		m, err := portforward.ParseMapping(spec)
+		if err != nil {
+			return err
+		}
+		mappings = append(mappings, m)
+	}
+
+	port, err := netutil.FreeLocalPort()
+	if err != nil {
+		return fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+	}
+
+	sshTunnel, _, err := connectTunnel(ctx, defaultAWSAccount(), instanceID, instanceTag, port, nil)
+	if err != nil {
+		return err
+	}
+	defer sshTunnel.Stop()
+
+	fwd := portforward.New(sshTunnel.SOCKSAddr(), timeout)
+	defer fwd.Close()
+
+	fmt.Println("✓ Forwarding ports:")
+	for i, m := range mappings {
+		bound, err := fwd.Listen(m)
+		if err != nil {
+			return err
+		}
+		prefix := "├─"
+		if i == len(mappings)-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("  %s %s\n", prefix, bound)
+	}
+	fmt.Println("\nPress Ctrl+C to stop...")
+
+	sig := keepTunnelUp(ctx, sshTunnel)
+	fmt.Printf("\n✓ Received %v, stopping port forwarding\n", sig)
+	return nil
+}
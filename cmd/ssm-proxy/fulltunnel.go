@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+)
+
+// fullTunnelCIDRs route all IPv4 traffic through the tunnel. Being more
+// specific than the default route, they win over it without replacing it,
+// so it is still there for the pinned routes and after shutdown.
+var fullTunnelCIDRs = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// nameserverPins returns host routes for the system's DNS servers, which
+// must stay reachable outside the tunnel in full-tunnel mode: reconnecting
+// resolves the SSM endpoints, and cannot do so through the tunnel it is
+// re-establishing
+func nameserverPins() []string {
+	var pins []string
+	for _, addr := range dns.SystemNameservers() {
+		if addr.Is4() {
+			pins = append(pins, netip.PrefixFrom(addr, addr.BitLen()).String())
+		}
+	}
+	return pins
+}
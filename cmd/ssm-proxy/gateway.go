@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+)
+
+// gatewayPeer selects the TUN device's peer address as gateway
+const gatewayPeer = "peer"
+
+// routedDevice is a device the routes point at: the TUN device, or the
+// WireGuard device of the wireguard transport
+type routedDevice interface {
+	Name() string
+	SetPeer(peer string) error
+}
+
+// parseRouteVia parses a --route-via value, CIDR=VIA
+func parseRouteVia(spec string) (cidr, via string, err error) {
+	cidr, via, ok := strings.Cut(spec, "=")
+	if !ok || cidr == "" || via == "" {
+		return "", "", fmt.Errorf("invalid --route-via %q (expected CIDR=interface, CIDR=peer or CIDR=GATEWAY-IP)", spec)
+	}
+	if err := validateCIDR(cidr); err != nil {
+		return "", "", fmt.Errorf("invalid --route-via %q: %w", spec, err)
+	}
+	if err := validateGateway(via, true); err != nil {
+		return "", "", fmt.Errorf("invalid --route-via %q: %w", spec, err)
+	}
+	return cidr, via, nil
+}
+
+// validateGateway checks a --route-gateway (or, with override set,
+// --route-via) target
+func validateGateway(via string, override bool) error {
+	switch {
+	case via == gatewayPeer:
+		return nil
+	case via == routing.ViaInterface && override:
+		return nil
+	case net.ParseIP(via).To4() != nil:
+		return nil
+	}
+	if override {
+		return fmt.Errorf("gateway must be %q, %q or an IPv4 address", routing.ViaInterface, gatewayPeer)
+	}
+	return fmt.Errorf("gateway must be %q or an IPv4 address", gatewayPeer)
+}
+
+// configureGateways sets up the router for --route-gateway and --route-via.
+// A gateway on the TUN device's subnet becomes its point-to-point peer; that
+// address is returned (nil if there is none) so the forwarder can answer
+// for it. localIP is the TUN device's address.
+func configureGateways(router *routing.Router, tun routedDevice, localIP string) (net.IP, error) {
+	if routeGateway == "" && len(routeVia) == 0 {
+		return nil, nil
+	}
+
+	_, tunNet, err := net.ParseCIDR(localIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --local-ip %s: %w", localIP, err)
+	}
+
+	var peer net.IP
+	resolve := func(via string) (string, error) {
+		if via == routing.ViaInterface {
+			return via, nil
+		}
+
+		ip := net.ParseIP(via)
+		if via == gatewayPeer {
+			if ip, err = tunnel.PeerAddress(localIP); err != nil {
+				return "", err
+			}
+		}
+		if tunNet.Contains(ip) {
+			if peer != nil && !peer.Equal(ip) {
+				return "", fmt.Errorf("gateways %s and %s are both on the TUN subnet %s (only one peer address is possible)", peer, ip, tunNet)
+			}
+			peer = ip
+		}
+		return ip.String(), nil
+	}
+
+	if routeGateway != "" {
+		gateway, err := resolve(routeGateway)
+		if err != nil {
+			return nil, err
+		}
+		if err := router.SetGateway(gateway); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range routeVia {
+		cidr, via, err := parseRouteVia(spec)
+		if err != nil {
+			return nil, err
+		}
+		gateway, err := resolve(via)
+		if err != nil {
+			return nil, err
+		}
+		if err := router.SetGatewayOverride(cidr, gateway); err != nil {
+			return nil, err
+		}
+	}
+
+	if peer != nil {
+		if err := tun.SetPeer(peer.String()); err != nil {
+			return nil, err
+		}
+	}
+	return peer, nil
+}
+
+// routeTarget describes where the route for the CIDR block points
+func routeTarget(router *routing.Router, cidr, tunName string) string {
+	if gateway := router.Gateway(cidr); gateway != "" {
+		return fmt.Sprintf("%s (gateway)", gateway)
+	}
+	return tunName
+}
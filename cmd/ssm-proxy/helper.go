@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
+	"github.com/spf13/cobra"
+)
+
+// helperUser is the user the privileged helper works for
+var helperUser string
+
+// Settings of a privileged helper started by a session (--drop-privileges)
+var (
+	helperSocket  string
+	helperDevices []string
+	helperSession bool
+)
+
+var helperCmd = &cobra.Command{
+	Use:   "helper",
+	Short: "Let a user start the proxy without sudo (macOS)",
+	Long: `Install the privileged helper: a small launchd daemon running as root that
+creates utun devices, changes routes and writes /etc/resolver files for one
+user, so that this user can run 'ssm-proxy start' and 'stop' without sudo.
+
+The helper listens on ` + helper.SocketPath + `, which only root and that user
+may use. It only configures utun devices it created itself, only runs route
+add, change, delete and get, and only touches files in /etc/resolver and
+ssm-proxy's own supplemental resolvers. Its log is
+/Library/Logs/ssm-proxy/helper.log.
+
+Examples:
+  # Once, for the user running sudo
+  sudo ssm-proxy helper install
+
+  # From then on
+  ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/8
+
+  # Check that it is running
+  ssm-proxy helper status`,
+}
+
+var helperInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install and start the privileged helper for a user",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		requireRoot()
+		return nil
+	},
+	RunE: runHelperInstall,
+}
+
+var helperUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stop and remove the privileged helper",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		requireRoot()
+		return nil
+	},
+	RunE: runHelperUninstall,
+}
+
+var helperStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Check that the privileged helper is running and lets this user in",
+	RunE:  runHelperStatus,
+}
+
+var helperRunCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Run the privileged helper (started by launchd)",
+	Hidden: true,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		requireRoot()
+		return nil
+	},
+	RunE: runHelper,
+}
+
+func init() {
+	rootCmd.AddCommand(helperCmd)
+	helperCmd.AddCommand(helperInstallCmd)
+	helperCmd.AddCommand(helperUninstallCmd)
+	helperCmd.AddCommand(helperStatusCmd)
+	helperCmd.AddCommand(helperRunCmd)
+
+	helperInstallCmd.Flags().StringVar(&helperUser, "user", "", "User to run the proxy as (name or UID) (default: the user running sudo)")
+	helperRunCmd.Flags().StringVar(&helperUser, "user", "", "User the helper works for (name or UID)")
+	helperRunCmd.Flags().StringVar(&helperSocket, "socket", helper.SocketPath, "Socket to listen on")
+	helperRunCmd.Flags().StringSliceVar(&helperDevices, "device", []string{}, "utun devices created before the helper that it may configure (repeatable)")
+	helperRunCmd.Flags().BoolVar(&helperSession, "session", false, "Serve one session, stopping when stdin closes")
+}
+
+// errHelperUnsupported is returned by the helper commands where there is
+// no privileged helper
+var errHelperUnsupported = errors.New("the privileged helper is only available on macOS; use sudo")
+
+func runHelperStatus(cmd *cobra.Command, args []string) error {
+	if !helperSupported {
+		return errHelperUnsupported
+	}
+	_, helperVersion, err := helper.Dial(helper.SocketPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println("✓ Privileged helper is running")
+	fmt.Printf("  ├─ Version: %s\n", helperVersion)
+	fmt.Printf("  └─ Socket: %s\n", helper.SocketPath)
+	if helperVersion != version {
+		fmt.Printf("\n⚠️  This is ssm-proxy %s; reinstall the helper with 'sudo ssm-proxy helper install'\n", version)
+	}
+	return nil
+}
+
+// helperUID returns the UID of --user, or of the user running sudo
+func helperUID() (int, error) {
+	name := helperUser
+	if name == "" {
+		name = os.Getenv("SUDO_UID")
+	}
+	if name == "" {
+		return -1, fmt.Errorf("--user is required when not running with sudo")
+	}
+
+	uid, err := strconv.Atoi(name)
+	if err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return -1, fmt.Errorf("unknown user %q: %w", name, err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, fmt.Errorf("invalid UID of user %q: %w", name, err)
+		}
+	}
+	if uid <= 0 {
+		return -1, fmt.Errorf("the helper is for a user other than root")
+	}
+	return uid, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// helperSupported tells whether this platform has the privileged helper
+const helperSupported = true
+
+// helperServiceName is the launchd label of the privileged helper
+const helperServiceName = "com.github.sbkg0002.ssm-proxy-helper"
+
+// Privileged helper timeouts
+const (
+	helperStartTimeout   = 5 * time.Second
+	helperCommandTimeout = 8 * time.Second
+)
+
+func runHelperInstall(cmd *cobra.Command, args []string) error {
+	uid, err := helperUID()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate ssm-proxy executable: %w", err)
+	}
+	spec := serviceSpec{
+		Name:    helperServiceName,
+		Args:    []string{exe, "helper", "run", "--user", strconv.Itoa(uid), "--verbose"},
+		LogPath: filepath.Join(serviceLogDir, "helper.log"),
+	}
+	if err := os.MkdirAll(serviceLogDir, 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	path := serviceFile(spec.Name)
+	if _, err := os.Stat(path); err == nil {
+		fmt.Println("✓ Replacing the privileged helper...")
+		if err := stopService(spec.Name); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("✓ Installing the privileged helper...")
+	}
+	if err := os.WriteFile(path, renderService(spec), 0644); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	if err := enableService(spec.Name); err != nil {
+		return err
+	}
+	if err := startService(spec.Name); err != nil {
+		return err
+	}
+	fmt.Printf("  ├─ Service file: %s\n", path)
+	fmt.Printf("  ├─ User: %d\n", uid)
+	fmt.Printf("  └─ Log: %s\n", spec.LogPath)
+
+	if _, err := waitForHelper(helper.SocketPath); err != nil {
+		return err
+	}
+	fmt.Println("\n✓ 'ssm-proxy start' and 'stop' no longer need sudo for this user")
+	return nil
+}
+
+func runHelperUninstall(cmd *cobra.Command, args []string) error {
+	path := serviceFile(helperServiceName)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("the privileged helper is not installed (%s)", path)
+	}
+
+	fmt.Println("✓ Removing the privileged helper...")
+	if err := stopService(helperServiceName); err != nil {
+		return err
+	}
+	if err := disableService(helperServiceName); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove service file: %w", err)
+	}
+	fmt.Printf("  └─ Removed %s\n", path)
+	return nil
+}
+
+// runHelper serves the privileged helper's socket until it is told to stop
+func runHelper(cmd *cobra.Command, args []string) error {
+	uid, err := helperUID()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(helperSocket), 0755); err != nil {
+		return fmt.Errorf("failed to create helper socket directory: %w", err)
+	}
+	// The user's sessions put their control sockets there
+	if helperSocket == helper.SocketPath {
+		if err := os.MkdirAll(control.DefaultDir, 0755); err != nil {
+			return fmt.Errorf("failed to create control socket directory: %w", err)
+		}
+		if err := os.Chown(control.DefaultDir, uid, -1); err != nil {
+			return fmt.Errorf("failed to set control socket directory owner: %w", err)
+		}
+	}
+
+	server, err := control.Listen(helperSocket, control.Access{OwnerUID: uid})
+	if err != nil {
+		return err
+	}
+	h := &helperServer{devices: make(map[string]bool)}
+	for _, name := range helperDevices {
+		h.devices[name] = true
+	}
+	h.register(server)
+	go server.Serve()
+	log.Infof("Privileged helper %s serving uid %d on %s", version, uid, helperSocket)
+
+	// The helper of a session stops with it, when its stdin closes
+	sessionEnded := make(chan struct{})
+	if helperSession {
+		go func() {
+			io.Copy(io.Discard, os.Stdin)
+			close(sessionEnded)
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		log.Infof("Received %s, stopping", sig)
+	case <-sessionEnded:
+		log.Info("Session ended, stopping")
+	}
+	return server.Close()
+}
+
+// waitForHelper waits until the privileged helper on socket answers
+func waitForHelper(socket string) (*helper.Client, error) {
+	deadline := time.Now().Add(helperStartTimeout)
+	for {
+		client, _, err := helper.Dial(socket)
+		if err == nil {
+			return client, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("helper did not come up within %s: %w", helperStartTimeout, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// sessionHelperStdin is the stdin of this process's privileged helper,
+// held open as long as the process runs
+var sessionHelperStdin *os.File
+
+// startSessionHelper starts a privileged helper serving only this process
+// (as the user uid, once it drops its privileges), which may configure
+// devices, and uses it for the privileged operations from then on. It
+// returns the helper's PID.
+func startSessionHelper(uid int, devices []string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate ssm-proxy executable: %w", err)
+	}
+	socket := filepath.Join(control.DefaultDir, fmt.Sprintf("helper-%d.sock", os.Getpid()))
+	args := []string{"helper", "run", "--user", strconv.Itoa(uid), "--socket", socket, "--session"}
+	for _, name := range devices {
+		args = append(args, "--device", name)
+	}
+	if debug {
+		args = append(args, "--debug")
+	} else if verbose {
+		args = append(args, "--verbose")
+	}
+
+	stdin, keep, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create pipe: %w", err)
+	}
+	child := exec.Command(exe, args...)
+	child.Stdin = stdin
+	child.Stdout = os.Stderr
+	child.Stderr = os.Stderr
+	// Ctrl+C must not stop it before this process has cleaned up
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = child.Start()
+	stdin.Close()
+	if err != nil {
+		keep.Close()
+		return 0, fmt.Errorf("failed to start privileged helper: %w", err)
+	}
+	sessionHelperStdin = keep
+	go child.Wait()
+
+	client, err := waitForHelper(socket)
+	if err != nil {
+		keep.Close()
+		return 0, err
+	}
+	tunnel.UseHelper(client)
+	routing.UseHelper(client)
+	dns.UseHelper(client)
+	log.Infof("Using the privileged helper %d at %s", child.Process.Pid, socket)
+	return child.Process.Pid, nil
+}
+
+// useHelper sends the privileged operations of this process to the
+// privileged helper, if it is running and lets this user in
+func useHelper() error {
+	client, helperVersion, err := helper.Dial(helper.SocketPath)
+	if err != nil {
+		return err
+	}
+	if helperVersion != version {
+		log.Warnf("The privileged helper is ssm-proxy %s, this is %s; reinstall it with 'sudo ssm-proxy helper install'", helperVersion, version)
+	}
+	tunnel.UseHelper(client)
+	routing.UseHelper(client)
+	dns.UseHelper(client)
+	log.Infof("Using the privileged helper at %s", helper.SocketPath)
+	return nil
+}
+
+// helperServer runs the privileged operations of one user's sessions
+type helperServer struct {
+	mu      sync.Mutex
+	devices map[string]bool // utun devices created for the user
+}
+
+// register adds the helper's methods to its socket; only root and the
+// user may call them
+func (h *helperServer) register(server *control.Server) {
+	server.Handle(helper.MethodVersion, control.ClassSessionAdmin, func(json.RawMessage) (any, error) {
+		return version, nil
+	})
+	server.Handle(helper.MethodTUNCreate, control.ClassSessionAdmin, h.createTUN)
+	server.Handle(helper.MethodIfconfig, control.ClassSessionAdmin, h.ifconfig)
+	server.Handle(helper.MethodRoute, control.ClassSessionAdmin, h.route)
+	server.Handle(helper.MethodScutil, control.ClassSessionAdmin, h.scutil)
+	server.Handle(helper.MethodResolverWrite, control.ClassSessionAdmin, h.writeResolverFile)
+	server.Handle(helper.MethodResolverRename, control.ClassSessionAdmin, h.renameResolverFile)
+	server.Handle(helper.MethodResolverRemove, control.ClassSessionAdmin, h.removeResolverFile)
+	server.Handle(helper.MethodDNSFlush, control.ClassSessionAdmin, func(json.RawMessage) (any, error) {
+		return nil, dns.FlushDNSCache()
+	})
+}
+
+// createTUN creates a utun device and passes it to the client
+func (h *helperServer) createTUN(json.RawMessage) (any, error) {
+	file, name, err := tunnel.OpenTUN()
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.devices[name] = true
+	h.mu.Unlock()
+
+	log.Infof("Created %s", name)
+	return control.File{Result: helper.TUNResult{Name: name}, File: file}, nil
+}
+
+// ifconfig configures a utun device created by createTUN
+func (h *helperServer) ifconfig(raw json.RawMessage) (any, error) {
+	var params helper.CommandParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	h.mu.Lock()
+	ours := h.devices[params.Name]
+	h.mu.Unlock()
+	if !ours {
+		return nil, fmt.Errorf("%s is not a utun device of the helper", params.Name)
+	}
+
+	log.Infof("ifconfig %s %s", params.Name, strings.Join(params.Args, " "))
+	return commandResult(tunnel.Ifconfig(params.Name, params.Args...)), nil
+}
+
+// route adds or deletes the route for a CIDR block to a utun device
+// created by createTUN; routes via a gateway, scoped or default routes
+// are refused
+func (h *helperServer) route(raw json.RawMessage) (any, error) {
+	var params helper.CommandParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	verb, cidr, name, err := routing.ParseInterfaceRoute(params.Args)
+	if err != nil {
+		log.Warnf("Refused route %s: %v", strings.Join(params.Args, " "), err)
+		return nil, fmt.Errorf("the privileged helper only adds and deletes routes to its own utun devices: %w", err)
+	}
+	h.mu.Lock()
+	ours := h.devices[name]
+	h.mu.Unlock()
+	if !ours {
+		log.Warnf("Refused route %s: %s is not a utun device of the helper", strings.Join(params.Args, " "), name)
+		return nil, fmt.Errorf("%s is not a utun device of the helper", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), helperCommandTimeout)
+	defer cancel()
+
+	log.Infof("route %s %s -interface %s", verb, cidr, name)
+	return commandResult(routing.InterfaceRouteCommand(ctx, verb, cidr, name)), nil
+}
+
+// scutil sets, shows or removes one of ssm-proxy's supplemental resolvers
+func (h *helperServer) scutil(raw json.RawMessage) (any, error) {
+	var params helper.CommandParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	log.Infof("scutil: %s", strings.ReplaceAll(strings.TrimSpace(params.Input), "\n", "; "))
+	return commandResult(dns.Scutil(params.Input)), nil
+}
+
+// writeResolverFile writes a file in /etc/resolver
+func (h *helperServer) writeResolverFile(raw json.RawMessage) (any, error) {
+	var params helper.FileParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	log.Infof("Writing %s", params.Path)
+	return nil, dns.WriteResolverFile(params.Path, params.Content)
+}
+
+// renameResolverFile renames a file in /etc/resolver
+func (h *helperServer) renameResolverFile(raw json.RawMessage) (any, error) {
+	var params helper.FileParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	log.Infof("Renaming %s to %s", params.Path, params.To)
+	return fileResult(dns.RenameResolverFile(params.Path, params.To))
+}
+
+// removeResolverFile removes a file from /etc/resolver
+func (h *helperServer) removeResolverFile(raw json.RawMessage) (any, error) {
+	var params helper.FileParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	log.Infof("Removing %s", params.Path)
+	return fileResult(dns.RemoveResolverFile(params.Path))
+}
+
+// commandResult returns the output of a command and why it failed
+func commandResult(output string, err error) helper.CommandResult {
+	result := helper.CommandResult{Output: output}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// fileResult tells the client that the file did not exist, rather than
+// failing
+func fileResult(err error) (any, error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return helper.FileResult{Missing: true}, nil
+	}
+	return helper.FileResult{}, err
+}
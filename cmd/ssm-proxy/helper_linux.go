@@ -0,0 +1,23 @@
+package main
+
+import "github.com/spf13/cobra"
+
+// helperSupported tells whether this platform has the privileged helper
+const helperSupported = false
+
+func runHelperInstall(cmd *cobra.Command, args []string) error {
+	return errHelperUnsupported
+}
+
+func runHelperUninstall(cmd *cobra.Command, args []string) error {
+	return errHelperUnsupported
+}
+
+func runHelper(cmd *cobra.Command, args []string) error {
+	return errHelperUnsupported
+}
+
+// useHelper fails: Linux has no privileged helper
+func useHelper() error {
+	return errHelperUnsupported
+}
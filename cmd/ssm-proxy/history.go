@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyJSON     bool
+	historyCSV      bool
+	historySince    string
+	historyInstance string
+	historyLimit    int
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show past proxy sessions",
+	Long: `Display past (and currently active) proxy sessions from the persistent
+state store, including start/stop times, instance, routed CIDR blocks,
+bytes transferred and why each session ended.
+
+Examples:
+  # Show the 20 most recent sessions
+  ssm-proxy history
+
+  # Sessions from the last week
+  ssm-proxy history --since 7d
+
+  # Sessions through a specific instance since a date
+  ssm-proxy history --instance-id i-1234567890abcdef0 --since 2024-01-01
+
+  # Export for reporting
+  ssm-proxy history --since 30d --limit 0 --csv > sessions.csv
+  ssm-proxy history --json`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if historyJSON && historyCSV {
+			return fmt.Errorf("cannot specify both --json and --csv")
+		}
+		return nil
+	},
+	RunE: runHistory,
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	historyCmd.Flags().BoolVar(&historyJSON, "json", false, "Output in JSON format")
+	historyCmd.Flags().BoolVar(&historyCSV, "csv", false, "Output in CSV format")
+	historyCmd.Flags().StringVar(&historySince, "since", "", "Only sessions started since a duration ago (e.g. 12h, 7d) or a date (YYYY-MM-DD)")
+	historyCmd.Flags().StringVar(&historyInstance, "instance-id", "", "Only sessions through this EC2 instance")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 20, "Maximum number of sessions to show (0 = unlimited)")
+}
+
+func runHistory(cmd *cobra.Command, args []string) error {
+	filter := store.HistoryFilter{
+		InstanceID: historyInstance,
+		Limit:      historyLimit,
+	}
+
+	if historySince != "" {
+		since, err := parseSince(historySince, time.Now())
+		if err != nil {
+			return err
+		}
+		filter.Since = since
+	}
+
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+
+	st, err := sessionMgr.Store()
+	if err != nil {
+		return fmt.Errorf("failed to open state store: %w", err)
+	}
+
+	records, err := st.SessionHistory(filter)
+	if err != nil {
+		return fmt.Errorf("failed to query session history: %w", err)
+	}
+
+	switch {
+	case historyJSON:
+		return displayHistoryJSON(records)
+	case historyCSV:
+		return displayHistoryCSV(records)
+	default:
+		return displayHistoryTable(records)
+	}
+}
+
+// historyEntry is the JSON/CSV representation of a past session
+type historyEntry struct {
+	Name            string     `json:"name"`
+	InstanceID      string     `json:"instance_id"`
+	CIDRBlocks      []string   `json:"cidr_blocks"`
+	StartedAt       time.Time  `json:"started_at"`
+	EndedAt         *time.Time `json:"ended_at,omitempty"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	EndReason       string     `json:"end_reason,omitempty"`
+	PacketsTX       uint64     `json:"packets_tx"`
+	PacketsRX       uint64     `json:"packets_rx"`
+	BytesTX         uint64     `json:"bytes_tx"`
+	BytesRX         uint64     `json:"bytes_rx"`
+}
+
+func newHistoryEntry(rec *store.SessionRecord) historyEntry {
+	entry := historyEntry{
+		Name:       rec.Name,
+		InstanceID: rec.InstanceID,
+		CIDRBlocks: rec.CIDRBlocks,
+		StartedAt:  displayTime(rec.StartedAt),
+		EndReason:  rec.EndReason,
+		PacketsTX:  rec.PacketsTX,
+		PacketsRX:  rec.PacketsRX,
+		BytesTX:    rec.BytesTX,
+		BytesRX:    rec.BytesRX,
+	}
+	if entry.CIDRBlocks == nil {
+		entry.CIDRBlocks = []string{}
+	}
+
+	end := time.Now()
+	if !rec.Active() {
+		endedAt := displayTime(rec.EndedAt)
+		entry.EndedAt = &endedAt
+		end = endedAt
+	}
+	entry.DurationSeconds = int64(end.Sub(rec.StartedAt).Seconds())
+
+	return entry
+}
+
+func displayHistoryJSON(records []*store.SessionRecord) error {
+	output := struct {
+		Sessions []historyEntry `json:"sessions"`
+	}{
+		Sessions: make([]historyEntry, len(records)),
+	}
+
+	for i, rec := range records {
+		output.Sessions[i] = newHistoryEntry(rec)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+func displayHistoryCSV(records []*store.SessionRecord) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{
+		"name", "instance_id", "cidr_blocks", "started_at", "ended_at", "duration_seconds",
+		"end_reason", "packets_tx", "packets_rx", "bytes_tx", "bytes_rx",
+	})
+
+	for _, rec := range records {
+		entry := newHistoryEntry(rec)
+		endedAt := ""
+		if entry.EndedAt != nil {
+			endedAt = entry.EndedAt.Format(time.RFC3339)
+		}
+		w.Write([]string{
+			entry.Name,
+			entry.InstanceID,
+			strings.Join(entry.CIDRBlocks, " "),
+			entry.StartedAt.Format(time.RFC3339),
+			endedAt,
+			strconv.FormatInt(entry.DurationSeconds, 10),
+			entry.EndReason,
+			strconv.FormatUint(entry.PacketsTX, 10),
+			strconv.FormatUint(entry.PacketsRX, 10),
+			strconv.FormatUint(entry.BytesTX, 10),
+			strconv.FormatUint(entry.BytesRX, 10),
+		})
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func displayHistoryTable(records []*store.SessionRecord) error {
+	if len(records) == 0 {
+		fmt.Println("No sessions found")
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println("SESSION HISTORY")
+	fmt.Println()
+	fmt.Println("SESSION         INSTANCE ID          STARTED                   DURATION  TX        RX        CIDR BLOCKS           END REASON")
+	fmt.Println("──────────────────────────────────────────────────────────────────────────────────────────────────────────────────────────────")
+
+	for _, rec := range records {
+		entry := newHistoryEntry(rec)
+		reason := entry.EndReason
+		if rec.Active() {
+			reason = "(active)"
+		}
+
+		fmt.Printf("%-15s %-20s %-25s %-9s %-9s %-9s %-21s %s\n",
+			truncate(entry.Name, 15),
+			entry.InstanceID,
+			formatTime(entry.StartedAt),
+			formatUptime(time.Duration(entry.DurationSeconds)*time.Second),
+			formatBytes(entry.BytesTX),
+			formatBytes(entry.BytesRX),
+			formatCIDRList(entry.CIDRBlocks),
+			reason,
+		)
+	}
+	fmt.Println()
+
+	return nil
+}
+
+// parseSince parses a --since value: a Go duration, a number of days
+// ("7d"), or a date/time in YYYY-MM-DD or RFC3339 format
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid --since value %q (use e.g. 12h, 7d, 2024-01-31)", value)
+}
+
+// formatBytes formats a byte count using binary units
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
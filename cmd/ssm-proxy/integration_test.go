@@ -0,0 +1,303 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+)
+
+// The start flow test runs ssm-proxy end to end against the fixtures of
+// scripts/integration/run.sh (make integration): LocalStack at
+// SSM_PROXY_IT_ENDPOINT, a container running sshd at SSM_PROXY_IT_SSH_ADDR
+// standing in for the instance, with its authorized_keys in
+// SSM_PROXY_IT_KEYS_DIR, and a web server and a DNS server behind it.
+// ssm-proxy is this test binary run in a network namespace, so that its
+// routes and TUN device do not touch the host.
+
+// itMainEnv makes the test binary run ssm-proxy instead of the tests, with
+// the hooks standing in for what LocalStack does not emulate
+const itMainEnv = "SSM_PROXY_IT_MAIN"
+
+// The network namespace, and the fixtures as seen from it
+const (
+	itNamespace = "ssm-proxy-it"
+	itHostIP    = "10.200.99.1" // the host, as seen from the namespace
+	itNSIP      = "10.200.99.2"
+	itVPCCIDR   = "172.30.99.0/24"
+	itWebIP     = "172.30.99.10"
+	itDNS       = "172.30.99.53:53"
+	itSession   = "it"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(itMainEnv) != "" {
+		installITHooks()
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// installITHooks has ssh connect to the sshd container directly instead of
+// through an SSM session, adds its key to the container's authorized_keys
+// instead of sending it with EC2 Instance Connect, and counts the instance
+// under test as online in SSM
+func installITHooks() {
+	host, port, _ := net.SplitHostPort(os.Getenv("SSM_PROXY_IT_SSH_ADDR"))
+	tunnel.SSHProxyCommandHook = func(string) string {
+		return fmt.Sprintf("nc %s %s", host, port)
+	}
+	tunnel.PushSSHKeyHook = func(instanceID, user, publicKey string) error {
+		f, err := os.OpenFile(filepath.Join(os.Getenv("SSM_PROXY_IT_KEYS_DIR"), "authorized_keys"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, strings.TrimSpace(publicKey))
+		return err
+	}
+	online := strings.Split(os.Getenv("SSM_PROXY_IT_ONLINE"), ",")
+	aws.AgentOnlineHook = func(instanceID string) bool {
+		return slices.Contains(online, instanceID)
+	}
+}
+
+// itFixtures returns the fixtures' addresses as seen from the network
+// namespace and the directory of the container's authorized_keys
+func itFixtures(t *testing.T) (endpoint, sshAddr, keysDir string) {
+	t.Helper()
+	hostEndpoint := os.Getenv("SSM_PROXY_IT_ENDPOINT")
+	hostSSH := os.Getenv("SSM_PROXY_IT_SSH_ADDR")
+	keysDir = os.Getenv("SSM_PROXY_IT_KEYS_DIR")
+	if hostEndpoint == "" || hostSSH == "" || keysDir == "" {
+		t.Skip("the integration fixtures are not running (run: sudo make integration)")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("the start flow test needs root (network namespace, TUN device)")
+	}
+
+	_, endpointPort, err := net.SplitHostPort(strings.TrimPrefix(hostEndpoint, "http://"))
+	if err != nil {
+		t.Fatalf("invalid SSM_PROXY_IT_ENDPOINT %q: %v", hostEndpoint, err)
+	}
+	_, sshPort, err := net.SplitHostPort(hostSSH)
+	if err != nil {
+		t.Fatalf("invalid SSM_PROXY_IT_SSH_ADDR %q: %v", hostSSH, err)
+	}
+	return "http://" + net.JoinHostPort(itHostIP, endpointPort), net.JoinHostPort(itHostIP, sshPort), keysDir
+}
+
+// run runs a command for the test, failing it if the command fails
+func run(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// itInstance runs an instance tagged Name=name in LocalStack, terminated
+// when the test ends
+func itInstance(t *testing.T, name string) string {
+	t.Helper()
+	t.Setenv("AWS_ENDPOINT_URL", os.Getenv("SSM_PROXY_IT_ENDPOINT"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	ctx := context.Background()
+	client, err := aws.NewClient(ctx, "", "us-east-1")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	images, err := client.EC2Client().DescribeImages(ctx, &ec2.DescribeImagesInput{})
+	if err != nil || len(images.Images) == 0 {
+		t.Fatalf("DescribeImages: no image to run (%v)", err)
+	}
+	result, err := client.EC2Client().RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:      images.Images[0].ImageId,
+		InstanceType: ec2types.InstanceTypeT3Micro,
+		MinCount:     awssdk.Int32(1),
+		MaxCount:     awssdk.Int32(1),
+		TagSpecifications: []ec2types.TagSpecification{{
+			ResourceType: ec2types.ResourceTypeInstance,
+			Tags:         []ec2types.Tag{{Key: awssdk.String("Name"), Value: awssdk.String(name)}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("RunInstances: %v", err)
+	}
+	id := awssdk.ToString(result.Instances[0].InstanceId)
+	t.Cleanup(func() { client.TerminateInstance(ctx, id) })
+	return id
+}
+
+// itNetns creates the network namespace, reaching the host over a veth
+// pair, removed when the test ends
+func itNetns(t *testing.T) {
+	t.Helper()
+	exec.Command("ip", "netns", "del", itNamespace).Run()
+	exec.Command("ip", "link", "del", "it-host").Run()
+	t.Cleanup(func() {
+		exec.Command("ip", "netns", "del", itNamespace).Run()
+		exec.Command("ip", "link", "del", "it-host").Run()
+	})
+
+	run(t, "ip", "netns", "add", itNamespace)
+	run(t, "ip", "link", "add", "it-host", "type", "veth", "peer", "name", "it-ns")
+	run(t, "ip", "link", "set", "it-ns", "netns", itNamespace)
+	run(t, "ip", "addr", "add", itHostIP+"/30", "dev", "it-host")
+	run(t, "ip", "link", "set", "it-host", "up")
+	run(t, "ip", "-n", itNamespace, "addr", "add", itNSIP+"/30", "dev", "it-ns")
+	run(t, "ip", "-n", itNamespace, "link", "set", "it-ns", "up")
+	run(t, "ip", "-n", itNamespace, "link", "set", "lo", "up")
+	run(t, "ip", "-n", itNamespace, "route", "add", "default", "via", itHostIP)
+}
+
+// ssmProxy returns the command running ssm-proxy with args in the network
+// namespace, against the fixtures
+func ssmProxy(endpoint, sshAddr, keysDir, home, instanceID string, args ...string) *exec.Cmd {
+	self, _ := os.Executable()
+	cmd := exec.Command("ip", append([]string{"netns", "exec", itNamespace, self}, args...)...)
+	cmd.Env = append(os.Environ(),
+		itMainEnv+"=1",
+		"HOME="+home,
+		"AWS_ENDPOINT_URL="+endpoint,
+		"AWS_ACCESS_KEY_ID=test", "AWS_SECRET_ACCESS_KEY=test", "AWS_REGION=us-east-1",
+		"SSM_PROXY_IT_SSH_ADDR="+sshAddr,
+		"SSM_PROXY_IT_KEYS_DIR="+keysDir,
+		"SSM_PROXY_IT_ONLINE="+instanceID,
+	)
+	return cmd
+}
+
+// waitFor polls cond every 200ms until it is true or timeout passes
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return true
+}
+
+func TestStartFlow(t *testing.T) {
+	endpoint, sshAddr, keysDir := itFixtures(t)
+	name := fmt.Sprintf("ssm-proxy-it-%d", time.Now().UnixNano())
+	instanceID := itInstance(t, name)
+	itNetns(t)
+	home := t.TempDir()
+
+	output := filepath.Join(t.TempDir(), "start.log")
+	out, err := os.Create(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	logged := func() string {
+		data, _ := os.ReadFile(output)
+		return string(data)
+	}
+
+	start := ssmProxy(endpoint, sshAddr, keysDir, home, instanceID,
+		"start", "--headless", "--headless-timeout", "90s",
+		"--instance-tag", "Name="+name, "--cidr", itVPCCIDR, "--session-name", itSession, "--temp-key",
+		"--dns-resolver", itDNS, "--dns-domains", "it.internal",
+		"--dns-listen", "127.0.0.1:53053", "--dns-backend", "none")
+	start.Stdout, start.Stderr = out, out
+	if err := start.Start(); err != nil {
+		t.Fatalf("failed to start ssm-proxy: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		start.Wait()
+		close(exited)
+	}()
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			start.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("ssm-proxy output:\n%s", logged())
+		}
+	}()
+
+	if !waitFor(100*time.Second, func() bool { return strings.Contains(logged(), "Proxy active") }) {
+		t.Fatal("the proxy did not come up")
+	}
+
+	t.Run("instance discovery", func(t *testing.T) {
+		if !regexp.MustCompile(`Instance: .*t3\.micro`).MatchString(logged()) {
+			t.Errorf("instance %s not discovered by its tag", instanceID)
+		}
+	})
+
+	t.Run("key push", func(t *testing.T) {
+		keys, err := os.ReadFile(filepath.Join(keysDir, "authorized_keys"))
+		if err != nil || !strings.Contains(string(keys), "ssh-") {
+			t.Errorf("no SSH key pushed to the instance (%v)", err)
+		}
+	})
+
+	t.Run("tunnel bring-up", func(t *testing.T) {
+		if !strings.Contains(logged(), "Tunnel established") {
+			t.Error("tunnel not established")
+		}
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		route := run(t, "ip", "-n", itNamespace, "route", "get", itWebIP)
+		if !regexp.MustCompile(`dev ssmtun\d+`).MatchString(route) {
+			t.Errorf("%s is not routed to the TUN device: %s", itVPCCIDR, route)
+		}
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		answer := strings.TrimSpace(run(t, "ip", "netns", "exec", itNamespace, "dig", "+short", "-p", "53053", "@127.0.0.1", "web.it.internal"))
+		if answer != itWebIP {
+			t.Errorf("web.it.internal resolved to %q, want %s", answer, itWebIP)
+		}
+	})
+
+	t.Run("traffic", func(t *testing.T) {
+		body := run(t, "ip", "netns", "exec", itNamespace, "curl", "-sf", "--max-time", "10", "http://"+itWebIP+"/")
+		if !strings.Contains(body, "nginx") {
+			t.Errorf("unexpected response from the web server through the tunnel: %q", body)
+		}
+	})
+
+	stop := ssmProxy(endpoint, sshAddr, keysDir, home, instanceID, "stop", "--session-name", itSession)
+	stop.Stdout, stop.Stderr = out, out
+	if err := stop.Run(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(15 * time.Second):
+		t.Fatal("ssm-proxy did not exit after stop")
+	}
+	if routes := run(t, "ip", "-n", itNamespace, "route", "show"); strings.Contains(routes, itVPCCIDR) {
+		t.Errorf("route %s left behind after stop:\n%s", itVPCCIDR, routes)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/spf13/cobra"
+)
+
+// listTimeout bounds looking up the instances
+const listTimeout = time.Minute
+
+var (
+	listTag     string
+	listSSMOnly bool
+	listPick    bool
+)
+
+var listCmd = &cobra.Command{
+	Use:     "list-instances",
+	Aliases: []string{"list"},
+	Short:   "List running EC2 instances, or pick one interactively",
+	Long: `List the running EC2 instances of the account and region with their name,
+availability zone, private IP and whether their SSM agent is connected.
+
+With --pick, choose one of the SSM-connected instances interactively: type
+to narrow the list down (fuzzy, on name, ID, zone and IP) and enter its
+number. The chosen instance ID is printed on stdout, so it can be passed on.
+'ssm-proxy start' without an instance offers the same picker.
+
+Examples:
+  # List all running instances
+  ssm-proxy list-instances
+
+  # Filter by tag
+  ssm-proxy list-instances --tag Environment=production
+
+  # Only show SSM-ready instances
+  ssm-proxy list-instances --ssm-only
+
+  # Pick an instance and start a session against it
+  sudo -E ssm-proxy start --instance-id "$(ssm-proxy list --pick)" --cidr 10.0.0.0/16`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if listTag != "" {
+			if key, _, ok := strings.Cut(listTag, "="); !ok || key == "" {
+				return fmt.Errorf("invalid --tag %q (expected Key=Value)", listTag)
+			}
+		}
+		return nil
+	},
+	RunE: runList,
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringVar(&listTag, "tag", "", "Only instances with this tag (Key=Value)")
+	listCmd.Flags().BoolVar(&listSSMOnly, "ssm-only", false, "Only instances whose SSM agent is connected")
+	listCmd.Flags().BoolVar(&listPick, "pick", false, "Choose an SSM-connected instance interactively and print its ID")
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+
+	instances, err := findInstances(ctx, listTag, listSSMOnly || listPick)
+	if err != nil {
+		return err
+	}
+
+	if listPick {
+		instance, err := pickInstance(instances, os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		fmt.Println(instance.InstanceID)
+		return nil
+	}
+
+	if len(instances) == 0 {
+		fmt.Println("No running instances found")
+		return nil
+	}
+
+	fmt.Printf("%-24s %-20s %-12s %-15s %-12s %s\n", "NAME", "INSTANCE ID", "ZONE", "PRIVATE IP", "TYPE", "SSM")
+	fmt.Println(strings.Repeat("-", 92))
+	for _, instance := range instances {
+		ssm := "✗"
+		if instance.SSMConnected {
+			ssm = "✓"
+		}
+		fmt.Printf("%-24s %-20s %-12s %-15s %-12s %s\n", truncate(instanceName(instance), 24), instance.InstanceID,
+			instance.AvailabilityZone, instance.PrivateIP, instance.InstanceType, ssm)
+	}
+	fmt.Printf("\n%d instance(s)\n", len(instances))
+	return nil
+}
+
+// findInstances lists the running instances, optionally only those with a
+// Key=Value tag and a connected SSM agent, sorted by name and ID
+func findInstances(ctx context.Context, tag string, ssmOnly bool) ([]*aws.Instance, error) {
+	awsClient, err := newAWSClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+
+	var instances []*aws.Instance
+	if key, value, ok := strings.Cut(tag, "="); ok {
+		instances, err = awsClient.FindInstancesByTag(ctx, key, value)
+	} else {
+		instances, err = awsClient.ListInstances(ctx, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ssmOnly {
+		instances = slices.DeleteFunc(instances, func(instance *aws.Instance) bool {
+			return !instance.SSMConnected
+		})
+	}
+	slices.SortFunc(instances, func(a, b *aws.Instance) int {
+		if c := strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.InstanceID, b.InstanceID)
+	})
+	return instances, nil
+}
+
+// instanceName returns the instance's Name tag, or "-" without one
+func instanceName(instance *aws.Instance) string {
+	if instance.Name == "" {
+		return "-"
+	}
+	return instance.Name
+}
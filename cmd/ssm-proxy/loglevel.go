@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sbkg0002/ssm-proxy/internal/audit"
+	"github.com/sbkg0002/ssm-proxy/internal/chaos"
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/httpproxy"
+	"github.com/sbkg0002/ssm-proxy/internal/metrics"
+	"github.com/sbkg0002/ssm-proxy/internal/netmon"
+	"github.com/sbkg0002/ssm-proxy/internal/portforward"
+	"github.com/sbkg0002/ssm-proxy/internal/socks"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// logLevelSession is the session 'log-level' changes
+var logLevelSession string
+
+var logLevelCmd = &cobra.Command{
+	Use:   "log-level [LEVEL]",
+	Short: "Show or change the log level of a running session",
+	Long: `Show or change the log level of a running session without restarting
+it, e.g. to look into an intermittent issue hours into a session started at
+the default level. LEVEL is error, warn, info (like --verbose), debug (like
+--debug) or trace. The change lasts until the session stops.
+
+Examples:
+  sudo ssm-proxy log-level debug
+  sudo ssm-proxy log-level warn --session-name prod-vpc
+
+  # Show the current level
+  sudo ssm-proxy log-level`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runLogLevel,
+}
+
+func init() {
+	rootCmd.AddCommand(logLevelCmd)
+
+	logLevelCmd.Flags().StringVar(&logLevelSession, "session-name", "", "Session to change (default: the most recent one)")
+}
+
+// logLevelParams are the parameters of the log level control method
+type logLevelParams struct {
+	Level string `json:"level,omitempty"`
+}
+
+// logLevelResult is the result of the log level control method
+type logLevelResult struct {
+	Level    string `json:"level"`
+	Previous string `json:"previous,omitempty"` // if it was changed
+}
+
+func runLogLevel(cmd *cobra.Command, args []string) error {
+	var params logLevelParams
+	if len(args) == 1 {
+		// Checked here for a better error than the session's
+		if _, err := parseLogLevel(args[0]); err != nil {
+			return err
+		}
+		params.Level = args[0]
+	}
+
+	name, err := runningSession(logLevelSession)
+	if err != nil {
+		return err
+	}
+
+	var result logLevelResult
+	if err := control.Call(control.SocketPath(name), control.MethodLogLevel, "", params, &result); err != nil {
+		return fmt.Errorf("session %s: %w", name, err)
+	}
+	if result.Previous != "" && result.Previous != result.Level {
+		fmt.Printf("✓ Session %s: log level %s (was %s)\n", name, result.Level, result.Previous)
+	} else {
+		fmt.Printf("✓ Session %s: log level %s\n", name, result.Level)
+	}
+	return nil
+}
+
+// changeLogLevel is the log level control method: it returns the level and
+// changes it if params name one
+func changeLogLevel(raw json.RawMessage) (any, error) {
+	var params logLevelParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+
+	previous := log.GetLevel()
+	if params.Level == "" {
+		return &logLevelResult{Level: previous.String()}, nil
+	}
+	level, err := parseLogLevel(params.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logged whatever the levels, for the record
+	log.SetLevel(max(level, previous, logrus.InfoLevel))
+	log.Infof("Log level changed from %s to %s via the control socket", previous, level)
+	log.SetLevel(level)
+	return &logLevelResult{Level: level.String(), Previous: previous.String()}, nil
+}
+
+// parseLogLevel parses the levels 'log-level' accepts
+func parseLogLevel(s string) (logrus.Level, error) {
+	level, err := logrus.ParseLevel(s)
+	if err != nil || level < logrus.ErrorLevel {
+		return 0, fmt.Errorf("invalid log level %q (expected error, warn, info, debug or trace)", s)
+	}
+	return level, nil
+}
+
+// shareLogger makes the packages log through the command's logger, so that
+// --verbose, --debug, --quiet and 'log-level' apply to all of them
+func shareLogger() {
+	audit.SetLogger(log)
+	chaos.SetLogger(log)
+	control.SetLogger(log)
+	dns.SetLogger(log)
+	forwarder.SetLogger(log)
+	httpproxy.SetLogger(log)
+	metrics.SetLogger(log)
+	netmon.SetLogger(log)
+	portforward.SetLogger(log)
+	socks.SetLogger(log)
+	ssm.SetLogger(log)
+	tunnel.SetLogger(log)
+}
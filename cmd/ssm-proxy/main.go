@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -24,16 +25,34 @@ func main() {
 	})
 
 	// Check platform
-	if runtime.GOOS != "darwin" {
-		log.Fatalf("Error: ssm-proxy currently only supports macOS (darwin)\nYour platform: %s", runtime.GOOS)
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		log.Fatalf("Error: ssm-proxy currently only supports macOS (darwin) and Linux\nYour platform: %s", runtime.GOOS)
 	}
 
 	// Execute root command
 	if err := Execute(version, commit, buildTime); err != nil {
+		// Commands may request a specific exit code for scripting
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			if exitErr.message != "" {
+				fmt.Fprintln(os.Stderr, exitErr.message)
+			}
+			os.Exit(exitErr.code)
+		}
 		log.Fatal(err)
 	}
 }
 
+// exitError makes the process exit with a specific code
+type exitError struct {
+	code    int
+	message string
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d: %s", e.code, e.message)
+}
+
 // isRoot checks if the current process is running with root privileges
 func isRoot() bool {
 	return os.Geteuid() == 0
@@ -42,18 +61,45 @@ func isRoot() bool {
 // requireRoot checks if running as root and exits with error if not
 func requireRoot() {
 	if !isRoot() {
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
-		fmt.Fprintf(os.Stderr, "⚠️  Root privileges required\n")
-		fmt.Fprintf(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "This command requires root privileges to:\n")
-		fmt.Fprintf(os.Stderr, "  • Create virtual network interface (utun device)\n")
-		fmt.Fprintf(os.Stderr, "  • Modify system routing table\n")
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "Please run with sudo:\n")
-		fmt.Fprintf(os.Stderr, "  $ sudo ssm-proxy %s\n", os.Args[1])
-		fmt.Fprintf(os.Stderr, "\n")
+		printRootRequired(false)
 		os.Exit(1)
 	}
 }
+
+// requireRootOrHelper checks that this process may set up or tear down a
+// session and exits with error if not: as root, or through the privileged
+// helper, which it then uses
+func requireRootOrHelper() {
+	if isRoot() {
+		return
+	}
+	err := useHelper()
+	if err == nil {
+		return
+	}
+	log.Debugf("Not using the privileged helper: %v", err)
+	printRootRequired(helperSupported)
+	os.Exit(1)
+}
+
+// printRootRequired explains why root is needed, and the privileged helper
+// if it would do instead
+func printRootRequired(helperHint bool) {
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Fprintf(os.Stderr, "⚠️  Root privileges required\n")
+	fmt.Fprintf(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "This command requires root privileges to:\n")
+	fmt.Fprintf(os.Stderr, "  • Create virtual network interface (TUN device)\n")
+	fmt.Fprintf(os.Stderr, "  • Modify system routing table\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "Please run with sudo:\n")
+	fmt.Fprintf(os.Stderr, "  $ sudo ssm-proxy %s\n", os.Args[1])
+	fmt.Fprintf(os.Stderr, "\n")
+	if helperHint {
+		fmt.Fprintf(os.Stderr, "Or install the privileged helper once, so that you do not need sudo:\n")
+		fmt.Fprintf(os.Stderr, "  $ sudo ssm-proxy helper install\n")
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/metrics"
+)
+
+// tunnelMetrics returns the metrics source of a running tunnel, labeled
+// with its session, TUN device and instance
+func tunnelMetrics(session, device, instanceID string, t socksTunnel, translator *forwarder.TunToSOCKS, reconnects *atomic.Int64) metrics.Source {
+	labels := metrics.Labels{"session": session, "device": device, "instance": instanceID}
+	return metrics.TunnelSource(labels, func() metrics.TunnelStats {
+		traffic := translator.GetStats()
+		stats := metrics.TunnelStats{
+			Up:          t.IsRunning(),
+			PacketsTX:   traffic.PacketsTX,
+			PacketsRX:   traffic.PacketsRX,
+			BytesTX:     traffic.BytesTX,
+			BytesRX:     traffic.BytesRX,
+			ErrorsTX:    traffic.ErrorsTX,
+			ErrorsRX:    traffic.ErrorsRX,
+			ConnsActive: traffic.ConnsActive,
+			ConnsPeak:   traffic.ConnsPeak,
+			ConnsDenied: traffic.ConnsDenied,
+			Reconnects:  uint64(reconnects.Load()),
+		}
+		if resolver := translator.DNSResolver(); resolver != nil {
+			dnsStats := resolver.Stats()
+			stats.DNS = true
+			stats.DNSCacheHits = dnsStats.CacheHits
+			stats.DNSCacheMisses = dnsStats.CacheMisses
+			stats.DNSFailures = dnsStats.Failures
+			stats.DNSNXDomain = dnsStats.NXDomain
+			stats.DNSServFail = dnsStats.ServFail
+			stats.DNSOtherDomain = dnsStats.OtherDomain
+			stats.DNSTruncated = dnsStats.Truncated
+			stats.DNSDenied = dnsStats.Denied
+			for _, q := range dnsStats.Queries {
+				stats.DNSQueries = append(stats.DNSQueries, metrics.DNSQueryCount(q))
+			}
+			latency := dnsStats.Latency
+			stats.DNSLatencyQuantiles = map[float64]float64{
+				0.5:  latency.P50.Seconds(),
+				0.9:  latency.P90.Seconds(),
+				0.99: latency.P99.Seconds(),
+			}
+			stats.DNSLatencySum = latency.Sum.Seconds()
+			stats.DNSLatencyCount = latency.Count
+			for _, server := range dnsStats.Servers {
+				stats.DNSServers = append(stats.DNSServers, metrics.DNSServer{
+					Address:  server.Address,
+					Up:       server.Healthy,
+					Queries:  server.Queries,
+					Failures: server.Failures,
+				})
+			}
+		}
+		return stats
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sbkg0002/ssm-proxy/internal/netmon"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+)
+
+// errNetworkChanged fails the health check of a tunnel whose default route
+// changed: its connection to AWS went out the old way and is dead, even if
+// the tunnel process has not noticed yet
+var errNetworkChanged = errors.New("default route changed, the tunnel's connection to AWS is gone")
+
+// networkWatch follows network changes such as switching Wi-Fi networks or
+// waking from sleep. It moves the routes kept outside the tunnel (AWS
+// endpoints, --exclude-cidr blocks, DNS servers) to a new default gateway,
+// and has the health monitor check the routes and the tunnel right away.
+type networkWatch struct {
+	events  <-chan netmon.Event // nil if changes cannot be watched
+	router  *routing.Router
+	bypass  *endpointBypass          // nil without --bypass-aws-endpoints
+	uplinks map[bool]routing.NextHop // default route, by IPv6
+}
+
+// newNetworkWatch starts watching the network, ignoring the tunnel's own
+// device. Without a way to watch, the periodic checks still catch changes,
+// only later.
+func newNetworkWatch(ctx context.Context, router *routing.Router, bypass *endpointBypass, tunName string) *networkWatch {
+	w := &networkWatch{
+		router:  router,
+		bypass:  bypass,
+		uplinks: make(map[bool]routing.NextHop),
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if hop, err := routing.DefaultNextHop(ipv6); err == nil {
+			w.uplinks[ipv6] = hop
+		}
+	}
+
+	events, err := netmon.Watch(ctx, netmon.DefaultDebounce, tunName)
+	if err != nil {
+		log.Warnf("Failed to watch for network changes, relying on periodic checks: %v", err)
+		return w
+	}
+	w.events = events
+	return w
+}
+
+// handle follows a network change and reports whether a default route
+// moved to another gateway or interface
+func (w *networkWatch) handle(ctx context.Context, event netmon.Event) bool {
+	log.Infof("Network changed (%s), checking routes and tunnel", event.Reason)
+
+	moved := false
+	for _, ipv6 := range []bool{false, true} {
+		hop, err := routing.DefaultNextHop(ipv6)
+		if err != nil {
+			// Offline for now; the next change brings the new route
+			log.Debugf("No default route (IPv6 %t): %v", ipv6, err)
+			continue
+		}
+		previous, known := w.uplinks[ipv6]
+		w.uplinks[ipv6] = hop
+		if !known || previous == hop {
+			continue
+		}
+
+		moved = true
+		log.Infof("Default route moved from %s to %s", previous, hop)
+		for _, result := range w.router.MoveBypassRoutes(ctx, previous, hop) {
+			if result.Err != nil {
+				log.Warnf("Failed to move route %s to %s: %v", result.CIDR, hop, result.Err)
+			} else {
+				log.Infof("Route %s moved to %s", result.CIDR, hop)
+			}
+		}
+		if w.bypass != nil {
+			w.bypass.moveUplink(previous, hop)
+		}
+	}
+	return moved
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// networkGroupPrefix marks a --cidr value as a reference to a named group
+// defined under 'networks:' in the config file
+const networkGroupPrefix = "@"
+
+// expandCIDRs replaces @group references with the CIDR blocks configured
+// for that group. Groups may reference other groups. Duplicates are removed
+// while preserving the original order.
+func expandCIDRs(values []string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+
+	for _, value := range values {
+		expanded, err := expandCIDR(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, cidr := range expanded {
+			if !seen[cidr] {
+				seen[cidr] = true
+				result = append(result, cidr)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// expandCIDR expands a single --cidr value; stack tracks the groups being
+// expanded to detect reference cycles
+func expandCIDR(value string, stack []string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, networkGroupPrefix) {
+		return []string{value}, nil
+	}
+
+	name := strings.TrimPrefix(value, networkGroupPrefix)
+	if name == "" {
+		return nil, fmt.Errorf("empty network group name in %q", value)
+	}
+
+	for _, parent := range stack {
+		if parent == name {
+			return nil, fmt.Errorf("network group cycle: %s -> %s", strings.Join(stack, " -> "), name)
+		}
+	}
+
+	key := "networks." + name
+	if !viper.IsSet(key) {
+		return nil, fmt.Errorf("unknown network group %q (define it under 'networks:' in the config file)", name)
+	}
+
+	members := viper.GetStringSlice(key)
+	if len(members) == 0 {
+		return nil, fmt.Errorf("network group %q is empty", name)
+	}
+
+	var result []string
+	for _, member := range members {
+		expanded, err := expandCIDR(member, append(stack, name))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded...)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+)
+
+// pickerRows is the number of instances the picker shows at once
+const pickerRows = 20
+
+// errPickCancelled is returned when the user leaves the picker
+var errPickCancelled = errors.New("no instance selected")
+
+// pickInstance lets the user choose one of the instances: typing text
+// narrows the list down (fuzzy, on name, ID, zone and IP) and a number
+// selects. The list and prompts go to out, so stdout can carry the result.
+func pickInstance(instances []*aws.Instance, in io.Reader, out io.Writer) (*aws.Instance, error) {
+	if len(instances) == 0 {
+		return nil, errors.New("no running instances with a connected SSM agent found")
+	}
+
+	reader := bufio.NewReader(in)
+	query := ""
+	for {
+		matches := filterInstances(instances, query)
+		shown := matches[:min(len(matches), pickerRows)]
+
+		fmt.Fprintln(out)
+		for i, instance := range shown {
+			fmt.Fprintf(out, "  %2d) %-24s %-20s %-12s %s\n", i+1, truncate(instanceName(instance), 24),
+				instance.InstanceID, instance.AvailabilityZone, instance.PrivateIP)
+		}
+		switch {
+		case len(matches) == 0:
+			fmt.Fprintf(out, "  No instances match %q\n", query)
+		case len(matches) > len(shown):
+			fmt.Fprintf(out, "  ... and %d more (type to filter)\n", len(matches)-len(shown))
+		}
+
+		switch {
+		case len(matches) == 1:
+			fmt.Fprint(out, "Press Enter to select it, or type to filter: ")
+		case query != "":
+			fmt.Fprint(out, "Select a number, type to filter, or press Enter to show all: ")
+		default:
+			fmt.Fprint(out, "Select a number, type to filter, or press Enter to cancel: ")
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(out)
+			return nil, errPickCancelled
+		}
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(shown) {
+			return shown[n-1], nil
+		}
+		switch {
+		case line == "" && len(matches) == 1:
+			return matches[0], nil
+		case line == "" && query == "":
+			return nil, errPickCancelled
+		default:
+			query = line
+		}
+	}
+}
+
+// filterInstances returns the instances with a field matching the query
+func filterInstances(instances []*aws.Instance, query string) []*aws.Instance {
+	if query == "" {
+		return instances
+	}
+	var matches []*aws.Instance
+	for _, instance := range instances {
+		fields := []string{instance.Name, instance.InstanceID, instance.AvailabilityZone, instance.PrivateIP}
+		if slices.ContainsFunc(fields, func(field string) bool { return fuzzyMatch(field, query) }) {
+			matches = append(matches, instance)
+		}
+	}
+	return matches
+}
+
+// fuzzyMatch reports whether the characters of query appear in s in order
+// (ignoring case and spaces in the query), e.g. "wbprd" in "web-prod-1"
+func fuzzyMatch(s, query string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(query) {
+		if r == ' ' {
+			continue
+		}
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// isInteractive reports whether stdin is a terminal a picker can read from
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sbkg0002/ssm-proxy/internal/policy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// policyRules are --policy: the allow and deny rules of destinations
+	policyRules []string
+	// policyDefault is --policy-default: what destinations no rule matches get
+	policyDefault string
+	// destinationPolicy is parsed from them, nil without rules
+	destinationPolicy *policy.Policy
+)
+
+// loadPolicy parses the destination policy from the flags, falling back to
+// the policy section of the config file
+func loadPolicy(cmd *cobra.Command) (*policy.Policy, error) {
+	rules := policyRules
+	if !cmd.Flags().Changed("policy") {
+		rules = viper.GetStringSlice("policy.rules")
+	}
+	defaultAction := policyDefault
+	if !cmd.Flags().Changed("policy-default") {
+		defaultAction = viper.GetString("policy.default")
+	}
+	if len(rules) == 0 {
+		if defaultAction != "" {
+			return nil, fmt.Errorf("--policy-default requires --policy rules")
+		}
+		return nil, nil
+	}
+	return policy.Parse(rules, defaultAction)
+}
+
+// printPolicy shows the rules of the destination policy
+func printPolicy(p *policy.Policy) {
+	fmt.Printf("✓ Destination policy: %d rule(s), default %s\n", len(p.Rules()), p.Default())
+	for i, rule := range p.Rules() {
+		prefix := "├─"
+		if i == len(p.Rules())-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("  %s %s\n", prefix, rule)
+	}
+}
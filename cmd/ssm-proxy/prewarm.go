@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/store"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	prewarmSOCKSPort  int
+	prewarmTTL        time.Duration
+	prewarmForeground bool
+	prewarmStop       bool
+	prewarmList       bool
+)
+
+var prewarmCmd = &cobra.Command{
+	Use:   "prewarm [NAME]",
+	Short: "Open the SSM/SSH channel ahead of time for a near-instant start",
+	Long: `Perform all AWS lookups, push the SSH key and establish the SSM/SSH
+channel in the background, without creating a TUN device or adding routes.
+A later 'start --from-prewarm NAME' then only performs the local TUN, route
+and DNS setup, which makes frequent connect/disconnect cycles near-instant.
+
+The instance is selected with --instance-id or --instance-tag, or taken from
+the instance_id / instance_tag of the profile NAME in the config file. The
+channel is kept alive (and reconnected if it drops) until it is stopped or
+its --ttl expires. Run it with the same privileges as start (e.g. sudo -E)
+so that both use the same state store.
+
+Examples:
+  # Prewarm a channel to the bastion and use it
+  ssm-proxy prewarm prod --instance-id i-1234567890abcdef0
+  sudo -E ssm-proxy start --from-prewarm prod --cidr 10.0.0.0/16
+
+  # List and stop prewarmed channels
+  ssm-proxy prewarm --list
+  ssm-proxy prewarm prod --stop`,
+	Args: cobra.MaximumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if prewarmList {
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("a prewarm NAME is required")
+		}
+		if err := session.ValidateName(args[0]); err != nil {
+			return err
+		}
+		if prewarmStop {
+			return nil
+		}
+
+		// Fall back to the instance selector of the named profile
+		if instanceID == "" && instanceTag == "" {
+			instanceID = viper.GetString(fmt.Sprintf("profiles.%s.instance_id", args[0]))
+			instanceTag = viper.GetString(fmt.Sprintf("profiles.%s.instance_tag", args[0]))
+		}
+		if instanceID == "" && instanceTag == "" {
+			return fmt.Errorf("either --instance-id or --instance-tag is required (or a profile %q in the config file)", args[0])
+		}
+		if instanceID != "" && instanceTag != "" {
+			return fmt.Errorf("cannot specify both --instance-id and --instance-tag")
+		}
+		return validateTransport(transport)
+	},
+	RunE: runPrewarm,
+}
+
+func init() {
+	rootCmd.AddCommand(prewarmCmd)
+
+	prewarmCmd.Flags().StringVar(&instanceID, "instance-id", "", "EC2 instance ID (e.g., i-1234567890abcdef0)")
+	prewarmCmd.Flags().StringVar(&instanceTag, "instance-tag", "", "Find instance by tag (format: Key=Value)")
+	prewarmCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Always generate temporary SSH key (ignore existing keys)")
+	prewarmCmd.Flags().StringVar(&transport, "transport", transportSSH, "How the SSH tunnel is run: ssh or native (in process)")
+	prewarmCmd.Flags().IntVar(&prewarmSOCKSPort, "socks-port", 0, "Local SOCKS5 port for the channel (0 = pick a free port)")
+	prewarmCmd.Flags().DurationVar(&prewarmTTL, "ttl", 8*time.Hour, "Close the channel after this duration (0 = never)")
+	prewarmCmd.Flags().BoolVar(&prewarmStop, "stop", false, "Stop the prewarmed channel NAME")
+	prewarmCmd.Flags().BoolVar(&prewarmList, "list", false, "List prewarmed channels")
+	prewarmCmd.Flags().BoolVar(&prewarmForeground, "foreground", false, "Keep the channel in the foreground instead of detaching")
+}
+
+func runPrewarm(cmd *cobra.Command, args []string) error {
+	sessionMgr := session.NewManager()
+	defer sessionMgr.Close()
+
+	st, err := sessionMgr.Store()
+	if err != nil {
+		return fmt.Errorf("failed to open state store: %w", err)
+	}
+
+	switch {
+	case prewarmList:
+		return listPrewarms(st)
+	case prewarmStop:
+		return stopPrewarm(st, args[0])
+	case prewarmForeground:
+		return servePrewarm(st, args[0])
+	}
+
+	name := args[0]
+	if rec, err := st.Prewarm(name); err == nil && isProcessRunning(rec.PID) {
+		fmt.Printf("✓ Channel %s is already prewarmed (pid %d, SOCKS5 %s)\n", name, rec.PID, rec.SOCKSAddr)
+		return nil
+	}
+
+	logFile := filepath.Join(filepath.Dir(store.DefaultPath()), fmt.Sprintf("prewarm-%s.log", name))
+
+	childArgs := append(globalFlagArgs(), "prewarm", name, "--foreground",
+		"--socks-port", fmt.Sprint(prewarmSOCKSPort),
+		"--ttl", prewarmTTL.String(),
+	)
+	if instanceID != "" {
+		childArgs = append(childArgs, "--instance-id", instanceID)
+	} else {
+		childArgs = append(childArgs, "--instance-tag", instanceTag)
+	}
+	if tempKey {
+		childArgs = append(childArgs, "--temp-key")
+	}
+	childArgs = append(childArgs, "--transport", transport)
+	if headless {
+		childArgs = append(childArgs, "--headless")
+	}
+
+	fmt.Printf("✓ Prewarming channel %s...\n", name)
+	child, err := spawnDetached(childArgs, logFile)
+	if err != nil {
+		return fmt.Errorf("failed to start prewarm process: %w", err)
+	}
+
+	rec, err := waitForPrewarm(st, child.Process, name, 2*time.Minute)
+	if err != nil {
+		child.Process.Signal(syscall.SIGTERM)
+		return fmt.Errorf("%w (see %s)", err, logFile)
+	}
+	child.Process.Release()
+
+	fmt.Printf("  ├─ Instance: %s\n", rec.InstanceID)
+	fmt.Printf("  ├─ SOCKS5 proxy: %s\n", rec.SOCKSAddr)
+	fmt.Printf("  ├─ Log: %s\n", logFile)
+	fmt.Printf("  └─ Use: sudo -E ssm-proxy start --from-prewarm %s --cidr ...\n", name)
+	return nil
+}
+
+// waitForPrewarm waits until the prewarm process reports its channel ready,
+// exits, or the timeout elapses
+func waitForPrewarm(st *store.Store, process *os.Process, name string, timeout time.Duration) (*store.PrewarmRecord, error) {
+	exited := make(chan struct{})
+	go func() {
+		process.Wait()
+		close(exited)
+	}()
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case <-exited:
+			return nil, fmt.Errorf("prewarm process exited before the channel was ready")
+		case <-deadline:
+			return nil, fmt.Errorf("channel was not ready within %s", timeout)
+		case <-ticker.C:
+			rec, err := st.Prewarm(name)
+			if err == nil && rec.PID == process.Pid && rec.Ready {
+				return rec, nil
+			}
+		}
+	}
+}
+
+// servePrewarm opens the channel and keeps it alive until stopped or expired
+func servePrewarm(st *store.Store, name string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port := prewarmSOCKSPort
+	if port == 0 {
+		var err error
+		if port, err = netutil.FreeLocalPort(); err != nil {
+			return fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+		}
+	}
+
+	rec := &store.PrewarmRecord{
+		Name:      name,
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+	}
+	if prewarmTTL > 0 {
+		rec.ExpiresAt = rec.StartedAt.Add(prewarmTTL)
+	}
+	if err := st.SavePrewarm(rec); err != nil {
+		return err
+	}
+	defer st.DeletePrewarm(name, rec.PID)
+
+	sshTunnel, instance, err := connectTunnel(ctx, defaultAWSAccount(), instanceID, instanceTag, port, nil)
+	if err != nil {
+		return err
+	}
+	defer sshTunnel.Stop()
+
+	rec.InstanceID = instance.InstanceID
+	rec.SOCKSAddr = sshTunnel.SOCKSAddr()
+	rec.Ready = true
+	if err := st.SavePrewarm(rec); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Channel %s ready on %s\n", name, rec.SOCKSAddr)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	var expired <-chan time.Time
+	if prewarmTTL > 0 {
+		expired = time.After(prewarmTTL)
+	}
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sig := <-sigCh:
+			fmt.Printf("✓ Received %v, closing channel %s\n", sig, name)
+			return nil
+		case <-expired:
+			fmt.Printf("✓ TTL of %s reached, closing channel %s\n", prewarmTTL, name)
+			return nil
+		case <-ticker.C:
+			if sshTunnel.IsRunning() {
+				continue
+			}
+			log.Warn("Prewarmed channel down, reconnecting...")
+			if err := sshTunnel.Start(ctx); err != nil {
+				log.Errorf("Failed to reconnect prewarmed channel: %v", err)
+			}
+		}
+	}
+}
+
+// stopPrewarm stops the prewarm process for name and removes its record
+func stopPrewarm(st *store.Store, name string) error {
+	rec, err := st.Prewarm(name)
+	if err != nil {
+		fmt.Printf("No prewarmed channel named %s\n", name)
+		return nil
+	}
+
+	if isProcessRunning(rec.PID) {
+		if process, err := os.FindProcess(rec.PID); err == nil {
+			process.Signal(syscall.SIGTERM)
+		}
+	}
+	if err := st.DeletePrewarm(name, 0); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Prewarmed channel %s stopped\n", name)
+	return nil
+}
+
+// listPrewarms prints all prewarmed channels
+func listPrewarms(st *store.Store) error {
+	records, err := st.Prewarms()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("No prewarmed channels")
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println("NAME            INSTANCE ID          SOCKS5               STATE    EXPIRES")
+	fmt.Println("─────────────────────────────────────────────────────────────────────────────────")
+	for _, rec := range records {
+		state := "ready"
+		switch {
+		case !isProcessRunning(rec.PID):
+			state = "stale"
+		case !rec.Ready:
+			state = "starting"
+		}
+		expires := "never"
+		if !rec.ExpiresAt.IsZero() {
+			expires = formatTimeAgo(rec.ExpiresAt)
+		}
+		fmt.Printf("%-15s %-20s %-20s %-8s %s\n", truncate(rec.Name, 15), rec.InstanceID, rec.SOCKSAddr, state, expires)
+	}
+	fmt.Println()
+	return nil
+}
+
+// prewarmTunnel is a channel owned by a `prewarm` process, used by start
+type prewarmTunnel struct {
+	rec *store.PrewarmRecord
+}
+
+// attachPrewarm looks up a ready prewarmed channel for start --from-prewarm
+func attachPrewarm(mgr *session.Manager, name string) (*prewarmTunnel, error) {
+	st, err := mgr.Store()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store: %w", err)
+	}
+
+	rec, err := st.Prewarm(name)
+	if err != nil {
+		return nil, fmt.Errorf("no prewarmed channel named %s; run 'ssm-proxy prewarm %s' first", name, name)
+	}
+
+	p := &prewarmTunnel{rec: rec}
+	if !rec.Ready || !p.IsRunning() {
+		return nil, fmt.Errorf("prewarmed channel %s is not ready; run 'ssm-proxy prewarm %s' again", name, name)
+	}
+
+	fmt.Printf("✓ Using prewarmed channel %s\n", name)
+	fmt.Printf("  ├─ Instance: %s\n", rec.InstanceID)
+	fmt.Printf("  └─ SOCKS5 proxy: %s\n", rec.SOCKSAddr)
+	return p, nil
+}
+
+// Start is not supported: the owning prewarm process reconnects the channel
+func (p *prewarmTunnel) Start(ctx context.Context) error {
+	return fmt.Errorf("prewarmed channel %s is managed by its prewarm process", p.rec.Name)
+}
+
+// Stop is a no-op: the channel belongs to its prewarm process
+func (p *prewarmTunnel) Stop() error {
+	return nil
+}
+
+// IsRunning reports whether the prewarm process is alive and its SOCKS5
+// port accepts connections
+func (p *prewarmTunnel) IsRunning() bool {
+	if !isProcessRunning(p.rec.PID) {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", p.rec.SOCKSAddr, 2*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// SOCKSAddr returns the channel's SOCKS5 address
+func (p *prewarmTunnel) SOCKSAddr() string {
+	return p.rec.SOCKSAddr
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sbkg0002/ssm-proxy/internal/store"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges is --drop-privileges: run as the user who ran sudo once
+// every tunnel is up
+var dropPrivileges bool
+
+// inheritedDescriptors are the descriptors beyond stdin, stdout and stderr
+// the process was started with, which it has no use for. They are the ones
+// without close-on-exec at startup: the process opens its own with it.
+var inheritedDescriptors = openDescriptors(func(fd int) bool {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == nil && flags&unix.FD_CLOEXEC == 0
+})
+
+// dropUser is the user the process switches to with --drop-privileges
+var dropUser struct {
+	uid, gid int
+}
+
+// prepareDropPrivileges finds the user to drop the privileges to, the one
+// who ran sudo. The ssh processes of the tunnels run as that user from the
+// start, as the process could not stop them after switching.
+func prepareDropPrivileges() error {
+	if !isRoot() {
+		return fmt.Errorf("--drop-privileges needs sudo: this process does not run as root")
+	}
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil || uid <= 0 {
+		return fmt.Errorf("--drop-privileges needs sudo from a user other than root (SUDO_UID is %q)", os.Getenv("SUDO_UID"))
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil || gid < 0 {
+		return fmt.Errorf("--drop-privileges needs sudo (SUDO_GID is %q)", os.Getenv("SUDO_GID"))
+	}
+	if err := checkSwitchUser(); err != nil {
+		return err
+	}
+
+	dropUser.uid, dropUser.gid = uid, gid
+	tunnel.SetChildCredential(uint32(uid), uint32(gid))
+	return nil
+}
+
+// dropToUser switches the process to the user found by
+// prepareDropPrivileges. devices are the TUN devices of the tunnels, which
+// stay open.
+func dropToUser(devices []string) error {
+	groups, err := userGroups(dropUser.uid, dropUser.gid)
+	if err != nil {
+		return err
+	}
+	if err := handOverFiles(dropUser.uid, dropUser.gid); err != nil {
+		log.Warnf("Failed to hand over files to uid %d: %v", dropUser.uid, err)
+		fmt.Printf("⚠️  %v\n", err)
+	}
+	// The PID file's directory is root's: a process of root removes it
+	if isDaemonChild() {
+		if err := startPIDFileRemover(pidFile, os.Getpid()); err != nil {
+			return err
+		}
+	}
+	closeDescriptors()
+	kept, err := switchUser(dropUser.uid, dropUser.gid, groups, devices)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != dropUser.uid || os.Getegid() != dropUser.gid {
+		return fmt.Errorf("still running as uid %d, gid %d", os.Geteuid(), os.Getegid())
+	}
+
+	log.Infof("Dropped privileges to uid %d, gid %d (%s)", dropUser.uid, dropUser.gid, kept)
+	fmt.Printf("✓ Dropped privileges to uid %d (gid %d)\n", dropUser.uid, dropUser.gid)
+	fmt.Printf("  └─ %s\n", kept)
+	return nil
+}
+
+// handOverFiles gives uid and gid the files the process still writes
+// after the switch, all created by root: the state store with its WAL
+// files and the directory they are in, where the daemon log is rotated by
+// default, and the daemon log with its rotated files. Later commands of the
+// user open the store too.
+func handOverFiles(uid, gid int) error {
+	dir := filepath.Dir(store.DefaultPath())
+	paths := []string{dir, store.DefaultPath(), store.DefaultPath() + "-wal", store.DefaultPath() + "-shm"}
+	if isDaemonChild() || (isServiceChild() && logFile != "") {
+		path := daemonLogPath()
+		paths = append(paths, path)
+		for i := 1; i <= logMaxBackups; i++ {
+			paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+		}
+	}
+
+	var errs []error
+	for _, path := range paths {
+		if err := os.Lchown(path, uid, gid); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to hand over files to uid %d: %w", uid, errors.Join(errs...))
+	}
+	return nil
+}
+
+// closeDescriptors closes the inherited descriptors and marks every other
+// one close-on-exec, so that the commands run after the switch get none of
+// them. What the tunnels use stays open: the TUN devices, SSM connections
+// and ssh pipes, the control socket, the state store and the log.
+func closeDescriptors() {
+	for _, fd := range inheritedDescriptors {
+		unix.Close(fd)
+	}
+	// A descriptor closed while listing is skipped with EBADF
+	for _, fd := range openDescriptors(func(int) bool { return true }) {
+		unix.CloseOnExec(fd)
+	}
+	log.Debugf("Closed %d inherited descriptors", len(inheritedDescriptors))
+}
+
+// openDescriptors returns the open descriptors of the process beyond
+// stdin, stdout and stderr for which keep returns true
+func openDescriptors(keep func(fd int) bool) []int {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return nil
+	}
+	var fds []int
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err == nil && fd > 2 && keep(fd) {
+			fds = append(fds, fd)
+		}
+	}
+	return fds
+}
+
+// userGroups returns the groups of the user uid, starting with gid
+func userGroups(uid, gid int) ([]int, error) {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up uid %d: %w", uid, err)
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the groups of %s: %w", u.Username, err)
+	}
+
+	groups := []int{gid}
+	for _, id := range ids {
+		group, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group ID %q of %s", id, u.Username)
+		}
+		if group != gid {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
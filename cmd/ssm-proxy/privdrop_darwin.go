@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkSwitchUser reports whether switchUser works in this build, which
+// it always does on macOS
+func checkSwitchUser() error {
+	return nil
+}
+
+// switchUser makes the process run as uid and gid with groups. macOS has
+// no capabilities to keep: the routes and DNS changes after the switch go
+// through a privileged helper of this process, started first. It returns
+// what it kept.
+func switchUser(uid, gid int, groups []int, devices []string) (string, error) {
+	pid, err := startSessionHelper(uid, devices)
+	if err != nil {
+		return "", err
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return "", fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return "", fmt.Errorf("failed to set gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return "", fmt.Errorf("failed to set uid %d: %w", uid, err)
+	}
+	return fmt.Sprintf("privileged helper for routes and DNS: pid %d", pid), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// switchUser makes the process, all of its threads, run as uid and gid
+// with groups, keeping of root's capabilities only CAP_NET_ADMIN: routes
+// are still added and removed after the switch. It returns what it kept.
+func switchUser(uid, gid int, groups []int, devices []string) (string, error) {
+	// Keep the permitted capabilities across setuid, to pick one of them
+	if err := allThreadsPrctl(unix.PR_SET_KEEPCAPS, 1); err != nil {
+		return "", fmt.Errorf("failed to keep capabilities: %w", err)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return "", fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return "", fmt.Errorf("failed to set gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return "", fmt.Errorf("failed to set uid %d: %w", uid, err)
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	data[0].Effective = 1 << unix.CAP_NET_ADMIN
+	data[0].Permitted = 1 << unix.CAP_NET_ADMIN
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return "", fmt.Errorf("failed to drop capabilities: %w", errno)
+	}
+	if err := allThreadsPrctl(unix.PR_SET_KEEPCAPS, 0); err != nil {
+		return "", fmt.Errorf("failed to reset capabilities on setuid: %w", err)
+	}
+	return "kept CAP_NET_ADMIN to maintain the routes", nil
+}
+
+// checkSwitchUser reports whether switchUser works in this build. It
+// switches every thread with syscall.AllThreadsSyscall, which is not
+// supported in builds with cgo.
+func checkSwitchUser() error {
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_GET_KEEPCAPS, 0, 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("--drop-privileges does not work in this build of ssm-proxy, which uses cgo: build it with CGO_ENABLED=0 (as make build does)")
+	}
+	return nil
+}
+
+// allThreadsPrctl runs prctl on every thread of the process (it fails in
+// builds with cgo)
+func allThreadsPrctl(option, arg int) error {
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, uintptr(option), uintptr(arg), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
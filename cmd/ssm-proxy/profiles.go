@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// profileName is the profile of the config file's 'profiles:' section that
+// start takes its settings from (argument or --profile-name)
+var profileName string
+
+// profileAliases are profile keys that are not named after a flag
+var profileAliases = map[string]string{
+	"cidrs":       "cidr",
+	"aws_profile": "profile",
+}
+
+// sliceFlag is a flag holding a list, whose values are replaced rather
+// than appended to when set from a profile
+type sliceFlag interface {
+	Replace([]string) error
+}
+
+// applyProfile sets the flags of cmd not given on the command line from
+// the config file's profile name. Its keys are the long flag names, with _
+// or -; the session is named after the profile unless it says otherwise.
+func applyProfile(cmd *cobra.Command, name string) error {
+	key := "profiles." + name
+	if !viper.IsSet(key) {
+		return fmt.Errorf("no profile %q in the 'profiles' section of the config file (%s)", name, configFileUsed())
+	}
+	settings := viper.GetStringMap(key)
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		flagName := k
+		if alias, ok := profileAliases[k]; ok {
+			flagName = alias
+		}
+		flagName = strings.ReplaceAll(flagName, "_", "-")
+
+		flag := cmd.Flags().Lookup(flagName)
+		if flag == nil || flag.Hidden || flagName == "profile-name" {
+			return fmt.Errorf("unknown setting %q in profile %s", k, name)
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := setProfileFlag(cmd, flagName, settings[k]); err != nil {
+			return fmt.Errorf("invalid %s in profile %s: %w", k, name, err)
+		}
+	}
+
+	if !cmd.Flags().Changed("session-name") && session.ValidateName(name) == nil {
+		sessionName = name
+	}
+	return nil
+}
+
+// setProfileFlag sets a flag of cmd to a value from the config file: a
+// list for list flags, a single value for the others
+func setProfileFlag(cmd *cobra.Command, flagName string, value any) error {
+	flag := cmd.Flags().Lookup(flagName)
+	list, isList := value.([]any)
+
+	if slice, ok := flag.Value.(sliceFlag); ok {
+		values := make([]string, 0, len(list))
+		if isList {
+			for _, v := range list {
+				values = append(values, fmt.Sprint(v))
+			}
+		} else {
+			values = strings.Split(fmt.Sprint(value), ",")
+		}
+		if err := slice.Replace(values); err != nil {
+			return err
+		}
+		flag.Changed = true
+		return nil
+	}
+
+	if isList {
+		return fmt.Errorf("expected a single value, not a list")
+	}
+	return cmd.Flags().Set(flagName, fmt.Sprint(value))
+}
+
+// configFileUsed returns the config file read, for messages
+func configFileUsed() string {
+	if file := viper.ConfigFileUsed(); file != "" {
+		return file
+	}
+	return "none found"
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+)
+
+// reconnectPolicyFlags are the --reconnect-policy rules, CLASS=DELAY[..MAX]
+// or CLASS=never each
+var reconnectPolicyFlags []string
+
+// reconnectRule is how the tunnel is reconnected after a class of failure:
+// first after Delay, then after twice as long each time up to MaxDelay,
+// unless Never
+type reconnectRule struct {
+	Never    bool
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// String formats the rule as it is given in --reconnect-policy
+func (r reconnectRule) String() string {
+	if r.Never {
+		return "never"
+	}
+	if r.MaxDelay <= r.Delay {
+		return r.Delay.String()
+	}
+	return r.Delay.String() + ".." + r.MaxDelay.String()
+}
+
+// wait returns how long to wait before the attempt'th reconnect in a row
+// (from 0) after failures of the rule's class
+func (r reconnectRule) wait(attempt int) time.Duration {
+	if attempt == 0 {
+		return r.Delay
+	}
+	d := max(r.Delay, time.Second)
+	for i := 1; i < attempt && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	return max(min(d, r.MaxDelay), r.Delay)
+}
+
+// reconnectPolicy is the reconnect rule of each failure class
+type reconnectPolicy map[tunnel.Failure]reconnectRule
+
+// defaultReconnectPolicy returns the rules used unless --reconnect-policy
+// overrides them: network blips are retried at once and then every delay
+// (--reconnect-delay), throttling and expired credentials back off for
+// minutes, and denied access is not retried
+func defaultReconnectPolicy(delay time.Duration) reconnectPolicy {
+	return reconnectPolicy{
+		tunnel.FailureNetwork:      {Delay: 0, MaxDelay: delay},
+		tunnel.FailureTarget:       {Delay: delay, MaxDelay: 2 * time.Minute},
+		tunnel.FailureThrottled:    {Delay: 30 * time.Second, MaxDelay: 5 * time.Minute},
+		tunnel.FailureAuth:         {Delay: time.Minute, MaxDelay: 5 * time.Minute},
+		tunnel.FailureAccessDenied: {Never: true},
+	}
+}
+
+// parseReconnectPolicy returns the default policy with the rules of
+// --reconnect-policy (or the config file) applied
+func parseReconnectPolicy(rules []string, delay time.Duration) (reconnectPolicy, error) {
+	policy := defaultReconnectPolicy(delay)
+	for _, value := range rules {
+		class, spec, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --reconnect-policy %q (expected CLASS=DELAY[..MAX_DELAY] or CLASS=never)", value)
+		}
+		failure, err := tunnel.ParseFailure(class)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --reconnect-policy %q: %w", value, err)
+		}
+		rule, err := parseReconnectRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --reconnect-policy %q: %w", value, err)
+		}
+		policy[failure] = rule
+	}
+	return policy, nil
+}
+
+// parseReconnectRule parses DELAY, DELAY..MAX_DELAY or never
+func parseReconnectRule(spec string) (reconnectRule, error) {
+	if spec == "never" {
+		return reconnectRule{Never: true}, nil
+	}
+	first, last, backoff := strings.Cut(spec, "..")
+	delay, err := time.ParseDuration(first)
+	if err != nil || delay < 0 {
+		return reconnectRule{}, fmt.Errorf("invalid delay %q", first)
+	}
+	rule := reconnectRule{Delay: delay, MaxDelay: delay}
+	if backoff {
+		maxDelay, err := time.ParseDuration(last)
+		if err != nil || maxDelay < delay {
+			return reconnectRule{}, fmt.Errorf("invalid maximum delay %q (expected at least %s)", last, delay)
+		}
+		rule.MaxDelay = maxDelay
+	}
+	return rule, nil
+}
+
+// reconnectState tracks the failures in a row of a tunnel, to pick the
+// reconnect delay from the policy
+type reconnectState struct {
+	policy  reconnectPolicy
+	class   tunnel.Failure // of the latest failure
+	attempt int            // reconnects in a row after failures of class
+}
+
+// decide returns the class of a failure, its rule and how long to wait
+// before reconnecting. The backoff starts over when the class changes.
+func (s *reconnectState) decide(err error) (tunnel.Failure, reconnectRule, time.Duration) {
+	class := tunnel.Classify(err)
+	if class != s.class {
+		s.class, s.attempt = class, 0
+	}
+	rule := s.policy[class]
+	wait := rule.wait(s.attempt)
+	s.attempt++
+	return class, rule, wait
+}
+
+// reset starts the backoff over once the tunnel is healthy again
+func (s *reconnectState) reset() {
+	s.class, s.attempt = "", 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+)
+
+// recordingExt is the file extension of recordings
+const recordingExt = ".ssmrec"
+
+// sessionRecorders are the recordings of a session (--record)
+type sessionRecorders struct {
+	packets  *record.Writer // TUN packets
+	messages *record.Writer // SSM messages, with the native transport
+}
+
+// openRecorders creates the recordings of a session in dir. Without a dir
+// nothing is recorded; the nil writers record nothing.
+func openRecorders(dir, session string) (*sessionRecorders, error) {
+	recorders := &sessionRecorders{}
+	if dir == "" {
+		return recorders, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	path := filepath.Join(dir, session+"-packets"+recordingExt)
+	packets, err := record.Create(path, record.KindPackets)
+	if err != nil {
+		return nil, err
+	}
+	recorders.packets = packets
+	fmt.Printf("✓ Recording TUN packets to %s\n", path)
+
+	if transport != transportNative {
+		fmt.Printf("  └─ ⚠️  SSM messages are only recorded with --transport %s\n", transportNative)
+		return recorders, nil
+	}
+	path = filepath.Join(dir, session+"-messages"+recordingExt)
+	messages, err := record.Create(path, record.KindMessages)
+	if err != nil {
+		packets.Close()
+		return nil, err
+	}
+	recorders.messages = messages
+	fmt.Printf("✓ Recording SSM messages to %s\n", path)
+	return recorders, nil
+}
+
+// Close finishes the recordings
+func (r *sessionRecorders) Close() error {
+	err := r.packets.Close()
+	if messagesErr := r.messages.Close(); err == nil {
+		err = messagesErr
+	}
+	return err
+}
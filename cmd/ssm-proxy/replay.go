@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayTarget   string
+	replayDNS      string
+	replayRealtime bool
+	replayOutput   string
+	replayDump     bool
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay RECORDING",
+	Short: "Replay a recording taken with 'start --record'",
+	Long: `Feed a recording taken with 'start --record' back through ssm-proxy to
+reproduce protocol bugs, without AWS or a TUN device.
+
+A packets recording is fed through the packet forwarder as if read from the
+TUN device; the report shows which connections it opened and how many
+packets it wrote back. Connections are refused unless --target is given;
+TCP does not get past the handshake, as the forwarder picks other sequence
+numbers than the recording's.
+
+A messages recording is fed through the SSM session's message handling as
+if received from the agent; the report counts the messages by type and the
+stream data they carried, and lists the ones that could not be handled.
+
+Examples:
+  # Reproduce a field report
+  ssm-proxy replay prod-vpc-packets.ssmrec
+
+  # Let connections reach a local test server, answer DNS with a local server
+  ssm-proxy replay prod-vpc-packets.ssmrec --target 127.0.0.1:8080 --dns-resolver 127.0.0.1:53
+
+  # Extract the stream the agent sent
+  ssm-proxy replay prod-vpc-messages.ssmrec --output stream.bin
+
+  # List the records
+  ssm-proxy replay prod-vpc-messages.ssmrec --dump`,
+	Args: cobra.ExactArgs(1),
+	RunE: runReplay,
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().StringVar(&replayTarget, "target", "", "Send every TCP connection of a packets recording to this address (default: refuse them)")
+	replayCmd.Flags().StringVar(&replayDNS, "dns-resolver", "", "Answer the DNS queries of a packets recording with this DNS server (default: drop them)")
+	replayCmd.Flags().BoolVar(&replayRealtime, "realtime", false, "Keep the recorded gaps between packets (up to 1s each)")
+	replayCmd.Flags().StringVar(&replayOutput, "output", "", "Write what the replay produced: a recording of the packets written back, or the stream data of a messages recording")
+	replayCmd.Flags().BoolVar(&replayDump, "dump", false, "List the records instead of replaying them")
+}
+
+func runReplay(cmd *cobra.Command, args []string) error {
+	r, err := record.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if replayDump {
+		return dumpRecording(r)
+	}
+
+	switch r.Kind() {
+	case record.KindPackets:
+		return replayPackets(r)
+	default:
+		return replayMessages(r)
+	}
+}
+
+// replayPackets feeds a packets recording through the forwarder
+func replayPackets(r *record.Reader) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	options := forwarder.ReplayOptions{Realtime: replayRealtime}
+	if replayTarget != "" || replayDNS != "" {
+		options.Dialer = replayDialer{}
+	}
+	if replayDNS != "" {
+		options.DNS = &dns.Config{Resolvers: []string{replayDNS}}
+	}
+	if replayOutput != "" {
+		output, err := record.Create(replayOutput, record.KindPackets)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+		options.Output = output
+	}
+
+	result, err := forwarder.ReplayPackets(ctx, r, options)
+	if result == nil {
+		return err
+	}
+
+	fmt.Printf("✓ Replayed %d packet(s)\n", result.Fed)
+	fmt.Printf("  ├─ Written back: %d packet(s) (%d in the recording)\n", result.Written, result.Recorded)
+	fmt.Printf("  ├─ Errors: %d forwarding, %d writing back\n", result.Stats.ErrorsTX, result.Stats.ErrorsRX)
+	fmt.Printf("  ├─ Connections: %d (peak %d open)\n", len(result.Dials), result.Stats.ConnsPeak)
+	for i, dial := range result.Dials {
+		prefix := "│  ├─"
+		if i == len(result.Dials)-1 {
+			prefix = "│  └─"
+		}
+		fmt.Printf("  %s %s\n", prefix, dial)
+	}
+	if replayOutput != "" {
+		fmt.Printf("  └─ Output: %s\n", replayOutput)
+	} else {
+		fmt.Printf("  └─ Done\n")
+	}
+	return err
+}
+
+// replayDialer opens the connections of a packet replay: those to the DNS
+// server go to --dns-resolver, the others to --target
+type replayDialer struct{}
+
+// DialContext connects to --dns-resolver or --target instead of address
+func (replayDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	switch {
+	case replayDNS != "" && address == replayDNS:
+		return d.DialContext(ctx, network, replayDNS)
+	case replayTarget != "":
+		return d.DialContext(ctx, network, replayTarget)
+	}
+	return nil, errors.New("connections are refused without --target")
+}
+
+// replayMessages feeds a messages recording through the SSM message
+// handling
+func replayMessages(r *record.Reader) error {
+	var out io.Writer
+	if replayOutput != "" {
+		file, err := os.Create(replayOutput)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	result, err := ssm.ReplayMessages(r, out)
+	if result == nil {
+		return err
+	}
+
+	received := 0
+	types := make([]string, 0, len(result.Received))
+	for messageType, count := range result.Received {
+		received += count
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+
+	fmt.Printf("✓ Replayed %d message(s) from the agent (%d sent to it)\n", received+len(result.Errors), result.Sent)
+	for _, messageType := range types {
+		fmt.Printf("  ├─ %s: %d\n", messageType, result.Received[messageType])
+	}
+	fmt.Printf("  ├─ Stream data: %s\n", formatBytes(uint64(result.StreamBytes)))
+	if result.EndedAt > 0 {
+		fmt.Printf("  ├─ Session ended at record %d (%d message(s) after it ignored)\n", result.EndedAt, result.AfterEnd)
+	}
+
+	records := make([]int, 0, len(result.Errors))
+	for n := range result.Errors {
+		records = append(records, n)
+	}
+	sort.Ints(records)
+	for _, n := range records {
+		fmt.Printf("  ├─ ⚠️  Record %d: %v\n", n, result.Errors[n])
+	}
+	if replayOutput != "" {
+		fmt.Printf("  └─ Output: %s\n", replayOutput)
+	} else {
+		fmt.Printf("  └─ Done\n")
+	}
+	return err
+}
+
+// dumpRecording lists the records of a recording, one per line
+func dumpRecording(r *record.Reader) error {
+	var start int64
+	for n := 1; ; n++ {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read record %d: %w", n, err)
+		}
+		if start == 0 {
+			start = rec.Time.UnixNano()
+		}
+
+		summary := describeMessage(rec.Data)
+		if r.Kind() == record.KindPackets {
+			summary = describePacket(rec.Data)
+		}
+		fmt.Printf("%6d %+10.3fs %-3s %6d  %s\n",
+			n, float64(rec.Time.UnixNano()-start)/1e9, rec.Direction, len(rec.Data), summary)
+	}
+}
+
+// describePacket summarizes an IP packet: protocol and addresses
+func describePacket(packet []byte) string {
+	var src, dst netip.Addr
+	var protocol byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		protocol = packet[9]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		protocol = packet[6]
+	default:
+		return "invalid IP packet"
+	}
+
+	name := fmt.Sprintf("proto %d", protocol)
+	switch protocol {
+	case 1, 58:
+		name = "ICMP"
+	case 6:
+		name = "TCP"
+	case 17:
+		name = "UDP"
+	}
+	return fmt.Sprintf("%s %s -> %s", name, src, dst)
+}
+
+// describeMessage summarizes a Session Manager message: type, sequence
+// number and payload. The first message of a session opens the data
+// channel, in JSON.
+func describeMessage(message []byte) string {
+	if msg, err := ssm.ParseAgentMessage(message); err == nil {
+		return msg.String()
+	}
+	var open struct{ TokenValue string }
+	if err := json.Unmarshal(message, &open); err == nil && open.TokenValue != "" {
+		return "open_data_channel"
+	}
+	return "invalid message"
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+)
+
+// Role assumed for all AWS calls (--role-arn, --external-id, --mfa-serial)
+var (
+	roleARN    string
+	externalID string
+	mfaSerial  string
+)
+
+// mfaPrompt serializes MFA prompts: clients refreshing the role
+// credentials at once share one
+var mfaPrompt sync.Mutex
+
+// awsAccount is the region and role AWS calls for a tunnel are made in,
+// so that tunnels of one start can reach instances in other regions and
+// accounts than the profile's
+type awsAccount struct {
+	Region  string // "" for the profile's
+	RoleARN string // "" to use the profile's credentials as they are
+}
+
+// defaultAWSAccount returns the account of --region and --role-arn
+func defaultAWSAccount() awsAccount {
+	return awsAccount{Region: awsRegion, RoleARN: roleARN}
+}
+
+// String describes the account for output, "" for the default one
+func (a awsAccount) String() string {
+	var parts []string
+	if a.Region != "" {
+		parts = append(parts, "region: "+a.Region)
+	}
+	if a.RoleARN != "" {
+		parts = append(parts, "role: "+a.RoleARN)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// newAWSClient creates an AWS client for --profile and --region, assuming
+// --role-arn if set
+func newAWSClient(ctx context.Context) (*aws.Client, error) {
+	return defaultAWSAccount().client(ctx)
+}
+
+// client creates an AWS client for --profile in the account, after
+// logging in to SSO if the profile needs it
+func (a awsAccount) client(ctx context.Context) (*aws.Client, error) {
+	client, err := aws.NewClientWithRole(ctx, awsProfile, a.Region, assumedRole(a.RoleARN))
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSSOLogin(ctx, client, 0); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// assumedRole returns the role to assume, with --external-id and
+// --mfa-serial; nil for ""
+func assumedRole(roleARN string) *aws.AssumeRole {
+	if roleARN == "" {
+		return nil
+	}
+	role := &aws.AssumeRole{RoleARN: roleARN, ExternalID: externalID, MFASerial: mfaSerial}
+	if mfaSerial != "" && !headless {
+		role.TokenProvider = readMFACode
+	}
+	return role
+}
+
+// readMFACode asks for the current code of the --mfa-serial device on the
+// terminal
+func readMFACode() (string, error) {
+	mfaPrompt.Lock()
+	defer mfaPrompt.Unlock()
+
+	if !isInteractive() {
+		return "", fmt.Errorf("an MFA code for %s is required, but stdin is not a terminal", mfaSerial)
+	}
+	fmt.Fprintf(os.Stderr, "Enter MFA code for %s: ", mfaSerial)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read MFA code: %w", err)
+	}
+	code := strings.TrimSpace(line)
+	if code == "" {
+		return "", fmt.Errorf("no MFA code entered")
+	}
+	return code, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -18,6 +19,11 @@ var (
 	debug      bool
 	quiet      bool
 	log        = logrus.New()
+
+	// Headless mode for CI: no prompts, banners or TTY behaviors, and
+	// bounded startup time
+	headless        bool
+	headlessTimeout time.Duration
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -41,6 +47,17 @@ Example:
 
 For more information: https://github.com/sbkg0002/ssm-proxy`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// --headless may also come from the config file or SSM_PROXY_HEADLESS
+		headless = viper.GetBool("headless")
+
+		// So may the AWS profile, region and role
+		awsProfile = viper.GetString("aws.profile")
+		awsRegion = viper.GetString("aws.region")
+		roleARN = viper.GetString("aws.role_arn")
+		externalID = viper.GetString("aws.external_id")
+		mfaSerial = viper.GetString("aws.mfa_serial")
+		ssoLogin = viper.GetBool("aws.sso_login")
+
 		// Set up logging based on flags
 		if quiet {
 			log.SetLevel(logrus.ErrorLevel)
@@ -52,10 +69,12 @@ For more information: https://github.com/sbkg0002/ssm-proxy`,
 			log.SetLevel(logrus.WarnLevel)
 		}
 
-		log.SetFormatter(&logrus.TextFormatter{
+		log.SetFormatter(&logFormatter{logrus.TextFormatter{
 			FullTimestamp:   true,
-			TimestampFormat: "2006-01-02 15:04:05",
-		})
+			TimestampFormat: time.RFC3339,
+			DisableColors:   headless,
+		}})
+		shareLogger()
 	},
 }
 
@@ -74,13 +93,28 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default: ~/.ssm-proxy/config.yaml)")
 	rootCmd.PersistentFlags().StringVar(&awsProfile, "profile", "", "AWS profile name (default: $AWS_PROFILE or 'default')")
 	rootCmd.PersistentFlags().StringVar(&awsRegion, "region", "", "AWS region (default: $AWS_REGION or from profile)")
+	rootCmd.PersistentFlags().StringVar(&roleARN, "role-arn", "", "IAM role to assume with the profile's credentials for all AWS calls")
+	rootCmd.PersistentFlags().StringVar(&externalID, "external-id", "", "external ID required by the trust policy of --role-arn")
+	rootCmd.PersistentFlags().StringVar(&mfaSerial, "mfa-serial", "", "ARN of the MFA device --role-arn requires (prompts for a code)")
+	rootCmd.PersistentFlags().BoolVar(&ssoLogin, "sso-login", true, "run 'aws sso login' when the SSO session of the profile has expired (interactive only)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "debug output (very verbose)")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "quiet mode (errors only)")
+	rootCmd.PersistentFlags().BoolVar(&useUTC, "utc", false, "show and log times in UTC instead of local time")
+
+	rootCmd.PersistentFlags().BoolVar(&headless, "headless", false,
+		"non-interactive mode for CI: no prompts, banners or terminal control sequences, and fail if startup exceeds --headless-timeout")
+	rootCmd.PersistentFlags().DurationVar(&headlessTimeout, "headless-timeout", 2*time.Minute,
+		"maximum time to establish the tunnel in --headless mode")
 
 	// Bind flags to viper
+	viper.BindPFlag("headless", rootCmd.PersistentFlags().Lookup("headless"))
 	viper.BindPFlag("aws.profile", rootCmd.PersistentFlags().Lookup("profile"))
 	viper.BindPFlag("aws.region", rootCmd.PersistentFlags().Lookup("region"))
+	viper.BindPFlag("aws.role_arn", rootCmd.PersistentFlags().Lookup("role-arn"))
+	viper.BindPFlag("aws.external_id", rootCmd.PersistentFlags().Lookup("external-id"))
+	viper.BindPFlag("aws.mfa_serial", rootCmd.PersistentFlags().Lookup("mfa-serial"))
+	viper.BindPFlag("aws.sso_login", rootCmd.PersistentFlags().Lookup("sso-login"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/spf13/cobra"
+)
+
+// routeSession is the session the route commands change
+var routeSession string
+
+var routeCmd = &cobra.Command{
+	Use:   "route",
+	Short: "Change the routes of a running session",
+	Long: `Add or remove CIDR blocks routed through a running session without
+restarting its tunnel. Connections to the remaining blocks are not
+interrupted.
+
+Examples:
+  # Also route another subnet through the most recent session
+  sudo ssm-proxy route add 172.31.0.0/16
+
+  # Stop routing it through session prod-vpc
+  sudo ssm-proxy route remove 172.31.0.0/16 --session-name prod-vpc`,
+}
+
+var routeAddCmd = &cobra.Command{
+	Use:   "add CIDR...",
+	Short: "Route more CIDR blocks through a running session",
+	Long: `Route more CIDR blocks (or @group references) through a running session.
+Route conflicts are handled per the session's --route-conflicts. Blocks the
+session already routes are skipped; if a route cannot be added, none are.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return changeRoutes(control.MethodRouteAdd, args)
+	},
+}
+
+var routeRemoveCmd = &cobra.Command{
+	Use:   "remove CIDR...",
+	Short: "Stop routing CIDR blocks through a running session",
+	Long: `Stop routing CIDR blocks (or @group references) through a running session.
+Each must be one of the session's blocks, as listed by 'ssm-proxy status'.`,
+	Aliases: []string{"rm", "delete"},
+	Args:    cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return changeRoutes(control.MethodRouteRemove, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(routeCmd)
+	routeCmd.AddCommand(routeAddCmd)
+	routeCmd.AddCommand(routeRemoveCmd)
+
+	routeCmd.PersistentFlags().StringVar(&routeSession, "session-name", "", "Session to change (default: the most recent one)")
+}
+
+// changeRoutes asks a running session to add or remove routes and prints
+// the outcome
+func changeRoutes(method string, args []string) error {
+	cidrs, err := expandCIDRs(args)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range cidrs {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR block %s: %w", cidr, err)
+		}
+	}
+
+	name, err := runningSession(routeSession)
+	if err != nil {
+		return err
+	}
+
+	var result routeResult
+	if err := control.Call(control.SocketPath(name), method, "", routeParams{CIDRs: cidrs}, &result); err != nil {
+		return fmt.Errorf("session %s: %w", name, err)
+	}
+
+	switch {
+	case method == control.MethodRouteRemove:
+		fmt.Printf("✓ Stopped routing %v through session %s\n", cidrs, name)
+		for _, route := range result.Routes {
+			fmt.Printf("  ├─ Removed route %s\n", route)
+		}
+		if result.Reset > 0 {
+			fmt.Printf("  ├─ Reset %d connection(s) to them\n", result.Reset)
+		}
+	case len(result.Routes) == 0:
+		fmt.Printf("✓ Session %s already routes %v\n", name, cidrs)
+	default:
+		fmt.Printf("✓ Routing %v through session %s\n", cidrs, name)
+		for _, route := range result.Routes {
+			fmt.Printf("  ├─ Added route %s\n", route)
+		}
+	}
+	fmt.Printf("  └─ CIDR blocks: %v\n", result.CIDRs)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/health"
+)
+
+// Self-test modes (--selftest)
+const (
+	selftestOff  = "off"
+	selftestWarn = "warn"
+	selftestFail = "fail"
+)
+
+// validateSelfTest checks the --selftest flags
+func validateSelfTest() error {
+	switch selftestMode {
+	case selftestOff, selftestWarn, selftestFail:
+	default:
+		return fmt.Errorf("invalid --selftest value %q (expected %s, %s or %s)", selftestMode, selftestOff, selftestWarn, selftestFail)
+	}
+	if selftestEndpoint != "" {
+		if _, _, err := net.SplitHostPort(selftestEndpoint); err != nil {
+			return fmt.Errorf("invalid --selftest-endpoint %q (expected host:port): %w", selftestEndpoint, err)
+		}
+	}
+	if selftestURL != "" {
+		if u, err := url.Parse(selftestURL); err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid --selftest-url %q (expected http://host/path)", selftestURL)
+		}
+	}
+	return nil
+}
+
+// runSelfTest resolves a name, connects and downloads through the tunnel's
+// routes like an application would, and fails (or warns) if the tunnel is
+// unusable. With several tunnels, each tests the endpoints it routes.
+func runSelfTest(ctx context.Context, spec *tunnelSpec) error {
+	config := health.SelfTestConfig{Endpoint: selftestEndpoint, URL: selftestURL}
+	if config.Endpoint == "" && spec.Health {
+		config.Endpoint = healthEndpoint
+	}
+	if dnsResolver != "" && spec.DNS {
+		if config.Endpoint == "" {
+			config.Endpoint = dnsResolver
+		}
+		config.DNSServer = dnsResolver
+		config.DNSName = selfTestDNSName()
+	}
+	if !routedBy(config.Endpoint, spec.CIDRs) {
+		config.Endpoint = ""
+	}
+	if config.URL != "" {
+		if u, err := url.Parse(config.URL); err != nil || !routedBy(u.Host, spec.CIDRs) {
+			config.URL = ""
+		}
+	}
+
+	if config.Endpoint == "" {
+		if selftestMode == selftestFail {
+			return fmt.Errorf("self-test needs an endpoint the tunnel routes (--selftest-endpoint, --health-endpoint or --dns-resolver)")
+		}
+		fmt.Println("⚠️  Self-test skipped: no endpoint the tunnel routes (see --selftest-endpoint)")
+		return nil
+	}
+
+	fmt.Println("✓ Running self-test...")
+	report := health.SelfTest(ctx, &net.Dialer{}, config)
+	for i, step := range report.Steps {
+		prefix := "├─"
+		if i == len(report.Steps)-1 {
+			prefix = "└─"
+		}
+		if step.Err != nil {
+			fmt.Printf("  %s %s: ✗ %v\n", prefix, step.Name, step.Err)
+		} else {
+			fmt.Printf("  %s %s: %s\n", prefix, step.Name, step.Detail)
+		}
+	}
+
+	if err := report.Err(); err != nil {
+		if selftestMode == selftestFail {
+			return fmt.Errorf("self-test failed, the tunnel is not usable: %w", err)
+		}
+		fmt.Println("  ⚠️  The tunnel may not be usable (check security groups, NAT mappings and routes)")
+	}
+	return nil
+}
+
+// selfTestDNSName returns the name the self-test resolves: the health
+// check's, else one in the first --dns-domains suffix, else a public name
+// the VPC resolver answers for
+func selfTestDNSName() string {
+	switch {
+	case healthDNSName != "":
+		return healthDNSName
+	case len(dnsDomains) > 0:
+		return strings.TrimPrefix(dnsDomains[0], ".")
+	default:
+		return "amazonaws.com"
+	}
+}
+
+// routedBy reports whether the host of a host[:port] address is an IP in
+// one of the CIDR blocks; names are assumed to be routed
+func routedBy(hostport string, cidrs []string) bool {
+	if hostport == "" {
+		return false
+	}
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serviceEnv marks a process started by the system service of a profile
+// (its value is the profile)
+const serviceEnv = "SSM_PROXY_SERVICE"
+
+// serviceNoStart installs the service without starting it now
+var serviceNoStart bool
+
+// serviceEnvKeys are the environment variables passed on to the service,
+// so that it finds the same AWS credentials and state as 'sudo ssm-proxy'
+var serviceEnvKeys = []string{
+	"HOME",
+	"AWS_PROFILE",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_CONFIG_FILE",
+	"AWS_SHARED_CREDENTIALS_FILE",
+}
+
+// serviceSpec is what the service of a profile runs
+type serviceSpec struct {
+	Name    string // launchd label or systemd unit
+	Profile string
+	Args    []string // executable first
+	Env     []string // KEY=VALUE
+	LogPath string   // "" if the service manager keeps the logs
+}
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Run a profile as a system service that starts at boot",
+	Long: `Install a profile of the config file ('profiles:' section) as a system
+service: a launchd daemon on macOS, a systemd unit on Linux. The service
+starts the proxy at boot and restarts it when it fails, as
+'ssm-proxy start PROFILE --headless'.
+
+Each profile is its own service, so several can be installed side by side.
+Logs go to /Library/Logs/ssm-proxy/PROFILE.log on macOS (rotated like the
+--daemon log) and to the journal on Linux.
+
+Examples:
+  # Start the prod-vpc profile at boot, and now
+  sudo ssm-proxy service install prod-vpc
+
+  # Stop it until the next boot or 'service start'
+  sudo ssm-proxy service stop prod-vpc
+
+  # Remove it
+  sudo ssm-proxy service uninstall prod-vpc`,
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install PROFILE",
+	Short: "Install and start the service of a profile",
+	Long: `Install the service of a profile and start it, unless --no-start is given.
+Installing a profile again replaces its service, picking up changes of the
+global flags and the AWS environment variables.
+
+The service runs with the config file, global flags (--profile, --region,
+--role-arn, ...), HOME and AWS_* environment variables of this command.
+It cannot prompt, so its AWS credentials must not need an MFA code or an
+interactive SSO login.`,
+	Args:    cobra.ExactArgs(1),
+	PreRunE: serviceArgs,
+	RunE:    runServiceInstall,
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:     "uninstall PROFILE",
+	Short:   "Stop and remove the service of a profile",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: serviceArgs,
+	RunE:    runServiceUninstall,
+}
+
+var serviceStartCmd = &cobra.Command{
+	Use:     "start PROFILE",
+	Short:   "Start the installed service of a profile",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: serviceArgs,
+	RunE:    runServiceStart,
+}
+
+var serviceStopCmd = &cobra.Command{
+	Use:   "stop PROFILE",
+	Short: "Stop the service of a profile until the next boot",
+	Long: `Stop the service of a profile. It stays stopped until the next boot or
+'service start'; use 'service uninstall' to keep it from starting at boot.`,
+	Args:    cobra.ExactArgs(1),
+	PreRunE: serviceArgs,
+	RunE:    runServiceStop,
+}
+
+func init() {
+	rootCmd.AddCommand(serviceCmd)
+	serviceCmd.AddCommand(serviceInstallCmd)
+	serviceCmd.AddCommand(serviceUninstallCmd)
+	serviceCmd.AddCommand(serviceStartCmd)
+	serviceCmd.AddCommand(serviceStopCmd)
+
+	serviceInstallCmd.Flags().BoolVar(&serviceNoStart, "no-start", false, "Only start the service at the next boot")
+}
+
+// serviceArgs checks the privileges and the profile name of the service
+// commands
+func serviceArgs(cmd *cobra.Command, args []string) error {
+	requireRoot()
+	if err := session.ValidateName(args[0]); err != nil {
+		return fmt.Errorf("invalid profile name: %w", err)
+	}
+	return nil
+}
+
+// isServiceChild reports whether this process was started by the system
+// service of a profile
+func isServiceChild() bool {
+	return os.Getenv(serviceEnv) != ""
+}
+
+func runServiceInstall(cmd *cobra.Command, args []string) error {
+	spec, err := buildServiceSpec(args[0])
+	if err != nil {
+		return err
+	}
+	if spec.LogPath != "" {
+		if err := os.MkdirAll(filepath.Dir(spec.LogPath), 0755); err != nil {
+			return fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+
+	path := serviceFile(spec.Name)
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("✓ Replacing the service of profile %s...\n", spec.Profile)
+		if err := stopService(spec.Name); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("✓ Installing the service of profile %s...\n", spec.Profile)
+	}
+
+	if err := os.WriteFile(path, renderService(spec), 0644); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	fmt.Printf("  ├─ Service file: %s\n", path)
+	fmt.Printf("  ├─ Runs: %s\n", strings.Join(spec.Args, " "))
+	if err := enableService(spec.Name); err != nil {
+		return err
+	}
+
+	if serviceNoStart {
+		fmt.Printf("  └─ Logs: %s\n", serviceLogs(spec))
+		fmt.Printf("\nStarts at the next boot, or now with: sudo ssm-proxy service start %s\n", spec.Profile)
+		return nil
+	}
+	if err := startService(spec.Name); err != nil {
+		return err
+	}
+	fmt.Printf("  └─ Logs: %s\n", serviceLogs(spec))
+	fmt.Println("\n✓ Service started")
+	return nil
+}
+
+func runServiceUninstall(cmd *cobra.Command, args []string) error {
+	profile := args[0]
+	name := serviceName(profile)
+	path := serviceFile(name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no service installed for profile %s (%s)", profile, path)
+	}
+
+	fmt.Printf("✓ Removing the service of profile %s...\n", profile)
+	if err := stopService(name); err != nil {
+		return err
+	}
+	if err := disableService(name); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove service file: %w", err)
+	}
+	fmt.Printf("  └─ Removed %s\n", path)
+	return nil
+}
+
+func runServiceStart(cmd *cobra.Command, args []string) error {
+	profile := args[0]
+	name := serviceName(profile)
+	if _, err := os.Stat(serviceFile(name)); err != nil {
+		return fmt.Errorf("no service installed for profile %s (install it with 'ssm-proxy service install %s')", profile, profile)
+	}
+	if err := startService(name); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Service of profile %s started\n", profile)
+	return nil
+}
+
+func runServiceStop(cmd *cobra.Command, args []string) error {
+	profile := args[0]
+	name := serviceName(profile)
+	if _, err := os.Stat(serviceFile(name)); err != nil {
+		return fmt.Errorf("no service installed for profile %s", profile)
+	}
+	if err := stopService(name); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Service of profile %s stopped\n", profile)
+	return nil
+}
+
+// buildServiceSpec returns what the service of profile runs: this
+// executable's start command with the profile, the config file found now
+// and the global flags of this invocation
+func buildServiceSpec(profile string) (serviceSpec, error) {
+	config := viper.ConfigFileUsed()
+	if config == "" {
+		return serviceSpec{}, fmt.Errorf("no config file found; the service runs a profile of its 'profiles' section")
+	}
+	if !viper.IsSet("profiles." + profile) {
+		return serviceSpec{}, fmt.Errorf("no profile %q in the 'profiles' section of the config file (%s)", profile, config)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return serviceSpec{}, fmt.Errorf("failed to locate ssm-proxy executable: %w", err)
+	}
+	// The service starts in another directory
+	if config, err = filepath.Abs(config); err != nil {
+		return serviceSpec{}, fmt.Errorf("failed to resolve config file path: %w", err)
+	}
+	cfgFile = config
+
+	spec := serviceSpec{
+		Name:    serviceName(profile),
+		Profile: profile,
+		Args:    append([]string{exe, "start", profile, "--headless"}, globalFlagArgs()...),
+		Env:     []string{serviceEnv + "=" + profile},
+		LogPath: serviceLogPath(profile),
+	}
+	if spec.LogPath != "" {
+		spec.Args = append(spec.Args, "--log-file", spec.LogPath)
+	}
+	for _, key := range serviceEnvKeys {
+		if value := os.Getenv(key); value != "" {
+			spec.Env = append(spec.Env, key+"="+value)
+		}
+	}
+	return spec, nil
+}
+
+// serviceLogs describes where the logs of a service go
+func serviceLogs(spec serviceSpec) string {
+	if spec.LogPath != "" {
+		return spec.LogPath
+	}
+	return "journalctl -u " + spec.Name
+}
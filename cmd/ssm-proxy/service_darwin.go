@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchd locations of the services
+const (
+	serviceDir    = "/Library/LaunchDaemons"
+	serviceLogDir = "/Library/Logs/ssm-proxy"
+)
+
+// serviceRestartDelay is how long launchd waits before restarting a failed
+// service, in seconds
+const serviceRestartDelay = 30
+
+// serviceName returns the launchd label of the service of profile
+func serviceName(profile string) string {
+	return "com.github.sbkg0002.ssm-proxy." + profile
+}
+
+// serviceFile returns the path of the launchd plist of a service
+func serviceFile(name string) string {
+	return filepath.Join(serviceDir, name+".plist")
+}
+
+// serviceLogPath returns the log file of the service of profile
+func serviceLogPath(profile string) string {
+	return filepath.Join(serviceLogDir, profile+".log")
+}
+
+// renderService returns the launchd plist of a service: started at boot,
+// and again whenever it exits with an error
+func renderService(spec serviceSpec) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	plistString(&b, "Label", spec.Name)
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range spec.Args {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", plistEscape(arg))
+	}
+	b.WriteString("\t</array>\n\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+	for _, env := range spec.Env {
+		key, value, _ := strings.Cut(env, "=")
+		fmt.Fprintf(&b, "\t\t<key>%s</key>\n\t\t<string>%s</string>\n", plistEscape(key), plistEscape(value))
+	}
+	b.WriteString("\t</dict>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	fmt.Fprintf(&b, "\t<key>ThrottleInterval</key>\n\t<integer>%d</integer>\n", serviceRestartDelay)
+	plistString(&b, "StandardOutPath", spec.LogPath)
+	plistString(&b, "StandardErrorPath", spec.LogPath)
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// plistString writes a string entry of the top-level dict
+func plistString(b *bytes.Buffer, key, value string) {
+	fmt.Fprintf(b, "\t<key>%s</key>\n\t<string>%s</string>\n", key, plistEscape(value))
+}
+
+// plistEscape escapes s for XML text
+func plistEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// enableService lets launchd load a service at boot
+func enableService(name string) error {
+	return launchctl("enable", "system/"+name)
+}
+
+// disableService keeps launchd from loading a service at boot
+func disableService(name string) error {
+	return launchctl("disable", "system/"+name)
+}
+
+// startService loads a service, which starts it, or restarts it if it is
+// loaded already
+func startService(name string) error {
+	if serviceLoaded(name) {
+		return launchctl("kickstart", "-k", "system/"+name)
+	}
+	return launchctl("bootstrap", "system", serviceFile(name))
+}
+
+// stopService unloads a service, which stops it until the next boot
+func stopService(name string) error {
+	if !serviceLoaded(name) {
+		return nil
+	}
+	return launchctl("bootout", "system/"+name)
+}
+
+// serviceLoaded reports whether launchd has loaded a service
+func serviceLoaded(name string) bool {
+	return exec.Command("launchctl", "print", "system/"+name).Run() == nil
+}
+
+// launchctl runs launchctl with args
+func launchctl(args ...string) error {
+	if output, err := exec.Command("launchctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl %s: %s: %w", args[0], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
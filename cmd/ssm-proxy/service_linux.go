@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// serviceDir is where the systemd units of the services go
+const serviceDir = "/etc/systemd/system"
+
+// serviceRestartDelay is how long systemd waits before restarting a failed
+// service
+const serviceRestartDelay = "30s"
+
+// serviceName returns the systemd unit of the service of profile
+func serviceName(profile string) string {
+	return "ssm-proxy-" + profile + ".service"
+}
+
+// serviceFile returns the path of the systemd unit of a service
+func serviceFile(name string) string {
+	return filepath.Join(serviceDir, name)
+}
+
+// serviceLogPath returns "": the journal keeps the logs of the services
+func serviceLogPath(profile string) string {
+	return ""
+}
+
+// renderService returns the systemd unit of a service: started at boot
+// once the network is up, and again whenever it exits with an error
+func renderService(spec serviceSpec) []byte {
+	var b bytes.Buffer
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=ssm-proxy profile %s\n", spec.Profile)
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n\n")
+
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=simple\n")
+	quoted := make([]string, len(spec.Args))
+	for i, arg := range spec.Args {
+		quoted[i] = systemdQuote(arg)
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	for _, env := range spec.Env {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(env))
+	}
+	b.WriteString("Restart=on-failure\n")
+	fmt.Fprintf(&b, "RestartSec=%s\n", serviceRestartDelay)
+	fmt.Fprintf(&b, "TimeoutStopSec=%d\n\n", int((daemonStopTimeout + stopTimeout).Seconds()))
+
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.Bytes()
+}
+
+// systemdQuote quotes s for a unit file if it needs quoting; % and $ are
+// doubled so that systemd takes them literally
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// enableService has systemd start a service at boot
+func enableService(name string) error {
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", name)
+}
+
+// disableService keeps systemd from starting a service at boot
+func disableService(name string) error {
+	if err := systemctl("disable", name); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// startService starts a service, or restarts it if it is running
+func startService(name string) error {
+	return systemctl("restart", name)
+}
+
+// stopService stops a service until the next boot
+func stopService(name string) error {
+	return systemctl("stop", name)
+}
+
+// systemctl runs systemctl with args
+func systemctl(args ...string) error {
+	if output, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %s: %s: %w", args[0], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
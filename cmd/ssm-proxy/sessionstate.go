@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sbkg0002/ssm-proxy/internal/session"
+)
+
+// sessionUpdates carries changes to a running tunnel's session state to the
+// main loop of runTunnel, the only goroutine touching the session. The
+// control socket, health monitor, standby and failover send them rather than
+// change the session themselves.
+type sessionUpdates chan func(sess *session.Session)
+
+// update has the main loop apply change to the session, and waits until it
+// has. It returns false without applying it once ctx is done.
+func (u sessionUpdates) update(ctx context.Context, change func(sess *session.Session)) bool {
+	done := make(chan struct{})
+	select {
+	case u <- func(sess *session.Session) {
+		change(sess)
+		close(done)
+	}:
+	case <-ctx.Done():
+		return false
+	}
+	// The main loop applies a change as soon as it receives it
+	<-done
+	return true
+}
+
+// saveSession persists the session state, warning if it cannot
+func saveSession(sessionMgr *session.Manager, sess *session.Session) {
+	if err := sessionMgr.Save(sess); err != nil {
+		log.Warnf("Failed to save session state: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/httpproxy"
+	"github.com/spf13/cobra"
+)
+
+var (
+	socksPort     int
+	httpProxyPort int
+)
+
+var socksCmd = &cobra.Command{
+	Use:   "socks",
+	Short: "Run only the local SOCKS5 proxy, without a TUN device",
+	Long: `Start the SSH-over-SSM dynamic forward and serve it as a SOCKS5 proxy on
+localhost, without a TUN device, routes or DNS changes. This does not
+require root; configure browsers and applications to use the proxy.
+
+Examples:
+  # SOCKS5 proxy on 127.0.0.1:1080
+  ssm-proxy socks --instance-id i-1234567890abcdef0
+
+  # Use it with curl (remote DNS resolution)
+  curl --socks5-hostname 127.0.0.1:1080 http://internal.example.com
+
+  # Also serve an HTTP proxy for tools that only support HTTP(S)_PROXY
+  ssm-proxy socks --instance-id i-1234567890abcdef0 --http-proxy-port 8080
+  HTTPS_PROXY=http://127.0.0.1:8080 curl https://internal.example.com`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if instanceID == "" && instanceTag == "" {
+			return fmt.Errorf("either --instance-id or --instance-tag is required")
+		}
+		if instanceID != "" && instanceTag != "" {
+			return fmt.Errorf("cannot specify both --instance-id and --instance-tag")
+		}
+		if socksPort < 1 || socksPort > 65535 {
+			return fmt.Errorf("invalid --port %d (expected 1-65535)", socksPort)
+		}
+		if httpProxyPort < 0 || httpProxyPort > 65535 || (httpProxyPort != 0 && httpProxyPort == socksPort) {
+			return fmt.Errorf("invalid --http-proxy-port %d (expected 1-65535, different from --port)", httpProxyPort)
+		}
+		return validateTransport(transport)
+	},
+	RunE: runSOCKS,
+}
+
+func init() {
+	rootCmd.AddCommand(socksCmd)
+
+	socksCmd.Flags().StringVar(&instanceID, "instance-id", "", "EC2 instance ID (e.g., i-1234567890abcdef0)")
+	socksCmd.Flags().StringVar(&instanceTag, "instance-tag", "", "Find instance by tag (format: Key=Value)")
+	socksCmd.Flags().IntVarP(&socksPort, "port", "p", 1080, "Local SOCKS5 port")
+	socksCmd.Flags().IntVar(&httpProxyPort, "http-proxy-port", 0, "Also serve an HTTP/HTTPS (CONNECT) proxy on this local port (0 = disabled)")
+	socksCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Always generate temporary SSH key (ignore existing keys)")
+	socksCmd.Flags().StringVar(&transport, "transport", transportSSH, "How the SSH tunnel is run: ssh or native (in process)")
+	socksCmd.Flags().DurationVar(&keepAlive, "keep-alive", 30*time.Second, "Keep-alive interval: SSH ServerAliveInterval and tunnel health-check period")
+	socksCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Connection timeout: SSH connect and SOCKS5 dials to destinations")
+}
+
+func runSOCKS(cmd *cobra.Command, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Fail before any AWS calls if a port is taken
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", socksPort))
+	if err != nil {
+		return fmt.Errorf("SOCKS5 port %d is not available: %w", socksPort, err)
+	}
+	l.Close()
+
+	var httpListener net.Listener
+	if httpProxyPort != 0 {
+		httpListener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", httpProxyPort))
+		if err != nil {
+			return fmt.Errorf("HTTP proxy port %d is not available: %w", httpProxyPort, err)
+		}
+		defer httpListener.Close()
+	}
+
+	sshTunnel, _, err := connectTunnel(ctx, defaultAWSAccount(), instanceID, instanceTag, socksPort, nil)
+	if err != nil {
+		return err
+	}
+	defer sshTunnel.Stop()
+
+	addr := sshTunnel.SOCKSAddr()
+	fmt.Printf("✓ SOCKS5 proxy listening on %s\n", addr)
+	fmt.Printf("  ├─ Browser: SOCKS v5 host 127.0.0.1, port %d (enable remote DNS)\n", socksPort)
+	fmt.Printf("  ├─ Shell: export ALL_PROXY=socks5h://%s\n", addr)
+	fmt.Printf("  └─ Test: curl --socks5-hostname %s http://<internal-host>\n", addr)
+
+	if httpListener != nil {
+		httpProxy := httpproxy.NewSOCKSServer(addr, timeout)
+		go func() {
+			if err := httpProxy.Serve(httpListener); err != nil {
+				log.Errorf("HTTP proxy stopped: %v", err)
+			}
+		}()
+		defer httpProxy.Close()
+
+		httpAddr := httpListener.Addr().String()
+		fmt.Printf("✓ HTTP proxy listening on %s\n", httpAddr)
+		fmt.Printf("  └─ Shell: export HTTP_PROXY=http://%s HTTPS_PROXY=http://%s\n", httpAddr, httpAddr)
+	}
+	fmt.Println("\nPress Ctrl+C to stop...")
+
+	sig := keepTunnelUp(ctx, sshTunnel)
+	fmt.Printf("\n✓ Received %v, stopping SOCKS5 proxy\n", sig)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+)
+
+// ssoLogin runs 'aws sso login' when the SSO token of the profile is
+// missing or about to expire (--sso-login)
+var ssoLogin bool
+
+// ssoLoginMu serializes SSO logins: clients created at once share one
+var ssoLoginMu sync.Mutex
+
+// ssoLoginRetry is how long the credential watcher waits before running
+// 'aws sso login' again after it failed
+const ssoLoginRetry = 10 * time.Minute
+
+// canSSOLogin reports whether 'aws sso login' may be run: it opens a
+// browser and may ask to confirm a code
+func canSSOLogin() bool {
+	return ssoLogin && !headless && isInteractive()
+}
+
+// ensureSSOLogin runs 'aws sso login' for the client's profile if it uses
+// SSO and its token is missing, or cannot be refreshed and expires within
+// margin. Where no login can be run (--headless, --sso-login=false, no
+// terminal) it only says what to run.
+func ensureSSOLogin(ctx context.Context, client *aws.Client, margin time.Duration) error {
+	ssoLoginMu.Lock()
+	defer ssoLoginMu.Unlock()
+
+	// Checked again under the lock: another client may just have logged in
+	required, err := client.SSOLoginRequired(ctx, margin)
+	if err != nil || !required {
+		return err
+	}
+
+	profile := client.SSOProfile()
+	if !canSSOLogin() {
+		log.Warnf("⚠️  The AWS SSO session of profile %s has expired or is about to; run 'aws sso login --profile %s'", profile, profile)
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "⚠️  The AWS SSO session of profile %s has expired or is about to, running 'aws sso login'...\n", profile)
+	login := exec.CommandContext(ctx, "aws", "sso", "login", "--profile", profile)
+	login.Stdin, login.Stdout, login.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := login.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("'aws sso login --profile %s' failed (exit status %d)", profile, exitErr.ExitCode())
+		}
+		return fmt.Errorf("failed to run 'aws sso login': %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "✓ Logged in to AWS SSO (profile: %s)\n", profile)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+)
+
+// Warm standby (--standby, --standby-instance-id)
+var (
+	warmStandbyTunnel bool
+	standbyInstanceID string
+)
+
+// Standby tunnel states in session status
+const (
+	standbyReady = "ready"
+	standbyDown  = "down"
+)
+
+// standbyCheckInterval is how often the active tunnel of a warm standby
+// pair is checked, bounding how long its failure goes unnoticed
+const standbyCheckInterval = 100 * time.Millisecond
+
+// connectStandby opens the standby tunnel of a session, to the standby
+// instance or else the session's own
+func connectStandby(ctx context.Context, spec *tunnelSpec) (socksTunnel, error) {
+	id, tag := spec.InstanceID, spec.InstanceTag
+	if standbyInstanceID != "" {
+		id, tag = standbyInstanceID, ""
+	}
+
+	port, err := netutil.FreeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+	}
+
+	fmt.Println("✓ Opening warm standby tunnel...")
+	standby, _, err := connectTunnel(ctx, spec.Account, id, tag, port, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open standby tunnel: %w", err)
+	}
+	return standby, nil
+}
+
+// warmStandby is an active tunnel and a standby one kept established
+// alongside it. When the active tunnel fails the forwarder switches to the
+// standby, which takes over within milliseconds instead of a reconnect
+// taking seconds, and the failed tunnel is re-established as the new
+// standby.
+type warmStandby struct {
+	reconnects *atomic.Int64 // counts switches
+
+	mu        sync.Mutex
+	active    socksTunnel
+	standby   socksTunnel
+	forwarder *forwarder.TunToSOCKS  // nil until run
+	onSwitch  func(socksAddr string) // called with the new active tunnel's address
+}
+
+// newWarmStandby pairs the active tunnel with a standby one
+func newWarmStandby(active, standby socksTunnel, reconnects *atomic.Int64) *warmStandby {
+	return &warmStandby{reconnects: reconnects, active: active, standby: standby}
+}
+
+// tunnels returns the active and the standby tunnel
+func (w *warmStandby) tunnels() (active, standby socksTunnel) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active, w.standby
+}
+
+// Start starts the active tunnel; the standby is re-established by run
+func (w *warmStandby) Start(ctx context.Context) error {
+	active, _ := w.tunnels()
+	return active.Start(ctx)
+}
+
+// Stop stops the active tunnel
+func (w *warmStandby) Stop() error {
+	active, _ := w.tunnels()
+	return active.Stop()
+}
+
+// IsRunning returns whether the active tunnel is up
+func (w *warmStandby) IsRunning() bool {
+	active, _ := w.tunnels()
+	return active.IsRunning()
+}
+
+// SOCKSAddr returns the SOCKS5 address of the active tunnel
+func (w *warmStandby) SOCKSAddr() string {
+	active, _ := w.tunnels()
+	return active.SOCKSAddr()
+}
+
+// SessionID returns the SSM session of the active tunnel
+func (w *warmStandby) SessionID() string {
+	active, _ := w.tunnels()
+	return ssmSessionID(active)
+}
+
+// Disconnect drops the transport of the active tunnel (for --chaos)
+func (w *warmStandby) Disconnect() error {
+	active, _ := w.tunnels()
+	disconnecter, ok := active.(interface{ Disconnect() error })
+	if !ok {
+		return fmt.Errorf("this transport cannot be disconnected")
+	}
+	return disconnecter.Disconnect()
+}
+
+// StandbyReady returns whether the standby tunnel is up
+func (w *warmStandby) StandbyReady() bool {
+	_, standby := w.tunnels()
+	return standby.IsRunning()
+}
+
+// Failover switches the forwarder to the standby tunnel if it is up and
+// reports whether it did. The failed tunnel is stopped if it is still
+// running (e.g. up but not passing traffic), to be re-established by run.
+func (w *warmStandby) Failover() bool {
+	w.mu.Lock()
+	if w.forwarder == nil || !w.standby.IsRunning() {
+		w.mu.Unlock()
+		return false
+	}
+	addr := w.standby.SOCKSAddr()
+	if err := w.forwarder.SetSOCKSAddr(addr); err != nil {
+		w.mu.Unlock()
+		log.Warnf("Failed to switch to the standby tunnel: %v", err)
+		return false
+	}
+	failed := w.active
+	w.active, w.standby = w.standby, failed
+	onSwitch := w.onSwitch
+	w.mu.Unlock()
+
+	w.reconnects.Add(1)
+	log.Warnf("Switched to the standby tunnel (SOCKS5 %s)", addr)
+	onSwitch(addr)
+
+	if failed.IsRunning() {
+		if err := failed.Stop(); err != nil {
+			log.Warnf("Failed to stop the failed tunnel: %v", err)
+		}
+	}
+	return true
+}
+
+// run lets Failover switch translator to the standby tunnel, calling
+// onSwitch with its address. Until ctx is done it then switches as soon as
+// the active tunnel goes down and re-establishes the standby whenever it is
+// down (at most every delay).
+func (w *warmStandby) run(ctx context.Context, translator *forwarder.TunToSOCKS, onSwitch func(string), delay *time.Duration) {
+	w.mu.Lock()
+	w.forwarder, w.onSwitch = translator, onSwitch
+	w.mu.Unlock()
+
+	ticker := time.NewTicker(standbyCheckInterval)
+	defer ticker.Stop()
+
+	var lastAttempt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Without a standby ready the health monitor reconnects the active
+		// tunnel
+		active, standby := w.tunnels()
+		if !active.IsRunning() && standby.IsRunning() {
+			log.Warn("Active tunnel down, switching to the standby tunnel...")
+			if w.Failover() {
+				continue
+			}
+		}
+
+		if standby.IsRunning() || time.Since(lastAttempt) < *delay {
+			continue
+		}
+		lastAttempt = time.Now()
+		log.Info("Re-establishing the standby tunnel...")
+		if err := standby.Start(ctx); err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("Failed to re-establish the standby tunnel: %v", err)
+			}
+			continue
+		}
+		log.Info("Standby tunnel ready")
+	}
+}
@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/sbkg0002/ssm-proxy/internal/audit"
 	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/chaos"
+	"github.com/sbkg0002/ssm-proxy/internal/control"
 	"github.com/sbkg0002/ssm-proxy/internal/dns"
 	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/health"
+	"github.com/sbkg0002/ssm-proxy/internal/metrics"
+	"github.com/sbkg0002/ssm-proxy/internal/nat"
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+	"github.com/sbkg0002/ssm-proxy/internal/procinfo"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
 	"github.com/sbkg0002/ssm-proxy/internal/routing"
 	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
 	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -24,41 +41,142 @@ var (
 	instanceID  string
 	instanceTag string
 
-	// CIDR blocks to route
+	// CIDR blocks to route, and whether to add those of the instance's VPC
 	cidrBlocks []string
+	autoCIDR   bool
+
+	// Several tunnels, INSTANCE:CIDR[,CIDR...] each, and the tunnels to
+	// start (from --tunnel, the config file or the single-tunnel flags)
+	tunnelFlags []string
+	tunnelSpecs []*tunnelSpec
 
 	// TUN device configuration
-	localIP string
-	mtu     int
+	localIP   string
+	localIPv6 string
+	mtu       int
+
+	// Route conflict handling (warn, split, ignore)
+	routeConflicts string
+
+	// Gateway routes: next hop for all routes, and CIDR=VIA overrides
+	routeGateway string
+	routeVia     []string
+
+	// CIDR blocks inside the routed ones that bypass the tunnel, and
+	// whether all IPv4 traffic is routed (--full-tunnel)
+	excludeCIDRs []string
+	fullTunnel   bool
+
+	// Keep ssm-proxy's own AWS API endpoints outside the tunnel
+	bypassAWSEndpoints bool
+
+	// NAT mappings (LOCAL=REMOTE) for overlapping remote networks
+	natMaps  []string
+	natTable *nat.Table
+
+	// TCP ports probed to answer pings through the tunnel
+	pingPorts []int
+
+	// How TCP flows share the tunnel (fifo or drr) and the ports preferred
+	// by drr
+	scheduler     string
+	priorityPorts []int
+
+	// Prewarmed channel to attach to instead of connecting
+	fromPrewarm string
+
+	// Format of the shutdown summary (text or json)
+	outputFormat string
 
 	// Session configuration
 	sessionName    string
+	replaceSession bool
 	keepAlive      time.Duration
 	timeout        time.Duration
 	autoReconnect  bool
 	reconnectDelay time.Duration
 	maxRetries     int
+	reconnectRules reconnectPolicy // --reconnect-policy over the defaults
+	resumeTimeout  time.Duration
+	maxLifetime    time.Duration
+
+	// Health checks
+	healthInterval time.Duration
+	healthEndpoint string
+	healthDNSName  string
+
+	// Self-test after startup (off, warn or fail)
+	selftestMode     string
+	selftestEndpoint string
+	selftestURL      string
+	repairDrift      bool
+
+	// Control socket access for other local users
+	statusGroup     string
+	statusTokenFile string
+	controlGrants   []string
+	controlAccess   control.Access
 
 	// Daemon configuration
-	daemon  bool
-	pidFile string
-	logFile string
+	daemon        bool
+	pidFile       string
+	logFile       string
+	logMaxSize    int
+	logMaxBackups int
+
+	// pickedInstance is the instance chosen in the picker, passed on to the
+	// background process
+	pickedInstance string
 
 	// Advanced options
 	logPackets bool
 	tempKey    bool
-
-	// DNS configuration
-	dnsResolver string
-	dnsDomains  []string
+	sshUser    string
+
+	// selectStrategy picks among several instances matching --instance-tag
+	// (--select-strategy); selectTarget is the address of same-az
+	selectStrategy string
+	selectTarget   string
+	transport      string
+	compression    string
+
+	// iamPreflight checks the IAM permissions the tunnel needs before
+	// connecting (--iam-preflight)
+	iamPreflight bool
+
+	// Prometheus metrics endpoint (--metrics-addr); every tunnel adds its
+	// counters to the registry
+	metricsAddr     string
+	metricsRegistry *metrics.Registry
+
+	// Directory the TUN packets and SSM messages are recorded to (--record)
+	recordDir string
+
+	// DNS configuration. dnsResolver is the first of dnsResolvers, the one
+	// the system resolver, health checks and self-test use.
+	dnsResolvers    []string
+	dnsResolver     string
+	dnsStrategy     string
+	dnsBackend      string // how the system resolver is configured
+	dnsDomains      []string
+	dnsRewrites     []string
+	dnsRewriteRules []*dns.RewriteRule
+	dnsRewriteFlag  bool // rules from --dns-rewrite, not the config file
+	dnsListen       string
+
+	// Fake-IP mode: names routed by domain get addresses of fakeIPRange
+	routeDomains []string
+	fakeIPRange  string
+	fakeIPPool   *dns.FakeIPPool
 )
 
 var startCmd = &cobra.Command{
-	Use:   "start",
+	Use:   "start [PROFILE]",
 	Short: "Start transparent proxy tunnel",
+	Args:  cobra.MaximumNArgs(1),
 	Long: `Start a transparent proxy tunnel through an AWS EC2 instance via SSM.
 
-This command creates a virtual network interface (utun), adds routes for
+This command creates a virtual network interface (utun on macOS, ssmtun on Linux), adds routes for
 specified CIDR blocks, and forwards all traffic through an SSM tunnel.
 
 Applications require NO configuration - traffic is automatically routed
@@ -74,32 +192,419 @@ Examples:
   # Multiple CIDR blocks
   sudo ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/8 --cidr 172.16.0.0/12
 
+  # Named network group from the config file ('networks:' section)
+  sudo ssm-proxy start --instance-id i-xxx --cidr @prod-data
+
+  # Everything in 10.0.0.0/8 except the office network, which stays on the VPN
+  sudo ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/8 --exclude-cidr 10.1.2.0/24
+
+  # Send all IPv4 traffic out through the VPC, like a VPN
+  sudo ssm-proxy start --instance-id i-xxx --full-tunnel
+
+  # Route whatever CIDR blocks the bastion's VPC has
+  sudo ssm-proxy start --instance-tag Name=bastion-host --auto-cidr
+
+  # Reach a VPC whose 10.0.0.0/16 overlaps another one via 10.200.0.0/16
+  sudo ssm-proxy start --instance-id i-xxx --nat-map 10.200.0.0/16=10.0.0.0/16
+
   # Run as daemon in background
-  sudo ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/8 --daemon`,
+  sudo ssm-proxy start --instance-id i-xxx --cidr 10.0.0.0/8 --daemon
+
+  # Near-instant start using a channel opened earlier with 'ssm-proxy prewarm prod'
+  sudo ssm-proxy start --from-prewarm prod --cidr 10.0.0.0/8
+
+  # Route by name instead of CIDR block (fake-IP mode)
+  sudo ssm-proxy start --instance-id i-xxx --route-domain '*.internal.corp' --dns-resolver 169.254.169.253:53
+
+  # Reach the dev and prod VPCs at the same time (one TUN device each)
+  sudo ssm-proxy start --tunnel i-0dev0000000000000:10.10.0.0/16 --tunnel Name=prod-bastion:10.20.0.0/16
+
+  # Everything from the profile prod-vpc of the config file ('profiles:' section);
+  # flags override its settings
+  sudo ssm-proxy start prod-vpc`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		// Check for root privileges
-		requireRoot()
+		// Check for root privileges, or the privileged helper
+		requireRootOrHelper()
+		if daemon && !isRoot() && !cmd.Flags().Changed("pid-file") {
+			return fmt.Errorf("--daemon without sudo needs a --pid-file you can write, e.g. ~/.ssm-proxy/ssm-proxy.pid")
+		}
+
+		// Settings of a named profile, under those given as flags
+		if len(args) > 0 {
+			if profileName != "" && profileName != args[0] {
+				return fmt.Errorf("profile %q given both as argument and --profile-name %q", args[0], profileName)
+			}
+			profileName = args[0]
+		}
+		if profileName != "" {
+			if err := applyProfile(cmd, profileName); err != nil {
+				return err
+			}
+		}
 
 		// Validate required flags
-		if instanceID == "" && instanceTag == "" {
-			return fmt.Errorf("either --instance-id or --instance-tag is required")
+		if err := validateBastionFlags(); err != nil {
+			return err
+		}
+		if len(tunnelFlags) > 0 {
+			if instanceID != "" || instanceTag != "" || fromPrewarm != "" || len(cidrBlocks) > 0 || len(natMaps) > 0 || len(routeDomains) > 0 {
+				return fmt.Errorf("--tunnel cannot be combined with --instance-id, --instance-tag, --from-prewarm, --cidr, --nat-map or --route-domain")
+			}
+		} else if fromPrewarm != "" {
+			if instanceID != "" || instanceTag != "" {
+				return fmt.Errorf("--from-prewarm cannot be combined with --instance-id or --instance-tag")
+			}
+			if warmStandbyTunnel || standbyInstanceID != "" {
+				return fmt.Errorf("--from-prewarm cannot be combined with --standby or --standby-instance-id")
+			}
+		} else if instanceID == "" && instanceTag == "" && !launchBastion && !viper.IsSet("tunnels") {
+			if headless || !isInteractive() {
+				return fmt.Errorf("either --instance-id, --instance-tag or --tunnel is required")
+			}
+
+			// Let the user pick one of the SSM-connected instances
+			ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+			instances, err := findInstances(ctx, "", true)
+			cancel()
+			if err != nil {
+				return err
+			}
+			instance, err := pickInstance(instances, os.Stdin, os.Stdout)
+			if err != nil {
+				return err
+			}
+			instanceID = instance.InstanceID
+			pickedInstance = instance.InstanceID
+			fmt.Printf("✓ Selected %s (%s)\n\n", instance.InstanceID, instanceName(instance))
 		}
 
 		if instanceID != "" && instanceTag != "" {
 			return fmt.Errorf("cannot specify both --instance-id and --instance-tag")
 		}
 
-		if len(cidrBlocks) == 0 {
-			return fmt.Errorf("at least one --cidr block is required")
+		if sessionName != "" {
+			if err := session.ValidateName(sessionName); err != nil {
+				return err
+			}
 		}
 
-		// Validate CIDR blocks
-		for _, cidr := range cidrBlocks {
-			if err := validateCIDR(cidr); err != nil {
-				return fmt.Errorf("invalid CIDR block %s: %w", cidr, err)
+		// Flags win over the config file (bound to viper in init)
+		keepAlive = viper.GetDuration("defaults.keep_alive")
+		timeout = viper.GetDuration("defaults.timeout")
+		localIP = viper.GetString("defaults.local_ip")
+		mtu = viper.GetInt("defaults.mtu")
+		autoReconnect = viper.GetBool("defaults.auto_reconnect")
+		reconnectDelay = viper.GetDuration("defaults.reconnect_delay")
+		maxRetries = viper.GetInt("defaults.max_retries")
+		rules, err := parseReconnectPolicy(viper.GetStringSlice("defaults.reconnect_policy"), reconnectDelay)
+		if err != nil {
+			return err
+		}
+		reconnectRules = rules
+		resumeTimeout = viper.GetDuration("defaults.resume_timeout")
+		if resumeTimeout < 0 || resumeTimeout > 10*time.Minute {
+			return fmt.Errorf("invalid --resume-timeout %s (expected between 0 and 10m)", resumeTimeout)
+		}
+		if keepAlive < time.Second || keepAlive > 10*time.Minute {
+			return fmt.Errorf("invalid --keep-alive %s (expected between 1s and 10m)", keepAlive)
+		}
+		if timeout < time.Second || timeout > 5*time.Minute {
+			return fmt.Errorf("invalid --timeout %s (expected between 1s and 5m)", timeout)
+		}
+
+		healthInterval = viper.GetDuration("health.interval")
+		healthEndpoint = viper.GetString("health.endpoint")
+		healthDNSName = viper.GetString("health.dns_name")
+		repairDrift = viper.GetBool("health.repair_drift")
+		if healthInterval != 0 && (healthInterval < time.Second || healthInterval > 10*time.Minute) {
+			return fmt.Errorf("invalid --health-interval %s (expected between 1s and 10m)", healthInterval)
+		}
+		if healthEndpoint != "" {
+			if _, _, err := net.SplitHostPort(healthEndpoint); err != nil {
+				return fmt.Errorf("invalid --health-endpoint %q (expected host:port): %w", healthEndpoint, err)
+			}
+		}
+		dnsResolver = ""
+		if len(dnsResolvers) > 0 {
+			dnsResolver = dnsResolvers[0]
+		}
+		if _, err := dns.ParseStrategy(dnsStrategy); err != nil {
+			return err
+		}
+		backend, err := dns.ParseBackend(dnsBackend)
+		if err != nil {
+			return err
+		}
+		dnsBackend = backend
+		if healthDNSName != "" && dnsResolver == "" {
+			return fmt.Errorf("--health-dns-name requires --dns-resolver")
+		}
+		if dnsListen != "" {
+			if dnsResolver == "" {
+				return fmt.Errorf("--dns-listen requires --dns-resolver")
+			}
+			if err := validateDNSListen(dnsListen); err != nil {
+				return err
 			}
 		}
 
+		auditLogPath = viper.GetString("audit.log")
+		metricsAddr = viper.GetString("metrics.addr")
+		if metricsAddr != "" {
+			if _, _, err := net.SplitHostPort(metricsAddr); err != nil {
+				return fmt.Errorf("invalid --metrics-addr %q (expected host:port): %w", metricsAddr, err)
+			}
+		}
+
+		if chaosSpec != "" {
+			config, err := chaos.ParseConfig(chaosSpec)
+			if err != nil {
+				return fmt.Errorf("invalid --chaos: %w", err)
+			}
+			chaosConfig = &config
+		}
+
+		selftestMode = viper.GetString("health.selftest")
+		selftestEndpoint = viper.GetString("health.selftest_endpoint")
+		selftestURL = viper.GetString("health.selftest_url")
+		if err := validateSelfTest(); err != nil {
+			return err
+		}
+
+		for _, port := range pingPorts {
+			if port < 0 || port > 65535 {
+				return fmt.Errorf("invalid --ping-ports value %d (expected 1-65535, or 0 to drop pings)", port)
+			}
+		}
+		if slices.Contains(pingPorts, 0) {
+			pingPorts = nil
+		}
+
+		if scheduler != schedulerFIFO && scheduler != schedulerDRR {
+			return fmt.Errorf("invalid --scheduler value %q (expected %s or %s)", scheduler, schedulerFIFO, schedulerDRR)
+		}
+		for _, port := range priorityPorts {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("invalid --priority-ports value %d (expected 1-65535)", port)
+			}
+		}
+
+		if err := validateTransport(transport); err != nil {
+			return err
+		}
+		if err := validateCompression(compression); err != nil {
+			return err
+		}
+
+		switch outputFormat {
+		case outputText, outputJSON:
+		default:
+			return fmt.Errorf("invalid --output value %q (expected text or json)", outputFormat)
+		}
+
+		switch routeConflicts {
+		case routing.ConflictWarn, routing.ConflictSplit, routing.ConflictIgnore:
+		default:
+			return fmt.Errorf("invalid --route-conflicts value %q (expected warn, split or ignore)", routeConflicts)
+		}
+
+		routeGateway = viper.GetString("defaults.route_gateway")
+		bypassAWSEndpoints = viper.GetBool("defaults.bypass_aws_endpoints")
+		if fullTunnel {
+			if !bypassAWSEndpoints {
+				return fmt.Errorf("--full-tunnel needs --bypass-aws-endpoints, or the tunnel would route its own traffic")
+			}
+			// The routes of the local network are meant to win over ours
+			if !cmd.Flags().Changed("route-conflicts") {
+				routeConflicts = routing.ConflictIgnore
+			}
+		}
+		iamPreflight = viper.GetBool("defaults.iam_preflight")
+		selectStrategy = viper.GetString("defaults.select_strategy")
+		if !slices.Contains(aws.SelectStrategies, selectStrategy) {
+			return fmt.Errorf("invalid --select-strategy %q (expected %s)", selectStrategy, strings.Join(aws.SelectStrategies, ", "))
+		}
+		if selectTarget != "" {
+			if _, err := netip.ParseAddr(selectTarget); err != nil {
+				return fmt.Errorf("invalid --select-target %q: %w", selectTarget, err)
+			}
+		} else if selectStrategy == aws.SelectSameAZ {
+			return fmt.Errorf("--select-strategy same-az needs --select-target")
+		}
+		if routeGateway != "" {
+			if err := validateGateway(routeGateway, false); err != nil {
+				return fmt.Errorf("invalid --route-gateway %q: %w", routeGateway, err)
+			}
+		}
+		for _, spec := range routeVia {
+			if _, _, err := parseRouteVia(spec); err != nil {
+				return err
+			}
+		}
+		excludeCIDRs = viper.GetStringSlice("defaults.exclude_cidr")
+		if err := validateExclusions(excludeCIDRs); err != nil {
+			return err
+		}
+
+		table, err := nat.NewTable(natMaps)
+		if err != nil {
+			return err
+		}
+		natTable = table
+
+		// Names routed by domain are resolved through the tunnel too
+		fakeIPPool = nil
+		if len(routeDomains) > 0 {
+			if dnsResolver == "" {
+				return fmt.Errorf("--route-domain requires --dns-resolver")
+			}
+			pool, err := dns.NewFakeIPPool(fakeIPRange, routeDomains)
+			if err != nil {
+				return err
+			}
+			for _, m := range table.Mappings() {
+				if m.Local.Contains(pool.Network().IP) || pool.Network().Contains(m.Local.IP) {
+					return fmt.Errorf("--fake-ip-range %s overlaps --nat-map %s", pool.Network(), m)
+				}
+			}
+			for _, suffix := range pool.Suffixes() {
+				if !slices.Contains(dnsDomains, suffix) {
+					dnsDomains = append(dnsDomains, suffix)
+				}
+			}
+			fakeIPPool = pool
+		}
+
+		// Expand @group references and NAT-mapped ranges per tunnel
+		specs, err := buildTunnelSpecs(tunnelFlags)
+		if err != nil {
+			return err
+		}
+		tunnelSpecs = specs
+
+		for _, spec := range tunnelSpecs {
+			if spec.SessionName != "" {
+				if err := session.ValidateName(spec.SessionName); err != nil {
+					return err
+				}
+			}
+
+			// IPv6 prefixes need an IPv6 address on the TUN device, and IPv6
+			// itself needs an MTU of at least 1280
+			if hasIPv6CIDR(spec.CIDRs) {
+				if ip, _, err := net.ParseCIDR(spec.LocalIPv6); err != nil || ip.To4() != nil {
+					return fmt.Errorf("invalid --local-ipv6 %s (expected x:x::x/y)", spec.LocalIPv6)
+				}
+				if mtu < 1280 {
+					return fmt.Errorf("--mtu must be at least 1280 to route IPv6 CIDR blocks")
+				}
+			}
+		}
+
+		if failoverEnabled {
+			if warmStandbyTunnel || standbyInstanceID != "" || fromPrewarm != "" {
+				return fmt.Errorf("--failover cannot be combined with --standby, --standby-instance-id or --from-prewarm")
+			}
+			if !slices.ContainsFunc(tunnelSpecs, func(spec *tunnelSpec) bool { return spec.InstanceTag != "" }) {
+				return fmt.Errorf("--failover needs an instance found by tag (--instance-tag or --tunnel Key=Value:CIDR)")
+			}
+		}
+
+		// The standby instance stands in for a single one
+		if standbyInstanceID != "" {
+			if len(tunnelSpecs) > 1 {
+				return fmt.Errorf("--standby-instance-id cannot be used with several tunnels")
+			}
+			warmStandbyTunnel = true
+		}
+
+		// A gateway address would belong to one tunnel's subnet only
+		if len(tunnelSpecs) > 1 {
+			if routeGateway != "" && routeGateway != gatewayPeer {
+				return fmt.Errorf("with several tunnels --route-gateway must be %q", gatewayPeer)
+			}
+			for _, spec := range routeVia {
+				if _, via, _ := parseRouteVia(spec); via != gatewayPeer && via != routing.ViaInterface {
+					return fmt.Errorf("with several tunnels --route-via must be CIDR=%s or CIDR=%s", routing.ViaInterface, gatewayPeer)
+				}
+			}
+		}
+
+		// The user who ran sudo, or the privileged helper, owns the session
+		// and may stop it
+		controlAccess = control.Access{OwnerUID: -1}
+		if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil && uid > 0 {
+			controlAccess.OwnerUID = uid
+		} else if !isRoot() {
+			controlAccess.OwnerUID = os.Getuid()
+		}
+		if dropPrivileges {
+			if err := prepareDropPrivileges(); err != nil {
+				return err
+			}
+		}
+		if name := viper.GetString("sharing.group"); name != "" {
+			grant, err := control.ParseGrant("group:" + name + "=" + string(control.ClassRead))
+			if err != nil {
+				return fmt.Errorf("invalid --status-group: %w", err)
+			}
+			controlAccess.Grants = append(controlAccess.Grants, grant)
+		}
+		if path := viper.GetString("sharing.token_file"); path != "" {
+			grant, err := control.ParseGrant("token-file:" + path + "=" + string(control.ClassRead))
+			if err != nil {
+				return fmt.Errorf("invalid --status-token-file: %w", err)
+			}
+			controlAccess.Grants = append(controlAccess.Grants, grant)
+		}
+		grants := controlGrants
+		if !cmd.Flags().Changed("control-grant") {
+			grants = viper.GetStringSlice("sharing.grants")
+		}
+		for _, spec := range grants {
+			grant, err := control.ParseGrant(spec)
+			if err != nil {
+				return fmt.Errorf("invalid --control-grant: %w", err)
+			}
+			controlAccess.Grants = append(controlAccess.Grants, grant)
+		}
+
+		// DNS rewrite rules from the flag, falling back to the config file
+		rewrites := dnsRewrites
+		dnsRewriteFlag = cmd.Flags().Changed("dns-rewrite")
+		if !dnsRewriteFlag {
+			rewrites = viper.GetStringSlice("dns.rewrite")
+		}
+		if len(rewrites) > 0 && dnsResolver == "" && dnsRewriteFlag {
+			return fmt.Errorf("--dns-rewrite requires --dns-resolver")
+		}
+		dnsRewriteRules = nil
+		for _, spec := range rewrites {
+			rule, err := dns.ParseRewriteRule(spec)
+			if err != nil {
+				return err
+			}
+			dnsRewriteRules = append(dnsRewriteRules, rule)
+		}
+
+		destinationPolicy, err = loadPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		selectedApps = nil
+		if apps := viper.GetStringSlice("defaults.only_app"); len(apps) > 0 {
+			if !appRoutingSupported {
+				return fmt.Errorf("--only-app is only supported on macOS")
+			}
+			if selectedApps, err = procinfo.ParseApps(apps); err != nil {
+				return fmt.Errorf("invalid --only-app: %w", err)
+			}
+		}
+
+		if transport == transportDatachannel || transport == transportWireGuard {
+			return validateDatachannel(cmd)
+		}
 		return nil
 	},
 	RunE: runStart,
@@ -109,279 +614,1336 @@ func init() {
 	rootCmd.AddCommand(startCmd)
 
 	// Instance selection flags
-	startCmd.Flags().StringVar(&instanceID, "instance-id", "", "EC2 instance ID (e.g., i-1234567890abcdef0)")
+	startCmd.Flags().StringVar(&instanceID, "instance-id", "",
+		"EC2 instance ID (e.g., i-1234567890abcdef0), managed instance ID (mi-...) or ECS task container (ecs:CLUSTER/TASK[/CONTAINER])")
 	startCmd.Flags().StringVar(&instanceTag, "instance-tag", "", "Find instance by tag (format: Key=Value)")
-
-	// CIDR blocks (required, repeatable)
-	startCmd.Flags().StringSliceVar(&cidrBlocks, "cidr", []string{}, "CIDR blocks to route (repeatable)")
-	startCmd.MarkFlagRequired("cidr")
+	startCmd.Flags().BoolVar(&launchBastion, "launch-bastion", false,
+		"Launch a bastion for this session (or start the one a previous session stopped) in --subnet-id, and terminate or stop it on exit (--bastion-on-exit)")
+	startCmd.Flags().StringVar(&bastionSubnetID, "subnet-id", "", "Subnet to launch the --launch-bastion instance in")
+	startCmd.Flags().StringVar(&bastionProfile, "instance-profile", "", "Instance profile (name or ARN) of the --launch-bastion instance, allowing SSM (e.g. with AmazonSSMManagedInstanceCore)")
+	startCmd.Flags().StringVar(&bastionInstanceType, "bastion-instance-type", aws.DefaultBastionInstanceType, "Instance type of the --launch-bastion instance")
+	startCmd.Flags().StringVar(&bastionImageID, "bastion-ami", "", "AMI of the --launch-bastion instance (default: the latest Amazon Linux 2023)")
+	startCmd.Flags().StringSliceVar(&bastionSecurityGroup, "bastion-security-group", []string{}, "Security groups of the --launch-bastion instance (default: the VPC's default group)")
+	startCmd.Flags().StringVar(&bastionOnExit, "bastion-on-exit", bastionTerminate, "What to do with the --launch-bastion instance on exit: terminate, or stop (the next --launch-bastion in the subnet starts it again)")
+	startCmd.Flags().DurationVar(&bastionTimeout, "bastion-timeout", 5*time.Minute, "How long to wait for the --launch-bastion instance's SSM Agent to come online")
+	startCmd.Flags().StringVar(&selectStrategy, "select-strategy", aws.SelectNone,
+		"How to pick one of several instances matching --instance-tag: none (fail), random, newest, least-loaded (lowest CloudWatch CPU) or same-az (as --select-target)")
+	startCmd.Flags().StringVar(&selectTarget, "select-target", "", "Address whose availability zone the same-az strategy picks an instance in (e.g. a database's IP)")
+
+	// CIDR blocks (required unless --nat-map is given, repeatable)
+	startCmd.Flags().StringSliceVar(&cidrBlocks, "cidr", []string{}, "CIDR blocks to route (repeatable, or @name for a network group from the config file)")
+	startCmd.Flags().BoolVar(&autoCIDR, "auto-cidr", false, "Also route the CIDR blocks of the instance's VPC (needs ec2:DescribeVpcs and ec2:DescribeSubnets)")
+	startCmd.Flags().StringSliceVar(&natMaps, "nat-map", []string{},
+		"Map a local CIDR onto an overlapping remote one, LOCAL=REMOTE (e.g. 10.200.0.0/16=10.0.0.0/16, repeatable)")
+
+	startCmd.Flags().StringArrayVar(&tunnelFlags, "tunnel", []string{},
+		"Run a tunnel INSTANCE:CIDR[,CIDR...][,region=REGION][,role=ROLE_ARN] (INSTANCE is an instance ID or Key=Value tag; repeatable for several tunnels, each with its own TUN device)")
+
+	startCmd.Flags().StringVar(&fromPrewarm, "from-prewarm", "", "Use the SSM/SSH channel opened by 'ssm-proxy prewarm NAME' (skips AWS lookups and SSH setup)")
 
 	// TUN device configuration
-	startCmd.Flags().StringVar(&localIP, "local-ip", "169.254.169.1/30", "IP address for utun device")
-	startCmd.Flags().IntVar(&mtu, "mtu", 1500, "MTU for utun device")
+	startCmd.Flags().StringVar(&localIP, "local-ip", "169.254.169.1/30", "IP address for the TUN device")
+	startCmd.Flags().StringVar(&localIPv6, "local-ipv6", "fd73:736d:7072::1/64", "IPv6 address for the TUN device (used when an IPv6 --cidr is routed)")
+	startCmd.Flags().IntVar(&mtu, "mtu", 1500, "MTU for the TUN device")
+
+	// Routing options
+	startCmd.Flags().StringVar(&routeConflicts, "route-conflicts", routing.ConflictWarn,
+		"How to handle existing routes that would take precedence over --cidr blocks: warn, split (install more-specific routes), ignore")
+	startCmd.Flags().StringVar(&routeGateway, "route-gateway", "",
+		"Add routes via this gateway instead of interface-scoped routes: 'peer' (the TUN device's peer address) or an IPv4 address")
+	startCmd.Flags().StringSliceVar(&routeVia, "route-via", []string{},
+		"Per-CIDR route override CIDR=VIA, VIA being 'interface', 'peer' or a gateway IPv4 address (repeatable)")
+	startCmd.Flags().BoolVar(&fullTunnel, "full-tunnel", false,
+		"Route all IPv4 traffic through the tunnel (0.0.0.0/1 and 128.0.0.0/1), keeping the AWS endpoints and DNS servers it needs outside, like a VPN")
+	startCmd.Flags().StringSliceVar(&excludeCIDRs, "exclude-cidr", []string{},
+		"CIDR block inside the routed ones to keep out of the tunnel, routed via the next hop it had before (repeatable; e.g. the bastion's or a VPN's range)")
+	startCmd.Flags().BoolVar(&bypassAWSEndpoints, "bypass-aws-endpoints", true,
+		"Route the AWS API endpoints ssm-proxy itself uses around the tunnel when --cidr blocks cover their addresses")
+
+	startCmd.Flags().StringVarP(&outputFormat, "output", "o", outputText, "Format of the summary printed on shutdown: text or json")
+
+	startCmd.Flags().IntSliceVar(&pingPorts, "ping-ports", forwarder.DefaultPingPorts,
+		"TCP ports probed to answer pings through the tunnel (0 = drop pings)")
+	startCmd.Flags().StringVar(&scheduler, "scheduler", schedulerFIFO,
+		"How TCP flows share the tunnel: fifo, or drr (fair turns, so bulk transfers do not hold up other flows)")
+	startCmd.Flags().IntSliceVar(&priorityPorts, "priority-ports", forwarder.DefaultPriorityPorts,
+		"Destination ports served before others with --scheduler drr")
 
 	// Session configuration
-	startCmd.Flags().StringVar(&sessionName, "session-name", "", "Custom session name (default: auto-generated)")
-	startCmd.Flags().DurationVar(&keepAlive, "keep-alive", 30*time.Second, "Keep-alive interval")
-	startCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Connection timeout")
+	startCmd.Flags().StringVar(&sessionName, "session-name", "", "Custom session name (default: the profile's name, or auto-generated)")
+	startCmd.Flags().StringVar(&profileName, "profile-name", "", "Take the settings not given as flags from this profile of the config file (same as the PROFILE argument)")
+	startCmd.Flags().BoolVar(&replaceSession, "replace", false, "Reuse --session-name even if a session with that name exists (stops it first if running)")
+	startCmd.Flags().BoolVar(&adoptOrphans, "adopt", false, "Take over the routes and DNS resolver files left by sessions whose process died (and their names), instead of failing on them")
+	startCmd.Flags().DurationVar(&keepAlive, "keep-alive", 30*time.Second, "Keep-alive interval: SSH ServerAliveInterval and tunnel health-check period")
+	startCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Connection timeout: SSH connect and SOCKS5 dials to destinations")
 	startCmd.Flags().BoolVar(&autoReconnect, "auto-reconnect", true, "Auto-reconnect on failure")
-	startCmd.Flags().DurationVar(&reconnectDelay, "reconnect-delay", 5*time.Second, "Delay between reconnection attempts")
+	startCmd.Flags().DurationVar(&reconnectDelay, "reconnect-delay", 5*time.Second, "Delay between reconnection attempts after network failures (see --reconnect-policy)")
+	startCmd.Flags().StringSliceVar(&reconnectPolicyFlags, "reconnect-policy", []string{},
+		"Reconnect rule CLASS=DELAY[..MAX_DELAY] or CLASS=never per failure class: auth, access-denied, throttled, target or network (repeatable; e.g. throttled=1m..10m)")
+	startCmd.Flags().DurationVar(&resumeTimeout, "resume-timeout", time.Minute,
+		"How long TCP connections wait for a reconnecting tunnel before they are reset (0 = reset them right away)")
 	startCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Maximum reconnection attempts (0 = unlimited)")
+	startCmd.Flags().BoolVar(&warmStandbyTunnel, "standby", false,
+		"Keep a second tunnel established and switch to it within milliseconds if the active one fails, instead of reconnecting")
+	startCmd.Flags().BoolVar(&failoverEnabled, "failover", false,
+		"If the instance found by --instance-tag goes down, reconnect to another SSM-connected instance with the tag (picked by --select-strategy, random if none), keeping routes and DNS")
+	startCmd.Flags().StringVar(&standbyInstanceID, "standby-instance-id", "", "Instance for the --standby tunnel (default: the session's own; implies --standby)")
+	startCmd.Flags().DurationVar(&maxLifetime, "max-lifetime", 0, "Stop the session automatically after this duration (0 = unlimited)")
+
+	// Health checks
+	startCmd.Flags().DurationVar(&healthInterval, "health-interval", 0, "Tunnel health-check interval (default: --keep-alive, at most 30s)")
+	startCmd.Flags().StringVar(&healthEndpoint, "health-endpoint", "", "Internal host:port to connect to through the tunnel on every health check")
+	startCmd.Flags().StringVar(&healthDNSName, "health-dns-name", "", "Name to resolve through the tunnel via --dns-resolver on every health check")
+	startCmd.Flags().BoolVar(&repairDrift, "repair-drift", true, "Reinstall routes and DNS resolver files changed or removed while running (false = only warn)")
+	startCmd.Flags().StringVar(&selftestMode, "selftest", selftestOff,
+		"Test the tunnel end to end once it is up: off, warn, or fail (abort the start if it is unusable; the default with a bare --selftest)")
+	startCmd.Flags().Lookup("selftest").NoOptDefVal = selftestFail
+	startCmd.Flags().StringVar(&selftestEndpoint, "selftest-endpoint", "", "Internal host:port the self-test connects to (default: --health-endpoint, else --dns-resolver)")
+	startCmd.Flags().StringVar(&selftestURL, "selftest-url", "", "Internal http:// URL the self-test downloads (up to 1 MiB) to sample throughput")
+
+	// Session sharing
+	startCmd.Flags().StringVar(&statusGroup, "status-group", "", "Let members of this group read the session's status via its control socket (read-only)")
+	startCmd.Flags().StringVar(&statusTokenFile, "status-token-file", "", "Require the token in this file for status requests (without --status-group, any local user holding it may query)")
+	startCmd.Flags().StringArrayVar(&controlGrants, "control-grant", nil, "Grant control operations: user:NAME=CLASS, group:NAME=CLASS or token-file:PATH=CLASS, CLASS being read, flow-admin or session-admin (repeatable)")
 
 	// Daemon mode
-	startCmd.Flags().BoolVarP(&daemon, "daemon", "d", false, "Run in background as daemon")
-	startCmd.Flags().StringVar(&pidFile, "pid-file", "/var/run/ssm-proxy.pid", "PID file location")
-	startCmd.Flags().StringVar(&logFile, "log-file", "", "Log file location (default: stderr)")
+	startCmd.Flags().BoolVarP(&daemon, "daemon", "d", false, "Run in the background once the tunnel is up (implies --headless for the background process)")
+	startCmd.Flags().BoolVar(&dropPrivileges, "drop-privileges", false,
+		"Once the tunnels are up, run as the user who ran sudo instead of root (keeping only what maintaining the routes needs)")
+	startCmd.Flags().StringVar(&pidFile, "pid-file", defaultPIDFile, "PID file of the background process (--daemon)")
+	startCmd.Flags().StringVar(&logFile, "log-file", "", "Log file of the background process (--daemon) or service (default: ~/.ssm-proxy/daemon.log)")
+	startCmd.Flags().IntVar(&logMaxSize, "log-max-size", 10, "Rotate the --daemon log file when it exceeds this many MB (0 to disable)")
+	startCmd.Flags().IntVar(&logMaxBackups, "log-max-backups", 3, "Rotated --daemon log files to keep")
+
+	// Advanced options
+	startCmd.Flags().BoolVar(&logPackets, "log-packets", false, "Log individual packets (debug only, very verbose)")
+	startCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Generate a temporary SSH key pair for this session only (ignore existing ~/.ssh keys)")
+	startCmd.Flags().StringVar(&sshUser, "ssh-user", tunnel.DefaultSSHUser, "User to log in as on the instance (managed instances and ECS tasks often need another one)")
+	startCmd.Flags().StringVar(&transport, "transport", transportSSH,
+		"How traffic reaches the instance: ssh (an SSH tunnel run by the ssh and aws CLI binaries), native (the SSH tunnel in process, no external binaries), ssm-datachannel (raw IP packets to ssm-proxy-agent, no SSH) or wireguard (WireGuard through ssm-proxy-agent)")
+	startCmd.Flags().IntVar(&datachannelAgentPort, "agent-port", defaultAgentPort, "Port of ssm-proxy-agent on the instance (--transport ssm-datachannel or wireguard)")
+	startCmd.Flags().StringVar(&compression, "compression", "off",
+		"Compress tunneled traffic: off, lz4 or deflate (the ssh transport uses SSH's own compression for either)")
+	startCmd.Flags().BoolVar(&iamPreflight, "iam-preflight", true,
+		"Check the IAM permissions the tunnel needs before connecting, by simulating the caller's policies (needs iam:SimulatePrincipalPolicy, skipped without it)")
+	startCmd.Flags().StringVar(&chaosSpec, "chaos", "", "Inject faults for testing, e.g. latency=200ms,jitter=50ms,loss=5%,disconnect=10m (see 'ssm-proxy chaos --help')")
+	startCmd.Flags().MarkHidden("chaos")
+	startCmd.Flags().StringVar(&recordDir, "record", "", "Record the TUN packets (and SSM messages with --transport native) to files in this directory for 'ssm-proxy replay'; recordings contain the traffic unencrypted")
+	startCmd.Flags().DurationVar(&credentialWarning, "credential-warning", 15*time.Minute, "Warn this long before the AWS credentials or SSO token expire (0 to disable)")
+	startCmd.Flags().StringVar(&auditLogPath, "audit-log", "",
+		"Append every connection relayed through the tunnel to this file as a JSON line (time, user, instance, destination, host name, bytes, duration)")
+	startCmd.Flags().StringSliceVar(&onlyApps, "only-app", []string{},
+		"Only route the traffic of these applications through the tunnel, by executable name or PID (e.g. psql,curl; macOS); other applications connect directly")
+	startCmd.Flags().StringSliceVar(&policyRules, "policy", []string{},
+		"Allow or deny destinations: 'allow 10.0.0.0/8:5432,443', 'deny *.prod.internal', 'allow *' (repeatable; the first matching rule decides)")
+	startCmd.Flags().StringVar(&policyDefault, "policy-default", "",
+		"What destinations no --policy rule matches get: allow or deny (default: deny if there are allow rules, else allow)")
+	startCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "Expose traffic, connection, DNS and reconnect metrics for Prometheus at http://ADDR/metrics (e.g. 127.0.0.1:9090)")
+
+	// DNS configuration
+	startCmd.Flags().StringSliceVar(&dnsResolvers, "dns-resolver", []string{}, "DNS server accessible through tunnel (e.g., '10.0.0.2:53' or '169.254.169.253:53' for AWS VPC DNS); repeatable, e.g. VPC DNS plus an on-premises server reachable through the same tunnel")
+	startCmd.Flags().StringVar(&dnsStrategy, "dns-strategy", string(dns.StrategyFailover),
+		"How queries use several --dns-resolver servers: failover (ask the first healthy one, the next if it fails) or race (ask all healthy ones, take the first answer)")
+	startCmd.Flags().StringVar(&dnsBackend, "dns-backend", "",
+		"How the system resolver is pointed at the tunnel for --dns-domains: resolver-files (/etc/resolver, macOS default), scutil (supplemental resolver, macOS), resolvectl (systemd-resolved, Linux default) or none")
+	startCmd.Flags().StringSliceVar(&dnsDomains, "dns-domains", []string{}, "Domain suffixes to resolve through tunnel (e.g., '.internal.company.com,.amazonaws.com'). If empty, all DNS queries routed through tunnel")
+	startCmd.Flags().StringVar(&dnsListen, "dns-listen", "",
+		"Serve DNS for --dns-domains on this local IPv4 address (e.g. 127.0.0.1:53053) and point the system resolver at it, instead of intercepting queries routed into the TUN device")
+	startCmd.Flags().StringSliceVar(&dnsRewrites, "dns-rewrite", []string{}, "DNS answer rewrite rule KIND[:ARG][@DOMAIN]: replace:MATCH=REPLACEMENT, strip-aaaa, ttl:SECONDS (repeatable)")
+	startCmd.Flags().StringSliceVar(&routeDomains, "route-domain", []string{},
+		"Route connections to these names through the tunnel by answering their DNS queries with fake addresses (e.g. '*.internal.corp' or 'db.example.com'; repeatable; needs --dns-resolver)")
+	startCmd.Flags().StringVar(&fakeIPRange, "fake-ip-range", dns.DefaultFakeIPRange, "IPv4 range the fake addresses of --route-domain names are handed out from (routed through the tunnel)")
+
+	// Bind to viper for config file support
+	viper.BindPFlag("defaults.local_ip", startCmd.Flags().Lookup("local-ip"))
+	viper.BindPFlag("defaults.mtu", startCmd.Flags().Lookup("mtu"))
+	viper.BindPFlag("defaults.keep_alive", startCmd.Flags().Lookup("keep-alive"))
+	viper.BindPFlag("defaults.timeout", startCmd.Flags().Lookup("timeout"))
+	viper.BindPFlag("defaults.auto_reconnect", startCmd.Flags().Lookup("auto-reconnect"))
+	viper.BindPFlag("defaults.reconnect_delay", startCmd.Flags().Lookup("reconnect-delay"))
+	viper.BindPFlag("defaults.max_retries", startCmd.Flags().Lookup("max-retries"))
+	viper.BindPFlag("defaults.reconnect_policy", startCmd.Flags().Lookup("reconnect-policy"))
+	viper.BindPFlag("defaults.resume_timeout", startCmd.Flags().Lookup("resume-timeout"))
+	viper.BindPFlag("defaults.route_gateway", startCmd.Flags().Lookup("route-gateway"))
+	viper.BindPFlag("defaults.exclude_cidr", startCmd.Flags().Lookup("exclude-cidr"))
+	viper.BindPFlag("defaults.only_app", startCmd.Flags().Lookup("only-app"))
+	viper.BindPFlag("defaults.bypass_aws_endpoints", startCmd.Flags().Lookup("bypass-aws-endpoints"))
+	viper.BindPFlag("defaults.iam_preflight", startCmd.Flags().Lookup("iam-preflight"))
+	viper.BindPFlag("defaults.select_strategy", startCmd.Flags().Lookup("select-strategy"))
+	viper.BindPFlag("health.interval", startCmd.Flags().Lookup("health-interval"))
+	viper.BindPFlag("health.endpoint", startCmd.Flags().Lookup("health-endpoint"))
+	viper.BindPFlag("health.dns_name", startCmd.Flags().Lookup("health-dns-name"))
+	viper.BindPFlag("health.repair_drift", startCmd.Flags().Lookup("repair-drift"))
+	viper.BindPFlag("health.selftest", startCmd.Flags().Lookup("selftest"))
+	viper.BindPFlag("health.selftest_endpoint", startCmd.Flags().Lookup("selftest-endpoint"))
+	viper.BindPFlag("health.selftest_url", startCmd.Flags().Lookup("selftest-url"))
+	viper.BindPFlag("metrics.addr", startCmd.Flags().Lookup("metrics-addr"))
+	viper.BindPFlag("audit.log", startCmd.Flags().Lookup("audit-log"))
+	viper.BindPFlag("sharing.group", startCmd.Flags().Lookup("status-group"))
+	viper.BindPFlag("sharing.token_file", startCmd.Flags().Lookup("status-token-file"))
+}
+
+func runStart(cmd *cobra.Command, args []string) (retErr error) {
+	// --daemon re-executes this command in the background. Errors (shown
+	// with the log's last lines) should not be buried under the usage.
+	if daemon || isDaemonChild() {
+		cmd.SilenceUsage = true
+	}
+	if daemon && !isDaemonChild() {
+		return startDaemon(pickedInstance)
+	}
+	if isDaemonChild() {
+		defer daemonExit()
+	}
+	// A service's launchd log is rotated like the daemon log
+	if (isDaemonChild() || (isServiceChild() && logFile != "")) && logMaxSize > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go rotateDaemonLog(daemonLogPath(), int64(logMaxSize)<<20, logMaxBackups, done)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// In headless mode startup must finish (or fail) within a bounded time
+	var startupTimedOut atomic.Bool
+	stopStartupWatchdog := func() {}
+	if headless {
+		watchdog := time.AfterFunc(headlessTimeout, func() {
+			startupTimedOut.Store(true)
+			log.Errorf("Startup did not complete within %s, aborting", headlessTimeout)
+			cancel()
+		})
+		stopStartupWatchdog = func() { watchdog.Stop() }
+		defer func() {
+			if retErr != nil && startupTimedOut.Load() {
+				retErr = &exitError{
+					code:    exitStartupTimeout,
+					message: fmt.Sprintf("Error: startup did not complete within %s: %v", headlessTimeout, retErr),
+				}
+			}
+		}()
+	} else {
+		printStartBanner()
+	}
+
+	// Step 1: Check privileges
+	log.Info("✓ Checking privileges... OK (running as root)")
+	fmt.Println("✓ Checking privileges... OK (running as root)")
+
+	// One audit log for all tunnels of the process
+	if auditLogPath != "" {
+		opened, err := audit.Open(auditLogPath)
+		if err != nil {
+			return err
+		}
+		auditLog = opened
+		defer auditLog.Close()
+		fmt.Printf("✓ Audit log: %s\n", auditLogPath)
+	}
+	if destinationPolicy != nil {
+		printPolicy(destinationPolicy)
+	}
+	if selectedApps != nil {
+		fmt.Printf("✓ Only routing the traffic of: %s\n", selectedApps)
+	}
+
+	// One metrics endpoint serves all tunnels of the process
+	if metricsAddr != "" {
+		metricsRegistry = metrics.NewRegistry()
+		metricsServer, err := metrics.Listen(metricsAddr, metricsRegistry)
+		if err != nil {
+			return err
+		}
+		go metricsServer.Serve()
+		defer metricsServer.Close()
+		fmt.Printf("✓ Metrics endpoint: http://%s/metrics\n", metricsServer.Addr())
+	}
+
+	// Reconnects fail once the AWS credentials expire; status shows when
+	// they do and a warning is logged ahead of time
+	if watch, err := startCredentialWatch(ctx); err != nil {
+		log.Warnf("Failed to load AWS credentials for expiry checks: %v", err)
+	} else {
+		credentialWatcher = watch
+	}
+
+	group := newTunnelGroup(ctx, cancel, len(tunnelSpecs), stopStartupWatchdog, &startupTimedOut)
+	if len(tunnelSpecs) == 1 {
+		return runTunnel(ctx, tunnelSpecs[0], group, group.sequencer())
+	}
+
+	// Tunnels start one after another, in order, then run side by side; if
+	// one fails the others are stopped
+	errs := make([]error, len(tunnelSpecs))
+	var wg sync.WaitGroup
+	for i, spec := range tunnelSpecs {
+		out := group.sequencer()
+		out.enter()
+		if ctx.Err() != nil {
+			out.leave()
+			group.started()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runTunnel(ctx, spec, group, out); err != nil {
+				errs[i] = fmt.Errorf("tunnel %s: %w", spec.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runTunnel starts one tunnel, runs it until the process is interrupted
+// (or ctx is cancelled) and cleans up. It is called holding out; a failure
+// stops the other tunnels of the group.
+func runTunnel(ctx context.Context, spec *tunnelSpec, group *tunnelGroup, out *outputSequencer) (retErr error) {
+	if transport == transportDatachannel || transport == transportWireGuard {
+		return runDatachannelTunnel(ctx, spec, group, out)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Startup and shutdown output of concurrent tunnels is kept apart
+	out.enter()
+	defer out.leave()
+	started := sync.OnceFunc(group.started)
+	defer func() {
+		if retErr != nil {
+			group.cancel()
+		}
+		started()
+	}()
+	if group.multi {
+		fmt.Printf("\n✓ Starting tunnel %s...\n", spec.Name)
+	}
+
+	// Generate session name if not provided
+	name := spec.SessionName
+	generatedName := name == ""
+	if generatedName {
+		name = fmt.Sprintf("ssm-proxy-%d", time.Now().Unix())
+	}
+
+	// Reserve the session name before touching the system so that two
+	// concurrent starts can never share (and overwrite) the same state
+	sessionMgr := session.NewManager()
+	stale := staleSessions(sessionMgr)
+	sess := &session.Session{
+		Name:      name,
+		StartedAt: time.Now(),
+		PID:       os.Getpid(),
+	}
+	if err := reserveSessionName(sessionMgr, sess, generatedName); err != nil {
+		return err
+	}
+	name = sess.Name
+
+	// Printed last, after every cleanup step has run
+	summary := &shutdownSummary{Session: name}
+	defer summary.print(outputFormat)
+
+	// Record why the session ended in the persistent store
+	endReason := "startup failed"
+	defer func() {
+		if err := sessionMgr.End(name, endReason); err != nil {
+			summary.cleanupFailed("record session end", err)
+		}
+		sessionMgr.Close()
+	}()
+
+	// Recordings for protocol debugging (--record)
+	recorders, err := openRecorders(recordDir, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := recorders.Close(); err != nil {
+			summary.cleanupFailed("finish recordings", err)
+		}
+	}()
+
+	// Step 2: Find the instance and open the SSH tunnel over SSM, or attach to a channel opened earlier by `ssm-proxy prewarm`
+	var sshTunnel socksTunnel
+	var standbyTunnel socksTunnel // with --standby
+	var tunnelInstanceID string
+	if fromPrewarm != "" {
+		prewarmed, err := attachPrewarm(sessionMgr, fromPrewarm)
+		if err != nil {
+			return err
+		}
+		sshTunnel = prewarmed
+		tunnelInstanceID = prewarmed.rec.InstanceID
+	} else {
+		socksPort := spec.SOCKSPort
+		if socksPort == 0 {
+			port, err := netutil.FreeLocalPort()
+			if err != nil {
+				return fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+			}
+			socksPort = port
+		}
+		if launchBastion {
+			bastion, err := startBastion(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := bastion.release(); err != nil {
+					summary.cleanupFailed("release bastion", err)
+				}
+			}()
+			spec.InstanceID = bastion.instanceID
+		}
+		ssh, instance, err := connectTunnel(ctx, spec.Account, spec.InstanceID, spec.InstanceTag, socksPort, recorders.messages)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := ssh.Stop(); err != nil {
+				summary.cleanupFailed("stop SSH tunnel", err)
+			}
+		}()
+		sshTunnel = ssh
+		tunnelInstanceID = instance.InstanceID
+
+		if warmStandbyTunnel {
+			standby, err := connectStandby(ctx, spec)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := standby.Stop(); err != nil {
+					summary.cleanupFailed("stop standby tunnel", err)
+				}
+			}()
+			standbyTunnel = standby
+		}
+	}
+
+	// Move to another instance with the tag if this one goes down (--failover)
+	var failover *failoverTunnel
+	if failoverEnabled && spec.InstanceTag != "" {
+		failover = newFailoverTunnel(sshTunnel, spec.Account, tunnelInstanceID, spec.InstanceTag, recorders.messages)
+		sshTunnel = failover
+		defer func() {
+			if err := failover.Stop(); err != nil {
+				summary.cleanupFailed("stop SSH tunnel", err)
+			}
+		}()
+	}
+
+	// Routes for the instance's VPC, looked up now that the instance is known
+	if autoCIDR {
+		discovered, err := discoverVPCCIDRs(ctx, spec.Account, tunnelInstanceID)
+		if err != nil {
+			return fmt.Errorf("failed to discover VPC CIDR blocks: %w", err)
+		}
+		spec.CIDRs = mergeCIDRs(spec.CIDRs, discovered)
+		if hasIPv6CIDR(spec.CIDRs) {
+			if ip, _, err := net.ParseCIDR(spec.LocalIPv6); err != nil || ip.To4() != nil {
+				return fmt.Errorf("invalid --local-ipv6 %s (expected x:x::x/y)", spec.LocalIPv6)
+			}
+		}
+	}
+
+	// Step 3: Flush DNS cache to prevent stale entries from interfering
+	fmt.Println("✓ Flushing DNS cache...")
+	if err := dns.FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	}
+
+	// Step 4: Create TUN device
+	// TUN will be closed during shutdown sequence (must be closed before stopping forwarder)
+	tun, err := createTunnelTUN(spec, group)
+	if err != nil {
+		return err
+	}
+
+	// Step 5: Add routes
+	routes, err := addTunnelRoutes(ctx, spec, tun, sessionMgr, stale, name)
+	if err != nil {
+		return err
+	}
+	router, bypass, plans, tunPeer := routes.router, routes.bypass, routes.plans, routes.peer
+
+	printNATMappings(spec)
+
+	// Ensure routes are cleaned up on exit
+	defer func() {
+		fmt.Println("\n✓ Removing routes...")
+		if err := router.Cleanup(); err != nil {
+			summary.cleanupFailed("remove routes", err)
+		}
+	}()
+
+	// Step 6: Configure DNS resolver if specified (on the tunnel that
+	// routes it, with several tunnels)
+	tunDNS, err := setupTunnelDNS(spec, tun.Name())
+	if err != nil {
+		return err
+	}
+	if tunDNS.server != nil {
+		defer tunDNS.server.Close()
+	}
+
+	// Ensure system DNS resolver is cleaned up on exit
+	if tunDNS.system != nil {
+		defer func() {
+			if err := tunDNS.system.Cleanup(); err != nil {
+				summary.cleanupFailed("restore system DNS resolver", err)
+			}
+		}()
+	}
+
+	// Step 7: Start TUN-to-SOCKS translator
+	fmt.Println("✓ Starting transparent packet forwarder...")
+
+	var device forwarder.Device = tun
+	if recorders.packets != nil {
+		device = record.NewDevice(tun, recorders.packets)
+	}
+	// Reconnects, including switches to the standby tunnel
+	var reconnects atomic.Int64
+	var standby *warmStandby
+	if standbyTunnel != nil {
+		standby = newWarmStandby(sshTunnel, standbyTunnel, &reconnects)
+		sshTunnel = standby
+	}
+	device, injector := startChaos(ctx, device, sshTunnel)
+	tunToSocks, err := startForwarder(ctx, spec, name, device, sshTunnel, tunDNS.config, tunPeer, func() string {
+		if failover != nil {
+			_, instanceID := failover.current()
+			return instanceID
+		}
+		return tunnelInstanceID
+	})
+	if err != nil {
+		return err
+	}
+	// Forwarder will be stopped during shutdown sequence (after closing TUN device)
+
+	fmt.Printf("  └─ Transparent forwarding active ✓\n")
+
+	if tunDNS.server != nil {
+		go tunDNS.server.Serve(tunToSocks.DNSResolver())
+	}
+
+	// Other than startup below, only the main loop touches sess: the other
+	// goroutines send it their changes
+	updates := make(sessionUpdates)
+
+	// Switch to the standby tunnel when the active one fails (--standby)
+	if standby != nil {
+		startStandby(ctx, standby, tunToSocks, sessionMgr, updates)
+	}
+	// Record the instance --failover moves the tunnel to
+	if failover != nil {
+		recordFailovers(ctx, failover, sessionMgr, updates)
+	}
+
+	// Health checks beyond process liveness, per --health-* flags
+	checker, checkInterval := newTunnelChecker(spec)
+
+	// Step 8: Save session state
+	sess.InstanceID = tunnelInstanceID
+	sess.Region, sess.RoleARN = spec.Account.Region, spec.Account.RoleARN
+	sess.SessionID = ssmSessionID(sshTunnel)
+	sess.TunDevice = tun.Name()
+	sess.TunIP = spec.LocalIP
+	sess.SOCKSAddr = sshTunnel.SOCKSAddr()
+	sess.CIDRBlocks = spec.CIDRs
+	for _, plan := range plans {
+		sess.Routes = append(sess.Routes, plan.Routes...)
+	}
+	sess.StartedAt = time.Now()
+	sess.HealthInterval = checkInterval
+	if err := sessionMgr.Save(sess); err != nil {
+		log.Warnf("Failed to save session state: %v", err)
+	}
+	recordHealth(sessionMgr, sess, checker.Check(ctx, sshTunnel))
+
+	// Serve the control socket, through which route changes reach the
+	// main loop
+	stopCh := make(chan string, 1)
+	controlServer, err := serveControl(&sessionControl{
+		ctx:        ctx,
+		name:       name,
+		spec:       spec,
+		sessionMgr: sessionMgr,
+		updates:    updates,
+		tun:        tun,
+		router:     router,
+		forwarder:  tunToSocks,
+		bypass:     bypass,
+		system:     tunDNS.system,
+		standby:    standby,
+		stopCh:     stopCh,
+	}, plans, injector)
+	if err != nil {
+		return err
+	}
+	if controlServer != nil {
+		defer controlServer.Close()
+	}
+
+	// Test the whole path before startup counts as done (--selftest)
+	if selftestMode != selftestOff {
+		if err := runSelfTest(ctx, spec); err != nil {
+			return err
+		}
+	}
+
+	// Print success banner
+	switch {
+	case headless:
+		fmt.Printf("✓ Proxy active (session: %s, device: %s, SOCKS5: %s)\n", name, tun.Name(), sshTunnel.SOCKSAddr())
+	case group.multi:
+		fmt.Printf("✓ Tunnel %s active (session: %s, device: %s)\n", spec.Name, name, tun.Name())
+	default:
+		printSuccessBanner(tun.Name(), spec.CIDRs, strings.Join(dnsResolvers, ", "), dnsDomains)
+	}
+
+	// Startup is complete; the headless deadline no longer applies
+	started()
+	if group.timedOut.Load() {
+		return fmt.Errorf("startup aborted")
+	}
+	if err := group.err(); err != nil {
+		return err
+	}
+	out.leave()
+
+	// Step 9: Wait for interrupt signal
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Monitor SSH tunnel health (reconnecting if auto-reconnect is enabled;
+	// a prewarmed channel is reconnected by its own process)
+	drift := newDriftMonitor(router, tunDNS.verified, repairDrift)
+	network := newNetworkWatch(ctx, router, bypass, tun.Name())
+	go monitorTunnelHealth(ctx, sshTunnel, tunToSocks, checker, drift, network, sessionMgr, updates, autoReconnect && fromPrewarm == "", reconnectRules, maxRetries,
+		checkInterval, &reconnects)
+
+	// Expose the counters to Prometheus (--metrics-addr)
+	if metricsRegistry != nil {
+		unregister := metricsRegistry.Register(tunnelMetrics(name, tun.Name(), tunnelInstanceID, sshTunnel, tunToSocks, &reconnects))
+		defer unregister()
+	}
+
+	// Periodically persist traffic counters so history survives crashes
+	go recordSessionTraffic(ctx, sessionMgr, sess, tunToSocks)
+
+	// Follow the AWS endpoints' addresses as they change
+	if bypass != nil {
+		go bypass.watch(ctx, endpointRecheckInterval)
+	}
+
+	endReason = waitForStop(ctx, sess, updates, sigCh, stopCh)
+
+	out.enter()
+	if group.multi {
+		fmt.Printf("\n\n✓ Shutting down tunnel %s gracefully...\n", spec.Name)
+	} else {
+		fmt.Println("\n\n✓ Shutting down gracefully...")
+	}
+
+	// Cancel context to stop health monitor and other goroutines
+	cancel()
+
+	stopForwarder(tun, tunToSocks, summary)
+
+	printDNSRewriteHits(tunToSocks.DNSResolver())
+
+	// Persist final traffic totals and add them to the lifetime counters
+	finalStats := tunToSocks.GetStats()
+	summary.begin(endReason, sess.StartedAt, &finalStats, reconnects.Load())
+	recordFinalTraffic(sessionMgr, sess, &finalStats)
+
+	return nil
+}
+
+// createTunnelTUN creates and configures the tunnel's TUN device
+func createTunnelTUN(spec *tunnelSpec, group *tunnelGroup) (*tunnel.TunDevice, error) {
+	fmt.Println("✓ Creating TUN device...")
+	tun, err := tunnel.CreateTUN()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	group.addDevice(tun.Name())
+
+	if err := tun.Configure(spec.LocalIP, mtu); err != nil {
+		return nil, fmt.Errorf("failed to configure TUN device: %w", err)
+	}
+
+	fmt.Printf("  ├─ Device: %s\n", tun.Name())
+	fmt.Printf("  ├─ IP: %s\n", spec.LocalIP)
+	if hasIPv6CIDR(spec.CIDRs) {
+		if err := tun.ConfigureIPv6(spec.LocalIPv6); err != nil {
+			return nil, fmt.Errorf("failed to configure TUN device: %w", err)
+		}
+		fmt.Printf("  ├─ IPv6: %s\n", spec.LocalIPv6)
+	}
+	fmt.Printf("  └─ MTU: %d\n", mtu)
+	return tun, nil
+}
+
+// printNATMappings lists the tunnel's --nat-map mappings, if it has any
+func printNATMappings(spec *tunnelSpec) {
+	if spec.NAT.Empty() {
+		return
+	}
+	fmt.Println("✓ NAT mappings:")
+	mappings := spec.NAT.Mappings()
+	for i, m := range mappings {
+		prefix := "├─"
+		if i == len(mappings)-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("  %s %s → %s (remote)\n", prefix, m.Local, m.Remote)
+	}
+}
+
+// tunnelDNS is what setupTunnelDNS set up
+type tunnelDNS struct {
+	config   *dns.Config               // nil without --dns-resolver
+	system   *dns.SystemResolverConfig // nil without system DNS configuration
+	verified *dns.SystemResolverConfig // checked for drift
+	server   *dns.Server               // with --dns-listen
+}
+
+// setupTunnelDNS configures the DNS resolver if specified (on the tunnel
+// that routes it, with several tunnels): the forwarder's configuration,
+// the local DNS server and the system resolver configuration for tunName
+func setupTunnelDNS(spec *tunnelSpec, tunName string) (*tunnelDNS, error) {
+	d := &tunnelDNS{}
+	if dnsResolver == "" || !spec.DNS {
+		return d, nil
+	}
+	d.config = &dns.Config{
+		Resolvers: dnsResolvers,
+		Strategy:  dns.Strategy(dnsStrategy),
+		Domains:   dnsDomains,
+		NAT:       spec.NAT,
+		Rewrite:   dnsRewriteRules,
+		FakeIP:    fakeIPPool,
+		Policy:    destinationPolicy,
+	}
+	fmt.Printf("✓ DNS resolver configured: %s\n", strings.Join(dnsResolvers, ", "))
+	if len(dnsResolvers) > 1 {
+		fmt.Printf("  ├─ Strategy: %s\n", dnsStrategy)
+	}
+	if fakeIPPool != nil {
+		fmt.Printf("  ├─ Fake IPs: %s for %v\n", fakeIPPool.Network(), fakeIPPool.Patterns())
+	}
+	for _, rule := range dnsRewriteRules {
+		fmt.Printf("  ├─ Rewrite: %s\n", rule)
+	}
+
+	// Local DNS server, answering once the forwarder's resolver is up
+	if dnsListen != "" {
+		var err error
+		if d.server, err = dns.Listen(dnsListen); err != nil {
+			return nil, err
+		}
+		fmt.Printf("  ├─ Local DNS server: %s\n", d.server.Addr())
+	}
+
+	if len(dnsDomains) > 0 && dnsBackend == dns.BackendNone {
+		fmt.Printf("  └─ Domains: %v\n", dnsDomains)
+		fmt.Printf("  ⚠️  Note: --dns-backend none, leaving the system DNS resolver alone\n")
+	} else if len(dnsDomains) > 0 {
+		fmt.Printf("  └─ Domains: %v\n", dnsDomains)
+
+		// Set up system DNS resolver configuration, sending the queries
+		// to the local DNS server if there is one
+		fmt.Println("✓ Configuring system DNS resolver...")
+		d.system = dns.NewSystemResolverConfig(dnsDomains, dnsResolver)
+		if d.server != nil {
+			d.system = dns.NewSystemResolverConfig(dnsDomains, d.server.Addr().String())
+			d.system.SetPort(d.server.Addr().Port)
+		}
+		d.system.SetBackend(dnsBackend)
+		d.system.SetInterface(tunName)
+		if adoptOrphans {
+			d.system.Adopt()
+		}
+		if err := d.system.Setup(); err != nil {
+			log.Warnf("Failed to configure system DNS resolver: %v", err)
+			fmt.Printf("  ⚠️  Could not configure system DNS resolver automatically: %v\n", err)
+			fmt.Printf("     Continuing without automatic DNS configuration...\n")
+		} else {
+			d.verified = d.system
+		}
+	} else {
+		fmt.Printf("  └─ All DNS queries will be routed through tunnel\n")
+		fmt.Printf("  ⚠️  Note: No specific domains configured, skipping system DNS resolver setup\n")
+	}
+	return d, nil
+}
+
+// startForwarder starts the TUN-to-SOCKS translator relaying the traffic of
+// device through t. instanceID returns the tunnel's current instance, for
+// the audit log.
+func startForwarder(ctx context.Context, spec *tunnelSpec, name string, device forwarder.Device, t socksTunnel, dnsConfig *dns.Config,
+	gateway net.IP, instanceID func() string) (*forwarder.TunToSOCKS, error) {
+	tunToSocks, err := forwarder.NewTunToSOCKS(device, t.SOCKSAddr(), dnsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN-to-SOCKS translator: %w", err)
+	}
+	tunToSocks.SetNATTable(spec.NAT)
+	tunToSocks.SetDialTimeout(timeout)
+	tunToSocks.SetResumeTimeout(resumeTimeout)
+	tunToSocks.SetPingPorts(pingPorts)
+	if scheduler == schedulerDRR {
+		tunToSocks.SetScheduler(forwarder.NewScheduler(forwarder.DefaultQuantum, priorityPorts))
+	}
+	tunToSocks.SetGatewayAddress(gateway)
+	tunToSocks.SetCIDRs(spec.CIDRs)
+	tunToSocks.SetPolicy(destinationPolicy)
+	if selectedApps != nil {
+		tunToSocks.SetFlowSelector(appSelector(selectedApps), directDialer())
+	}
+	if auditLog != nil {
+		tunToSocks.SetFlowEnded(auditFlows(name, instanceID))
+	}
+
+	if err := tunToSocks.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start TUN-to-SOCKS translator: %w", err)
+	}
+	return tunToSocks, nil
+}
+
+// startStandby switches the forwarder to the standby tunnel when the
+// active one fails (--standby), sending the new address to the main loop
+func startStandby(ctx context.Context, standby *warmStandby, translator *forwarder.TunToSOCKS, sessionMgr *session.Manager, updates sessionUpdates) {
+	go standby.run(ctx, translator, func(addr string) {
+		updates.update(ctx, func(sess *session.Session) {
+			sess.SOCKSAddr = addr
+			saveSession(sessionMgr, sess)
+		})
+	}, &reconnectDelay)
+}
+
+// recordFailovers sends the instance the tunnel failed over to
+// (--failover) to the main loop
+func recordFailovers(ctx context.Context, failover *failoverTunnel, sessionMgr *session.Manager, updates sessionUpdates) {
+	failover.setOnSwitch(func(instanceID string) {
+		updates.update(ctx, func(sess *session.Session) {
+			sess.InstanceID = instanceID
+			saveSession(sessionMgr, sess)
+		})
+	})
+}
+
+// newTunnelChecker returns the tunnel's health checker and the interval of
+// its checks
+func newTunnelChecker(spec *tunnelSpec) (*health.Checker, time.Duration) {
+	checkInterval := healthInterval
+	if checkInterval == 0 {
+		checkInterval = min(keepAlive, healthCheckInterval)
+	}
+	healthConfig := health.Config{Timeout: min(timeout, checkInterval)}
+	if spec.Health {
+		healthConfig.Endpoint = healthEndpoint
+	}
+	if healthDNSName != "" && spec.DNS {
+		healthConfig.DNSServer = dnsResolver
+		healthConfig.DNSName = healthDNSName
+	}
+	checker := health.NewChecker(healthConfig)
+	log.Debugf("Tunnel health checks every %s: %s", checkInterval, strings.Join(checker.Layers(), ", "))
+	return checker, checkInterval
+}
+
+// serveControl serves the session's control socket: root and the owner
+// may do everything, others what --status-group, --status-token-file and
+// --control-grant allow them. Without grants, failing to open it is only
+// a warning and the server returned is nil.
+func serveControl(c *sessionControl, plans []routing.RoutePlan, injector *chaos.Injector) (*control.Server, error) {
+	server, err := control.Listen(control.SocketPath(c.name), controlAccess)
+	if err != nil {
+		if len(controlAccess.Grants) > 0 {
+			return nil, fmt.Errorf("failed to share session status: %w", err)
+		}
+		log.Warnf("Failed to open control socket: %v", err)
+		return nil, nil
+	}
+
+	c.routes = make(map[string][]string)
+	for _, plan := range plans {
+		c.routes[plan.CIDR] = plan.Routes
+	}
+	c.register(server)
+	if injector != nil {
+		handleChaos(server, injector)
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// waitForStop is the main loop of a running tunnel. It applies the changes
+// sent on updates to sess until the tunnel is to stop: on a signal, after
+// --max-lifetime (e.g. if a CI job never cleans up), on a reason sent on
+// stopCh or when ctx is done. It returns why the tunnel stops.
+func waitForStop(ctx context.Context, sess *session.Session, updates sessionUpdates, sigCh <-chan os.Signal, stopCh <-chan string) string {
+	var lifetimeCh <-chan time.Time
+	if maxLifetime > 0 {
+		lifetimeCh = time.After(maxLifetime)
+	}
+
+	for {
+		select {
+		case change := <-updates:
+			change(sess)
+		case sig := <-sigCh:
+			return fmt.Sprintf("signal: %v", sig)
+		case <-lifetimeCh:
+			log.Warnf("Maximum lifetime of %s reached, shutting down", maxLifetime)
+			return "max lifetime reached"
+		case reason := <-stopCh:
+			return reason
+		case <-ctx.Done():
+			// Another tunnel of this process failed
+			return "stopped with another tunnel"
+		}
+	}
+}
+
+// stopForwarder resets the relayed connections, closes the TUN device and
+// stops the forwarder, in that order
+func stopForwarder(tun *tunnel.TunDevice, tunToSocks *forwarder.TunToSOCKS, summary *shutdownSummary) {
+	// Reset the relayed connections while the TUN device is still open, so
+	// local applications see them end instead of hanging until they time out
+	tunToSocks.Drain()
+	if n := tunToSocks.ResetConnections(nil); n > 0 {
+		fmt.Printf("✓ Reset %d open connection(s)\n", n)
+	}
+
+	// Shutdown sequence: Close TUN device BEFORE stopping forwarder
+	// This ensures any blocked Read() operations are interrupted
+	fmt.Println("✓ Closing TUN device...")
+	if err := tun.Close(); err != nil {
+		summary.cleanupFailed("close TUN device", err)
+	}
 
-	// Advanced options
-	startCmd.Flags().BoolVar(&logPackets, "log-packets", false, "Log individual packets (debug only, very verbose)")
-	startCmd.Flags().BoolVar(&tempKey, "temp-key", false, "Generate a temporary SSH key pair for this session only (ignore existing ~/.ssh keys)")
+	// Now stop the forwarder (Read() will return error and goroutine will exit)
+	fmt.Println("✓ Stopping packet forwarder...")
+	if err := tunToSocks.Stop(); err != nil {
+		summary.cleanupFailed("stop packet forwarder", err)
+	}
+}
 
-	// DNS configuration
-	startCmd.Flags().StringVar(&dnsResolver, "dns-resolver", "", "DNS server accessible through tunnel (e.g., '10.0.0.2:53' or '169.254.169.253:53' for AWS VPC DNS)")
-	startCmd.Flags().StringSliceVar(&dnsDomains, "dns-domains", []string{}, "Domain suffixes to resolve through tunnel (e.g., '.internal.company.com,.amazonaws.com'). If empty, all DNS queries routed through tunnel")
+// recordFinalTraffic persists the traffic totals of an ended session and
+// adds them to the lifetime counters
+func recordFinalTraffic(sessionMgr *session.Manager, sess *session.Session, finalStats *forwarder.Stats) {
+	if err := sessionMgr.RecordTraffic(sess, finalStats.PacketsTX, finalStats.PacketsRX, finalStats.BytesTX, finalStats.BytesRX); err != nil {
+		log.Warnf("Failed to record session traffic: %v", err)
+	}
+	if st, err := sessionMgr.Store(); err == nil {
+		st.AddCounters(map[string]uint64{
+			"sessions_total": 1,
+			"packets_tx":     finalStats.PacketsTX,
+			"packets_rx":     finalStats.PacketsRX,
+			"bytes_tx":       finalStats.BytesTX,
+			"bytes_rx":       finalStats.BytesRX,
+		})
+	}
+}
 
-	// Bind to viper for config file support
-	viper.BindPFlag("defaults.local_ip", startCmd.Flags().Lookup("local-ip"))
-	viper.BindPFlag("defaults.mtu", startCmd.Flags().Lookup("mtu"))
-	viper.BindPFlag("defaults.keep_alive", startCmd.Flags().Lookup("keep-alive"))
-	viper.BindPFlag("defaults.timeout", startCmd.Flags().Lookup("timeout"))
-	viper.BindPFlag("defaults.auto_reconnect", startCmd.Flags().Lookup("auto-reconnect"))
-	viper.BindPFlag("defaults.reconnect_delay", startCmd.Flags().Lookup("reconnect-delay"))
-	viper.BindPFlag("defaults.max_retries", startCmd.Flags().Lookup("max-retries"))
+// tunnelRoutes is what addTunnelRoutes set up
+type tunnelRoutes struct {
+	router *routing.Router
+	bypass *endpointBypass // nil without --bypass-aws-endpoints
+	plans  []routing.RoutePlan
+	peer   net.IP // the gateway of gateway routes
 }
 
-func runStart(cmd *cobra.Command, args []string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// addTunnelRoutes routes the tunnel's CIDR blocks to tun, except the
+// --exclude-cidr blocks and (with --bypass-aws-endpoints) the AWS
+// endpoints, adopting routes left by the stale sessions. If adding the
+// routes fails, those added are removed again.
+func addTunnelRoutes(ctx context.Context, spec *tunnelSpec, tun routedDevice, sessionMgr *session.Manager, stale []*session.Session, name string) (*tunnelRoutes, error) {
+	fmt.Println("✓ Adding routes...")
+	router := routing.NewRouter()
+	tunPeer, err := configureGateways(router, tun, spec.LocalIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure gateway routes: %w", err)
+	}
+	// Where the AWS endpoints are reached now, before the routes change it
+	var bypass *endpointBypass
+	if bypassAWSEndpoints {
+		if bypass, err = newEndpointBypass(ctx, spec.Account, router, spec.CIDRs); err != nil {
+			// With all traffic routed the tunnel would carry itself
+			if fullTunnel {
+				return nil, fmt.Errorf("failed to look up the AWS endpoints to keep outside the full tunnel: %w", err)
+			}
+			log.Warnf("Failed to look up AWS endpoints, they may become unreachable: %v", err)
+		}
+	}
+	// Where the --exclude-cidr blocks are reached now, likewise, and with
+	// --full-tunnel the DNS servers the reconnects need
+	exclusions, err := planExclusions(spec.CIDRs, excludeCIDRs, "excluded")
+	if err != nil {
+		return nil, err
+	}
+	if fullTunnel {
+		pins, err := planExclusions(spec.CIDRs, nameserverPins(), "DNS server")
+		if err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, pins...)
+	}
+	plans := planRoutes(spec.CIDRs, tun.Name())
+	var wantedRoutes []string
+	for _, plan := range plans {
+		wantedRoutes = append(wantedRoutes, plan.Routes...)
+	}
+	results := router.AddRoutes(ctx, wantedRoutes, tun.Name())
+	orphans := orphansOf(stale, wantedRoutes)
+	adoptErr := adoptRoutes(ctx, router, results, tun.Name(), orphans)
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("  └─ %s ✗ %v\n", result.CIDR, result.Err)
+		} else {
+			fmt.Printf("  └─ %s → %s\n", result.CIDR, routeTarget(router, result.CIDR, tun.Name()))
+		}
+	}
+	if err := results.Err(); err != nil {
+		// Roll back the routes that were added (ctx may be cancelled)
+		router.Cleanup()
+		if adoptErr != nil {
+			return nil, fmt.Errorf("failed to add %d of %d routes: %w", len(results.Failed()), len(results), adoptErr)
+		}
+		return nil, fmt.Errorf("failed to add %d of %d routes: %w", len(results.Failed()), len(results), err)
+	}
+	if adoptOrphans {
+		endOrphans(sessionMgr, orphans, name)
+	}
+	if err := addExclusions(ctx, router, exclusions); err != nil {
+		router.Cleanup()
+		return nil, err
+	}
+	if bypass != nil {
+		bypass.update(ctx, true)
+	}
 
-	// Print banner
-	printStartBanner()
+	return &tunnelRoutes{router: router, bypass: bypass, plans: plans, peer: tunPeer}, nil
+}
 
-	// Generate session name if not provided
-	if sessionName == "" {
-		sessionName = fmt.Sprintf("ssm-proxy-%d", time.Now().Unix())
+// printDNSRewriteHits prints how often each DNS rewrite rule matched
+func printDNSRewriteHits(resolver *dns.Resolver) {
+	if resolver == nil {
+		return
+	}
+	rules := resolver.RewriteRules()
+	if len(rules) == 0 {
+		return
 	}
 
-	// Step 1: Initialize AWS clients
-	log.Info("✓ Checking privileges... OK (running as root)")
-	fmt.Println("✓ Checking privileges... OK (running as root)")
+	fmt.Println("✓ DNS rewrite rule hits:")
+	for i, rule := range rules {
+		prefix := "├─"
+		if i == len(rules)-1 {
+			prefix = "└─"
+		}
+		name := rule.String()
+		if rule.Source != "" {
+			name += " (" + rule.Source + ")"
+		}
+		fmt.Printf("  %s %s: %d\n", prefix, name, rule.Hits())
+	}
+}
 
-	awsClient, err := aws.NewClient(ctx, awsProfile, awsRegion)
+// lookupTarget initializes the AWS client for the account and looks up the
+// EC2 instance (or other SSM target) by ID or Key=Value tag (--instance-id
+// or --instance-tag), checking that its SSM Agent is connected
+func lookupTarget(ctx context.Context, account awsAccount, id, tag string) (*aws.Client, *aws.Instance, error) {
+	awsClient, err := account.client(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to initialize AWS client: %w", err)
+		return nil, nil, fmt.Errorf("failed to initialize AWS client: %w", err)
 	}
 
 	profile := awsProfile
 	if profile == "" {
 		profile = "default"
 	}
+	if details := account.String(); details != "" {
+		profile += ", " + details
+	}
 	log.Infof("✓ Validating AWS credentials... OK (using profile: %s)", profile)
 	fmt.Printf("✓ Validating AWS credentials... OK (using profile: %s)\n", profile)
 
-	// Step 2: Find EC2 instance
+	// Find EC2 instance
 	var instance *aws.Instance
-	if instanceID != "" {
-		fmt.Printf("✓ Finding EC2 instance %s...\n", instanceID)
-		instance, err = awsClient.GetInstance(ctx, instanceID)
+	if id != "" && aws.TargetKind(id) != aws.TargetEC2 {
+		fmt.Printf("✓ Finding SSM target %s...\n", id)
+		instance, err = awsClient.GetInstance(ctx, id)
 		if err != nil {
-			return fmt.Errorf("failed to find instance: %w", err)
+			return nil, nil, fmt.Errorf("failed to find target: %w", err)
+		}
+	} else if id != "" {
+		fmt.Printf("✓ Finding EC2 instance %s...\n", id)
+		instance, err = awsClient.GetInstance(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find instance: %w", err)
 		}
 	} else {
-		fmt.Printf("✓ Finding EC2 instance by tag %s...\n", instanceTag)
-		tagParts := strings.SplitN(instanceTag, "=", 2)
+		fmt.Printf("✓ Finding EC2 instance by tag %s...\n", tag)
+		tagParts := strings.SplitN(tag, "=", 2)
 		if len(tagParts) != 2 {
-			return fmt.Errorf("invalid tag format, expected Key=Value")
+			return nil, nil, fmt.Errorf("invalid tag format, expected Key=Value")
 		}
 		instances, err := awsClient.FindInstancesByTag(ctx, tagParts[0], tagParts[1])
 		if err != nil {
-			return fmt.Errorf("failed to find instances: %w", err)
+			return nil, nil, fmt.Errorf("failed to find instances: %w", err)
 		}
 		if len(instances) == 0 {
-			return fmt.Errorf("no instances found with tag %s", instanceTag)
+			return nil, nil, fmt.Errorf("no instances found with tag %s", tag)
 		}
+		instance = instances[0]
 		if len(instances) > 1 {
-			return fmt.Errorf("multiple instances found with tag %s, use --instance-id to specify", instanceTag)
+			selected, reason, err := awsClient.SelectInstance(ctx, instances, selectStrategy, selectTargetAddr())
+			if err != nil {
+				return nil, nil, fmt.Errorf("multiple instances found with tag %s: %w", tag, err)
+			}
+			fmt.Printf("  ├─ Selected %s of %d: %s\n", selected.InstanceID, len(instances), reason)
+			instance = selected
 		}
-		instance = instances[0]
 	}
 
 	fmt.Printf("  ├─ Instance: %s (%s)\n", instance.Name, instance.InstanceType)
 	fmt.Printf("  ├─ State: %s\n", instance.State)
-	fmt.Printf("  ├─ AZ: %s\n", instance.AvailabilityZone)
+	if instance.AvailabilityZone != "" {
+		fmt.Printf("  ├─ AZ: %s\n", instance.AvailabilityZone)
+	}
 	fmt.Printf("  ├─ Private IP: %s\n", instance.PrivateIP)
 
 	if instance.State != "running" {
-		return fmt.Errorf("instance is not running (state: %s)", instance.State)
+		return nil, nil, fmt.Errorf("instance is not running (state: %s)", instance.State)
 	}
 
 	if !instance.SSMConnected {
-		return fmt.Errorf("SSM Agent is not connected on instance")
+		switch aws.TargetKind(instance.InstanceID) {
+		case aws.TargetECS:
+			return nil, nil, fmt.Errorf("ECS Exec agent is not running in the container (is enableExecuteCommand set on the task?)")
+		case aws.TargetManaged:
+			return nil, nil, fmt.Errorf("SSM Agent of the managed instance is not online")
+		}
+		return nil, nil, fmt.Errorf("SSM Agent is not connected on instance")
 	}
 	fmt.Printf("  └─ SSM Status: connected ✓\n")
 
-	// Step 3: Flush DNS cache to prevent stale entries from interfering
-	fmt.Println("✓ Flushing DNS cache...")
-	if err := dns.FlushDNSCache(); err != nil {
-		log.Warnf("Failed to flush DNS cache: %v", err)
+	return awsClient, instance, nil
+}
+
+// connectTunnel initializes the AWS client for the account, looks up the EC2 instance by ID
+// or Key=Value tag (--instance-id or --instance-tag), pushes the SSH key and starts the SSH
+// tunnel with dynamic SOCKS5 forwarding over SSM on socksPort, using the
+// --transport implementation
+func connectTunnel(ctx context.Context, account awsAccount, id, tag string, socksPort int, recorder *record.Writer) (socksTunnel, *aws.Instance, error) {
+	awsClient, instance, err := lookupTarget(ctx, account, id, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if iamPreflight {
+		if err := checkIAMPermissions(ctx, awsClient, instance.InstanceID); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Step 4: Start SSH tunnel with dynamic SOCKS5 forwarding over SSM
-	fmt.Println("✓ Starting SSH tunnel over SSM...")
-	sshTunnel := tunnel.NewSSHTunnel(tunnel.SSHTunnelConfig{
+	// Start SSH tunnel with dynamic SOCKS5 forwarding over SSM
+	fmt.Printf("✓ Starting SSH tunnel over SSM (%s transport)...\n", transport)
+	tunnelConfig := tunnel.SSHTunnelConfig{
 		InstanceID:       instance.InstanceID,
 		Region:           awsClient.Region(),
 		AWSProfile:       awsProfile,
 		AWSConfig:        awsClient.Config(),
 		AvailabilityZone: instance.AvailabilityZone,
-		SOCKSPort:        1080,
-		SSHUser:          "ec2-user",
+		SOCKSPort:        socksPort,
+		SSHUser:          sshUser,
 		TempKey:          tempKey,
-	})
+		NonInteractive:   headless,
+		KeepAlive:        keepAlive,
+		ConnectTimeout:   timeout,
+		Compression:      compression != "off",
+		CredentialsEnv:   account.RoleARN != "",
+		Recorder:         recorder,
+	}
+	var sshTunnel socksTunnel = tunnel.NewSSHTunnel(tunnelConfig)
+	if transport == transportNative {
+		if tunnelConfig.Compression {
+			fmt.Printf("  ⚠️  --compression is not supported by the native transport, sending uncompressed\n")
+		}
+		sshTunnel = tunnel.NewNativeTunnel(tunnelConfig)
+	}
 
 	if err := sshTunnel.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start SSH tunnel: %w", err)
+		return nil, nil, fmt.Errorf("failed to start SSH tunnel: %w", err)
 	}
-	defer sshTunnel.Stop()
 
 	fmt.Printf("  ├─ SOCKS5 proxy: %s\n", sshTunnel.SOCKSAddr())
 	fmt.Printf("  └─ Tunnel established ✓\n")
 
-	// Step 4: Create TUN device
-	fmt.Println("✓ Creating utun device...")
-	tun, err := tunnel.CreateTUN()
+	return sshTunnel, instance, nil
+}
+
+// selectTargetAddr returns the --select-target address, the zero address
+// if none is given (validated in PreRunE)
+func selectTargetAddr() netip.Addr {
+	addr, _ := netip.ParseAddr(selectTarget)
+	return addr
+}
+
+// checkIAMPermissions simulates the caller's IAM policies for the
+// permissions the tunnel needs and fails naming the missing ones, instead
+// of an opaque AWS error halfway through the setup. Without the permission
+// to simulate, it is skipped.
+func checkIAMPermissions(ctx context.Context, awsClient *aws.Client, instanceID string) error {
+	fmt.Printf("✓ Checking IAM permissions...\n")
+	caller, err := awsClient.CallerIdentity(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create TUN device: %w", err)
+		return fmt.Errorf("failed to get caller identity: %w", err)
 	}
-	// TUN will be closed during shutdown sequence (must be closed before stopping forwarder)
-
-	// Configure TUN device
-	if err := tun.Configure(localIP, mtu); err != nil {
-		return fmt.Errorf("failed to configure TUN device: %w", err)
+	results, err := awsClient.CheckPermissions(ctx, caller, awsClient.RequiredPermissions(caller, instanceID))
+	if errors.Is(err, aws.ErrSimulationUnavailable) {
+		log.Debugf("IAM preflight skipped: %v", err)
+		fmt.Printf("  └─ Skipped: cannot simulate the policies of %s\n", caller)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("  ├─ Device: %s\n", tun.Name())
-	fmt.Printf("  ├─ IP: %s\n", localIP)
-	fmt.Printf("  └─ MTU: %d\n", mtu)
-
-	// Step 5: Add routes
-	fmt.Println("✓ Adding routes...")
-	router := routing.NewRouter()
-	for _, cidr := range cidrBlocks {
-		if err := router.AddRoute(cidr, tun.Name()); err != nil {
-			// Clean up previously added routes
-			router.Cleanup()
-			return fmt.Errorf("failed to add route for %s: %w", cidr, err)
+	var missing []string
+	allowed := 0
+	for _, r := range results {
+		if r.Allowed {
+			allowed++
+			continue
 		}
-		fmt.Printf("  └─ %s → %s\n", cidr, tun.Name())
+		if r.Optional && !autoCIDR {
+			continue
+		}
+		missing = append(missing, fmt.Sprintf("%s (%s, %s)", r.Permission, r.Purpose, r.Decision))
 	}
-
-	// Ensure routes are cleaned up on exit
-	defer func() {
-		fmt.Println("\n✓ Removing routes...")
-		router.Cleanup()
-	}()
-
-	// Step 6: Configure DNS resolver if specified
-	var dnsConfig *dns.Config
-	var macOSResolver *dns.MacOSResolverConfig
-	if dnsResolver != "" {
-		dnsConfig = &dns.Config{
-			Resolver: dnsResolver,
-			Domains:  dnsDomains,
+	if len(missing) > 0 {
+		for _, m := range missing {
+			fmt.Printf("  ├─ Missing: %s\n", m)
 		}
-		fmt.Printf("✓ DNS resolver configured: %s\n", dnsResolver)
-		if len(dnsDomains) > 0 {
-			fmt.Printf("  └─ Domains: %v\n", dnsDomains)
+		fmt.Printf("  └─ Caller: %s\n", caller)
+		return fmt.Errorf("missing IAM permissions for %s: %s (use --iam-preflight=false to try anyway)", caller, strings.Join(missing, "; "))
+	}
+	fmt.Printf("  └─ %d of %d permission(s) allowed ✓\n", allowed, len(results))
+	return nil
+}
+
+// recordSessionTraffic periodically writes the forwarder's traffic totals
+// to the session record until ctx is cancelled
+func recordSessionTraffic(ctx context.Context, mgr *session.Manager, sess *session.Session, t *forwarder.TunToSOCKS) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 
-			// Set up macOS DNS resolver configuration
-			fmt.Println("✓ Configuring macOS DNS resolver...")
-			macOSResolver = dns.NewMacOSResolverConfig(dnsDomains, dnsResolver)
-			if err := macOSResolver.Setup(); err != nil {
-				log.Warnf("Failed to configure macOS DNS resolver: %v", err)
-				fmt.Printf("  ⚠️  Could not configure macOS DNS resolver automatically: %v\n", err)
-				fmt.Printf("     Continuing without automatic DNS configuration...\n")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := t.GetStats()
+			if err := mgr.RecordTraffic(sess, stats.PacketsTX, stats.PacketsRX, stats.BytesTX, stats.BytesRX); err != nil {
+				log.Debugf("Failed to record session traffic: %v", err)
 			}
-		} else {
-			fmt.Printf("  └─ All DNS queries will be routed through tunnel\n")
-			fmt.Printf("  ⚠️  Note: No specific domains configured, skipping macOS DNS resolver setup\n")
 		}
 	}
+}
 
-	// Ensure macOS DNS resolver is cleaned up on exit
-	if macOSResolver != nil {
-		defer func() {
-			if err := macOSResolver.Cleanup(); err != nil {
-				log.Warnf("Failed to cleanup macOS DNS resolver: %v", err)
-			}
-		}()
+// reserveSessionName claims sess.Name in the session store. Generated names
+// are auto-suffixed on collision; user-provided names are rejected unless
+// --replace was given, in which case a running owner is stopped first.
+func reserveSessionName(mgr *session.Manager, sess *session.Session, generated bool) error {
+	if generated {
+		return mgr.CreateUnique(sess)
 	}
 
-	// Step 7: Start TUN-to-SOCKS translator
-	fmt.Println("✓ Starting transparent packet forwarder...")
-
-	tunToSocks, err := forwarder.NewTunToSOCKS(tun, sshTunnel.SOCKSAddr(), dnsConfig)
-	if err != nil {
-		return fmt.Errorf("failed to create TUN-to-SOCKS translator: %w", err)
+	err := mgr.Create(sess)
+	if err == nil || !errors.Is(err, session.ErrSessionExists) {
+		return err
 	}
 
-	if err := tunToSocks.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start TUN-to-SOCKS translator: %w", err)
+	existing, getErr := mgr.Get(sess.Name)
+	running := getErr == nil && existing.IsRunning()
+
+	if !replaceSession && !(adoptOrphans && getErr == nil && !running) {
+		if running {
+			return fmt.Errorf("session %q is already running (pid %d); choose another --session-name or use --replace to take it over",
+				sess.Name, existing.PID)
+		}
+		return fmt.Errorf("session %q already exists but is stale; use --adopt to take over what it left, --replace to reuse the name or run 'ssm-proxy stop --session-name %s' to clean it up",
+			sess.Name, sess.Name)
 	}
-	// Forwarder will be stopped during shutdown sequence (after closing TUN device)
 
-	fmt.Printf("  └─ Transparent forwarding active ✓\n")
+	if running && existing.PID != os.Getpid() {
+		fmt.Printf("✓ Replacing running session %s (pid %d)...\n", existing.Name, existing.PID)
+		if err := stopSession(existing, false); err != nil {
+			return fmt.Errorf("failed to stop session %s: %w", existing.Name, err)
+		}
 
-	// Step 8: Save session state
-	sessionMgr := session.NewManager()
-	sess := &session.Session{
-		Name:       sessionName,
-		InstanceID: instance.InstanceID,
-		SessionID:  sessionName, // Use session name as ID for SSH tunnel
-		TunDevice:  tun.Name(),
-		TunIP:      localIP,
-		CIDRBlocks: cidrBlocks,
-		StartedAt:  time.Now(),
-		PID:        os.Getpid(),
-	}
-	if err := sessionMgr.Save(sess); err != nil {
-		log.Warnf("Failed to save session state: %v", err)
+		if !waitForExit(existing, 10*time.Second) {
+			return fmt.Errorf("session %s (pid %d) did not exit in time", existing.Name, existing.PID)
+		}
 	}
-	defer sessionMgr.Remove(sessionName)
-
-	// Print success banner
-	printSuccessBanner(tun.Name(), cidrBlocks, dnsResolver, dnsDomains)
 
-	// Step 9: Wait for interrupt signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	return mgr.Save(sess)
+}
 
-	// Monitor SSH tunnel health if auto-reconnect is enabled
-	if autoReconnect {
-		go monitorTunnelHealth(ctx, sshTunnel, &reconnectDelay, maxRetries)
+// planRoutes detects existing routes that would take precedence over the
+// requested CIDR blocks and, depending on --route-conflicts, subdivides
+// them into more-specific routes. A report of conflicts and splits is printed.
+func planRoutes(cidrs []string, tunName string) []routing.RoutePlan {
+	var systemRoutes []routing.SystemRoute
+	if routeConflicts != routing.ConflictIgnore {
+		var err error
+		systemRoutes, err = routing.SystemRoutes()
+		if err != nil {
+			log.Warnf("Could not read routing table for conflict detection: %v", err)
+		}
 	}
 
-	// Wait for signal
-	<-sigCh
-	fmt.Println("\n\n✓ Shutting down gracefully...")
+	// Routes within --exclude-cidr blocks are meant to win over ours
+	systemRoutes = slices.DeleteFunc(systemRoutes, func(route routing.SystemRoute) bool {
+		return route.Destination != nil && excluded(route.Destination)
+	})
 
-	// Cancel context to stop health monitor and other goroutines
-	cancel()
+	plans := make([]routing.RoutePlan, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		conflicts, err := routing.FindConflicts(cidr, systemRoutes, tunName)
+		if err != nil {
+			log.Warnf("Conflict detection failed for %s: %v", cidr, err)
+		}
 
-	// Shutdown sequence: Close TUN device BEFORE stopping forwarder
-	// This ensures any blocked Read() operations are interrupted
-	fmt.Println("✓ Closing utun device...")
-	if err := tun.Close(); err != nil {
-		log.Warnf("Error closing TUN device: %v", err)
-	}
+		plan := routing.PlanRoutes(cidr, conflicts, routeConflicts)
+		for _, c := range plan.Conflicts {
+			fmt.Printf("  ⚠️  Route conflict: %s\n", c.Reason())
+		}
+		if plan.Split {
+			fmt.Printf("  ├─ %s split into %s to take precedence\n", cidr, strings.Join(plan.Routes, ", "))
+		} else if len(plan.Conflicts) > 0 && routeConflicts == routing.ConflictWarn {
+			fmt.Printf("  ├─ Traffic for the conflicting ranges may bypass the tunnel (use --route-conflicts split)\n")
+		}
+		for _, c := range plan.Unsolved {
+			fmt.Printf("  ⚠️  Cannot take precedence over %s\n", c.Existing)
+		}
 
-	// Now stop the forwarder (Read() will return error and goroutine will exit)
-	fmt.Println("✓ Stopping packet forwarder...")
-	if err := tunToSocks.Stop(); err != nil {
-		log.Warnf("Error stopping forwarder: %v", err)
+		plans = append(plans, plan)
 	}
 
-	return nil
+	return plans
 }
 
 func printStartBanner() {
@@ -441,67 +2003,313 @@ func printSuccessBanner(tunDevice string, cidrs []string, dnsResolver string, dn
 	fmt.Println()
 }
 
-func monitorTunnelHealth(ctx context.Context, sshTunnel *tunnel.SSHTunnel, delay *time.Duration, maxRetries int) {
+// Tunnel transports (--transport)
+const (
+	// transportSSH runs the ssh binary with the aws CLI as ProxyCommand
+	transportSSH = "ssh"
+	// transportNative runs the SSH client and SOCKS5 server in process over
+	// an SSM session opened by internal/ssm
+	transportNative = "native"
+	// transportDatachannel carries the TUN device's packets to
+	// ssm-proxy-agent on the instance over an SSM session, framed with
+	// SSMP, without SSH or SOCKS5
+	transportDatachannel = "ssm-datachannel"
+	// transportWireGuard runs WireGuard between the client and the
+	// instance, its datagrams carried like the packets of
+	// transportDatachannel
+	transportWireGuard = "wireguard"
+)
+
+// Flow schedulers (--scheduler)
+const (
+	// schedulerFIFO lets flows send as they come
+	schedulerFIFO = "fifo"
+	// schedulerDRR makes flows take turns (deficit round robin)
+	schedulerDRR = "drr"
+)
+
+// validateTransport checks a --transport value
+func validateTransport(name string) error {
+	switch name {
+	case transportSSH, transportNative, transportDatachannel, transportWireGuard:
+		return nil
+	}
+	return fmt.Errorf("invalid --transport value %q (expected %s, %s, %s or %s)", name, transportSSH, transportNative, transportDatachannel, transportWireGuard)
+}
+
+// validateCompression checks a --compression value and normalizes it.
+// auto (follow the peer) is for the agent only: the client decides.
+func validateCompression(name string) error {
+	c, err := ssmp.ParseCompression(name)
+	if err != nil {
+		return fmt.Errorf("invalid --compression value %q (expected off, lz4 or deflate)", name)
+	}
+	if c == ssmp.CompressionAuto {
+		return fmt.Errorf("invalid --compression value %q (auto is an agent setting; expected off, lz4 or deflate)", name)
+	}
+	compression = c.String()
+	return nil
+}
+
+// socksTunnel is the transport a session forwards through: an SSH tunnel
+// owned by this process or a prewarmed channel owned by another one
+type socksTunnel interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	SOCKSAddr() string
+}
+
+// ssmSessionID returns the ID of the SSM session carrying a tunnel, "" if
+// it is not known
+func ssmSessionID(t socksTunnel) string {
+	if s, ok := t.(interface{ SessionID() string }); ok {
+		return s.SessionID()
+	}
+	return ""
+}
+
+// recordSSMSession stores the SSM session of the tunnel when it changed,
+// e.g. after a reconnect
+func recordSSMSession(sessionMgr *session.Manager, sess *session.Session, id string) {
+	if id == "" || id == sess.SessionID {
+		return
+	}
+	sess.SessionID = id
+	if err := sessionMgr.Save(sess); err != nil {
+		log.Debugf("Failed to record SSM session: %v", err)
+	}
+}
+
+// keepTunnelUp restarts the tunnel whenever it goes down, until the process
+// is interrupted, and returns the signal
+func keepTunnelUp(ctx context.Context, t socksTunnel) os.Signal {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	ticker := time.NewTicker(min(keepAlive, healthCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sig := <-sigCh:
+			return sig
+		case <-ticker.C:
+			restartIfDown(ctx, t)
+		}
+	}
+}
+
+// restartIfDown restarts the tunnel if it went down
+func restartIfDown(ctx context.Context, t socksTunnel) {
+	if t.IsRunning() {
+		return
+	}
+	log.Warn("SSH tunnel down, reconnecting...")
+	if err := t.Start(ctx); err != nil {
+		log.Errorf("Failed to reconnect SSH tunnel: %v", err)
+	}
+}
+
+// healthCheckInterval is the default longest interval at which the running
+// process checks and reports tunnel health (--keep-alive can make it
+// shorter, --health-interval overrides it)
+const healthCheckInterval = 30 * time.Second
+
+// exitStartupTimeout is the exit code when --headless startup exceeds
+// --headless-timeout (matches timeout(1))
+const exitStartupTimeout = 124
+
+// recordHealth stores a health check result in the session store
+func recordHealth(sessionMgr *session.Manager, sess *session.Session, result health.Result) {
+	healthError := ""
+	if !result.Healthy() {
+		healthError = result.String()
+	}
+	if err := sessionMgr.RecordHealth(sess, result.Healthy(), healthError); err != nil {
+		log.Debugf("Failed to record session health: %v", err)
+	}
+}
+
+// monitorTunnelHealth periodically checks the SSH tunnel layer by layer and
+// the routes and DNS configuration for drift, reports both to the session
+// store and, if reconnect is enabled, restarts the tunnel when a check fails
+// (counting restarts in reconnects). How long it waits before restarting,
+// and whether it does at all, depends on the class of the failure. While
+// it restarts the tunnel, the translator holds TCP connections. A network
+// change is checked right away, and restarts the tunnel if the default
+// route moved. The session state is changed through updates.
+func monitorTunnelHealth(ctx context.Context, sshTunnel socksTunnel, translator *forwarder.TunToSOCKS, checker *health.Checker, drift *driftMonitor,
+	network *networkWatch, sessionMgr *session.Manager, updates sessionUpdates, reconnect bool, policy reconnectPolicy, maxRetries int, interval time.Duration,
+	reconnects *atomic.Int64) {
 	retries := 0
-	ticker := time.NewTicker(30 * time.Second)
+	state := &reconnectState{policy: policy}
+	record := func(change func(sess *session.Session)) {
+		updates.update(ctx, change)
+	}
+	defer translator.Resume() // connections stop waiting once it gives up
+	var startErr error        // of the latest failed restart
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
+		networkMoved := false // the default route moved to another gateway
 		select {
 		case <-ctx.Done():
 			log.Debug("Health monitor stopping due to context cancellation")
 			return
+		case event := <-network.events:
+			networkMoved = network.handle(ctx, event)
+			ticker.Reset(interval)
 		case <-ticker.C:
-			// Check context again before attempting reconnect
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			if !sshTunnel.IsRunning() {
-				// Check if we're shutting down
-				select {
-				case <-ctx.Done():
-					log.Debug("SSH tunnel down but context cancelled, not reconnecting")
-					return
-				default:
-				}
+		}
+		// Check context again before attempting reconnect
+		if ctx.Err() != nil {
+			return
+		}
 
-				log.Warn("SSH tunnel down, attempting reconnection...")
-				if maxRetries > 0 && retries >= maxRetries {
-					log.Error("Max reconnection attempts reached, giving up")
-					return
+		sessionID := ssmSessionID(sshTunnel)
+		record(func(sess *session.Session) { recordSSMSession(sessionMgr, sess, sessionID) })
+		if drift.check(ctx) {
+			counts := drift.counts
+			record(func(sess *session.Session) {
+				if err := sessionMgr.RecordDrift(sess, counts); err != nil {
+					log.Debugf("Failed to record session drift: %v", err)
 				}
-				retries++
-				time.Sleep(*delay)
-
-				// Attempt to restart tunnel
-				if err := sshTunnel.Start(ctx); err != nil {
-					log.Errorf("Failed to restart SSH tunnel: %v", err)
-				} else {
-					log.Info("SSH tunnel reconnected successfully")
-					retries = 0
-				}
-			} else {
-				retries = 0 // Reset retry counter on successful health check
+			})
+		}
+
+		result := checker.Check(ctx, sshTunnel)
+		if ctx.Err() != nil {
+			return
+		}
+		// The tunnel process may not have noticed its connection is gone
+		if networkMoved && result.Healthy() {
+			result = health.Result{Layer: health.LayerNetwork, Err: errNetworkChanged}
+		}
+		record(func(sess *session.Session) { recordHealth(sessionMgr, sess, result) })
+
+		if result.Healthy() {
+			retries = 0 // Reset retry counter on successful health check
+			state.reset()
+			startErr = nil
+			continue
+		}
+
+		log.Warnf("Tunnel health check failed at %s layer: %v", result.Layer, result.Err)
+
+		// Switch to a warm standby tunnel (--standby) rather than reconnect,
+		// unless the network change took it down as well
+		if standby, ok := sshTunnel.(interface{ Failover() bool }); ok && !networkMoved && standby.Failover() {
+			retries = 0
+			continue
+		}
+
+		if !reconnect {
+			log.Warn("Tunnel unhealthy (auto-reconnect disabled)")
+			continue
+		}
+
+		// A failed restart tells more about the failure than the check
+		failure := result.Err
+		if startErr != nil {
+			failure = startErr
+		}
+		class, rule, wait := state.decide(failure)
+		if rule.Never {
+			log.Errorf("Not reconnecting after %s failure (reconnect policy %s=never): %v", class, class, failure)
+			record(func(sess *session.Session) { recordDecision(sessionMgr, sess, class, "not reconnecting", failure) })
+			return
+		}
+		if maxRetries > 0 && retries >= maxRetries {
+			log.Error("Max reconnection attempts reached, giving up")
+			record(func(sess *session.Session) {
+				recordDecision(sessionMgr, sess, class, "gave up after max retries", failure)
+			})
+			return
+		}
+		retries++
+
+		log.Warnf("Reconnecting SSH tunnel in %s after %s failure (%s check failed, attempt %d)...",
+			wait, class, result.Layer, retries)
+		record(func(sess *session.Session) {
+			recordDecision(sessionMgr, sess, class, "reconnecting in "+wait.String(), failure)
+		})
+		translator.Suspend()
+
+		// The process is still up but not passing traffic: replace it
+		if result.Layer != health.LayerProcess {
+			if err := sshTunnel.Stop(); err != nil {
+				log.Warnf("Failed to stop unhealthy SSH tunnel: %v", err)
 			}
 		}
+
+		select {
+		case <-ctx.Done():
+			log.Debug("SSH tunnel down but context cancelled, not reconnecting")
+			return
+		case <-time.After(wait):
+		}
+
+		// Attempt to restart tunnel
+		if startErr = sshTunnel.Start(ctx); startErr != nil {
+			log.Errorf("Failed to restart SSH tunnel (%s failure): %v", tunnel.Classify(startErr), startErr)
+			continue
+		}
+		translator.Resume()
+
+		result = checker.Check(ctx, sshTunnel)
+		record(func(sess *session.Session) { recordHealth(sessionMgr, sess, result) })
+		reconnects.Add(1)
+		if result.Healthy() {
+			log.Info("SSH tunnel reconnected successfully")
+			retries = 0
+			state.reset()
+		} else {
+			log.Warnf("SSH tunnel restarted but %s check still fails: %v", result.Layer, result.Err)
+		}
+	}
+}
+
+// recordDecision stores what the health monitor does about a failure in the
+// session's health, so that status shows it
+func recordDecision(sessionMgr *session.Manager, sess *session.Session, class tunnel.Failure, decision string, err error) {
+	healthError := fmt.Sprintf("%s failure, %s: %v", class, decision, err)
+	if err := sessionMgr.RecordHealth(sess, false, healthError); err != nil {
+		log.Debugf("Failed to record session health: %v", err)
 	}
 }
 
 func validateCIDR(cidr string) error {
-	parts := strings.Split(cidr, "/")
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid CIDR format, expected x.x.x.x/y")
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return fmt.Errorf("invalid CIDR format, expected x.x.x.x/y or x:x::x/y")
 	}
+	return nil
+}
 
-	// Validate IP address
-	ipParts := strings.Split(parts[0], ".")
-	if len(ipParts) != 4 {
-		return fmt.Errorf("invalid IP address")
+// hasIPv6CIDR reports whether any of the CIDR blocks is an IPv6 prefix
+func hasIPv6CIDR(cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+			return true
+		}
 	}
+	return false
+}
 
-	// Basic validation - real implementation would be more thorough
+// validateDNSListen checks a --dns-listen address: an IPv4 address with an
+// optional port, as the system resolver configuration takes
+func validateDNSListen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "53"
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid --dns-listen %q (expected an IPv4 address, e.g. 127.0.0.1:53053)", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid --dns-listen port %q (expected 1-65535)", port)
+	}
 	return nil
 }
@@ -2,13 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
 	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
 	"github.com/spf13/cobra"
 )
 
@@ -17,8 +25,241 @@ var (
 	statusWatch      bool
 	statusShowRoutes bool
 	statusShowStats  bool
+	statusTop        int
+	statusCheck      bool
+	statusSession    string
+	statusShared     bool
+	statusTokenPath  string
 )
 
+// statusTokenEnv holds the token for --shared when --token-file is not given
+const statusTokenEnv = "SSM_PROXY_STATUS_TOKEN"
+
+// sharedStatus is what a running session reports over its control socket
+type sharedStatus struct {
+	Session  *session.Session `json:"session"`
+	Traffic  trafficCounters  `json:"traffic"`
+	Draining bool             `json:"draining,omitempty"`
+	Standby  string           `json:"standby,omitempty"` // with --standby: ready or down
+
+	Credentials *credentialStatus `json:"credentials,omitempty"`
+}
+
+// trafficCounters are a session's live forwarder counters
+type trafficCounters struct {
+	PacketsTX   uint64 `json:"packets_tx"`
+	PacketsRX   uint64 `json:"packets_rx"`
+	BytesTX     uint64 `json:"bytes_tx"`
+	BytesRX     uint64 `json:"bytes_rx"`
+	ConnsActive uint64 `json:"connections_active"`
+	ConnsPeak   uint64 `json:"connections_peak"`
+	ConnsDenied uint64 `json:"connections_denied"`
+}
+
+// newTrafficCounters copies the counters of forwarder stats
+func newTrafficCounters(stats *forwarder.Stats) trafficCounters {
+	return trafficCounters{
+		PacketsTX:   stats.PacketsTX,
+		PacketsRX:   stats.PacketsRX,
+		BytesTX:     stats.BytesTX,
+		BytesRX:     stats.BytesRX,
+		ConnsActive: stats.ConnsActive,
+		ConnsPeak:   stats.ConnsPeak,
+		ConnsDenied: stats.ConnsDenied,
+	}
+}
+
+// statsParams are the parameters of the stats control method
+type statsParams struct {
+	// Top is how many of the busiest destinations to report (none if 0)
+	Top int `json:"top,omitempty"`
+}
+
+// sessionStats is what a running session reports for 'status --show-stats'
+type sessionStats struct {
+	Traffic      trafficCounters      `json:"traffic"`
+	CIDRs        []cidrTraffic        `json:"cidrs"`
+	Destinations []destinationTraffic `json:"destinations,omitempty"` // with --top
+	Flows        []flowInfo           `json:"flows"`
+	DNS          *dnsStats            `json:"dns,omitempty"`
+
+	// DestinationsDropped counts the quietest destinations dropped to keep
+	// the per-destination table bounded
+	DestinationsDropped uint64 `json:"destinations_dropped,omitempty"`
+}
+
+// dnsStats are the counters of a session's DNS resolver
+type dnsStats struct {
+	CacheHits    uint64          `json:"cache_hits"`
+	CacheMisses  uint64          `json:"cache_misses"`
+	CacheHitRate float64         `json:"cache_hit_rate"`
+	Failures     uint64          `json:"failures"`
+	NXDomain     uint64          `json:"nxdomain"`
+	ServFail     uint64          `json:"servfail"`
+	OtherDomain  uint64          `json:"other_domain"`
+	Truncated    uint64          `json:"truncated"`
+	Denied       uint64          `json:"denied"`
+	LatencyP50   float64         `json:"latency_p50_ms"`
+	LatencyP90   float64         `json:"latency_p90_ms"`
+	LatencyP99   float64         `json:"latency_p99_ms"`
+	Queries      []dnsQueryCount `json:"queries"`
+	Servers      []dnsServer     `json:"servers"`
+}
+
+// dnsServer is the health of one of the DNS servers
+type dnsServer struct {
+	Address   string `json:"address"`
+	Healthy   bool   `json:"healthy"`
+	Queries   uint64 `json:"queries"`
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// dnsQueryCount is the number of queries for a tunnel domain and query type
+type dnsQueryCount struct {
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+	Count  uint64 `json:"count"`
+}
+
+// cidrTraffic are the counters of one routed CIDR block
+type cidrTraffic struct {
+	CIDR      string `json:"cidr"`
+	PacketsTX uint64 `json:"packets_tx"`
+	PacketsRX uint64 `json:"packets_rx"`
+	BytesTX   uint64 `json:"bytes_tx"`
+	BytesRX   uint64 `json:"bytes_rx"`
+}
+
+// destinationTraffic are the counters of one destination reached through
+// the tunnel
+type destinationTraffic struct {
+	Protocol  string `json:"protocol"`
+	Dst       string `json:"dst"`
+	Addr      string `json:"addr"` // on the TUN side, before NAT
+	Flows     uint64 `json:"flows"`
+	PacketsTX uint64 `json:"packets_tx"`
+	PacketsRX uint64 `json:"packets_rx"`
+	BytesTX   uint64 `json:"bytes_tx"`
+	BytesRX   uint64 `json:"bytes_rx"`
+}
+
+// flowInfo is a connection relayed through the tunnel
+type flowInfo struct {
+	Protocol  string    `json:"protocol"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	StartedAt time.Time `json:"started_at"`
+	BytesTX   uint64    `json:"bytes_tx"`
+	BytesRX   uint64    `json:"bytes_rx"`
+}
+
+// newSessionStats takes a snapshot of a translator's statistics, with its
+// top busiest destinations
+func newSessionStats(t *forwarder.TunToSOCKS, top int) *sessionStats {
+	stats := t.GetStats()
+	result := &sessionStats{
+		Traffic: newTrafficCounters(&stats),
+		CIDRs:   []cidrTraffic{},
+		Flows:   []flowInfo{},
+	}
+	for _, c := range t.CIDRStats() {
+		result.CIDRs = append(result.CIDRs, cidrTraffic(c))
+	}
+	if top > 0 {
+		destinations, dropped := t.TopDestinations(top)
+		for _, d := range destinations {
+			result.Destinations = append(result.Destinations, destinationTraffic{
+				Protocol:  d.Protocol,
+				Dst:       d.Dst,
+				Addr:      d.Addr.String(),
+				Flows:     d.Flows,
+				PacketsTX: d.PacketsTX,
+				PacketsRX: d.PacketsRX,
+				BytesTX:   d.BytesTX,
+				BytesRX:   d.BytesRX,
+			})
+		}
+		result.DestinationsDropped = dropped
+	}
+	for _, f := range t.Flows() {
+		result.Flows = append(result.Flows, flowInfo{
+			Protocol:  f.Protocol,
+			Src:       f.Src,
+			Dst:       f.Dst,
+			StartedAt: f.Started,
+			BytesTX:   f.BytesTX,
+			BytesRX:   f.BytesRX,
+		})
+	}
+	if resolver := t.DNSResolver(); resolver != nil {
+		result.DNS = newDNSStats(resolver.Stats())
+	}
+	return result
+}
+
+// newDNSStats converts the counters of a DNS resolver
+func newDNSStats(stats dns.Stats) *dnsStats {
+	result := &dnsStats{
+		CacheHits:   stats.CacheHits,
+		CacheMisses: stats.CacheMisses,
+		Failures:    stats.Failures,
+		NXDomain:    stats.NXDomain,
+		ServFail:    stats.ServFail,
+		OtherDomain: stats.OtherDomain,
+		Truncated:   stats.Truncated,
+		Denied:      stats.Denied,
+		LatencyP50:  milliseconds(stats.Latency.P50),
+		LatencyP90:  milliseconds(stats.Latency.P90),
+		LatencyP99:  milliseconds(stats.Latency.P99),
+		Queries:     []dnsQueryCount{},
+		Servers:     []dnsServer{},
+	}
+	if total := stats.CacheHits + stats.CacheMisses; total > 0 {
+		result.CacheHitRate = float64(stats.CacheHits) / float64(total)
+	}
+	for _, q := range stats.Queries {
+		result.Queries = append(result.Queries, dnsQueryCount(q))
+	}
+	for _, s := range stats.Servers {
+		result.Servers = append(result.Servers, dnsServer(s))
+	}
+	return result
+}
+
+// milliseconds returns a duration in (fractional) milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statusMaxFlows is how many connections per session 'status --show-stats'
+// lists (--json lists all)
+const statusMaxFlows = 20
+
+// Exit codes for 'status --check'
+const (
+	checkExitHealthy       = 0
+	checkExitMissing       = 3
+	checkExitStale         = 4
+	checkExitTunnelDown    = 5
+	checkExitRoutesMissing = 6
+)
+
+// healthStaleAfter is how many health-check intervals a report may be old
+// before the tunnel state is considered unknown (the owning process stopped
+// reporting)
+const healthStaleAfter = 3
+
+// healthReportStale reports whether the session's last health report is too
+// old, based on the interval its process checks at
+func healthReportStale(sess *session.Session) bool {
+	interval := sess.HealthInterval
+	if interval <= 0 {
+		interval = healthCheckInterval
+	}
+	return time.Since(sess.HealthCheckedAt) > healthStaleAfter*interval
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show status of active proxy sessions",
@@ -36,7 +277,23 @@ Examples:
   ssm-proxy status --watch
 
   # Detailed output with routes and stats
-  ssm-proxy status --show-routes --show-stats`,
+  ssm-proxy status --show-routes --show-stats
+
+  # Which services use the tunnel the most
+  ssm-proxy status --show-stats --top 10
+
+  # Health check for scripts (exit code 0 = healthy)
+  ssm-proxy status --session-name prod-vpc --check || echo "tunnel unhealthy"
+
+  # As another user, ask the running sessions (see 'start --status-group')
+  ssm-proxy status --shared --show-stats --token-file ~/.ssm-proxy-token
+
+Exit codes with --check:
+  0  session healthy
+  3  session not found
+  4  session stale (owning process is not running)
+  5  tunnel down (or no recent health report)
+  6  one or more routes missing or not pointing at the session's TUN device`,
 	RunE: runStatus,
 }
 
@@ -46,11 +303,30 @@ func init() {
 	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Output in JSON format")
 	statusCmd.Flags().BoolVarP(&statusWatch, "watch", "w", false, "Watch mode (refresh every 2s)")
 	statusCmd.Flags().BoolVar(&statusShowRoutes, "show-routes", false, "Show routing table entries")
-	statusCmd.Flags().BoolVar(&statusShowStats, "show-stats", false, "Show traffic statistics")
+	statusCmd.Flags().BoolVar(&statusShowStats, "show-stats", false, "Show live traffic statistics per CIDR block and the relayed connections")
+	statusCmd.Flags().IntVar(&statusTop, "top", 0, "With --show-stats, list the N destinations (address and port) with the most traffic")
+	statusCmd.Flags().BoolVar(&statusCheck, "check", false, "Check session health and exit non-zero if unhealthy")
+	statusCmd.Flags().StringVar(&statusSession, "session-name", "", "Session to show or check (default: all, or most recent for --check)")
+	statusCmd.Flags().BoolVar(&statusShared, "shared", false, "Ask running sessions over their control sockets instead of reading the state store (for users other than the one who started them)")
+	statusCmd.Flags().StringVar(&statusTokenPath, "token-file", "", "File with the token for --shared (default: $"+statusTokenEnv+")")
 }
 
 func runStatus(cmd *cobra.Command, args []string) error {
+	if statusTop < 0 {
+		return fmt.Errorf("invalid --top value %d (expected a positive number)", statusTop)
+	}
+	if statusTop > 0 && !statusShowStats {
+		return fmt.Errorf("--top requires --show-stats")
+	}
+
+	if statusCheck {
+		return runStatusCheck()
+	}
+
 	if statusWatch {
+		if headless {
+			return fmt.Errorf("--watch is not available in --headless mode")
+		}
 		return runStatusWatch()
 	}
 
@@ -83,23 +359,130 @@ func runStatusWatch() error {
 }
 
 func displayStatus() error {
-	sessionMgr := session.NewManager()
-	sessions, err := sessionMgr.ListAll()
+	sessions, live, err := listSessions()
 	if err != nil {
 		return fmt.Errorf("failed to list sessions: %w", err)
 	}
 
+	if statusSession != "" {
+		var filtered []*session.Session
+		for _, sess := range sessions {
+			if sess.Name == statusSession {
+				filtered = append(filtered, sess)
+			}
+		}
+		sessions = filtered
+	}
+
 	if statusJSON {
-		return displayStatusJSON(sessions)
+		return displayStatusJSON(sessions, live)
+	}
+
+	return displayStatusTable(sessions, live)
+}
+
+// listSessions returns the active sessions, most recent first, from the
+// state store or, with --shared, from the running sessions' control sockets,
+// along with what the running sessions report over them (live traffic
+// counters, draining)
+func listSessions() ([]*session.Session, map[string]*sharedStatus, error) {
+	if !statusShared {
+		sessionMgr := session.NewManager()
+		defer sessionMgr.Close()
+
+		sessions, err := sessionMgr.ListAll()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Sessions without a control socket (or not ours) only have
+		// their state
+		live := make(map[string]*sharedStatus)
+		for _, sess := range sessions {
+			if !isProcessRunning(sess.PID) {
+				continue
+			}
+			var status sharedStatus
+			if err := control.Call(control.SocketPath(sess.Name), control.MethodStatus, "", nil, &status); err != nil {
+				log.Debugf("Session %s: %v", sess.Name, err)
+				continue
+			}
+			live[sess.Name] = &status
+		}
+		return sessions, live, nil
+	}
+
+	token, err := statusToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sockets, err := control.Sockets(control.DefaultDir)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return displayStatusTable(sessions)
+	var sessions []*session.Session
+	live := make(map[string]*sharedStatus)
+	for name, path := range sockets {
+		var status sharedStatus
+		if err := control.Call(path, control.MethodStatus, token, nil, &status); err != nil {
+			log.Warnf("Session %s: %v", name, err)
+			continue
+		}
+		if status.Session == nil {
+			continue
+		}
+		sessions = append(sessions, status.Session)
+		live[status.Session.Name] = &status
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+	return sessions, live, nil
+}
+
+// statusToken returns the token for the control sockets, from --token-file
+// or the environment. The owner of a session needs none.
+func statusToken() (string, error) {
+	if statusTokenPath != "" {
+		return control.ReadTokenFile(statusTokenPath)
+	}
+	return os.Getenv(statusTokenEnv), nil
 }
 
-func displayStatusJSON(sessions []*session.Session) error {
+// fetchStats asks the running sessions for their live statistics over
+// their control sockets. Sessions that cannot be asked are left out, with
+// the reason in the second map.
+func fetchStats(sessions []*session.Session) (map[string]*sessionStats, map[string]error) {
+	stats := make(map[string]*sessionStats)
+	failed := make(map[string]error)
+
+	token, err := statusToken()
+	for _, sess := range sessions {
+		switch {
+		case err != nil:
+			failed[sess.Name] = err
+		case !statusShared && !isProcessRunning(sess.PID):
+			failed[sess.Name] = errors.New("session is not running")
+		default:
+			var s sessionStats
+			params := statsParams{Top: statusTop}
+			if err := control.Call(control.SocketPath(sess.Name), control.MethodStats, token, params, &s); err != nil {
+				failed[sess.Name] = err
+				continue
+			}
+			stats[sess.Name] = &s
+		}
+	}
+	return stats, failed
+}
+
+func displayStatusJSON(sessions []*session.Session, live map[string]*sharedStatus) error {
 	type SessionJSON struct {
 		Name          string    `json:"name"`
 		InstanceID    string    `json:"instance_id"`
+		SSMSessionID  string    `json:"ssm_session_id,omitempty"`
 		Status        string    `json:"status"`
 		TunDevice     string    `json:"tun_device"`
 		TunIP         string    `json:"tun_ip"`
@@ -107,6 +490,17 @@ func displayStatusJSON(sessions []*session.Session) error {
 		StartedAt     time.Time `json:"started_at"`
 		UptimeSeconds int64     `json:"uptime_seconds"`
 		PID           int       `json:"pid"`
+		TunnelUp      bool      `json:"tunnel_up"`
+		HealthError   string    `json:"health_error,omitempty"`
+		Draining      bool      `json:"draining,omitempty"`
+		Standby       string    `json:"standby,omitempty"`
+
+		Credentials *credentialStatus   `json:"credentials,omitempty"`
+		Drift       session.DriftCounts `json:"drift"`
+
+		// With --show-stats
+		Stats      *sessionStats `json:"stats,omitempty"`
+		StatsError string        `json:"stats_error,omitempty"`
 	}
 
 	output := struct {
@@ -115,6 +509,12 @@ func displayStatusJSON(sessions []*session.Session) error {
 		Sessions: make([]SessionJSON, len(sessions)),
 	}
 
+	var stats map[string]*sessionStats
+	var statsErrors map[string]error
+	if statusShowStats {
+		stats, statsErrors = fetchStats(sessions)
+	}
+
 	for i, sess := range sessions {
 		uptime := time.Since(sess.StartedAt)
 		status := "active"
@@ -129,9 +529,33 @@ func displayStatusJSON(sessions []*session.Session) error {
 			TunDevice:     sess.TunDevice,
 			TunIP:         sess.TunIP,
 			CIDRBlocks:    sess.CIDRBlocks,
-			StartedAt:     sess.StartedAt,
+			StartedAt:     displayTime(sess.StartedAt),
 			UptimeSeconds: int64(uptime.Seconds()),
 			PID:           sess.PID,
+			TunnelUp:      sess.TunnelUp,
+			HealthError:   sess.HealthError,
+			Drift:         sess.Drift,
+			Stats:         stats[sess.Name],
+		}
+		if ssm.IsSessionID(sess.SessionID) {
+			output.Sessions[i].SSMSessionID = sess.SessionID
+		}
+		if l, ok := live[sess.Name]; ok {
+			output.Sessions[i].Draining = l.Draining
+			output.Sessions[i].Standby = l.Standby
+			if c := l.Credentials; c != nil {
+				c.ExpiresAt = displayTimePtr(c.ExpiresAt)
+				c.SSOTokenExpiresAt = displayTimePtr(c.SSOTokenExpiresAt)
+				output.Sessions[i].Credentials = c
+			}
+		}
+		if s := stats[sess.Name]; s != nil {
+			for j := range s.Flows {
+				s.Flows[j].StartedAt = displayTime(s.Flows[j].StartedAt)
+			}
+		}
+		if err := statsErrors[sess.Name]; err != nil {
+			output.Sessions[i].StatsError = err.Error()
 		}
 	}
 
@@ -140,7 +564,7 @@ func displayStatusJSON(sessions []*session.Session) error {
 	return encoder.Encode(output)
 }
 
-func displayStatusTable(sessions []*session.Session) error {
+func displayStatusTable(sessions []*session.Session, live map[string]*sharedStatus) error {
 	if len(sessions) == 0 {
 		fmt.Println("No active sessions found")
 		fmt.Println()
@@ -152,8 +576,8 @@ func displayStatusTable(sessions []*session.Session) error {
 	fmt.Println()
 	fmt.Println("ACTIVE SSM PROXY SESSIONS")
 	fmt.Println()
-	fmt.Println("SESSION       INSTANCE ID          STATUS    UTUN     CIDR BLOCKS           UPTIME")
-	fmt.Println("────────────────────────────────────────────────────────────────────────────────────────")
+	fmt.Println("SESSION       INSTANCE ID          STATUS    UTUN     CIDR BLOCKS           UPTIME    STARTED")
+	fmt.Println("──────────────────────────────────────────────────────────────────────────────────────────────────────────────────")
 
 	for _, sess := range sessions {
 		uptime := formatUptime(time.Since(sess.StartedAt))
@@ -166,7 +590,7 @@ func displayStatusTable(sessions []*session.Session) error {
 
 		cidrDisplay := formatCIDRList(sess.CIDRBlocks)
 
-		fmt.Printf("%-13s %-20s %s %-6s %-8s %-21s %s\n",
+		fmt.Printf("%-13s %-20s %s %-6s %-8s %-21s %-9s %s\n",
 			truncate(sess.Name, 13),
 			sess.InstanceID,
 			statusIcon,
@@ -174,7 +598,26 @@ func displayStatusTable(sessions []*session.Session) error {
 			sess.TunDevice,
 			cidrDisplay,
 			uptime,
+			formatTime(sess.StartedAt),
 		)
+		if ssm.IsSessionID(sess.SessionID) {
+			fmt.Printf("  └─ SSM session: %s\n", sess.SessionID)
+		}
+		if l, ok := live[sess.Name]; ok && l.Draining {
+			fmt.Printf("  └─ Draining: refusing new connections, stopping when %d open one(s) are closed\n", l.Traffic.ConnsActive)
+		}
+		if l, ok := live[sess.Name]; ok && l.Standby != "" {
+			fmt.Printf("  └─ Standby tunnel: %s\n", l.Standby)
+		}
+		if l, ok := live[sess.Name]; ok && l.Credentials != nil {
+			if line := l.Credentials.describe(); line != "" {
+				fmt.Printf("  └─ %s\n", line)
+			}
+		}
+		if sess.Drift.Any() {
+			fmt.Printf("  └─ Drift: %d route(s) (%d repaired), %d DNS (%d repaired)\n",
+				sess.Drift.RoutesDrifted, sess.Drift.RoutesRepaired, sess.Drift.DNSDrifted, sess.Drift.DNSRepaired)
+		}
 	}
 	fmt.Println()
 
@@ -188,44 +631,238 @@ func displayStatusTable(sessions []*session.Session) error {
 		fmt.Println()
 	}
 
-	// Show statistics if requested
+	// Show live statistics, asked from the running sessions, if requested
 	if statusShowStats {
 		fmt.Println()
 		fmt.Println("TRAFFIC STATISTICS:")
-		fmt.Println("(Statistics collection not yet implemented)")
+		stats, failed := fetchStats(sessions)
+		for _, sess := range sessions {
+			fmt.Println()
+			if s, ok := stats[sess.Name]; ok {
+				displaySessionStats(sess.Name, s)
+				continue
+			}
+			// Sessions started before the stats method existed still
+			// report their totals
+			if l, ok := live[sess.Name]; ok {
+				displaySessionStats(sess.Name, &sessionStats{Traffic: l.Traffic})
+				continue
+			}
+			fmt.Printf("%s: statistics unavailable (%v)\n", sess.Name, failed[sess.Name])
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// displaySessionStats prints a session's totals, its traffic per CIDR block
+// and its relayed connections
+func displaySessionStats(name string, s *sessionStats) {
+	t := s.Traffic
+	fmt.Printf("%s: sent %s in %d packets, received %s in %d packets, %d connection(s) (peak %d)\n",
+		name, formatBytes(t.BytesTX), t.PacketsTX, formatBytes(t.BytesRX), t.PacketsRX, t.ConnsActive, t.ConnsPeak)
+	if t.ConnsDenied > 0 {
+		fmt.Printf("  └─ Denied by policy: %d connection(s)\n", t.ConnsDenied)
+	}
+
+	if len(s.CIDRs) > 0 {
+		fmt.Println()
+		fmt.Println("  CIDR BLOCK            SENT        RECEIVED    PACKETS (TX/RX)")
+		for _, c := range s.CIDRs {
+			fmt.Printf("  %-21s %-11s %-11s %d/%d\n",
+				c.CIDR, formatBytes(c.BytesTX), formatBytes(c.BytesRX), c.PacketsTX, c.PacketsRX)
+		}
+	}
+
+	if len(s.Destinations) > 0 {
+		fmt.Println()
+		fmt.Println("  DESTINATION                             PROTO  FLOWS     SENT        RECEIVED    PACKETS (TX/RX)")
+		for _, d := range s.Destinations {
+			fmt.Printf("  %-39s %-6s %-9d %-11s %-11s %d/%d\n",
+				truncate(d.Dst, 39), d.Protocol, d.Flows, formatBytes(d.BytesTX), formatBytes(d.BytesRX), d.PacketsTX, d.PacketsRX)
+		}
+		if s.DestinationsDropped > 0 {
+			fmt.Printf("  (%d quieter destinations no longer counted)\n", s.DestinationsDropped)
+		}
+	}
+
+	if len(s.Flows) > 0 {
+		fmt.Println()
+		fmt.Println("  PROTO  SOURCE                                  DESTINATION                             AGE       SENT        RECEIVED")
+		for i, f := range s.Flows {
+			if i == statusMaxFlows {
+				fmt.Printf("  ... and %d more (see --json)\n", len(s.Flows)-statusMaxFlows)
+				break
+			}
+			fmt.Printf("  %-6s %-39s %-39s %-9s %-11s %s\n",
+				f.Protocol, truncate(f.Src, 39), truncate(f.Dst, 39), formatUptime(time.Since(f.StartedAt)),
+				formatBytes(f.BytesTX), formatBytes(f.BytesRX))
+		}
+	}
+
+	if d := s.DNS; d != nil {
 		fmt.Println()
+		fmt.Printf("  DNS: %d answered from cache (%.0f%% hit rate), %d sent through the tunnel, %d failed\n",
+			d.CacheHits, d.CacheHitRate*100, d.CacheMisses, d.Failures)
+		fmt.Printf("  ├─ Errors: %d NXDOMAIN, %d SERVFAIL\n", d.NXDomain, d.ServFail)
+		fmt.Printf("  ├─ Fallbacks: %d for other domains, %d truncated (retried over TCP)\n", d.OtherDomain, d.Truncated)
+		if d.Denied > 0 {
+			fmt.Printf("  ├─ Refused by policy: %d\n", d.Denied)
+		}
+		fmt.Printf("  └─ Latency: p50 %.1fms, p90 %.1fms, p99 %.1fms\n", d.LatencyP50, d.LatencyP90, d.LatencyP99)
+		if len(d.Servers) > 1 {
+			fmt.Println()
+			fmt.Println("  DNS SERVER              HEALTH     QUERIES   FAILED")
+			for _, srv := range d.Servers {
+				health := "✓ healthy"
+				if !srv.Healthy {
+					health = "✗ failing"
+				}
+				fmt.Printf("  %-23s %-10s %-9d %d\n", srv.Address, health, srv.Queries, srv.Failures)
+				if srv.LastError != "" {
+					fmt.Printf("    └─ %s\n", srv.LastError)
+				}
+			}
+		}
+		if len(d.Queries) > 0 {
+			fmt.Println()
+			fmt.Println("  DOMAIN                          TYPE    QUERIES")
+			for _, q := range d.Queries {
+				fmt.Printf("  %-31s %-7s %d\n", truncate(q.Domain, 31), q.Type, q.Count)
+			}
+		}
 	}
+}
+
+// checkResult is the outcome of a session health check
+type checkResult struct {
+	Session       string   `json:"session"`
+	Healthy       bool     `json:"healthy"`
+	Status        string   `json:"status"`
+	ExitCode      int      `json:"exit_code"`
+	Message       string   `json:"message"`
+	MissingRoutes []string `json:"missing_routes,omitempty"`
+}
 
+// runStatusCheck checks a single session and exits with a code describing
+// its health so shell scripts can gate on it without parsing output
+func runStatusCheck() error {
+	// A store that cannot be read is reported as a missing session
+	sessions, _, err := listSessions()
+	if err != nil {
+		log.Debugf("Failed to list sessions: %v", err)
+	}
+	result := checkSession(sessions, statusSession)
+
+	if statusJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else if !quiet {
+		icon := "✓"
+		if !result.Healthy {
+			icon = "✗"
+		}
+		fmt.Printf("%s %s\n", icon, result.Message)
+	}
+
+	if result.ExitCode != checkExitHealthy {
+		return &exitError{code: result.ExitCode}
+	}
 	return nil
 }
 
+// checkSession determines the health of the named (or most recent) of the
+// active sessions
+func checkSession(sessions []*session.Session, name string) checkResult {
+	result := checkResult{Session: name}
+
+	var sess *session.Session
+	for _, s := range sessions {
+		if name == "" || s.Name == name {
+			sess = s
+			result.Session = sess.Name
+			break
+		}
+	}
+
+	if sess == nil {
+		result.Status = "missing"
+		result.ExitCode = checkExitMissing
+		if name == "" {
+			result.Message = "no active sessions found"
+		} else {
+			result.Message = fmt.Sprintf("session %s not found", name)
+		}
+		return result
+	}
+
+	if !isProcessRunning(sess.PID) {
+		result.Status = "stale"
+		result.ExitCode = checkExitStale
+		result.Message = fmt.Sprintf("session %s is stale (pid %d is not running)", sess.Name, sess.PID)
+		return result
+	}
+
+	if !sess.TunnelUp || healthReportStale(sess) {
+		result.Status = "tunnel-down"
+		result.ExitCode = checkExitTunnelDown
+		if !sess.TunnelUp && sess.HealthError != "" {
+			result.Message = fmt.Sprintf("session %s: tunnel is down (%s)", sess.Name, sess.HealthError)
+		} else if !sess.TunnelUp {
+			result.Message = fmt.Sprintf("session %s: tunnel is down", sess.Name)
+		} else {
+			result.Message = fmt.Sprintf("session %s: no health report since %s", sess.Name, formatTimeAgo(sess.HealthCheckedAt))
+		}
+		return result
+	}
+
+	for _, cidr := range sess.InstalledRoutes() {
+		ok, err := routing.VerifyRouteInterface(cidr, sess.TunDevice)
+		if err != nil || !ok {
+			result.MissingRoutes = append(result.MissingRoutes, cidr)
+		}
+	}
+	if len(result.MissingRoutes) > 0 {
+		result.Status = "routes-missing"
+		result.ExitCode = checkExitRoutesMissing
+		result.Message = fmt.Sprintf("session %s: routes missing for %s", sess.Name, strings.Join(result.MissingRoutes, ", "))
+		return result
+	}
+
+	result.Healthy = true
+	result.Status = "healthy"
+	result.ExitCode = checkExitHealthy
+	result.Message = fmt.Sprintf("session %s is healthy", sess.Name)
+	return result
+}
+
+// displayRoutes prints the system routes that point at one of our TUN
+// devices
 func displayRoutes() error {
-	cmd := exec.Command("netstat", "-rn")
-	output, err := cmd.Output()
+	routes, err := routing.SystemRoutes()
 	if err != nil {
 		return err
 	}
 
-	lines := strings.Split(string(output), "\n")
 	found := false
-
-	for _, line := range lines {
-		if strings.Contains(line, "utun") {
-			if !found {
-				fmt.Println("DESTINATION        GATEWAY          FLAGS    INTERFACE")
-				fmt.Println("─────────────────────────────────────────────────────")
-				found = true
-			}
-			// Clean up and display the route line
-			fields := strings.Fields(line)
-			if len(fields) >= 4 {
-				fmt.Printf("%-18s %-16s %-8s %s\n", fields[0], fields[1], fields[2], fields[len(fields)-1])
-			}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Interface, tunnel.DeviceNamePrefix) {
+			continue
+		}
+		if !found {
+			fmt.Println("DESTINATION        GATEWAY          INTERFACE")
+			fmt.Println("─────────────────────────────────────────────")
+			found = true
 		}
+		fmt.Printf("%-18s %-16s %s\n", route.Destination, route.Gateway, route.Interface)
 	}
 
 	if !found {
-		fmt.Println("No utun routes found")
+		fmt.Printf("No %s routes found\n", tunnel.DeviceNamePrefix)
 	}
 
 	return nil
@@ -278,6 +915,6 @@ func isProcessRunning(pid int) bool {
 	}
 
 	// Send signal 0 to check if process exists
-	err = process.Signal(os.Signal(nil))
-	return err == nil
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
 }
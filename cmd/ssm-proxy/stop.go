@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"syscall"
+	"time"
 
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
 	"github.com/sbkg0002/ssm-proxy/internal/session"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
 	"github.com/spf13/cobra"
 )
 
@@ -14,18 +19,27 @@ var (
 	stopSessionName string
 	stopAll         bool
 	forceStop       bool
+	stopPIDFile     string
+	stopDrain       bool
+	stopDrainWait   time.Duration
 )
 
+// stopTimeout is how long a session asked to stop over its control socket
+// gets to clean up before it is sent SIGTERM
+const stopTimeout = 15 * time.Second
+
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop running proxy session",
 	Long: `Stop a running proxy session and clean up routes and TUN device.
 
-This command will:
-  • Terminate the SSM session
-  • Remove routing table entries
-  • Close the TUN device
-  • Clean up session state
+The session is asked to shut down over its control socket, and cleans up
+itself: it terminates the SSM session, removes its routes and closes the
+TUN device. Sessions that cannot be asked are sent SIGTERM, and the
+routes they leave through their TUN device are removed by this command.
+
+With --drain the session first stops relaying new connections and shuts
+down once the open ones are closed (or --drain-timeout expires).
 
 Examples:
   # Stop default session
@@ -37,11 +51,17 @@ Examples:
   # Stop all running sessions
   sudo ssm-proxy stop --all
 
+  # Let open connections finish first, for up to 10 minutes
+  sudo ssm-proxy stop --drain --drain-timeout 10m
+
   # Force stop without graceful shutdown
-  sudo ssm-proxy stop --force`,
+  sudo ssm-proxy stop --force
+
+  # Stop a proxy started with 'start --daemon --pid-file ...'
+  sudo ssm-proxy stop --pid-file /run/ssm-proxy-prod.pid`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		// Check for root privileges
-		requireRoot()
+		// Check for root privileges, or the privileged helper
+		requireRootOrHelper()
 		return nil
 	},
 	RunE: runStop,
@@ -53,9 +73,19 @@ func init() {
 	stopCmd.Flags().StringVar(&stopSessionName, "session-name", "", "Stop specific session by name")
 	stopCmd.Flags().BoolVar(&stopAll, "all", false, "Stop all running sessions")
 	stopCmd.Flags().BoolVar(&forceStop, "force", false, "Force stop without graceful shutdown")
+	stopCmd.Flags().StringVar(&stopPIDFile, "pid-file", "", "Stop the background process of this PID file (from 'start --daemon')")
+	stopCmd.Flags().BoolVar(&stopDrain, "drain", false, "Stop once the open connections are closed, refusing new ones meanwhile")
+	stopCmd.Flags().DurationVar(&stopDrainWait, "drain-timeout", defaultDrainTimeout, "Longest time to wait for the connections to close with --drain")
 }
 
 func runStop(cmd *cobra.Command, args []string) error {
+	if stopDrain && forceStop {
+		return fmt.Errorf("cannot use --drain with --force")
+	}
+	if stopPIDFile != "" {
+		return stopDaemon(stopPIDFile, forceStop)
+	}
+
 	sessionMgr := session.NewManager()
 
 	// Get sessions to stop
@@ -83,6 +113,10 @@ func runStop(cmd *cobra.Command, args []string) error {
 				return fmt.Errorf("failed to list sessions: %w", err)
 			}
 			if len(sessions) == 0 {
+				// A daemon still starting up has no session yet
+				if pid, err := readPIDFile(defaultPIDFile); err == nil && isProcessRunning(pid) {
+					return stopDaemon(defaultPIDFile, forceStop)
+				}
 				fmt.Println("No active sessions found")
 				return nil
 			}
@@ -100,15 +134,23 @@ func runStop(cmd *cobra.Command, args []string) error {
 	// Stop each session
 	for _, sess := range sessionsToStop {
 		fmt.Printf("\n✓ Stopping session: %s\n", sess.Name)
-		if err := stopSession(sess, forceStop); err != nil {
-			log.Errorf("Failed to stop session %s: %v", sess.Name, err)
-			continue
+		drained := stopDrain && drainSession(sess, stopDrainWait)
+		if !drained {
+			if err := stopSession(sess, forceStop); err != nil {
+				log.Errorf("Failed to stop session %s: %v", sess.Name, err)
+				continue
+			}
 		}
 
 		// Remove session state
 		if err := sessionMgr.Remove(sess.Name); err != nil {
 			log.Warnf("Failed to remove session state: %v", err)
 		}
+
+		// A killed daemon cannot remove its PID file itself
+		if pid, err := readPIDFile(defaultPIDFile); forceStop && err == nil && pid == sess.PID {
+			os.Remove(defaultPIDFile)
+		}
 	}
 
 	fmt.Println("\n✓ All sessions stopped successfully")
@@ -116,8 +158,25 @@ func runStop(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// stopSession stops a session's process: over its control socket, waiting
+// for it to clean up, or else with a signal (SIGKILL with force), removing
+// the routes it leaves
 func stopSession(sess *session.Session, force bool) error {
+	if !force && sess.IsRunning() {
+		err := control.Call(control.SocketPath(sess.Name), control.MethodStop, "", nil, nil)
+		switch {
+		case err != nil:
+			log.Debugf("Failed to stop session %s via its control socket: %v", sess.Name, err)
+		case waitForExit(sess, stopTimeout):
+			fmt.Println("  └─ Stopped via control socket (routes removed by the session)")
+			return nil
+		default:
+			log.Warnf("Session %s did not stop within %s, sending SIGTERM", sess.Name, stopTimeout)
+		}
+	}
+
 	// Step 1: Send signal to process
+	running := sess.IsRunning()
 	if sess.PID > 0 {
 		process, err := os.FindProcess(sess.PID)
 		if err == nil {
@@ -135,109 +194,136 @@ func stopSession(sess *session.Session, force bool) error {
 		}
 	}
 
-	// Step 2: Clean up routes (in case process didn't clean up)
-	fmt.Println("  ├─ Removing routes...")
-	for _, cidr := range sess.CIDRBlocks {
-		if err := removeRoute(cidr); err != nil {
-			log.Warnf("Failed to remove route %s: %v", cidr, err)
-		} else {
-			fmt.Printf("  │  └─ %s\n", cidr)
-		}
+	// Step 2: Clean up the routes the process left (a terminated one
+	// removes them itself, given the time)
+	if running && !force && waitForExit(sess, stopTimeout) {
+		fmt.Println("  ├─ Process exited")
 	}
+	removeLeftoverRoutes(sess)
 
-	// Step 3: Terminate SSM session
-	fmt.Println("  └─ SSM session terminated")
+	// Step 3: Terminate SSM session, which a killed or dead process cannot
+	// do itself
+	if running && !force {
+		fmt.Println("  └─ SSM session terminated by the session")
+	} else {
+		terminateSSMSession(sess)
+	}
 
 	return nil
 }
 
-func removeRoute(cidr string) error {
-	// Parse CIDR to get network and mask
-	network, mask, err := parseCIDRForRoute(cidr)
-	if err != nil {
-		return err
+// terminateSSMSession ends a session's SSM session in AWS, so that it does
+// not stay active (and count against the limits) until it times out
+func terminateSSMSession(sess *session.Session) {
+	if !ssm.IsSessionID(sess.SessionID) {
+		fmt.Println("  └─ SSM session unknown, left to time out")
+		return
 	}
 
-	// Execute: route delete -net <network> -netmask <mask>
-	cmd := exec.Command("route", "delete", "-net", network, "-netmask", mask)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Ignore "not in table" errors
-		if len(output) > 0 && contains(string(output), "not in table") {
-			return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// In the region and account the session was started in
+	account := defaultAWSAccount()
+	if sess.Region != "" {
+		account.Region = sess.Region
+	}
+	if sess.RoleARN != "" {
+		account.RoleARN = sess.RoleARN
+	}
+	awsClient, err := account.client(ctx)
+	if err == nil {
+		var client *ssm.Client
+		if client, err = ssm.NewClient(ctx, awsClient, sess.InstanceID); err == nil {
+			err = client.TerminateSession(ctx, sess.SessionID)
 		}
-		return fmt.Errorf("%s: %w", string(output), err)
 	}
-
-	return nil
+	if err != nil {
+		log.Warnf("Failed to terminate SSM session: %v", err)
+		fmt.Printf("  └─ ⚠️  SSM session %s not terminated: %v\n", sess.SessionID, err)
+		return
+	}
+	fmt.Printf("  └─ SSM session %s terminated\n", sess.SessionID)
 }
 
-func parseCIDRForRoute(cidr string) (network, mask string, err error) {
-	// Simple CIDR to netmask conversion
-	parts := splitString(cidr, "/")
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid CIDR format: %s", cidr)
-	}
-
-	network = parts[0]
-
-	// Convert CIDR prefix to netmask
-	switch parts[1] {
-	case "8":
-		mask = "255.0.0.0"
-	case "12":
-		mask = "255.240.0.0"
-	case "16":
-		mask = "255.255.0.0"
-	case "20":
-		mask = "255.255.240.0"
-	case "24":
-		mask = "255.255.255.0"
-	case "28":
-		mask = "255.255.255.240"
-	case "30":
-		mask = "255.255.255.252"
-	case "32":
-		mask = "255.255.255.255"
-	default:
-		// Calculate mask from prefix length (for other values)
-		mask = cidrPrefixToMask(parts[1])
-	}
-
-	return network, mask, nil
+// drainSession asks a session to stop once its connections are closed and
+// waits up to timeout (and stopTimeout for its cleanup) for it to exit,
+// reporting whether it did. A session that cannot be asked or is still
+// running is left to stopSession.
+func drainSession(sess *session.Session, timeout time.Duration) bool {
+	if !sess.IsRunning() {
+		return false
+	}
+
+	var result drainResult
+	params := drainParams{Timeout: timeout.String()}
+	if err := control.Call(control.SocketPath(sess.Name), control.MethodDrain, "", params, &result); err != nil {
+		fmt.Printf("  ├─ ⚠️  Cannot drain the session, stopping it now: %v\n", err)
+		return false
+	}
+	fmt.Printf("  ├─ Draining %d connection(s) (at most %s)...\n", result.Connections, timeout)
+	if !waitForExit(sess, timeout+stopTimeout) {
+		return false
+	}
+	fmt.Println("  └─ Stopped (routes removed by the session)")
+	return true
 }
 
-func cidrPrefixToMask(prefix string) string {
-	// This is a simplified version - a full implementation would
-	// calculate the mask properly for any prefix length
-	return "255.255.255.0" // Default fallback
+// waitForExit waits up to timeout for the session's process to exit and
+// reports whether it did
+func waitForExit(sess *session.Session, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for sess.IsRunning() && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return !sess.IsRunning()
 }
 
-func splitString(s, sep string) []string {
-	var result []string
-	current := ""
-	for i := 0; i < len(s); i++ {
-		if s[i:i+len(sep)] == sep {
-			result = append(result, current)
-			current = ""
-			i += len(sep) - 1
-		} else {
-			current += string(s[i])
+// removeLeftoverRoutes removes the session's routes that are still
+// installed through its TUN device, leaving alone routes for the same CIDR
+// blocks that have since been set up through another device
+func removeLeftoverRoutes(sess *session.Session) {
+	installed := make(map[string]bool)
+	for _, cidr := range sess.InstalledRoutes() {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			installed[network.String()] = true
 		}
 	}
-	result = append(result, current)
-	return result
-}
+	if len(installed) == 0 || sess.TunDevice == "" {
+		return
+	}
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && findSubstring(s, substr)
-}
+	routes, err := routing.SystemRoutes()
+	if err != nil {
+		log.Warnf("Failed to list routes: %v", err)
+		fmt.Printf("  ├─ ⚠️  Routes not checked: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 
-func findSubstring(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+	var leftovers []string
+	for _, route := range routes {
+		if route.Destination == nil || route.Interface != sess.TunDevice {
+			continue
+		}
+		if cidr := route.Destination.String(); installed[cidr] {
+			leftovers = append(leftovers, cidr)
+		}
+	}
+	if len(leftovers) == 0 {
+		fmt.Println("  ├─ No routes left to remove")
+		return
+	}
+
+	fmt.Println("  ├─ Removing leftover routes...")
+	for _, cidr := range leftovers {
+		if err := routing.DeleteSystemRoute(ctx, cidr, sess.TunDevice); err != nil {
+			log.Warnf("Failed to remove route %s: %v", cidr, err)
+			fmt.Printf("  │  └─ ⚠️  %s: %v\n", cidr, err)
+		} else {
+			fmt.Printf("  │  └─ %s\n", cidr)
 		}
 	}
-	return false
 }
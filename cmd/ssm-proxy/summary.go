@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+)
+
+// Output formats for the shutdown summary (start --output)
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// shutdownSummary describes a stopped session: how long it ran, what it
+// carried, and which cleanup steps failed and need manual attention
+type shutdownSummary struct {
+	Session         string           `json:"session"`
+	Reason          string           `json:"reason"`
+	StartedAt       time.Time        `json:"started_at"`
+	StoppedAt       time.Time        `json:"stopped_at"`
+	DurationSeconds int64            `json:"duration_seconds"`
+	BytesTX         uint64           `json:"bytes_tx"`
+	BytesRX         uint64           `json:"bytes_rx"`
+	PacketsTX       uint64           `json:"packets_tx"`
+	PacketsRX       uint64           `json:"packets_rx"`
+	PeakConnections uint64           `json:"peak_connections"`
+	Reconnects      int64            `json:"reconnects"`
+	ResumedConns    uint64           `json:"resumed_connections"`
+	BrokenConns     uint64           `json:"reset_connections"`
+	DeniedConns     uint64           `json:"denied_connections"`
+	CleanupFailures []cleanupFailure `json:"cleanup_failures"`
+
+	// stopping is set once the session is up and shutting down; nothing is
+	// printed for a failed start
+	stopping bool
+}
+
+// cleanupFailure is a shutdown step that did not complete
+type cleanupFailure struct {
+	Step  string `json:"step"`
+	Error string `json:"error"`
+}
+
+// begin records the end of the session and its final traffic counters
+func (s *shutdownSummary) begin(reason string, startedAt time.Time, stats *forwarder.Stats, reconnects int64) {
+	s.stopping = true
+	s.Reason = reason
+	s.StartedAt = displayTime(startedAt)
+	s.StoppedAt = displayTime(time.Now())
+	s.DurationSeconds = int64(s.StoppedAt.Sub(s.StartedAt).Seconds())
+	s.BytesTX = stats.BytesTX
+	s.BytesRX = stats.BytesRX
+	s.PacketsTX = stats.PacketsTX
+	s.PacketsRX = stats.PacketsRX
+	s.PeakConnections = stats.ConnsPeak
+	s.Reconnects = reconnects
+	s.ResumedConns = stats.ConnsResumed
+	s.BrokenConns = stats.ConnsBroken
+	s.DeniedConns = stats.ConnsDenied
+}
+
+// cleanupFailed records a failed cleanup step
+func (s *shutdownSummary) cleanupFailed(step string, err error) {
+	log.Warnf("Failed to %s: %v", step, err)
+	s.CleanupFailures = append(s.CleanupFailures, cleanupFailure{Step: step, Error: err.Error()})
+}
+
+// print writes the summary in the given output format. The JSON form is a
+// single line, so it can be picked out of captured output.
+func (s *shutdownSummary) print(format string) {
+	if !s.stopping {
+		return
+	}
+
+	if format == outputJSON {
+		if s.CleanupFailures == nil {
+			s.CleanupFailures = []cleanupFailure{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(s); err != nil {
+			log.Warnf("Failed to write session summary: %v", err)
+		}
+		return
+	}
+
+	duration := time.Duration(s.DurationSeconds) * time.Second
+	fmt.Printf("\n✓ Session summary (%s)\n", s.Session)
+	fmt.Printf("  ├─ Duration: %s (%s)\n", duration, s.Reason)
+	fmt.Printf("  ├─ Started: %s, stopped: %s\n", formatTime(s.StartedAt), formatTime(s.StoppedAt))
+	fmt.Printf("  ├─ Sent: %s in %d packets\n", formatBytes(s.BytesTX), s.PacketsTX)
+	fmt.Printf("  ├─ Received: %s in %d packets\n", formatBytes(s.BytesRX), s.PacketsRX)
+	fmt.Printf("  ├─ Peak connections: %d\n", s.PeakConnections)
+	if s.ResumedConns > 0 || s.BrokenConns > 0 {
+		fmt.Printf("  ├─ Reconnects: %d (%d connections resumed, %d reset)\n", s.Reconnects, s.ResumedConns, s.BrokenConns)
+	} else {
+		fmt.Printf("  ├─ Reconnects: %d\n", s.Reconnects)
+	}
+	if s.DeniedConns > 0 {
+		fmt.Printf("  ├─ Denied by policy: %d connection(s)\n", s.DeniedConns)
+	}
+	if len(s.CleanupFailures) == 0 {
+		fmt.Println("  └─ Cleanup: complete")
+		return
+	}
+
+	fmt.Println("  └─ ⚠️  Cleanup steps that need manual attention:")
+	for i, f := range s.CleanupFailures {
+		prefix := "├─"
+		if i == len(s.CleanupFailures)-1 {
+			prefix = "└─"
+		}
+		fmt.Printf("       %s %s: %s\n", prefix, f.Step, f.Error)
+	}
+}
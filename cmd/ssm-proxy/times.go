@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// useUTC shows and logs times in UTC instead of local time (--utc), e.g.
+// for correlating incidents across timezones
+var useUTC bool
+
+// displayTime returns t as shown to the user: whole seconds, in UTC with
+// --utc and local time otherwise. JSON encodes it as RFC 3339.
+func displayTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	t = t.Truncate(time.Second)
+	if useUTC {
+		return t.UTC()
+	}
+	return t.Local()
+}
+
+// displayTimePtr is displayTime for optional times
+func displayTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	shown := displayTime(*t)
+	return &shown
+}
+
+// formatTime formats t as an RFC 3339 timestamp, e.g.
+// "2025-01-15T14:04:05+01:00"
+func formatTime(t time.Time) string {
+	return displayTime(t).Format(time.RFC3339)
+}
+
+// formatTimeAgo formats t as an RFC 3339 timestamp followed by how long
+// ago (or in how long) it is, e.g. "2025-01-15T14:04:05Z (3m ago)"
+func formatTimeAgo(t time.Time) string {
+	if d := time.Until(t); d > 0 {
+		return formatTime(t) + " (in " + formatUptime(d) + ")"
+	}
+	return formatTime(t) + " (" + formatUptime(time.Since(t)) + " ago)"
+}
+
+// logFormatter formats log entries with RFC 3339 timestamps, in UTC with
+// --utc
+type logFormatter struct {
+	logrus.TextFormatter
+}
+
+// Format renders a log entry
+func (f *logFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if useUTC {
+		utc := *entry
+		utc.Time = entry.Time.UTC()
+		return f.TextFormatter.Format(&utc)
+	}
+	return f.TextFormatter.Format(entry)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/nat"
+	"github.com/spf13/viper"
+)
+
+// tunnelSpec is one tunnel managed by start: an instance, the CIDR blocks
+// routed through it, and its own TUN addresses and session
+type tunnelSpec struct {
+	Name        string
+	InstanceID  string
+	InstanceTag string
+	Account     awsAccount // region and role of the instance
+	CIDRs       []string
+	NAT         *nat.Table
+
+	LocalIP   string
+	LocalIPv6 string
+	SOCKSPort int // 0 for any free port
+
+	// SessionName is empty for a generated name
+	SessionName string
+
+	// DNS is set on the tunnel that serves --dns-resolver (and configures
+	// the system resolver); Health on the one checked via --health-*
+	DNS    bool
+	Health bool
+}
+
+// tunnelConfig is an entry of the config file's 'tunnels:' section
+type tunnelConfig struct {
+	Name        string   `mapstructure:"name"`
+	InstanceID  string   `mapstructure:"instance_id"`
+	InstanceTag string   `mapstructure:"instance_tag"`
+	CIDR        []string `mapstructure:"cidr"`
+	Region      string   `mapstructure:"region"`   // default --region
+	RoleARN     string   `mapstructure:"role_arn"` // default --role-arn
+}
+
+// parseTunnelFlag parses a --tunnel value, INSTANCE:CIDR[,CIDR...], where
+// INSTANCE is an instance ID or a Key=Value tag. With --auto-cidr the CIDR
+// blocks may be left out. region=REGION and role=ROLE_ARN among the CIDR
+// blocks set the region and role of the instance.
+func parseTunnelFlag(value string) (tunnelConfig, error) {
+	// ECS targets (ecs:CLUSTER/TASK) have a colon of their own
+	instance, cidrs, ok := strings.Cut(strings.TrimPrefix(value, "ecs:"), ":")
+	if strings.HasPrefix(value, "ecs:") {
+		instance = "ecs:" + instance
+	}
+	if !ok && autoCIDR {
+		ok, cidrs = true, ""
+	} else if cidrs == "" {
+		ok = false
+	}
+	if !ok || instance == "" {
+		return tunnelConfig{}, fmt.Errorf("invalid --tunnel %q (expected INSTANCE:CIDR[,CIDR...], INSTANCE being an instance ID or Key=Value tag)", value)
+	}
+
+	cfg := tunnelConfig{Name: instance}
+	if cidrs != "" {
+		for _, item := range strings.Split(cidrs, ",") {
+			switch key, val, _ := strings.Cut(item, "="); key {
+			case "region":
+				cfg.Region = val
+			case "role":
+				cfg.RoleARN = val
+			default:
+				cfg.CIDR = append(cfg.CIDR, item)
+			}
+		}
+	}
+	if key, val, isTag := strings.Cut(instance, "="); isTag {
+		cfg.InstanceTag = instance
+		cfg.Name = val
+		if key == "" || val == "" {
+			return tunnelConfig{}, fmt.Errorf("invalid --tunnel %q: tag must be Key=Value", value)
+		}
+	} else {
+		cfg.InstanceID = instance
+		if aws.TargetKind(instance) == aws.TargetECS {
+			cfg.Name = instance[strings.LastIndex(instance, "/")+1:]
+		}
+	}
+	return cfg, nil
+}
+
+// buildTunnelSpecs returns the tunnels to start: one per --tunnel, one per
+// entry of the config file's 'tunnels:' section if neither --tunnel nor an
+// instance flag is given, or else the single tunnel of --instance-id /
+// --instance-tag / --from-prewarm / --launch-bastion and --cidr. Tunnels after the first get
+// the next TUN subnets after --local-ip and --local-ipv6, and any free
+// SOCKS5 port.
+func buildTunnelSpecs(tunnelFlags []string) ([]*tunnelSpec, error) {
+	var configs []tunnelConfig
+	switch {
+	case len(tunnelFlags) > 0:
+		for _, value := range tunnelFlags {
+			cfg, err := parseTunnelFlag(value)
+			if err != nil {
+				return nil, err
+			}
+			configs = append(configs, cfg)
+		}
+	case instanceID == "" && instanceTag == "" && fromPrewarm == "" && !launchBastion && viper.IsSet("tunnels"):
+		if err := viper.UnmarshalKey("tunnels", &configs); err != nil {
+			return nil, fmt.Errorf("invalid 'tunnels' section in config file: %w", err)
+		}
+		for i, cfg := range configs {
+			if (cfg.InstanceID == "") == (cfg.InstanceTag == "") {
+				return nil, fmt.Errorf("tunnel %d in config file needs exactly one of instance_id and instance_tag", i+1)
+			}
+			if len(cfg.CIDR) == 0 && !autoCIDR {
+				return nil, fmt.Errorf("tunnel %d in config file has no cidr", i+1)
+			}
+		}
+	default:
+		// A single tunnel; it may only have --nat-map ranges
+		spec := &tunnelSpec{
+			Name:        sessionName,
+			InstanceID:  instanceID,
+			InstanceTag: instanceTag,
+			Account:     defaultAWSAccount(),
+			NAT:         natTable,
+			LocalIP:     localIP,
+			LocalIPv6:   localIPv6,
+			SOCKSPort:   1080,
+			SessionName: sessionName,
+			DNS:         true,
+			Health:      true,
+		}
+		cidrs := cidrBlocks
+		if fullTunnel {
+			cidrs = append(slices.Clone(cidrs), fullTunnelCIDRs...)
+		}
+		if fakeIPPool != nil {
+			cidrs = append(slices.Clone(cidrs), fakeIPPool.Network().String())
+		}
+		cidrs, err := prepareCIDRs(cidrs, natTable)
+		if err != nil {
+			return nil, err
+		}
+		spec.CIDRs = cidrs
+		return []*tunnelSpec{spec}, nil
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no tunnels configured")
+	}
+	if fullTunnel {
+		return nil, fmt.Errorf("--full-tunnel routes everything through one tunnel and cannot be combined with --tunnel or the config file's tunnels")
+	}
+
+	var specs []*tunnelSpec
+	names := make(map[string]bool)
+	for i, cfg := range configs {
+		cidrs, err := prepareCIDRs(cfg.CIDR, nil)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %s: %w", cfg.Name, err)
+		}
+		ip, err := offsetPrefix(localIP, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --local-ip %s: %w", localIP, err)
+		}
+		ipv6, err := offsetPrefix(localIPv6, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --local-ipv6 %s: %w", localIPv6, err)
+		}
+
+		spec := &tunnelSpec{
+			Name:        cfg.Name,
+			InstanceID:  cfg.InstanceID,
+			InstanceTag: cfg.InstanceTag,
+			Account:     defaultAWSAccount(),
+			CIDRs:       cidrs,
+			LocalIP:     ip,
+			LocalIPv6:   ipv6,
+		}
+		if cfg.Region != "" {
+			spec.Account.Region = cfg.Region
+		}
+		if cfg.RoleARN != "" {
+			spec.Account.RoleARN = cfg.RoleARN
+		}
+		if i == 0 {
+			spec.SOCKSPort = 1080
+		}
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("tunnel-%d", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate tunnel %s (give all its CIDR blocks in one tunnel)", spec.Name)
+		}
+		names[spec.Name] = true
+		if sessionName != "" {
+			spec.SessionName = sessionName + "-" + spec.Name
+		}
+		specs = append(specs, spec)
+	}
+
+	if err := checkTunnelOverlaps(specs); err != nil {
+		return nil, err
+	}
+
+	// DNS and health checks go through the tunnel that routes their address
+	ownerOf(specs, dnsResolver).DNS = true
+	ownerOf(specs, healthEndpoint).Health = true
+	return specs, nil
+}
+
+// prepareCIDRs expands @group references, adds NAT-mapped local ranges
+// (routed like any other CIDR block) and validates the result, which may
+// only be empty with --auto-cidr
+func prepareCIDRs(cidrs []string, table *nat.Table) ([]string, error) {
+	expanded, err := expandCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if table != nil {
+		for _, local := range table.LocalCIDRs() {
+			if !slices.Contains(expanded, local) {
+				expanded = append(expanded, local)
+			}
+		}
+	}
+	if len(expanded) == 0 && !autoCIDR {
+		return nil, fmt.Errorf("at least one --cidr block (or --nat-map, --route-domain, --auto-cidr or --full-tunnel) is required")
+	}
+	for _, cidr := range expanded {
+		if err := validateCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %s: %w", cidr, err)
+		}
+	}
+	return expanded, nil
+}
+
+// checkTunnelOverlaps rejects tunnels whose CIDR blocks overlap, since a
+// destination can only be routed through one of them
+func checkTunnelOverlaps(specs []*tunnelSpec) error {
+	for i, a := range specs {
+		for _, b := range specs[i+1:] {
+			for _, ca := range a.CIDRs {
+				pa := netip.MustParsePrefix(ca).Masked()
+				for _, cb := range b.CIDRs {
+					pb := netip.MustParsePrefix(cb).Masked()
+					if pa.Overlaps(pb) {
+						return fmt.Errorf("CIDR %s of tunnel %s overlaps %s of tunnel %s (use --nat-map in separate sessions for overlapping networks)",
+							ca, a.Name, cb, b.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ownerOf returns the tunnel routing addr (host or host:port), or the first
+// tunnel if none does or addr is a name
+func ownerOf(specs []*tunnelSpec, addr string) *tunnelSpec {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		for _, spec := range specs {
+			for _, cidr := range spec.CIDRs {
+				if netip.MustParsePrefix(cidr).Contains(ip.Unmap()) {
+					return spec
+				}
+			}
+		}
+	}
+	return specs[0]
+}
+
+// offsetPrefix returns the address of cidr moved n subnets of its size
+// further, e.g. 169.254.169.1/30 offset 1 is 169.254.169.5/30
+func offsetPrefix(cidr string, n int) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return cidr, nil
+	}
+
+	addr := prefix.Addr()
+	value := new(big.Int).SetBytes(addr.AsSlice())
+	value.Add(value, new(big.Int).Lsh(big.NewInt(int64(n)), uint(addr.BitLen()-prefix.Bits())))
+	if value.BitLen() > addr.BitLen() {
+		return "", fmt.Errorf("no room for %d more subnets", n)
+	}
+
+	next, _ := netip.AddrFromSlice(value.FillBytes(make([]byte, addr.BitLen()/8)))
+	return netip.PrefixFrom(next, prefix.Bits()).String(), nil
+}
+
+// tunnelGroup is what the tunnels of one start share
+type tunnelGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc // stops all tunnels
+	multi  bool
+
+	// timedOut is set when the headless startup deadline passed
+	timedOut     *atomic.Bool
+	stopWatchdog func()
+
+	// output is held by a tunnel printing its startup or shutdown steps
+	output sync.Mutex
+
+	mu       sync.Mutex
+	starting int
+	devices  []string // TUN devices of the tunnels
+	dropErr  error    // why --drop-privileges failed
+}
+
+// newTunnelGroup creates the group of n tunnels, stopping the headless
+// startup watchdog once all of them have started
+func newTunnelGroup(ctx context.Context, cancel context.CancelFunc, n int, stopWatchdog func(), timedOut *atomic.Bool) *tunnelGroup {
+	return &tunnelGroup{
+		ctx:          ctx,
+		cancel:       cancel,
+		multi:        n > 1,
+		timedOut:     timedOut,
+		stopWatchdog: stopWatchdog,
+		starting:     n,
+	}
+}
+
+// started marks the startup of one tunnel complete (or failed). It is
+// called by each tunnel, once; the caller must hold the output.
+func (g *tunnelGroup) started() {
+	g.mu.Lock()
+	g.starting--
+	last := g.starting == 0
+	g.mu.Unlock()
+	if !last {
+		return
+	}
+
+	g.stopWatchdog()
+	if isDaemonChild() && g.ctx.Err() == nil {
+		daemonReady()
+	}
+	// After the PID file is written, which needs root
+	if dropPrivileges && g.ctx.Err() == nil {
+		g.mu.Lock()
+		devices := g.devices
+		g.mu.Unlock()
+		if err := dropToUser(devices); err != nil {
+			g.mu.Lock()
+			g.dropErr = fmt.Errorf("failed to drop privileges: %w", err)
+			g.mu.Unlock()
+			g.cancel()
+		}
+	}
+	if g.multi && !headless && g.ctx.Err() == nil {
+		fmt.Println("\nPress Ctrl+C to stop and clean up...")
+	}
+}
+
+// addDevice records the TUN device of a tunnel
+func (g *tunnelGroup) addDevice(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.devices = append(g.devices, name)
+}
+
+// err returns why the group failed after startup, nil if it did not
+func (g *tunnelGroup) err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.dropErr
+}
+
+// sequencer returns a tunnel's handle on the group's output
+func (g *tunnelGroup) sequencer() *outputSequencer {
+	return &outputSequencer{shared: &g.output}
+}
+
+// outputSequencer keeps the startup and shutdown output of concurrent
+// tunnels apart: a tunnel holds it while it prints a sequence of steps
+type outputSequencer struct {
+	shared *sync.Mutex
+	held   bool
+}
+
+// enter waits until no other tunnel is printing
+func (o *outputSequencer) enter() {
+	if !o.held {
+		o.shared.Lock()
+		o.held = true
+	}
+}
+
+// leave lets other tunnels print
+func (o *outputSequencer) leave() {
+	if o.held {
+		o.held = false
+		o.shared.Unlock()
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+)
+
+const (
+	// wireGuardOverhead is what WireGuard adds to a packet: the outer IPv4
+	// and UDP headers and its own header and authentication tag
+	wireGuardOverhead = 80
+
+	// wireGuardKeepalive makes the client send something at least this
+	// often, so the handshake is kept fresh through SSM reconnects
+	wireGuardKeepalive = 25 * time.Second
+
+	// wireGuardHandshakeTimeout is how long startup waits for the first
+	// handshake with the instance
+	wireGuardHandshakeTimeout = 20 * time.Second
+
+	// wireGuardInstancePrefix is the name prefix of the WireGuard
+	// interfaces on instances, followed by a random suffix
+	wireGuardInstancePrefix = "ssmwg"
+
+	// wireGuardRelayPort is the source port of the client's datagrams on
+	// the agent's TUN subnet
+	wireGuardRelayPort = 51820
+)
+
+// wireGuardTunnel is the WireGuard side of the wireguard transport: the
+// client's WireGuard device, whose endpoint is the relay that carries its
+// datagrams to the instance's WireGuard interface through the agent
+type wireGuardTunnel struct {
+	device *tunnel.WireGuardDevice
+	relay  *forwarder.UDPRelay
+
+	// instanceDevice is the name of the WireGuard interface on the
+	// instance, clientIP the client's address in it
+	instanceDevice string
+	clientIP       netip.Addr
+}
+
+// wireGuardInstance is what the setup script reports about the instance's
+// WireGuard interface
+type wireGuardInstance struct {
+	publicKey  string
+	listenPort uint16
+}
+
+// setupWireGuard sets up WireGuard between the client and the instance:
+// a key pair is generated for each end, the instance's by the instance,
+// and the public keys are exchanged through Run Command. The instance's
+// interface gets the peer address of spec.LocalIP and masquerades the
+// client's traffic. The relay sends over session.
+func setupWireGuard(ctx context.Context, awsClient *aws.Client, instanceID string, spec *tunnelSpec, session *ssm.Session) (*wireGuardTunnel, error) {
+	prefix, err := netip.ParsePrefix(spec.LocalIP)
+	if err != nil || !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("invalid --local-ip %s (expected x.x.x.x/y)", spec.LocalIP)
+	}
+	instanceIP, err := tunnel.PeerAddress(spec.LocalIP)
+	if err != nil {
+		return nil, err
+	}
+	agentPeerAddr, ok := agentPeer(defaultAgentTUNAddr)
+	if !ok {
+		return nil, fmt.Errorf("no peer address on the agent's TUN subnet %s", defaultAgentTUNAddr)
+	}
+
+	privateKey, publicKey, err := tunnel.GenerateWireGuardKey()
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 2)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to name the instance's WireGuard interface: %w", err)
+	}
+	w := &wireGuardTunnel{
+		instanceDevice: wireGuardInstancePrefix + hex.EncodeToString(suffix),
+		clientIP:       prefix.Addr(),
+	}
+
+	// The bits of the subnet are the client's, the address the peer's
+	instancePrefix := fmt.Sprintf("%s/%d", instanceIP, prefix.Bits())
+	fmt.Printf("  ├─ Setting up %s on %s (Run Command)...\n", w.instanceDevice, instanceID)
+	result, err := awsClient.RunShellScript(ctx, instanceID,
+		wireGuardSetupScript(w.instanceDevice, publicKey, w.clientIP, instancePrefix, mtu-wireGuardOverhead), agentCommandTimeout)
+	if err != nil {
+		w.teardown(awsClient, instanceID)
+		return nil, fmt.Errorf("failed to set up WireGuard on %s: %w", instanceID, err)
+	}
+	instance, err := parseWireGuardInstance(result.Stdout)
+	if err != nil {
+		w.teardown(awsClient, instanceID)
+		return nil, err
+	}
+	fmt.Printf("  ├─ Instance: %s, port %d, public key %s\n", instanceIP, instance.listenPort, instance.publicKey)
+
+	w.relay, err = forwarder.NewUDPRelay(session,
+		netip.AddrPortFrom(agentPeerAddr, wireGuardRelayPort),
+		netip.AddrPortFrom(defaultAgentTUNAddr.Addr(), instance.listenPort))
+	if err != nil {
+		w.teardown(awsClient, instanceID)
+		return nil, err
+	}
+
+	if w.device, err = tunnel.CreateWireGuard(); err != nil {
+		w.teardown(awsClient, instanceID)
+		return nil, fmt.Errorf("failed to create WireGuard device: %w", err)
+	}
+	if err := w.configureDevice(spec.LocalIP, privateKey, instance); err != nil {
+		w.teardown(awsClient, instanceID)
+		return nil, err
+	}
+	return w, nil
+}
+
+// configureDevice gives the client's WireGuard device its address, keys
+// and the relay as its peer's endpoint
+func (w *wireGuardTunnel) configureDevice(localIP, privateKey string, instance *wireGuardInstance) error {
+	if err := w.device.Configure(localIP, mtu-wireGuardOverhead); err != nil {
+		return fmt.Errorf("failed to configure WireGuard device: %w", err)
+	}
+	// Only the routed CIDR blocks reach the device, so the peer can have
+	// them all
+	return w.device.SetKeys(privateKey, tunnel.WireGuardPeer{
+		PublicKey:  instance.publicKey,
+		Endpoint:   w.relay.Addr(),
+		AllowedIPs: []string{"0.0.0.0/0"},
+		Keepalive:  wireGuardKeepalive,
+	})
+}
+
+// waitHandshake starts the relay and waits for the client's WireGuard
+// device to complete its first handshake with the instance
+func (w *wireGuardTunnel) waitHandshake(ctx context.Context) error {
+	w.relay.Start()
+
+	ctx, cancel := context.WithTimeout(ctx, wireGuardHandshakeTimeout)
+	defer cancel()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		latest, err := w.device.LatestHandshake()
+		if err != nil {
+			return err
+		}
+		if !latest.IsZero() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no WireGuard handshake with the instance within %s (is UDP to the agent's TUN address filtered on the instance?)", wireGuardHandshakeTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// teardown stops the relay and removes the client's device and the
+// instance's WireGuard interface with its NAT rules. It runs during
+// shutdown, so it does not use the tunnel's (cancelled) context.
+func (w *wireGuardTunnel) teardown(awsClient *aws.Client, instanceID string) error {
+	var errs []string
+	if w.relay != nil {
+		w.relay.Stop()
+	}
+	if w.device != nil {
+		if err := w.device.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), agentCommandTimeout)
+	defer cancel()
+	if _, err := awsClient.RunShellScript(ctx, instanceID, wireGuardTeardownScript(w.instanceDevice, w.clientIP), agentCommandTimeout); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove %s from %s: %v", w.instanceDevice, instanceID, err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// wireGuardSetupScript creates the instance's WireGuard interface dev with
+// a key pair of its own and the client (publicKey at clientIP) as its peer,
+// masquerades the client's traffic, and prints the interface's public key
+// and listen port. Forwarding is on while the agent runs. What a failed
+// setup leaves is removed by wireGuardTeardownScript.
+func wireGuardSetupScript(dev, publicKey string, clientIP netip.Addr, addr string, mtu int) []string {
+	script := fmt.Sprintf(`set -e
+if ! command -v wg >/dev/null 2>&1; then
+  if command -v dnf >/dev/null 2>&1; then dnf install -y -q wireguard-tools
+  elif command -v yum >/dev/null 2>&1; then yum install -y -q wireguard-tools
+  elif command -v apt-get >/dev/null 2>&1; then apt-get install -y -qq wireguard-tools
+  else echo "wg is not installed" >&2; exit 1
+  fi >/dev/null
+fi
+ip link add %[1]s type wireguard
+umask 077
+if ! (
+  wg genkey > /run/%[1]s.key &&
+  wg set %[1]s listen-port 0 private-key /run/%[1]s.key peer %[2]s allowed-ips %[3]s/32 &&
+  ip addr add %[4]s dev %[1]s &&
+  ip link set %[1]s mtu %[5]d up &&
+  if command -v iptables >/dev/null 2>&1; then
+    iptables -t nat -A POSTROUTING -s %[3]s/32 ! -o %[1]s -m comment --comment %[1]s -j MASQUERADE &&
+    iptables -I FORWARD -i %[1]s -m comment --comment %[1]s -j ACCEPT &&
+    iptables -I FORWARD -o %[1]s -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment %[1]s -j ACCEPT
+  else
+    nft -f - <<'EOF'
+table ip %[1]s {
+  chain postrouting { type nat hook postrouting priority srcnat; ip saddr %[3]s oifname != "%[1]s" masquerade; }
+  chain forward { type filter hook forward priority filter; iifname "%[1]s" accept; oifname "%[1]s" ct state related,established accept; }
+}
+EOF
+  fi
+); then
+  rm -f /run/%[1]s.key
+  exit 1
+fi
+rm -f /run/%[1]s.key
+echo "public-key $(wg show %[1]s public-key)"
+echo "listen-port $(wg show %[1]s listen-port)"`, dev, publicKey, clientIP, addr, mtu)
+	return strings.Split(script, "\n")
+}
+
+// wireGuardTeardownScript undoes wireGuardSetupScript; what is already
+// gone is skipped
+func wireGuardTeardownScript(dev string, clientIP netip.Addr) []string {
+	script := fmt.Sprintf(`ip link del %[1]s 2>/dev/null
+if command -v iptables >/dev/null 2>&1; then
+  iptables -t nat -D POSTROUTING -s %[2]s/32 ! -o %[1]s -m comment --comment %[1]s -j MASQUERADE 2>/dev/null
+  iptables -D FORWARD -i %[1]s -m comment --comment %[1]s -j ACCEPT 2>/dev/null
+  iptables -D FORWARD -o %[1]s -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment %[1]s -j ACCEPT 2>/dev/null
+fi
+nft delete table ip %[1]s 2>/dev/null
+exit 0`, dev, clientIP)
+	return strings.Split(script, "\n")
+}
+
+// parseWireGuardInstance parses the output of wireGuardSetupScript
+func parseWireGuardInstance(output string) (*wireGuardInstance, error) {
+	instance := &wireGuardInstance{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "public-key":
+			instance.publicKey = value
+		case "listen-port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid WireGuard listen port %q from the instance", value)
+			}
+			instance.listenPort = uint16(port)
+		}
+	}
+	if instance.publicKey == "" || instance.listenPort == 0 {
+		return nil, fmt.Errorf("the instance did not report its WireGuard public key and port: %q", output)
+	}
+	return instance, nil
+}
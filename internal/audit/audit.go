@@ -0,0 +1,88 @@
+// Package audit writes the audit log of a session: one JSON object per
+// line for every connection relayed through the tunnel, appended when the
+// connection ends, so that what was reached through the instance can be
+// reviewed later.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/ratelog"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// hotLog reports write failures, which every connection would repeat
+var hotLog = ratelog.New(log, ratelog.DefaultInterval)
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time       time.Time `json:"time"` // when the connection ended
+	Started    time.Time `json:"started"`
+	DurationMS int64     `json:"duration_ms"`
+	User       string    `json:"user"` // local user who started the session
+	Session    string    `json:"session"`
+	InstanceID string    `json:"instance_id"`
+	Protocol   string    `json:"protocol"`       // "tcp" or "udp"
+	Src        string    `json:"src"`            // local client address
+	Dst        string    `json:"dst"`            // destination IP:port (after NAT)
+	Host       string    `json:"host,omitempty"` // name of the destination, if known
+	BytesTX    uint64    `json:"bytes_tx"`       // payload bytes sent to the destination
+	BytesRX    uint64    `json:"bytes_rx"`       // and received from it
+}
+
+// Log appends entries to an audit log file
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the audit log at path for appending, creating it and its
+// directory if needed. Entries are only ever appended, each with a single
+// write, so several processes may share the file.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &Log{file: file}, nil
+}
+
+// Write appends an entry. Failures are logged (rate-limited) rather than
+// returned: they must not end the connection being logged.
+func (l *Log) Write(entry Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		hotLog.Warnf("Failed to encode audit log entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		hotLog.Warnf("Failed to write audit log: %v", err)
+	}
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// SetLogger sets the logger of the audit log
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+	hotLog.SetLogger(logger)
+}
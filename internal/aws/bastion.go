@@ -0,0 +1,168 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// BastionTag marks the instances launched as on-demand bastions, with the
+// subnet they were launched in as value. A stopped one is started again
+// instead of launching another.
+const BastionTag = "ssm-proxy:bastion"
+
+// DefaultBastionInstanceType is the instance type of on-demand bastions:
+// ssh with dynamic forwarding needs little
+const DefaultBastionInstanceType = "t3.micro"
+
+// bastionAMIParameter is the public SSM parameter holding the latest Amazon
+// Linux 2023 AMI (which ships the SSM Agent and EC2 Instance Connect) for
+// an architecture
+const bastionAMIParameter = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-%s"
+
+// BastionConfig configures an on-demand bastion
+type BastionConfig struct {
+	SubnetID        string
+	InstanceProfile string // name or ARN of an instance profile allowing SSM
+	InstanceType    string // default DefaultBastionInstanceType
+	ImageID         string // default the latest Amazon Linux 2023
+	SecurityGroups  []string
+}
+
+// FindStoppedBastion returns a stopped bastion launched earlier in the
+// subnet, nil if there is none
+func (c *Client) FindStoppedBastion(ctx context.Context, subnetID string) (*Instance, error) {
+	result, err := c.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("tag:" + BastionTag), Values: []string{subnetID}},
+			{Name: aws.String("instance-state-name"), Values: []string{"stopped"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %w", err)
+	}
+	for _, reservation := range result.Reservations {
+		for _, ec2Instance := range reservation.Instances {
+			return c.convertEC2Instance(ec2Instance), nil
+		}
+	}
+	return nil, nil
+}
+
+// LaunchBastion launches an instance to serve as bastion and returns its
+// ID. It shuts down into termination, so that a bastion stopped from
+// inside does not linger.
+func (c *Client) LaunchBastion(ctx context.Context, config BastionConfig) (string, error) {
+	if config.InstanceType == "" {
+		config.InstanceType = DefaultBastionInstanceType
+	}
+	if config.ImageID == "" {
+		param := fmt.Sprintf(bastionAMIParameter, instanceArchitecture(config.InstanceType))
+		out, err := c.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(param)})
+		if err != nil {
+			return "", fmt.Errorf("failed to look up the Amazon Linux AMI: %w", err)
+		}
+		config.ImageID = aws.ToString(out.Parameter.Value)
+	}
+
+	profile := &ec2types.IamInstanceProfileSpecification{Name: aws.String(config.InstanceProfile)}
+	if strings.HasPrefix(config.InstanceProfile, "arn:") {
+		profile = &ec2types.IamInstanceProfileSpecification{Arn: aws.String(config.InstanceProfile)}
+	}
+
+	result, err := c.ec2Client.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:                           aws.String(config.ImageID),
+		InstanceType:                      ec2types.InstanceType(config.InstanceType),
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		SubnetId:                          aws.String(config.SubnetID),
+		SecurityGroupIds:                  config.SecurityGroups,
+		IamInstanceProfile:                profile,
+		InstanceInitiatedShutdownBehavior: ec2types.ShutdownBehaviorTerminate,
+		MetadataOptions: &ec2types.InstanceMetadataOptionsRequest{
+			HttpTokens: ec2types.HttpTokensStateRequired,
+		},
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeInstance,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String("ssm-proxy-bastion")},
+					{Key: aws.String(BastionTag), Value: aws.String(config.SubnetID)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to launch instance: %w", err)
+	}
+	if len(result.Instances) == 0 {
+		return "", fmt.Errorf("failed to launch instance: none returned")
+	}
+	return aws.ToString(result.Instances[0].InstanceId), nil
+}
+
+// StartInstance starts a stopped instance
+func (c *Client) StartInstance(ctx context.Context, instanceID string) error {
+	if _, err := c.ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+		return fmt.Errorf("failed to start instance: %w", err)
+	}
+	return nil
+}
+
+// StopInstance stops an instance
+func (c *Client) StopInstance(ctx context.Context, instanceID string) error {
+	if _, err := c.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+		return fmt.Errorf("failed to stop instance: %w", err)
+	}
+	return nil
+}
+
+// TerminateInstance terminates an instance
+func (c *Client) TerminateInstance(ctx context.Context, instanceID string) error {
+	if _, err := c.ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+		return fmt.Errorf("failed to terminate instance: %w", err)
+	}
+	return nil
+}
+
+// WaitForSSM waits until an instance is running and its SSM Agent online,
+// polling every interval, and returns it
+func (c *Client) WaitForSSM(ctx context.Context, instanceID string, timeout, interval time.Duration) (*Instance, error) {
+	waiter := ec2.NewInstanceRunningWaiter(c.ec2Client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}, timeout); err != nil {
+		return nil, fmt.Errorf("instance %s did not start: %w", instanceID, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		instance, err := c.GetInstance(ctx, instanceID)
+		if err == nil && instance.SSMConnected {
+			return instance, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("SSM Agent of %s did not come online within %s (does the subnet reach the SSM endpoints, and does the instance profile allow SSM?)", instanceID, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// instanceArchitecture returns the architecture of an instance type's
+// AMIs: arm64 for Graviton families (a "g" after the first letter, as in
+// t4g or c7gn), x86_64 otherwise
+func instanceArchitecture(instanceType string) string {
+	family, _, _ := strings.Cut(instanceType, ".")
+	if len(family) > 1 && strings.Contains(family[1:], "g") {
+		return "arm64"
+	}
+	return "x86_64"
+}
@@ -2,7 +2,9 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -10,6 +12,7 @@ import (
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 )
 
 // Client wraps AWS SDK clients for EC2 and SSM
@@ -18,23 +21,56 @@ type Client struct {
 	ec2Client *ec2.Client
 	ssmClient *ssm.Client
 	region    string
+	profile   string // shared config profile, "" for the default
 }
 
-// Instance represents an EC2 instance with relevant details
+// Instance represents an EC2 instance with relevant details, or another
+// SSM target (see TargetKind)
 type Instance struct {
-	InstanceID       string
+	InstanceID       string // SSM target ID
 	Name             string
 	State            string
 	InstanceType     string
 	PrivateIP        string
 	PublicIP         string
 	AvailabilityZone string
+	VpcID            string
+	SubnetID         string
 	SSMConnected     bool
+	LaunchTime       time.Time // zero for other SSM targets
 	Tags             map[string]string
 }
 
+// VPC is an EC2 VPC with the CIDR blocks associated with it
+type VPC struct {
+	VpcID      string
+	CIDRBlocks []string // IPv4 and IPv6
+}
+
+// Subnet is a subnet of a VPC
+type Subnet struct {
+	SubnetID         string
+	CIDRBlock        string
+	IPv6CIDRBlocks   []string
+	AvailabilityZone string
+}
+
+// CredentialsRefreshWindow is how long before they expire credentials
+// are refreshed
+const CredentialsRefreshWindow = 5 * time.Minute
+
+// ErrInstanceNotFound is returned by GetInstance for an EC2 instance that
+// does not exist (anymore: terminated instances disappear after a while)
+var ErrInstanceNotFound = errors.New("instance not found")
+
 // NewClient creates a new AWS client with the specified profile and region
 func NewClient(ctx context.Context, profile, region string) (*Client, error) {
+	return NewClientWithRole(ctx, profile, region, nil)
+}
+
+// NewClientWithRole creates a new AWS client with the specified profile and
+// region that, unless role is nil, assumes the role
+func NewClientWithRole(ctx context.Context, profile, region string, role *AssumeRole) (*Client, error) {
 	var opts []func(*config.LoadOptions) error
 
 	// Set profile if specified
@@ -47,12 +83,31 @@ func NewClient(ctx context.Context, profile, region string) (*Client, error) {
 		opts = append(opts, config.WithRegion(region))
 	}
 
+	// Refresh expiring credentials ahead of time, so that a request (or
+	// the SSM WebSocket) is never signed with ones about to expire
+	opts = append(opts, config.WithCredentialsCacheOptions(func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = CredentialsRefreshWindow
+	}))
+
 	// Load AWS config
 	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
 	}
 
+	if role != nil {
+		if err := assumeRole(&cfg, profile, *role); err != nil {
+			return nil, err
+		}
+	}
+
+	client := NewClientFromConfig(cfg)
+	client.profile = profile
+	return client, nil
+}
+
+// NewClientFromConfig creates a new AWS client from an already loaded config
+func NewClientFromConfig(cfg aws.Config) *Client {
 	// Get actual region being used
 	actualRegion := cfg.Region
 	if actualRegion == "" {
@@ -64,22 +119,34 @@ func NewClient(ctx context.Context, profile, region string) (*Client, error) {
 		ec2Client: ec2.NewFromConfig(cfg),
 		ssmClient: ssm.NewFromConfig(cfg),
 		region:    actualRegion,
-	}, nil
+	}
 }
 
-// GetInstance retrieves details for a specific EC2 instance by ID
+// GetInstance retrieves details for a specific EC2 instance by ID, or for
+// a managed instance (mi-...) or ECS task container (ecs:CLUSTER/TASK[/CONTAINER])
 func (c *Client) GetInstance(ctx context.Context, instanceID string) (*Instance, error) {
+	switch TargetKind(instanceID) {
+	case TargetManaged:
+		return c.getManagedInstance(ctx, instanceID)
+	case TargetECS:
+		return c.getECSTarget(ctx, instanceID)
+	}
+
 	input := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	}
 
 	result, err := c.ec2Client.DescribeInstances(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to describe instance: %w", err)
 	}
 
 	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
-		return nil, fmt.Errorf("instance not found: %s", instanceID)
+		return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
 	}
 
 	ec2Instance := result.Reservations[0].Instances[0]
@@ -96,89 +163,177 @@ func (c *Client) GetInstance(ctx context.Context, instanceID string) (*Instance,
 	return instance, nil
 }
 
-// FindInstancesByTag finds EC2 instances matching the specified tag
+// FindInstancesByTag finds running EC2 instances matching the specified tag
 func (c *Client) FindInstancesByTag(ctx context.Context, key, value string) ([]*Instance, error) {
-	input := &ec2.DescribeInstancesInput{
-		Filters: []ec2types.Filter{
-			{
-				Name:   aws.String(fmt.Sprintf("tag:%s", key)),
-				Values: []string{value},
-			},
-			{
-				Name:   aws.String("instance-state-name"),
-				Values: []string{"running"},
-			},
+	return c.describeRunning(ctx, []ec2types.Filter{
+		{
+			Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+			Values: []string{value},
 		},
-	}
+	})
+}
 
-	result, err := c.ec2Client.DescribeInstances(ctx, input)
+// ListInstances lists all running EC2 instances
+func (c *Client) ListInstances(ctx context.Context, ssmOnly bool) ([]*Instance, error) {
+	instances, err := c.describeRunning(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to describe instances: %w", err)
+		return nil, err
 	}
 
-	var instances []*Instance
-	for _, reservation := range result.Reservations {
-		for _, ec2Instance := range reservation.Instances {
-			instance := c.convertEC2Instance(ec2Instance)
-
-			// Check SSM connectivity
-			ssmConnected, err := c.isSSMConnected(ctx, instance.InstanceID)
-			if err != nil {
-				ssmConnected = false
+	// Filter by SSM connectivity if requested
+	if ssmOnly {
+		var connected []*Instance
+		for _, instance := range instances {
+			if instance.SSMConnected {
+				connected = append(connected, instance)
 			}
-			instance.SSMConnected = ssmConnected
-
-			instances = append(instances, instance)
 		}
+		instances = connected
 	}
-
 	return instances, nil
 }
 
-// ListInstances lists all running EC2 instances
-func (c *Client) ListInstances(ctx context.Context, ssmOnly bool) ([]*Instance, error) {
-	filters := []ec2types.Filter{
-		{
+// describeRunning lists the running instances matching the filters, with
+// their SSM connectivity
+func (c *Client) describeRunning(ctx context.Context, filters []ec2types.Filter) ([]*Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: append(filters, ec2types.Filter{
 			Name:   aws.String("instance-state-name"),
 			Values: []string{"running"},
+		}),
+	}
+
+	var instances []*Instance
+	paginator := ec2.NewDescribeInstancesPaginator(c.ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+		for _, reservation := range page.Reservations {
+			for _, ec2Instance := range reservation.Instances {
+				instances = append(instances, c.convertEC2Instance(ec2Instance))
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return instances, nil
+	}
+
+	// Check SSM connectivity for all of them at once; without it they are
+	// reported as not connected
+	online, err := c.onlineSSMInstances(ctx)
+	if err != nil {
+		online = nil
+	}
+	for _, instance := range instances {
+		instance.SSMConnected = online[instance.InstanceID] || agentOnline(instance.InstanceID)
+	}
+
+	return instances, nil
+}
+
+// onlineSSMInstances returns the IDs of the managed instances whose SSM
+// agent is online
+func (c *Client) onlineSSMInstances(ctx context.Context) (map[string]bool, error) {
+	input := &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("PingStatus"),
+				Values: []string{string(ssmtypes.PingStatusOnline)},
+			},
 		},
 	}
 
-	input := &ec2.DescribeInstancesInput{
-		Filters: filters,
+	online := make(map[string]bool)
+	paginator := ssm.NewDescribeInstanceInformationPaginator(c.ssmClient, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe SSM instances: %w", err)
+		}
+		for _, info := range page.InstanceInformationList {
+			online[aws.ToString(info.InstanceId)] = true
+		}
 	}
+	return online, nil
+}
 
-	result, err := c.ec2Client.DescribeInstances(ctx, input)
+// GetVPC retrieves a VPC and its associated IPv4 and IPv6 CIDR blocks
+// (blocks being disassociated or that failed to associate are skipped)
+func (c *Client) GetVPC(ctx context.Context, vpcID string) (*VPC, error) {
+	result, err := c.ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
+		VpcIds: []string{vpcID},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to describe instances: %w", err)
+		return nil, fmt.Errorf("failed to describe VPC: %w", err)
+	}
+	if len(result.Vpcs) == 0 {
+		return nil, fmt.Errorf("VPC not found: %s", vpcID)
 	}
 
-	var instances []*Instance
-	for _, reservation := range result.Reservations {
-		for _, ec2Instance := range reservation.Instances {
-			instance := c.convertEC2Instance(ec2Instance)
-
-			// Check SSM connectivity
-			ssmConnected, err := c.isSSMConnected(ctx, instance.InstanceID)
-			if err != nil {
-				ssmConnected = false
-			}
-			instance.SSMConnected = ssmConnected
+	ec2VPC := result.Vpcs[0]
+	vpc := &VPC{VpcID: aws.ToString(ec2VPC.VpcId)}
+	for _, assoc := range ec2VPC.CidrBlockAssociationSet {
+		if assoc.CidrBlockState != nil && assoc.CidrBlockState.State == ec2types.VpcCidrBlockStateCodeAssociated {
+			vpc.CIDRBlocks = append(vpc.CIDRBlocks, aws.ToString(assoc.CidrBlock))
+		}
+	}
+	for _, assoc := range ec2VPC.Ipv6CidrBlockAssociationSet {
+		if assoc.Ipv6CidrBlockState != nil && assoc.Ipv6CidrBlockState.State == ec2types.VpcCidrBlockStateCodeAssociated {
+			vpc.CIDRBlocks = append(vpc.CIDRBlocks, aws.ToString(assoc.Ipv6CidrBlock))
+		}
+	}
+	// Older VPCs may only report their primary block
+	if len(vpc.CIDRBlocks) == 0 && ec2VPC.CidrBlock != nil {
+		vpc.CIDRBlocks = append(vpc.CIDRBlocks, aws.ToString(ec2VPC.CidrBlock))
+	}
 
-			// Filter by SSM connectivity if requested
-			if ssmOnly && !ssmConnected {
-				continue
-			}
+	return vpc, nil
+}
 
-			instances = append(instances, instance)
+// ListSubnets lists the subnets of a VPC
+func (c *Client) ListSubnets(ctx context.Context, vpcID string) ([]*Subnet, error) {
+	input := &ec2.DescribeSubnetsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []string{vpcID},
+			},
+		},
+	}
+
+	var subnets []*Subnet
+	paginator := ec2.NewDescribeSubnetsPaginator(c.ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets: %w", err)
+		}
+		for _, ec2Subnet := range page.Subnets {
+			subnet := &Subnet{
+				SubnetID:         aws.ToString(ec2Subnet.SubnetId),
+				CIDRBlock:        aws.ToString(ec2Subnet.CidrBlock),
+				AvailabilityZone: aws.ToString(ec2Subnet.AvailabilityZone),
+			}
+			for _, assoc := range ec2Subnet.Ipv6CidrBlockAssociationSet {
+				if assoc.Ipv6CidrBlockState != nil && assoc.Ipv6CidrBlockState.State == ec2types.SubnetCidrBlockStateCodeAssociated {
+					subnet.IPv6CIDRBlocks = append(subnet.IPv6CIDRBlocks, aws.ToString(assoc.Ipv6CidrBlock))
+				}
+			}
+			subnets = append(subnets, subnet)
 		}
 	}
 
-	return instances, nil
+	return subnets, nil
 }
 
 // isSSMConnected checks if the SSM agent is connected for the given instance
 func (c *Client) isSSMConnected(ctx context.Context, instanceID string) (bool, error) {
+	if agentOnline(instanceID) {
+		return true, nil
+	}
+
 	input := &ssm.DescribeInstanceInformationInput{
 		Filters: []ssmtypes.InstanceInformationStringFilter{
 			{
@@ -202,6 +357,45 @@ func (c *Client) isSSMConnected(ctx context.Context, instanceID string) (bool, e
 	return info.PingStatus == ssmtypes.PingStatusOnline, nil
 }
 
+// AgentInfo is what the SSM Agent of a managed instance reports
+type AgentInfo struct {
+	PingStatus      string // Online, ConnectionLost or Inactive
+	AgentVersion    string
+	PlatformType    string // Linux, Windows or MacOS
+	PlatformName    string // e.g. "Amazon Linux" or "Ubuntu"
+	PlatformVersion string
+}
+
+// AgentInfo returns what the SSM Agent of an instance reports, or nil if
+// the instance is not registered with SSM
+func (c *Client) AgentInfo(ctx context.Context, instanceID string) (*AgentInfo, error) {
+	input := &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{instanceID},
+			},
+		},
+	}
+
+	result, err := c.ssmClient.DescribeInstanceInformation(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance information: %w", err)
+	}
+	if len(result.InstanceInformationList) == 0 {
+		return nil, nil
+	}
+
+	info := result.InstanceInformationList[0]
+	return &AgentInfo{
+		PingStatus:      string(info.PingStatus),
+		AgentVersion:    aws.ToString(info.AgentVersion),
+		PlatformType:    string(info.PlatformType),
+		PlatformName:    aws.ToString(info.PlatformName),
+		PlatformVersion: aws.ToString(info.PlatformVersion),
+	}, nil
+}
+
 // convertEC2Instance converts an EC2 SDK instance to our Instance type
 func (c *Client) convertEC2Instance(ec2Instance ec2types.Instance) *Instance {
 	instance := &Instance{
@@ -211,6 +405,9 @@ func (c *Client) convertEC2Instance(ec2Instance ec2types.Instance) *Instance {
 		PrivateIP:        aws.ToString(ec2Instance.PrivateIpAddress),
 		PublicIP:         aws.ToString(ec2Instance.PublicIpAddress),
 		AvailabilityZone: aws.ToString(ec2Instance.Placement.AvailabilityZone),
+		VpcID:            aws.ToString(ec2Instance.VpcId),
+		SubnetID:         aws.ToString(ec2Instance.SubnetId),
+		LaunchTime:       aws.ToTime(ec2Instance.LaunchTime),
 		Tags:             make(map[string]string),
 	}
 
@@ -0,0 +1,102 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// cpuWindow is how far back the CPU utilization of an instance is averaged
+const cpuWindow = 15 * time.Minute
+
+// metricStatisticsResponse is the part of a GetMetricStatistics response
+// read
+type metricStatisticsResponse struct {
+	Datapoints []struct {
+		Average float64 `xml:"Average"`
+	} `xml:"GetMetricStatisticsResult>Datapoints>member"`
+}
+
+// AverageCPU returns the average CPUUtilization of an EC2 instance over
+// the last 15 minutes, and false if CloudWatch has no datapoints for it
+// (basic monitoring reports every 5 minutes). CloudWatch is called through
+// its query API, signed with the client's credentials, as the SDK client
+// is not a dependency.
+func (c *Client) AverageCPU(ctx context.Context, instanceID string) (float64, bool, error) {
+	end := time.Now().UTC().Truncate(time.Minute)
+	form := url.Values{
+		"Action":                    {"GetMetricStatistics"},
+		"Version":                   {"2010-08-01"},
+		"Namespace":                 {"AWS/EC2"},
+		"MetricName":                {"CPUUtilization"},
+		"Dimensions.member.1.Name":  {"InstanceId"},
+		"Dimensions.member.1.Value": {instanceID},
+		"StartTime":                 {end.Add(-cpuWindow).Format(time.RFC3339)},
+		"EndTime":                   {end.Format(time.RFC3339)},
+		"Period":                    {"300"},
+		"Statistics.member.1":       {"Average"},
+	}
+	body := form.Encode()
+
+	endpoint := fmt.Sprintf("https://monitoring.%s.amazonaws.com/", c.region)
+	if strings.HasPrefix(c.region, "cn-") {
+		endpoint = fmt.Sprintf("https://monitoring.%s.amazonaws.com.cn/", c.region)
+	}
+	if c.cfg.BaseEndpoint != nil {
+		endpoint = *c.cfg.BaseEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create CloudWatch request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+	hash := sha256.Sum256([]byte(body))
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "monitoring", c.region, time.Now()); err != nil {
+		return 0, false, fmt.Errorf("failed to sign CloudWatch request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get CPU utilization: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read CloudWatch response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &apiErr)
+		return 0, false, fmt.Errorf("failed to get CPU utilization: %s: %s (HTTP %d)", apiErr.Code, apiErr.Message, resp.StatusCode)
+	}
+
+	var result metricStatisticsResponse
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return 0, false, fmt.Errorf("failed to parse CloudWatch response: %w", err)
+	}
+	if len(result.Datapoints) == 0 {
+		return 0, false, nil
+	}
+	var sum float64
+	for _, point := range result.Datapoints {
+		sum += point.Average
+	}
+	return sum / float64(len(result.Datapoints)), true, nil
+}
@@ -0,0 +1,97 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// commandPollInterval is how often a Run Command invocation is checked
+const commandPollInterval = time.Second
+
+// CommandResult is the outcome of a shell script run with Run Command
+type CommandResult struct {
+	Status   string // Success, Failed, TimedOut or Cancelled
+	ExitCode int
+	Stdout   string // the first 24000 characters
+	Stderr   string // the first 8000 characters
+}
+
+// RunShellScript runs commands as root on a Linux managed instance with
+// the AWS-RunShellScript document and waits for them to finish (at most
+// timeout). A script that ran but failed returns a result with the error.
+func (c *Client) RunShellScript(ctx context.Context, instanceID string, commands []string, timeout time.Duration) (*CommandResult, error) {
+	seconds := max(int(timeout.Seconds()), 30)
+	sent, err := c.ssmClient.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []string{instanceID},
+		Parameters: map[string][]string{
+			"commands":         commands,
+			"executionTimeout": {strconv.Itoa(seconds)},
+		},
+		// How long the instance has to pick the command up
+		TimeoutSeconds: aws.Int32(int32(max(seconds, 60))),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	commandID := aws.ToString(sent.Command.CommandId)
+
+	ticker := time.NewTicker(commandPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		out, err := c.ssmClient.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandID),
+			InstanceId: aws.String(instanceID),
+		})
+		if err != nil {
+			// The invocation shows up a moment after the command is sent
+			var missing *ssmtypes.InvocationDoesNotExist
+			if errors.As(err, &missing) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get command %s: %w", commandID, err)
+		}
+
+		switch out.Status {
+		case ssmtypes.CommandInvocationStatusPending, ssmtypes.CommandInvocationStatusInProgress,
+			ssmtypes.CommandInvocationStatusDelayed, ssmtypes.CommandInvocationStatusCancelling:
+			continue
+		}
+		result := &CommandResult{
+			Status:   string(out.Status),
+			ExitCode: int(out.ResponseCode),
+			Stdout:   aws.ToString(out.StandardOutputContent),
+			Stderr:   aws.ToString(out.StandardErrorContent),
+		}
+		if out.Status != ssmtypes.CommandInvocationStatusSuccess {
+			return result, result.err()
+		}
+		return result, nil
+	}
+}
+
+// err describes a failed command
+func (r *CommandResult) err() error {
+	detail := strings.TrimSpace(r.Stderr)
+	if detail == "" {
+		detail = strings.TrimSpace(r.Stdout)
+	}
+	if detail == "" {
+		return fmt.Errorf("command %s (exit code %d)", strings.ToLower(r.Status), r.ExitCode)
+	}
+	return fmt.Errorf("command %s (exit code %d): %s", strings.ToLower(r.Status), r.ExitCode, detail)
+}
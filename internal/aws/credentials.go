@@ -0,0 +1,183 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// CredentialExpiry is when the AWS credentials of a client stop working
+type CredentialExpiry struct {
+	Source string // credentials provider, e.g. "SSOProvider"
+
+	// Credentials is when the current (e.g. STS) credentials expire, zero
+	// if they do not. The SDK refreshes them before then, as long as their
+	// source allows.
+	Credentials time.Time
+
+	// SSOToken is when the cached AWS IAM Identity Center (SSO) token of
+	// the profile expires, zero without one. Credentials cannot be
+	// refreshed after it without 'aws sso login'.
+	SSOToken time.Time
+}
+
+// Earliest returns when the first of the credentials and the SSO token
+// expires, zero if neither does
+func (e CredentialExpiry) Earliest() time.Time {
+	switch {
+	case e.Credentials.IsZero():
+		return e.SSOToken
+	case e.SSOToken.IsZero() || e.Credentials.Before(e.SSOToken):
+		return e.Credentials
+	default:
+		return e.SSOToken
+	}
+}
+
+// CredentialExpiry retrieves the client's credentials, refreshing them if
+// needed, and reports when they and the profile's SSO token expire
+func (c *Client) CredentialExpiry(ctx context.Context) (CredentialExpiry, error) {
+	var expiry CredentialExpiry
+	if c.cfg.Credentials == nil {
+		return expiry, errors.New("no AWS credentials configured")
+	}
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return expiry, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	expiry.Source = creds.Source
+	if creds.CanExpire {
+		expiry.Credentials = creds.Expires
+	}
+
+	expiry.SSOToken, err = ssoTokenExpiry(ctx, c.profile)
+	if err != nil {
+		return expiry, err
+	}
+	return expiry, nil
+}
+
+// CallerIdentity returns the ARN of the identity the client's credentials
+// belong to, verifying them with AWS
+func (c *Client) CallerIdentity(ctx context.Context) (string, error) {
+	out, err := sts.NewFromConfig(c.cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	return aws.ToString(out.Arn), nil
+}
+
+// ErrSSOTokenMissing is returned when an SSO profile has no cached token,
+// i.e. 'aws sso login' has not been run
+var ErrSSOTokenMissing = errors.New("no cached SSO token")
+
+// ssoToken is the part of a cached SSO token that matters here
+type ssoToken struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// RefreshToken lets the SDK renew the token of sso-session profiles
+	// without a new login, until the session itself ends
+	RefreshToken string `json:"refreshToken"`
+}
+
+// SSOLoginRequired reports whether the profile of the client uses SSO and
+// its token is missing, or cannot be refreshed and expires within margin,
+// so that 'aws sso login' is needed to keep getting credentials
+func (c *Client) SSOLoginRequired(ctx context.Context, margin time.Duration) (bool, error) {
+	// Credentials in the environment win over those of an implicit profile
+	if c.profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return false, nil
+	}
+	token, err := loadSSOToken(ctx, c.profile)
+	if errors.Is(err, ErrSSOTokenMissing) {
+		return true, nil
+	}
+	if err != nil || token == nil {
+		return false, err
+	}
+	return token.RefreshToken == "" && time.Until(token.ExpiresAt) < margin, nil
+}
+
+// SSOProfile returns the name of the client's profile as given to 'aws
+// sso login'
+func (c *Client) SSOProfile() string {
+	return profileName(c.profile)
+}
+
+// ssoTokenExpiry returns when the cached SSO token of a profile expires,
+// zero if the profile does not use SSO
+func ssoTokenExpiry(ctx context.Context, profile string) (time.Time, error) {
+	token, err := loadSSOToken(ctx, profile)
+	if err != nil || token == nil {
+		return time.Time{}, err
+	}
+	return token.ExpiresAt, nil
+}
+
+// profileName returns the profile the SDK uses for profile ""
+func profileName(profile string) string {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	return profile
+}
+
+// loadSSOToken returns the cached SSO token of a profile, nil if the
+// profile does not use SSO
+func loadSSOToken(ctx context.Context, profile string) (*ssoToken, error) {
+	profile = profileName(profile)
+	// Unlike LoadDefaultConfig, this does not look at the environment
+	shared, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+		if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+			o.ConfigFiles = []string{path}
+		}
+		if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+			o.CredentialsFiles = []string{path}
+		}
+	})
+	if err != nil {
+		var notExist config.SharedConfigProfileNotExistError
+		if errors.As(err, &notExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load AWS profile %s: %w", profile, err)
+	}
+
+	// The token is cached under the sso-session name, or the start URL of
+	// legacy profiles
+	key := shared.SSOStartURL
+	if shared.SSOSession != nil {
+		key = shared.SSOSession.Name
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	path, err := ssocreds.StandardCachedTokenFilepath(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate SSO token: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w for profile %s (run 'aws sso login --profile %s')", ErrSSOTokenMissing, profile, profile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSO token (run 'aws sso login --profile %s'): %w", profile, err)
+	}
+	var token ssoToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse SSO token %s: %w", path, err)
+	}
+	return &token, nil
+}
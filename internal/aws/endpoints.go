@@ -0,0 +1,57 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+)
+
+// EndpointHosts returns the host names of the AWS APIs ssm-proxy itself
+// calls: EC2, EC2 Instance Connect, SSM, the SSM data channel
+// (ssmmessages) and STS for refreshing credentials. A custom endpoint
+// (endpoint_url in the AWS config) replaces all of them.
+func (c *Client) EndpointHosts(ctx context.Context) ([]string, error) {
+	region := c.region
+	base := c.cfg.BaseEndpoint
+
+	resolvers := []func() (smithyendpoints.Endpoint, error){
+		func() (smithyendpoints.Endpoint, error) {
+			return ec2.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, ec2.EndpointParameters{Region: &region, Endpoint: base})
+		},
+		func() (smithyendpoints.Endpoint, error) {
+			return ec2instanceconnect.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, ec2instanceconnect.EndpointParameters{Region: &region, Endpoint: base})
+		},
+		func() (smithyendpoints.Endpoint, error) {
+			return ssm.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, ssm.EndpointParameters{Region: &region, Endpoint: base})
+		},
+		func() (smithyendpoints.Endpoint, error) {
+			return sts.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, sts.EndpointParameters{Region: &region, Endpoint: base})
+		},
+	}
+
+	var hosts []string
+	for _, resolve := range resolvers {
+		endpoint, err := resolve()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve AWS endpoint: %w", err)
+		}
+		host := endpoint.URI.Hostname()
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+
+		// The data channel has no SDK client; it lives next to SSM (the
+		// stream URL returned by StartSession)
+		if rest, ok := strings.CutPrefix(host, "ssm."); ok {
+			hosts = append(hosts, "ssmmessages."+rest)
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,12 @@
+package aws
+
+// AgentOnlineHook, if set, counts the SSM agents of the instances it returns
+// true for as online without asking SSM. The integration tests set it, as
+// LocalStack has no agents.
+var AgentOnlineHook func(instanceID string) bool
+
+// agentOnline reports whether an instance's SSM agent is known to be online
+// without asking SSM
+func agentOnline(instanceID string) bool {
+	return AgentOnlineHook != nil && AgentOnlineHook(instanceID)
+}
@@ -0,0 +1,187 @@
+//go:build integration
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The integration tests run against LocalStack, started by
+// scripts/integration/run.sh (make integration), which sets
+// SSM_PROXY_IT_ENDPOINT to its URL
+
+// localStackClient returns a client of LocalStack's APIs
+func localStackClient(t *testing.T) *Client {
+	t.Helper()
+	endpoint := os.Getenv("SSM_PROXY_IT_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SSM_PROXY_IT_ENDPOINT is not set (run: sudo make integration)")
+	}
+	t.Setenv("AWS_ENDPOINT_URL", endpoint)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_PROFILE", "")
+
+	c, err := NewClient(context.Background(), "", "us-east-1")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+// testVPC creates a VPC with a subnet in LocalStack, removed when the test
+// ends
+func testVPC(t *testing.T, c *Client, cidr string) (vpcID, subnetID string) {
+	t.Helper()
+	ctx := context.Background()
+
+	vpc, err := c.ec2Client.CreateVpc(ctx, &ec2.CreateVpcInput{CidrBlock: aws.String(cidr)})
+	if err != nil {
+		t.Fatalf("CreateVpc: %v", err)
+	}
+	vpcID = aws.ToString(vpc.Vpc.VpcId)
+	subnet, err := c.ec2Client.CreateSubnet(ctx, &ec2.CreateSubnetInput{VpcId: aws.String(vpcID), CidrBlock: aws.String(cidr)})
+	if err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+	subnetID = aws.ToString(subnet.Subnet.SubnetId)
+
+	t.Cleanup(func() {
+		c.ec2Client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{SubnetId: aws.String(subnetID)})
+		c.ec2Client.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: aws.String(vpcID)})
+	})
+	return vpcID, subnetID
+}
+
+// testInstance runs an instance tagged Name=name in subnetID, terminated
+// when the test ends
+func testInstance(t *testing.T, c *Client, name, subnetID string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	images, err := c.ec2Client.DescribeImages(ctx, &ec2.DescribeImagesInput{})
+	if err != nil || len(images.Images) == 0 {
+		t.Fatalf("DescribeImages: no image to run (%v)", err)
+	}
+	result, err := c.ec2Client.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:      images.Images[0].ImageId,
+		InstanceType: ec2types.InstanceTypeT3Micro,
+		SubnetId:     aws.String(subnetID),
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		TagSpecifications: []ec2types.TagSpecification{{
+			ResourceType: ec2types.ResourceTypeInstance,
+			Tags:         []ec2types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("RunInstances: %v", err)
+	}
+	id := aws.ToString(result.Instances[0].InstanceId)
+	t.Cleanup(func() {
+		c.TerminateInstance(ctx, id)
+	})
+	return id
+}
+
+// withAgentOnline counts the SSM agents of ids as online until the test
+// ends
+func withAgentOnline(t *testing.T, ids ...string) {
+	AgentOnlineHook = func(instanceID string) bool {
+		return slices.Contains(ids, instanceID)
+	}
+	t.Cleanup(func() { AgentOnlineHook = nil })
+}
+
+func TestFindInstancesByTag(t *testing.T) {
+	c := localStackClient(t)
+	ctx := context.Background()
+	name := fmt.Sprintf("ssm-proxy-it-%d", time.Now().UnixNano())
+	vpcID, subnetID := testVPC(t, c, "10.42.0.0/24")
+	id := testInstance(t, c, name, subnetID)
+
+	instances, err := c.FindInstancesByTag(ctx, "Name", name)
+	if err != nil {
+		t.Fatalf("FindInstancesByTag: %v", err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("FindInstancesByTag found %d instances, want 1", len(instances))
+	}
+	got := instances[0]
+	if got.InstanceID != id || got.Name != name || got.VpcID != vpcID || got.SubnetID != subnetID {
+		t.Errorf("FindInstancesByTag = %+v, want %s (%s) in %s/%s", got, id, name, vpcID, subnetID)
+	}
+	if got.SSMConnected {
+		t.Errorf("%s counts as connected to SSM without an agent", id)
+	}
+
+	withAgentOnline(t, id)
+	instances, err = c.FindInstancesByTag(ctx, "Name", name)
+	if err != nil {
+		t.Fatalf("FindInstancesByTag: %v", err)
+	}
+	if len(instances) != 1 || !instances[0].SSMConnected {
+		t.Errorf("%s does not count as connected to SSM with its agent online", id)
+	}
+
+	instances, err = c.FindInstancesByTag(ctx, "Name", name+"-none")
+	if err != nil {
+		t.Fatalf("FindInstancesByTag: %v", err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("FindInstancesByTag found %d instances for an unused tag", len(instances))
+	}
+}
+
+func TestGetInstance(t *testing.T) {
+	c := localStackClient(t)
+	ctx := context.Background()
+	name := fmt.Sprintf("ssm-proxy-it-%d", time.Now().UnixNano())
+	_, subnetID := testVPC(t, c, "10.43.0.0/24")
+	id := testInstance(t, c, name, subnetID)
+	withAgentOnline(t, id)
+
+	instance, err := c.GetInstance(ctx, id)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if instance.InstanceID != id || instance.Name != name || !instance.SSMConnected {
+		t.Errorf("GetInstance = %+v, want %s (%s) connected to SSM", instance, id, name)
+	}
+
+	if _, err := c.GetInstance(ctx, "i-0123456789abcdef0"); !errors.Is(err, ErrInstanceNotFound) {
+		t.Errorf("GetInstance of an unknown instance: %v, want ErrInstanceNotFound", err)
+	}
+}
+
+func TestGetVPC(t *testing.T) {
+	c := localStackClient(t)
+	ctx := context.Background()
+	vpcID, subnetID := testVPC(t, c, "10.44.0.0/24")
+
+	vpc, err := c.GetVPC(ctx, vpcID)
+	if err != nil {
+		t.Fatalf("GetVPC: %v", err)
+	}
+	if !slices.Contains(vpc.CIDRBlocks, "10.44.0.0/24") {
+		t.Errorf("GetVPC CIDR blocks = %v, want 10.44.0.0/24", vpc.CIDRBlocks)
+	}
+
+	subnets, err := c.ListSubnets(ctx, vpcID)
+	if err != nil {
+		t.Fatalf("ListSubnets: %v", err)
+	}
+	if len(subnets) != 1 || subnets[0].SubnetID != subnetID || subnets[0].CIDRBlock != "10.44.0.0/24" {
+		t.Errorf("ListSubnets = %+v, want %s (10.44.0.0/24)", subnets, subnetID)
+	}
+}
@@ -0,0 +1,168 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+// sshSessionDocument is the SSM document the tunnel's sessions are started
+// with
+const sshSessionDocument = "AWS-StartSSHSession"
+
+// Permission is an IAM action on a resource that ssm-proxy needs
+type Permission struct {
+	Action   string
+	Resource string // ARN, "*" for actions without resource-level permissions
+	Purpose  string // what needs it
+	Optional bool   // only needed by some options
+}
+
+// String returns the action and, unless it is "*", the resource
+func (p Permission) String() string {
+	if p.Resource == "*" {
+		return p.Action
+	}
+	return fmt.Sprintf("%s on %s", p.Action, p.Resource)
+}
+
+// PermissionResult is the outcome of simulating a permission
+type PermissionResult struct {
+	Permission
+	Allowed  bool
+	Decision string // allowed, implicitDeny or explicitDeny
+}
+
+// ErrSimulationUnavailable is returned when the caller's policies cannot
+// be simulated: root and federated users have none to simulate, and the
+// caller may lack iam:SimulatePrincipalPolicy or iam:GetRole
+var ErrSimulationUnavailable = errors.New("IAM policy simulation unavailable")
+
+// RequiredPermissions returns the permissions starting a tunnel to an
+// instance (or other SSM target) needs. callerARN is the ARN CallerIdentity
+// returns.
+func (c *Client) RequiredPermissions(callerARN, instanceID string) []Permission {
+	partition, account := "aws", ""
+	if fields := strings.Split(callerARN, ":"); len(fields) >= 5 {
+		partition, account = fields[1], fields[4]
+	}
+	document := fmt.Sprintf("arn:%s:ssm:%s::document/%s", partition, c.region, sshSessionDocument)
+	sessions := fmt.Sprintf("arn:%s:ssm:%s:%s:session/*", partition, c.region, account)
+
+	switch TargetKind(instanceID) {
+	case TargetManaged:
+		instance := fmt.Sprintf("arn:%s:ssm:%s:%s:managed-instance/%s", partition, c.region, account, instanceID)
+		return []Permission{
+			{Action: "ssm:DescribeInstanceInformation", Resource: "*", Purpose: "look up the managed instance"},
+			{Action: "ssm:StartSession", Resource: instance, Purpose: "open the SSM session"},
+			{Action: "ssm:StartSession", Resource: document, Purpose: "open the SSM session"},
+			{Action: "ssm:TerminateSession", Resource: sessions, Purpose: "end the SSM session on stop"},
+		}
+	case TargetECS:
+		// ecs:CLUSTER_TASK_RUNTIMEID; cluster names may contain underscores
+		// but task and runtime IDs do not
+		parts := strings.Split(strings.TrimPrefix(instanceID, ecsTargetPrefix), "_")
+		task := "*"
+		if len(parts) >= 3 {
+			task = strings.Join(parts[:len(parts)-2], "_") + "/" + parts[len(parts)-2]
+		}
+		instance := fmt.Sprintf("arn:%s:ecs:%s:%s:task/%s", partition, c.region, account, task)
+		return []Permission{
+			{Action: "ecs:DescribeTasks", Resource: instance, Purpose: "look up the ECS task"},
+			{Action: "ssm:StartSession", Resource: instance, Purpose: "open the SSM session"},
+			{Action: "ssm:StartSession", Resource: document, Purpose: "open the SSM session"},
+			{Action: "ssm:TerminateSession", Resource: sessions, Purpose: "end the SSM session on stop"},
+		}
+	}
+
+	instance := fmt.Sprintf("arn:%s:ec2:%s:%s:instance/%s", partition, c.region, account, instanceID)
+	return []Permission{
+		{Action: "ec2:DescribeInstances", Resource: "*", Purpose: "look up the instance"},
+		{Action: "ssm:DescribeInstanceInformation", Resource: "*", Purpose: "check the SSM Agent"},
+		{Action: "ssm:StartSession", Resource: instance, Purpose: "open the SSM session"},
+		{Action: "ssm:StartSession", Resource: document, Purpose: "open the SSM session"},
+		{Action: "ec2-instance-connect:SendSSHPublicKey", Resource: instance, Purpose: "log in with a temporary SSH key"},
+		{Action: "ssm:TerminateSession", Resource: sessions, Purpose: "end the SSM session on stop"},
+		{Action: "ec2:DescribeVpcs", Resource: "*", Purpose: "--auto-cidr", Optional: true},
+		{Action: "ec2:DescribeSubnets", Resource: "*", Purpose: "--auto-cidr", Optional: true},
+	}
+}
+
+// CheckPermissions simulates the caller's IAM policies for each permission.
+// It covers the identity's policies and permissions boundary, not service
+// control policies or conditions on context the simulation is not given.
+func (c *Client) CheckPermissions(ctx context.Context, callerARN string, permissions []Permission) ([]PermissionResult, error) {
+	principal, err := c.policySource(ctx, callerARN)
+	if err != nil {
+		return nil, err
+	}
+
+	client := iam.NewFromConfig(c.cfg)
+	results := make([]PermissionResult, 0, len(permissions))
+	for _, p := range permissions {
+		out, err := client.SimulatePrincipalPolicy(ctx, &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     []string{p.Action},
+			ResourceArns:    []string{p.Resource},
+		})
+		if err != nil {
+			if isAccessDenied(err) {
+				return nil, fmt.Errorf("%w: %v", ErrSimulationUnavailable, err)
+			}
+			return nil, fmt.Errorf("failed to simulate %s: %w", p, err)
+		}
+
+		result := PermissionResult{Permission: p, Decision: "implicitDeny"}
+		if len(out.EvaluationResults) > 0 {
+			result.Decision = string(out.EvaluationResults[0].EvalDecision)
+		}
+		result.Allowed = result.Decision == "allowed"
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// policySource returns the IAM user or role whose policies apply to the
+// caller: an assumed role's session is simulated as its role, looked up for
+// its path (roles of IAM Identity Center have one)
+func (c *Client) policySource(ctx context.Context, callerARN string) (string, error) {
+	fields := strings.SplitN(callerARN, ":", 6)
+	if len(fields) < 6 {
+		return "", fmt.Errorf("%w: unexpected caller ARN %s", ErrSimulationUnavailable, callerARN)
+	}
+	resource := fields[5]
+
+	switch {
+	case fields[2] == "iam" && strings.HasPrefix(resource, "user/"):
+		return callerARN, nil
+	case fields[2] == "sts" && strings.HasPrefix(resource, "assumed-role/"):
+		parts := strings.Split(resource, "/")
+		if len(parts) < 3 {
+			return "", fmt.Errorf("%w: unexpected caller ARN %s", ErrSimulationUnavailable, callerARN)
+		}
+		out, err := iam.NewFromConfig(c.cfg).GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(parts[1])})
+		if err != nil {
+			return "", fmt.Errorf("%w: failed to look up role %s: %v", ErrSimulationUnavailable, parts[1], err)
+		}
+		return aws.ToString(out.Role.Arn), nil
+	}
+	return "", fmt.Errorf("%w for %s", ErrSimulationUnavailable, callerARN)
+}
+
+// isAccessDenied reports whether an AWS API error is an authorization
+// failure
+func isAccessDenied(err error) bool {
+	var apiErr interface{ ErrorCode() string }
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// DefaultRoleDuration is how long assumed role credentials last by
+// default, STS's own default
+const DefaultRoleDuration = time.Hour
+
+// AssumeRole configures a role assumed with the profile's credentials,
+// e.g. to reach the account owning the bastion
+type AssumeRole struct {
+	RoleARN     string
+	ExternalID  string        // required by some roles' trust policies
+	MFASerial   string        // ARN of the MFA device, if the role requires MFA
+	SessionName string        // default ssm-proxy-PID
+	Duration    time.Duration // default DefaultRoleDuration
+
+	// TokenProvider returns the current code of the MFA device. It is
+	// called whenever the credentials are refreshed, i.e. once per
+	// Duration.
+	TokenProvider func() (string, error)
+}
+
+// roleKey identifies the assumed role credentials of a profile
+type roleKey struct {
+	profile, region                         string
+	roleARN, externalID, mfaSerial, session string
+	duration                                time.Duration
+}
+
+// roleCredentials caches the assumed role credentials per profile and
+// role, so that all clients of the process share them and an MFA code is
+// asked for once per refresh rather than once per client
+var roleCredentials = struct {
+	sync.Mutex
+	cache map[roleKey]*aws.CredentialsCache
+}{cache: make(map[roleKey]*aws.CredentialsCache)}
+
+// assumeRole replaces the credentials of cfg with those of the role,
+// assumed with the original credentials
+func assumeRole(cfg *aws.Config, profile string, role AssumeRole) error {
+	if role.SessionName == "" {
+		role.SessionName = "ssm-proxy-" + strconv.Itoa(os.Getpid())
+	}
+	if role.Duration == 0 {
+		role.Duration = DefaultRoleDuration
+	}
+	if role.MFASerial != "" && role.TokenProvider == nil {
+		return fmt.Errorf("role %s requires an MFA code, but none can be asked for", role.RoleARN)
+	}
+
+	key := roleKey{profile, cfg.Region, role.RoleARN, role.ExternalID, role.MFASerial, role.SessionName, role.Duration}
+	roleCredentials.Lock()
+	defer roleCredentials.Unlock()
+	if cached, ok := roleCredentials.cache[key]; ok {
+		cfg.Credentials = cached
+		return nil
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = role.SessionName
+		o.Duration = role.Duration
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+		if role.MFASerial != "" {
+			o.SerialNumber = aws.String(role.MFASerial)
+			o.TokenProvider = role.TokenProvider
+		}
+	})
+	cached := aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = CredentialsRefreshWindow
+	})
+	roleCredentials.cache[key] = cached
+	cfg.Credentials = cached
+	return nil
+}
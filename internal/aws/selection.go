@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Strategies choosing among several instances matching a tag
+const (
+	SelectNone        = "none"         // fail, asking for --instance-id
+	SelectRandom      = "random"       // spread sessions over the fleet
+	SelectNewest      = "newest"       // most recently launched
+	SelectLeastLoaded = "least-loaded" // lowest average CPU in CloudWatch
+	SelectSameAZ      = "same-az"      // in the availability zone of a target address
+)
+
+// SelectStrategies lists the strategies, for flag help and validation
+var SelectStrategies = []string{SelectNone, SelectRandom, SelectNewest, SelectLeastLoaded, SelectSameAZ}
+
+// SelectInstance picks one of several instances with a strategy, and
+// returns why it was picked. Instances whose SSM Agent is connected are
+// preferred over the others. target is the address same-az keeps traffic
+// in the availability zone of.
+func (c *Client) SelectInstance(ctx context.Context, instances []*Instance, strategy string, target netip.Addr) (*Instance, string, error) {
+	if len(instances) == 0 {
+		return nil, "", fmt.Errorf("no instances to select from")
+	}
+	candidates := slices.DeleteFunc(slices.Clone(instances), func(instance *Instance) bool {
+		return !instance.SSMConnected
+	})
+	if len(candidates) == 0 {
+		candidates = instances
+	}
+	if len(candidates) == 1 {
+		return candidates[0], "the only one with SSM connected", nil
+	}
+
+	switch strategy {
+	case SelectRandom:
+		return candidates[rand.IntN(len(candidates))], fmt.Sprintf("random of %d", len(candidates)), nil
+
+	case SelectNewest:
+		newest := slices.MaxFunc(candidates, func(a, b *Instance) int {
+			return a.LaunchTime.Compare(b.LaunchTime)
+		})
+		return newest, "launched " + newest.LaunchTime.Local().Format("2006-01-02 15:04"), nil
+
+	case SelectLeastLoaded:
+		return c.selectLeastLoaded(ctx, candidates)
+
+	case SelectSameAZ:
+		if !target.IsValid() {
+			return nil, "", fmt.Errorf("the same-az strategy needs a target address")
+		}
+		zone, err := c.subnetZone(ctx, candidates, target)
+		if err != nil {
+			return nil, "", err
+		}
+		local := slices.DeleteFunc(slices.Clone(candidates), func(instance *Instance) bool {
+			return instance.AvailabilityZone != zone
+		})
+		if len(local) == 0 {
+			return candidates[rand.IntN(len(candidates))], fmt.Sprintf("none in %s (%s), random of %d", zone, target, len(candidates)), nil
+		}
+		return local[rand.IntN(len(local))], fmt.Sprintf("in %s like %s, random of %d", zone, target, len(local)), nil
+	}
+
+	ids := make([]string, len(candidates))
+	for i, instance := range candidates {
+		ids[i] = instance.InstanceID
+	}
+	return nil, "", fmt.Errorf("%d instances match: %s (use --instance-id, or --select-strategy to pick one)",
+		len(candidates), strings.Join(ids, ", "))
+}
+
+// selectLeastLoaded picks the instance with the lowest average CPU
+// utilization; instances CloudWatch has no datapoints for come last
+func (c *Client) selectLeastLoaded(ctx context.Context, candidates []*Instance) (*Instance, string, error) {
+	var best *Instance
+	var bestCPU float64
+	var lastErr error
+	for _, instance := range candidates {
+		cpu, ok, err := c.AverageCPU(ctx, instance.InstanceID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ok && (best == nil || cpu < bestCPU) {
+			best, bestCPU = instance, cpu
+		}
+	}
+	if best != nil {
+		return best, fmt.Sprintf("%.1f%% CPU over the last %s", bestCPU, cpuWindow), nil
+	}
+	if lastErr != nil {
+		return nil, "", lastErr
+	}
+	return candidates[rand.IntN(len(candidates))], "no CPU datapoints, random", nil
+}
+
+// subnetZone returns the availability zone of the subnet containing addr,
+// looked for in the VPCs of the instances
+func (c *Client) subnetZone(ctx context.Context, instances []*Instance, addr netip.Addr) (string, error) {
+	var vpcs []string
+	for _, instance := range instances {
+		if instance.VpcID != "" && !slices.Contains(vpcs, instance.VpcID) {
+			vpcs = append(vpcs, instance.VpcID)
+		}
+	}
+
+	for _, vpc := range vpcs {
+		subnets, err := c.ListSubnets(ctx, vpc)
+		if err != nil {
+			return "", err
+		}
+		for _, subnet := range subnets {
+			blocks := append([]string{subnet.CIDRBlock}, subnet.IPv6CIDRBlocks...)
+			for _, block := range blocks {
+				if prefix, err := netip.ParsePrefix(block); err == nil && prefix.Contains(addr) {
+					return subnet.AvailabilityZone, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no subnet of %s contains %s", strings.Join(vpcs, ", "), addr)
+}
@@ -0,0 +1,183 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// Kinds of SSM targets
+const (
+	TargetEC2     = "ec2"     // EC2 instance, i-...
+	TargetManaged = "managed" // on-premises machine of a hybrid activation, mi-...
+	TargetECS     = "ecs"     // container of an ECS task with ECS Exec enabled
+)
+
+// ecsTargetPrefix starts ECS targets, both as given
+// (ecs:CLUSTER/TASK[/CONTAINER]) and as SSM takes them
+// (ecs:CLUSTER_TASK_RUNTIMEID)
+const ecsTargetPrefix = "ecs:"
+
+// TargetKind returns the kind of target an ID refers to
+func TargetKind(id string) string {
+	switch {
+	case strings.HasPrefix(id, "mi-"):
+		return TargetManaged
+	case strings.HasPrefix(id, ecsTargetPrefix):
+		return TargetECS
+	}
+	return TargetEC2
+}
+
+// UsesInstanceConnect reports whether SSH keys can be sent to a target with
+// EC2 Instance Connect, which only EC2 instances support. On other targets
+// the key must already be authorized.
+func UsesInstanceConnect(id string) bool {
+	return TargetKind(id) == TargetEC2
+}
+
+// getManagedInstance retrieves a managed instance of a hybrid activation.
+// Managed instances have no EC2 state: a registered one is reported as
+// running, and its agent's ping status tells whether it is reachable.
+func (c *Client) getManagedInstance(ctx context.Context, instanceID string) (*Instance, error) {
+	result, err := c.ssmClient.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{instanceID},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe managed instance: %w", err)
+	}
+	if len(result.InstanceInformationList) == 0 {
+		return nil, fmt.Errorf("managed instance not found: %s", instanceID)
+	}
+
+	info := result.InstanceInformationList[0]
+	instance := &Instance{
+		InstanceID:   instanceID,
+		Name:         aws.ToString(info.Name),
+		State:        "running",
+		InstanceType: "managed instance",
+		PrivateIP:    aws.ToString(info.IPAddress),
+		SSMConnected: info.PingStatus == ssmtypes.PingStatusOnline || agentOnline(instanceID),
+		Tags:         make(map[string]string),
+	}
+	if instance.Name == "" {
+		instance.Name = aws.ToString(info.ComputerName)
+	}
+	if instance.Name == "" {
+		instance.Name = instanceID
+	}
+	return instance, nil
+}
+
+// getECSTarget retrieves a container of an ECS task, given as
+// ecs:CLUSTER/TASK[/CONTAINER] (TASK being the task ID or ARN), and returns
+// it with the SSM target ID ECS Exec sessions take as its InstanceID. The
+// container can be left out if the task has only one.
+func (c *Client) getECSTarget(ctx context.Context, target string) (*Instance, error) {
+	cluster, task, container, err := parseECSTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ecs.NewFromConfig(c.cfg).DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(cluster),
+		Tasks:   []string{task},
+		Include: []ecstypes.TaskField{ecstypes.TaskFieldTags},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe ECS task: %w", err)
+	}
+	if len(result.Tasks) == 0 {
+		return nil, fmt.Errorf("ECS task not found: %s in cluster %s", task, cluster)
+	}
+	ecsTask := result.Tasks[0]
+
+	var selected *ecstypes.Container
+	for i, candidate := range ecsTask.Containers {
+		if container != "" {
+			if aws.ToString(candidate.Name) == container {
+				selected = &ecsTask.Containers[i]
+				break
+			}
+			continue
+		}
+		if selected != nil {
+			return nil, fmt.Errorf("ECS task %s has several containers, use ecs:%s/%s/CONTAINER", task, cluster, task)
+		}
+		selected = &ecsTask.Containers[i]
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("container %s not found in ECS task %s", container, task)
+	}
+	if aws.ToString(selected.RuntimeId) == "" {
+		return nil, fmt.Errorf("container %s of ECS task %s has not started", aws.ToString(selected.Name), task)
+	}
+
+	taskID := lastARNSegment(aws.ToString(ecsTask.TaskArn))
+	instance := &Instance{
+		InstanceID: fmt.Sprintf("%s%s_%s_%s", ecsTargetPrefix,
+			lastARNSegment(aws.ToString(ecsTask.ClusterArn)), taskID, aws.ToString(selected.RuntimeId)),
+		Name:             aws.ToString(selected.Name),
+		State:            strings.ToLower(aws.ToString(ecsTask.LastStatus)),
+		InstanceType:     "ecs task (" + strings.ToLower(string(ecsTask.LaunchType)) + ")",
+		AvailabilityZone: aws.ToString(ecsTask.AvailabilityZone),
+		Tags:             make(map[string]string),
+	}
+	for _, iface := range selected.NetworkInterfaces {
+		if ip := aws.ToString(iface.PrivateIpv4Address); ip != "" {
+			instance.PrivateIP = ip
+			break
+		}
+	}
+	for _, tag := range ecsTask.Tags {
+		instance.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	// ECS Exec runs its own SSM agent in the container
+	if ecsTask.EnableExecuteCommand {
+		for _, agent := range selected.ManagedAgents {
+			if agent.Name == ecstypes.ManagedAgentNameExecuteCommandAgent && aws.ToString(agent.LastStatus) == "RUNNING" {
+				instance.SSMConnected = true
+			}
+		}
+	}
+	instance.SSMConnected = instance.SSMConnected || agentOnline(instance.InstanceID)
+	return instance, nil
+}
+
+// parseECSTarget splits ecs:CLUSTER/TASK[/CONTAINER]; a task ARN is taken
+// as TASK (its own slashes included)
+func parseECSTarget(target string) (cluster, task, container string, err error) {
+	rest := strings.TrimPrefix(target, ecsTargetPrefix)
+	cluster, rest, ok := strings.Cut(rest, "/")
+	if !ok || cluster == "" || rest == "" {
+		return "", "", "", fmt.Errorf("invalid ECS target %q (expected ecs:CLUSTER/TASK[/CONTAINER])", target)
+	}
+
+	if strings.HasPrefix(rest, "arn:") {
+		// arn:...:task/CLUSTER/TASK_ID[/CONTAINER]
+		parts := strings.Split(rest, "/")
+		if len(parts) > 3 {
+			return cluster, strings.Join(parts[:3], "/"), parts[3], nil
+		}
+		return cluster, rest, "", nil
+	}
+	task, container, _ = strings.Cut(rest, "/")
+	return cluster, task, container, nil
+}
+
+// lastARNSegment returns what follows the last slash of an ARN
+func lastARNSegment(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
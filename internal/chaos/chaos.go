@@ -0,0 +1,289 @@
+// Package chaos injects faults into a session for testing: latency and
+// loss of the packets between the TUN device and the forwarder, and
+// disconnects of the transport. It lets reconnection, TCP handling and
+// applications be validated under adverse conditions.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Config is what to inject
+type Config struct {
+	// Latency delays the packets written back to the TUN device, adding
+	// to every round trip; each packet is delayed by up to Jitter more or
+	// less (keeping their order)
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Loss is the probability (0 to 1) that a packet is dropped, in each
+	// direction
+	Loss float64
+
+	// Disconnect is the mean interval between transport disconnects (0:
+	// none). The intervals are random (exponentially distributed).
+	Disconnect time.Duration
+}
+
+// ParseConfig parses a comma-separated list of settings, e.g.
+// "latency=200ms,jitter=50ms,loss=5%,disconnect=10m". "none" injects
+// nothing.
+func ParseConfig(spec string) (Config, error) {
+	var config Config
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "none" {
+		return config, nil
+	}
+
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return Config{}, fmt.Errorf("invalid chaos setting %q (expected key=value)", setting)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			config.Latency, err = parseDuration(value)
+		case "jitter":
+			config.Jitter, err = parseDuration(value)
+		case "disconnect":
+			config.Disconnect, err = parseDuration(value)
+		case "loss":
+			config.Loss, err = parseProbability(value)
+		default:
+			return Config{}, fmt.Errorf("unknown chaos setting %q (expected latency, jitter, loss or disconnect)", key)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid chaos %s %q: %w", key, value, err)
+		}
+	}
+	return config, nil
+}
+
+// parseDuration parses a non-negative duration
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
+
+// parseProbability parses a percentage ("5%") or a fraction ("0.05")
+func parseProbability(value string) (float64, error) {
+	percent := strings.HasSuffix(value, "%")
+	p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent {
+		p /= 100
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1 (or 0%% and 100%%)")
+	}
+	return p, nil
+}
+
+// String returns the configuration in the form ParseConfig takes
+func (c Config) String() string {
+	var settings []string
+	if c.Latency > 0 {
+		settings = append(settings, "latency="+c.Latency.String())
+	}
+	if c.Jitter > 0 {
+		settings = append(settings, "jitter="+c.Jitter.String())
+	}
+	if c.Loss > 0 {
+		settings = append(settings, "loss="+strconv.FormatFloat(c.Loss*100, 'f', -1, 64)+"%")
+	}
+	if c.Disconnect > 0 {
+		settings = append(settings, "disconnect="+c.Disconnect.String())
+	}
+	if len(settings) == 0 {
+		return "none"
+	}
+	return strings.Join(settings, ",")
+}
+
+// Injector injects the faults of its configuration, which can be changed
+// while running
+type Injector struct {
+	config atomic.Pointer[Config]
+}
+
+// NewInjector creates an injector
+func NewInjector(config Config) *Injector {
+	i := &Injector{}
+	i.Set(config)
+	return i
+}
+
+// Set changes what is injected
+func (i *Injector) Set(config Config) {
+	i.config.Store(&config)
+	log.Warnf("Chaos: injecting %s", config)
+}
+
+// Config returns what is injected
+func (i *Injector) Config() Config {
+	return *i.config.Load()
+}
+
+// lose reports whether a packet is to be dropped
+func (i *Injector) lose() bool {
+	loss := i.config.Load().Loss
+	return loss > 0 && rand.Float64() < loss
+}
+
+// delay returns how long to hold a packet back
+func (i *Injector) delay() time.Duration {
+	config := i.config.Load()
+	d := config.Latency
+	if config.Jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(2*config.Jitter+1))) - config.Jitter
+	}
+	return max(d, 0)
+}
+
+// RunDisconnects calls disconnect at random intervals of the configured
+// mean until ctx is done. Without disconnects configured it waits for them
+// to be.
+func (i *Injector) RunDisconnects(ctx context.Context, disconnect func() error) {
+	for {
+		wait := time.Second
+		mean := i.config.Load().Disconnect
+		if mean > 0 {
+			wait = time.Duration(rand.ExpFloat64() * float64(mean))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		// The setting may have been turned off while waiting
+		if mean == 0 || i.config.Load().Disconnect == 0 {
+			continue
+		}
+		log.Warn("Chaos: disconnecting the transport")
+		if err := disconnect(); err != nil {
+			log.Warnf("Chaos: failed to disconnect the transport: %v", err)
+		}
+	}
+}
+
+// Device is a TUN device, e.g. a *tunnel.TunDevice
+type Device interface {
+	Read(packet []byte) (int, error)
+	Write(packet []byte) (int, error)
+	MTU() int
+}
+
+// delayQueueLen bounds the packets held back; more are dropped
+const delayQueueLen = 4096
+
+// delayedPacket is a packet held back until its time
+type delayedPacket struct {
+	at   time.Time
+	data []byte
+}
+
+// chaosDevice drops packets read from and written to a device and delays
+// those written
+type chaosDevice struct {
+	Device
+	injector *Injector
+	ctx      context.Context
+
+	mu     sync.Mutex
+	last   time.Time // when the last queued packet is due
+	queue  chan delayedPacket
+	queued sync.Once
+}
+
+// Device returns dev with the injector's loss and latency applied until
+// ctx is done
+func (i *Injector) Device(ctx context.Context, dev Device) Device {
+	return &chaosDevice{Device: dev, injector: i, ctx: ctx, queue: make(chan delayedPacket, delayQueueLen)}
+}
+
+// Read reads the next packet that is not lost
+func (d *chaosDevice) Read(packet []byte) (int, error) {
+	for {
+		n, err := d.Device.Read(packet)
+		if err != nil || !d.injector.lose() {
+			return n, err
+		}
+	}
+}
+
+// Write writes a packet unless it is lost, after its delay
+func (d *chaosDevice) Write(packet []byte) (int, error) {
+	if d.injector.lose() {
+		return len(packet), nil
+	}
+	delay := d.injector.delay()
+	if delay == 0 {
+		return d.Device.Write(packet)
+	}
+	d.queued.Do(func() { go d.writeDelayed() })
+
+	// Packets keep their order, whatever their jitter
+	d.mu.Lock()
+	at := time.Now().Add(delay)
+	if at.Before(d.last) {
+		at = d.last
+	}
+	d.last = at
+	d.mu.Unlock()
+
+	select {
+	case d.queue <- delayedPacket{at: at, data: append([]byte(nil), packet...)}:
+	default:
+		// Like a full router queue
+	}
+	return len(packet), nil
+}
+
+// writeDelayed writes the held back packets when they are due
+func (d *chaosDevice) writeDelayed() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case p := <-d.queue:
+			if wait := time.Until(p.at); wait > 0 {
+				select {
+				case <-d.ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+			if _, err := d.Device.Write(p.data); err != nil {
+				log.Debugf("Chaos: failed to write delayed packet: %v", err)
+			}
+		}
+	}
+}
+
+// SetLogger sets the logger of fault injection
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
@@ -0,0 +1,58 @@
+// Package connset tracks the connections of a server so that closing the
+// server closes them too and waits until their handlers are done with
+// them.
+package connset
+
+import (
+	"io"
+	"sync"
+)
+
+// Set is a set of open connections (or listeners). The zero value is an
+// empty set ready to use.
+type Set struct {
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Track registers a connection to be closed by Close; it returns false
+// once the set is closed, in which case the caller must close conn itself.
+// Each tracked connection must be released with Untrack.
+func (s *Set) Track(conn io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[io.Closer]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// Untrack closes a connection and forgets it
+func (s *Set) Untrack(conn io.Closer) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Close closes all connections, refuses new ones and waits until all are
+// released with Untrack
+func (s *Set) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
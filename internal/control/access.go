@@ -0,0 +1,228 @@
+package control
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Class is a class of control operations. Each class includes the ones
+// below it: session-admin may do everything, flow-admin may also read.
+type Class string
+
+const (
+	// ClassNone grants nothing
+	ClassNone Class = ""
+	// ClassRead covers status and statistics
+	ClassRead Class = "read"
+	// ClassFlowAdmin covers changes to what the session forwards: its
+	// flows and routes
+	ClassFlowAdmin Class = "flow-admin"
+	// ClassSessionAdmin covers stopping and reconnecting the session
+	ClassSessionAdmin Class = "session-admin"
+)
+
+// classRank orders the classes
+var classRank = map[Class]int{
+	ClassNone:         0,
+	ClassRead:         1,
+	ClassFlowAdmin:    2,
+	ClassSessionAdmin: 3,
+}
+
+// ParseClass parses a class name
+func ParseClass(name string) (Class, error) {
+	class := Class(name)
+	if _, ok := classRank[class]; !ok || class == ClassNone {
+		return ClassNone, fmt.Errorf("invalid class %q (expected %s, %s or %s)", name, ClassRead, ClassFlowAdmin, ClassSessionAdmin)
+	}
+	return class, nil
+}
+
+// Allows reports whether the class includes the operations of need
+func (c Class) Allows(need Class) bool {
+	return classRank[c] >= classRank[need]
+}
+
+// ErrPermission is returned for an operation the client is not allowed
+var ErrPermission = errors.New("permission denied")
+
+// Grant gives a class of operations to a user, the members of a group or
+// the clients presenting a token (exactly one of UID, GID and Token is set)
+type Grant struct {
+	UID   int // -1 if unset
+	GID   int // -1 if unset
+	Token string
+	Class Class
+}
+
+// ParseGrant parses SUBJECT=CLASS, SUBJECT being user:NAME|UID,
+// group:NAME|GID or token-file:PATH
+func ParseGrant(spec string) (Grant, error) {
+	subject, className, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Grant{}, fmt.Errorf("invalid grant %q (expected user:NAME=CLASS, group:NAME=CLASS or token-file:PATH=CLASS)", spec)
+	}
+	class, err := ParseClass(className)
+	if err != nil {
+		return Grant{}, fmt.Errorf("invalid grant %q: %w", spec, err)
+	}
+
+	kind, name, _ := strings.Cut(subject, ":")
+	if name == "" {
+		return Grant{}, fmt.Errorf("invalid grant %q: missing name after %q", spec, kind+":")
+	}
+	grant := Grant{UID: -1, GID: -1, Class: class}
+	switch kind {
+	case "user":
+		grant.UID, err = lookupUID(name)
+	case "group":
+		grant.GID, err = lookupGID(name)
+	case "token-file":
+		grant.Token, err = ReadTokenFile(name)
+	default:
+		err = fmt.Errorf("unknown subject kind %q (expected user, group or token-file)", kind)
+	}
+	if err != nil {
+		return Grant{}, fmt.Errorf("invalid grant %q: %w", spec, err)
+	}
+	return grant, nil
+}
+
+// String describes the grant without revealing a token
+func (g Grant) String() string {
+	switch {
+	case g.UID >= 0:
+		return fmt.Sprintf("uid %d: %s", g.UID, g.Class)
+	case g.GID >= 0:
+		return fmt.Sprintf("gid %d: %s", g.GID, g.Class)
+	default:
+		return fmt.Sprintf("token: %s", g.Class)
+	}
+}
+
+// Access controls who may use a control socket and for what. Root and the
+// owner (the user who started the session) may do everything; others get
+// the highest class granted to their user, one of their groups or the
+// token they present.
+type Access struct {
+	OwnerUID int // -1 if the session was started by root itself
+	Grants   []Grant
+}
+
+// classOf returns the class of operations a client may perform
+func (a Access) classOf(peer *peerCred, token string) (Class, error) {
+	class := ClassNone
+	if peer != nil {
+		if peer.uid == 0 || (a.OwnerUID >= 0 && peer.uid == a.OwnerUID) {
+			return ClassSessionAdmin, nil
+		}
+		for _, g := range a.Grants {
+			if (g.UID >= 0 && g.UID == peer.uid) || (g.GID >= 0 && peer.inGroup(g.GID)) {
+				class = maxClass(class, g.Class)
+			}
+		}
+	}
+
+	if token != "" {
+		matched := false
+		for _, g := range a.Grants {
+			if g.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(g.Token)) == 1 {
+				class = maxClass(class, g.Class)
+				matched = true
+			}
+		}
+		if !matched {
+			return ClassNone, errors.New("invalid token")
+		}
+	}
+	return class, nil
+}
+
+// socketMode returns the permissions and group for the socket file: as
+// narrow as the grants allow, since classOf checks every request anyway
+func (a Access) socketMode() (mode uint32, gid int) {
+	gid = -1
+	for _, g := range a.Grants {
+		switch {
+		case g.Token != "", g.UID >= 0:
+			return 0666, -1
+		case gid >= 0 && gid != g.GID:
+			return 0666, -1
+		default:
+			gid = g.GID
+		}
+	}
+	if gid >= 0 {
+		return 0660, gid
+	}
+	return 0600, -1
+}
+
+// maxClass returns the higher of two classes
+func maxClass(a, b Class) Class {
+	if b.Allows(a) {
+		return b
+	}
+	return a
+}
+
+// peerCred identifies the user on the other end of a unix socket
+type peerCred struct {
+	uid    int
+	gid    int
+	groups []int // supplementary groups, looked up lazily
+	looked bool
+}
+
+// inGroup reports whether the peer's primary or a supplementary group is gid
+func (p *peerCred) inGroup(gid int) bool {
+	if p.gid == gid {
+		return true
+	}
+	if !p.looked {
+		p.looked = true
+		if u, err := user.LookupId(strconv.Itoa(p.uid)); err == nil {
+			if ids, err := u.GroupIds(); err == nil {
+				for _, id := range ids {
+					if n, err := strconv.Atoi(id); err == nil {
+						p.groups = append(p.groups, n)
+					}
+				}
+			}
+		}
+	}
+	for _, g := range p.groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupUID resolves a user name or numeric ID
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID resolves a group name or numeric ID
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,143 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Call sends one request, with params (nil for none), to the control socket
+// at path and decodes the result into result
+func Call(path, method, token string, params, result any) error {
+	_, err := call(path, method, token, params, result, false)
+	return err
+}
+
+// CallFile is Call for a method whose result comes with an open file
+func CallFile(path, method, token string, params, result any) (*os.File, error) {
+	return call(path, method, token, params, result, true)
+}
+
+// call sends one request and reads its response, with the file attached
+// to it if withFile
+func call(path, method, token string, params, result any, withFile bool) (*os.File, error) {
+	conn, err := net.DialTimeout("unix", path, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control socket %s: %w", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	req := Request{Method: method, Token: token}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode params: %w", err)
+		}
+		req.Params = data
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var line []byte
+	var file *os.File
+	if withFile {
+		line, file, err = readWithFile(conn.(*net.UnixConn))
+	} else {
+		line, err = bufio.NewReader(conn).ReadBytes('\n')
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var resp Response
+	if err = json.Unmarshal(line, &resp); err != nil {
+		err = fmt.Errorf("invalid response: %w", err)
+	} else if resp.Error != "" {
+		err = errors.New(resp.Error)
+	} else if result != nil {
+		err = json.Unmarshal(resp.Result, result)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// readWithFile reads a response line and the file passed along with it,
+// nil if there is none
+func readWithFile(conn *net.UnixConn) ([]byte, *os.File, error) {
+	var line []byte
+	var file *os.File
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err == nil && n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return nil, nil, err
+		}
+		line = append(line, buf[:n]...)
+
+		if oobn > 0 && file == nil {
+			messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil || len(messages) == 0 {
+				continue
+			}
+			if fds, err := unix.ParseUnixRights(&messages[0]); err == nil && len(fds) > 0 {
+				for _, extra := range fds[1:] {
+					unix.Close(extra)
+				}
+				file = os.NewFile(uintptr(fds[0]), "control")
+			}
+		}
+	}
+	return line, file, nil
+}
+
+// Sockets returns the control sockets in dir, keyed by session name
+func Sockets(dir string) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	sockets := make(map[string]string, len(paths))
+	for _, path := range paths {
+		sockets[strings.TrimSuffix(filepath.Base(path), ".sock")] = path
+	}
+	return sockets, nil
+}
+
+// ReadTokenFile reads a token from the first line of a file
+func ReadTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token, _, _ := strings.Cut(string(data), "\n")
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
@@ -0,0 +1,32 @@
+package control
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the user of a unix socket peer (LOCAL_PEERCRED)
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Xucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	peer := &peerCred{uid: int(cred.Uid), gid: -1}
+	if cred.Ngroups > 0 {
+		peer.gid = int(cred.Groups[0])
+	}
+	return peer, nil
+}
@@ -0,0 +1,267 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/connset"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var log = logrus.New()
+
+// DefaultDir holds the control sockets of running sessions
+const DefaultDir = "/var/run/ssm-proxy"
+
+// Methods of the control API
+const (
+	// MethodStatus returns the session's state and live traffic counters
+	MethodStatus = "status"
+	// MethodStats returns the session's traffic counters per routed CIDR
+	// block, its relayed connections and, if asked, its busiest
+	// destinations
+	MethodStats = "stats"
+	// MethodCloseFlows closes the session's relayed TCP connections
+	MethodCloseFlows = "flows.close"
+	// MethodRouteAdd routes more CIDR blocks through the session
+	MethodRouteAdd = "routes.add"
+	// MethodRouteRemove stops routing CIDR blocks through the session
+	MethodRouteRemove = "routes.remove"
+	// MethodDNSReload reloads the session's DNS configuration
+	MethodDNSReload = "dns.reload"
+	// MethodDrain stops the session once its connections are closed,
+	// relaying no new ones meanwhile
+	MethodDrain = "drain"
+	// MethodStop stops the session
+	MethodStop = "stop"
+	// MethodChaos shows or changes the faults injected into the session
+	// (start --chaos)
+	MethodChaos = "chaos"
+	// MethodLogLevel shows or changes the log level of the session's
+	// process
+	MethodLogLevel = "log.level"
+)
+
+// requestTimeout bounds reading a request and writing its response
+const requestTimeout = 10 * time.Second
+
+// SocketPath returns the control socket of a session in DefaultDir
+func SocketPath(session string) string {
+	return filepath.Join(DefaultDir, session+".sock")
+}
+
+// Request is one line of JSON sent by a client
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Token  string          `json:"token,omitempty"`
+}
+
+// Response is the server's reply to a request
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Handler answers a request
+type Handler func(params json.RawMessage) (any, error)
+
+// File is a result that comes with an open file, which is passed to the
+// client along with the response (SCM_RIGHTS) and closed by the server
+type File struct {
+	Result any
+	File   *os.File
+}
+
+// method is a registered handler and the class of operations it belongs to
+type method struct {
+	class   Class
+	handler Handler
+}
+
+// Server serves a session's control socket. Every request is checked
+// against the class of its method: clients that may read statistics cannot
+// stop the session or change its routes unless granted to.
+type Server struct {
+	path     string
+	access   Access
+	listener net.Listener
+	methods  map[string]method
+	conns    connset.Set
+}
+
+// Listen creates the control socket at path, owned by the access's owner
+// and accessible to the users it grants operations to. A stale socket left
+// by a crashed process is replaced.
+func Listen(path string, access Access) (*Server, error) {
+	mode, gid := access.socketMode()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chown(path, access.OwnerUID, gid); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set control socket owner: %w", err)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+
+	return &Server{
+		path:     path,
+		access:   access,
+		listener: l,
+		methods:  make(map[string]method),
+	}, nil
+}
+
+// Path returns the socket path
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Handle registers the handler of a method in a class of operations. Must
+// be called before Serve.
+func (s *Server) Handle(name string, class Class, h Handler) {
+	s.methods[name] = method{class: class, handler: h}
+}
+
+// Serve accepts clients until the server is closed
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.conns.Track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.conns.Untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops the server, closing all connections, and removes the socket
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.conns.Close()
+	os.Remove(s.path)
+	return err
+}
+
+// serveConn answers the requests of one client, one per line
+func (s *Server) serveConn(conn net.Conn) {
+	// Without credentials only tokens count
+	var peer *peerCred
+	if uc, ok := conn.(*net.UnixConn); ok {
+		cred, err := peerCredentials(uc)
+		if err != nil {
+			log.Debugf("Failed to get control socket peer credentials: %v", err)
+		}
+		peer = cred
+	}
+
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var resp Response
+		var file *os.File
+		var req Request
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp.Error = "invalid request"
+		} else {
+			resp, file = s.handle(peer, req)
+		}
+		if file != nil {
+			err = sendWithFile(conn, resp, file)
+			file.Close()
+		} else {
+			err = encoder.Encode(resp)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendWithFile writes a response with a file attached to it
+func sendWithFile(conn net.Conn, resp Response, file *os.File) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("cannot pass files over %s", conn.LocalAddr().Network())
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, _, err = uc.WriteMsgUnix(append(data, '\n'), unix.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// handle authorizes a request and runs its method, returning the file
+// that comes with the result, if any
+func (s *Server) handle(peer *peerCred, req Request) (Response, *os.File) {
+	m, ok := s.methods[req.Method]
+	if !ok {
+		return Response{Error: fmt.Sprintf("unknown method %q", req.Method)}, nil
+	}
+
+	class, err := s.access.classOf(peer, req.Token)
+	if err != nil {
+		log.Debugf("Control socket request %q rejected: %v", req.Method, err)
+		return Response{Error: err.Error()}, nil
+	}
+	if !class.Allows(m.class) {
+		log.Debugf("Control socket request %q needs %s, client has %q", req.Method, m.class, class)
+		return Response{Error: fmt.Sprintf("%v: %s needs %s access", ErrPermission, req.Method, m.class)}, nil
+	}
+
+	result, err := m.handler(req.Params)
+	if err != nil {
+		return Response{Error: err.Error()}, nil
+	}
+	var file *os.File
+	if f, ok := result.(File); ok {
+		result, file = f.Result, f.File
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return Response{Error: fmt.Sprintf("failed to encode result: %v", err)}, nil
+	}
+	return Response{Result: data}, file
+}
+
+// SetLogger sets the logger of the control socket servers
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
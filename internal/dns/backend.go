@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Backends of the system resolver configuration (see
+// SystemResolverConfig.SetBackend)
+const (
+	// BackendResolverFiles writes a file per domain to /etc/resolver (macOS)
+	BackendResolverFiles = "resolver-files"
+
+	// BackendScutil adds a supplemental resolver to the System
+	// Configuration dynamic store with scutil, like VPN clients do (macOS)
+	BackendScutil = "scutil"
+
+	// BackendResolvectl makes systemd-resolved send the queries for the
+	// domains over the TUN device's link (Linux)
+	BackendResolvectl = "resolvectl"
+
+	// BackendNone leaves the system resolver alone
+	BackendNone = "none"
+)
+
+// ParseBackend checks that a system resolver backend is available on this
+// platform; "" is the platform's DefaultBackend
+func ParseBackend(name string) (string, error) {
+	if name == "" {
+		return DefaultBackend, nil
+	}
+	if name == BackendNone || slices.Contains(platformBackends, name) {
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid DNS backend %q on %s (expected %s or %s)",
+		name, runtime.GOOS, strings.Join(platformBackends, ", "), BackendNone)
+}
+
+// extractBaseDomain extracts the base domain from a pattern
+func extractBaseDomain(pattern string) string {
+	domain := strings.TrimSpace(pattern)
+	domain = strings.TrimPrefix(domain, ".")
+	domain = strings.TrimSuffix(domain, ".")
+
+	if domain == "" || !strings.Contains(domain, ".") {
+		return ""
+	}
+
+	return domain
+}
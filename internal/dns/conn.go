@@ -0,0 +1,347 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPoolSize is the default number of TCP connections kept open to
+	// the DNS server
+	defaultPoolSize = 4
+
+	// idleConnTimeout is how long an idle TCP connection to the DNS server
+	// is kept for reuse. Servers close idle connections after a few seconds
+	// (RFC 7766), so older connections are dropped instead of tried.
+	idleConnTimeout = 10 * time.Second
+)
+
+// errQueryTimeout is returned when no response arrived before the deadline
+var errQueryTimeout = errors.New("DNS query timed out")
+
+// pooledConn is a persistent TCP connection to the DNS server carrying
+// length-prefixed messages (RFC 1035 section 4.2.2). Queries are pipelined:
+// each is sent with a connection-unique transaction ID and a reader
+// goroutine hands responses back by ID, so answers may arrive out of order
+// (RFC 7766 section 6.2.1.1).
+type pooledConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex // serializes writes of whole messages
+
+	mu       sync.Mutex
+	pending  map[uint16]chan []byte // in-flight queries by wire ID
+	nextID   uint16
+	lastUsed time.Time
+	err      error         // set once the connection has failed
+	done     chan struct{} // closed when the connection has failed
+}
+
+// newPooledConn wraps conn and starts reading responses from it
+func newPooledConn(conn net.Conn) *pooledConn {
+	c := &pooledConn{
+		conn:     conn,
+		pending:  make(map[uint16]chan []byte),
+		lastUsed: time.Now(),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// exchange sends a query and waits for its response. The response carries
+// the transaction ID of the original query.
+func (c *pooledConn) exchange(ctx context.Context, query []byte, deadline time.Time) ([]byte, error) {
+	ch := make(chan []byte, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	for c.pending[c.nextID] != nil {
+		c.nextID++
+	}
+	id := c.nextID
+	c.pending[id] = ch
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.lastUsed = time.Now()
+		c.mu.Unlock()
+	}()
+
+	// Send DNS query with TCP length prefix (2 bytes) and our wire ID
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg[0:2], uint16(len(query)))
+	copy(msg[2:], query)
+	binary.BigEndian.PutUint16(msg[2:4], id)
+
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(msg)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(fmt.Errorf("failed to send DNS query: %w", err))
+		return nil, c.err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case response := <-ch:
+		copy(response[0:2], query[0:2])
+		return response, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		// A server that stops answering is treated as unhealthy, so that
+		// later queries do not queue up behind it
+		c.fail(errQueryTimeout)
+		return nil, errQueryTimeout
+	}
+}
+
+// readLoop reads responses and hands them to the waiting queries
+func (c *pooledConn) readLoop() {
+	for {
+		// The response may span several TCP segments, so read exactly the
+		// length prefix and then exactly the announced number of bytes
+		var lengthBuf [2]byte
+		if _, err := io.ReadFull(c.conn, lengthBuf[:]); err != nil {
+			c.fail(fmt.Errorf("failed to read DNS response length: %w", err))
+			return
+		}
+
+		responseLen := int(binary.BigEndian.Uint16(lengthBuf[:]))
+		if responseLen < 12 {
+			c.fail(fmt.Errorf("DNS response too short (%d bytes)", responseLen))
+			return
+		}
+
+		response := make([]byte, responseLen)
+		if _, err := io.ReadFull(c.conn, response); err != nil {
+			c.fail(fmt.Errorf("failed to read DNS response: %w", err))
+			return
+		}
+
+		id := binary.BigEndian.Uint16(response[0:2])
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if ch == nil {
+			// Late answer to a query that already gave up
+			log.Debugf("DNS: discarding response with unexpected ID %d", id)
+			continue
+		}
+		ch <- response
+	}
+}
+
+// fail marks the connection as failed and closes it
+func (c *pooledConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// inFlight returns the number of queries waiting for a response
+func (c *pooledConn) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// healthy reports whether the connection can take new queries
+func (c *pooledConn) healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil && (len(c.pending) > 0 || time.Since(c.lastUsed) < idleConnTimeout)
+}
+
+// connPool keeps a small set of persistent connections to the DNS server
+type connPool struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	size    int
+	mu      sync.Mutex
+	conns   []*pooledConn
+	dialing int
+	dialed  *sync.Cond // broadcast when a dial finishes
+	closed  bool
+}
+
+// newConnPool creates a pool of at most size connections
+func newConnPool(size int, dial func(ctx context.Context) (net.Conn, error)) *connPool {
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	p := &connPool{dial: dial, size: size}
+	p.dialed = sync.NewCond(&p.mu)
+	return p
+}
+
+// get returns the least busy connection, dialing a new one while the pool
+// has room and every existing connection already has queries in flight.
+// The second return value reports whether an existing connection was reused.
+func (p *connPool) get(ctx context.Context) (*pooledConn, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, false, fmt.Errorf("DNS resolver is stopped")
+		}
+		p.pruneLocked()
+
+		var best *pooledConn
+		bestLoad := 0
+		for _, c := range p.conns {
+			if load := c.inFlight(); best == nil || load < bestLoad {
+				best, bestLoad = c, load
+			}
+		}
+
+		atCapacity := len(p.conns)+p.dialing >= p.size
+		if best != nil && (bestLoad == 0 || atCapacity) {
+			return best, true, nil
+		}
+		if !atCapacity {
+			break
+		}
+
+		// Every slot is still being dialed; wait for one to come up
+		// (dials are bounded by the resolver timeout)
+		p.dialed.Wait()
+	}
+
+	p.dialing++
+	p.mu.Unlock()
+
+	conn, err := p.dial(ctx)
+
+	p.mu.Lock()
+	p.dialing--
+	p.dialed.Broadcast()
+	if err != nil {
+		return nil, false, err
+	}
+
+	c := newPooledConn(conn)
+	if p.closed {
+		c.fail(fmt.Errorf("DNS resolver is stopped"))
+		return nil, false, c.err
+	}
+	p.conns = append(p.conns, c)
+	return c, false, nil
+}
+
+// prune closes idle and failed connections
+func (p *connPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked()
+}
+
+// pruneLocked is prune with p.mu held
+func (p *connPool) pruneLocked() {
+	kept := p.conns[:0]
+	for _, c := range p.conns {
+		if c.healthy() {
+			kept = append(kept, c)
+			continue
+		}
+		c.fail(fmt.Errorf("idle DNS connection closed"))
+	}
+	clear(p.conns[len(kept):])
+	p.conns = kept
+}
+
+// close closes every connection; later calls to get fail
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, c := range p.conns {
+		c.fail(fmt.Errorf("DNS resolver is stopped"))
+	}
+	p.conns = nil
+}
+
+// dial opens a new TCP connection to a DNS server, through the SOCKS5
+// proxy if one is configured
+func (r *Resolver) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if r.config.SOCKSDialer != nil {
+		// Try to dial through SOCKS5 using DialContext if available
+		if dialer, ok := r.config.SOCKSDialer.(interface {
+			DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+		}); ok {
+			dialCtx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+			defer cancel()
+			conn, err = dialer.DialContext(dialCtx, "tcp", addr)
+		} else {
+			// Fallback to regular Dial
+			conn, err = r.config.SOCKSDialer.Dial("tcp", addr)
+		}
+	} else {
+		// Direct connection (no SOCKS5)
+		dialer := &net.Dialer{Timeout: r.config.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// exchange sends a query to a DNS server over a pooled connection. A
+// failure on a reused connection (typically because the server closed it)
+// is retried once on a fresh connection.
+func (r *Resolver) exchange(ctx context.Context, u *upstream, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(r.config.Timeout)
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := u.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := conn.exchange(ctx, query, deadline)
+		if err == nil {
+			return response, nil
+		}
+
+		if attempt > 0 || !reused || errors.Is(err, errQueryTimeout) ||
+			ctx.Err() != nil || time.Now().After(deadline) {
+			return nil, err
+		}
+		log.Debugf("DNS: reused connection failed (%v), retrying", err)
+	}
+}
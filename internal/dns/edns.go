@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MinUDPSize is the UDP payload size every client must accept, and the
+	// limit for clients that do not advertise one with EDNS0 (RFC 1035)
+	MinUDPSize = 512
+
+	// maxUDPSize is the largest UDP payload that fits an IPv4 datagram
+	maxUDPSize = 65535 - 20 - 8
+)
+
+// TruncateUDP returns response unchanged if it fits in size bytes.
+// Otherwise it returns the header and question with the TC bit set (and the
+// OPT record, if any), telling the client to retry over TCP (RFC 7766).
+func TruncateUDP(response []byte, size int) []byte {
+	if len(response) <= size {
+		return response
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(response); err == nil {
+		truncated := dnsmessage.Message{
+			Header:    m.Header,
+			Questions: m.Questions,
+		}
+		truncated.Header.Truncated = true
+		for _, rr := range m.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				truncated.Additionals = append(truncated.Additionals, rr)
+			}
+		}
+		if out, err := truncated.Pack(); err == nil && len(out) <= size {
+			return out
+		}
+	}
+
+	// Unparseable response: keep only the header, with TC set and all
+	// section counts cleared
+	out := make([]byte, 12)
+	copy(out, response[:min(len(response), 12)])
+	out[2] |= 0x02
+	clear(out[4:12])
+	return out
+}
+
+// ErrorResponse builds an empty response to query with the given RCODE,
+// e.g. dnsmessage.RCodeRefused. It returns nil if query cannot be parsed.
+func ErrorResponse(query []byte, rcode dnsmessage.RCode) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		return nil
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               m.Header.ID,
+			Response:         true,
+			OpCode:           m.Header.OpCode,
+			RecursionDesired: m.Header.RecursionDesired,
+			RCode:            rcode,
+		},
+		Questions: m.Questions,
+	}
+
+	out, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
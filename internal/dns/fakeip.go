@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultFakeIPRange is the range fake addresses are handed out from:
+	// the benchmarking range (RFC 2544), which no real network uses
+	DefaultFakeIPRange = "198.18.0.0/15"
+
+	// fakeIPTTL is the TTL of fake answers in seconds. It is kept short so
+	// that clients do not hold on to addresses that a restart forgot.
+	fakeIPTTL = 10
+)
+
+// FakeIPPool hands out synthetic addresses for names matching its domain
+// patterns and maps them back to the names, so that connections can be
+// routed by domain: the tunnel's end resolves the name when it is dialed
+// through SOCKS5. Addresses are handed out in turn; once the range is used
+// up the oldest mappings are reused. A nil *FakeIPPool maps nothing.
+type FakeIPPool struct {
+	network  *net.IPNet
+	patterns []string
+
+	mu     sync.Mutex
+	byName map[string]uint32 // host offset by name
+	byHost map[uint32]string // name by host offset
+	next   uint32            // offset handed out next
+	size   uint32            // usable offsets, from 1
+}
+
+// NewFakeIPPool creates a pool handing out the addresses of cidr (an IPv4
+// range) for names matching patterns, each a name ("db.example.com") or a
+// wildcard matching its subdomains ("*.example.com")
+func NewFakeIPPool(cidr string, patterns []string) (*FakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake-IP range %q: %w", cidr, err)
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid fake-IP range %q: only IPv4 is supported", cidr)
+	}
+	ones, _ := network.Mask.Size()
+	if ones > 30 {
+		return nil, fmt.Errorf("invalid fake-IP range %q: must be /30 or larger", cidr)
+	}
+	network.IP = network.IP.To4()
+
+	p := &FakeIPPool{
+		network: network,
+		byName:  make(map[string]uint32),
+		byHost:  make(map[uint32]string),
+		next:    1,
+		// Without the network and broadcast addresses
+		size: uint32(1)<<(32-ones) - 2,
+	}
+	for _, pattern := range patterns {
+		normalized, err := parseDomainPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, normalized)
+	}
+	return p, nil
+}
+
+// parseDomainPattern validates and normalizes a domain pattern
+func parseDomainPattern(s string) (string, error) {
+	pattern := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") || strings.HasPrefix(name, ".") || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid domain pattern %q (expected a name like db.example.com or *.example.com)", s)
+	}
+	return pattern, nil
+}
+
+// Network returns the range addresses are handed out from
+func (p *FakeIPPool) Network() *net.IPNet {
+	if p == nil {
+		return nil
+	}
+	return p.network
+}
+
+// Patterns returns the domain patterns, normalized
+func (p *FakeIPPool) Patterns() []string {
+	if p == nil {
+		return nil
+	}
+	return p.patterns
+}
+
+// Suffixes returns the domains the patterns fall under, e.g. for the
+// system resolver configuration
+func (p *FakeIPPool) Suffixes() []string {
+	var suffixes []string
+	for _, pattern := range p.Patterns() {
+		suffixes = append(suffixes, strings.TrimPrefix(pattern, "*."))
+	}
+	return suffixes
+}
+
+// Matches reports whether a name gets fake addresses
+func (p *FakeIPPool) Matches(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, pattern := range p.Patterns() {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocate returns the fake address of a name, handing out one if it has
+// none
+func (p *FakeIPPool) Allocate(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	host, ok := p.byName[name]
+	if !ok {
+		host = p.next
+		p.next = p.next%p.size + 1
+		if old, used := p.byHost[host]; used {
+			log.Debugf("Fake IP: range used up, %s no longer maps to %s", p.addr(host), old)
+			delete(p.byName, old)
+		}
+		p.byName[name] = host
+		p.byHost[host] = name
+		log.Debugf("Fake IP: %s -> %s", name, p.addr(host))
+	}
+	return p.addr(host)
+}
+
+// Contains reports whether ip is in the fake range
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p != nil && p.network.Contains(ip)
+}
+
+// Lookup returns the name a fake address was handed out for. The second
+// return value is false if ip is not a fake address in use.
+func (p *FakeIPPool) Lookup(ip net.IP) (string, bool) {
+	if !p.Contains(ip) {
+		return "", false
+	}
+	host := binary.BigEndian.Uint32(ip.To4()) &^ binary.BigEndian.Uint32(p.network.Mask)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name, ok := p.byHost[host]
+	return name, ok
+}
+
+// Len returns how many names have a fake address
+func (p *FakeIPPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.byName)
+}
+
+// addr returns the address at a host offset of the range
+func (p *FakeIPPool) addr(host uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(p.network.IP)|host)
+	return ip
+}
+
+// answer builds the response to a query for a name with fake addresses:
+// its fake address for A queries, and no records (but no error either)
+// for AAAA, so that clients connect over IPv4. Other types are left to the
+// DNS server; ok is false for them.
+func (p *FakeIPPool) answer(query []byte, q *Query) ([]byte, bool) {
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return nil, false
+	}
+	name, err := dnsmessage.NewName(q.Name + ".")
+	if err != nil {
+		return nil, false
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 q.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   len(query) > 2 && query[2]&0x01 != 0,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{{Name: name, Type: q.Type, Class: q.Class}},
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], p.Allocate(q.Name))
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: fakeIPTTL},
+			Body:   &a,
+		}}
+	}
+
+	response, err := msg.Pack()
+	if err != nil {
+		log.Debugf("Fake IP: failed to pack answer for %s: %v", q.Name, err)
+		return nil, false
+	}
+	return response, true
+}
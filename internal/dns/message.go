@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Query is the parsed form of a DNS query message
+type Query struct {
+	ID    uint16
+	Name  string // question name without the trailing dot
+	Type  dnsmessage.Type
+	Class dnsmessage.Class
+
+	// EDNS is set if the query carries an EDNS0 OPT record (RFC 6891)
+	EDNS bool
+	// UDPSize is the largest UDP response the client accepts
+	// (MinUDPSize without EDNS0)
+	UDPSize int
+	// Options are the EDNS0 options of the OPT record
+	Options []dnsmessage.Option
+}
+
+// ParseQuery parses a DNS query message. Only the first question is
+// reported; compressed names are resolved.
+func ParseQuery(msg []byte) (*Query, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS header: %w", err)
+	}
+	if header.Response {
+		return nil, fmt.Errorf("DNS message is a response, not a query")
+	}
+
+	question, err := p.Question()
+	if errors.Is(err, dnsmessage.ErrSectionDone) {
+		return nil, fmt.Errorf("DNS query has no question")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS question: %w", err)
+	}
+
+	q := &Query{
+		ID:      header.ID,
+		Name:    strings.TrimSuffix(question.Name.String(), "."),
+		Type:    question.Type,
+		Class:   question.Class,
+		UDPSize: MinUDPSize,
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS question: %w", err)
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS answers: %w", err)
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS authorities: %w", err)
+	}
+
+	for {
+		h, err := p.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return q, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DNS additional record: %w", err)
+		}
+
+		if h.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, fmt.Errorf("failed to parse DNS additional record: %w", err)
+			}
+			continue
+		}
+
+		opt, err := p.OPTResource()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EDNS0 OPT record: %w", err)
+		}
+
+		// The OPT record's class carries the payload size
+		q.EDNS = true
+		q.UDPSize = min(max(int(h.Class), MinUDPSize), maxUDPSize)
+		q.Options = opt.Options
+		return q, nil
+	}
+}
+
+// String returns the question in "NAME TYPE" form, e.g. "db.example.com A"
+func (q *Query) String() string {
+	return q.Name + " " + strings.TrimPrefix(q.Type.String(), "Type")
+}
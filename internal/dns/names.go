@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxAddrNames bounds the addresses whose names are remembered; the
+// address answered longest ago is forgotten first
+const maxAddrNames = 4096
+
+// addrNames remembers which name the answers gave each address, so that
+// connections to it can be reported by name (the latest answer wins)
+type addrNames struct {
+	mu    sync.Mutex
+	names map[netip.Addr]string
+	order []netip.Addr // ring of the addresses, in the order first answered
+	next  int          // oldest entry of order once it is full
+}
+
+// record remembers the names of the A and AAAA records of a response, by
+// the question's name: that asked for, rather than the end of a CNAME chain
+func (a *addrNames) record(response []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(response); err != nil {
+		return
+	}
+	question, err := p.Question()
+	if err != nil {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	var addrs []netip.Addr
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			if r, err := p.AResource(); err == nil {
+				addrs = append(addrs, netip.AddrFrom4(r.A))
+			}
+		case dnsmessage.TypeAAAA:
+			if r, err := p.AAAAResource(); err == nil {
+				addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+			}
+		default:
+			err = p.SkipAnswer()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.names == nil {
+		a.names = make(map[netip.Addr]string)
+	}
+	for _, addr := range addrs {
+		if _, ok := a.names[addr]; !ok {
+			if len(a.order) < maxAddrNames {
+				a.order = append(a.order, addr)
+			} else {
+				delete(a.names, a.order[a.next])
+				a.order[a.next] = addr
+				a.next = (a.next + 1) % maxAddrNames
+			}
+		}
+		a.names[addr] = name
+	}
+}
+
+// lookup returns the name last answered for addr
+func (a *addrNames) lookup(addr netip.Addr) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	name, ok := a.names[addr.Unmap()]
+	return name, ok
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// resolvConfFiles list the DNS servers of the system resolver: the
+// generated /etc/resolv.conf (also on macOS, for its primary servers) and
+// the upstream servers behind systemd-resolved's stub
+var resolvConfFiles = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// SystemNameservers returns the addresses of the DNS servers the system
+// resolver asks, leaving out loopback stubs
+func SystemNameservers() []netip.Addr {
+	var servers []netip.Addr
+	for _, path := range resolvConfFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			// Link-local IPv6 servers carry a zone (fe80::1%en0)
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil || addr.IsLoopback() {
+				continue
+			}
+			addr = addr.Unmap()
+			if !slices.Contains(servers, addr) {
+				servers = append(servers, addr)
+			}
+		}
+		file.Close()
+	}
+	return servers
+}
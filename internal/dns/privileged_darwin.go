@@ -0,0 +1,89 @@
+//go:build darwin
+
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
+)
+
+// privileged changes the system resolver configuration in the helper, if
+// set
+var privileged *helper.Client
+
+// UseHelper has the privileged helper write the resolver files, set the
+// supplemental resolvers and flush the DNS cache, for a process not running
+// as root
+func UseHelper(c *helper.Client) {
+	privileged = c
+}
+
+// WriteResolverFile writes a file in /etc/resolver, creating the directory
+// if needed
+func WriteResolverFile(path string, content []byte) error {
+	if err := checkResolverPath(path); err != nil {
+		return err
+	}
+	if privileged != nil {
+		return privileged.WriteResolverFile(path, content)
+	}
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", resolverDir, err)
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// RenameResolverFile renames a file in /etc/resolver
+func RenameResolverFile(from, to string) error {
+	for _, path := range []string{from, to} {
+		if err := checkResolverPath(path); err != nil {
+			return err
+		}
+	}
+	if privileged != nil {
+		return privileged.RenameResolverFile(from, to)
+	}
+	return os.Rename(from, to)
+}
+
+// RemoveResolverFile removes a file from /etc/resolver
+func RemoveResolverFile(path string) error {
+	if err := checkResolverPath(path); err != nil {
+		return err
+	}
+	if privileged != nil {
+		return privileged.RemoveResolverFile(path)
+	}
+	return os.Remove(path)
+}
+
+// checkResolverPath checks that path is a file right in /etc/resolver
+func checkResolverPath(path string) error {
+	clean := filepath.Clean(path)
+	if clean != path || filepath.Dir(clean) != resolverDir || strings.HasPrefix(filepath.Base(clean), ".") {
+		return fmt.Errorf("%s is not a file in %s", path, resolverDir)
+	}
+	return nil
+}
+
+// Scutil runs scutil commands that only touch ssm-proxy's supplemental
+// resolvers, and returns its output
+func Scutil(commands string) (string, error) {
+	for _, line := range strings.Split(strings.TrimSpace(commands), "\n") {
+		verb, key, _ := strings.Cut(line, " ")
+		switch verb {
+		case "d.init", "d.add":
+		case "set", "remove", "show":
+			if !strings.HasPrefix(key, scutilKeyPrefix) || strings.ContainsAny(key, " \t") {
+				return "", fmt.Errorf("scutil key %q is not ssm-proxy's", key)
+			}
+		default:
+			return "", fmt.Errorf("unsupported scutil command %q", line)
+		}
+	}
+	return runScutil(commands)
+}
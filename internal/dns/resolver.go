@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sbkg0002/ssm-proxy/internal/nat"
+	"github.com/sbkg0002/ssm-proxy/internal/policy"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/proxy"
 )
 
@@ -21,16 +26,38 @@ type Config struct {
 	// If empty, all DNS queries will be routed through the tunnel
 	Domains []string
 
-	// Resolver is the DNS server address to use through the tunnel
-	// e.g., "10.0.0.2:53" or "169.254.169.253:53" (AWS VPC DNS)
+	// Resolvers are the addresses of the DNS servers to use through the
+	// tunnel, e.g. "169.254.169.253:53" (AWS VPC DNS) and "10.1.0.2:53"
+	// (an on-premises server), asked as Strategy says
 	// Note: DNS queries are sent via TCP for better SOCKS5 compatibility
-	Resolver string
+	Resolvers []string
+
+	// Strategy picks the DNS servers a query is sent to (default failover)
+	Strategy Strategy
 
 	// Timeout for DNS queries
 	Timeout time.Duration
 
+	// PoolSize is the number of persistent TCP connections kept open to
+	// each DNS server (default 4)
+	PoolSize int
+
 	// SOCKS5 dialer for routing DNS queries through the tunnel
 	SOCKSDialer proxy.Dialer
+
+	// NAT translates remote addresses in A records into the local ranges
+	// they are mapped to (nil disables rewriting)
+	NAT *nat.Table
+
+	// Rewrite rules applied to every response, after the NAT mappings
+	Rewrite []*RewriteRule
+
+	// FakeIP answers A queries for the names it matches with fake
+	// addresses instead of asking the DNS server (nil disables fake-IP mode)
+	FakeIP *FakeIPPool
+
+	// Policy refuses the queries for names it denies (nil allows all)
+	Policy *policy.Policy
 }
 
 // Resolver handles DNS resolution through the SSM tunnel
@@ -39,8 +66,49 @@ type Resolver struct {
 	cache       map[string]*cacheEntry
 	cacheMu     sync.RWMutex
 	socksDialer proxy.Dialer
+	rewriter    atomic.Pointer[Rewriter]
+	upstreams   []*upstream
+	names       addrNames // of the addresses answered
 	stopCh      chan struct{}
 	wg          sync.WaitGroup
+
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	failures    atomic.Uint64
+	nxDomain    atomic.Uint64
+	servFail    atomic.Uint64
+	otherDomain atomic.Uint64
+	truncated   atomic.Uint64
+	denied      atomic.Uint64
+	queries     queryStats
+}
+
+// Stats counts the queries a resolver answered
+type Stats struct {
+	CacheHits   uint64 // answered from the cache
+	CacheMisses uint64 // sent to the DNS server
+	Failures    uint64 // sent to the DNS server without an answer
+
+	// Answers of the DNS server with an error code
+	NXDomain uint64
+	ServFail uint64
+
+	// Fallbacks: queries outside the tunnel domains, left to other DNS
+	// servers, and UDP answers truncated for the client to retry over TCP
+	OtherDomain uint64
+	Truncated   uint64
+
+	// Denied are the queries refused by the destination policy
+	Denied uint64
+
+	// Queries for the tunnel domains by domain and type
+	Queries []QueryCount
+
+	// Latency of the DNS servers through the tunnel
+	Latency Latency
+
+	// Health and queries of each DNS server
+	Servers []ServerStats
 }
 
 type cacheEntry struct {
@@ -50,9 +118,14 @@ type cacheEntry struct {
 
 // NewResolver creates a new DNS resolver
 func NewResolver(config Config) (*Resolver, error) {
-	if config.Resolver == "" {
+	if len(config.Resolvers) == 0 {
 		return nil, fmt.Errorf("DNS resolver address is required")
 	}
+	strategy, err := ParseStrategy(string(config.Strategy))
+	if err != nil {
+		return nil, err
+	}
+	config.Strategy = strategy
 
 	if config.Timeout == 0 {
 		config.Timeout = 5 * time.Second
@@ -63,6 +136,14 @@ func NewResolver(config Config) (*Resolver, error) {
 		cache:  make(map[string]*cacheEntry),
 		stopCh: make(chan struct{}),
 	}
+	r.rewriter.Store(NewRewriter(rewriteRules(config.NAT, config.Rewrite)))
+	for _, addr := range config.Resolvers {
+		u := &upstream{addr: addr}
+		u.pool = newConnPool(config.PoolSize, func(ctx context.Context) (net.Conn, error) {
+			return r.dial(ctx, addr)
+		})
+		r.upstreams = append(r.upstreams, u)
+	}
 
 	// Start cache cleanup goroutine
 	r.wg.Add(1)
@@ -71,11 +152,55 @@ func NewResolver(config Config) (*Resolver, error) {
 	return r, nil
 }
 
+// rewriteRules returns the rules of NAT mappings, expressed as replace
+// rules from remote to local, followed by rewrite
+func rewriteRules(table *nat.Table, rewrite []*RewriteRule) []*RewriteRule {
+	var rules []*RewriteRule
+	for _, m := range table.Mappings() {
+		rules = append(rules, &RewriteRule{
+			Kind:   RewriteReplace,
+			From:   m.Remote,
+			To:     m.Local,
+			Source: "nat",
+		})
+	}
+	return append(rules, rewrite...)
+}
+
+// Reload replaces the rewrite rules (those of NAT mappings are kept) and
+// empties the cache, so that no answer rewritten by the old rules is served
+func (r *Resolver) Reload(rewrite []*RewriteRule) {
+	r.rewriter.Store(NewRewriter(rewriteRules(r.config.NAT, rewrite)))
+
+	r.cacheMu.Lock()
+	r.cache = make(map[string]*cacheEntry)
+	r.cacheMu.Unlock()
+}
+
 // ShouldHandle checks if a domain should be resolved through the tunnel
 func (r *Resolver) ShouldHandle(domain string) bool {
+	_, ok := r.matchDomain(domain)
+	return ok
+}
+
+// Accept reports whether a query should be resolved through the tunnel,
+// counting it by domain and type, or as one for another domain
+func (r *Resolver) Accept(q *Query) bool {
+	suffix, ok := r.matchDomain(q.Name)
+	if !ok {
+		r.otherDomain.Add(1)
+		return false
+	}
+	r.queries.countQuery(suffix, q.Type)
+	return true
+}
+
+// matchDomain returns the entry of Domains a domain falls under ("." if
+// all domains are resolved through the tunnel)
+func (r *Resolver) matchDomain(domain string) (string, bool) {
 	if len(r.config.Domains) == 0 {
 		// If no domains specified, handle all DNS queries
-		return true
+		return ".", true
 	}
 
 	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
@@ -84,103 +209,162 @@ func (r *Resolver) ShouldHandle(domain string) bool {
 
 		// Exact match
 		if domain == suffix {
-			return true
+			return suffix, true
 		}
 
 		// Suffix match
 		if strings.HasSuffix(domain, "."+suffix) {
-			return true
+			return suffix, true
 		}
 
 		// Handle patterns like ".amazonaws.com"
 		if strings.HasPrefix(r.config.Domains[0], ".") && strings.HasSuffix(domain, suffix) {
-			return true
+			return suffix, true
 		}
 	}
-	return false
+	return "", false
+}
+
+// TruncateUDP truncates a response to the client's UDP size like the
+// package's TruncateUDP, counting truncated answers
+func (r *Resolver) TruncateUDP(response []byte, size int) []byte {
+	if len(response) <= size {
+		return response
+	}
+	r.truncated.Add(1)
+	return TruncateUDP(response, size)
 }
 
 // Query performs a DNS query through the tunnel using TCP
 // TCP is used instead of UDP for better SOCKS5 compatibility
 func (r *Resolver) Query(ctx context.Context, queryData []byte) ([]byte, error) {
-	// Check cache first
-	cacheKey := string(queryData)
-	if cached := r.getFromCache(cacheKey); cached != nil {
-		log.Debugf("DNS: cache hit")
-		return cached, nil
+	if len(queryData) < 12 {
+		return nil, fmt.Errorf("DNS query too short")
 	}
 
-	// Create TCP connection through SOCKS5 proxy (if available) or direct
-	// TCP is used for DNS to ensure compatibility with SOCKS5 proxies
-	var conn net.Conn
-	var err error
-
-	if r.config.SOCKSDialer != nil {
-		// Try to dial through SOCKS5 using DialContext if available
-		if dialer, ok := r.config.SOCKSDialer.(interface {
-			DialContext(ctx context.Context, network, addr string) (net.Conn, error)
-		}); ok {
-			dialCtx, cancel := context.WithTimeout(ctx, r.config.Timeout)
-			defer cancel()
-			conn, err = dialer.DialContext(dialCtx, "tcp", r.config.Resolver)
-		} else {
-			// Fallback to regular Dial
-			conn, err = r.config.SOCKSDialer.Dial("tcp", r.config.Resolver)
+	// Names the destination policy denies are not looked up
+	if p := r.config.Policy; p != nil {
+		if q, err := ParseQuery(queryData); err == nil && !p.AllowsName(q.Name) {
+			r.denied.Add(1)
+			log.Debugf("DNS: refused %s (destination policy)", q)
+			return ErrorResponse(queryData, dnsmessage.RCodeRefused), nil
 		}
-	} else {
-		// Direct connection (no SOCKS5)
-		dialer := &net.Dialer{Timeout: r.config.Timeout}
-		conn, err = dialer.DialContext(ctx, "tcp", r.config.Resolver)
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to DNS server %s: %w", r.config.Resolver, err)
+	// Names routed by domain get fake addresses, whatever the DNS server
+	// would answer
+	if pool := r.config.FakeIP; pool != nil {
+		if q, err := ParseQuery(queryData); err == nil && pool.Matches(q.Name) {
+			if response, ok := pool.answer(queryData, q); ok {
+				log.Debugf("DNS: answered %s with a fake address", q)
+				return response, nil
+			}
+		}
 	}
-	defer conn.Close()
 
-	// Set deadline
-	deadline, ok := ctx.Deadline()
-	if !ok {
-		deadline = time.Now().Add(r.config.Timeout)
+	// Check cache first
+	key := cacheKey(queryData)
+	if cached := r.getFromCache(key); cached != nil {
+		r.cacheHits.Add(1)
+		log.Debugf("DNS: cache hit")
+		response := make([]byte, len(cached))
+		copy(response, cached)
+		copy(response[0:2], queryData[0:2])
+		r.names.record(response)
+		return response, nil
 	}
-	conn.SetDeadline(deadline)
 
-	// Send DNS query with TCP length prefix (2 bytes)
-	// TCP DNS queries are prefixed with a 2-byte length field
-	queryLen := uint16(len(queryData))
-	tcpQuery := make([]byte, 2+len(queryData))
-	tcpQuery[0] = byte(queryLen >> 8)
-	tcpQuery[1] = byte(queryLen)
-	copy(tcpQuery[2:], queryData)
-
-	_, err = conn.Write(tcpQuery)
+	// Send the query over TCP through the SOCKS5 proxy (if available)
+	// TCP is used for DNS to ensure compatibility with SOCKS5 proxies
+	r.cacheMisses.Add(1)
+	start := time.Now()
+	responseData, err := r.forward(ctx, queryData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send DNS query: %w", err)
+		r.failures.Add(1)
+		return nil, err
 	}
-
-	// Read TCP DNS response (first 2 bytes are length)
-	lengthBuf := make([]byte, 2)
-	_, err = conn.Read(lengthBuf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read DNS response length: %w", err)
+	r.queries.observeLatency(time.Since(start))
+	switch responseCode(responseData) {
+	case dnsmessage.RCodeNameError:
+		r.nxDomain.Add(1)
+	case dnsmessage.RCodeServerFailure:
+		r.servFail.Add(1)
 	}
 
-	responseLen := int(lengthBuf[0])<<8 | int(lengthBuf[1])
-	response := make([]byte, responseLen)
-	n, err := conn.Read(response)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read DNS response: %w", err)
+	// Apply NAT mappings and rewrite rules
+	if rewritten, err := r.rewriter.Load().Apply(responseData); err != nil {
+		log.Debugf("DNS: failed to rewrite response: %v", err)
+	} else {
+		responseData = rewritten
 	}
 
-	responseData := response[:n]
-
 	// Cache the response (simple TTL-based caching)
-	r.addToCache(cacheKey, responseData, 60*time.Second)
+	r.addToCache(key, responseData, 60*time.Second)
+	r.names.record(responseData)
 
-	log.Debugf("DNS: resolved query (%d bytes response)", n)
+	log.Debugf("DNS: resolved query (%d bytes response)", len(responseData))
 	return responseData, nil
 }
 
+// NameOf returns the name of the latest answer with addr (as rewritten,
+// so the address clients connect to), if the resolver still remembers it
+func (r *Resolver) NameOf(addr netip.Addr) (string, bool) {
+	return r.names.lookup(addr)
+}
+
+// RewriteRules returns the active rewrite rules, including those generated
+// from NAT mappings, with their hit counters
+func (r *Resolver) RewriteRules() []*RewriteRule {
+	return r.rewriter.Load().Rules()
+}
+
+// Lookup returns the cached response for a query without any network I/O.
+// The returned slice is shared and must not be modified; its transaction ID
+// is that of the query that populated the cache, not of queryData.
+func (r *Resolver) Lookup(queryData []byte) ([]byte, bool) {
+	if len(queryData) < 12 {
+		return nil, false
+	}
+	cached := r.getFromCache(cacheKey(queryData))
+	if cached != nil {
+		r.cacheHits.Add(1)
+	}
+	return cached, cached != nil
+}
+
+// Stats returns the query counters
+func (r *Resolver) Stats() Stats {
+	queries, latency := r.queries.snapshot()
+	return Stats{
+		CacheHits:   r.cacheHits.Load(),
+		CacheMisses: r.cacheMisses.Load(),
+		Failures:    r.failures.Load(),
+		NXDomain:    r.nxDomain.Load(),
+		ServFail:    r.servFail.Load(),
+		OtherDomain: r.otherDomain.Load(),
+		Truncated:   r.truncated.Load(),
+		Denied:      r.denied.Load(),
+		Queries:     queries,
+		Latency:     latency,
+		Servers:     r.serverStats(),
+	}
+}
+
+// serverStats returns the health and counters of each DNS server
+func (r *Resolver) serverStats() []ServerStats {
+	servers := make([]ServerStats, 0, len(r.upstreams))
+	for _, u := range r.upstreams {
+		servers = append(servers, u.stats())
+	}
+	return servers
+}
+
+// cacheKey identifies a query independently of its transaction ID, so that
+// repeated lookups of the same name hit the cache
+func cacheKey(queryData []byte) string {
+	return string(queryData[2:])
+}
+
 // getFromCache retrieves a DNS response from cache
 func (r *Resolver) getFromCache(key string) []byte {
 	r.cacheMu.RLock()
@@ -222,6 +406,9 @@ func (r *Resolver) cleanupLoop() {
 			return
 		case <-ticker.C:
 			r.cleanCache()
+			for _, u := range r.upstreams {
+				u.pool.prune()
+			}
 		}
 	}
 }
@@ -248,35 +435,20 @@ func (r *Resolver) Stop() {
 		close(r.stopCh)
 	}
 	r.wg.Wait()
+	for _, u := range r.upstreams {
+		u.pool.close()
+	}
 }
 
-// ExtractDomainFromQuery extracts the domain name from a DNS query packet
+// ExtractDomainFromQuery extracts the domain name from a DNS query packet,
+// or returns "" if the query cannot be parsed. Use ParseQuery to also get
+// the query type, class and EDNS0 options.
 func ExtractDomainFromQuery(query []byte) string {
-	if len(query) < 13 {
+	q, err := ParseQuery(query)
+	if err != nil {
 		return ""
 	}
-
-	// Skip DNS header (12 bytes)
-	pos := 12
-	domain := ""
-
-	for pos < len(query) {
-		length := int(query[pos])
-		if length == 0 {
-			break
-		}
-		if length > 63 || pos+1+length > len(query) {
-			return ""
-		}
-
-		if domain != "" {
-			domain += "."
-		}
-		domain += string(query[pos+1 : pos+1+length])
-		pos += 1 + length
-	}
-
-	return domain
+	return q.Name
 }
 
 // SetLogger sets the logger for the DNS resolver
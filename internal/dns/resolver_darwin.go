@@ -3,20 +3,40 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
 const resolverDir = "/etc/resolver"
 
-// MacOSResolverConfig manages macOS DNS resolver configuration
+// DefaultBackend is the system resolver backend used unless another is set
+const DefaultBackend = BackendResolverFiles
+
+// platformBackends are the system resolver backends available on macOS
+var platformBackends = []string{BackendResolverFiles, BackendScutil}
+
+// resolverFileMarker is the first line of our resolver files, so that files
+// left by a session that died can be told from the user's own
+const resolverFileMarker = "# Managed by ssm-proxy"
+
+// MacOSResolverConfig manages macOS DNS resolver configuration, as
+// /etc/resolver files or a supplemental resolver set with scutil
 type MacOSResolverConfig struct {
 	domains   []string
 	dnsServer string
+	port      int      // 0 for the default, 53
+	adopt     bool     // take over our files left by a previous session
 	created   []string // Track created files for cleanup
+
+	backend   string // BackendResolverFiles or BackendScutil
+	iface     string // TUN device, naming the scutil service
+	scutilSet bool   // the supplemental resolver was set
 }
 
 // NewMacOSResolverConfig creates a new macOS resolver configuration manager
@@ -25,11 +45,41 @@ func NewMacOSResolverConfig(domains []string, dnsServer string) *MacOSResolverCo
 		domains:   domains,
 		dnsServer: dnsServer,
 		created:   make([]string, 0),
+		backend:   DefaultBackend,
 	}
 }
 
+// SetBackend selects how the system resolver is configured, one of the
+// backends ParseBackend accepts (but BackendNone). Must be called before
+// Setup.
+func (m *MacOSResolverConfig) SetBackend(backend string) {
+	m.backend = backend
+}
+
+// SetInterface names the TUN device the queries go through; the scutil
+// backend names its service after it. Must be called before Setup.
+func (m *MacOSResolverConfig) SetInterface(name string) {
+	m.iface = name
+}
+
+// SetPort makes the system send the queries to port instead of 53, e.g.
+// that of a local Server. Must be called before Setup.
+func (m *MacOSResolverConfig) SetPort(port int) {
+	m.port = port
+}
+
+// Adopt makes Setup take over resolver files left by a previous ssm-proxy
+// session (one that died without cleaning up) instead of backing them up
+// and restoring them on Cleanup. Must be called before Setup.
+func (m *MacOSResolverConfig) Adopt() {
+	m.adopt = true
+}
+
 // Setup configures macOS resolver files for the specified domains
 func (m *MacOSResolverConfig) Setup() error {
+	if m.backend == BackendScutil {
+		return m.setupScutil()
+	}
 	if len(m.domains) == 0 {
 		log.Info("No DNS domains specified, skipping macOS resolver configuration")
 		return nil
@@ -37,11 +87,6 @@ func (m *MacOSResolverConfig) Setup() error {
 
 	log.Info("Configuring macOS DNS resolver...")
 
-	// Create /etc/resolver directory if it doesn't exist
-	if err := os.MkdirAll(resolverDir, 0755); err != nil {
-		return fmt.Errorf("failed to create %s directory: %w (are you running as root?)", resolverDir, err)
-	}
-
 	// Create resolver file for each domain
 	for _, domain := range m.domains {
 		baseDomain := extractBaseDomain(domain)
@@ -53,10 +98,15 @@ func (m *MacOSResolverConfig) Setup() error {
 		resolverFile := filepath.Join(resolverDir, baseDomain)
 
 		// Check if file already exists
-		if _, err := os.Stat(resolverFile); err == nil {
+		if content, err := os.ReadFile(resolverFile); err == nil && isOwnResolverFile(content) && m.adopt {
+			log.Infof("  Adopting resolver file %s left by a previous session", resolverFile)
+		} else if err == nil {
+			if isOwnResolverFile(content) {
+				log.Warnf("Resolver file %s was left by a previous session; use --adopt to take it over instead of restoring it on exit", resolverFile)
+			}
 			// File exists, back it up
-			backupFile := resolverFile + ".ssm-proxy-backup"
-			if err := os.Rename(resolverFile, backupFile); err != nil {
+			backupFile := resolverFile + backupSuffix
+			if err := RenameResolverFile(resolverFile, backupFile); err != nil {
 				log.Warnf("Failed to backup existing resolver file %s: %v", resolverFile, err)
 			} else {
 				log.Debugf("  Backed up existing resolver file to %s", backupFile)
@@ -64,15 +114,11 @@ func (m *MacOSResolverConfig) Setup() error {
 			}
 		}
 
-		// Create resolver file content
-		// Only include IP address (without port) as macOS resolver format expects
 		dnsIP := extractIPPort(m.dnsServer)
-		content := fmt.Sprintf("nameserver %s\nsearch_order 1\n", dnsIP)
-
-		if err := os.WriteFile(resolverFile, []byte(content), 0644); err != nil {
+		if err := WriteResolverFile(resolverFile, m.resolverFileContent()); err != nil {
 			// Clean up any files we created
 			m.Cleanup()
-			return fmt.Errorf("failed to create resolver file %s: %w", resolverFile, err)
+			return fmt.Errorf("failed to create resolver file %s: %w (are you running as root?)", resolverFile, err)
 		}
 
 		m.created = append(m.created, resolverFile)
@@ -90,21 +136,86 @@ func (m *MacOSResolverConfig) Setup() error {
 	return nil
 }
 
+// resolverFileContent returns the content of our resolver files. Only the IP
+// address (without port) is included, as the macOS resolver format expects;
+// a port set with SetPort is a separate entry.
+func (m *MacOSResolverConfig) resolverFileContent() []byte {
+	content := fmt.Sprintf("%s\nnameserver %s\n", resolverFileMarker, extractIPPort(m.dnsServer))
+	if m.port != 0 && m.port != 53 {
+		content += fmt.Sprintf("port %d\n", m.port)
+	}
+	return []byte(content + "search_order 1\n")
+}
+
+// isOwnResolverFile reports whether a resolver file was written by
+// ssm-proxy, including versions that did not mark their files
+func isOwnResolverFile(content []byte) bool {
+	s := string(content)
+	return strings.HasPrefix(s, resolverFileMarker+"\n") ||
+		(strings.HasPrefix(s, "nameserver ") && strings.HasSuffix(s, "search_order 1\n"))
+}
+
+// Verify checks that the resolver files written by Setup are still in place
+func (m *MacOSResolverConfig) Verify() bool {
+	if m.backend == BackendScutil {
+		return m.verifyScutil()
+	}
+	return VerifyResolverConfiguration(m.domains, m.dnsServer)
+}
+
+// Repair rewrites resolver files that were removed or changed since Setup.
+// Backups made by Setup are kept, so Cleanup still restores them.
+func (m *MacOSResolverConfig) Repair() error {
+	if m.backend == BackendScutil {
+		return m.setupScutil()
+	}
+	content := m.resolverFileContent()
+	for _, domain := range m.domains {
+		baseDomain := extractBaseDomain(domain)
+		if baseDomain == "" {
+			continue
+		}
+
+		resolverFile := filepath.Join(resolverDir, baseDomain)
+		if current, err := os.ReadFile(resolverFile); err == nil && string(current) == string(content) {
+			continue
+		}
+
+		if err := WriteResolverFile(resolverFile, content); err != nil {
+			return fmt.Errorf("failed to rewrite resolver file %s: %w", resolverFile, err)
+		}
+		if !slices.Contains(m.created, resolverFile) {
+			m.created = append(m.created, resolverFile)
+		}
+		log.Infof("  ✓ Restored DNS resolver: %s → %s", baseDomain, extractIPPort(m.dnsServer))
+	}
+
+	if err := FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	}
+	return nil
+}
+
 // Cleanup removes all resolver files created by Setup and restores backups
 func (m *MacOSResolverConfig) Cleanup() error {
+	if m.backend == BackendScutil {
+		return m.cleanupScutil()
+	}
 	if len(m.created) == 0 {
 		return nil
 	}
 
 	log.Info("Cleaning up macOS DNS resolver configuration...")
 
+	// In reverse, so that our file is removed before the backup made for
+	// it is restored in its place
 	var errors []string
-	for _, file := range m.created {
+	for _, file := range slices.Backward(m.created) {
 		// Check if this is a backup file
-		if strings.HasSuffix(file, ".ssm-proxy-backup") {
+		if strings.HasSuffix(file, backupSuffix) {
 			// Restore backup
-			originalFile := strings.TrimSuffix(file, ".ssm-proxy-backup")
-			if err := os.Rename(file, originalFile); err != nil {
+			originalFile := strings.TrimSuffix(file, backupSuffix)
+			if err := RenameResolverFile(file, originalFile); err != nil {
 				if !os.IsNotExist(err) {
 					errors = append(errors, fmt.Sprintf("restore %s: %v", file, err))
 					log.Warnf("  Failed to restore backup %s: %v", file, err)
@@ -114,7 +225,7 @@ func (m *MacOSResolverConfig) Cleanup() error {
 			}
 		} else {
 			// Remove resolver file we created
-			if err := os.Remove(file); err != nil {
+			if err := RemoveResolverFile(file); err != nil {
 				if !os.IsNotExist(err) {
 					errors = append(errors, fmt.Sprintf("remove %s: %v", file, err))
 					log.Warnf("  Failed to remove %s: %v", file, err)
@@ -142,19 +253,6 @@ func (m *MacOSResolverConfig) Cleanup() error {
 	return nil
 }
 
-// extractBaseDomain extracts the base domain from a pattern
-func extractBaseDomain(pattern string) string {
-	domain := strings.TrimSpace(pattern)
-	domain = strings.TrimPrefix(domain, ".")
-	domain = strings.TrimSuffix(domain, ".")
-
-	if domain == "" || !strings.Contains(domain, ".") {
-		return ""
-	}
-
-	return domain
-}
-
 // extractIPPort extracts just the IP address from "IP:PORT" format
 // macOS resolver files expect just the IP without the port
 func extractIPPort(addr string) string {
@@ -167,6 +265,9 @@ func extractIPPort(addr string) string {
 
 // FlushDNSCache flushes the macOS DNS cache
 func FlushDNSCache() error {
+	if privileged != nil {
+		return privileged.FlushDNSCache()
+	}
 	log.Debug("Flushing macOS DNS cache...")
 
 	// Try dscacheutil (works on all modern macOS versions)
@@ -212,3 +313,65 @@ func VerifyResolverConfiguration(domains []string, dnsServer string) bool {
 
 	return true
 }
+
+// SystemResolverConfig is the platform's split-DNS configuration backend
+// (/etc/resolver files on macOS)
+type SystemResolverConfig = MacOSResolverConfig
+
+// NewSystemResolverConfig creates the platform's split-DNS configuration
+// manager for the specified domains
+func NewSystemResolverConfig(domains []string, dnsServer string) *SystemResolverConfig {
+	return NewMacOSResolverConfig(domains, dnsServer)
+}
+
+// backupSuffix is appended to the resolver files of others that Setup
+// replaced
+const backupSuffix = ".ssm-proxy-backup"
+
+// LeftoverResolverFiles returns the resolver files written by ssm-proxy and
+// the backups it made of others' files. With no session running they were
+// left by one that died.
+func LeftoverResolverFiles() ([]string, error) {
+	entries, err := os.ReadDir(resolverDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", resolverDir, err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		path := filepath.Join(resolverDir, entry.Name())
+		if strings.HasSuffix(entry.Name(), backupSuffix) {
+			files = append(files, path)
+		} else if content, err := os.ReadFile(path); err == nil && isOwnResolverFile(content) {
+			// Replaced by its backup, if there is one
+			if _, err := os.Stat(path + backupSuffix); err != nil {
+				files = append(files, path)
+			}
+		}
+	}
+	return files, nil
+}
+
+// RemoveLeftoverResolverFile removes a resolver file written by ssm-proxy,
+// or puts a backup back in place of the file it was made for
+func RemoveLeftoverResolverFile(path string) error {
+	original, isBackup := strings.CutSuffix(path, backupSuffix)
+	if !isBackup {
+		if err := RemoveResolverFile(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return nil
+	}
+
+	// Our file in its place goes; anyone else's stays
+	if content, err := os.ReadFile(original); err == nil && !isOwnResolverFile(content) {
+		return fmt.Errorf("%s has been replaced since, keeping the backup %s", original, path)
+	}
+	if err := RenameResolverFile(path, original); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", original, err)
+	}
+	return nil
+}
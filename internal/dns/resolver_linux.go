@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultBackend is the system resolver backend used unless another is set
+const DefaultBackend = BackendResolvectl
+
+// platformBackends are the system resolver backends available on Linux
+var platformBackends = []string{BackendResolvectl}
+
+// SystemResolverConfig is the platform's split-DNS configuration backend.
+// Linux has no equivalent of /etc/resolver; with systemd-resolved, the DNS
+// server and routing domains are set on the TUN device's link instead, and
+// without it Setup only explains what to configure by hand.
+type SystemResolverConfig struct {
+	domains   []string
+	dnsServer string
+	port      int // 0 for the default, 53
+
+	iface      string // TUN device the link settings go on
+	configured bool   // the link settings were made
+}
+
+// NewSystemResolverConfig creates the platform's split-DNS configuration
+// manager for the specified domains
+func NewSystemResolverConfig(domains []string, dnsServer string) *SystemResolverConfig {
+	return &SystemResolverConfig{
+		domains:   domains,
+		dnsServer: dnsServer,
+	}
+}
+
+// SetBackend selects how the system resolver is configured. resolvectl is
+// the only backend on Linux, so this is a no-op.
+func (c *SystemResolverConfig) SetBackend(backend string) {}
+
+// SetInterface names the TUN device whose link gets the DNS settings. Must
+// be called before Setup.
+func (c *SystemResolverConfig) SetInterface(name string) {
+	c.iface = name
+}
+
+// SetPort makes the system send the queries to port instead of 53, e.g.
+// that of a local Server. Must be called before Setup.
+func (c *SystemResolverConfig) SetPort(port int) {
+	c.port = port
+}
+
+// Adopt is a no-op, as the link settings go away with the TUN device of the
+// previous session
+func (c *SystemResolverConfig) Adopt() {}
+
+// server returns the DNS server as resolvectl takes it, with the port if
+// it is not 53
+func (c *SystemResolverConfig) server() string {
+	server := extractIPPort(c.dnsServer)
+	if c.port != 0 && c.port != 53 {
+		server = net.JoinHostPort(server, strconv.Itoa(c.port))
+	}
+	return server
+}
+
+// routingDomains returns the domains as systemd-resolved routing domains,
+// which only steer queries and are not added to single-label names
+func (c *SystemResolverConfig) routingDomains() []string {
+	var domains []string
+	for _, domain := range c.domains {
+		baseDomain := extractBaseDomain(domain)
+		if baseDomain == "" {
+			log.Warnf("Skipping invalid domain pattern: %s", domain)
+			continue
+		}
+		domains = append(domains, "~"+baseDomain)
+	}
+	return domains
+}
+
+// Setup makes systemd-resolved send the queries for the domains to the DNS
+// server over the TUN device's link. Without resolvectl it reports what to
+// configure by hand instead.
+func (c *SystemResolverConfig) Setup() error {
+	domains := c.routingDomains()
+	if len(domains) == 0 {
+		log.Info("No DNS domains specified, skipping systemd-resolved configuration")
+		return nil
+	}
+	if _, err := exec.LookPath("resolvectl"); err != nil || c.iface == "" {
+		return fmt.Errorf("automatic DNS configuration needs systemd-resolved; "+
+			"send queries for %s to %s yourself (e.g. with resolvectl dns/domain on the TUN device)",
+			strings.Join(c.domains, ", "), c.server())
+	}
+
+	log.Info("Configuring systemd-resolved...")
+
+	if err := resolvectl("dns", c.iface, c.server()); err != nil {
+		return fmt.Errorf("failed to set DNS server on %s: %w", c.iface, err)
+	}
+	c.configured = true
+	if err := resolvectl(append([]string{"domain", c.iface}, domains...)...); err != nil {
+		c.Cleanup()
+		return fmt.Errorf("failed to set DNS domains on %s: %w", c.iface, err)
+	}
+	// Keep the link from answering every other name; older versions of
+	// systemd-resolved only use it for its routing domains anyway
+	if err := resolvectl("default-route", c.iface, "false"); err != nil {
+		log.Debugf("Failed to clear default DNS route of %s: %v", c.iface, err)
+	}
+
+	log.Infof("  ✓ Configured DNS resolver: %s → %s on %s",
+		strings.Join(domains, ", "), c.server(), c.iface)
+
+	if err := FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	}
+	return nil
+}
+
+// Cleanup reverts the link settings made by Setup. Nothing is left to
+// revert once the TUN device is gone.
+func (c *SystemResolverConfig) Cleanup() error {
+	if !c.configured {
+		return nil
+	}
+	c.configured = false
+
+	if _, err := net.InterfaceByName(c.iface); err != nil {
+		log.Debugf("  %s is gone with its DNS settings", c.iface)
+		return nil
+	}
+	if err := resolvectl("revert", c.iface); err != nil {
+		return fmt.Errorf("failed to revert DNS settings of %s: %w", c.iface, err)
+	}
+	log.Info("  ✓ systemd-resolved cleanup complete")
+	return nil
+}
+
+// Verify reports whether the TUN device's link still has the DNS server and
+// every domain
+func (c *SystemResolverConfig) Verify() bool {
+	if !c.configured {
+		return false
+	}
+	servers, err := resolvectlOutput("dns", c.iface)
+	if err != nil || !slices.Contains(servers, c.server()) {
+		return false
+	}
+	domains, err := resolvectlOutput("domain", c.iface)
+	if err != nil {
+		return false
+	}
+	for _, domain := range c.routingDomains() {
+		if !slices.Contains(domains, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// Repair sets the link's DNS settings again
+func (c *SystemResolverConfig) Repair() error {
+	return c.Setup()
+}
+
+// resolvectl runs resolvectl with args
+func resolvectl(args ...string) error {
+	if output, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvectl %s: %s: %w", args[0], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// resolvectlOutput runs a resolvectl query about one link and returns the
+// values it lists after "Link N (iface):"
+func resolvectlOutput(args ...string) ([]string, error) {
+	output, err := exec.Command("resolvectl", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("resolvectl %s: %w", args[0], err)
+	}
+	_, values, _ := strings.Cut(string(output), "):")
+	return strings.Fields(values), nil
+}
+
+// extractIPPort extracts the IP from "ip:port" format
+func extractIPPort(addr string) string {
+	if strings.Contains(addr, ":") {
+		parts := strings.Split(addr, ":")
+		return parts[0]
+	}
+	return addr
+}
+
+// FlushDNSCache flushes the systemd-resolved cache, if it is in use
+func FlushDNSCache() error {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		log.Debug("resolvectl not found, no DNS cache to flush")
+		return nil
+	}
+
+	log.Debug("Flushing systemd-resolved DNS cache...")
+	if output, err := exec.Command("resolvectl", "flush-caches").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to flush systemd-resolved cache: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// VerifyResolverConfiguration reports whether the system resolver is
+// configured for the domains. Link settings are not known without the
+// interface, so this always returns false; see SystemResolverConfig.Verify.
+func VerifyResolverConfiguration(domains []string, dnsServer string) bool {
+	return false
+}
+
+// LeftoverResolverFiles returns nothing on Linux: the link settings made
+// with systemd-resolved go away with the TUN device
+func LeftoverResolverFiles() ([]string, error) {
+	return nil, nil
+}
+
+// RemoveLeftoverResolverFile is not needed on Linux
+func RemoveLeftoverResolverFile(path string) error {
+	return fmt.Errorf("no resolver files on Linux")
+}
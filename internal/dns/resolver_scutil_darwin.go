@@ -0,0 +1,128 @@
+//go:build darwin
+
+package dns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// scutilKeyPrefix starts the dynamic store keys of our supplemental
+// resolvers
+const scutilKeyPrefix = "State:/Network/Service/ssm-proxy-"
+
+// scutilKey returns the dynamic store key of our supplemental resolver,
+// named after the TUN device so that sessions do not overwrite each other
+func (m *MacOSResolverConfig) scutilKey() string {
+	id := m.iface
+	if id == "" {
+		id = strconv.Itoa(os.Getpid())
+	}
+	return scutilKeyPrefix + id + "/DNS"
+}
+
+// scutilDomains returns the base domains the supplemental resolver answers
+func (m *MacOSResolverConfig) scutilDomains() []string {
+	var domains []string
+	for _, domain := range m.domains {
+		baseDomain := extractBaseDomain(domain)
+		if baseDomain == "" {
+			log.Warnf("Skipping invalid domain pattern: %s", domain)
+			continue
+		}
+		domains = append(domains, baseDomain)
+	}
+	return domains
+}
+
+// setupScutil adds a supplemental resolver for the domains to the System
+// Configuration dynamic store, as VPN clients do. Unlike /etc/resolver
+// files it leaves nothing behind on disk, and the store forgets it on
+// reboot.
+func (m *MacOSResolverConfig) setupScutil() error {
+	domains := m.scutilDomains()
+	if len(domains) == 0 {
+		log.Info("No DNS domains specified, skipping macOS resolver configuration")
+		return nil
+	}
+
+	log.Info("Configuring macOS DNS resolver with scutil...")
+
+	dnsIP := extractIPPort(m.dnsServer)
+	var script strings.Builder
+	script.WriteString("d.init\n")
+	fmt.Fprintf(&script, "d.add ServerAddresses * %s\n", dnsIP)
+	fmt.Fprintf(&script, "d.add SupplementalMatchDomains * %s\n", strings.Join(domains, " "))
+	if m.port != 0 && m.port != 53 {
+		fmt.Fprintf(&script, "d.add ServerPort # %d\n", m.port)
+	}
+	fmt.Fprintf(&script, "set %s\n", m.scutilKey())
+
+	if _, err := runScutil(script.String()); err != nil {
+		return fmt.Errorf("failed to set supplemental DNS resolver: %w (are you running as root?)", err)
+	}
+	m.scutilSet = true
+	log.Infof("  ✓ Configured supplemental DNS resolver: %s → %s", strings.Join(domains, ", "), dnsIP)
+
+	if err := FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache: %v", err)
+	} else {
+		log.Debug("  ✓ DNS cache flushed")
+	}
+	return nil
+}
+
+// verifyScutil reports whether our supplemental resolver is still in the
+// dynamic store with the DNS server and every domain
+func (m *MacOSResolverConfig) verifyScutil() bool {
+	out, err := runScutil("show " + m.scutilKey() + "\n")
+	if err != nil || strings.Contains(out, "No such key") {
+		return false
+	}
+	if !strings.Contains(out, extractIPPort(m.dnsServer)) {
+		return false
+	}
+	for _, domain := range m.scutilDomains() {
+		if !strings.Contains(out, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanupScutil removes our supplemental resolver from the dynamic store
+func (m *MacOSResolverConfig) cleanupScutil() error {
+	if !m.scutilSet {
+		return nil
+	}
+
+	log.Info("Cleaning up macOS DNS resolver configuration...")
+	if _, err := runScutil("remove " + m.scutilKey() + "\n"); err != nil {
+		return fmt.Errorf("failed to remove supplemental DNS resolver: %w", err)
+	}
+	m.scutilSet = false
+
+	if err := FlushDNSCache(); err != nil {
+		log.Warnf("Failed to flush DNS cache after cleanup: %v", err)
+	}
+	log.Info("  ✓ macOS DNS resolver cleanup complete")
+	return nil
+}
+
+// runScutil runs scutil with the commands on its standard input, in the
+// privileged helper if set, and returns its output
+func runScutil(commands string) (string, error) {
+	if privileged != nil {
+		return privileged.Scutil(commands)
+	}
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(commands)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("scutil: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Rewrite rule kinds
+const (
+	// RewriteReplace replaces A/AAAA answers inside a network (or equal to an
+	// address) with the corresponding address of another network
+	RewriteReplace = "replace"
+	// RewriteStripAAAA removes AAAA records from responses
+	RewriteStripAAAA = "strip-aaaa"
+	// RewriteTTL forces the TTL of every answer record
+	RewriteTTL = "ttl"
+)
+
+// RewriteRule is a single DNS answer rewrite rule. Rules are written as
+// KIND[:ARG][@DOMAIN], e.g. "replace:10.0.0.0/16=10.200.0.0/16",
+// "strip-aaaa@internal.example.com" or "ttl:30".
+type RewriteRule struct {
+	Kind   string
+	Domain string     // optional domain suffix the rule is limited to
+	From   *net.IPNet // replace: addresses to match
+	To     *net.IPNet // replace: replacement network (same prefix length)
+	TTL    uint32     // ttl: forced TTL in seconds
+	Source string     // where the rule came from, e.g. "nat" (informational)
+
+	hits atomic.Uint64
+}
+
+// ParseRewriteRule parses a rule in KIND[:ARG][@DOMAIN] notation
+func ParseRewriteRule(s string) (*RewriteRule, error) {
+	spec, domain, _ := strings.Cut(strings.TrimSpace(s), "@")
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	rule := &RewriteRule{
+		Kind:   strings.ToLower(kind),
+		Domain: strings.ToLower(strings.Trim(domain, ".")),
+	}
+
+	switch rule.Kind {
+	case RewriteReplace:
+		fromStr, toStr, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rewrite rule %q, expected replace:MATCH=REPLACEMENT", s)
+		}
+		from, err := parseAddrOrCIDR(fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %w", s, err)
+		}
+		to, err := parseAddrOrCIDR(toStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %w", s, err)
+		}
+		fromOnes, fromBits := from.Mask.Size()
+		toOnes, toBits := to.Mask.Size()
+		if fromOnes != toOnes || fromBits != toBits {
+			return nil, fmt.Errorf("invalid rewrite rule %q: match and replacement must have the same prefix length", s)
+		}
+		rule.From, rule.To = from, to
+
+	case RewriteStripAAAA:
+		if arg != "" {
+			return nil, fmt.Errorf("invalid rewrite rule %q: strip-aaaa takes no argument", s)
+		}
+
+	case RewriteTTL:
+		ttl, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: TTL must be a number of seconds", s)
+		}
+		rule.TTL = uint32(ttl)
+
+	default:
+		return nil, fmt.Errorf("invalid rewrite rule %q: unknown kind %q (expected replace, strip-aaaa or ttl)", s, kind)
+	}
+
+	return rule, nil
+}
+
+// String returns the rule in the notation accepted by ParseRewriteRule
+func (r *RewriteRule) String() string {
+	var s string
+	switch r.Kind {
+	case RewriteReplace:
+		s = fmt.Sprintf("%s:%s=%s", r.Kind, r.From, r.To)
+	case RewriteTTL:
+		s = fmt.Sprintf("%s:%d", r.Kind, r.TTL)
+	default:
+		s = r.Kind
+	}
+	if r.Domain != "" {
+		s += "@" + r.Domain
+	}
+	return s
+}
+
+// Hits returns how many records the rule has rewritten or removed
+func (r *RewriteRule) Hits() uint64 {
+	return r.hits.Load()
+}
+
+// appliesTo reports whether the rule is in scope for a query name
+func (r *RewriteRule) appliesTo(name string) bool {
+	if r.Domain == "" {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == r.Domain || strings.HasSuffix(name, "."+r.Domain)
+}
+
+// Rewriter applies an ordered list of rewrite rules to DNS responses
+type Rewriter struct {
+	rules []*RewriteRule
+}
+
+// NewRewriter creates a rewriter for the given rules
+func NewRewriter(rules []*RewriteRule) *Rewriter {
+	return &Rewriter{rules: rules}
+}
+
+// Rules returns the configured rules (with their hit counters)
+func (w *Rewriter) Rules() []*RewriteRule {
+	if w == nil {
+		return nil
+	}
+	return w.rules
+}
+
+// Apply rewrites a DNS response according to the rules. The original message
+// is returned unchanged if no rule matched.
+func (w *Rewriter) Apply(msg []byte) ([]byte, error) {
+	if w == nil || len(w.rules) == 0 {
+		return msg, nil
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg, fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+
+	qname := ""
+	if len(m.Questions) > 0 {
+		qname = m.Questions[0].Name.String()
+	}
+
+	changed := false
+	for _, rule := range w.rules {
+		if !rule.appliesTo(qname) {
+			continue
+		}
+		for _, section := range []*[]dnsmessage.Resource{&m.Answers, &m.Authorities, &m.Additionals} {
+			n := rule.apply(section)
+			if n > 0 {
+				rule.hits.Add(uint64(n))
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return msg, nil
+	}
+
+	out, err := m.Pack()
+	if err != nil {
+		return msg, fmt.Errorf("failed to pack rewritten DNS response: %w", err)
+	}
+	return out, nil
+}
+
+// apply rewrites the records of one message section and returns how many
+// records were changed or removed
+func (r *RewriteRule) apply(records *[]dnsmessage.Resource) int {
+	hits := 0
+	kept := (*records)[:0]
+
+	for _, rr := range *records {
+		switch r.Kind {
+		case RewriteReplace:
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				if ip, ok := r.replace(body.A[:]); ok {
+					copy(body.A[:], ip)
+					hits++
+				}
+			case *dnsmessage.AAAAResource:
+				if ip, ok := r.replace(body.AAAA[:]); ok {
+					copy(body.AAAA[:], ip)
+					hits++
+				}
+			}
+
+		case RewriteStripAAAA:
+			if rr.Header.Type == dnsmessage.TypeAAAA {
+				hits++
+				continue
+			}
+
+		case RewriteTTL:
+			if rr.Header.Type != dnsmessage.TypeOPT && rr.Header.TTL != r.TTL {
+				rr.Header.TTL = r.TTL
+				hits++
+			}
+		}
+		kept = append(kept, rr)
+	}
+
+	*records = kept
+	return hits
+}
+
+// replace maps ip from the rule's From network into its To network,
+// keeping the host bits
+func (r *RewriteRule) replace(ip net.IP) (net.IP, bool) {
+	if len(ip) != len(r.From.IP) || !r.From.Contains(ip) {
+		return nil, false
+	}
+
+	out := make(net.IP, len(ip))
+	for i := range ip {
+		out[i] = r.To.IP[i]&r.From.Mask[i] | ip[i]&^r.From.Mask[i]
+	}
+	return out, true
+}
+
+// parseAddrOrCIDR parses a CIDR block or a single address (as a host route),
+// normalizing IPv4 to its 4-byte form
+func parseAddrOrCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		network.IP = ip4
+	}
+	return network, nil
+}
@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxServerInFlight bounds the queries a Server resolves concurrently
+const maxServerInFlight = 64
+
+// Server is a local DNS server answering queries for the tunnel's domains
+// through a Resolver, over UDP and TCP. Pointing the system resolver at it
+// (see SystemResolverConfig.SetPort) keeps split DNS working even when
+// queries would never be routed into the TUN device.
+type Server struct {
+	udp *net.UDPConn
+	tcp net.Listener
+	sem chan struct{} // bounds queries in flight
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // TCP clients, closed by Close
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Listen opens the UDP and TCP sockets of a local DNS server on addr
+// (host:port, port 53 if omitted)
+func Listen(addr string) (*Server, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS listen address %s: %w", addr, err)
+	}
+
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DNS on udp %s: %w", addr, err)
+	}
+	// The same port over TCP, for clients retrying truncated answers
+	tcpAddr := net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port))
+	tcp, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("failed to listen for DNS on tcp %s: %w", tcpAddr, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		udp:    udp,
+		tcp:    tcp,
+		sem:    make(chan struct{}, maxServerInFlight),
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.udp.LocalAddr().(*net.UDPAddr)
+}
+
+// Serve answers queries with resolver until the server is closed
+func (s *Server) Serve(resolver *Resolver) {
+	s.wg.Add(1)
+	go s.serveTCP(resolver)
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debugf("DNS server: failed to read query: %v", err)
+			}
+			return
+		}
+		if n < 12 {
+			continue
+		}
+
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			// The client will retry; queueing would only add latency
+			log.Debugf("DNS server: %d queries in flight, dropping query", maxServerInFlight)
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-s.sem }()
+
+			response, udpSize := s.answer(resolver, query)
+			if response == nil {
+				return
+			}
+			if _, err := s.udp.WriteToUDP(resolver.TruncateUDP(response, udpSize), client); err != nil {
+				log.Debugf("DNS server: failed to write response: %v", err)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts TCP clients until the server is closed
+func (s *Server) serveTCP(resolver *Resolver) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debugf("DNS server: failed to accept connection: %v", err)
+			}
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.serveConn(resolver, conn)
+		}()
+	}
+}
+
+// serveConn answers the length-prefixed queries of a TCP client, in
+// completion order as RFC 7766 allows
+func (s *Server) serveConn(resolver *Resolver, conn net.Conn) {
+	var writeMu sync.Mutex
+	var queries sync.WaitGroup
+	defer queries.Wait()
+
+	for {
+		var lengthBuf [2]byte
+		if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lengthBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if len(query) < 12 {
+			return
+		}
+
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+
+			response, _ := s.answer(resolver, query)
+			if response == nil {
+				return
+			}
+
+			msg := make([]byte, 2+len(response))
+			binary.BigEndian.PutUint16(msg[0:2], uint16(len(response)))
+			copy(msg[2:], response)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if _, err := conn.Write(msg); err != nil {
+				log.Debugf("DNS server: failed to write TCP response: %v", err)
+			}
+		}()
+	}
+}
+
+// answer resolves a query and returns the response with the largest UDP
+// response the client accepts. Queries outside the tunnel domains are
+// refused and failures answered with SERVFAIL, so clients fall back to
+// other servers instead of timing out.
+func (s *Server) answer(resolver *Resolver, query []byte) ([]byte, int) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		log.Debugf("DNS server: refusing unparseable query: %v", err)
+		return ErrorResponse(query, dnsmessage.RCodeFormatError), MinUDPSize
+	}
+	domain := q.String()
+
+	if !resolver.Accept(q) {
+		log.Debugf("DNS server: refusing query for %s", domain)
+		return ErrorResponse(query, dnsmessage.RCodeRefused), q.UDPSize
+	}
+
+	response, err := resolver.Query(s.ctx, query)
+	if err != nil {
+		log.Debugf("DNS server: query failed for %s: %v", domain, err)
+		return ErrorResponse(query, dnsmessage.RCodeServerFailure), q.UDPSize
+	}
+	log.Debugf("DNS server: answered %s (%d bytes)", domain, len(response))
+	return response, q.UDPSize
+}
+
+// track registers a TCP client to be closed by Close; it returns false once
+// the server is closed
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack closes a TCP client and forgets it
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// Close stops the server, abandoning the queries in flight
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+	err := s.udp.Close()
+	if tcpErr := s.tcp.Close(); err == nil {
+		err = tcpErr
+	}
+	s.wg.Wait()
+	return err
+}
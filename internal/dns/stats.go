@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// latencyWindow is how many of the latest answers from the DNS server the
+// latency percentiles are taken over
+const latencyWindow = 1024
+
+// QueryCount is the number of queries for a tunnel domain and query type
+type QueryCount struct {
+	Domain string // the Domains entry matched, "." if all are resolved
+	Type   string // e.g. "A", "AAAA", or "other"
+	Count  uint64
+}
+
+// Latency summarizes how long the DNS server took to answer through the
+// tunnel
+type Latency struct {
+	// Percentiles of the latest answers
+	P50, P90, P99 time.Duration
+
+	// Totals of all answers
+	Sum   time.Duration
+	Count uint64
+}
+
+// queryKey identifies the queries counted together
+type queryKey struct {
+	domain, qtype string
+}
+
+// queryStats counts queries by domain and type and keeps the latest
+// latencies of the DNS server
+type queryStats struct {
+	mu      sync.Mutex
+	queries map[queryKey]uint64
+
+	window     [latencyWindow]time.Duration // ring buffer
+	next       int
+	filled     int
+	latencySum time.Duration
+	latencyN   uint64
+}
+
+// countQuery counts a query for a tunnel domain
+func (s *queryStats) countQuery(domain string, qtype dnsmessage.Type) {
+	key := queryKey{domain, typeName(qtype)}
+	s.mu.Lock()
+	if s.queries == nil {
+		s.queries = make(map[queryKey]uint64)
+	}
+	s.queries[key]++
+	s.mu.Unlock()
+}
+
+// observeLatency records how long the DNS server took to answer
+func (s *queryStats) observeLatency(d time.Duration) {
+	s.mu.Lock()
+	s.window[s.next] = d
+	s.next = (s.next + 1) % latencyWindow
+	s.filled = min(s.filled+1, latencyWindow)
+	s.latencySum += d
+	s.latencyN++
+	s.mu.Unlock()
+}
+
+// snapshot returns the query counts, sorted by domain and type, and the
+// latency summary
+func (s *queryStats) snapshot() ([]QueryCount, Latency) {
+	s.mu.Lock()
+	counts := make([]QueryCount, 0, len(s.queries))
+	for key, n := range s.queries {
+		counts = append(counts, QueryCount{Domain: key.domain, Type: key.qtype, Count: n})
+	}
+	latest := slices.Clone(s.window[:s.filled])
+	latency := Latency{Sum: s.latencySum, Count: s.latencyN}
+	s.mu.Unlock()
+
+	slices.SortFunc(counts, func(a, b QueryCount) int {
+		return cmp.Or(cmp.Compare(a.Domain, b.Domain), cmp.Compare(a.Type, b.Type))
+	})
+
+	slices.Sort(latest)
+	latency.P50 = percentile(latest, 0.50)
+	latency.P90 = percentile(latest, 0.90)
+	latency.P99 = percentile(latest, 0.99)
+	return counts, latency
+}
+
+// percentile returns the p-th percentile (nearest rank) of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+// typeName returns the name of a query type for counting, "other" for
+// types without one
+func typeName(t dnsmessage.Type) string {
+	name := strings.TrimPrefix(t.String(), "Type")
+	if _, err := strconv.Atoi(name); err == nil {
+		return "other"
+	}
+	return name
+}
+
+// responseCode returns the RCODE of a DNS message
+func responseCode(msg []byte) dnsmessage.RCode {
+	if len(msg) < 4 {
+		return dnsmessage.RCodeSuccess
+	}
+	return dnsmessage.RCode(msg[3] & 0x0f)
+}
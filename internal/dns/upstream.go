@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Strategy is how a resolver with several DNS servers picks the ones a
+// query is sent to
+type Strategy string
+
+const (
+	// StrategyFailover sends a query to the first healthy server, and to
+	// the next ones only if it fails
+	StrategyFailover Strategy = "failover"
+
+	// StrategyRace sends a query to every healthy server at once and takes
+	// the first answer
+	StrategyRace Strategy = "race"
+)
+
+const (
+	// unhealthyAfter is how many queries in a row a DNS server fails
+	// before it is marked unhealthy
+	unhealthyAfter = 2
+
+	// unhealthyFor is how long an unhealthy DNS server is only asked after
+	// the healthy ones failed. It is tried again first afterwards.
+	unhealthyFor = 30 * time.Second
+)
+
+// ParseStrategy parses a strategy name ("" is failover)
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "", StrategyFailover:
+		return StrategyFailover, nil
+	case StrategyRace:
+		return StrategyRace, nil
+	}
+	return "", fmt.Errorf("invalid DNS strategy %q (expected %s or %s)", s, StrategyFailover, StrategyRace)
+}
+
+// ServerStats is the health and query counts of one DNS server
+type ServerStats struct {
+	Address   string
+	Healthy   bool
+	Queries   uint64 // sent to the server
+	Failures  uint64 // sent to the server without an answer
+	LastError string // of the latest failure, while unhealthy
+}
+
+// upstream is one DNS server of a resolver with its connections and health
+type upstream struct {
+	addr string
+	pool *connPool
+
+	queries  atomic.Uint64
+	failures atomic.Uint64
+
+	mu        sync.Mutex
+	failed    int       // queries failed in a row
+	downUntil time.Time // unhealthy until then
+	lastErr   error
+}
+
+// healthy reports whether the server is asked before the unhealthy ones
+func (u *upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !time.Now().Before(u.downUntil)
+}
+
+// record updates the server's health with the outcome of a query
+func (u *upstream) record(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err == nil {
+		if u.failed >= unhealthyAfter {
+			log.Infof("DNS server %s is answering again", u.addr)
+		}
+		u.failed, u.downUntil, u.lastErr = 0, time.Time{}, nil
+		return
+	}
+
+	u.failures.Add(1)
+	u.failed++
+	u.lastErr = err
+	if u.failed < unhealthyAfter {
+		return
+	}
+	if u.failed == unhealthyAfter {
+		log.Warnf("DNS server %s is not answering (%v); asking it last for %s", u.addr, err, unhealthyFor)
+	}
+	u.downUntil = time.Now().Add(unhealthyFor)
+}
+
+// stats returns the server's health and counters
+func (u *upstream) stats() ServerStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := ServerStats{
+		Address:  u.addr,
+		Healthy:  u.failed < unhealthyAfter,
+		Queries:  u.queries.Load(),
+		Failures: u.failures.Load(),
+	}
+	if !s.Healthy && u.lastErr != nil {
+		s.LastError = u.lastErr.Error()
+	}
+	return s
+}
+
+// byHealth returns the DNS servers with the healthy ones first, each in
+// configuration order, and how many are healthy
+func (r *Resolver) byHealth() ([]*upstream, int) {
+	servers := make([]*upstream, 0, len(r.upstreams))
+	var unhealthy []*upstream
+	for _, u := range r.upstreams {
+		if u.healthy() {
+			servers = append(servers, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(servers, unhealthy...), len(servers)
+}
+
+// forward sends a query to the DNS servers as the strategy says and returns
+// the first usable answer. Unhealthy servers are only asked once the
+// healthy ones failed, so that a server that is down does not slow down
+// every query.
+func (r *Resolver) forward(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+
+	servers, healthy := r.byHealth()
+	if r.config.Strategy == StrategyRace && healthy > 1 {
+		response, err := r.race(ctx, query, servers[:healthy])
+		if err == nil || healthy == len(servers) || ctx.Err() != nil {
+			return response, err
+		}
+		log.Debugf("DNS: no healthy server answered (%v), asking the others", err)
+		servers = servers[healthy:]
+	}
+	return r.failover(ctx, query, servers)
+}
+
+// failover asks the servers in turn until one answers, leaving each of the
+// servers after it a share of the remaining time
+func (r *Resolver) failover(ctx context.Context, query []byte, servers []*upstream) ([]byte, error) {
+	var fallback []byte
+	var lastErr error
+	for i, u := range servers {
+		deadline, _ := ctx.Deadline()
+		share := time.Until(deadline) / time.Duration(len(servers)-i)
+		attemptCtx, cancel := context.WithTimeout(ctx, share)
+		response, err := r.exchangeWith(attemptCtx, u, query)
+		cancel()
+
+		switch {
+		case err != nil:
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if i < len(servers)-1 {
+				log.Debugf("DNS: %s failed (%v), asking %s", u.addr, err, servers[i+1].addr)
+			}
+		case retryable(response):
+			// Another server may know better; this answer is kept in case
+			// none does
+			fallback = response
+		default:
+			return response, nil
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, lastErr
+}
+
+// race asks the servers at once and returns the first usable answer,
+// abandoning the other queries
+func (r *Resolver) race(ctx context.Context, query []byte, servers []*upstream) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		response []byte
+		err      error
+	}
+	results := make(chan result, len(servers))
+	for _, u := range servers {
+		go func() {
+			response, err := r.exchangeWith(ctx, u, query)
+			results <- result{response, err}
+		}()
+	}
+
+	var fallback []byte
+	var lastErr error
+	for range servers {
+		res := <-results
+		switch {
+		case res.err != nil:
+			lastErr = res.err
+		case retryable(res.response):
+			fallback = res.response
+		default:
+			return res.response, nil
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, lastErr
+}
+
+// exchangeWith sends a query to one server and records the outcome in its
+// health. Queries abandoned by a race do not count against it.
+func (r *Resolver) exchangeWith(ctx context.Context, u *upstream, query []byte) ([]byte, error) {
+	u.queries.Add(1)
+	response, err := r.exchange(ctx, u, query)
+	if err != nil && errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	u.record(err)
+	return response, err
+}
+
+// retryable reports whether another server should be asked for a better
+// answer than this one (SERVFAIL or REFUSED)
+func retryable(response []byte) bool {
+	switch responseCode(response) {
+	case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// maxDestinations bounds the destinations counted. Once full, the
+// destination with the least traffic makes room for a new one, so the
+// busiest destinations stay while scans of many addresses come and go.
+const maxDestinations = 1024
+
+// DestinationStats are the traffic counters of one destination: an
+// address and port reached through the tunnel
+type DestinationStats struct {
+	Protocol string         // "tcp", "udp", "icmp" or the protocol number
+	Addr     netip.AddrPort // destination on the TUN side (before NAT); port 0 for ICMP
+	Dst      string         // destination as seen by the proxy (after NAT, names for fake IPs)
+
+	PacketsTX uint64
+	PacketsRX uint64
+	BytesTX   uint64
+	BytesRX   uint64
+
+	// Flows are the TCP connections and UDP associations opened to it
+	Flows uint64
+}
+
+// destinationKey identifies a destination
+type destinationKey struct {
+	protocol uint8
+	addr     netip.AddrPort
+}
+
+// destinationCounter counts the traffic of one destination
+type destinationCounter struct {
+	packetsTX, packetsRX uint64
+	bytesTX, bytesRX     uint64
+	flows                uint64
+}
+
+// destinationTable holds the bounded per-destination counters
+type destinationTable struct {
+	mu      sync.Mutex
+	entries map[destinationKey]*destinationCounter
+	evicted uint64
+}
+
+// counter returns the counter of key, making room for it if needed.
+// Must be called with mu held.
+func (d *destinationTable) counter(key destinationKey) *destinationCounter {
+	if c, ok := d.entries[key]; ok {
+		return c
+	}
+	if d.entries == nil {
+		d.entries = make(map[destinationKey]*destinationCounter)
+	}
+	if len(d.entries) >= maxDestinations {
+		var smallest destinationKey
+		least := ^uint64(0)
+		for k, c := range d.entries {
+			if total := c.bytesTX + c.bytesRX; total < least {
+				smallest, least = k, total
+			}
+		}
+		delete(d.entries, smallest)
+		d.evicted++
+	}
+	c := &destinationCounter{}
+	d.entries[key] = c
+	return c
+}
+
+// CountDestination counts a packet sent to (tx) or received from a
+// destination
+func (s *Stats) CountDestination(protocol uint8, addr netip.AddrPort, tx bool, bytes int) {
+	d := &s.destinations
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.counter(destinationKey{protocol, addr})
+	if tx {
+		c.packetsTX++
+		c.bytesTX += uint64(bytes)
+	} else {
+		c.packetsRX++
+		c.bytesRX += uint64(bytes)
+	}
+}
+
+// DestinationFlow counts a flow opened to a destination
+func (s *Stats) DestinationFlow(protocol uint8, addr netip.AddrPort) {
+	d := &s.destinations
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counter(destinationKey{protocol, addr}).flows++
+}
+
+// TopDestinations returns the n destinations with the most traffic (all
+// of them if n <= 0), busiest first, and how many were dropped from the
+// table to keep it bounded
+func (s *Stats) TopDestinations(n int) ([]DestinationStats, uint64) {
+	d := &s.destinations
+	d.mu.Lock()
+	stats := make([]DestinationStats, 0, len(d.entries))
+	for k, c := range d.entries {
+		stats = append(stats, DestinationStats{
+			Protocol:  protocolName(k.protocol),
+			Addr:      k.addr,
+			Dst:       k.addr.String(),
+			PacketsTX: c.packetsTX,
+			PacketsRX: c.packetsRX,
+			BytesTX:   c.bytesTX,
+			BytesRX:   c.bytesRX,
+			Flows:     c.flows,
+		})
+	}
+	evicted := d.evicted
+	d.mu.Unlock()
+
+	slices.SortFunc(stats, func(a, b DestinationStats) int {
+		if a, b := a.BytesTX+a.BytesRX, b.BytesTX+b.BytesRX; a != b {
+			if a > b {
+				return -1
+			}
+			return 1
+		}
+		return a.Addr.Compare(b.Addr)
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats, evicted
+}
+
+// protocolName returns the name of an IP protocol number
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	case protoICMP, protoICMPv6:
+		return "icmp"
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// packetDestination returns the remote end of a packet: its destination
+// if sent into the tunnel, its source if received from it. Ports are only
+// known for TCP and UDP packets that are not later fragments.
+func packetDestination(packet []byte, p ipPacket, tx bool) (uint8, netip.AddrPort) {
+	addr, offset := p.dst, 2
+	if !tx {
+		addr, offset = p.src, 0
+	}
+
+	protocol := p.protocol
+	if protocol == protoICMPv6 {
+		protocol = protoICMP
+	}
+	if protocol != protoTCP && protocol != protoUDP {
+		return protocol, netip.AddrPortFrom(addr, 0)
+	}
+	if addr.Is4() && binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return protocol, netip.AddrPortFrom(addr, 0)
+	}
+	if len(p.payload) < 4 {
+		return protocol, netip.AddrPortFrom(addr, 0)
+	}
+	return protocol, netip.AddrPortFrom(addr, binary.BigEndian.Uint16(p.payload[offset:]))
+}
+
+// TopDestinations returns the n destinations with the most traffic (all
+// if n <= 0), busiest first, with the addresses translated like the
+// proxy sees them, and how many destinations were dropped from the table
+func (t *TunToSOCKS) TopDestinations(n int) ([]DestinationStats, uint64) {
+	stats, evicted := t.stats.TopDestinations(n)
+	for i := range stats {
+		ip := addrIP(stats[i].Addr.Addr())
+		if remoteIP, ok := t.nat.ToRemote(ip); ok {
+			ip = remoteIP
+		}
+		host, _ := t.remoteHost(ip)
+		if stats[i].Addr.Port() == 0 {
+			stats[i].Dst = host
+		} else {
+			stats[i].Dst = net.JoinHostPort(host, strconv.Itoa(int(stats[i].Addr.Port())))
+		}
+	}
+	return stats, evicted
+}
@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// FlowSelector reports whether a new flow from src to dst (the address the
+// client sent to, before NAT) is relayed through the tunnel; protocol is
+// "tcp" or "udp"
+type FlowSelector func(protocol string, src, dst netip.AddrPort) bool
+
+// SetFlowSelector relays through the tunnel only the flows selected, e.g.
+// those of some applications. TCP connections it does not select are
+// made with direct instead, as if the tunnel were not there (direct must
+// not route them back into the TUN device); other UDP flows are dropped.
+// Must be called before Start.
+func (t *TunToSOCKS) SetFlowSelector(selected FlowSelector, direct Dialer) {
+	t.selected = selected
+	t.direct = direct
+}
+
+// tunneled reports whether a new flow goes through the tunnel
+func (t *TunToSOCKS) tunneled(protocol string, src, dst netip.AddrPort) bool {
+	return t.selected == nil || t.selected(protocol, src, dst)
+}
+
+// forwardDirect connects a TCP connection the flow selector left out
+// straight to its destination, dst
+func (t *TunToSOCKS) forwardDirect(ctx context.Context, r *tcp.ForwarderRequest, dst netip.AddrPort) {
+	// Fake addresses only stand for names within the tunnel
+	if t.fakeIP.Contains(addrIP(dst.Addr())) {
+		log.Debugf("Refusing direct connection to fake address %s", dst)
+		r.Complete(true)
+		return
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, t.dialTimeout)
+	remote, err := t.direct.DialContext(dialCtx, "tcp", dst.String())
+	cancel()
+	if err != nil {
+		log.Debugf("Direct dial failed for %s: %v", dst, err)
+		r.Complete(true)
+		return
+	}
+
+	client, err := acceptTCP(r)
+	if err != nil {
+		log.Debugf("Failed to accept direct connection to %s: %v", dst, err)
+		remote.Close()
+		return
+	}
+
+	t.trackConn(client)
+	t.trackConn(remote)
+	t.wg.Add(1)
+	go t.relayDirect(client, remote)
+}
+
+// relayDirect copies data between the client and a direct connection until
+// both directions are closed, passing on half-closes
+func (t *TunToSOCKS) relayDirect(client *clientConn, remote net.Conn) {
+	defer t.wg.Done()
+	defer t.untrackConn(client)
+	defer t.untrackConn(remote)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(remote, client)
+		closeWrite(remote)
+	}()
+
+	io.Copy(client, remote)
+	closeWrite(client)
+	<-done
+}
+
+// directAddr returns the address and port of one end of a connection
+func directAddr(ip []byte, port uint16) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), port)
+}
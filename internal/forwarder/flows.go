@@ -0,0 +1,284 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is a connection relayed through the tunnel
+type Flow struct {
+	Protocol string // "tcp" or "udp"
+	Src      string // client address
+	Dst      string // destination as seen by the proxy (after NAT)
+	Host     string // name of the destination, if known (fake IPs, DNS answers)
+	Started  time.Time
+	Ended    time.Time // zero while the flow is open
+
+	// Payload bytes sent into the tunnel and received back
+	BytesTX uint64
+	BytesRX uint64
+}
+
+// CIDRStats are the traffic counters of one routed CIDR block
+type CIDRStats struct {
+	CIDR      string
+	PacketsTX uint64
+	PacketsRX uint64
+	BytesTX   uint64
+	BytesRX   uint64
+}
+
+// flow is a relayed connection and its live counters
+type flow struct {
+	protocol string
+	src, dst string
+	host     string
+	started  time.Time
+	tx, rx   atomic.Uint64
+}
+
+// snapshot returns the flow's current state
+func (f *flow) snapshot() Flow {
+	return Flow{
+		Protocol: f.protocol,
+		Src:      f.src,
+		Dst:      f.dst,
+		Host:     f.host,
+		Started:  f.started,
+		BytesTX:  f.tx.Load(),
+		BytesRX:  f.rx.Load(),
+	}
+}
+
+// SetFlowEnded sets a function called with every relayed connection once
+// it ends (e.g. to log it). It must not block. Must be called before Start.
+func (t *TunToSOCKS) SetFlowEnded(fn func(Flow)) {
+	t.flowEnded = fn
+}
+
+// endFlow reports the end of a flow to the SetFlowEnded function
+func (t *TunToSOCKS) endFlow(f *flow) {
+	if t.flowEnded == nil {
+		return
+	}
+	snapshot := f.snapshot()
+	snapshot.Ended = time.Now()
+	t.flowEnded(snapshot)
+}
+
+// hostName returns the name of a destination: the name a fake address
+// stands for (dstHost), else the name DNS answered with addr, the address
+// the client connected to
+func (t *TunToSOCKS) hostName(addr netip.Addr, dstHost string) string {
+	if _, err := netip.ParseAddr(dstHost); err != nil {
+		return dstHost
+	}
+	if t.dnsResolver != nil {
+		if name, ok := t.dnsResolver.NameOf(addr); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+// Read reads from the underlying reader
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// cidrCounter counts the packets of one CIDR block
+type cidrCounter struct {
+	prefix               netip.Prefix
+	packetsTX, packetsRX atomic.Uint64
+	bytesTX, bytesRX     atomic.Uint64
+}
+
+// cidrTable maps packets to the CIDR blocks they were routed by, most
+// specific first
+type cidrTable []*cidrCounter
+
+// lookup returns the counter of the most specific block containing addr
+func (c cidrTable) lookup(addr netip.Addr) *cidrCounter {
+	for _, counter := range c {
+		if counter.prefix.Contains(addr) {
+			return counter
+		}
+	}
+	return nil
+}
+
+// cidrStats holds the per-CIDR counters. The table is replaced as a whole,
+// so counting never takes a lock.
+type cidrStats struct {
+	mu    sync.Mutex // serializes SetCIDRs
+	table atomic.Pointer[cidrTable]
+}
+
+// SetCIDRs sets the CIDR blocks traffic is counted by. Counters of blocks
+// that were already set are kept, so it can be called again when routes
+// are added or removed while running. Invalid blocks are ignored.
+func (t *TunToSOCKS) SetCIDRs(cidrs []string) {
+	t.cidrs.mu.Lock()
+	defer t.cidrs.mu.Unlock()
+
+	existing := make(map[netip.Prefix]*cidrCounter)
+	if old := t.cidrs.table.Load(); old != nil {
+		for _, counter := range *old {
+			existing[counter.prefix] = counter
+		}
+	}
+
+	var table cidrTable
+	seen := make(map[netip.Prefix]bool)
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		prefix = prefix.Masked()
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+
+		counter := existing[prefix]
+		if counter == nil {
+			counter = &cidrCounter{prefix: prefix}
+		}
+		table = append(table, counter)
+	}
+	slices.SortStableFunc(table, func(a, b *cidrCounter) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	t.cidrs.table.Store(&table)
+}
+
+// CIDRStats returns the traffic counters of the blocks set with SetCIDRs,
+// most specific first. A packet is counted in the most specific block
+// containing its remote address only.
+func (t *TunToSOCKS) CIDRStats() []CIDRStats {
+	table := t.cidrs.table.Load()
+	if table == nil {
+		return nil
+	}
+
+	stats := make([]CIDRStats, 0, len(*table))
+	for _, counter := range *table {
+		stats = append(stats, CIDRStats{
+			CIDR:      counter.prefix.String(),
+			PacketsTX: counter.packetsTX.Load(),
+			PacketsRX: counter.packetsRX.Load(),
+			BytesTX:   counter.bytesTX.Load(),
+			BytesRX:   counter.bytesRX.Load(),
+		})
+	}
+	return stats
+}
+
+// countTX counts a packet read from the TUN device, by its destination
+func (t *TunToSOCKS) countTX(packet []byte) {
+	t.count(packet, true)
+}
+
+// countRX counts a packet written to the TUN device, by its source
+func (t *TunToSOCKS) countRX(packet []byte) {
+	t.count(packet, false)
+}
+
+// count counts a packet in the totals and by its remote address: the
+// destination of a packet sent into the tunnel, the source of one received
+func (t *TunToSOCKS) count(packet []byte, tx bool) {
+	if tx {
+		t.stats.IncrementTX(len(packet))
+	} else {
+		t.stats.IncrementRX(len(packet))
+	}
+
+	p, err := parseIPPacket(packet)
+	if err != nil {
+		return
+	}
+	protocol, remote := packetDestination(packet, p, tx)
+	t.stats.CountDestination(protocol, remote, tx, len(packet))
+
+	counter := t.cidrCounter(remote.Addr())
+	switch {
+	case counter == nil:
+	case tx:
+		counter.packetsTX.Add(1)
+		counter.bytesTX.Add(uint64(len(packet)))
+	default:
+		counter.packetsRX.Add(1)
+		counter.bytesRX.Add(uint64(len(packet)))
+	}
+}
+
+// cidrCounter returns the counter of the block containing addr, or nil
+func (t *TunToSOCKS) cidrCounter(addr netip.Addr) *cidrCounter {
+	table := t.cidrs.table.Load()
+	if table == nil || len(*table) == 0 {
+		return nil
+	}
+	return table.lookup(addr)
+}
+
+// trackFlow registers a relayed connection for Flows
+func (t *TunToSOCKS) trackFlow(f *flow) {
+	t.connMu.Lock()
+	t.flows[f] = struct{}{}
+	t.connMu.Unlock()
+}
+
+// untrackFlow forgets a relayed connection
+func (t *TunToSOCKS) untrackFlow(f *flow) {
+	t.connMu.Lock()
+	delete(t.flows, f)
+	t.connMu.Unlock()
+}
+
+// Flows returns the TCP connections relayed right now and the open UDP
+// associations, oldest first
+func (t *TunToSOCKS) Flows() []Flow {
+	t.connMu.Lock()
+	flows := make([]Flow, 0, len(t.flows))
+	for f := range t.flows {
+		flows = append(flows, f.snapshot())
+	}
+	t.connMu.Unlock()
+
+	t.udpMu.Lock()
+	for _, s := range t.udpSessions {
+		flows = append(flows, s.flow.snapshot())
+	}
+	t.udpMu.Unlock()
+
+	slices.SortFunc(flows, func(a, b Flow) int {
+		return a.Started.Compare(b.Started)
+	})
+	return flows
+}
+
+// newUDPFlow returns the flow of a UDP association to host
+func newUDPFlow(key udpConnKey, dstHost, host string) *flow {
+	return &flow{
+		protocol: "udp",
+		src:      netip.AddrPortFrom(key.src, key.srcPort).String(),
+		dst:      net.JoinHostPort(dstHost, strconv.Itoa(int(key.dstPort))),
+		host:     host,
+		started:  time.Now(),
+	}
+}
@@ -1,27 +1,44 @@
 package forwarder
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sbkg0002/ssm-proxy/internal/ratelog"
 	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
 	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.New()
 
+// hotLog throttles the messages logged for every packet, so that a wedged
+// TUN device or tunnel does not flood the log
+var hotLog = ratelog.New(log, ratelog.DefaultInterval)
+
 // Forwarder handles bidirectional packet forwarding between TUN and SSM
 type Forwarder struct {
-	tun        *tunnel.TunDevice
-	ssm        *ssm.Session
-	logPackets bool
-	stopCh     chan struct{}
-	wg         sync.WaitGroup
-	stats      *Stats
-	mu         sync.RWMutex
+	tun         *tunnel.TunDevice
+	link        atomic.Pointer[link]
+	compression ssmp.Compression
+	logPackets  bool
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	stats       *Stats
+	mu          sync.RWMutex
+}
+
+// link is the SSM session packets are forwarded over, with the framing of
+// its streams
+type link struct {
+	ssm     *ssm.Session
+	frames  *ssmp.Writer // TUN->SSM goroutine only
+	packets *ssmp.Reader // SSM->TUN goroutine of the link only
 }
 
 // Stats holds traffic statistics
@@ -32,18 +49,55 @@ type Stats struct {
 	BytesRX   uint64
 	ErrorsTX  uint64
 	ErrorsRX  uint64
-	mu        sync.RWMutex
+
+	// TCP connections relayed right now, and the most at any one time
+	ConnsActive uint64
+	ConnsPeak   uint64
+
+	// TCP connections moved to the restarted tunnel, and those reset
+	// because they could not be
+	ConnsResumed uint64
+	ConnsBroken  uint64
+
+	// Connections and UDP flows refused by the destination policy
+	ConnsDenied uint64
+
+	mu sync.RWMutex
+
+	// destinations counts the traffic per destination (TopDestinations);
+	// it is not part of Copy
+	destinations destinationTable
 }
 
 // New creates a new packet forwarder
-func New(tun *tunnel.TunDevice, ssm *ssm.Session, logPackets bool) *Forwarder {
-	return &Forwarder{
+func New(tun *tunnel.TunDevice, session *ssm.Session, logPackets bool) *Forwarder {
+	f := &Forwarder{
 		tun:        tun,
-		ssm:        ssm,
 		logPackets: logPackets,
 		stopCh:     make(chan struct{}),
 		stats:      &Stats{},
 	}
+	f.link.Store(newLink(session, ssmp.CompressionNone))
+	return f
+}
+
+// newLink frames packets over session; the agent's frames start a new
+// stream on every session
+func newLink(session *ssm.Session, compression ssmp.Compression) *link {
+	packets := ssmp.NewReader(session.Reader())
+	packets.Logf = hotLog.Warnf
+	frames := ssmp.NewWriter()
+	frames.SetCompression(compression)
+	frames.Negotiate(packets)
+	return &link{ssm: session, frames: frames, packets: packets}
+}
+
+// SetCompression sets how packets sent to the agent are compressed; the
+// agent compresses the packets it sends the same way unless told
+// otherwise. Must be called before Start.
+func (f *Forwarder) SetCompression(c ssmp.Compression) {
+	f.compression = c
+	f.link.Load().frames.SetCompression(c)
 }
 
 // Start starts the packet forwarder
@@ -54,7 +108,7 @@ func (f *Forwarder) Start() error {
 
 	// Start SSM -> TUN forwarding
 	f.wg.Add(1)
-	go f.forwardSSMToTun()
+	go f.forwardSSMToTun(f.link.Load())
 
 	log.Info("Packet forwarder started")
 	return nil
@@ -72,8 +126,13 @@ func (f *Forwarder) Stop() {
 		close(f.stopCh)
 	}
 
+	// SSM reads block until data arrives; an expired deadline wakes the
+	// SSM->TUN goroutine so it can observe stopCh
+	f.link.Load().ssm.SetReadDeadline(time.Now())
+
 	// Wait for goroutines to finish
 	f.wg.Wait()
+	hotLog.Flush()
 	log.Info("Packet forwarder stopped")
 }
 
@@ -95,16 +154,17 @@ func (f *Forwarder) forwardTunToSSM() {
 		// Read IP packet from TUN device
 		n, err := f.tun.Read(buf)
 		if err != nil {
-			select {
-			case <-f.stopCh:
+			switch {
+			case errors.Is(err, tunnel.ErrClosed):
+				log.Debug("TUN device closed, TUN->SSM forwarder stopping")
 				return
-			default:
-				if err != io.EOF {
-					log.Errorf("TUN read error: %v", err)
-					f.stats.IncrementErrorsTX()
-				}
-				time.Sleep(10 * time.Millisecond)
+			case tunnel.IsTemporary(err):
+				log.Debugf("TUN read error (will retry): %v", err)
 				continue
+			default:
+				log.Errorf("TUN read failed, TUN->SSM forwarder stopping: %v", err)
+				f.stats.IncrementErrorsTX()
+				return
 			}
 		}
 
@@ -121,12 +181,13 @@ func (f *Forwarder) forwardTunToSSM() {
 		}
 
 		// Encapsulate packet
-		frame := ssm.EncapsulatePacket(packet)
+		l := f.link.Load()
+		frame := l.frames.Frame(packet)
 
 		// Send through SSM tunnel
-		_, err = f.ssm.Write(frame)
+		_, err = l.ssm.Write(frame)
 		if err != nil {
-			log.Errorf("SSM write error: %v", err)
+			hotLog.Errorf("SSM write error: %v", err)
 			f.stats.IncrementErrorsTX()
 			continue
 		}
@@ -136,8 +197,9 @@ func (f *Forwarder) forwardTunToSSM() {
 	}
 }
 
-// forwardSSMToTun reads packets from SSM and forwards to TUN device
-func (f *Forwarder) forwardSSMToTun() {
+// forwardSSMToTun reads packets from the SSM session of l and forwards
+// them to the TUN device, until the session ends or is replaced
+func (f *Forwarder) forwardSSMToTun(l *link) {
 	defer f.wg.Done()
 
 	packetCount := 0
@@ -150,20 +212,34 @@ func (f *Forwarder) forwardSSMToTun() {
 		default:
 		}
 
-		// Read and decapsulate packet from SSM
-		packet, err := ssm.DecapsulatePacket(f.ssm.Reader())
+		// Read and decapsulate packet from SSM; damaged frames are skipped
+		// by the reader
+		packet, err := l.packets.ReadPacket()
 		if err != nil {
 			select {
 			case <-f.stopCh:
 				return
 			default:
-				if err != io.EOF {
-					log.Errorf("SSM read error: %v", err)
-					f.stats.IncrementErrorsRX()
-				}
-				time.Sleep(10 * time.Millisecond)
-				continue
 			}
+			if f.link.Load() != l {
+				log.Debug("SSM session replaced, its SSM->TUN forwarder stopping")
+				return
+			}
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Info("SSM session closed, SSM->TUN forwarder stopping")
+				return
+			}
+			if errors.Is(err, ssmp.ErrLegacyFraming) {
+				log.Errorf("SSM->TUN forwarder stopping: %v", err)
+				f.stats.IncrementErrorsRX()
+				return
+			}
+
+			hotLog.Errorf("SSM read error: %v", err)
+			f.stats.IncrementErrorsRX()
+			time.Sleep(10 * time.Millisecond)
+			continue
 		}
 
 		if len(packet) == 0 {
@@ -179,8 +255,12 @@ func (f *Forwarder) forwardSSMToTun() {
 
 		// Write packet to TUN device
 		_, err = f.tun.Write(packet)
+		if errors.Is(err, tunnel.ErrClosed) {
+			log.Debug("TUN device closed, SSM->TUN forwarder stopping")
+			return
+		}
 		if err != nil {
-			log.Errorf("TUN write error: %v", err)
+			hotLog.Errorf("TUN write error: %v", err)
 			f.stats.IncrementErrorsRX()
 			continue
 		}
@@ -190,6 +270,31 @@ func (f *Forwarder) forwardSSMToTun() {
 	}
 }
 
+// Session returns the SSM session packets are forwarded over
+func (f *Forwarder) Session() *ssm.Session {
+	return f.link.Load().ssm
+}
+
+// Replace moves the forwarding to session, e.g. after the previous one
+// was lost, and returns the previous session for the caller to close
+func (f *Forwarder) Replace(session *ssm.Session) *ssm.Session {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	l := newLink(session, f.compression)
+	previous := f.link.Swap(l)
+	// Wakes the previous SSM->TUN goroutine, which sees it was replaced
+	previous.ssm.SetReadDeadline(time.Now())
+
+	select {
+	case <-f.stopCh:
+	default:
+		f.wg.Add(1)
+		go f.forwardSSMToTun(l)
+	}
+	return previous.ssm
+}
+
 // GetStats returns current traffic statistics
 func (f *Forwarder) GetStats() Stats {
 	return f.stats.Copy()
@@ -225,6 +330,42 @@ func (s *Stats) IncrementErrorsRX() {
 	s.ErrorsRX++
 }
 
+// ConnOpened counts a new relayed connection
+func (s *Stats) ConnOpened() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ConnsActive++
+	s.ConnsPeak = max(s.ConnsPeak, s.ConnsActive)
+}
+
+// ConnClosed counts the end of a relayed connection
+func (s *Stats) ConnClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ConnsActive--
+}
+
+// ConnResumed counts a connection moved to the restarted tunnel
+func (s *Stats) ConnResumed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ConnsResumed++
+}
+
+// ConnBroken counts a connection reset because the tunnel went down
+func (s *Stats) ConnBroken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ConnsBroken++
+}
+
+// ConnDenied counts a connection refused by the destination policy
+func (s *Stats) ConnDenied() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ConnsDenied++
+}
+
 // Copy returns a copy of the statistics
 func (s *Stats) Copy() Stats {
 	s.mu.RLock()
@@ -236,6 +377,14 @@ func (s *Stats) Copy() Stats {
 		BytesRX:   s.BytesRX,
 		ErrorsTX:  s.ErrorsTX,
 		ErrorsRX:  s.ErrorsRX,
+
+		ConnsActive: s.ConnsActive,
+		ConnsPeak:   s.ConnsPeak,
+
+		ConnsResumed: s.ConnsResumed,
+		ConnsBroken:  s.ConnsBroken,
+
+		ConnsDenied: s.ConnsDenied,
 	}
 }
 
@@ -265,3 +414,9 @@ func logPacketDetails(direction string, count int, packet []byte) {
 	log.Debugf("[%s #%d] IPv%d %s %s -> %s (%d bytes)",
 		direction, count, version, protoName, srcIP, dstIP, len(packet))
 }
+
+// SetLogger sets the logger for the packet forwarders
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+	hotLog.SetLogger(logger)
+}
@@ -0,0 +1,167 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// IP protocol numbers
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// IPv6 extension headers skipped when looking for the transport protocol
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6DestOptions = 60
+)
+
+// ipPacket is a parsed IPv4 or IPv6 packet
+type ipPacket struct {
+	src, dst netip.Addr
+	protocol uint8  // transport protocol (the last IPv6 next header)
+	payload  []byte // transport header and data
+}
+
+// parseIPPacket parses the IP header of a packet read from the TUN device.
+// The payload aliases packet.
+func parseIPPacket(packet []byte) (ipPacket, error) {
+	if len(packet) < 1 {
+		return ipPacket{}, fmt.Errorf("empty packet")
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return ipPacket{}, fmt.Errorf("invalid IPv4 packet")
+		}
+		ihl := int(packet[0]&0x0F) * 4
+		if len(packet) < ihl || ihl < 20 {
+			return ipPacket{}, fmt.Errorf("invalid IP header length")
+		}
+		return ipPacket{
+			src:      netip.AddrFrom4([4]byte(packet[12:16])),
+			dst:      netip.AddrFrom4([4]byte(packet[16:20])),
+			protocol: packet[9],
+			payload:  packet[ihl:],
+		}, nil
+
+	case 6:
+		if len(packet) < 40 {
+			return ipPacket{}, fmt.Errorf("invalid IPv6 packet")
+		}
+		p := ipPacket{
+			src: netip.AddrFrom16([16]byte(packet[8:24])),
+			dst: netip.AddrFrom16([16]byte(packet[24:40])),
+		}
+
+		next, offset := packet[6], 40
+		for next == ipv6HopByHop || next == ipv6Routing || next == ipv6DestOptions {
+			if len(packet) < offset+8 {
+				return ipPacket{}, fmt.Errorf("truncated IPv6 extension header")
+			}
+			next = packet[offset]
+			offset += (int(packet[offset+1]) + 1) * 8
+		}
+		if next == ipv6Fragment {
+			return ipPacket{}, fmt.Errorf("fragmented IPv6 packets are not supported")
+		}
+		if len(packet) < offset {
+			return ipPacket{}, fmt.Errorf("truncated IPv6 extension header")
+		}
+
+		p.protocol = next
+		p.payload = packet[offset:]
+		return p, nil
+	}
+
+	return ipPacket{}, fmt.Errorf("unsupported IP version %d", packet[0]>>4)
+}
+
+// ipHeaderLen returns the size of the IP header of the packets we generate
+// for the address family of addr
+func ipHeaderLen(addr netip.Addr) int {
+	if addr.Is4() {
+		return 20
+	}
+	return 40
+}
+
+// putIPHeader writes the IPv4 or IPv6 header (depending on the address
+// family) at the start of packet, for a packet of len(packet) bytes
+func putIPHeader(packet []byte, src, dst netip.Addr, protocol uint8) {
+	if src.Is4() {
+		header := packet[:20]
+		clear(header)
+		header[0] = 0x45 // Version 4, IHL 5
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(header[6:8], 0x4000) // Don't fragment
+		header[8] = 64                                  // TTL
+		header[9] = protocol
+		s, d := src.As4(), dst.As4()
+		copy(header[12:16], s[:])
+		copy(header[16:20], d[:])
+		binary.BigEndian.PutUint16(header[10:12], ipChecksum(header))
+		return
+	}
+
+	header := packet[:40]
+	clear(header)
+	header[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(packet)-40))
+	header[6] = protocol
+	header[7] = 64 // Hop limit
+	s, d := src.As16(), dst.As16()
+	copy(header[8:24], s[:])
+	copy(header[24:40], d[:])
+}
+
+// transportChecksum calculates the checksum of a TCP, UDP or ICMPv6
+// segment, including the IPv4 or IPv6 pseudo-header. The checksum field of
+// segment must be zero.
+func transportChecksum(src, dst netip.Addr, protocol uint8, segment []byte) uint16 {
+	sum := uint32(protocol) + uint32(len(segment))
+
+	addrs := append(src.AsSlice(), dst.AsSlice()...)
+	for i := 0; i < len(addrs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(addrs[i : i+2]))
+	}
+
+	for i := 0; i+1 < len(segment); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(segment[i : i+2]))
+	}
+	if len(segment)%2 == 1 {
+		sum += uint32(segment[len(segment)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// ipChecksum calculates IP header checksum
+func ipChecksum(header []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i < len(header); i += 2 {
+		if i+1 < len(header) {
+			sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// addrIP converts an address to a net.IP (4 bytes for IPv4)
+func addrIP(addr netip.Addr) net.IP {
+	return net.IP(addr.AsSlice())
+}
@@ -0,0 +1,198 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+)
+
+// defaultReplaySettle is how long a replay waits for the translator's last
+// answers after the last packet
+const defaultReplaySettle = time.Second
+
+// errReplayRefused is what destinations answer in a replay without a dialer
+var errReplayRefused = errors.New("connections are refused in a replay")
+
+// ReplayOptions configures ReplayPackets
+type ReplayOptions struct {
+	// Dialer opens the connections the packets ask for (default: every
+	// connection is refused, so the clients get resets)
+	Dialer Dialer
+	// DNS answers the DNS queries of the packets (default: they are
+	// dropped)
+	DNS *dns.Config
+	// Gateway is the TUN device's peer address, answered locally
+	Gateway net.IP
+	// Realtime keeps the recorded gaps between packets (up to a second
+	// each) instead of feeding them back to back
+	Realtime bool
+	// Settle is how long to wait for answers after the last packet
+	// (default one second)
+	Settle time.Duration
+	// Output records the packets the translator writes back (optional)
+	Output *record.Writer
+}
+
+// ReplayResult summarizes a replayed recording of TUN packets
+type ReplayResult struct {
+	// Fed is the number of packets fed to the translator: those read from
+	// the TUN device in the recording
+	Fed int
+	// Recorded is the number of packets written to the TUN device in the
+	// recording, Written the number the translator wrote in the replay
+	Recorded int
+	Written  int
+	// Dials are the connections the translator opened (or tried to)
+	Dials []string
+	// Stats are the translator's counters at the end of the replay
+	Stats Stats
+}
+
+// ReplayPackets feeds the packets read from the TUN device in a recording
+// through a translator, as if read from the device, and reports what it
+// did with them. TCP connections do not get past their handshake: the
+// translator's TCP stack picks other sequence numbers than the recording's.
+func ReplayPackets(ctx context.Context, r *record.Reader, options ReplayOptions) (*ReplayResult, error) {
+	if r.Kind() != record.KindPackets {
+		return nil, fmt.Errorf("recording holds %s, not packets", r.Kind())
+	}
+	if options.Settle <= 0 {
+		options.Settle = defaultReplaySettle
+	}
+
+	result := &ReplayResult{}
+	dialer := &replayDialer{dialer: options.Dialer}
+	device := &replayDevice{packets: make(chan []byte), output: options.Output}
+
+	t, err := NewTunToDialer(device, dialer, options.DNS)
+	if err != nil {
+		return nil, err
+	}
+	if options.Gateway != nil {
+		t.SetGatewayAddress(options.Gateway)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := t.Start(runCtx); err != nil {
+		return nil, fmt.Errorf("failed to start translator: %w", err)
+	}
+
+	feedErr := feedPackets(runCtx, r, device, options.Realtime, result)
+	close(device.packets)
+
+	select {
+	case <-time.After(options.Settle):
+	case <-ctx.Done():
+	}
+	cancel()
+	t.Stop()
+
+	result.Written = int(device.written.Load())
+	result.Dials = dialer.dials()
+	result.Stats = t.GetStats()
+	return result, feedErr
+}
+
+// feedPackets hands the recording's outbound packets to the device, in
+// order, counting them and the inbound ones in result
+func feedPackets(ctx context.Context, r *record.Reader, device *replayDevice, realtime bool, result *ReplayResult) error {
+	var last time.Time
+	for n := 1; ; n++ {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read record %d: %w", n, err)
+		}
+
+		if rec.Direction == record.Inbound {
+			result.Recorded++
+			continue
+		}
+
+		if realtime && !last.IsZero() {
+			if gap := min(rec.Time.Sub(last), time.Second); gap > 0 {
+				select {
+				case <-time.After(gap):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		last = rec.Time
+
+		select {
+		case device.packets <- rec.Data:
+			result.Fed++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// replayDevice is a TUN device that reads the packets of a recording and
+// records the ones written to it
+type replayDevice struct {
+	packets chan []byte // closed after the last packet
+	output  *record.Writer
+	written atomic.Int64
+}
+
+// Read returns the next packet, or io.EOF after the last one
+func (d *replayDevice) Read(packet []byte) (int, error) {
+	data, ok := <-d.packets
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(packet, data), nil
+}
+
+// Write counts and records a packet from the translator
+func (d *replayDevice) Write(packet []byte) (int, error) {
+	d.written.Add(1)
+	d.output.Record(record.Inbound, packet)
+	return len(packet), nil
+}
+
+// MTU returns the largest packet a recording can hold
+func (d *replayDevice) MTU() int {
+	return 65535
+}
+
+// replayDialer notes the connections of a replay and refuses them unless
+// a dialer was given
+type replayDialer struct {
+	dialer Dialer
+
+	mu        sync.Mutex
+	addresses []string
+}
+
+// DialContext notes and opens (or refuses) a connection
+func (d *replayDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addresses = append(d.addresses, network+" "+address)
+	d.mu.Unlock()
+
+	if d.dialer == nil {
+		return nil, errReplayRefused
+	}
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// dials returns the connections noted so far
+func (d *replayDialer) dials() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.addresses...)
+}
@@ -0,0 +1,300 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// While the tunnel is restarted, new TCP connections are held (netstack
+// keeps their SYN, the client retransmits it) and connections that have
+// not carried any payload yet move to a new proxy connection once it is
+// back: their destination has seen nothing but a connect. Connections that
+// did carry payload cannot be resumed mid-stream and are reset, so their
+// clients do not take the broken stream for a complete one.
+
+const (
+	// defaultResumeTimeout is how long connections wait for the tunnel to
+	// come back by default
+	defaultResumeTimeout = time.Minute
+
+	// resumePollInterval is how often a waiting connection checks whether
+	// the proxy accepts connections again
+	resumePollInterval = 500 * time.Millisecond
+
+	// proxyProbeTimeout bounds the connect that checks the proxy is up
+	proxyProbeTimeout = time.Second
+)
+
+// SetResumeTimeout sets how long connections wait for the tunnel to come
+// back before they fail; 0 fails them right away. Must be called before
+// Start.
+func (t *TunToSOCKS) SetResumeTimeout(d time.Duration) {
+	if d >= 0 {
+		t.resumeTimeout = d
+	}
+}
+
+// Suspend tells the translator the tunnel is being restarted, so that
+// failing connections wait for Resume rather than failing
+func (t *TunToSOCKS) Suspend() {
+	if !t.suspended.Swap(true) {
+		log.Debug("Tunnel restarting, holding connections")
+	}
+}
+
+// Resume tells the translator the tunnel is back up
+func (t *TunToSOCKS) Resume() {
+	if t.suspended.Swap(false) {
+		log.Debug("Tunnel back up, resuming connections")
+	}
+}
+
+// proxyDown reports whether the tunnel behind the proxy at addr is down:
+// it is being restarted, or nothing accepts connections at addr (the SSH
+// process exited). With a custom dialer only Suspend tells.
+func (t *TunToSOCKS) proxyDown(addr string) bool {
+	if t.suspended.Load() {
+		return true
+	}
+	if addr == "" {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", addr, proxyProbeTimeout)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+// awaitProxy waits for the current proxy to be up again, for at most the
+// resume timeout. It returns false if the timeout passes, done is closed or
+// the translator stops first.
+func (t *TunToSOCKS) awaitProxy(done <-chan struct{}) bool {
+	if t.resumeTimeout <= 0 {
+		return false
+	}
+
+	timeout := time.NewTimer(t.resumeTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(resumePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !t.proxyDown(t.backend.Load().addr) {
+				return true
+			}
+		case <-timeout.C:
+			return false
+		case <-done:
+			return false
+		case <-t.stopCh:
+			return false
+		}
+	}
+}
+
+// upstreamConn is the proxy connection of a relayed TCP flow. If it fails
+// because the tunnel went down before payload went either way, it is
+// replaced by a new connection to the same destination once the tunnel is
+// back, and reading and writing carry on there.
+type upstreamConn struct {
+	t    *TunToSOCKS
+	addr string // destination
+
+	redialMu sync.Mutex // serializes re-dials of the two directions
+	done     chan struct{}
+	once     sync.Once
+
+	mu     sync.Mutex
+	conn   net.Conn
+	proxy  string // proxy conn goes through
+	gen    int    // incremented by every re-dial
+	used   bool   // payload went either way: the flow cannot move
+	broken bool   // failed because the tunnel went down
+}
+
+// newUpstreamConn wraps the proxy connection conn to addr, dialed through
+// the proxy at proxy
+func (t *TunToSOCKS) newUpstreamConn(conn net.Conn, addr, proxy string) *upstreamConn {
+	return &upstreamConn{t: t, addr: addr, conn: conn, proxy: proxy, done: make(chan struct{})}
+}
+
+// current returns the connection, its generation and whether payload went
+func (u *upstreamConn) current() (net.Conn, int, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conn, u.gen, u.used
+}
+
+// markUsed records that payload went through the connection
+func (u *upstreamConn) markUsed() {
+	u.mu.Lock()
+	u.used = true
+	u.mu.Unlock()
+}
+
+// Read reads from the proxy connection, moving to a new one if the tunnel
+// went down before any payload
+func (u *upstreamConn) Read(p []byte) (int, error) {
+	for {
+		conn, gen, _ := u.current()
+		n, err := conn.Read(p)
+		if n > 0 {
+			u.markUsed()
+			return n, err
+		}
+		if err == nil || !u.failed(gen) {
+			return n, err
+		}
+	}
+}
+
+// Write writes to the proxy connection, moving to a new one if the tunnel
+// went down before any payload
+func (u *upstreamConn) Write(p []byte) (int, error) {
+	for {
+		conn, gen, _ := u.current()
+		n, err := conn.Write(p)
+		if n > 0 || err == nil {
+			u.markUsed()
+			return n, err
+		}
+		if !u.failed(gen) {
+			return n, err
+		}
+	}
+}
+
+// failed handles the failure of the connection of generation gen. It
+// reports whether to retry on a new connection; otherwise the failure
+// stands, and is marked broken if the tunnel went down.
+func (u *upstreamConn) failed(gen int) bool {
+	u.redialMu.Lock()
+	defer u.redialMu.Unlock()
+
+	select {
+	case <-u.done:
+		return false
+	default:
+	}
+
+	u.mu.Lock()
+	moved, proxy, used := u.gen != gen, u.proxy, u.used
+	u.mu.Unlock()
+	if moved {
+		// The other direction already moved the flow
+		return true
+	}
+	if !u.t.proxyDown(proxy) {
+		// The destination closed the connection
+		return false
+	}
+	if used {
+		u.setBroken()
+		return false
+	}
+
+	log.Debugf("Tunnel down, holding connection to %s until it is back", u.addr)
+	if !u.t.awaitProxy(u.done) {
+		u.setBroken()
+		return false
+	}
+
+	proxy = u.t.backend.Load().addr
+	ctx, cancel := context.WithTimeout(context.Background(), u.t.dialTimeout)
+	conn, err := u.t.dialSOCKS(ctx, u.addr)
+	cancel()
+	if err != nil {
+		log.Debugf("Failed to resume connection to %s: %v", u.addr, err)
+		u.setBroken()
+		return false
+	}
+	if u.t.scheduler != nil {
+		u.t.scheduler.limitSendBuffer(conn)
+	}
+
+	u.mu.Lock()
+	select {
+	case <-u.done:
+		u.mu.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	old := u.conn
+	u.conn, u.proxy, u.gen = conn, proxy, u.gen+1
+	u.mu.Unlock()
+	old.Close()
+
+	u.t.stats.ConnResumed()
+	log.Debugf("Resumed connection to %s through the restarted tunnel", u.addr)
+	return true
+}
+
+// setBroken records that the connection failed because the tunnel went down
+func (u *upstreamConn) setBroken() {
+	u.mu.Lock()
+	u.broken = true
+	u.mu.Unlock()
+}
+
+// wasBroken reports whether the connection failed because the tunnel went
+// down, rather than being closed by the destination
+func (u *upstreamConn) wasBroken() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.broken
+}
+
+// CloseWrite half-closes the proxy connection. The destination sees it, so
+// the flow cannot move afterwards.
+func (u *upstreamConn) CloseWrite() error {
+	u.markUsed()
+	conn, _, _ := u.current()
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// Close closes the proxy connection and stops re-dials
+func (u *upstreamConn) Close() error {
+	u.once.Do(func() { close(u.done) })
+	conn, _, _ := u.current()
+	return conn.Close()
+}
+
+// LocalAddr returns the local address of the proxy connection
+func (u *upstreamConn) LocalAddr() net.Addr {
+	conn, _, _ := u.current()
+	return conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the proxy connection
+func (u *upstreamConn) RemoteAddr() net.Addr {
+	conn, _, _ := u.current()
+	return conn.RemoteAddr()
+}
+
+// SetDeadline sets the deadlines of the proxy connection
+func (u *upstreamConn) SetDeadline(t time.Time) error {
+	conn, _, _ := u.current()
+	return conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the proxy connection
+func (u *upstreamConn) SetReadDeadline(t time.Time) error {
+	conn, _, _ := u.current()
+	return conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the proxy connection
+func (u *upstreamConn) SetWriteDeadline(t time.Time) error {
+	conn, _, _ := u.current()
+	return conn.SetWriteDeadline(t)
+}
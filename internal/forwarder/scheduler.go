@@ -0,0 +1,202 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQuantum is the number of bytes a flow's deficit grows by each
+	// time the scheduler visits it
+	DefaultQuantum = 16 << 10
+
+	// maxChunk is the most a flow reads, and sends in one turn
+	maxChunk = 4 * DefaultQuantum
+
+	// turnTimeout is how long a flow's write may hold the turn. A write
+	// still blocked after it (the destination stopped reading) goes on
+	// without the turn, and the flow gets no other turn until it returns.
+	turnTimeout = 20 * time.Millisecond
+)
+
+// DefaultPriorityPorts are interactive services preferred over bulk
+// transfers by the fair scheduler
+var DefaultPriorityPorts = []int{22, 443, 5432}
+
+// Flow classes, in the order they are served
+const (
+	classPriority = iota
+	classBulk
+	numClasses
+)
+
+// Scheduler shares the tunnel between TCP flows with deficit round robin.
+// Each flow queues the chunk it read and waits for its turn to send it.
+// Flows to priority ports are served before all others; within a class,
+// the waiting flows are visited in turn, each visit adding the quantum to
+// the flow's deficit, and a flow sends once its deficit covers its chunk.
+// A bulk transfer sending large chunks therefore gets no more bytes
+// through per round than a flow sending small ones.
+//
+// The scheduler's lock is only held to pick the next flow; the write runs
+// outside it, holding the turn for at most turnTimeout, so a flow whose
+// destination stopped reading cannot hold up the others.
+type Scheduler struct {
+	quantum       int
+	priorityPorts map[uint16]bool
+	turnTimeout   time.Duration
+
+	mu       sync.Mutex
+	turn     *schedFlow               // flow whose write holds the turn
+	turnEnds time.Time                // when the turn expires
+	timer    *time.Timer              // expires the turn
+	queues   [numClasses][]*schedFlow // flows with a chunk waiting
+}
+
+// schedFlow is one TCP flow's place in the scheduler
+type schedFlow struct {
+	class   int
+	deficit int           // bytes the flow may still send
+	size    int           // size of the chunk waiting
+	ready   chan struct{} // signalled when the flow gets the turn
+}
+
+// NewScheduler creates a fair scheduler with the given quantum
+// (DefaultQuantum if zero) and priority destination ports
+func NewScheduler(quantum int, priorityPorts []int) *Scheduler {
+	if quantum <= 0 {
+		quantum = DefaultQuantum
+	}
+	s := &Scheduler{
+		quantum:       quantum,
+		priorityPorts: make(map[uint16]bool, len(priorityPorts)),
+		turnTimeout:   turnTimeout,
+	}
+	for _, port := range priorityPorts {
+		s.priorityPorts[uint16(port)] = true
+	}
+	s.timer = time.AfterFunc(time.Hour, s.expire)
+	s.timer.Stop()
+	return s
+}
+
+// newFlow registers a flow to a destination port
+func (s *Scheduler) newFlow(port uint16) *schedFlow {
+	f := &schedFlow{class: classBulk, ready: make(chan struct{}, 1)}
+	if s.priorityPorts[port] {
+		f.class = classPriority
+	}
+	return f
+}
+
+// acquire queues a chunk of size bytes of the flow and waits for its turn
+// to send it
+func (s *Scheduler) acquire(f *schedFlow, size int) {
+	s.mu.Lock()
+	f.size = size
+	s.queues[f.class] = append(s.queues[f.class], f)
+	s.dispatch()
+	s.mu.Unlock()
+
+	<-f.ready
+}
+
+// release ends the flow's turn, if it still holds it, and passes the turn
+// on
+func (s *Scheduler) release(f *schedFlow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.turn == f {
+		s.turn = nil
+		s.timer.Stop()
+	}
+	s.dispatch()
+}
+
+// expire takes the turn from a write that outlasted it
+func (s *Scheduler) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The timer may fire late, after the turn it was set for ended
+	if s.turn == nil || time.Now().Before(s.turnEnds) {
+		return
+	}
+	s.turn = nil
+	s.dispatch()
+}
+
+// dispatch gives a free turn to the next flow. Must be called with s.mu
+// held.
+func (s *Scheduler) dispatch() {
+	if s.turn != nil {
+		return
+	}
+	f := s.next()
+	if f == nil {
+		return
+	}
+	s.turn = f
+	s.turnEnds = time.Now().Add(s.turnTimeout)
+	s.timer.Reset(s.turnTimeout)
+	f.ready <- struct{}{}
+}
+
+// next removes the flow to send next from its queue: the first priority
+// flow whose deficit covers its chunk, else the first bulk one. Must be
+// called with s.mu held.
+func (s *Scheduler) next() *schedFlow {
+	for class := range s.queues {
+		for len(s.queues[class]) > 0 {
+			f := s.queues[class][0]
+			s.queues[class][0] = nil
+			s.queues[class] = s.queues[class][1:]
+
+			// The quantum is only added while the deficit falls short,
+			// so what is left after sending stays below the quantum
+			// and a flow sending small chunks saves up no turns
+			if f.deficit < f.size {
+				f.deficit += s.quantum
+			}
+			if f.deficit >= f.size {
+				f.deficit -= f.size
+				return f
+			}
+			s.queues[class] = append(s.queues[class], f)
+		}
+	}
+	return nil
+}
+
+// copy relays src to dst like io.Copy, sending each chunk in its turn
+func (s *Scheduler) copy(dst io.Writer, src io.Reader, port uint16) {
+	f := s.newFlow(port)
+	buf := make([]byte, maxChunk)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.acquire(f, n)
+			_, werr := dst.Write(buf[:n])
+			s.release(f)
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// limitSendBuffer shrinks the kernel send buffer of a proxy connection, so
+// a backlog builds up in the scheduler rather than in socket buffers where
+// it cannot be reordered
+func (s *Scheduler) limitSendBuffer(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(maxChunk)
+	}
+}
@@ -0,0 +1,284 @@
+package forwarder
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledWriter is a destination that stopped reading: writes block until
+// it is unblocked
+type stalledWriter struct {
+	started chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func newStalledWriter() *stalledWriter {
+	return &stalledWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.unblock
+	return len(p), nil
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// waitQueued waits until n flows of a class wait for their turn
+func waitQueued(t *testing.T, s *Scheduler, class, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := len(s.queues[class])
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d flows of class %d queued, want %d", queued, class, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestSchedulerCopy(t *testing.T) {
+	s := NewScheduler(0, DefaultPriorityPorts)
+
+	var wg sync.WaitGroup
+	for i, port := range []uint16{22, 80, 443, 8080, 9000} {
+		data := randomData(200<<10 + i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var dst lockedBuffer
+			s.copy(&dst, bytes.NewReader(data), port)
+			if !bytes.Equal(dst.Bytes(), data) {
+				t.Errorf("port %d: relayed %d bytes that differ from the %d sent", port, len(dst.Bytes()), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A flow whose destination stopped reading does not hold up the others
+func TestSchedulerStalledFlow(t *testing.T) {
+	s := NewScheduler(0, DefaultPriorityPorts)
+
+	stalled := newStalledWriter()
+	stalledDone := make(chan struct{})
+	go func() {
+		defer close(stalledDone)
+		s.copy(stalled, bytes.NewReader(randomData(1<<20)), 80)
+	}()
+	<-stalled.started
+	defer func() {
+		close(stalled.unblock)
+		<-stalledDone
+	}()
+
+	done := make(chan struct{})
+	var dst lockedBuffer
+	data := randomData(300 << 10)
+	go func() {
+		defer close(done)
+		s.copy(&dst, bytes.NewReader(data), 8080)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a flow is blocked behind a stalled one")
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Errorf("relayed %d bytes that differ from the %d sent", len(dst.Bytes()), len(data))
+	}
+}
+
+// The turn passes on when a write outlasts it, and the stalled flow does
+// not get another turn until its write returns
+func TestSchedulerTurnTimeout(t *testing.T) {
+	s := NewScheduler(0, nil)
+	s.turnTimeout = 10 * time.Millisecond
+
+	stalled := s.newFlow(80)
+	s.acquire(stalled, 100)
+
+	other := s.newFlow(80)
+	got := make(chan struct{})
+	go func() {
+		s.acquire(other, 100)
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the turn was not passed on after the stalled write timed out")
+	}
+
+	s.mu.Lock()
+	turn := s.turn
+	s.mu.Unlock()
+	if turn != other {
+		t.Error("the turn is not with the waiting flow")
+	}
+
+	// The stalled write returning does not take the turn back
+	s.release(stalled)
+	s.mu.Lock()
+	turn = s.turn
+	s.mu.Unlock()
+	if turn != other {
+		t.Error("the stalled flow's late release ended another flow's turn")
+	}
+	s.release(other)
+}
+
+// Priority flows are served before bulk flows waiting longer
+func TestSchedulerPriorityFirst(t *testing.T) {
+	s := NewScheduler(0, []int{22})
+
+	holder := s.newFlow(80)
+	s.acquire(holder, 100)
+
+	order := make(chan string, 4)
+	var wg sync.WaitGroup
+	start := func(name string, port uint16, class, queued int) {
+		f := s.newFlow(port)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acquire(f, 1000)
+			order <- name
+			s.release(f)
+		}()
+		waitQueued(t, s, class, queued)
+	}
+	start("bulk 1", 80, classBulk, 1)
+	start("bulk 2", 8080, classBulk, 2)
+	start("priority 1", 22, classPriority, 1)
+	start("priority 2", 22, classPriority, 2)
+
+	s.release(holder)
+	wg.Wait()
+	close(order)
+
+	var got []string
+	for name := range order {
+		got = append(got, name)
+	}
+	want := []string{"priority 1", "priority 2", "bulk 1", "bulk 2"}
+	if len(got) != len(want) {
+		t.Fatalf("served %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("served %v, want %v", got, want)
+		}
+	}
+}
+
+// Backlogged flows get the same bytes through whatever the size of their
+// chunks; flows with less than a quantum waiting send what they have
+func TestSchedulerDeficit(t *testing.T) {
+	const quantum = 1000
+	s := NewScheduler(quantum, nil)
+
+	sizes := map[*schedFlow]int{}
+	for _, size := range []int{4000, 1000, 300, 2500} {
+		f := s.newFlow(80)
+		f.size = size
+		sizes[f] = size
+		s.queues[f.class] = append(s.queues[f.class], f)
+	}
+
+	sent := map[*schedFlow]int{}
+	const rounds = 1000
+	for i := 0; i < rounds; i++ {
+		f := s.next()
+		if f == nil {
+			t.Fatal("no flow to serve")
+		}
+		sent[f] += f.size
+		if f.deficit < 0 || f.deficit >= quantum {
+			t.Fatalf("deficit %d left after sending, want 0 to %d", f.deficit, quantum-1)
+		}
+		// The flow is still backlogged
+		s.queues[f.class] = append(s.queues[f.class], f)
+	}
+
+	// Per round, the flows with a quantum or more waiting send about a
+	// quantum, the one with 300 bytes waiting sends those
+	fair := float64(quantum) / (3*quantum + 300)
+	for f, size := range sizes {
+		want := fair
+		if size < quantum {
+			want = float64(size) / (3*quantum + 300)
+		}
+		got := float64(sent[f]) / float64(sent[f]+otherBytes(sent, f))
+		if got < want*0.9 || got > want*1.1 {
+			t.Errorf("flow sending %d-byte chunks got %.1f%% of the bytes, want %.1f%%", size, 100*got, 100*want)
+		}
+	}
+}
+
+// otherBytes sums the bytes sent by the flows other than f
+func otherBytes(sent map[*schedFlow]int, f *schedFlow) int {
+	total := 0
+	for other, n := range sent {
+		if other != f {
+			total += n
+		}
+	}
+	return total
+}
+
+// A flow is not served before its deficit covers its chunk
+func TestSchedulerLargeChunkWaits(t *testing.T) {
+	s := NewScheduler(1000, nil)
+	large, small := s.newFlow(80), s.newFlow(80)
+	large.size, small.size = 3000, 500
+	s.queues[classBulk] = []*schedFlow{large, small}
+
+	var got []*schedFlow
+	for i := 0; i < 4; i++ {
+		f := s.next()
+		got = append(got, f)
+		if f == small {
+			s.queues[classBulk] = append(s.queues[classBulk], f)
+		}
+	}
+	// The large flow waits three visits while the small one is served
+	want := []*schedFlow{small, small, large, small}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pick %d went to the wrong flow", i+1)
+		}
+	}
+}
@@ -2,101 +2,277 @@ package forwarder
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/nat"
+	"github.com/sbkg0002/ssm-proxy/internal/policy"
 	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
 	"golang.org/x/net/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 const (
-	// TCP flags
-	tcpFIN = 0x01
-	tcpSYN = 0x02
-	tcpRST = 0x04
-	tcpPSH = 0x08
-	tcpACK = 0x10
-
 	// Connection timeouts
-	connTimeout   = 5 * time.Minute
-	dialTimeout   = 30 * time.Second
-	readTimeout   = 100 * time.Millisecond
-	cleanupTicker = 30 * time.Second
+	defaultDialTimeout = 30 * time.Second
+	cleanupTicker      = 30 * time.Second
 )
 
+// Device is the TUN device packets are read from and written to, e.g. a
+// *tunnel.TunDevice
+type Device interface {
+	Read(packet []byte) (int, error)
+	Write(packet []byte) (int, error)
+	MTU() int
+}
+
+// Dialer opens the connections to destinations, e.g. through a tunnel
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 // TunToSOCKS handles transparent packet forwarding from TUN to SOCKS5 proxy
 type TunToSOCKS struct {
-	tun         *tunnel.TunDevice
-	socksAddr   string
-	socksDialer proxy.Dialer
-	connections map[connKey]*tcpConn
-	connMu      sync.RWMutex
+	tun         Device
+	backend     atomic.Pointer[socksBackend] // switched by SetSOCKSAddr
 	stopCh      chan struct{}
 	wg          sync.WaitGroup
 	stats       *Stats
 	dnsResolver *dns.Resolver
+	dnsSem      chan struct{} // bounds DNS queries in flight
+	nat         *nat.Table
+	fakeIP      *dns.FakeIPPool // names of fake addresses, for fake-IP mode
+	dialTimeout time.Duration
+	scheduler   *Scheduler     // nil: flows send in FIFO order
+	policy      *policy.Policy // nil: every destination is allowed
+	selected    FlowSelector   // nil: every flow goes through the tunnel
+	direct      Dialer         // for the flows not selected
+
+	// TCP connections terminated by netstack
+	stack    *stack.Stack
+	link     *channel.Endpoint
+	tcpConns map[net.Conn]struct{} // client and proxy connections
+	flows    map[*flow]struct{}    // relayed connections, for Flows
+	connMu   sync.Mutex
+
+	// Called with every relayed connection once it ends
+	flowEnded func(Flow)
+
+	// Traffic counters per routed CIDR block
+	cidrs cidrStats
+
+	// Set by Drain: new flows are refused
+	draining atomic.Bool
+
+	// Set by Suspend while the tunnel restarts: connections wait for it
+	// (up to resumeTimeout) rather than failing
+	suspended     atomic.Bool
+	resumeTimeout time.Duration
+
+	// UDP flows relayed through SOCKS5 UDP associations
+	udpSessions         map[udpConnKey]*udpSession
+	udpMu               sync.Mutex
+	udpUnsupportedUntil time.Time // UDP is dropped until then
+	udpWarned           bool
+
+	// ICMP echo requests answered by probing the destination
+	ping *pingState
+
+	// Next hop of gateway routes (the TUN device's peer), answered locally
+	gateway netip.Addr
 }
 
-// connKey uniquely identifies a TCP connection
-type connKey struct {
-	srcIP   uint32
-	dstIP   uint32
-	srcPort uint16
-	dstPort uint16
-}
-
-// tcpConn represents a single TCP connection
-type tcpConn struct {
-	key         connKey
-	socksConn   net.Conn
-	lastActive  time.Time
-	seqNum      uint32 // client's sequence number (last seen)
-	ackNum      uint32 // next expected byte from client
-	serverSeq   uint32 // server's outgoing sequence number
-	established bool
-	closing     bool
-	mu          sync.Mutex
+// socksBackend is the proxy new connections go through
+type socksBackend struct {
+	addr   string // empty with a custom dialer
+	dialer proxy.Dialer
 }
 
 // NewTunToSOCKS creates a new TUN-to-SOCKS translator
-func NewTunToSOCKS(tun *tunnel.TunDevice, socksAddr string, dnsConfig *dns.Config) (*TunToSOCKS, error) {
+func NewTunToSOCKS(tun Device, socksAddr string, dnsConfig *dns.Config) (*TunToSOCKS, error) {
 	// Create SOCKS5 dialer
 	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
 	}
+	return newTunToSOCKS(tun, socksAddr, dialer, dnsConfig)
+}
 
+// SetSOCKSAddr switches to the SOCKS5 proxy at addr, e.g. a standby tunnel
+// taking over from a failed one. New connections, DNS queries and UDP flows
+// go through it; established ones stay on the old proxy. Not for
+// translators created with NewTunToDialer.
+func (t *TunToSOCKS) SetSOCKSAddr(addr string) error {
+	if t.backend.Load().addr == "" {
+		return errors.New("translator has a custom dialer")
+	}
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+	}
+	t.backend.Store(&socksBackend{addr: addr, dialer: dialer})
+	log.Debugf("Forwarding through SOCKS5 proxy %s", addr)
+	return nil
+}
+
+// NewTunToDialer creates a translator that opens TCP connections (and
+// those to the DNS server) with dialer instead of a SOCKS5 proxy. UDP
+// datagrams other than DNS queries are dropped, as they need a SOCKS5 UDP
+// association.
+func NewTunToDialer(tun Device, dialer Dialer, dnsConfig *dns.Config) (*TunToSOCKS, error) {
+	if dialer == nil {
+		return nil, errors.New("no dialer")
+	}
+	return newTunToSOCKS(tun, "", contextDialer{dialer}, dnsConfig)
+}
+
+// newTunToSOCKS creates a translator dialing with dialer, a SOCKS5 dialer
+// for the proxy at socksAddr or a custom one
+func newTunToSOCKS(tun Device, socksAddr string, dialer proxy.Dialer, dnsConfig *dns.Config) (*TunToSOCKS, error) {
 	t := &TunToSOCKS{
 		tun:         tun,
-		socksAddr:   socksAddr,
-		socksDialer: dialer,
-		connections: make(map[connKey]*tcpConn),
+		tcpConns:    make(map[net.Conn]struct{}),
+		flows:       make(map[*flow]struct{}),
+		udpSessions: make(map[udpConnKey]*udpSession),
 		stopCh:      make(chan struct{}),
 		stats:       &Stats{},
+		dialTimeout: defaultDialTimeout,
+
+		resumeTimeout: defaultResumeTimeout,
 	}
+	t.backend.Store(&socksBackend{addr: socksAddr, dialer: dialer})
+	t.SetPingPorts(DefaultPingPorts)
 
 	// Initialize DNS resolver if config provided
 	if dnsConfig != nil {
-		dnsConfig.SOCKSDialer = dialer
+		dnsConfig.SOCKSDialer = backendDialer{t}
 		resolver, err := dns.NewResolver(*dnsConfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create DNS resolver: %w", err)
 		}
 		t.dnsResolver = resolver
-		log.Infof("DNS resolver initialized for domains: %v, using server: %s", dnsConfig.Domains, dnsConfig.Resolver)
+		t.dnsSem = make(chan struct{}, maxDNSInFlight)
+		t.fakeIP = dnsConfig.FakeIP
+		log.Infof("DNS resolver initialized for domains: %v, using servers: %v", dnsConfig.Domains, dnsConfig.Resolvers)
 	}
 
 	return t, nil
 }
 
+// contextDialer adapts a Dialer to the proxy.Dialer the DNS resolver takes
+type contextDialer struct {
+	Dialer
+}
+
+// Dial connects to address without a deadline
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// backendDialer dials through the translator's current proxy, for the DNS
+// resolver
+type backendDialer struct {
+	t *TunToSOCKS
+}
+
+// Dial connects to address through the current proxy
+func (d backendDialer) Dial(network, address string) (net.Conn, error) {
+	return d.t.backend.Load().dialer.Dial(network, address)
+}
+
+// DialContext connects to address through the current proxy until ctx is
+// done
+func (d backendDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.t.backend.Load().dialer
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	return dialer.Dial(network, address)
+}
+
+// SetNATTable configures address translation for connections to NAT-mapped
+// local ranges. Must be called before Start.
+func (t *TunToSOCKS) SetNATTable(table *nat.Table) {
+	t.nat = table
+}
+
+// SetDialTimeout sets how long to wait for a SOCKS5 connection to a
+// destination. Must be called before Start.
+func (t *TunToSOCKS) SetDialTimeout(d time.Duration) {
+	if d > 0 {
+		t.dialTimeout = d
+	}
+}
+
+// SetScheduler makes TCP flows take turns sending into the tunnel. Must
+// be called before Start.
+func (t *TunToSOCKS) SetScheduler(s *Scheduler) {
+	t.scheduler = s
+}
+
+// SetPolicy sets which destinations connections may go to; the others
+// are refused. Must be called before Start.
+func (t *TunToSOCKS) SetPolicy(p *policy.Policy) {
+	t.policy = p
+}
+
+// allowed reports whether the policy lets a new flow of protocol go to
+// port of dstIP (after NAT), reached as dstHost, whose name is host. Denied
+// flows are counted and logged.
+func (t *TunToSOCKS) allowed(protocol string, dstIP net.IP, dstHost, host string, port uint16) bool {
+	if t.policy == nil {
+		return true
+	}
+	// The address of a fake-IP name means nothing at the destination
+	var addr netip.Addr
+	if _, err := netip.ParseAddr(dstHost); err == nil {
+		addr, _ = netip.AddrFromSlice(dstIP)
+	}
+	ok, rule := t.policy.Allows(addr, host, port)
+	if ok {
+		return true
+	}
+
+	t.stats.ConnDenied()
+	reason := "default policy"
+	if rule != nil {
+		reason = fmt.Sprintf("rule %q", rule)
+	}
+	dst := net.JoinHostPort(dstHost, strconv.Itoa(int(port)))
+	if host != "" && host != dstHost {
+		dst += " (" + host + ")"
+	}
+	hotLog.Warnf("Denied %s flow to %s by %s", protocol, dst, reason)
+	return false
+}
+
+// SetGatewayAddress sets the next-hop address of gateway routes through the
+// TUN device. Packets for it are not forwarded; pings to it are answered
+// locally. Must be called before Start.
+func (t *TunToSOCKS) SetGatewayAddress(ip net.IP) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		t.gateway = addr.Unmap()
+	}
+}
+
 // Start starts the TUN-to-SOCKS translator
 func (t *TunToSOCKS) Start(ctx context.Context) error {
 	log.Info("Starting TUN-to-SOCKS translator")
 
+	if err := t.startNetstack(ctx); err != nil {
+		return err
+	}
+
 	t.wg.Add(1)
 	go t.readPackets(ctx)
 
@@ -117,13 +293,11 @@ func (t *TunToSOCKS) Stop() error {
 		t.dnsResolver.Stop()
 	}
 
-	// Close all connections
-	t.connMu.Lock()
-	for _, conn := range t.connections {
-		conn.close()
-	}
-	t.connections = make(map[connKey]*tcpConn)
-	t.connMu.Unlock()
+	// Close all connections; the RSTs only reach local applications if
+	// the TUN device is still open (see ResetConnections)
+	t.ResetConnections(nil)
+	t.stopNetstack()
+	t.closeUDPSessions()
 
 	// Wait for goroutines to finish with timeout
 	done := make(chan struct{})
@@ -160,19 +334,19 @@ func (t *TunToSOCKS) readPackets(ctx context.Context) {
 
 		n, err := t.tun.Read(buf)
 		if err != nil {
-			// Check if we're stopping (TUN device closed during shutdown)
-			select {
-			case <-t.stopCh:
-				log.Debug("readPackets: stop signal received after read error, exiting")
-				return
-			case <-ctx.Done():
-				log.Debug("readPackets: context cancelled after read error, exiting")
+			switch {
+			case errors.Is(err, tunnel.ErrClosed), errors.Is(err, io.EOF), errors.Is(err, os.ErrClosed):
+				// The device is closed during shutdown (other devices than
+				// ours report io.EOF or os.ErrClosed)
+				log.Debug("readPackets: TUN device closed, exiting")
 				return
-			default:
-				// Transient error, retry after short delay
-				log.Debugf("readPackets: read error (will retry): %v", err)
-				time.Sleep(10 * time.Millisecond)
+			case tunnel.IsTemporary(err):
+				log.Debugf("readPackets: transient read error: %v", err)
 				continue
+			default:
+				log.Errorf("TUN read failed, no longer forwarding packets: %v", err)
+				t.stats.IncrementErrorsTX()
+				return
 			}
 		}
 
@@ -180,229 +354,52 @@ func (t *TunToSOCKS) readPackets(ctx context.Context) {
 			continue
 		}
 
-		packet := make([]byte, n)
-		copy(packet, buf[:n])
+		// Handlers copy whatever they need to keep, so the read buffer can
+		// be reused for the next packet without a per-packet allocation
+		packet := buf[:n]
 
 		if err := t.handlePacket(ctx, packet); err != nil {
 			log.Debugf("Packet handling error: %v", err)
 			t.stats.IncrementErrorsTX()
 		} else {
-			t.stats.IncrementTX(n)
+			t.countTX(packet)
 		}
 	}
 }
 
-// handlePacket processes an incoming IP packet
+// handlePacket processes an incoming IPv4 or IPv6 packet
 func (t *TunToSOCKS) handlePacket(ctx context.Context, packet []byte) error {
-	// Validate IP header
-	if len(packet) < 20 || (packet[0]>>4) != 4 {
-		return fmt.Errorf("invalid IPv4 packet")
-	}
-
-	ihl := int(packet[0]&0x0F) * 4
-	if len(packet) < ihl || ihl < 20 {
-		return fmt.Errorf("invalid IP header length")
-	}
-
-	protocol := packet[9]
-
-	// Handle UDP (for DNS)
-	if protocol == 17 {
-		return t.HandleUDPPacket(ctx, packet, ihl)
-	}
-
-	// Handle TCP only
-	if protocol != 6 {
-		return nil
-	}
-
-	srcIP := binary.BigEndian.Uint32(packet[12:16])
-	dstIP := binary.BigEndian.Uint32(packet[16:20])
-
-	// Validate TCP header
-	if len(packet) < ihl+20 {
-		return fmt.Errorf("packet too short for TCP")
-	}
-
-	tcpHeader := packet[ihl:]
-	srcPort := binary.BigEndian.Uint16(tcpHeader[0:2])
-	dstPort := binary.BigEndian.Uint16(tcpHeader[2:4])
-	seqNum := binary.BigEndian.Uint32(tcpHeader[4:8])
-	dataOffset := int(tcpHeader[12]>>4) * 4
-	flags := tcpHeader[13]
-
-	if len(tcpHeader) < dataOffset {
-		return fmt.Errorf("invalid TCP data offset")
+	p, err := parseIPPacket(packet)
+	if err != nil {
+		return err
 	}
 
-	payload := tcpHeader[dataOffset:]
-
-	key := connKey{srcIP, dstIP, srcPort, dstPort}
-
-	// Handle RST
-	if flags&tcpRST != 0 {
-		t.closeConn(key)
+	// Multicast and IPv6 link-local traffic (neighbour discovery, MLD, mDNS)
+	// is the kernel talking to the link, not to the remote network
+	if p.dst.IsMulticast() || (p.dst.Is6() && p.dst.IsLinkLocalUnicast()) {
 		return nil
 	}
 
-	// Handle FIN
-	if flags&tcpFIN != 0 {
-		t.closeConn(key)
-		return nil
+	// The gateway only exists locally, there is nothing to forward to
+	if t.gateway.IsValid() && p.dst == t.gateway {
+		return t.handleGatewayPacket(p)
 	}
 
-	// Handle SYN (new connection)
-	if flags&tcpSYN != 0 && flags&tcpACK == 0 {
-		return t.handleSYN(ctx, key, seqNum)
+	switch p.protocol {
+	case protoUDP:
+		// DNS is answered locally, the rest is relayed
+		return t.handleUDP(ctx, p)
+	case protoICMP, protoICMPv6:
+		// Echo requests are answered after a TCP probe
+		return t.handleICMP(ctx, p)
+	case protoTCP:
+		// TCP is handled by netstack
+		return t.handleTCP(packet, p.dst.Is6())
 	}
-
-	// Get existing connection
-	t.connMu.RLock()
-	conn, exists := t.connections[key]
-	t.connMu.RUnlock()
-
-	if !exists {
-		return nil // Connection not found, ignore
-	}
-
-	conn.mu.Lock()
-	conn.lastActive = time.Now()
-	conn.seqNum = seqNum
-	// ackNum in our outgoing packets = next byte we expect from client
-	conn.ackNum = seqNum + uint32(len(payload))
-	conn.mu.Unlock()
-
-	// Forward payload if present
-	if len(payload) > 0 && conn.socksConn != nil {
-		_, err := conn.socksConn.Write(payload)
-		if err != nil {
-			t.closeConn(key)
-			return fmt.Errorf("SOCKS write failed: %w", err)
-		}
-	}
-
-	return nil
-}
-
-// handleSYN handles a new TCP SYN packet
-func (t *TunToSOCKS) handleSYN(ctx context.Context, key connKey, seqNum uint32) error {
-	dstAddr := fmt.Sprintf("%s:%d", uint32ToIP(key.dstIP), key.dstPort)
-
-	log.Debugf("New connection: %s:%d -> %s", uint32ToIP(key.srcIP), key.srcPort, dstAddr)
-
-	// Dial through SOCKS5
-	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
-	defer cancel()
-
-	socksConn, err := t.socksDialer.(interface {
-		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
-	}).DialContext(dialCtx, "tcp", dstAddr)
-
-	if err != nil {
-		// If DialContext not available, try regular Dial
-		socksConn, err = t.socksDialer.Dial("tcp", dstAddr)
-		if err != nil {
-			log.Debugf("SOCKS dial failed for %s: %v", dstAddr, err)
-			return err
-		}
-	}
-
-	conn := &tcpConn{
-		key:         key,
-		socksConn:   socksConn,
-		lastActive:  time.Now(),
-		seqNum:      seqNum,
-		ackNum:      seqNum + 1,
-		serverSeq:   1, // SYN-ACK consumed seq 0
-		established: true,
-	}
-
-	t.connMu.Lock()
-	t.connections[key] = conn
-	t.connMu.Unlock()
-
-	// Send SYN-ACK
-	t.sendSYNACK(key, seqNum)
-
-	// Start reading from SOCKS connection
-	t.wg.Add(1)
-	go t.readFromSOCKS(conn)
-
 	return nil
 }
 
-// sendSYNACK sends a SYN-ACK response
-func (t *TunToSOCKS) sendSYNACK(key connKey, seqNum uint32) {
-	packet := buildTCPPacket(
-		uint32ToIP(key.dstIP), key.dstPort,
-		uint32ToIP(key.srcIP), key.srcPort,
-		0, seqNum+1,
-		tcpSYN|tcpACK, nil,
-	)
-
-	t.tun.Write(packet)
-	t.stats.IncrementRX(len(packet))
-}
-
-// readFromSOCKS reads data from SOCKS connection and sends to TUN
-func (t *TunToSOCKS) readFromSOCKS(conn *tcpConn) {
-	defer t.wg.Done()
-	defer t.closeConn(conn.key)
-
-	buf := make([]byte, 16384)
-
-	for {
-		select {
-		case <-t.stopCh:
-			log.Debug("readFromSOCKS: stop signal received, closing connection")
-			return
-		default:
-		}
-
-		conn.socksConn.SetReadDeadline(time.Now().Add(readTimeout))
-		n, err := conn.socksConn.Read(buf)
-
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			return
-		}
-
-		if n > 0 {
-			conn.mu.Lock()
-			serverSeq := conn.serverSeq
-			ackNum := conn.ackNum
-			conn.serverSeq += uint32(n)
-			conn.lastActive = time.Now()
-			conn.mu.Unlock()
-
-			// Send data packet: seq=our outgoing seq, ack=next expected from client
-			packet := buildTCPPacket(
-				uint32ToIP(conn.key.dstIP), conn.key.dstPort,
-				uint32ToIP(conn.key.srcIP), conn.key.srcPort,
-				serverSeq, ackNum,
-				tcpPSH|tcpACK, buf[:n],
-			)
-
-			t.tun.Write(packet)
-			t.stats.IncrementRX(len(packet))
-		}
-	}
-}
-
-// closeConn closes a connection
-func (t *TunToSOCKS) closeConn(key connKey) {
-	t.connMu.Lock()
-	defer t.connMu.Unlock()
-
-	if conn, exists := t.connections[key]; exists {
-		conn.close()
-		delete(t.connections, key)
-	}
-}
-
-// cleanupConnections periodically removes stale connections
+// cleanupConnections periodically removes idle UDP flows
 func (t *TunToSOCKS) cleanupConnections(ctx context.Context) {
 	defer t.wg.Done()
 	ticker := time.NewTicker(cleanupTicker)
@@ -417,131 +414,17 @@ func (t *TunToSOCKS) cleanupConnections(ctx context.Context) {
 			log.Debug("cleanupConnections: stop signal received, exiting")
 			return
 		case <-ticker.C:
-			t.cleanup()
+			t.cleanupUDP()
 		}
 	}
 }
 
-// cleanup removes idle connections
-func (t *TunToSOCKS) cleanup() {
-	t.connMu.Lock()
-	defer t.connMu.Unlock()
-
-	now := time.Now()
-	for key, conn := range t.connections {
-		conn.mu.Lock()
-		idle := now.Sub(conn.lastActive) > connTimeout
-		conn.mu.Unlock()
-
-		if idle {
-			log.Debugf("Closing idle connection: %s:%d -> %s:%d",
-				uint32ToIP(key.srcIP), key.srcPort,
-				uint32ToIP(key.dstIP), key.dstPort)
-			conn.close()
-			delete(t.connections, key)
-		}
-	}
-}
-
-// close closes a TCP connection
-func (c *tcpConn) close() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.closing {
-		return
-	}
-	c.closing = true
-
-	if c.socksConn != nil {
-		c.socksConn.Close()
-	}
-}
-
 // GetStats returns traffic statistics
 func (t *TunToSOCKS) GetStats() Stats {
 	return t.stats.Copy()
 }
 
-// buildTCPPacket constructs a TCP/IP packet
-func buildTCPPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
-	seqNum, ackNum uint32, flags byte, payload []byte) []byte {
-
-	ipHdrLen := 20
-	tcpHdrLen := 20
-	totalLen := ipHdrLen + tcpHdrLen + len(payload)
-
-	packet := make([]byte, totalLen)
-
-	// IP Header
-	packet[0] = 0x45 // Version 4, IHL 5
-	binary.BigEndian.PutUint16(packet[2:4], uint16(totalLen))
-	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment
-	packet[8] = 64                                  // TTL
-	packet[9] = 6                                   // TCP
-	copy(packet[12:16], srcIP.To4())
-	copy(packet[16:20], dstIP.To4())
-
-	// IP checksum
-	binary.BigEndian.PutUint16(packet[10:12], ipChecksum(packet[:ipHdrLen]))
-
-	// TCP Header
-	tcp := packet[ipHdrLen:]
-	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
-	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
-	binary.BigEndian.PutUint32(tcp[4:8], seqNum)
-	binary.BigEndian.PutUint32(tcp[8:12], ackNum)
-	tcp[12] = 0x50 // Data offset: 5 (20 bytes)
-	tcp[13] = flags
-	binary.BigEndian.PutUint16(tcp[14:16], 65535) // Window size
-
-	// Copy payload
-	copy(tcp[tcpHdrLen:], payload)
-
-	// TCP checksum
-	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(srcIP, dstIP, tcp))
-
-	return packet
-}
-
-// ipChecksum calculates IP header checksum
-func ipChecksum(header []byte) uint16 {
-	sum := uint32(0)
-	for i := 0; i < len(header); i += 2 {
-		if i+1 < len(header) {
-			sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
-		}
-	}
-	for sum > 0xffff {
-		sum = (sum & 0xffff) + (sum >> 16)
-	}
-	return ^uint16(sum)
-}
-
-// tcpChecksum calculates TCP checksum with pseudo-header
-func tcpChecksum(srcIP, dstIP net.IP, tcpSegment []byte) uint16 {
-	pseudo := make([]byte, 12+len(tcpSegment))
-	copy(pseudo[0:4], srcIP.To4())
-	copy(pseudo[4:8], dstIP.To4())
-	pseudo[9] = 6 // TCP protocol
-	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcpSegment)))
-	copy(pseudo[12:], tcpSegment)
-
-	sum := uint32(0)
-	for i := 0; i < len(pseudo); i += 2 {
-		if i+1 < len(pseudo) {
-			sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
-		} else {
-			sum += uint32(pseudo[i]) << 8
-		}
-	}
-	for sum > 0xffff {
-		sum = (sum & 0xffff) + (sum >> 16)
-	}
-	return ^uint16(sum)
-}
-
-// uint32ToIP converts uint32 to net.IP
-func uint32ToIP(ip uint32) net.IP {
-	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
+// DNSResolver returns the DNS resolver, or nil if DNS interception is disabled
+func (t *TunToSOCKS) DNSResolver() *dns.Resolver {
+	return t.dnsResolver
 }
@@ -4,60 +4,56 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"sync"
 
 	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
-// UDP connection tracking for DNS
-type udpConnKey struct {
-	srcIP   uint32
-	dstIP   uint32
-	srcPort uint16
-	dstPort uint16
-}
-
-// HandleUDPPacket processes UDP packets (primarily for DNS)
+// handleUDP processes UDP packets.
 // Note: UDP DNS queries are captured here but forwarded via TCP through the tunnel
 // for better SOCKS5 compatibility. This allows standard UDP DNS to work with SOCKS5 proxies.
-func (t *TunToSOCKS) HandleUDPPacket(ctx context.Context, packet []byte, ihl int) error {
-	if len(packet) < ihl+8 {
+// Other UDP traffic is relayed through a SOCKS5 UDP association (see forwardUDP).
+func (t *TunToSOCKS) handleUDP(ctx context.Context, p ipPacket) error {
+	if len(p.payload) < 8 {
 		return fmt.Errorf("packet too short for UDP")
 	}
 
-	udpHeader := packet[ihl:]
+	udpHeader := p.payload
 	srcPort := binary.BigEndian.Uint16(udpHeader[0:2])
 	dstPort := binary.BigEndian.Uint16(udpHeader[2:4])
 	udpLength := binary.BigEndian.Uint16(udpHeader[4:6])
 
-	if len(udpHeader) < int(udpLength) {
+	if len(udpHeader) < int(udpLength) || udpLength < 8 {
 		return fmt.Errorf("truncated UDP packet")
 	}
 
-	// Check if this is a DNS query (port 53)
-	if dstPort != 53 {
-		// Not DNS, ignore (could be extended to handle other UDP traffic)
-		log.Debugf("UDP: ignoring non-DNS packet to port %d", dstPort)
-		return nil
+	// Anything but a DNS query we can answer is relayed as is
+	if dstPort != 53 || t.dnsResolver == nil {
+		return t.forwardUDP(ctx, udpConnKey{p.src, p.dst, srcPort, dstPort}, udpHeader[8:udpLength])
 	}
 
-	// Extract IP addresses
-	srcIP := binary.BigEndian.Uint32(packet[12:16])
-	dstIP := binary.BigEndian.Uint32(packet[16:20])
-
 	// Extract DNS query payload
 	dnsPayload := udpHeader[8:udpLength]
 
 	// Handle DNS query
-	return t.handleDNSQuery(ctx, packet, srcIP, dstIP, srcPort, dstPort, dnsPayload)
+	return t.handleDNSQuery(ctx, p.src, p.dst, srcPort, dstPort, dnsPayload)
 }
 
 // handleDNSQuery processes a DNS query packet
 // This function receives UDP DNS queries from applications and forwards them
 // via TCP through the SOCKS5 tunnel (TCP DNS is more reliable through SOCKS5).
 // The response is then converted back to UDP and sent to the application.
-func (t *TunToSOCKS) handleDNSQuery(ctx context.Context, originalPacket []byte,
-	srcIP, dstIP uint32, srcPort, dstPort uint16, queryData []byte) error {
+//
+// Cached answers are written straight back to the TUN device from the read
+// loop; everything else is resolved in a separate goroutine so that a slow
+// lookup never stalls other traffic. queryData is only valid for the
+// duration of the call.
+func (t *TunToSOCKS) handleDNSQuery(ctx context.Context,
+	srcIP, dstIP netip.Addr, srcPort, dstPort uint16, queryData []byte) error {
 
 	if t.dnsResolver == nil {
 		// No DNS resolver configured, ignore
@@ -65,105 +61,229 @@ func (t *TunToSOCKS) handleDNSQuery(ctx context.Context, originalPacket []byte,
 		return nil
 	}
 
-	// Extract domain name from query to check if we should handle it
-	domain := dns.ExtractDomainFromQuery(queryData)
-	if domain == "" {
-		log.Debugf("DNS: could not extract domain from query")
+	if len(queryData) < 12 {
+		return fmt.Errorf("DNS query too short")
+	}
+
+	// Parse the query to check if we should handle it
+	q, err := dns.ParseQuery(queryData)
+	if err != nil {
+		log.Debugf("DNS: ignoring unparseable query: %v", err)
 		return nil
 	}
+	domain := q.String()
 
 	// Check if this domain should be resolved through the tunnel
-	if !t.dnsResolver.ShouldHandle(domain) {
-		log.Debugf("DNS: domain %s not configured for tunnel resolution", domain)
+	if !t.dnsResolver.Accept(q) {
+		log.Debugf("DNS: domain %s not configured for tunnel resolution", q.Name)
 		return nil
 	}
 
-	log.Debugf("DNS: resolving %s through tunnel (via TCP)", domain)
+	queryID := q.ID
 
-	// Perform DNS query through tunnel using TCP (converted from UDP)
-	responseData, err := t.dnsResolver.Query(ctx, queryData)
-	if err != nil {
-		log.Debugf("DNS: query failed for %s: %v", domain, err)
-		return err
+	// Answers larger than the client accepts are truncated with TC set, so
+	// that the client retries over TCP (see serveDNSOverTCP)
+	udpSize := q.UDPSize
+
+	// Fast path: answer from cache without touching the tunnel
+	if cached, ok := t.dnsResolver.Lookup(queryData); ok {
+		log.Debugf("DNS: answering %s from cache", domain)
+		return t.writeDNSResponse(dstIP, dstPort, srcIP, srcPort, queryID, t.dnsResolver.TruncateUDP(cached, udpSize))
+	}
+
+	// Slow path: resolve through the tunnel off the TUN read loop
+	select {
+	case t.dnsSem <- struct{}{}:
+	default:
+		// The client will retry; queueing would only add latency
+		log.Debugf("DNS: %d queries in flight, dropping query for %s", maxDNSInFlight, domain)
+		return nil
 	}
 
-	// Build UDP response packet
-	responsePacket := buildUDPPacket(
-		uint32ToIP(dstIP), dstPort,
-		uint32ToIP(srcIP), srcPort,
-		responseData,
-	)
+	query := make([]byte, len(queryData))
+	copy(query, queryData)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() { <-t.dnsSem }()
+
+		log.Debugf("DNS: resolving %s through tunnel (via TCP)", domain)
+
+		// Perform DNS query through tunnel using TCP (converted from UDP)
+		responseData, err := t.dnsResolver.Query(ctx, query)
+		if err != nil {
+			log.Debugf("DNS: query failed for %s: %v", domain, err)
+			t.stats.IncrementErrorsTX()
+			return
+		}
+
+		if len(responseData) > udpSize {
+			log.Debugf("DNS: response for %s exceeds %d bytes, truncating", domain, udpSize)
+			responseData = t.dnsResolver.TruncateUDP(responseData, udpSize)
+		}
+
+		if err := t.writeDNSResponse(dstIP, dstPort, srcIP, srcPort, queryID, responseData); err != nil {
+			log.Debugf("DNS: %v", err)
+			return
+		}
+		log.Debugf("DNS: sent response for %s (%d bytes)", domain, len(responseData))
+	}()
+
+	return nil
+}
+
+// serveDNSOverTCP answers length-prefixed DNS queries arriving on conn, the
+// local end of an intercepted TCP connection to port 53. Clients retry over
+// TCP when a UDP answer was truncated. Queries are resolved concurrently and
+// answered in completion order, as RFC 7766 allows.
+func (t *TunToSOCKS) serveDNSOverTCP(ctx context.Context, conn net.Conn) {
+	defer t.wg.Done()
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	var queries sync.WaitGroup
+	defer queries.Wait()
+
+	for {
+		var lengthBuf [2]byte
+		if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lengthBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if len(query) < 12 {
+			log.Debugf("DNS: TCP query too short")
+			return
+		}
+
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+
+			response := t.resolveTCPQuery(ctx, query)
+			if response == nil {
+				return
+			}
+
+			msg := make([]byte, 2+len(response))
+			binary.BigEndian.PutUint16(msg[0:2], uint16(len(response)))
+			copy(msg[2:], response)
 
-	// Send response back through TUN device
-	_, err = t.tun.Write(responsePacket)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if _, err := conn.Write(msg); err != nil {
+				log.Debugf("DNS: failed to write TCP response: %v", err)
+			}
+		}()
+	}
+}
+
+// resolveTCPQuery resolves a query received over TCP. Unlike UDP, where the
+// client simply times out, queries outside the tunnel domains are refused
+// and failures are answered with SERVFAIL so the client does not hang.
+func (t *TunToSOCKS) resolveTCPQuery(ctx context.Context, query []byte) []byte {
+	q, err := dns.ParseQuery(query)
 	if err != nil {
-		return fmt.Errorf("failed to write DNS response: %w", err)
+		log.Debugf("DNS: refusing unparseable TCP query: %v", err)
+		return dns.ErrorResponse(query, dnsmessage.RCodeFormatError)
 	}
+	domain := q.String()
 
-	t.stats.IncrementRX(len(responsePacket))
-	log.Debugf("DNS: sent response for %s (%d bytes)", domain, len(responsePacket))
+	if !t.dnsResolver.Accept(q) {
+		log.Debugf("DNS: refusing TCP query for %s", domain)
+		return dns.ErrorResponse(query, dnsmessage.RCodeRefused)
+	}
 
-	return nil
+	log.Debugf("DNS: resolving %s through tunnel (TCP client)", domain)
+
+	response, err := t.dnsResolver.Query(ctx, query)
+	if err != nil {
+		log.Debugf("DNS: query failed for %s: %v", domain, err)
+		t.stats.IncrementErrorsTX()
+		return dns.ErrorResponse(query, dnsmessage.RCodeServerFailure)
+	}
+	return response
 }
 
-// buildUDPPacket constructs a UDP/IP packet
-func buildUDPPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, payload []byte) []byte {
-	ipHdrLen := 20
-	udpHdrLen := 8
-	totalLen := ipHdrLen + udpHdrLen + len(payload)
+// writeDNSResponse builds the UDP reply for a DNS response in a pooled
+// buffer, sets the client's transaction ID and writes it to the TUN device
+func (t *TunToSOCKS) writeDNSResponse(srcIP netip.Addr, srcPort uint16, dstIP netip.Addr, dstPort uint16,
+	queryID uint16, response []byte) error {
 
-	packet := make([]byte, totalLen)
+	headerLen := udpPacketHeaderLen(srcIP)
+	totalLen := headerLen + len(response)
 
-	// IP Header
-	packet[0] = 0x45 // Version 4, IHL 5
-	binary.BigEndian.PutUint16(packet[2:4], uint16(totalLen))
-	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment
-	packet[8] = 64                                  // TTL
-	packet[9] = 17                                  // UDP
-	copy(packet[12:16], srcIP.To4())
-	copy(packet[16:20], dstIP.To4())
+	bufPtr := dnsPacketPool.Get().(*[]byte)
+	defer dnsPacketPool.Put(bufPtr)
+	buf := *bufPtr
+	if totalLen > len(buf) {
+		buf = make([]byte, totalLen)
+	}
+	packet := buf[:totalLen]
 
-	// IP checksum
-	binary.BigEndian.PutUint16(packet[10:12], ipChecksum(packet[:ipHdrLen]))
+	copy(packet[headerLen:], response)
+	binary.BigEndian.PutUint16(packet[headerLen:headerLen+2], queryID)
+	finishUDPPacket(packet, srcIP, srcPort, dstIP, dstPort)
 
-	// UDP Header
-	udp := packet[ipHdrLen:]
-	binary.BigEndian.PutUint16(udp[0:2], srcPort)
-	binary.BigEndian.PutUint16(udp[2:4], dstPort)
-	binary.BigEndian.PutUint16(udp[4:6], uint16(udpHdrLen+len(payload)))
+	if _, err := t.tun.Write(packet); err != nil {
+		return fmt.Errorf("failed to write DNS response: %w", err)
+	}
 
-	// Copy payload
-	copy(udp[udpHdrLen:], payload)
+	t.countRX(packet)
+	return nil
+}
+
+const (
+	// maxDNSInFlight bounds concurrent DNS queries sent through the tunnel
+	maxDNSInFlight = 64
+
+	// dnsPacketBufSize fits the reply packet of all but unusually large
+	// DNS responses
+	dnsPacketBufSize = 4096
+)
+
+// dnsPacketPool holds preallocated reply packet buffers
+var dnsPacketPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, dnsPacketBufSize)
+		return &buf
+	},
+}
 
-	// UDP checksum (calculate for better compatibility)
-	binary.BigEndian.PutUint16(udp[6:8], udpChecksum(srcIP, dstIP, udp))
+// udpPacketHeaderLen returns the size of the IP and UDP headers we generate
+// for packets from addr
+func udpPacketHeaderLen(addr netip.Addr) int {
+	return ipHeaderLen(addr) + 8
+}
 
+// buildUDPPacket constructs a UDP/IP packet
+func buildUDPPacket(srcIP netip.Addr, srcPort uint16, dstIP netip.Addr, dstPort uint16, payload []byte) []byte {
+	headerLen := udpPacketHeaderLen(srcIP)
+	packet := make([]byte, headerLen+len(payload))
+	copy(packet[headerLen:], payload)
+	finishUDPPacket(packet, srcIP, srcPort, dstIP, dstPort)
 	return packet
 }
 
-// udpChecksum calculates UDP checksum with pseudo-header
-func udpChecksum(srcIP, dstIP net.IP, udpSegment []byte) uint16 {
-	pseudo := make([]byte, 12+len(udpSegment))
-	copy(pseudo[0:4], srcIP.To4())
-	copy(pseudo[4:8], dstIP.To4())
-	pseudo[9] = 17 // UDP protocol
-	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(udpSegment)))
-	copy(pseudo[12:], udpSegment)
-
-	// Clear checksum field before calculation
-	pseudo[12+6] = 0
-	pseudo[12+7] = 0
-
-	sum := uint32(0)
-	for i := 0; i < len(pseudo); i += 2 {
-		if i+1 < len(pseudo) {
-			sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
-		} else {
-			sum += uint32(pseudo[i]) << 8
-		}
-	}
-	for sum > 0xffff {
-		sum = (sum & 0xffff) + (sum >> 16)
+// finishUDPPacket fills in the IP and UDP headers (including checksums) of
+// a packet whose payload is already in place after udpPacketHeaderLen
+func finishUDPPacket(packet []byte, srcIP netip.Addr, srcPort uint16, dstIP netip.Addr, dstPort uint16) {
+	putIPHeader(packet, srcIP, dstIP, protoUDP)
+
+	// UDP Header
+	udp := packet[ipHeaderLen(srcIP):]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	udp[6], udp[7] = 0, 0
+
+	// UDP checksum (mandatory for IPv6)
+	checksum := transportChecksum(srcIP, dstIP, protoUDP, udp)
+	if checksum == 0 {
+		checksum = 0xffff
 	}
-	return ^uint16(sum)
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
 }
@@ -0,0 +1,242 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ICMP and ICMPv6 message types
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	// maxPingInFlight bounds concurrent echo probes through the tunnel
+	maxPingInFlight = 32
+
+	// pingProbeTimeout bounds the TCP probe answering one echo request
+	pingProbeTimeout = 3 * time.Second
+)
+
+// DefaultPingPorts are the TCP ports probed to answer pings
+var DefaultPingPorts = []int{22, 443, 80}
+
+// pingState tracks echo probes. SOCKS5 cannot carry ICMP, so an echo
+// request is answered if a TCP connection to the destination can be made
+// (or is refused, which also proves the host is up).
+type pingState struct {
+	ports []int
+	sem   chan struct{}
+
+	mu       sync.Mutex
+	lastPort map[netip.Addr]int // port that answered last, per destination
+}
+
+// SetPingPorts sets the TCP ports probed to answer ICMP echo requests
+// through the tunnel; no ports disables ping support. Must be called before
+// Start.
+func (t *TunToSOCKS) SetPingPorts(ports []int) {
+	if len(ports) == 0 {
+		t.ping = nil
+		return
+	}
+	t.ping = &pingState{
+		ports:    ports,
+		sem:      make(chan struct{}, maxPingInFlight),
+		lastPort: make(map[netip.Addr]int),
+	}
+}
+
+// handleICMP answers ICMP and ICMPv6 echo requests after probing the
+// destination through the tunnel. Other ICMP messages are dropped.
+func (t *TunToSOCKS) handleICMP(ctx context.Context, p ipPacket) error {
+	if len(p.payload) < 8 {
+		return fmt.Errorf("packet too short for ICMP")
+	}
+	if t.ping == nil || !isEchoRequest(p) {
+		return nil
+	}
+
+	select {
+	case t.ping.sem <- struct{}{}:
+	default:
+		log.Debugf("ICMP: %d probes in flight, dropping echo request to %s", maxPingInFlight, p.dst)
+		return nil
+	}
+
+	// The echo message (identifier, sequence number and data) is sent back
+	// unchanged, so keep a copy
+	echo := make([]byte, len(p.payload))
+	copy(echo, p.payload)
+	src, dst := p.src, p.dst
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() { <-t.ping.sem }()
+
+		if !t.probeHost(ctx, dst) {
+			log.Debugf("ICMP: %s did not answer the TCP probe, no echo reply", dst)
+			return
+		}
+
+		reply := buildICMPEchoReply(dst, src, echo)
+		if _, err := t.tun.Write(reply); err != nil {
+			log.Debugf("ICMP: failed to write echo reply: %v", err)
+			t.stats.IncrementErrorsRX()
+			return
+		}
+		t.countRX(reply)
+	}()
+
+	return nil
+}
+
+// handleGatewayPacket answers pings to the gateway address, so that tools
+// checking the next hop see it as up. Other packets for it are dropped.
+func (t *TunToSOCKS) handleGatewayPacket(p ipPacket) error {
+	if len(p.payload) < 8 || !isEchoRequest(p) {
+		return nil
+	}
+
+	reply := buildICMPEchoReply(p.dst, p.src, p.payload)
+	if _, err := t.tun.Write(reply); err != nil {
+		t.stats.IncrementErrorsRX()
+		return fmt.Errorf("failed to write echo reply: %w", err)
+	}
+	t.countRX(reply)
+	return nil
+}
+
+// isEchoRequest reports whether the packet is an ICMP or ICMPv6 echo
+// request
+func isEchoRequest(p ipPacket) bool {
+	if len(p.payload) < 2 || p.payload[1] != 0 {
+		return false
+	}
+	switch p.protocol {
+	case protoICMP:
+		return p.dst.Is4() && p.payload[0] == icmpEchoRequest
+	case protoICMPv6:
+		return p.dst.Is6() && p.payload[0] == icmpv6EchoRequest
+	}
+	return false
+}
+
+// probeHost reports whether the destination answers a TCP connection
+// through the tunnel. The port that answered last time is tried first;
+// otherwise all ports are probed at once.
+func (t *TunToSOCKS) probeHost(ctx context.Context, dstIP netip.Addr) bool {
+	ip := addrIP(dstIP)
+	if remoteIP, ok := t.nat.ToRemote(ip); ok {
+		ip = remoteIP
+	}
+	host, ok := t.remoteHost(ip)
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, min(t.dialTimeout, pingProbeTimeout))
+	defer cancel()
+
+	t.ping.mu.Lock()
+	last, known := t.ping.lastPort[dstIP]
+	t.ping.mu.Unlock()
+
+	if known && t.probePort(ctx, host, last) {
+		return true
+	}
+
+	answered := make(chan int, len(t.ping.ports))
+	var wg sync.WaitGroup
+	for _, port := range t.ping.ports {
+		if known && port == last {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if t.probePort(ctx, host, port) {
+				answered <- port
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(answered)
+	}()
+
+	port, ok := <-answered
+	t.ping.mu.Lock()
+	if ok {
+		t.ping.lastPort[dstIP] = port
+	} else {
+		delete(t.ping.lastPort, dstIP)
+	}
+	t.ping.mu.Unlock()
+	return ok
+}
+
+// probePort reports whether a TCP connection to host:port through the
+// tunnel is accepted or actively refused
+func (t *TunToSOCKS) probePort(ctx context.Context, host string, port int) bool {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	conn, err := t.dialSOCKS(ctx, addr)
+	if err != nil {
+		// A proxy that reports "connection refused" got a RST from the host
+		return strings.Contains(err.Error(), "connection refused")
+	}
+	conn.Close()
+	return true
+}
+
+// buildICMPEchoReply constructs the ICMP (or, for IPv6 addresses, ICMPv6)
+// echo reply to an echo message
+func buildICMPEchoReply(srcIP, dstIP netip.Addr, echo []byte) []byte {
+	headerLen := ipHeaderLen(srcIP)
+	packet := make([]byte, headerLen+len(echo))
+
+	// Echo reply with the request's identifier, sequence and data
+	icmp := packet[headerLen:]
+	copy(icmp, echo)
+	icmp[1] = 0
+	icmp[2], icmp[3] = 0, 0
+
+	if srcIP.Is4() {
+		putIPHeader(packet, srcIP, dstIP, protoICMP)
+		icmp[0] = icmpEchoReply
+		binary.BigEndian.PutUint16(icmp[2:4], icmpChecksum(icmp))
+	} else {
+		// The ICMPv6 checksum covers the IPv6 pseudo-header
+		putIPHeader(packet, srcIP, dstIP, protoICMPv6)
+		icmp[0] = icmpv6EchoReply
+		binary.BigEndian.PutUint16(icmp[2:4], transportChecksum(srcIP, dstIP, protoICMPv6, icmp))
+	}
+
+	return packet
+}
+
+// icmpChecksum calculates the ICMP checksum. The checksum field of msg must
+// be zero.
+func icmpChecksum(msg []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i : i+2]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
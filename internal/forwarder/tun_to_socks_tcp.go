@@ -0,0 +1,491 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// TCP is terminated by gVisor's userspace TCP/IP stack (netstack), which
+// takes care of retransmission, windows and FIN handling. Each accepted
+// connection is relayed to a SOCKS5 connection to its destination.
+
+const (
+	// netstackNIC is the ID of the stack's only NIC, backed by the TUN device
+	netstackNIC tcpip.NICID = 1
+
+	// linkQueueLen is the number of packets queued from netstack to the TUN
+	// device
+	linkQueueLen = 1024
+
+	// maxTCPInFlight bounds connections being dialed through the proxy;
+	// further SYNs are dropped (and retransmitted by the client)
+	maxTCPInFlight = 1024
+)
+
+// startNetstack creates the userspace TCP/IP stack. It accepts TCP
+// connections to any address (the destinations behind the tunnel) and
+// hands them to forwardTCP.
+func (t *TunToSOCKS) startNetstack(ctx context.Context) error {
+	mtu := t.tun.MTU()
+	if mtu <= 0 {
+		mtu = 1500
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	link := channel.New(linkQueueLen, uint32(mtu), "")
+
+	if err := s.CreateNIC(netstackNIC, link); err != nil {
+		return fmt.Errorf("failed to create netstack NIC: %s", err)
+	}
+
+	// Accept packets for, and send packets from, any address
+	if err := s.SetPromiscuousMode(netstackNIC, true); err != nil {
+		return fmt.Errorf("failed to enable promiscuous mode: %s", err)
+	}
+	if err := s.SetSpoofing(netstackNIC, true); err != nil {
+		return fmt.Errorf("failed to enable spoofing: %s", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netstackNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: netstackNIC},
+	})
+
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return fmt.Errorf("failed to enable TCP SACK: %s", err)
+	}
+
+	forwarder := tcp.NewForwarder(s, 0, maxTCPInFlight, func(r *tcp.ForwarderRequest) {
+		t.forwardTCP(ctx, r)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	t.stack = s
+	t.link = link
+
+	t.wg.Add(1)
+	go t.writePackets(ctx)
+
+	return nil
+}
+
+// stopNetstack tears down the stack, closing all TCP connections
+func (t *TunToSOCKS) stopNetstack() {
+	if t.stack == nil {
+		return
+	}
+
+	t.connMu.Lock()
+	for conn := range t.tcpConns {
+		conn.Close()
+	}
+	t.connMu.Unlock()
+
+	t.link.Close()
+	t.stack.Close()
+	t.stack.Wait()
+}
+
+// CloseFlows closes the relayed TCP connections, which their clients see as
+// reset; new connections are still accepted. It returns the number of flows
+// it closed.
+func (t *TunToSOCKS) CloseFlows() int {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	flows := 0
+	for conn := range t.tcpConns {
+		// Each flow has one client connection, and a proxy connection once
+		// it is established
+		if _, ok := conn.(*clientConn); ok {
+			flows++
+		}
+		conn.Close()
+	}
+	return flows
+}
+
+// ResetConnections resets the relayed TCP connections whose destination
+// matches (all of them if match is nil) and returns how many it reset.
+// The RSTs are written to the TUN device right away, so local applications
+// see the connections end instead of waiting in ESTABLISHED for their own
+// timeouts. Resetting rather than closing with a FIN keeps applications
+// from taking a cut-off response for a complete one.
+func (t *TunToSOCKS) ResetConnections(match func(netip.Addr) bool) int {
+	if t.stack == nil {
+		return 0
+	}
+
+	t.connMu.Lock()
+	var clients []*clientConn
+	for conn := range t.tcpConns {
+		client, ok := conn.(*clientConn)
+		if !ok {
+			continue
+		}
+		if match != nil {
+			addr, ok := client.LocalAddr().(*net.TCPAddr)
+			if !ok || !match(addr.AddrPort().Addr().Unmap()) {
+				continue
+			}
+		}
+		clients = append(clients, client)
+	}
+	t.connMu.Unlock()
+
+	for _, client := range clients {
+		client.reset()
+		// The link queue is bounded: write the RSTs out as they come
+		t.flushLink()
+	}
+	return len(clients)
+}
+
+// flushLink writes the packets queued by netstack to the TUN device, also
+// when writePackets has already stopped during shutdown
+func (t *TunToSOCKS) flushLink() {
+	for {
+		pkt := t.link.Read()
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+
+		packet := view.AsSlice()
+		if _, err := t.tun.Write(packet); err == nil {
+			t.countRX(packet)
+		} else {
+			log.Debugf("Failed to write packet to TUN: %v", err)
+		}
+		view.Release()
+	}
+}
+
+// Drain stops relaying new flows: new TCP connections get a reset and the
+// datagrams of new UDP flows are dropped, while the open ones carry on. DNS
+// queries are still answered.
+func (t *TunToSOCKS) Drain() {
+	t.draining.Store(true)
+}
+
+// Draining reports whether Drain was called
+func (t *TunToSOCKS) Draining() bool {
+	return t.draining.Load()
+}
+
+// handleTCP hands a TCP packet (IPv4, or IPv6 if isIPv6 is set) from the TUN
+// device to netstack. The packet is copied, so the read buffer can be
+// reused.
+func (t *TunToSOCKS) handleTCP(packet []byte, isIPv6 bool) error {
+	if t.stack == nil {
+		return fmt.Errorf("netstack not started")
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(packet),
+	})
+	protocol := ipv4.ProtocolNumber
+	if isIPv6 {
+		protocol = ipv6.ProtocolNumber
+	}
+	t.link.InjectInbound(protocol, pkt)
+	pkt.DecRef()
+	return nil
+}
+
+// writePackets writes the packets netstack sends to the TUN device
+func (t *TunToSOCKS) writePackets(ctx context.Context) {
+	defer t.wg.Done()
+
+	for {
+		pkt := t.link.ReadContext(ctx)
+		if pkt == nil {
+			// Context cancelled or link closed
+			return
+		}
+
+		view := pkt.ToView()
+		pkt.DecRef()
+
+		packet := view.AsSlice()
+		_, err := t.tun.Write(packet)
+		if err == nil {
+			t.countRX(packet)
+		}
+		view.Release()
+		if errors.Is(err, tunnel.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Debugf("Failed to write packet to TUN: %v", err)
+			t.stats.IncrementErrorsRX()
+		}
+	}
+}
+
+// forwardTCP handles a new TCP connection accepted by netstack. The
+// connection is only completed once the destination has been reached
+// through the proxy; otherwise the client gets a reset, like it would from
+// an unreachable service.
+func (t *TunToSOCKS) forwardTCP(ctx context.Context, r *tcp.ForwarderRequest) {
+	id := r.ID()
+	srcAddr := net.JoinHostPort(net.IP(id.RemoteAddress.AsSlice()).String(), strconv.Itoa(int(id.RemotePort)))
+
+	dstIP := net.IP(id.LocalAddress.AsSlice())
+	if remoteIP, ok := t.nat.ToRemote(dstIP); ok {
+		// netstack keeps the local address, so replies carry the address
+		// the client connected to
+		log.Debugf("NAT: %s -> %s", dstIP, remoteIP)
+		dstIP = remoteIP
+	}
+	dstHost, ok := t.remoteHost(dstIP)
+	if !ok {
+		log.Debugf("Refusing connection to %s: fake address not handed out", dstIP)
+		r.Complete(true)
+		return
+	}
+	dstAddr := net.JoinHostPort(dstHost, strconv.Itoa(int(id.LocalPort)))
+
+	log.Debugf("New connection: %s -> %s", srcAddr, dstAddr)
+
+	// DNS over TCP (e.g. a retry after a truncated UDP answer) is answered
+	// by the local resolver, like UDP queries
+	if id.LocalPort == 53 && t.dnsResolver != nil {
+		client, err := acceptTCP(r)
+		if err != nil {
+			log.Debugf("Failed to accept DNS connection from %s: %v", srcAddr, err)
+			return
+		}
+		t.trackConn(client)
+		t.wg.Add(1)
+		go func() {
+			defer t.untrackConn(client)
+			t.serveDNSOverTCP(ctx, client)
+		}()
+		return
+	}
+
+	// Flows of other applications than those selected bypass the tunnel
+	dst := directAddr(id.LocalAddress.AsSlice(), id.LocalPort)
+	if !t.tunneled("tcp", directAddr(id.RemoteAddress.AsSlice(), id.RemotePort), dst) {
+		t.forwardDirect(ctx, r, dst)
+		return
+	}
+
+	addr, addrOK := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	var host string
+	if addrOK {
+		host = t.hostName(addr, dstHost)
+	}
+	if !t.allowed("tcp", dstIP, dstHost, host, id.LocalPort) {
+		r.Complete(true)
+		return
+	}
+
+	if t.draining.Load() {
+		log.Debugf("Draining, refusing connection to %s", dstAddr)
+		r.Complete(true)
+		return
+	}
+
+	remote, err := t.dialUpstream(ctx, dstAddr)
+	if err != nil {
+		log.Debugf("SOCKS dial failed for %s: %v", dstAddr, err)
+		r.Complete(true)
+		return
+	}
+
+	client, err := acceptTCP(r)
+	if err != nil {
+		log.Debugf("Failed to accept connection from %s: %v", srcAddr, err)
+		remote.Close()
+		return
+	}
+
+	f := &flow{protocol: "tcp", src: srcAddr, dst: dstAddr, host: host, started: time.Now()}
+	t.trackConn(client)
+	t.trackConn(remote)
+	t.trackFlow(f)
+	t.stats.ConnOpened()
+	if addrOK {
+		t.stats.DestinationFlow(protoTCP, netip.AddrPortFrom(addr, id.LocalPort))
+	}
+	t.wg.Add(1)
+	go t.relayTCP(client, remote, id.LocalPort, f)
+}
+
+// dialUpstream connects to addr through the proxy. If the tunnel is down,
+// the connection waits for it to come back (its SYN is held meanwhile)
+// rather than failing.
+func (t *TunToSOCKS) dialUpstream(ctx context.Context, addr string) (*upstreamConn, error) {
+	for retried := false; ; retried = true {
+		proxy := t.backend.Load().addr
+		dialCtx, cancel := context.WithTimeout(ctx, t.dialTimeout)
+		conn, err := t.dialSOCKS(dialCtx, addr)
+		cancel()
+		if err == nil {
+			return t.newUpstreamConn(conn, addr, proxy), nil
+		}
+		if retried || ctx.Err() != nil || !t.proxyDown(proxy) {
+			return nil, err
+		}
+
+		log.Debugf("Tunnel down, holding new connection to %s until it is back", addr)
+		if !t.awaitProxy(ctx.Done()) {
+			return nil, err
+		}
+	}
+}
+
+// remoteHost returns the host to dial through the proxy for a destination
+// address: the name a fake address stands for, else the address itself.
+// The second return value is false for fake addresses not handed out
+// (e.g. before a restart), which cannot be reached.
+func (t *TunToSOCKS) remoteHost(ip net.IP) (string, bool) {
+	if name, ok := t.fakeIP.Lookup(ip); ok {
+		return name, true
+	}
+	return ip.String(), !t.fakeIP.Contains(ip)
+}
+
+// clientConn is a connection accepted by netstack
+type clientConn struct {
+	*gonet.TCPConn
+	ep tcpip.Endpoint
+}
+
+// reset aborts the connection, sending the client a RST
+func (c *clientConn) reset() {
+	c.ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true})
+	c.Close()
+}
+
+// acceptTCP completes the handshake of a forwarded connection
+func acceptTCP(r *tcp.ForwarderRequest) (*clientConn, error) {
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		return nil, fmt.Errorf("failed to create endpoint: %s", tcpErr)
+	}
+	r.Complete(false)
+
+	// Detect clients that went away without closing the connection
+	ep.SocketOptions().SetKeepAlive(true)
+
+	return &clientConn{TCPConn: gonet.NewTCPConn(&wq, ep), ep: ep}, nil
+}
+
+// relayTCP copies data between the client and the remote connection until
+// both directions are closed. An EOF in one direction is passed on as a
+// half-close, so request/response protocols that rely on it keep working.
+// With a scheduler, data towards the tunnel is sent in turns with other
+// flows. The bytes relayed are counted in f. If the tunnel went down
+// mid-stream, the client gets a reset rather than an EOF, so it does not
+// take what it received for the whole stream.
+func (t *TunToSOCKS) relayTCP(client *clientConn, remote *upstreamConn, port uint16, f *flow) {
+	defer t.wg.Done()
+	defer t.stats.ConnClosed()
+	defer t.endFlow(f)
+	defer t.untrackFlow(f)
+	defer t.untrackConn(client)
+	defer t.untrackConn(remote)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		src := countingReader{client, &f.tx}
+		if t.scheduler != nil {
+			conn, _, _ := remote.current()
+			t.scheduler.limitSendBuffer(conn)
+			t.scheduler.copy(remote, src, port)
+		} else {
+			io.Copy(remote, src)
+		}
+		closeWrite(remote)
+	}()
+
+	io.Copy(client, countingReader{remote, &f.rx})
+	if remote.wasBroken() {
+		log.Debugf("Connection to %s lost with the tunnel, resetting it", f.dst)
+		t.stats.ConnBroken()
+		client.reset()
+	} else {
+		closeWrite(client)
+	}
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, or closes it if it
+// cannot be half-closed
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// dialSOCKS connects to addr through the SOCKS5 proxy (or the custom
+// dialer). The proxy connection is returned as is, so it can be half-closed.
+func (t *TunToSOCKS) dialSOCKS(ctx context.Context, addr string) (net.Conn, error) {
+	backend := t.backend.Load()
+	if d, ok := backend.dialer.(contextDialer); ok {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	d, ok := backend.dialer.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+	})
+	if !ok {
+		return backend.dialer.Dial("tcp", addr)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", backend.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	if _, err := d.DialWithConn(ctx, conn, "tcp", addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// trackConn registers a connection to be closed by Stop
+func (t *TunToSOCKS) trackConn(conn net.Conn) {
+	t.connMu.Lock()
+	t.tcpConns[conn] = struct{}{}
+	t.connMu.Unlock()
+}
+
+// untrackConn closes a connection and forgets it
+func (t *TunToSOCKS) untrackConn(conn net.Conn) {
+	conn.Close()
+	t.connMu.Lock()
+	delete(t.tcpConns, conn)
+	t.connMu.Unlock()
+}
@@ -0,0 +1,444 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// udpIdleTimeout is how long a UDP association is kept without traffic
+	udpIdleTimeout = 2 * time.Minute
+
+	// maxUDPSessions bounds concurrent UDP associations
+	maxUDPSessions = 256
+
+	// udpQueueLen is how many datagrams are queued per session while its
+	// association is being set up
+	udpQueueLen = 64
+
+	// udpUnsupportedBackoff is how long UDP is dropped after the SOCKS5
+	// proxy refused a UDP ASSOCIATE, before it is tried again
+	udpUnsupportedBackoff = time.Minute
+
+	// socks5UDPHeaderLen is the largest SOCKS5 UDP request header we send,
+	// for an IPv6 destination: RSV(2) FRAG(1) ATYP(1) DST.ADDR(16) DST.PORT(2)
+	socks5UDPHeaderLen = 22
+)
+
+// errUDPNotSupported is returned when the SOCKS5 proxy refuses UDP ASSOCIATE
+var errUDPNotSupported = errors.New("SOCKS5 proxy does not support UDP ASSOCIATE")
+
+// udpConnKey identifies a UDP flow between a local client and a destination
+type udpConnKey struct {
+	src     netip.Addr
+	dst     netip.Addr
+	srcPort uint16
+	dstPort uint16
+}
+
+// udpSession relays one UDP flow through a SOCKS5 UDP association
+// (RFC 1928 section 7)
+type udpSession struct {
+	key     udpConnKey
+	dstHost string // destination as seen by the proxy (after NAT and fake IPs)
+	flow    *flow  // for Flows
+	out     chan []byte
+	done    chan struct{}
+	closeMu sync.Once
+
+	mu         sync.Mutex
+	lastActive time.Time
+	ctrl       net.Conn     // TCP control connection; the association ends with it
+	relay      *net.UDPConn // proxy's UDP relay
+}
+
+// forwardUDP sends a UDP datagram through a SOCKS5 UDP association for its
+// flow, setting one up if needed. payload is only valid for the duration of
+// the call.
+func (t *TunToSOCKS) forwardUDP(ctx context.Context, key udpConnKey, payload []byte) error {
+	// UDP associations need a SOCKS5 proxy
+	if t.backend.Load().addr == "" {
+		return nil
+	}
+
+	t.udpMu.Lock()
+	if time.Now().Before(t.udpUnsupportedUntil) {
+		t.udpMu.Unlock()
+		return nil
+	}
+
+	s, exists := t.udpSessions[key]
+	if !exists {
+		if t.draining.Load() {
+			t.udpMu.Unlock()
+			return nil
+		}
+		if len(t.udpSessions) >= maxUDPSessions {
+			t.udpMu.Unlock()
+			log.Debugf("UDP: %d associations open, dropping datagram to %s", maxUDPSessions, netip.AddrPortFrom(key.dst, key.dstPort))
+			return nil
+		}
+
+		if !t.tunneled("udp", netip.AddrPortFrom(key.src, key.srcPort), netip.AddrPortFrom(key.dst, key.dstPort)) {
+			t.udpMu.Unlock()
+			log.Debugf("UDP: dropping datagram to %s: flow not selected", netip.AddrPortFrom(key.dst, key.dstPort))
+			return nil
+		}
+
+		dstIP := addrIP(key.dst)
+		if remoteIP, ok := t.nat.ToRemote(dstIP); ok {
+			log.Debugf("NAT: %s -> %s", dstIP, remoteIP)
+			dstIP = remoteIP
+		}
+		dstHost, ok := t.remoteHost(dstIP)
+		if !ok {
+			t.udpMu.Unlock()
+			log.Debugf("UDP: dropping datagram to %s: fake address not handed out", dstIP)
+			return nil
+		}
+		host := t.hostName(key.dst, dstHost)
+		if !t.allowed("udp", dstIP, dstHost, host, key.dstPort) {
+			t.udpMu.Unlock()
+			return nil
+		}
+
+		s = &udpSession{
+			key:        key,
+			dstHost:    dstHost,
+			flow:       newUDPFlow(key, dstHost, host),
+			out:        make(chan []byte, udpQueueLen),
+			done:       make(chan struct{}),
+			lastActive: time.Now(),
+		}
+		t.udpSessions[key] = s
+		t.stats.DestinationFlow(protoUDP, netip.AddrPortFrom(key.dst, key.dstPort))
+
+		t.wg.Add(1)
+		go t.runUDPSession(ctx, s)
+	}
+	t.udpMu.Unlock()
+
+	datagram := make([]byte, len(payload))
+	copy(datagram, payload)
+
+	select {
+	case s.out <- datagram:
+	default:
+		// UDP is lossy anyway; never block the TUN read loop
+		log.Debugf("UDP: queue full, dropping datagram to %s", net.JoinHostPort(s.dstHost, strconv.Itoa(int(key.dstPort))))
+	}
+	return nil
+}
+
+// runUDPSession sets up the UDP association and relays queued datagrams
+// to it until the session is closed
+func (t *TunToSOCKS) runUDPSession(ctx context.Context, s *udpSession) {
+	defer t.wg.Done()
+	defer t.removeUDPSession(s)
+
+	log.Debugf("New UDP flow: %s -> %s", netip.AddrPortFrom(s.key.src, s.key.srcPort), net.JoinHostPort(s.dstHost, strconv.Itoa(int(s.key.dstPort))))
+
+	ctrl, relay, err := udpAssociate(ctx, t.backend.Load().addr, t.dialTimeout)
+	if err != nil {
+		if errors.Is(err, errUDPNotSupported) {
+			t.udpMu.Lock()
+			t.udpUnsupportedUntil = time.Now().Add(udpUnsupportedBackoff)
+			warned := t.udpWarned
+			t.udpWarned = true
+			t.udpMu.Unlock()
+
+			if !warned {
+				log.Warnf("UDP forwarding unavailable: %v (OpenSSH dynamic forwarding only carries TCP); "+
+					"UDP traffic other than DNS is dropped", err)
+			}
+			return
+		}
+		log.Debugf("UDP: association for %s failed: %v", net.JoinHostPort(s.dstHost, strconv.Itoa(int(s.key.dstPort))), err)
+		return
+	}
+
+	s.mu.Lock()
+	s.ctrl, s.relay = ctrl, relay
+	s.mu.Unlock()
+	defer t.endFlow(s.flow)
+
+	// Close may have run before the connections were stored
+	select {
+	case <-s.done:
+		ctrl.Close()
+		relay.Close()
+		return
+	default:
+	}
+
+	// The association lasts as long as the control connection (RFC 1928)
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		s.close()
+	}()
+
+	t.wg.Add(1)
+	go t.readUDPRelay(s)
+
+	buf := make([]byte, 0, socks5UDPHeaderLen+65535)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.stopCh:
+			return
+		case datagram := <-s.out:
+			buf = appendSOCKS5UDPHeader(buf[:0], s.dstHost, s.key.dstPort)
+			buf = append(buf, datagram...)
+			if _, err := relay.Write(buf); err != nil {
+				log.Debugf("UDP: relay write failed: %v", err)
+				return
+			}
+			s.flow.tx.Add(uint64(len(datagram)))
+			s.touch()
+		}
+	}
+}
+
+// readUDPRelay writes datagrams from the proxy's UDP relay back to the TUN
+// device, as if sent by the flow's destination
+func (t *TunToSOCKS) readUDPRelay(s *udpSession) {
+	defer t.wg.Done()
+	defer s.close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.relay.Read(buf)
+		if err != nil {
+			return
+		}
+
+		payload, err := parseSOCKS5UDPHeader(buf[:n])
+		if err != nil {
+			log.Debugf("UDP: dropping relay datagram: %v", err)
+			continue
+		}
+		s.touch()
+
+		// Replies keep the local address the client sent to, so NAT-mapped
+		// flows are answered from the mapped address
+		packet := buildUDPPacket(s.key.dst, s.key.dstPort, s.key.src, s.key.srcPort, payload)
+		if _, err := t.tun.Write(packet); err != nil {
+			log.Debugf("UDP: failed to write reply: %v", err)
+			t.stats.IncrementErrorsRX()
+			continue
+		}
+		t.countRX(packet)
+		s.flow.rx.Add(uint64(len(payload)))
+	}
+}
+
+// removeUDPSession closes the session and forgets it
+func (t *TunToSOCKS) removeUDPSession(s *udpSession) {
+	s.close()
+
+	t.udpMu.Lock()
+	if t.udpSessions[s.key] == s {
+		delete(t.udpSessions, s.key)
+	}
+	t.udpMu.Unlock()
+}
+
+// cleanupUDP closes idle UDP sessions
+func (t *TunToSOCKS) cleanupUDP() {
+	t.udpMu.Lock()
+	defer t.udpMu.Unlock()
+
+	for key, s := range t.udpSessions {
+		if s.idleFor() > udpIdleTimeout {
+			log.Debugf("Closing idle UDP flow: %s -> %s",
+				netip.AddrPortFrom(key.src, key.srcPort), netip.AddrPortFrom(key.dst, key.dstPort))
+			s.close()
+			delete(t.udpSessions, key)
+		}
+	}
+}
+
+// closeUDPSessions closes every UDP session
+func (t *TunToSOCKS) closeUDPSessions() {
+	t.udpMu.Lock()
+	defer t.udpMu.Unlock()
+
+	for _, s := range t.udpSessions {
+		s.close()
+	}
+	t.udpSessions = make(map[udpConnKey]*udpSession)
+}
+
+// touch records activity on the session
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+// idleFor returns how long the session has had no traffic
+func (s *udpSession) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+// close ends the association
+func (s *udpSession) close() {
+	s.closeMu.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.ctrl != nil {
+			s.ctrl.Close()
+		}
+		if s.relay != nil {
+			s.relay.Close()
+		}
+	})
+}
+
+// udpAssociate asks the SOCKS5 proxy for a UDP relay. It returns the TCP
+// control connection, which must stay open for the association to last, and
+// a UDP socket connected to the relay.
+func udpAssociate(ctx context.Context, socksAddr string, timeout time.Duration) (net.Conn, *net.UDPConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	ctrl, err := dialer.DialContext(ctx, "tcp", socksAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(timeout))
+
+	fail := func(err error) (net.Conn, *net.UDPConn, error) {
+		ctrl.Close()
+		return nil, nil, err
+	}
+
+	// Greeting: version 5, one method, no authentication
+	if _, err := ctrl.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return fail(fmt.Errorf("failed to send SOCKS5 greeting: %w", err))
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return fail(fmt.Errorf("no SOCKS5 greeting reply: %w", err))
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		return fail(fmt.Errorf("unexpected SOCKS5 greeting reply %x", reply))
+	}
+
+	// UDP ASSOCIATE; the client's sending address is not known up front
+	if _, err := ctrl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return fail(fmt.Errorf("failed to send UDP ASSOCIATE: %w", err))
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, header); err != nil {
+		// OpenSSH closes the connection on commands other than CONNECT
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fail(errUDPNotSupported)
+		}
+		return fail(fmt.Errorf("no UDP ASSOCIATE reply: %w", err))
+	}
+	switch header[1] {
+	case 0x00:
+	case 0x07: // command not supported
+		return fail(errUDPNotSupported)
+	default:
+		return fail(fmt.Errorf("UDP ASSOCIATE refused (reply code %d)", header[1]))
+	}
+
+	var relayIP net.IP
+	switch header[3] {
+	case 0x01:
+		relayIP = make(net.IP, 4)
+	case 0x04:
+		relayIP = make(net.IP, 16)
+	default:
+		return fail(fmt.Errorf("unsupported UDP relay address type %d", header[3]))
+	}
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, relayIP); err != nil {
+		return fail(fmt.Errorf("failed to read UDP relay address: %w", err))
+	}
+	if _, err := io.ReadFull(ctrl, portBuf); err != nil {
+		return fail(fmt.Errorf("failed to read UDP relay port: %w", err))
+	}
+
+	// An unspecified relay address means "the proxy's own address"
+	if relayIP.IsUnspecified() {
+		host, _, err := net.SplitHostPort(socksAddr)
+		if err != nil {
+			return fail(fmt.Errorf("invalid SOCKS5 address %s: %w", socksAddr, err))
+		}
+		relayIP = net.ParseIP(host)
+	}
+	relayAddr := &net.UDPAddr{IP: relayIP, Port: int(binary.BigEndian.Uint16(portBuf))}
+
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		return fail(fmt.Errorf("failed to connect to UDP relay %s: %w", relayAddr, err))
+	}
+
+	ctrl.SetDeadline(time.Time{})
+	return ctrl, relay, nil
+}
+
+// appendSOCKS5UDPHeader appends the SOCKS5 UDP request header for an IPv4,
+// IPv6 or domain name destination to buf
+func appendSOCKS5UDPHeader(buf []byte, dstHost string, dstPort uint16) []byte {
+	dstIP := net.ParseIP(dstHost)
+	switch {
+	case dstIP == nil:
+		buf = append(buf, 0, 0, 0, 0x03, byte(len(dstHost)))
+		buf = append(buf, dstHost...)
+	case dstIP.To4() != nil:
+		buf = append(buf, 0, 0, 0, 0x01)
+		buf = append(buf, dstIP.To4()...)
+	default:
+		buf = append(buf, 0, 0, 0, 0x04)
+		buf = append(buf, dstIP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, dstPort)
+}
+
+// parseSOCKS5UDPHeader returns the payload of a datagram from the UDP relay
+func parseSOCKS5UDPHeader(datagram []byte) ([]byte, error) {
+	if len(datagram) < 4 {
+		return nil, fmt.Errorf("datagram too short")
+	}
+	if datagram[2] != 0 {
+		// Fragmentation is optional and nobody implements it
+		return nil, fmt.Errorf("fragmented datagram")
+	}
+
+	var addrLen int
+	switch datagram[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		if len(datagram) < 5 {
+			return nil, fmt.Errorf("datagram too short")
+		}
+		addrLen = 1 + int(datagram[4])
+	default:
+		return nil, fmt.Errorf("unknown address type %d", datagram[3])
+	}
+
+	headerLen := 4 + addrLen + 2
+	if len(datagram) < headerLen {
+		return nil, fmt.Errorf("datagram too short")
+	}
+	return datagram[headerLen:], nil
+}
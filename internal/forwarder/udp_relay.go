@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/ssmp"
+)
+
+// UDPRelay carries the datagrams sent to a local UDP socket to a UDP port
+// of the instance, as IP packets through ssm-proxy-agent, and the replies
+// back. The wireguard transport points its WireGuard device's endpoint at
+// the relay.
+type UDPRelay struct {
+	conn   *net.UDPConn
+	local  netip.AddrPort // the packets' source, on the agent's TUN subnet
+	remote netip.AddrPort // the packets' destination on the instance
+	peer   atomic.Pointer[netip.AddrPort]
+	link   atomic.Pointer[link]
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+	stats  *Stats
+	mu     sync.Mutex
+}
+
+// NewUDPRelay creates a relay listening on a free port of 127.0.0.1 that
+// sends what it receives over session from local to remote. The packets
+// are not compressed: what is relayed is usually encrypted.
+func NewUDPRelay(session *ssm.Session, local, remote netip.AddrPort) (*UDPRelay, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for UDP: %w", err)
+	}
+	r := &UDPRelay{
+		conn:   conn,
+		local:  local,
+		remote: remote,
+		stopCh: make(chan struct{}),
+		stats:  &Stats{},
+	}
+	r.link.Store(newLink(session, ssmp.CompressionNone))
+	return r, nil
+}
+
+// Addr returns the address the relay listens on
+func (r *UDPRelay) Addr() netip.AddrPort {
+	return r.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Start starts relaying
+func (r *UDPRelay) Start() {
+	r.wg.Add(2)
+	go r.forwardUDPToSSM()
+	go r.forwardSSMToUDP(r.link.Load())
+	log.Infof("UDP relay started on %s (to %s)", r.Addr(), r.remote)
+}
+
+// Stop stops relaying and closes the local socket
+func (r *UDPRelay) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.stopCh:
+		return // Already stopped
+	default:
+		close(r.stopCh)
+	}
+
+	r.conn.Close()
+	r.link.Load().ssm.SetReadDeadline(time.Now())
+	r.wg.Wait()
+	hotLog.Flush()
+	log.Info("UDP relay stopped")
+}
+
+// forwardUDPToSSM sends the datagrams of the local socket to the agent
+func (r *UDPRelay) forwardUDPToSSM() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := r.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			log.Debug("UDP relay socket closed, UDP->SSM relay stopping")
+			return
+		}
+		if err != nil {
+			hotLog.Errorf("UDP relay read error: %v", err)
+			r.stats.IncrementErrorsTX()
+			continue
+		}
+		// Replies go to whoever sent last, as WireGuard roams
+		r.peer.Store(&from)
+
+		packet := buildUDPPacket(r.local.Addr(), r.local.Port(), r.remote.Addr(), r.remote.Port(), buf[:n])
+		l := r.link.Load()
+		if _, err := l.ssm.Write(l.frames.Frame(packet)); err != nil {
+			hotLog.Errorf("SSM write error: %v", err)
+			r.stats.IncrementErrorsTX()
+			continue
+		}
+		r.stats.IncrementTX(n)
+	}
+}
+
+// forwardSSMToUDP sends the replies arriving over the SSM session of l to
+// the local peer, until the session ends or is replaced
+func (r *UDPRelay) forwardSSMToUDP(l *link) {
+	defer r.wg.Done()
+
+	for {
+		packet, err := l.packets.ReadPacket()
+		if err != nil {
+			select {
+			case <-r.stopCh:
+				return
+			default:
+			}
+			if r.link.Load() != l {
+				log.Debug("SSM session replaced, its SSM->UDP relay stopping")
+				return
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ssmp.ErrLegacyFraming) {
+				log.Infof("SSM->UDP relay stopping: %v", err)
+				return
+			}
+			hotLog.Errorf("SSM read error: %v", err)
+			r.stats.IncrementErrorsRX()
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		payload, ok := r.reply(packet)
+		if !ok {
+			// The agent's TUN device also carries the instance's other
+			// traffic to its subnet, e.g. IPv6 router solicitations
+			continue
+		}
+		peer := r.peer.Load()
+		if peer == nil {
+			continue
+		}
+		if _, err := r.conn.WriteToUDPAddrPort(payload, *peer); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			hotLog.Errorf("UDP relay write error: %v", err)
+			r.stats.IncrementErrorsRX()
+			continue
+		}
+		r.stats.IncrementRX(len(payload))
+	}
+}
+
+// reply returns the UDP payload of packet if it is a datagram from remote
+// to local
+func (r *UDPRelay) reply(packet []byte) ([]byte, bool) {
+	p, err := parseIPPacket(packet)
+	if err != nil || p.protocol != protoUDP || p.src != r.remote.Addr() || p.dst != r.local.Addr() || len(p.payload) < 8 {
+		return nil, false
+	}
+	udp := p.payload
+	srcPort, dstPort := binary.BigEndian.Uint16(udp[0:2]), binary.BigEndian.Uint16(udp[2:4])
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if srcPort != r.remote.Port() || dstPort != r.local.Port() || length < 8 || length > len(udp) {
+		return nil, false
+	}
+	return udp[8:length], true
+}
+
+// Session returns the SSM session the datagrams are relayed over
+func (r *UDPRelay) Session() *ssm.Session {
+	return r.link.Load().ssm
+}
+
+// Replace moves the relaying to session, e.g. after the previous one was
+// lost, and returns the previous session for the caller to close
+func (r *UDPRelay) Replace(session *ssm.Session) *ssm.Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := newLink(session, ssmp.CompressionNone)
+	previous := r.link.Swap(l)
+	previous.ssm.SetReadDeadline(time.Now())
+
+	select {
+	case <-r.stopCh:
+	default:
+		r.wg.Add(1)
+		go r.forwardSSMToUDP(l)
+	}
+	return previous.ssm
+}
+
+// GetStats returns current traffic statistics
+func (r *UDPRelay) GetStats() Stats {
+	return r.stats.Copy()
+}
@@ -0,0 +1,245 @@
+package health
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+// Layers of the tunnel health check, from the bottom up. A check stops at
+// the first layer that fails.
+const (
+	// LayerProcess: the tunnel process (ssh) is running
+	LayerProcess = "process"
+	// LayerSOCKS: the local SOCKS5 proxy completes a handshake
+	LayerSOCKS = "socks"
+	// LayerEndpoint: a TCP connection to an internal endpoint succeeds
+	// through the tunnel
+	LayerEndpoint = "endpoint"
+	// LayerDNS: the DNS server answers a query through the tunnel
+	LayerDNS = "dns"
+	// LayerNetwork: the network the tunnel runs over changed under it. It
+	// is not probed; callers set it to restart a tunnel that passed.
+	LayerNetwork = "network"
+)
+
+// defaultTimeout bounds each probe
+const defaultTimeout = 5 * time.Second
+
+// Target is the tunnel being checked
+type Target interface {
+	IsRunning() bool
+	SOCKSAddr() string
+}
+
+// Config selects the optional probes beyond process liveness and SOCKS5
+type Config struct {
+	// Endpoint is a host:port to connect to through the tunnel (optional)
+	Endpoint string
+
+	// DNSServer (host:port) and DNSName select the DNS probe: DNSName is
+	// resolved through the tunnel; any answer, including NXDOMAIN, passes
+	DNSServer string
+	DNSName   string
+
+	// Timeout bounds each probe (default 5s)
+	Timeout time.Duration
+}
+
+// Result is the outcome of a health check
+type Result struct {
+	Layer    string // layer that failed, "" if healthy
+	Err      error
+	Duration time.Duration
+}
+
+// Healthy reports whether every layer passed
+func (r Result) Healthy() bool {
+	return r.Layer == ""
+}
+
+// String describes the result, e.g. "healthy" or "socks: connection refused"
+func (r Result) String() string {
+	if r.Healthy() {
+		return "healthy"
+	}
+	return fmt.Sprintf("%s: %v", r.Layer, r.Err)
+}
+
+// Checker runs layered health checks against a tunnel
+type Checker struct {
+	config Config
+}
+
+// NewChecker creates a checker with the given probes
+func NewChecker(config Config) *Checker {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Checker{config: config}
+}
+
+// Layers returns the layers this checker probes, in order
+func (c *Checker) Layers() []string {
+	layers := []string{LayerProcess, LayerSOCKS}
+	if c.config.Endpoint != "" {
+		layers = append(layers, LayerEndpoint)
+	}
+	if c.config.DNSName != "" && c.config.DNSServer != "" {
+		layers = append(layers, LayerDNS)
+	}
+	return layers
+}
+
+// Check probes the tunnel layer by layer and reports the first failure
+func (c *Checker) Check(ctx context.Context, target Target) Result {
+	start := time.Now()
+	result := func(layer string, err error) Result {
+		return Result{Layer: layer, Err: err, Duration: time.Since(start)}
+	}
+
+	if !target.IsRunning() {
+		return result(LayerProcess, fmt.Errorf("tunnel process is not running"))
+	}
+
+	socksAddr := target.SOCKSAddr()
+	if err := c.probeSOCKS(ctx, socksAddr); err != nil {
+		return result(LayerSOCKS, err)
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, &net.Dialer{Timeout: c.config.Timeout})
+	if err != nil {
+		return result(LayerSOCKS, fmt.Errorf("failed to create SOCKS5 dialer: %w", err))
+	}
+
+	if c.config.Endpoint != "" {
+		if err := c.probeEndpoint(ctx, dialer); err != nil {
+			return result(LayerEndpoint, err)
+		}
+	}
+
+	if c.config.DNSName != "" && c.config.DNSServer != "" {
+		if err := c.probeDNS(ctx, dialer); err != nil {
+			return result(LayerDNS, err)
+		}
+	}
+
+	return result("", nil)
+}
+
+// probeSOCKS performs a SOCKS5 method negotiation with the local proxy
+func (c *Checker) probeSOCKS(ctx context.Context, addr string) error {
+	dialer := &net.Dialer{Timeout: c.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	// Version 5, one method: no authentication
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no SOCKS5 greeting reply: %w", err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		return fmt.Errorf("unexpected SOCKS5 greeting reply %x", reply)
+	}
+	return nil
+}
+
+// probeEndpoint connects to the configured endpoint through the tunnel
+func (c *Checker) probeEndpoint(ctx context.Context, dialer proxy.Dialer) error {
+	conn, err := dialContext(ctx, dialer, c.config.Endpoint, c.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s through the tunnel: %w", c.config.Endpoint, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// probeDNS resolves the configured name over TCP through the tunnel
+func (c *Checker) probeDNS(ctx context.Context, dialer proxy.Dialer) error {
+	name, err := dnsmessage.NewName(dnsName(c.config.DNSName))
+	if err != nil {
+		return fmt.Errorf("invalid DNS probe name %q: %w", c.config.DNSName, err)
+	}
+
+	id := uint16(rand.IntN(1 << 16))
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to build DNS probe: %w", err)
+	}
+
+	conn, err := dialContext(ctx, dialer, c.config.DNSServer, c.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to DNS server %s: %w", c.config.DNSServer, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := conn.Write(append(msg, packed...)); err != nil {
+		return fmt.Errorf("failed to send DNS probe: %w", err)
+	}
+
+	var lengthBuf [2]byte
+	if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+		return fmt.Errorf("no DNS answer for %s: %w", c.config.DNSName, err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(lengthBuf[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("failed to read DNS answer: %w", err)
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err != nil {
+		return fmt.Errorf("invalid DNS answer: %w", err)
+	}
+	if header.ID != id || !header.Response {
+		return fmt.Errorf("DNS answer does not match the probe")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return fmt.Errorf("DNS server answered %s for %s", header.RCode, c.config.DNSName)
+	}
+	return nil
+}
+
+// dialContext dials through the SOCKS5 dialer, honoring ctx and timeout
+func dialContext(ctx context.Context, dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// dnsName returns name in fully qualified form
+func dnsName(name string) string {
+	if name == "" || name[len(name)-1] != '.' {
+		return name + "."
+	}
+	return name
+}
@@ -0,0 +1,229 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Limits below which the self-test considers the tunnel unusable
+const (
+	// SelfTestMaxRTT is the highest acceptable average connect time
+	SelfTestMaxRTT = 2 * time.Second
+	// SelfTestMinThroughput is the lowest acceptable transfer rate in bytes
+	// per second
+	SelfTestMinThroughput = 16 * 1024
+)
+
+// Self-test defaults
+const (
+	defaultSelfTestSamples = 5
+	selfTestMaxBytes       = 1 << 20
+	selfTestTransferTime   = 5 * time.Second
+)
+
+// Dialer opens connections the way applications do, e.g. a net.Dialer
+// whose traffic the routes send through the tunnel
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SelfTestConfig selects the self-test's probes: the connect probe runs
+// with Endpoint, the DNS probe with DNSServer and DNSName, the throughput
+// sample with URL.
+type SelfTestConfig struct {
+	Endpoint  string // host:port connected to for round-trip times
+	DNSServer string // host:port
+	DNSName   string
+	URL       string // http:// URL downloaded (up to 1 MiB) for throughput
+
+	Samples int           // connects to Endpoint (default 5)
+	Timeout time.Duration // per probe (default 5s)
+}
+
+// SelfTestStep is the outcome of one probe
+type SelfTestStep struct {
+	Name   string
+	Detail string
+	Err    error // the tunnel is unusable per this probe
+}
+
+// SelfTestReport lists the outcome of each probe
+type SelfTestReport struct {
+	Steps []SelfTestStep
+}
+
+// Err returns the first probe's failure, or nil if the tunnel is usable
+func (r *SelfTestReport) Err() error {
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return fmt.Errorf("%s: %w", step.Name, step.Err)
+		}
+	}
+	return nil
+}
+
+// SelfTest checks that the tunnel is usable end to end: names resolve,
+// connections are set up quickly enough and data flows at a useful rate.
+// All traffic goes through dialer, so routes, NAT and security groups are
+// tested along with the tunnel itself.
+func SelfTest(ctx context.Context, dialer Dialer, config SelfTestConfig) *SelfTestReport {
+	if config.Samples == 0 {
+		config.Samples = defaultSelfTestSamples
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	report := &SelfTestReport{}
+	if config.DNSServer != "" && config.DNSName != "" {
+		report.Steps = append(report.Steps, selfTestDNS(ctx, dialer, config))
+	}
+	if config.Endpoint != "" {
+		report.Steps = append(report.Steps, selfTestConnect(ctx, dialer, config))
+	}
+	if config.URL != "" {
+		report.Steps = append(report.Steps, selfTestThroughput(ctx, dialer, config))
+	}
+	return report
+}
+
+// selfTestDNS resolves the name via the DNS server; like the health check,
+// any answer including "not found" passes
+func selfTestDNS(ctx context.Context, dialer Dialer, config SelfTestConfig) SelfTestStep {
+	step := SelfTestStep{Name: "DNS"}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, config.DNSServer)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := resolver.LookupNetIP(ctx, "ip", config.DNSName)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		step.Detail = fmt.Sprintf("%s → %d address(es) in %s via %s", config.DNSName, len(addrs), elapsed, config.DNSServer)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		step.Detail = fmt.Sprintf("%s → not found in %s via %s", config.DNSName, elapsed, config.DNSServer)
+	default:
+		step.Err = fmt.Errorf("failed to resolve %s via %s: %w", config.DNSName, config.DNSServer, err)
+	}
+	return step
+}
+
+// selfTestConnect connects to the endpoint several times, measuring the
+// round-trip time of each connection setup
+func selfTestConnect(ctx context.Context, dialer Dialer, config SelfTestConfig) SelfTestStep {
+	step := SelfTestStep{Name: "Connect"}
+
+	var rtts []time.Duration
+	var lastErr error
+	for range config.Samples {
+		dialCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+		start := time.Now()
+		conn, err := dialer.DialContext(dialCtx, "tcp", config.Endpoint)
+		rtt := time.Since(start)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		rtts = append(rtts, rtt)
+	}
+
+	if len(rtts) == 0 {
+		step.Err = fmt.Errorf("failed to connect to %s: %w", config.Endpoint, lastErr)
+		return step
+	}
+
+	lo, hi, sum := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		lo, hi, sum = min(lo, rtt), max(hi, rtt), sum+rtt
+	}
+	avg := sum / time.Duration(len(rtts))
+	step.Detail = fmt.Sprintf("%s, RTT min/avg/max %s/%s/%s", config.Endpoint,
+		lo.Round(time.Millisecond), avg.Round(time.Millisecond), hi.Round(time.Millisecond))
+	if failed := config.Samples - len(rtts); failed > 0 {
+		step.Detail += fmt.Sprintf(", %d of %d failed", failed, config.Samples)
+	}
+
+	switch {
+	case len(rtts) < (config.Samples+1)/2:
+		step.Err = fmt.Errorf("%d of %d connections to %s failed: %w", config.Samples-len(rtts), config.Samples, config.Endpoint, lastErr)
+	case avg > SelfTestMaxRTT:
+		step.Err = fmt.Errorf("average connect time %s to %s exceeds %s", avg.Round(time.Millisecond), config.Endpoint, SelfTestMaxRTT)
+	}
+	return step
+}
+
+// selfTestThroughput downloads (the start of) the URL to sample the
+// transfer rate
+func selfTestThroughput(ctx context.Context, dialer Dialer, config SelfTestConfig) SelfTestStep {
+	step := SelfTestStep{Name: "Throughput"}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+		Timeout:   config.Timeout + selfTestTransferTime,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.URL, nil)
+	if err != nil {
+		step.Err = fmt.Errorf("invalid URL %q: %w", config.URL, err)
+		return step
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		step.Err = fmt.Errorf("failed to fetch %s: %w", config.URL, err)
+		return step
+	}
+	defer resp.Body.Close()
+
+	// The transfer is timed from the first byte, so that setting up the
+	// connection (measured above) does not count
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(&deadlineReader{r: resp.Body, deadline: start.Add(selfTestTransferTime)}, selfTestMaxBytes))
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(err, errTransferTime) {
+		step.Err = fmt.Errorf("failed to read %s: %w", config.URL, err)
+		return step
+	}
+	if n == 0 {
+		step.Err = fmt.Errorf("%s returned no data (HTTP %d)", config.URL, resp.StatusCode)
+		return step
+	}
+
+	rate := float64(n) / max(elapsed.Seconds(), 0.001)
+	step.Detail = fmt.Sprintf("%d KiB in %s (%.1f Mbit/s)", n/1024, elapsed.Round(time.Millisecond), rate*8/1e6)
+	// A response that fits in a few packets says little about the rate
+	if n >= 64*1024 && rate < SelfTestMinThroughput {
+		step.Err = fmt.Errorf("transfer rate %.1f KiB/s is below %d KiB/s", rate/1024, SelfTestMinThroughput/1024)
+	}
+	return step
+}
+
+// errTransferTime ends a throughput sample that ran out of time
+var errTransferTime = errors.New("transfer time exceeded")
+
+// deadlineReader stops reading at the deadline
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+// Read reads from the underlying reader until the deadline has passed
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errTransferTime
+	}
+	return d.r.Read(p)
+}
@@ -0,0 +1,168 @@
+// Package helper talks to the privileged helper: a daemon running as root,
+// installed once with 'ssm-proxy helper install', that creates utun devices,
+// changes routes and writes the DNS resolver configuration on behalf of the
+// user it was installed for, so that 'ssm-proxy start' runs without sudo.
+//
+// The helper serves a control socket (see package control) that only root
+// and that user may use. The tunnel, routing and dns packages send their
+// privileged operations to it once given a Client.
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/sbkg0002/ssm-proxy/internal/control"
+)
+
+// SocketPath is the socket the helper listens on
+const SocketPath = "/var/run/ssm-proxy-helper.sock"
+
+// Methods of the helper
+const (
+	// MethodVersion returns the version of the helper
+	MethodVersion = "version"
+	// MethodTUNCreate creates a utun device and passes it to the client
+	MethodTUNCreate = "tun.create"
+	// MethodIfconfig runs ifconfig on a utun device the helper created
+	MethodIfconfig = "ifconfig"
+	// MethodRoute runs route add, change or delete
+	MethodRoute = "route"
+	// MethodScutil runs scutil commands on ssm-proxy's DNS configuration
+	MethodScutil = "scutil"
+	// MethodResolverWrite writes a file in /etc/resolver
+	MethodResolverWrite = "resolver.write"
+	// MethodResolverRename renames a file in /etc/resolver
+	MethodResolverRename = "resolver.rename"
+	// MethodResolverRemove removes a file from /etc/resolver
+	MethodResolverRemove = "resolver.remove"
+	// MethodDNSFlush flushes the system's DNS cache
+	MethodDNSFlush = "dns.flush"
+)
+
+// CommandParams are the arguments of a command the helper runs
+type CommandParams struct {
+	Name  string   `json:"name,omitempty"` // device, for ifconfig
+	Args  []string `json:"args"`
+	Input string   `json:"input,omitempty"` // standard input, for scutil
+}
+
+// CommandResult is the output of a command the helper ran, and why it
+// failed if it did
+type CommandResult struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FileParams name a file in /etc/resolver, and what to do with it
+type FileParams struct {
+	Path    string `json:"path"`
+	To      string `json:"to,omitempty"`      // for rename
+	Content []byte `json:"content,omitempty"` // for write
+}
+
+// FileResult tells that the file to rename or remove did not exist
+type FileResult struct {
+	Missing bool `json:"missing,omitempty"`
+}
+
+// TUNResult names the utun device passed along with it
+type TUNResult struct {
+	Name string `json:"name"`
+}
+
+// Client sends privileged operations to the helper
+type Client struct {
+	path string
+}
+
+// Dial returns a client of the helper at path if it is running and lets
+// this user in, and its version
+func Dial(path string) (*Client, string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, "", fmt.Errorf("privileged helper is not installed: %w", err)
+	}
+	c := &Client{path: path}
+	var version string
+	if err := control.Call(path, MethodVersion, "", nil, &version); err != nil {
+		return nil, "", fmt.Errorf("privileged helper is not available: %w", err)
+	}
+	return c, version, nil
+}
+
+// CreateTUN has the helper create a utun device and returns it, open, and
+// its name
+func (c *Client) CreateTUN() (*os.File, string, error) {
+	var result TUNResult
+	file, err := control.CallFile(c.path, MethodTUNCreate, "", nil, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	if file == nil {
+		return nil, "", errors.New("privileged helper did not pass the utun device")
+	}
+	return file, result.Name, nil
+}
+
+// Ifconfig runs ifconfig with args on a utun device the helper created
+func (c *Client) Ifconfig(name string, args ...string) (string, error) {
+	return c.command(MethodIfconfig, CommandParams{Name: name, Args: args})
+}
+
+// Route runs route with args
+func (c *Client) Route(args ...string) (string, error) {
+	return c.command(MethodRoute, CommandParams{Args: args})
+}
+
+// Scutil runs scutil with commands on its standard input
+func (c *Client) Scutil(commands string) (string, error) {
+	return c.command(MethodScutil, CommandParams{Input: commands})
+}
+
+// WriteResolverFile writes a file in /etc/resolver
+func (c *Client) WriteResolverFile(path string, content []byte) error {
+	return control.Call(c.path, MethodResolverWrite, "", FileParams{Path: path, Content: content}, nil)
+}
+
+// RenameResolverFile renames a file in /etc/resolver
+func (c *Client) RenameResolverFile(from, to string) error {
+	return c.fileOp(MethodResolverRename, "rename", FileParams{Path: from, To: to})
+}
+
+// RemoveResolverFile removes a file from /etc/resolver
+func (c *Client) RemoveResolverFile(path string) error {
+	return c.fileOp(MethodResolverRemove, "remove", FileParams{Path: path})
+}
+
+// fileOp has the helper rename or remove a file, failing with
+// fs.ErrNotExist if it did not exist
+func (c *Client) fileOp(method, op string, params FileParams) error {
+	var result FileResult
+	if err := control.Call(c.path, method, "", params, &result); err != nil {
+		return err
+	}
+	if result.Missing {
+		return &fs.PathError{Op: op, Path: params.Path, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// FlushDNSCache flushes the system's DNS cache
+func (c *Client) FlushDNSCache() error {
+	return control.Call(c.path, MethodDNSFlush, "", nil, nil)
+}
+
+// command has the helper run a command, returning its output and an error
+// if it failed
+func (c *Client) command(method string, params CommandParams) (string, error) {
+	var result CommandResult
+	if err := control.Call(c.path, method, "", params, &result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return result.Output, errors.New(result.Error)
+	}
+	return result.Output, nil
+}
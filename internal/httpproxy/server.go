@@ -0,0 +1,164 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/connset"
+	"github.com/sbkg0002/ssm-proxy/internal/socks"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Server is an HTTP proxy for clients that only support HTTP_PROXY /
+// HTTPS_PROXY. CONNECT requests are tunneled and plain HTTP requests are
+// forwarded; both reach their destination through Dial.
+type Server struct {
+	// Dial opens the connection to a destination (host:port)
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTimeout bounds connecting to a destination (30s if zero)
+	DialTimeout time.Duration
+
+	once      sync.Once
+	server    *http.Server
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+
+	conns connset.Set // hijacked CONNECT tunnels
+}
+
+// NewSOCKSServer returns a server that reaches destinations through the
+// SOCKS5 proxy at socksAddr
+func NewSOCKSServer(socksAddr string, dialTimeout time.Duration) *Server {
+	return &Server{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return socks.Dial(ctx, socksAddr, addr)
+		},
+		DialTimeout: dialTimeout,
+	}
+}
+
+// init sets up the HTTP server and the transport for plain requests
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.transport = &http.Transport{
+			DialContext:         s.dial,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		s.proxy = &httputil.ReverseProxy{
+			// The request URL is already absolute; hop-by-hop and Proxy-*
+			// headers are removed by ReverseProxy
+			Rewrite:   func(*httputil.ProxyRequest) {},
+			Transport: s.transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Debugf("HTTP proxy request to %s failed: %v", r.URL.Host, err)
+				http.Error(w, fmt.Sprintf("proxy error: %v", err), http.StatusBadGateway)
+			},
+		}
+		s.server = &http.Server{
+			Handler:           s,
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+	})
+}
+
+// Serve accepts and serves clients until the listener or server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.init()
+	err := s.server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server, closing the listener and all connections
+func (s *Server) Close() error {
+	s.init()
+	err := s.server.Close()
+	s.transport.CloseIdleConnections()
+
+	s.conns.Close()
+	return err
+}
+
+// ServeHTTP tunnels CONNECT requests and forwards absolute-form requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		s.connect(w, r)
+	case r.URL.IsAbs() && r.URL.Host != "":
+		s.proxy.ServeHTTP(w, r)
+	default:
+		http.Error(w, "this is an HTTP proxy; send absolute-form or CONNECT requests", http.StatusBadRequest)
+	}
+}
+
+// connect opens a tunnel to the requested host:port and relays the client
+// connection to it
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	remote, err := s.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		log.Debugf("HTTP proxy CONNECT to %s failed: %v", r.Host, err)
+		http.Error(w, fmt.Sprintf("failed to connect to %s: %v", r.Host, err), http.StatusBadGateway)
+		return
+	}
+	if !s.conns.Track(remote) {
+		remote.Close()
+		http.Error(w, "proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.conns.Untrack(remote)
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	if !s.conns.Track(client) {
+		client.Close()
+		return
+	}
+	defer s.conns.Untrack(client)
+
+	client.SetDeadline(time.Time{})
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Pass on anything the client sent after the request, e.g. a TLS
+	// ClientHello
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err := remote.Write(data); err != nil {
+			return
+		}
+	}
+
+	socks.Relay(client, remote)
+}
+
+// dial connects to a destination within the dial timeout
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.Dial(ctx, network, addr)
+}
+
+// SetLogger sets the logger of the HTTP proxy servers
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
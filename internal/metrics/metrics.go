@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// contentType is the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Type is the type of a metric
+type Type string
+
+// Metric types
+const (
+	Counter Type = "counter"
+	Gauge   Type = "gauge"
+	Summary Type = "summary"
+)
+
+// Metric describes a family of samples
+type Metric struct {
+	Name string
+	Help string
+	Type Type
+}
+
+// Labels identify a sample within its metric
+type Labels map[string]string
+
+// Sample is one value of a metric
+type Sample struct {
+	Metric *Metric
+	Labels Labels
+	Value  float64
+
+	// Suffix is appended to the metric name, e.g. "_sum" and "_count" of
+	// a summary
+	Suffix string
+}
+
+// Source returns the current samples, e.g. of one tunnel. It is called on
+// every scrape.
+type Source func() []Sample
+
+// Registry holds the sources of the metrics exposed
+type Registry struct {
+	mu      sync.Mutex
+	sources map[int]Source
+	next    int
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{sources: make(map[int]Source)}
+}
+
+// Register adds a source; the function returned removes it again
+func (r *Registry) Register(source Source) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.next
+	r.next++
+	r.sources[id] = source
+	return func() {
+		r.mu.Lock()
+		delete(r.sources, id)
+		r.mu.Unlock()
+	}
+}
+
+// Gather returns the samples of all sources, grouped by metric name
+func (r *Registry) Gather() []Sample {
+	r.mu.Lock()
+	sources := slices.Collect(maps.Values(r.sources))
+	r.mu.Unlock()
+
+	var samples []Sample
+	for _, source := range sources {
+		samples = append(samples, source()...)
+	}
+	slices.SortStableFunc(samples, func(a, b Sample) int {
+		return cmp.Compare(a.Metric.Name, b.Metric.Name)
+	})
+	return samples
+}
+
+// WriteText writes the samples in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var last *Metric
+	for _, sample := range r.Gather() {
+		if last == nil || sample.Metric.Name != last.Name {
+			last = sample.Metric
+			fmt.Fprintf(bw, "# HELP %s %s\n", last.Name, escapeHelp(last.Help))
+			fmt.Fprintf(bw, "# TYPE %s %s\n", last.Name, last.Type)
+		}
+		fmt.Fprintf(bw, "%s%s%s %s\n", sample.Metric.Name, sample.Suffix, formatLabels(sample.Labels), formatValue(sample.Value))
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP answers a scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	if err := r.WriteText(w); err != nil {
+		log.Debugf("Failed to write metrics: %v", err)
+	}
+}
+
+// formatLabels renders labels as {a="1",b="2"}, sorted by name
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range slices.Sorted(maps.Keys(labels)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatValue renders a sample value
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// escapeHelp escapes a help text
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// Server exposes a registry over HTTP at /metrics
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen opens the metrics endpoint at addr (host:port)
+func Listen(addr string, registry *Registry) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintln(w, "ssm-proxy metrics: /metrics")
+	})
+
+	return &Server{
+		listener: l,
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+	}, nil
+}
+
+// Addr returns the address the endpoint listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Serve answers scrapes until the server is closed
+func (s *Server) Serve() {
+	if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Warnf("Metrics endpoint stopped: %v", err)
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// SetLogger sets the logger of the metrics servers
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Metrics of a tunnel
+var (
+	TunnelUp = &Metric{
+		Name: "ssm_proxy_tunnel_up",
+		Help: "Whether the tunnel to the instance is connected (1) or not (0).",
+		Type: Gauge,
+	}
+	PacketsTotal = &Metric{
+		Name: "ssm_proxy_packets_total",
+		Help: "IP packets forwarded, by direction (tx: from the TUN device into the tunnel, rx: back).",
+		Type: Counter,
+	}
+	BytesTotal = &Metric{
+		Name: "ssm_proxy_bytes_total",
+		Help: "Bytes forwarded, by direction.",
+		Type: Counter,
+	}
+	ErrorsTotal = &Metric{
+		Name: "ssm_proxy_errors_total",
+		Help: "Packets that could not be forwarded, by direction.",
+		Type: Counter,
+	}
+	ConnectionsActive = &Metric{
+		Name: "ssm_proxy_tcp_connections_active",
+		Help: "TCP connections relayed through the tunnel right now.",
+		Type: Gauge,
+	}
+	ConnectionsPeak = &Metric{
+		Name: "ssm_proxy_tcp_connections_peak",
+		Help: "Most TCP connections relayed at the same time.",
+		Type: Gauge,
+	}
+	DNSCacheHitsTotal = &Metric{
+		Name: "ssm_proxy_dns_cache_hits_total",
+		Help: "DNS queries answered from the cache.",
+		Type: Counter,
+	}
+	DNSCacheMissesTotal = &Metric{
+		Name: "ssm_proxy_dns_cache_misses_total",
+		Help: "DNS queries sent to the DNS server through the tunnel.",
+		Type: Counter,
+	}
+	DNSFailuresTotal = &Metric{
+		Name: "ssm_proxy_dns_failures_total",
+		Help: "DNS queries sent to the DNS server that got no answer.",
+		Type: Counter,
+	}
+	DNSQueriesTotal = &Metric{
+		Name: "ssm_proxy_dns_queries_total",
+		Help: "DNS queries resolved through the tunnel, by tunnel domain and query type.",
+		Type: Counter,
+	}
+	DNSErrorResponsesTotal = &Metric{
+		Name: "ssm_proxy_dns_error_responses_total",
+		Help: "Answers of the DNS server with an error code, by code (NXDOMAIN, SERVFAIL).",
+		Type: Counter,
+	}
+	DNSFallbacksTotal = &Metric{
+		Name: "ssm_proxy_dns_fallbacks_total",
+		Help: "DNS queries not answered through the tunnel as asked, by reason (other_domain: left to other DNS servers, truncated: answer too large for UDP, retried over TCP).",
+		Type: Counter,
+	}
+	DNSUpstreamLatency = &Metric{
+		Name: "ssm_proxy_dns_upstream_latency_seconds",
+		Help: "How long the DNS server took to answer through the tunnel (quantiles of the latest answers).",
+		Type: Summary,
+	}
+	DNSServerUp = &Metric{
+		Name: "ssm_proxy_dns_server_up",
+		Help: "Whether a DNS server answers its queries (1) or is failing (0), by server.",
+		Type: Gauge,
+	}
+	DNSServerQueriesTotal = &Metric{
+		Name: "ssm_proxy_dns_server_queries_total",
+		Help: "DNS queries sent to a DNS server, by server.",
+		Type: Counter,
+	}
+	DNSServerFailuresTotal = &Metric{
+		Name: "ssm_proxy_dns_server_failures_total",
+		Help: "DNS queries sent to a DNS server that got no answer, by server.",
+		Type: Counter,
+	}
+	ConnectionsDeniedTotal = &Metric{
+		Name: "ssm_proxy_connections_denied_total",
+		Help: "Connections and UDP datagrams refused by the destination policy.",
+		Type: Counter,
+	}
+	DNSDeniedTotal = &Metric{
+		Name: "ssm_proxy_dns_denied_total",
+		Help: "DNS queries refused by the destination policy.",
+		Type: Counter,
+	}
+	ReconnectsTotal = &Metric{
+		Name: "ssm_proxy_tunnel_reconnects_total",
+		Help: "Times the tunnel was reconnected after failing.",
+		Type: Counter,
+	}
+)
+
+// TunnelStats is a snapshot of a tunnel's counters
+type TunnelStats struct {
+	Up bool
+
+	PacketsTX, PacketsRX uint64
+	BytesTX, BytesRX     uint64
+	ErrorsTX, ErrorsRX   uint64
+	ConnsActive          uint64
+	ConnsPeak            uint64
+	ConnsDenied          uint64
+
+	DNS            bool // a DNS resolver is configured
+	DNSCacheHits   uint64
+	DNSCacheMisses uint64
+	DNSFailures    uint64
+	DNSNXDomain    uint64
+	DNSServFail    uint64
+	DNSOtherDomain uint64
+	DNSTruncated   uint64
+	DNSDenied      uint64
+	DNSQueries     []DNSQueryCount
+
+	// Latency of the DNS server: quantiles (0.5, 0.9, 0.99) and totals,
+	// in seconds
+	DNSLatencyQuantiles map[float64]float64
+	DNSLatencySum       float64
+	DNSLatencyCount     uint64
+
+	// Health and queries of each DNS server
+	DNSServers []DNSServer
+
+	Reconnects uint64
+}
+
+// DNSServer is the health and query counts of one DNS server
+type DNSServer struct {
+	Address  string
+	Up       bool
+	Queries  uint64
+	Failures uint64
+}
+
+// DNSQueryCount is the number of DNS queries for a tunnel domain and query
+// type
+type DNSQueryCount struct {
+	Domain string
+	Type   string
+	Count  uint64
+}
+
+// TunnelSource returns the samples of a tunnel, labeled with labels (e.g.
+// its session and device), from the snapshots stats takes
+func TunnelSource(labels Labels, stats func() TunnelStats) Source {
+	return func() []Sample {
+		s := stats()
+		samples := []Sample{
+			{TunnelUp, labels, boolValue(s.Up), ""},
+			{PacketsTotal, with(labels, "direction", "tx"), float64(s.PacketsTX), ""},
+			{PacketsTotal, with(labels, "direction", "rx"), float64(s.PacketsRX), ""},
+			{BytesTotal, with(labels, "direction", "tx"), float64(s.BytesTX), ""},
+			{BytesTotal, with(labels, "direction", "rx"), float64(s.BytesRX), ""},
+			{ErrorsTotal, with(labels, "direction", "tx"), float64(s.ErrorsTX), ""},
+			{ErrorsTotal, with(labels, "direction", "rx"), float64(s.ErrorsRX), ""},
+			{ConnectionsActive, labels, float64(s.ConnsActive), ""},
+			{ConnectionsPeak, labels, float64(s.ConnsPeak), ""},
+			{ConnectionsDeniedTotal, labels, float64(s.ConnsDenied), ""},
+			{ReconnectsTotal, labels, float64(s.Reconnects), ""},
+		}
+		if s.DNS {
+			samples = append(samples,
+				Sample{DNSCacheHitsTotal, labels, float64(s.DNSCacheHits), ""},
+				Sample{DNSCacheMissesTotal, labels, float64(s.DNSCacheMisses), ""},
+				Sample{DNSFailuresTotal, labels, float64(s.DNSFailures), ""},
+				Sample{DNSErrorResponsesTotal, with(labels, "rcode", "NXDOMAIN"), float64(s.DNSNXDomain), ""},
+				Sample{DNSErrorResponsesTotal, with(labels, "rcode", "SERVFAIL"), float64(s.DNSServFail), ""},
+				Sample{DNSFallbacksTotal, with(labels, "reason", "other_domain"), float64(s.DNSOtherDomain), ""},
+				Sample{DNSFallbacksTotal, with(labels, "reason", "truncated"), float64(s.DNSTruncated), ""},
+				Sample{DNSDeniedTotal, labels, float64(s.DNSDenied), ""},
+			)
+			for _, q := range s.DNSQueries {
+				samples = append(samples, Sample{DNSQueriesTotal, with(with(labels, "domain", q.Domain), "type", q.Type), float64(q.Count), ""})
+			}
+			for _, q := range slices.Sorted(maps.Keys(s.DNSLatencyQuantiles)) {
+				quantile := strconv.FormatFloat(q, 'g', -1, 64)
+				samples = append(samples, Sample{DNSUpstreamLatency, with(labels, "quantile", quantile), s.DNSLatencyQuantiles[q], ""})
+			}
+			samples = append(samples,
+				Sample{DNSUpstreamLatency, labels, s.DNSLatencySum, "_sum"},
+				Sample{DNSUpstreamLatency, labels, float64(s.DNSLatencyCount), "_count"},
+			)
+			for _, server := range s.DNSServers {
+				serverLabels := with(labels, "server", server.Address)
+				samples = append(samples,
+					Sample{DNSServerUp, serverLabels, boolValue(server.Up), ""},
+					Sample{DNSServerQueriesTotal, serverLabels, float64(server.Queries), ""},
+					Sample{DNSServerFailuresTotal, serverLabels, float64(server.Failures), ""},
+				)
+			}
+		}
+		return samples
+	}
+}
+
+// with returns a copy of labels with one more label
+func with(labels Labels, name, value string) Labels {
+	l := maps.Clone(labels)
+	if l == nil {
+		l = make(Labels, 1)
+	}
+	l[name] = value
+	return l
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
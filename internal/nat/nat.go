@@ -0,0 +1,140 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Mapping maps a local CIDR block (routed through the TUN device) onto a
+// remote CIDR block of the same size, so that overlapping remote networks
+// can be reached through distinct local address ranges
+type Mapping struct {
+	Local  *net.IPNet
+	Remote *net.IPNet
+}
+
+// String returns the mapping in LOCAL=REMOTE notation
+func (m Mapping) String() string {
+	return fmt.Sprintf("%s=%s", m.Local, m.Remote)
+}
+
+// Table is an ordered set of NAT mappings. A nil *Table performs no mapping.
+type Table struct {
+	mappings []Mapping
+}
+
+// ParseMapping parses a mapping in LOCAL=REMOTE notation,
+// e.g. "10.200.0.0/16=10.0.0.0/16"
+func ParseMapping(s string) (Mapping, error) {
+	localStr, remoteStr, ok := strings.Cut(s, "=")
+	if !ok {
+		return Mapping{}, fmt.Errorf("invalid NAT mapping %q, expected LOCAL_CIDR=REMOTE_CIDR", s)
+	}
+
+	_, local, err := net.ParseCIDR(strings.TrimSpace(localStr))
+	if err != nil {
+		return Mapping{}, fmt.Errorf("invalid local CIDR in NAT mapping %q: %w", s, err)
+	}
+	_, remote, err := net.ParseCIDR(strings.TrimSpace(remoteStr))
+	if err != nil {
+		return Mapping{}, fmt.Errorf("invalid remote CIDR in NAT mapping %q: %w", s, err)
+	}
+
+	if local.IP.To4() == nil || remote.IP.To4() == nil {
+		return Mapping{}, fmt.Errorf("NAT mapping %q: only IPv4 is supported", s)
+	}
+
+	localOnes, _ := local.Mask.Size()
+	remoteOnes, _ := remote.Mask.Size()
+	if localOnes != remoteOnes {
+		return Mapping{}, fmt.Errorf("NAT mapping %q: local and remote prefixes must have the same length", s)
+	}
+
+	return Mapping{Local: local, Remote: remote}, nil
+}
+
+// NewTable creates a table from LOCAL=REMOTE mapping strings. Local ranges
+// must not overlap each other.
+func NewTable(specs []string) (*Table, error) {
+	t := &Table{}
+	for _, spec := range specs {
+		m, err := ParseMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, existing := range t.mappings {
+			if overlaps(existing.Local, m.Local) {
+				return nil, fmt.Errorf("NAT mappings %s and %s have overlapping local ranges", existing, m)
+			}
+		}
+
+		t.mappings = append(t.mappings, m)
+	}
+	return t, nil
+}
+
+// Mappings returns the configured mappings
+func (t *Table) Mappings() []Mapping {
+	if t == nil {
+		return nil
+	}
+	return t.mappings
+}
+
+// Empty reports whether the table has no mappings
+func (t *Table) Empty() bool {
+	return t == nil || len(t.mappings) == 0
+}
+
+// LocalCIDRs returns the local CIDR blocks that must be routed to the TUN
+func (t *Table) LocalCIDRs() []string {
+	var cidrs []string
+	for _, m := range t.Mappings() {
+		cidrs = append(cidrs, m.Local.String())
+	}
+	return cidrs
+}
+
+// ToRemote translates a local (routed) address into the remote address it
+// stands for. The second return value is false if no mapping applies.
+func (t *Table) ToRemote(ip net.IP) (net.IP, bool) {
+	for _, m := range t.Mappings() {
+		if m.Local.Contains(ip) {
+			return translate(ip, m.Local, m.Remote), true
+		}
+	}
+	return ip, false
+}
+
+// ToLocal translates a remote address (e.g. from a DNS answer) into the
+// local address routed through the tunnel. The second return value is false
+// if no mapping applies.
+func (t *Table) ToLocal(ip net.IP) (net.IP, bool) {
+	for _, m := range t.Mappings() {
+		if m.Remote.Contains(ip) {
+			return translate(ip, m.Remote, m.Local), true
+		}
+	}
+	return ip, false
+}
+
+// translate keeps the host bits of ip and replaces the network bits of from
+// with those of to
+func translate(ip net.IP, from, to *net.IPNet) net.IP {
+	ones, _ := from.Mask.Size()
+	mask := binary.BigEndian.Uint32(net.CIDRMask(ones, 32))
+	v := binary.BigEndian.Uint32(ip.To4())
+	base := binary.BigEndian.Uint32(to.IP.To4())
+
+	out := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(out, (base&mask)|(v&^mask))
+	return out
+}
+
+// overlaps reports whether two networks share any address
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
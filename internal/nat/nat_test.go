@@ -0,0 +1,177 @@
+package nat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string // "" if invalid
+	}{
+		{"10.200.0.0/16=10.0.0.0/16", "10.200.0.0/16=10.0.0.0/16"},
+		{" 10.200.0.0/16 = 10.0.0.0/16 ", "10.200.0.0/16=10.0.0.0/16"},
+		{"10.200.1.2/16=10.0.3.4/16", "10.200.0.0/16=10.0.0.0/16"},
+		{"10.200.0.7/32=172.16.0.9/32", "10.200.0.7/32=172.16.0.9/32"},
+		{"0.0.0.0/0=0.0.0.0/0", "0.0.0.0/0=0.0.0.0/0"},
+		{"10.200.0.0/16", ""},
+		{"10.200.0.0/16=", ""},
+		{"10.200.0.0=10.0.0.0/16", ""},
+		{"10.200.0.0/16=10.0.0.0/33", ""},
+		{"10.200.0.0/16=10.0.0.0/24", ""},
+		{"10.200.0.0/24=10.0.0.0/16", ""},
+		{"10.200.0.0/32=10.0.0.0/31", ""},
+		{"fd00::/64=fd01::/64", ""},
+		{"10.200.0.0/16=fd01::/16", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			m, err := ParseMapping(tt.spec)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("ParseMapping(%q) = %s, want an error", tt.spec, m)
+			case tt.want != "" && err != nil:
+				t.Errorf("ParseMapping(%q): %v", tt.spec, err)
+			case tt.want != "" && m.String() != tt.want:
+				t.Errorf("ParseMapping(%q) = %s, want %s", tt.spec, m, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []string
+		local    string
+		remote   string // "" if the local address is not mapped
+	}{
+		{"network address", []string{"10.200.0.0/16=10.0.0.0/16"}, "10.200.0.0", "10.0.0.0"},
+		{"host", []string{"10.200.0.0/16=10.0.0.0/16"}, "10.200.3.4", "10.0.3.4"},
+		{"broadcast address", []string{"10.200.0.0/16=10.0.0.0/16"}, "10.200.255.255", "10.0.255.255"},
+		{"outside", []string{"10.200.0.0/16=10.0.0.0/16"}, "10.201.0.1", ""},
+		{"/24", []string{"192.168.50.0/24=172.31.7.0/24"}, "192.168.50.99", "172.31.7.99"},
+		{"unaligned /20", []string{"10.200.16.0/20=10.0.32.0/20"}, "10.200.31.255", "10.0.47.255"},
+		{"/32", []string{"10.200.0.7/32=172.16.0.9/32"}, "10.200.0.7", "172.16.0.9"},
+		{"next to /32", []string{"10.200.0.7/32=172.16.0.9/32"}, "10.200.0.8", ""},
+		{"/0", []string{"0.0.0.0/0=0.0.0.0/0"}, "8.8.8.8", "8.8.8.8"},
+		{"second mapping", []string{"10.200.0.0/16=10.0.0.0/16", "10.250.0.0/24=192.168.1.0/24"}, "10.250.0.12", "192.168.1.12"},
+		{"IPv4-mapped IPv6", []string{"10.200.0.0/16=10.0.0.0/16"}, "::ffff:10.200.1.1", "10.0.1.1"},
+		{"IPv6", []string{"0.0.0.0/0=0.0.0.0/0"}, "fd00::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := NewTable(tt.mappings)
+			if err != nil {
+				t.Fatalf("NewTable: %v", err)
+			}
+			local := net.ParseIP(tt.local)
+
+			remote, ok := table.ToRemote(local)
+			if tt.remote == "" {
+				if ok || !remote.Equal(local) {
+					t.Errorf("ToRemote(%s) = %s, %v; want it unmapped", local, remote, ok)
+				}
+				return
+			}
+			if !ok || !remote.Equal(net.ParseIP(tt.remote)) {
+				t.Fatalf("ToRemote(%s) = %s, %v; want %s", local, remote, ok, tt.remote)
+			}
+
+			back, ok := table.ToLocal(remote)
+			if !ok || !back.Equal(local) {
+				t.Errorf("ToLocal(%s) = %s, %v; want %s", remote, back, ok, local)
+			}
+		})
+	}
+}
+
+func TestToLocalUnmapped(t *testing.T) {
+	table, err := NewTable([]string{"10.200.0.0/16=10.0.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	// A local address is not a remote one
+	for _, s := range []string{"10.1.0.1", "10.200.0.1", "fd00::1"} {
+		ip := net.ParseIP(s)
+		if got, ok := table.ToLocal(ip); ok || !got.Equal(ip) {
+			t.Errorf("ToLocal(%s) = %s, %v; want it unmapped", ip, got, ok)
+		}
+	}
+}
+
+// Two VPCs with the same CIDR block are reached through distinct local
+// ranges, which must not overlap
+func TestOverlappingVPCs(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []string
+		valid    bool
+	}{
+		{"distinct local ranges", []string{"10.200.0.0/16=10.0.0.0/16", "10.201.0.0/16=10.0.0.0/16"}, true},
+		{"same local range", []string{"10.200.0.0/16=10.0.0.0/16", "10.200.0.0/16=10.0.0.0/16"}, false},
+		{"same local range, other VPC", []string{"10.200.0.0/16=10.0.0.0/16", "10.200.0.0/16=172.16.0.0/16"}, false},
+		{"local range inside another", []string{"10.200.0.0/16=10.0.0.0/16", "10.200.8.0/24=10.0.8.0/24"}, false},
+		{"local range around another", []string{"10.200.8.0/24=10.0.8.0/24", "10.200.0.0/16=10.0.0.0/16"}, false},
+		{"adjacent local ranges", []string{"10.200.0.0/17=10.0.0.0/17", "10.200.128.0/17=10.0.0.0/17"}, true},
+		{"overlap with the third", []string{"10.200.0.0/24=10.0.0.0/24", "10.201.0.0/24=10.0.0.0/24", "10.200.0.128/25=10.0.0.0/25"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := NewTable(tt.mappings)
+			if tt.valid && err != nil {
+				t.Fatalf("NewTable: %v", err)
+			}
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("NewTable accepted overlapping local ranges: %v", table.Mappings())
+				}
+				return
+			}
+			if got := table.LocalCIDRs(); len(got) != len(tt.mappings) {
+				t.Errorf("LocalCIDRs = %v, want %d blocks", got, len(tt.mappings))
+			}
+		})
+	}
+}
+
+func TestSameRemoteRange(t *testing.T) {
+	table, err := NewTable([]string{"10.200.0.0/16=10.0.0.0/16", "10.201.0.0/16=10.0.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+
+	// Each local range reaches its own VPC's address
+	for _, local := range []string{"10.200.1.2", "10.201.1.2"} {
+		if remote, ok := table.ToRemote(net.ParseIP(local)); !ok || !remote.Equal(net.ParseIP("10.0.1.2")) {
+			t.Errorf("ToRemote(%s) = %s, %v; want 10.0.1.2", local, remote, ok)
+		}
+	}
+	// A remote address is ambiguous; the first mapping wins
+	if local, ok := table.ToLocal(net.ParseIP("10.0.1.2")); !ok || !local.Equal(net.ParseIP("10.200.1.2")) {
+		t.Errorf("ToLocal(10.0.1.2) = %s, %v; want 10.200.1.2", local, ok)
+	}
+}
+
+func TestNilTable(t *testing.T) {
+	var table *Table
+	ip := net.ParseIP("10.0.0.1")
+	if got, ok := table.ToRemote(ip); ok || !got.Equal(ip) {
+		t.Errorf("nil table: ToRemote(%s) = %s, %v", ip, got, ok)
+	}
+	if got, ok := table.ToLocal(ip); ok || !got.Equal(ip) {
+		t.Errorf("nil table: ToLocal(%s) = %s, %v", ip, got, ok)
+	}
+	if !table.Empty() || table.Mappings() != nil || table.LocalCIDRs() != nil {
+		t.Error("nil table is not empty")
+	}
+
+	table, err := NewTable(nil)
+	if err != nil || !table.Empty() {
+		t.Errorf("NewTable(nil) = %v, %v; want an empty table", table, err)
+	}
+	if len(table.LocalCIDRs()) != 0 {
+		t.Errorf("empty table has local CIDRs %v", table.LocalCIDRs())
+	}
+}
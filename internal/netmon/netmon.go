@@ -0,0 +1,118 @@
+// Package netmon reports changes of the network a tunnel depends on: links
+// going up or down, addresses coming and going, the default route being
+// replaced, and the system waking from sleep. Switching Wi-Fi networks or
+// waking up breaks the route to the SSM endpoints long before keep-alives
+// notice.
+package netmon
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// DefaultDebounce is how long changes have to be quiet before they are
+// reported; a network switch produces dozens within a second or two
+const DefaultDebounce = 2 * time.Second
+
+// sleepCheckInterval is how often the clocks are compared to detect that
+// the system slept, and sleepThreshold how far they have to drift apart
+const (
+	sleepCheckInterval = 5 * time.Second
+	sleepThreshold     = 10 * time.Second
+)
+
+// Event is a burst of network changes
+type Event struct {
+	Reason string // what changed, e.g. "default route replaced, address added on en0"
+	Time   time.Time
+}
+
+// Watch reports network changes until ctx is done, a burst of them as one
+// event once they have been quiet for debounce. Changes that only concern
+// the interfaces in ignore (the tunnel's own TUN devices) are left out. An
+// event not picked up before the next one is merged into it.
+func Watch(ctx context.Context, debounce time.Duration, ignore ...string) (<-chan Event, error) {
+	changes := make(chan string, 64)
+	ignored := func(name string) bool { return slices.Contains(ignore, name) }
+	if err := subscribe(ctx, changes, ignored); err != nil {
+		return nil, err
+	}
+	go watchSleep(ctx, changes)
+
+	events := make(chan Event, 1)
+	go coalesce(ctx, changes, events, debounce)
+	return events, nil
+}
+
+// SetLogger sets the logger of the network monitor
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
+
+// report passes a change on unless ctx is done
+func report(ctx context.Context, changes chan<- string, reason string) {
+	log.Debugf("Network change: %s", reason)
+	select {
+	case changes <- reason:
+	case <-ctx.Done():
+	}
+}
+
+// coalesce turns the changes into events, one per quiet period
+func coalesce(ctx context.Context, changes <-chan string, events chan Event, debounce time.Duration) {
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	var reasons []string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reason := <-changes:
+			if !slices.Contains(reasons, reason) {
+				reasons = append(reasons, reason)
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			event := Event{Reason: strings.Join(reasons, ", "), Time: time.Now()}
+			reasons = nil
+
+			// The consumer is still busy with the previous event
+			select {
+			case pending := <-events:
+				event.Reason = pending.Reason + ", " + event.Reason
+			default:
+			}
+			events <- event
+		}
+	}
+}
+
+// watchSleep reports the system waking from sleep, noticed by the wall
+// clock having moved on further than the monotonic clock, which stands
+// still while the system sleeps
+func watchSleep(ctx context.Context, changes chan<- string) {
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			now = time.Now()
+			slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+			last = now
+			if slept > sleepThreshold {
+				report(ctx, changes, "woke from sleep after "+slept.Round(time.Second).String())
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/route"
+)
+
+// subscribe reports link, address and default route changes, as the
+// routing socket announces them
+func subscribe(ctx context.Context, changes chan<- string, ignored func(string) bool) error {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	// Non-blocking, so that closing the file ends a pending read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to set up routing socket: %w", err)
+	}
+	socket := os.NewFile(uintptr(fd), "route")
+	context.AfterFunc(ctx, func() { socket.Close() })
+
+	go func() {
+		states := make(map[int]int) // up flag per interface index
+		if ifaces, err := net.Interfaces(); err == nil {
+			for _, iface := range ifaces {
+				if iface.Flags&net.FlagUp != 0 {
+					states[iface.Index] = syscall.IFF_UP
+				} else {
+					states[iface.Index] = 0
+				}
+			}
+		}
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warnf("Stopped receiving changes from the routing socket: %v", err)
+				}
+				return
+			}
+			messages, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+			if err != nil {
+				log.Debugf("Ignoring unparseable routing message: %v", err)
+				continue
+			}
+			for _, message := range messages {
+				if reason := describe(message, states, ignored); reason != "" {
+					report(ctx, changes, reason)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// describe returns what a routing message changed, or "" if it does not
+// matter: changes of the ignored interfaces, interface announcements that
+// leave it up or down, link-local addresses (which awdl0 and friends add and
+// remove all the time) and routes other than the default route. states are
+// the up flags of the interfaces seen so far.
+func describe(message route.Message, states map[int]int, ignored func(string) bool) string {
+	switch m := message.(type) {
+	case *route.InterfaceMessage:
+		name := interfaceName(m.Index, m.Name)
+		up := m.Flags & syscall.IFF_UP
+		previous, known := states[m.Index]
+		states[m.Index] = up
+		if ignored(name) || (known && previous == up) {
+			return ""
+		}
+		if up == 0 {
+			return "link " + name + " down"
+		}
+		return "link " + name + " up"
+	case *route.InterfaceAddrMessage:
+		name := interfaceName(m.Index, "")
+		if ignored(name) || isLinkLocal(m.Addrs) {
+			return ""
+		}
+		if m.Type == syscall.RTM_DELADDR {
+			return "address removed from " + name
+		}
+		return "address added on " + name
+	case *route.RouteMessage:
+		if !isDefault(m.Addrs) || ignored(interfaceName(m.Index, "")) {
+			return ""
+		}
+		switch m.Type {
+		case syscall.RTM_ADD:
+			return "default route added"
+		case syscall.RTM_DELETE:
+			return "default route removed"
+		case syscall.RTM_CHANGE:
+			return "default route changed"
+		}
+	}
+	return ""
+}
+
+// isDefault reports whether the addresses of a routing message are those of
+// a default route: no destination or netmask bits set
+func isDefault(addrs []route.Addr) bool {
+	if len(addrs) <= syscall.RTAX_DST || addrs[syscall.RTAX_DST] == nil {
+		return false
+	}
+	if !isZero(addrs[syscall.RTAX_DST]) {
+		return false
+	}
+	return len(addrs) <= syscall.RTAX_NETMASK || addrs[syscall.RTAX_NETMASK] == nil || isZero(addrs[syscall.RTAX_NETMASK])
+}
+
+// isLinkLocal reports whether the address of an address message is a
+// link-local one
+func isLinkLocal(addrs []route.Addr) bool {
+	if len(addrs) <= syscall.RTAX_IFA {
+		return false
+	}
+	switch a := addrs[syscall.RTAX_IFA].(type) {
+	case *route.Inet4Addr:
+		return net.IP(a.IP[:]).IsLinkLocalUnicast()
+	case *route.Inet6Addr:
+		return net.IP(a.IP[:]).IsLinkLocalUnicast()
+	}
+	return false
+}
+
+// isZero reports whether an address is all zeros
+func isZero(addr route.Addr) bool {
+	switch a := addr.(type) {
+	case *route.Inet4Addr:
+		return a.IP == [4]byte{}
+	case *route.Inet6Addr:
+		return a.IP == [16]byte{}
+	}
+	return false
+}
+
+// interfaceName returns the name of the interface with the given index,
+// unless the message named it already, or its index if it is gone
+func interfaceName(index int, name string) string {
+	if name != "" {
+		return name
+	}
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("interface %d", index)
+}
@@ -0,0 +1,145 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// linkUp are the link flags whose change matters: up and carrier
+const linkUp = unix.IFF_UP | unix.IFF_RUNNING
+
+// subscribe reports link, address and default route changes, as netlink
+// notifies them
+func subscribe(ctx context.Context, changes chan<- string, ignored func(string) bool) error {
+	done := make(chan struct{})
+	context.AfterFunc(ctx, func() { close(done) })
+
+	links := make(chan netlink.LinkUpdate, 16)
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return fmt.Errorf("failed to subscribe to link changes: %w", err)
+	}
+	addrs := make(chan netlink.AddrUpdate, 16)
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		return fmt.Errorf("failed to subscribe to address changes: %w", err)
+	}
+	routes := make(chan netlink.RouteUpdate, 16)
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		return fmt.Errorf("failed to subscribe to route changes: %w", err)
+	}
+
+	go func() {
+		// Up and carrier flags per link, to tell their changes from those
+		// of other attributes
+		flags := make(map[int]uint32)
+		if current, err := netlink.LinkList(); err == nil {
+			for _, link := range current {
+				flags[link.Attrs().Index] = link.Attrs().RawFlags & linkUp
+			}
+		}
+
+		for {
+			select {
+			case update, ok := <-links:
+				if !ok {
+					links = nil
+					stopped(ctx, "link")
+					continue
+				}
+				attrs := update.Attrs()
+				if ignored(attrs.Name) {
+					continue
+				}
+				if update.Header.Type == unix.RTM_DELLINK {
+					delete(flags, attrs.Index)
+					report(ctx, changes, "link "+attrs.Name+" removed")
+					continue
+				}
+				state, known := flags[attrs.Index]
+				flags[attrs.Index] = attrs.RawFlags & linkUp
+				if known && state == attrs.RawFlags&linkUp {
+					continue
+				}
+				report(ctx, changes, "link "+attrs.Name+" "+linkState(attrs.RawFlags))
+
+			case update, ok := <-addrs:
+				if !ok {
+					addrs = nil
+					stopped(ctx, "address")
+					continue
+				}
+				name := linkName(update.LinkIndex)
+				if ignored(name) || update.LinkAddress.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				if update.NewAddr {
+					report(ctx, changes, "address added on "+name)
+				} else {
+					report(ctx, changes, "address removed from "+name)
+				}
+
+			case update, ok := <-routes:
+				if !ok {
+					routes = nil
+					stopped(ctx, "route")
+					continue
+				}
+				if !isDefault(update.Route) || ignored(linkName(update.LinkIndex)) {
+					continue
+				}
+				if update.Type == unix.RTM_DELROUTE {
+					report(ctx, changes, "default route removed")
+				} else {
+					report(ctx, changes, "default route added")
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stopped logs that netlink ended a subscription other than by ctx
+func stopped(ctx context.Context, kind string) {
+	if ctx.Err() == nil {
+		log.Warnf("Stopped receiving %s changes from netlink", kind)
+	}
+}
+
+// isDefault reports whether a route of the main table is a default route
+func isDefault(route netlink.Route) bool {
+	if route.Table != 0 && route.Table != unix.RT_TABLE_MAIN {
+		return false
+	}
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// linkState describes the up and carrier flags of a link
+func linkState(flags uint32) string {
+	switch {
+	case flags&unix.IFF_UP == 0:
+		return "down"
+	case flags&unix.IFF_RUNNING == 0:
+		return "up without carrier"
+	default:
+		return "up"
+	}
+}
+
+// linkName returns the name of the link with the given index, or its
+// index if it is gone
+func linkName(index int) string {
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("link %d", index)
+}
@@ -0,0 +1,15 @@
+// Package netutil holds small network helpers shared by the command and
+// the client library.
+package netutil
+
+import "net"
+
+// FreeLocalPort returns a TCP port on 127.0.0.1 that is free right now
+func FreeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
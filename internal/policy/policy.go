@@ -0,0 +1,293 @@
+// Package policy decides which destinations may be reached through the
+// tunnel. A policy is an ordered list of allow and deny rules, each
+// matching destination networks or host names and, optionally, ports; the
+// first rule matching a destination decides, and destinations no rule
+// matches get the policy's default.
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Action is what a rule does with the destinations it matches
+type Action string
+
+const (
+	// Allow lets connections to the destinations through
+	Allow Action = "allow"
+	// Deny refuses them
+	Deny Action = "deny"
+)
+
+// PortRange is a range of ports, From to To inclusive
+type PortRange struct {
+	From, To uint16
+}
+
+// Rule allows or denies the destinations it matches
+type Rule struct {
+	Action Action
+	// Prefix is the network of an address rule
+	Prefix netip.Prefix
+	// Host is the host name of a name rule, or *.DOMAIN for the names under
+	// DOMAIN; "*" matches every destination
+	Host string
+	// Ports are the ports the rule matches; all ports if empty
+	Ports []PortRange
+}
+
+// ParseRule parses a rule in "ACTION TARGET[:PORTS]" notation. ACTION is
+// allow or deny. TARGET is a CIDR block, an address, a host name, *.DOMAIN
+// or * (anything); IPv6 targets with ports are bracketed, e.g.
+// [fd00::/8]:443. PORTS is a comma-separated list of ports and ranges,
+// e.g. 5432,8000-8100.
+func ParseRule(s string) (*Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid policy rule %q, expected ACTION TARGET[:PORTS]", s)
+	}
+
+	rule := &Rule{Action: Action(strings.ToLower(fields[0]))}
+	if rule.Action != Allow && rule.Action != Deny {
+		return nil, fmt.Errorf("invalid policy rule %q: unknown action %q (expected allow or deny)", s, fields[0])
+	}
+
+	target, ports, err := splitPorts(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy rule %q: %w", s, err)
+	}
+	if ports != "" {
+		if rule.Ports, err = parsePorts(ports); err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %w", s, err)
+		}
+	}
+
+	if prefix, err := netip.ParsePrefix(target); err == nil {
+		rule.Prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(target); err == nil {
+		rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else if validHost(target) {
+		rule.Host = strings.ToLower(strings.TrimSuffix(target, "."))
+	} else {
+		return nil, fmt.Errorf("invalid policy rule %q: %q is not a CIDR block, address or host name", s, target)
+	}
+	return rule, nil
+}
+
+// splitPorts splits TARGET[:PORTS] into its target and ports
+func splitPorts(s string) (string, string, error) {
+	if rest, ok := strings.CutPrefix(s, "["); ok {
+		target, after, ok := strings.Cut(rest, "]")
+		if !ok {
+			return "", "", fmt.Errorf("missing ] in %q", s)
+		}
+		if after == "" {
+			return target, "", nil
+		}
+		ports, ok := strings.CutPrefix(after, ":")
+		if !ok || ports == "" {
+			return "", "", fmt.Errorf("expected :PORTS after ] in %q", s)
+		}
+		return target, ports, nil
+	}
+	// An unbracketed IPv6 target has no ports
+	if strings.Count(s, ":") > 1 {
+		return s, "", nil
+	}
+	target, ports, hasPorts := strings.Cut(s, ":")
+	if hasPorts && ports == "" {
+		return "", "", fmt.Errorf("missing ports after : in %q", s)
+	}
+	return target, ports, nil
+}
+
+// parsePorts parses a comma-separated list of ports and ranges
+func parsePorts(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		first, err := strconv.ParseUint(from, 10, 16)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		last, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, PortRange{From: uint16(first), To: uint16(last)})
+	}
+	return ranges, nil
+}
+
+// validHost reports whether s is a host name, *.DOMAIN or *
+func validHost(s string) bool {
+	if s == "*" {
+		return true
+	}
+	s = strings.TrimPrefix(s, "*.")
+	if s == "" || strings.ContainsAny(s, "*/[]") {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the rule in the notation accepted by ParseRule
+func (r *Rule) String() string {
+	target := r.Host
+	if r.Host == "" {
+		target = r.Prefix.String()
+		if r.Prefix.IsSingleIP() {
+			target = r.Prefix.Addr().String()
+		}
+		if r.Prefix.Addr().Is6() && len(r.Ports) > 0 {
+			target = "[" + target + "]"
+		}
+	}
+	if len(r.Ports) == 0 {
+		return fmt.Sprintf("%s %s", r.Action, target)
+	}
+
+	ports := make([]string, len(r.Ports))
+	for i, p := range r.Ports {
+		ports[i] = strconv.Itoa(int(p.From))
+		if p.To != p.From {
+			ports[i] += "-" + strconv.Itoa(int(p.To))
+		}
+	}
+	return fmt.Sprintf("%s %s:%s", r.Action, target, strings.Join(ports, ","))
+}
+
+// matchesPort reports whether the rule applies to port
+func (r *Rule) matchesPort(port uint16) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.Ports, func(p PortRange) bool {
+		return port >= p.From && port <= p.To
+	})
+}
+
+// matchesName reports whether the rule is a name rule matching name
+func (r *Rule) matchesName(name string) bool {
+	switch {
+	case r.Host == "":
+		return false
+	case r.Host == "*":
+		return true
+	case name == "":
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(r.Host, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return name == r.Host
+}
+
+// matches reports whether the rule applies to a connection to addr:port,
+// whose name is host ("" if unknown)
+func (r *Rule) matches(addr netip.Addr, host string, port uint16) bool {
+	if !r.matchesPort(port) {
+		return false
+	}
+	if r.Host != "" {
+		return r.matchesName(host)
+	}
+	return addr.IsValid() && r.Prefix.Contains(addr.Unmap())
+}
+
+// Policy is an ordered list of rules and the action for destinations none
+// of them match. A nil *Policy allows everything.
+type Policy struct {
+	rules  []*Rule
+	action Action
+}
+
+// New returns the policy of rules. Destinations no rule matches get
+// defaultAction; if it is "", they are denied when there are allow rules,
+// and allowed otherwise.
+func New(rules []*Rule, defaultAction Action) (*Policy, error) {
+	switch defaultAction {
+	case Allow, Deny:
+	case "":
+		defaultAction = Allow
+		if slices.ContainsFunc(rules, func(r *Rule) bool { return r.Action == Allow }) {
+			defaultAction = Deny
+		}
+	default:
+		return nil, fmt.Errorf("invalid default policy %q (expected allow or deny)", defaultAction)
+	}
+	return &Policy{rules: rules, action: defaultAction}, nil
+}
+
+// Parse returns the policy of rules in ParseRule notation
+func Parse(specs []string, defaultAction string) (*Policy, error) {
+	var rules []*Rule
+	for _, spec := range specs {
+		rule, err := ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return New(rules, Action(strings.ToLower(defaultAction)))
+}
+
+// Rules returns the policy's rules, in order
+func (p *Policy) Rules() []*Rule {
+	if p == nil {
+		return nil
+	}
+	return p.rules
+}
+
+// Default returns the action for destinations no rule matches
+func (p *Policy) Default() Action {
+	if p == nil {
+		return Allow
+	}
+	return p.action
+}
+
+// Allows reports whether a connection to addr:port may go through the
+// tunnel; host is the destination's name, "" if unknown (only rules for
+// its address then apply). The rule that decided is returned too, nil for
+// the default.
+func (p *Policy) Allows(addr netip.Addr, host string, port uint16) (bool, *Rule) {
+	if p == nil {
+		return true, nil
+	}
+	for _, rule := range p.rules {
+		if rule.matches(addr, host, port) {
+			return rule.Action == Allow, rule
+		}
+	}
+	return p.action == Allow, nil
+}
+
+// AllowsName reports whether name may be looked up through the tunnel: it
+// may not if the first name rule matching it (other than *) denies every
+// port. Whether its addresses may be connected to is up to Allows.
+func (p *Policy) AllowsName(name string) bool {
+	if p == nil {
+		return true
+	}
+	for _, rule := range p.rules {
+		if rule.Host != "*" && rule.matchesName(name) {
+			return rule.Action == Allow || len(rule.Ports) > 0
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         []string
+		defaultAction string
+		addr          string // "" for a connection without a known address
+		host          string
+		port          uint16
+		want          bool
+		rule          string // the deciding rule, "" for the default
+	}{
+		// CIDR rules
+		{"address in allowed block", []string{"allow 10.0.0.0/16"}, "", "10.0.3.4", "", 443, true, "allow 10.0.0.0/16"},
+		{"address outside allowed block", []string{"allow 10.0.0.0/16"}, "", "10.1.0.1", "", 443, false, ""},
+		{"address in denied block", []string{"deny 10.0.5.0/24"}, "", "10.0.5.9", "", 22, false, "deny 10.0.5.0/24"},
+		{"single address", []string{"allow 10.0.0.7"}, "", "10.0.0.7", "", 80, true, "allow 10.0.0.7"},
+		{"next to single address", []string{"allow 10.0.0.7"}, "", "10.0.0.8", "", 80, false, ""},
+		{"unmasked block", []string{"allow 10.0.3.4/16"}, "", "10.0.200.1", "", 80, true, "allow 10.0.0.0/16"},
+		{"IPv4-mapped address", []string{"allow 10.0.0.0/16"}, "", "::ffff:10.0.1.1", "", 80, true, "allow 10.0.0.0/16"},
+		{"CIDR rule without address", []string{"allow 10.0.0.0/16"}, "", "", "db.internal", 5432, false, ""},
+		{"CIDR rule ignores host", []string{"deny 10.0.0.0/16"}, "", "192.168.1.1", "db.internal", 5432, true, ""},
+
+		// Domain rules
+		{"exact host", []string{"allow db.internal"}, "", "10.0.0.1", "db.internal", 5432, true, "allow db.internal"},
+		{"host case and trailing dot", []string{"allow DB.Internal."}, "", "10.0.0.1", "db.INTERNAL.", 5432, true, "allow db.internal"},
+		{"other host", []string{"allow db.internal"}, "", "10.0.0.1", "web.internal", 80, false, ""},
+		{"host rule without host", []string{"allow db.internal"}, "", "10.0.0.1", "", 5432, false, ""},
+		{"wildcard subdomain", []string{"allow *.corp.example"}, "", "10.0.0.1", "git.eu.corp.example", 443, true, "allow *.corp.example"},
+		{"wildcard excludes the domain", []string{"allow *.corp.example"}, "", "10.0.0.1", "corp.example", 443, false, ""},
+		{"wildcard excludes lookalikes", []string{"allow *.corp.example"}, "", "10.0.0.1", "evilcorp.example", 443, false, ""},
+		{"star matches without host", []string{"deny *"}, "allow", "10.0.0.1", "", 80, false, "deny *"},
+
+		// Ports
+		{"port in list", []string{"allow 10.0.0.0/8:22,443"}, "", "10.1.1.1", "", 443, true, "allow 10.0.0.0/8:22,443"},
+		{"port not in list", []string{"allow 10.0.0.0/8:22,443"}, "", "10.1.1.1", "", 80, false, ""},
+		{"port range bounds", []string{"allow db.internal:5432-5439"}, "", "", "db.internal", 5439, true, "allow db.internal:5432-5439"},
+		{"port past range", []string{"allow db.internal:5432-5439"}, "", "", "db.internal", 5440, false, ""},
+
+		// The first matching rule decides
+		{"deny before broader allow", []string{"deny 10.0.5.0/24", "allow 10.0.0.0/16"}, "", "10.0.5.1", "", 80, false, "deny 10.0.5.0/24"},
+		{"broader allow after deny", []string{"deny 10.0.5.0/24", "allow 10.0.0.0/16"}, "", "10.0.6.1", "", 80, true, "allow 10.0.0.0/16"},
+		{"allow before broader deny", []string{"allow 10.0.5.0/24", "deny 10.0.0.0/16"}, "", "10.0.5.1", "", 80, true, "allow 10.0.5.0/24"},
+		{"denied host before allowed block", []string{"deny secrets.internal", "allow 10.0.0.0/16"}, "", "10.0.0.9", "secrets.internal", 443, false, "deny secrets.internal"},
+		{"denied port before allowed host", []string{"deny *:22", "allow *.internal"}, "", "10.0.0.9", "db.internal", 22, false, "deny *:22"},
+		{"other port after denied port", []string{"deny *:22", "allow *.internal"}, "", "10.0.0.9", "db.internal", 5432, true, "allow *.internal"},
+
+		// Default action
+		{"no rules", nil, "", "10.0.0.1", "", 80, true, ""},
+		{"only deny rules default to allow", []string{"deny 10.0.0.0/8"}, "", "192.168.0.1", "", 80, true, ""},
+		{"allow rules default to deny", []string{"deny 10.0.0.0/8", "allow 192.168.0.0/16"}, "", "172.16.0.1", "", 80, false, ""},
+		{"explicit default allow", []string{"allow 10.0.0.0/8"}, "allow", "172.16.0.1", "", 80, true, ""},
+		{"explicit default deny", []string{"deny 10.0.0.0/8"}, "DENY", "172.16.0.1", "", 80, false, ""},
+
+		// IPv6
+		{"IPv6 block", []string{"allow fd00::/8"}, "", "fd12:3456::1", "", 443, true, "allow fd00::/8"},
+		{"IPv6 outside block", []string{"allow fd00::/8"}, "", "fe80::1", "", 443, false, ""},
+		{"IPv6 block with ports", []string{"allow [fd00::/8]:443"}, "", "fd00::1", "", 443, true, "allow [fd00::/8]:443"},
+		{"IPv6 block other port", []string{"allow [fd00::/8]:443"}, "", "fd00::1", "", 80, false, ""},
+		{"single IPv6 address", []string{"deny [2001:db8::1]:22", "allow 2001:db8::/32"}, "", "2001:db8::1", "", 22, false, "deny [2001:db8::1]:22"},
+		{"IPv6 rule ignores IPv4", []string{"allow ::/0"}, "", "10.0.0.1", "", 80, false, ""},
+		{"IPv4 rule ignores IPv6", []string{"allow 0.0.0.0/0"}, "", "fd00::1", "", 80, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(tt.rules, tt.defaultAction)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			var addr netip.Addr
+			if tt.addr != "" {
+				addr = netip.MustParseAddr(tt.addr)
+			}
+
+			got, rule := p.Allows(addr, tt.host, tt.port)
+			if got != tt.want {
+				t.Errorf("Allows(%s, %q, %d) = %v, want %v", tt.addr, tt.host, tt.port, got, tt.want)
+			}
+			switch {
+			case rule == nil && tt.rule != "":
+				t.Errorf("decided by the default, want %q", tt.rule)
+			case rule != nil && rule.String() != tt.rule:
+				t.Errorf("decided by %q, want %q", rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if ok, rule := p.Allows(netip.MustParseAddr("10.0.0.1"), "", 22); !ok || rule != nil {
+		t.Errorf("nil policy: Allows = %v, %v; want true, nil", ok, rule)
+	}
+	if !p.AllowsName("db.internal") || p.Default() != Allow || p.Rules() != nil {
+		t.Error("nil policy does not allow everything")
+	}
+}
+
+func TestAllowsName(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		host  string
+		want  bool
+	}{
+		{"no rules", nil, "db.internal", true},
+		{"denied host", []string{"deny db.internal"}, "db.internal", false},
+		{"denied domain", []string{"deny *.internal"}, "db.internal", false},
+		{"denied on some ports", []string{"deny db.internal:22"}, "db.internal", true},
+		{"allowed before denied", []string{"allow db.internal", "deny *.internal"}, "db.internal", true},
+		{"denied before allowed", []string{"deny db.internal", "allow *.internal"}, "db.internal", false},
+		{"star is ignored", []string{"deny *"}, "db.internal", true},
+		{"CIDR rules are ignored", []string{"deny 0.0.0.0/0", "deny ::/0"}, "db.internal", true},
+		{"other host", []string{"deny db.internal"}, "web.internal", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(tt.rules, "")
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := p.AllowsName(tt.host); got != tt.want {
+				t.Errorf("AllowsName(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string // "" if invalid
+	}{
+		{"allow 10.0.0.0/16", "allow 10.0.0.0/16"},
+		{"ALLOW 10.0.0.1/16:443", "allow 10.0.0.0/16:443"},
+		{"deny 10.0.0.1", "deny 10.0.0.1"},
+		{"deny 10.0.0.1/32", "deny 10.0.0.1"},
+		{"allow fd00::/8", "allow fd00::/8"},
+		{"allow [fd00::/8]:443,8000-8100", "allow [fd00::/8]:443,8000-8100"},
+		{"allow [2001:db8::1]", "allow 2001:db8::1"},
+		{"allow *.Example.COM:443", "allow *.example.com:443"},
+		{"deny *:25", "deny *:25"},
+		{"allow", ""},
+		{"allow 10.0.0.0/8 extra", ""},
+		{"permit 10.0.0.0/8", ""},
+		{"allow 10.0.0.0/8:0", ""},
+		{"allow 10.0.0.0/8:70000", ""},
+		{"allow 10.0.0.0/8:443-80", ""},
+		{"allow 10.0.0.0/8:", ""},
+		{"allow [fd00::/8", ""},
+		{"allow [fd00::/8]443", ""},
+		{"allow [fd00::/8]:", ""},
+		{"allow db..internal", ""},
+		{"allow a*.internal", ""},
+		{"allow *.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			rule, err := ParseRule(tt.spec)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("ParseRule(%q) = %q, want an error", tt.spec, rule)
+			case tt.want != "" && err != nil:
+				t.Errorf("ParseRule(%q): %v", tt.spec, err)
+			case tt.want != "" && rule.String() != tt.want:
+				t.Errorf("ParseRule(%q) = %q, want %q", tt.spec, rule, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalidDefault(t *testing.T) {
+	if _, err := Parse([]string{"allow 10.0.0.0/8"}, "reject"); err == nil {
+		t.Error("Parse accepted default policy \"reject\"")
+	}
+}
@@ -0,0 +1,205 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/connset"
+	"github.com/sbkg0002/ssm-proxy/internal/socks"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// DefaultBindAddress is the local address mappings listen on unless one is
+// given, like ssh -L
+const DefaultBindAddress = "127.0.0.1"
+
+// Mapping is a local port forward: connections to BindAddress:LocalPort
+// are forwarded to RemoteHost:RemotePort through the tunnel
+type Mapping struct {
+	BindAddress string
+	LocalPort   int
+	RemoteHost  string
+	RemotePort  int
+}
+
+// ParseMapping parses an ssh-style -L value: [bind_address:]port:host:hostport.
+// IPv6 addresses are written in brackets, e.g. [::1]:5432:[fd00::5]:5432.
+func ParseMapping(spec string) (Mapping, error) {
+	fields, err := splitSpec(spec)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("invalid -L %q: %w", spec, err)
+	}
+
+	m := Mapping{BindAddress: DefaultBindAddress}
+	switch len(fields) {
+	case 3:
+	case 4:
+		m.BindAddress = fields[0]
+		fields = fields[1:]
+	default:
+		return Mapping{}, fmt.Errorf("invalid -L %q (expected [bind_address:]port:host:hostport)", spec)
+	}
+
+	if m.LocalPort, err = parsePort(fields[0]); err != nil {
+		return Mapping{}, fmt.Errorf("invalid -L %q: local %w", spec, err)
+	}
+	m.RemoteHost = fields[1]
+	if m.RemoteHost == "" {
+		return Mapping{}, fmt.Errorf("invalid -L %q: remote host is empty", spec)
+	}
+	if m.RemotePort, err = parsePort(fields[2]); err != nil {
+		return Mapping{}, fmt.Errorf("invalid -L %q: remote %w", spec, err)
+	}
+	if m.RemotePort == 0 {
+		return Mapping{}, fmt.Errorf("invalid -L %q: remote port must not be 0", spec)
+	}
+	return m, nil
+}
+
+// splitSpec splits spec at colons outside of brackets, removing the brackets
+func splitSpec(spec string) ([]string, error) {
+	var fields []string
+	for {
+		var field string
+		if strings.HasPrefix(spec, "[") {
+			end := strings.IndexByte(spec, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			field, spec = spec[1:end], spec[end+1:]
+			if spec != "" && spec[0] != ':' {
+				return nil, fmt.Errorf("expected : after ]")
+			}
+		} else if i := strings.IndexByte(spec, ':'); i >= 0 {
+			field, spec = spec[:i], spec[i:]
+		} else {
+			field, spec = spec, ""
+		}
+		fields = append(fields, field)
+
+		if spec == "" {
+			return fields, nil
+		}
+		spec = spec[1:]
+	}
+}
+
+// parsePort parses a port number (0 picks a free local port)
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("port %q is not a number between 0 and 65535", s)
+	}
+	return port, nil
+}
+
+// LocalAddr returns the address the mapping listens on
+func (m Mapping) LocalAddr() string {
+	return net.JoinHostPort(m.BindAddress, strconv.Itoa(m.LocalPort))
+}
+
+// RemoteAddr returns the destination connections are forwarded to
+func (m Mapping) RemoteAddr() string {
+	return net.JoinHostPort(m.RemoteHost, strconv.Itoa(m.RemotePort))
+}
+
+// String describes the mapping
+func (m Mapping) String() string {
+	return fmt.Sprintf("%s → %s", m.LocalAddr(), m.RemoteAddr())
+}
+
+// Forwarder listens on the local side of mappings and relays each accepted
+// connection to its destination through a SOCKS5 proxy
+type Forwarder struct {
+	socksAddr   string
+	dialTimeout time.Duration
+
+	conns connset.Set // listeners and forwarded connections
+}
+
+// New creates a forwarder that dials through the SOCKS5 proxy at socksAddr
+func New(socksAddr string, dialTimeout time.Duration) *Forwarder {
+	if dialTimeout <= 0 {
+		dialTimeout = 30 * time.Second
+	}
+	return &Forwarder{
+		socksAddr:   socksAddr,
+		dialTimeout: dialTimeout,
+	}
+}
+
+// Listen starts forwarding a mapping. It returns the mapping with the
+// actual local port (for port 0).
+func (f *Forwarder) Listen(m Mapping) (Mapping, error) {
+	l, err := net.Listen("tcp", m.LocalAddr())
+	if err != nil {
+		return m, fmt.Errorf("failed to listen on %s: %w", m.LocalAddr(), err)
+	}
+	m.LocalPort = l.Addr().(*net.TCPAddr).Port
+
+	if !f.conns.Track(l) {
+		l.Close()
+		return m, net.ErrClosed
+	}
+
+	go f.accept(l, m)
+	return m, nil
+}
+
+// Close stops listening and closes all forwarded connections
+func (f *Forwarder) Close() {
+	f.conns.Close()
+}
+
+// accept serves a mapping's listener until it is closed
+func (f *Forwarder) accept(l net.Listener, m Mapping) {
+	defer f.conns.Untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Failed to accept connection on %s: %v", m.LocalAddr(), err)
+			}
+			return
+		}
+		if !f.conns.Track(conn) {
+			conn.Close()
+			return
+		}
+		go f.forward(conn, m)
+	}
+}
+
+// forward relays one local connection to the mapping's destination
+func (f *Forwarder) forward(local net.Conn, m Mapping) {
+	defer f.conns.Untrack(local)
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.dialTimeout)
+	remote, err := socks.Dial(ctx, f.socksAddr, m.RemoteAddr())
+	cancel()
+	if err != nil {
+		log.Warnf("Failed to connect to %s for %s: %v", m.RemoteAddr(), local.RemoteAddr(), err)
+		return
+	}
+	if !f.conns.Track(remote) {
+		remote.Close()
+		return
+	}
+	defer f.conns.Untrack(remote)
+
+	log.Debugf("Forwarding %s → %s", local.RemoteAddr(), m.RemoteAddr())
+	socks.Relay(local, remote)
+}
+
+// SetLogger sets the logger of the port forwarders
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
@@ -0,0 +1,86 @@
+// Package procinfo finds the local process that owns a connection, so that
+// traffic can be told apart by application.
+package procinfo
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned when no socket matches a connection, e.g. because
+// it was closed already
+var ErrNotFound = errors.New("no socket owns the connection")
+
+// Process is the owner of a socket
+type Process struct {
+	PID  int
+	Name string // executable name
+	Path string // executable path, if known
+}
+
+// String describes the process as name[pid]
+func (p Process) String() string {
+	return fmt.Sprintf("%s[%d]", p.Name, p.PID)
+}
+
+// Owner returns the process owning the socket of a connection from local to
+// remote; protocol is "tcp" or "udp". For UDP, only the local port is
+// matched: the socket may not be connected.
+func Owner(protocol string, local, remote netip.AddrPort) (Process, error) {
+	if protocol != "tcp" && protocol != "udp" {
+		return Process{}, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	return owner(protocol, local, remote)
+}
+
+// Apps selects processes by executable name or PID
+type Apps struct {
+	names []string // lowercased
+	pids  []int
+}
+
+// ParseApps parses a list of executable names (e.g. psql, "Google Chrome")
+// and PIDs
+func ParseApps(specs []string) (*Apps, error) {
+	apps := &Apps{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if pid, err := strconv.Atoi(spec); err == nil {
+			if pid <= 0 {
+				return nil, fmt.Errorf("invalid PID %d", pid)
+			}
+			apps.pids = append(apps.pids, pid)
+			continue
+		}
+		if strings.ContainsRune(spec, '/') {
+			spec = filepath.Base(spec)
+		}
+		apps.names = append(apps.names, strings.ToLower(spec))
+	}
+	if len(apps.names) == 0 && len(apps.pids) == 0 {
+		return nil, fmt.Errorf("no applications given")
+	}
+	return apps, nil
+}
+
+// Match reports whether p is one of the applications
+func (a *Apps) Match(p Process) bool {
+	return slices.Contains(a.pids, p.PID) || slices.Contains(a.names, strings.ToLower(p.Name))
+}
+
+// String lists the applications
+func (a *Apps) String() string {
+	list := slices.Clone(a.names)
+	for _, pid := range a.pids {
+		list = append(list, "pid "+strconv.Itoa(pid))
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,147 @@
+package procinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kinds of the items of the pcblist_n sysctls (XSO_* in netinet/in_pcb.h)
+const (
+	xsoSocket = 0x001
+	xsoRcvBuf = 0x002
+	xsoSndBuf = 0x004
+	xsoStats  = 0x008
+	xsoInPCB  = 0x010
+	xsoTCPCB  = 0x020
+
+	// A socket's items are complete once all of its kinds were seen
+	allUDPKinds = xsoSocket | xsoRcvBuf | xsoSndBuf | xsoStats | xsoInPCB
+	allTCPKinds = allUDPKinds | xsoTCPCB
+)
+
+// Offsets of the fields used in struct xinpcb_n and struct xsocket_n
+const (
+	inpcbFPort   = 16 // u_short inp_fport, network order
+	inpcbLPort   = 18 // u_short inp_lport, network order
+	inpcbVFlag   = 28 // u_char inp_vflag
+	inpcbFAddr   = 32 // struct in6_addr, or in_addr_4in6
+	inpcbLAddr   = 48
+	inpcbMinLen  = 64
+	inpVFlagIPv4 = 0x1
+
+	socketLastPID = 72 // pid_t so_last_pid
+	socketEPID    = 76 // pid_t so_e_pid, the app a daemon acts for
+	socketMinLen  = 80
+
+	xinpgenLen = 24 // struct xinpgen, before and after the list
+)
+
+// pcb is the part of a socket's entry owner needs
+type pcb struct {
+	local, remote netip.AddrPort
+	pid           int
+}
+
+// owner looks the connection up in the kernel's list of sockets, the one
+// netstat -v reads
+func owner(protocol string, local, remote netip.AddrPort) (Process, error) {
+	buf, err := unix.SysctlRaw("net.inet." + protocol + ".pcblist_n")
+	if err != nil {
+		return Process{}, fmt.Errorf("failed to list %s sockets: %w", protocol, err)
+	}
+	kinds := uint32(allUDPKinds)
+	if protocol == "tcp" {
+		kinds = allTCPKinds
+	}
+
+	for _, p := range parsePCBList(buf, kinds) {
+		if p.local.Port() != local.Port() {
+			continue
+		}
+		if protocol == "tcp" && p.remote != netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()) {
+			continue
+		}
+		return process(p.pid), nil
+	}
+	return Process{}, ErrNotFound
+}
+
+// parsePCBList parses the items of a pcblist_n sysctl, an xinpgen header
+// followed by a run of items (each starting with its length and kind) for
+// every socket
+func parsePCBList(buf []byte, kinds uint32) []pcb {
+	if len(buf) < xinpgenLen {
+		return nil
+	}
+
+	var pcbs []pcb
+	var current pcb
+	var seen uint32
+	for off := roundUp8(binary.LittleEndian.Uint32(buf)); off+8 <= len(buf); {
+		length := binary.LittleEndian.Uint32(buf[off:])
+		kind := binary.LittleEndian.Uint32(buf[off+4:])
+		// The trailing xinpgen ends the list
+		if length <= xinpgenLen || off+int(length) > len(buf) {
+			break
+		}
+		item := buf[off : off+int(length)]
+
+		switch kind {
+		case xsoInPCB:
+			if len(item) >= inpcbMinLen {
+				current.local = netip.AddrPortFrom(inpcbAddr(item, inpcbLAddr), binary.BigEndian.Uint16(item[inpcbLPort:]))
+				current.remote = netip.AddrPortFrom(inpcbAddr(item, inpcbFAddr), binary.BigEndian.Uint16(item[inpcbFPort:]))
+			}
+		case xsoSocket:
+			if len(item) >= socketMinLen {
+				current.pid = int(int32(binary.LittleEndian.Uint32(item[socketEPID:])))
+				if current.pid <= 0 {
+					current.pid = int(int32(binary.LittleEndian.Uint32(item[socketLastPID:])))
+				}
+			}
+		}
+		seen |= kind
+		if seen&kinds == kinds {
+			pcbs = append(pcbs, current)
+			current, seen = pcb{}, 0
+		}
+		off += roundUp8(length)
+	}
+	return pcbs
+}
+
+// inpcbAddr returns the address at off of an xinpcb_n: an IPv6 address,
+// or an IPv4 one in its last four bytes
+func inpcbAddr(item []byte, off int) netip.Addr {
+	if item[inpcbVFlag]&inpVFlagIPv4 != 0 {
+		return netip.AddrFrom4([4]byte(item[off+12 : off+16]))
+	}
+	return netip.AddrFrom16([16]byte(item[off : off+16]))
+}
+
+// roundUp8 rounds an item length up to the 8-byte alignment of the list
+func roundUp8(n uint32) int {
+	return int((n + 7) &^ 7)
+}
+
+// process returns the name and path of the executable of pid
+func process(pid int) Process {
+	p := Process{PID: pid}
+	// kern.procargs2: argc, then the executable path
+	if args, err := unix.SysctlRaw("kern.procargs2", pid); err == nil && len(args) > 4 {
+		if path, _, ok := bytes.Cut(args[4:], []byte{0}); ok && len(path) > 0 {
+			p.Path = string(path)
+			p.Name = filepath.Base(p.Path)
+			return p
+		}
+	}
+	if info, err := unix.SysctlKinfoProc("kern.proc.pid", pid); err == nil {
+		p.Name = unix.ByteSliceToString(info.Proc.P_comm[:])
+	}
+	return p
+}
@@ -0,0 +1,11 @@
+package procinfo
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// owner is only implemented on macOS
+func owner(protocol string, local, remote netip.AddrPort) (Process, error) {
+	return Process{}, errors.ErrUnsupported
+}
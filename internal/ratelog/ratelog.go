@@ -0,0 +1,144 @@
+// Package ratelog throttles log messages from hot paths. A wedged TUN
+// device or proxy makes every packet fail the same way; instead of logging
+// each failure, the first one is logged and the rest are counted and
+// summarized once per interval ("suppressed 4,213 similar messages in
+// 1m0s").
+package ratelog
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterval is how long similar messages are suppressed after one is
+// logged
+const DefaultInterval = time.Minute
+
+// Limiter logs a message at most once per interval for each format string
+// (messages from the same call site are similar, whatever their
+// arguments), and summarizes the ones it suppressed at the end of the
+// interval
+type Limiter struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	logger  *logrus.Logger
+	entries map[string]*entry
+}
+
+// entry tracks the messages of one format string
+type entry struct {
+	level      logrus.Level
+	start      time.Time // of the interval
+	until      time.Time // similar messages are suppressed until then
+	suppressed int
+	last       string // latest suppressed message
+	timer      *time.Timer
+}
+
+// New creates a limiter logging to logger
+func New(logger *logrus.Logger, interval time.Duration) *Limiter {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Limiter{
+		interval: interval,
+		logger:   logger,
+		entries:  make(map[string]*entry),
+	}
+}
+
+// SetLogger switches the logger messages go to
+func (l *Limiter) SetLogger(logger *logrus.Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger = logger
+}
+
+// Warnf logs a warning, unless a similar one was logged within the interval
+func (l *Limiter) Warnf(format string, args ...any) {
+	l.logf(logrus.WarnLevel, format, args...)
+}
+
+// Errorf logs an error, unless a similar one was logged within the interval
+func (l *Limiter) Errorf(format string, args ...any) {
+	l.logf(logrus.ErrorLevel, format, args...)
+}
+
+// logf logs a message at level or counts it as suppressed. The first
+// message suppressed in an interval schedules its summary.
+func (l *Limiter) logf(level logrus.Level, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.logger.IsLevelEnabled(level) {
+		return
+	}
+
+	now := time.Now()
+	e, ok := l.entries[format]
+	if !ok || !now.Before(e.until) {
+		l.logger.Logf(level, format, args...)
+		l.entries[format] = &entry{level: level, start: now, until: now.Add(l.interval)}
+		return
+	}
+
+	e.suppressed++
+	e.last = fmt.Sprintf(format, args...)
+	if e.timer == nil {
+		e.timer = time.AfterFunc(e.until.Sub(now), func() { l.summarize(format) })
+	}
+}
+
+// summarize logs how many messages of a format string were suppressed and
+// starts a new interval, so that a flood that goes on is summarized once
+// per interval
+func (l *Limiter) summarize(format string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[format]
+	if !ok || e.suppressed == 0 {
+		return
+	}
+	l.log(e)
+	e.start = time.Now()
+	e.until = e.start.Add(l.interval)
+	e.suppressed, e.last, e.timer = 0, "", nil
+}
+
+// Flush logs the summaries of the messages suppressed so far, e.g. before
+// the component logging them stops
+func (l *Limiter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for format, e := range l.entries {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		if e.suppressed > 0 {
+			l.log(e)
+		}
+		delete(l.entries, format)
+	}
+}
+
+// log writes the summary of an entry
+func (l *Limiter) log(e *entry) {
+	elapsed := time.Since(e.start).Round(time.Second)
+	l.logger.Logf(e.level, "%s (suppressed %s similar messages in %s)", e.last, formatCount(e.suppressed), elapsed)
+}
+
+// formatCount formats n with thousands separators, e.g. 4,213
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,39 @@
+package record
+
+// Device is a TUN device, e.g. a *tunnel.TunDevice
+type Device interface {
+	Read(packet []byte) (int, error)
+	Write(packet []byte) (int, error)
+	MTU() int
+}
+
+// recordingDevice records the packets read from and written to a device
+type recordingDevice struct {
+	Device
+	w *Writer
+}
+
+// NewDevice returns dev with every packet read from it recorded as
+// Outbound and every packet written to it as Inbound into w, a recording
+// of KindPackets
+func NewDevice(dev Device, w *Writer) Device {
+	return &recordingDevice{Device: dev, w: w}
+}
+
+// Read reads a packet from the device and records it
+func (d *recordingDevice) Read(packet []byte) (int, error) {
+	n, err := d.Device.Read(packet)
+	if n > 0 {
+		d.w.Record(Outbound, packet[:n])
+	}
+	return n, err
+}
+
+// Write records a packet and writes it to the device
+func (d *recordingDevice) Write(packet []byte) (int, error) {
+	n, err := d.Device.Write(packet)
+	if err == nil {
+		d.w.Record(Inbound, packet)
+	}
+	return n, err
+}
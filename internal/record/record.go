@@ -0,0 +1,255 @@
+// Package record writes and reads recordings of the byte streams a session
+// handles: the IP packets read from and written to the TUN device, or the
+// SSM Session Manager messages exchanged with the agent. Recordings taken
+// in the field can be replayed (see 'ssm-proxy replay') to reproduce
+// protocol bugs.
+//
+// A recording starts with an 8-byte magic, a version byte and a kind byte,
+// followed by records of: direction (1 byte), time (Unix nanoseconds,
+// 8 bytes), length (4 bytes) and data. Integers are big-endian.
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// magic starts every recording
+const magic = "SSMPREC\x00"
+
+// version is the format version written
+const version = 1
+
+// flushInterval is how often buffered records are written out, so that a
+// crash loses at most this much of a recording
+const flushInterval = time.Second
+
+// maxRecordLen bounds a record's data when reading, so a corrupt length
+// cannot exhaust memory
+const maxRecordLen = 16 << 20
+
+// Kind is what a recording holds
+type Kind uint8
+
+const (
+	// KindPackets are IP packets of the TUN device
+	KindPackets Kind = 1
+	// KindMessages are SSM Session Manager messages (websocket frames)
+	KindMessages Kind = 2
+)
+
+// String returns the kind's name
+func (k Kind) String() string {
+	switch k {
+	case KindPackets:
+		return "packets"
+	case KindMessages:
+		return "messages"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+// Direction is which way a record's data went
+type Direction uint8
+
+const (
+	// Outbound data goes towards the instance: packets read from the TUN
+	// device, messages sent to the agent
+	Outbound Direction = 1
+	// Inbound data comes back: packets written to the TUN device, messages
+	// received from the agent
+	Inbound Direction = 2
+)
+
+// String returns the direction's name
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "out"
+	case Inbound:
+		return "in"
+	}
+	return fmt.Sprintf("direction(%d)", uint8(d))
+}
+
+// Record is one packet or message of a recording
+type Record struct {
+	Direction Direction
+	Time      time.Time
+	Data      []byte
+}
+
+// Writer writes a recording. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	err     error // first write error; later records are dropped
+	closed  bool
+	flushed time.Time
+}
+
+// Create creates (or truncates) the recording at path
+func Create(path string, kind Kind) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	w := &Writer{file: file, buf: bufio.NewWriter(file), flushed: time.Now()}
+	header := append([]byte(magic), version, byte(kind))
+	if _, err := w.buf.Write(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+	return w, nil
+}
+
+// Record appends data going in direction. The data is copied. A nil
+// Writer records nothing, so callers need not check whether recording is
+// enabled.
+func (w *Writer) Record(direction Direction, data []byte) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.err != nil {
+		return
+	}
+
+	now := time.Now()
+	var header [13]byte
+	header[0] = byte(direction)
+	binary.BigEndian.PutUint64(header[1:9], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(data)))
+	if _, err := w.buf.Write(header[:]); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.buf.Write(data); err != nil {
+		w.err = err
+		return
+	}
+
+	if now.Sub(w.flushed) >= flushInterval {
+		w.flushed = now
+		if err := w.buf.Flush(); err != nil {
+			w.err = err
+		}
+	}
+}
+
+// Flush writes buffered records to the file
+func (w *Writer) Flush() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.buf.Flush()
+}
+
+// Close flushes the recording and closes the file. It returns the first
+// error writing the recording, if any.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.err
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reader reads a recording
+type Reader struct {
+	file *os.File
+	buf  *bufio.Reader
+	kind Kind
+}
+
+// Open opens the recording at path
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	r := &Reader{file: file, buf: bufio.NewReader(file)}
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r.buf, header); err != nil || string(header[:len(magic)]) != magic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a recording", path)
+	}
+	if header[len(magic)] != version {
+		file.Close()
+		return nil, fmt.Errorf("unsupported recording version %d", header[len(magic)])
+	}
+	r.kind = Kind(header[len(magic)+1])
+	if r.kind != KindPackets && r.kind != KindMessages {
+		file.Close()
+		return nil, fmt.Errorf("unsupported recording %s", r.kind)
+	}
+	return r, nil
+}
+
+// Kind returns what the recording holds
+func (r *Reader) Kind() Kind {
+	return r.kind
+}
+
+// Next returns the next record, or io.EOF at the end of the recording. A
+// recording cut short (e.g. by a crash) ends with io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r.buf, header[:]); err != nil {
+		return Record{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length > maxRecordLen {
+		return Record{}, fmt.Errorf("invalid record length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.buf, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+
+	return Record{
+		Direction: Direction(header[0]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+		Data:      data,
+	}, nil
+}
+
+// Close closes the recording
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// NextHop is where the system sends traffic for a destination
+type NextHop struct {
+	Interface string
+	Gateway   string // empty for a directly connected destination
+}
+
+// String describes the next hop like the route commands do
+func (h NextHop) String() string {
+	if h.Gateway == "" {
+		return h.Interface
+	}
+	return fmt.Sprintf("%s via %s", h.Interface, h.Gateway)
+}
+
+// AddBypassRoute adds a route for the CIDR block via the given next hop,
+// typically the one the system used before the tunnel's routes were added,
+// so that the addresses in it keep bypassing the tunnel. The route is
+// tracked, verified and repaired like the others.
+func (r *Router) AddBypassRoute(ctx context.Context, cidr string, hop NextHop) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return &RouteError{Op: "add", CIDR: cidr, Interface: hop.Interface, Gateway: hop.Gateway, Err: fmt.Errorf("%w: %w", ErrInvalidCIDR, err)}
+	}
+
+	r.mu.Lock()
+	r.overrides[network.String()] = via(hop)
+	r.mu.Unlock()
+
+	if err := r.AddRouteContext(ctx, cidr, hop.Interface); err != nil {
+		r.mu.Lock()
+		delete(r.overrides, network.String())
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// DeleteBypassRoute removes a route added by AddBypassRoute
+func (r *Router) DeleteBypassRoute(ctx context.Context, cidr string) error {
+	if err := r.DeleteRouteContext(ctx, cidr); err != nil {
+		return err
+	}
+	if _, network, err := net.ParseCIDR(cidr); err == nil {
+		r.mu.Lock()
+		delete(r.overrides, network.String())
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// MoveBypassRoutes moves the bypass routes via one next hop to another,
+// e.g. to the new default gateway after a network change, and reports the
+// outcome for every route. A route that cannot be added via the new next
+// hop stays tracked with it, so that drift repair retries it.
+func (r *Router) MoveBypassRoutes(ctx context.Context, from, to NextHop) RouteResults {
+	r.mu.Lock()
+	var cidrs []string
+	for cidr, iface := range r.routes {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && iface == from.Interface && sameGateway(r.overrides[network.String()], via(from)) {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	r.mu.Unlock()
+	slices.Sort(cidrs)
+
+	results := make(RouteResults, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		// The route may have gone with the old network
+		_ = r.DeleteBypassRoute(ctx, cidr)
+
+		err := r.AddBypassRoute(ctx, cidr, to)
+		if err != nil {
+			_, network, _ := net.ParseCIDR(cidr)
+			r.mu.Lock()
+			r.routes[cidr] = to.Interface
+			r.overrides[network.String()] = via(to)
+			r.mu.Unlock()
+		}
+		results = append(results, RouteResult{CIDR: cidr, Err: err})
+	}
+	return results
+}
+
+// via returns the gateway override routes via the next hop are added with
+func via(hop NextHop) string {
+	if hop.Gateway == "" {
+		return ViaInterface
+	}
+	return hop.Gateway
+}
+
+// sameGateway reports whether two gateway overrides are the same, whether
+// or not the IPv6 link-local ones carry a zone (fe80::1%en0)
+func sameGateway(a, b string) bool {
+	a, _, _ = strings.Cut(a, "%")
+	b, _, _ = strings.Cut(b, "%")
+	return a == b
+}
@@ -0,0 +1,157 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// Conflict resolution modes for routes that overlap existing system routes
+const (
+	// ConflictWarn reports conflicts but installs routes unchanged
+	ConflictWarn = "warn"
+	// ConflictSplit installs more-specific subdivided routes so that the
+	// tunnel wins over the conflicting route
+	ConflictSplit = "split"
+	// ConflictIgnore skips conflict detection entirely
+	ConflictIgnore = "ignore"
+)
+
+// SystemRoute is an entry of the system routing table
+type SystemRoute struct {
+	Destination *net.IPNet
+	Gateway     string
+	Interface   string
+}
+
+// String returns a human-readable description of the route
+func (r SystemRoute) String() string {
+	return fmt.Sprintf("%s via %s (%s)", r.Destination, r.Interface, r.Gateway)
+}
+
+// Conflict describes an existing route that takes precedence over (part of)
+// a CIDR block we want to route through the tunnel
+type Conflict struct {
+	CIDR     string      // CIDR block we want to route
+	Existing SystemRoute // conflicting route on another interface
+	Equal    bool        // true if the existing route has the same prefix
+}
+
+// Reason explains why the conflict affects our traffic
+func (c Conflict) Reason() string {
+	if c.Equal {
+		return fmt.Sprintf("%s already routed via %s with an equal-length prefix", c.CIDR, c.Existing.Interface)
+	}
+	return fmt.Sprintf("%s is more specific and routed via %s", c.Existing.Destination, c.Existing.Interface)
+}
+
+// RoutePlan is the set of routes to install for one requested CIDR block
+type RoutePlan struct {
+	CIDR      string     // requested CIDR block
+	Routes    []string   // routes to actually install
+	Conflicts []Conflict // conflicts that were detected
+	Split     bool       // true if Routes differ from CIDR because of conflicts
+	Unsolved  []Conflict // conflicts that could not be resolved by splitting
+}
+
+// FindConflicts returns the routes on other interfaces that would win over
+// (part of) cidr: routes with an equal prefix, or more-specific routes inside it
+func FindConflicts(cidr string, routes []SystemRoute, ourInterface string) ([]Conflict, error) {
+	_, want, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+	}
+	wantOnes, wantBits := want.Mask.Size()
+
+	var conflicts []Conflict
+	for _, route := range routes {
+		if route.Destination == nil || route.Interface == ourInterface {
+			continue
+		}
+		ones, bits := route.Destination.Mask.Size()
+		if bits != wantBits || ones == 0 {
+			continue // other address family, and default routes never win over ours
+		}
+
+		if ones < wantOnes || !want.Contains(route.Destination.IP) {
+			continue
+		}
+
+		conflicts = append(conflicts, Conflict{
+			CIDR:     cidr,
+			Existing: route,
+			Equal:    ones == wantOnes,
+		})
+	}
+
+	return conflicts, nil
+}
+
+// PlanRoutes decides which routes to install for cidr given the detected
+// conflicts. In ConflictSplit mode an equal-prefix conflict replaces cidr by
+// its two halves, and each more-specific conflict is covered by that route's
+// two halves, so the tunnel's routes are always the longest match.
+func PlanRoutes(cidr string, conflicts []Conflict, mode string) RoutePlan {
+	plan := RoutePlan{CIDR: cidr, Conflicts: conflicts}
+	if mode != ConflictSplit || len(conflicts) == 0 {
+		plan.Routes = []string{cidr}
+		return plan
+	}
+
+	includeSelf := true
+	seen := make(map[string]bool)
+	var extra []string
+
+	for _, c := range conflicts {
+		target := c.Existing.Destination.String()
+		if c.Equal {
+			includeSelf = false
+			target = cidr
+		}
+
+		halves, err := SplitCIDR(target)
+		if err != nil {
+			plan.Unsolved = append(plan.Unsolved, c)
+			continue
+		}
+		for _, h := range halves {
+			if !seen[h] {
+				seen[h] = true
+				extra = append(extra, h)
+			}
+		}
+		plan.Split = true
+	}
+
+	if includeSelf {
+		plan.Routes = append(plan.Routes, cidr)
+	}
+	plan.Routes = append(plan.Routes, extra...)
+
+	return plan
+}
+
+// SplitCIDR splits an IPv4 or IPv6 CIDR block into its two halves
+// e.g. "10.0.0.0/16" -> ["10.0.0.0/17", "10.0.128.0/17"]
+func SplitCIDR(cidr string) ([]string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+	}
+
+	ones, bits := network.Mask.Size()
+	if ones >= bits {
+		return nil, fmt.Errorf("cannot split host route %s", cidr)
+	}
+
+	mask := net.CIDRMask(ones+1, bits)
+	low := network.IP
+	high := make(net.IP, len(low))
+	copy(high, low)
+	bit := uint(bits - 1 - ones)
+	high[len(high)-1-int(bit/8)] |= 1 << (bit % 8)
+
+	return []string{
+		(&net.IPNet{IP: low, Mask: mask}).String(),
+		(&net.IPNet{IP: high, Mask: mask}).String(),
+	}, nil
+}
@@ -0,0 +1,47 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// DriftedRoutes returns the routes added by this router whose traffic no
+// longer goes through the interface they were added to, e.g. because a VPN
+// client or a network change replaced them
+func (r *Router) DriftedRoutes() []string {
+	var drifted []string
+	for cidr := range r.ListRoutes() {
+		if ok, err := r.VerifyRoute(cidr); err == nil && !ok {
+			drifted = append(drifted, cidr)
+		}
+	}
+	slices.Sort(drifted)
+	return drifted
+}
+
+// RepairRoute reinstalls a route added by this router, replacing whatever
+// route for the CIDR block took its place
+func (r *Router) RepairRoute(ctx context.Context, cidr string) error {
+	iface, ok := r.ListRoutes()[cidr]
+	if !ok {
+		return fmt.Errorf("route %s is not managed by this router", cidr)
+	}
+
+	// The route may be gone already; only the re-add has to succeed
+	_ = r.DeleteRouteContext(ctx, cidr)
+
+	if err := r.AddRouteContext(ctx, cidr, iface); err != nil {
+		// Keep tracking the route, so that it is still verified and
+		// cleaned up
+		r.mu.Lock()
+		r.routes[cidr] = iface
+		r.mu.Unlock()
+		return err
+	}
+
+	if ok, err := r.VerifyRoute(cidr); err != nil || !ok {
+		return fmt.Errorf("route %s still does not use %s (a more specific route may take precedence)", cidr, iface)
+	}
+	return nil
+}
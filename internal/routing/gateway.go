@@ -0,0 +1,75 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// ViaInterface is the gateway override that routes a CIDR block straight to
+// the interface, even when the router uses a gateway
+const ViaInterface = "interface"
+
+// SetGateway makes the router add routes via the given next-hop address
+// (route add -net X <gateway>) instead of interface-scoped routes. An empty
+// gateway restores interface-scoped routes. Routes already added are not
+// changed.
+func (r *Router) SetGateway(gateway string) error {
+	if gateway != "" && net.ParseIP(gateway).To4() == nil {
+		return fmt.Errorf("invalid gateway address %q (expected an IPv4 address)", gateway)
+	}
+
+	r.mu.Lock()
+	r.gateway = gateway
+	r.mu.Unlock()
+	return nil
+}
+
+// SetGatewayOverride sets how routes within the CIDR block are added: via
+// the given gateway address, or straight to the interface with
+// ViaInterface. The most specific override containing a route applies.
+func (r *Router) SetGatewayOverride(cidr, via string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCIDR, err)
+	}
+	if via != ViaInterface && net.ParseIP(via).To4() == nil {
+		return fmt.Errorf("invalid gateway %q for %s (expected an IPv4 address or %q)", via, cidr, ViaInterface)
+	}
+
+	r.mu.Lock()
+	r.overrides[network.String()] = via
+	r.mu.Unlock()
+	return nil
+}
+
+// Gateway returns the next-hop address routes for the CIDR block are added
+// via, or "" for an interface-scoped route
+func (r *Router) Gateway(cidr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gateway := r.gateway
+	_, route, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return gateway
+	}
+	routeOnes, _ := route.Mask.Size()
+
+	best := -1
+	for overrideCIDR, via := range r.overrides {
+		_, network, _ := net.ParseCIDR(overrideCIDR)
+		ones, _ := network.Mask.Size()
+		if ones > routeOnes || ones <= best || !network.Contains(route.IP) {
+			continue
+		}
+		best = ones
+		gateway = via
+	}
+
+	// A gateway of the other address family cannot be the next hop, e.g. the
+	// IPv4 --route-gateway for an IPv6 CIDR block
+	if gateway == ViaInterface || isIPv6CIDR(gateway) != isIPv6CIDR(cidr) {
+		return ""
+	}
+	return gateway
+}
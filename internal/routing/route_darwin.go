@@ -1,124 +1,221 @@
 package routing
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
 )
 
-// Router manages routing table entries on macOS
-type Router struct {
-	routes map[string]string // CIDR -> interface mapping
-	mu     sync.Mutex
-}
+// addRoute adds a route for cidr to the interface, or via the gateway if
+// one is given, with the route command
+func addRoute(ctx context.Context, cidr, interfaceName, gateway string) error {
+	dest, err := routeDestination(cidr)
+	if err != nil {
+		return &RouteError{Op: "add", CIDR: cidr, Interface: interfaceName, Gateway: gateway, Err: fmt.Errorf("%w: %w", ErrInvalidCIDR, err)}
+	}
 
-// NewRouter creates a new router instance
-func NewRouter() *Router {
-	return &Router{
-		routes: make(map[string]string),
+	// Execute: route add -net <network> -netmask <mask> -interface <interface>
+	// or, via a gateway: route add -net <network> -netmask <mask> <gateway>
+	// (route add -inet6 -net <cidr> ... for IPv6)
+	args := append([]string{"add"}, dest...)
+	if gateway != "" {
+		args = append(args, gateway)
+	} else {
+		args = append(args, "-interface", interfaceName)
+	}
+	output, err := runRoute(ctx, args...)
+	if err != nil {
+		routeErr := routeCommandError(ctx, "add", cidr, interfaceName, output, err)
+		routeErr.Gateway = gateway
+		return routeErr
 	}
+	return nil
 }
 
-// AddRoute adds a route for the specified CIDR block to the given interface
-func (r *Router) AddRoute(cidr, interfaceName string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// Parse CIDR to get network and netmask
-	network, netmask, err := parseCIDR(cidr)
+// deleteRoute removes the route for cidr with the route command
+func deleteRoute(ctx context.Context, cidr, interfaceName string) error {
+	dest, err := routeDestination(cidr)
 	if err != nil {
-		return fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+		return &RouteError{Op: "delete", CIDR: cidr, Interface: interfaceName, Err: fmt.Errorf("%w: %w", ErrInvalidCIDR, err)}
 	}
 
-	// Execute: route add -net <network> -netmask <mask> -interface <interface>
-	cmd := exec.Command("route", "add", "-net", network, "-netmask", netmask, "-interface", interfaceName)
-	output, err := cmd.CombinedOutput()
+	// Execute: route delete -net <network> -netmask <mask>; the privileged
+	// helper only deletes routes to its own devices, named with -interface
+	args := append([]string{"delete"}, dest...)
+	if privileged != nil && interfaceName != "" {
+		args = append(args, "-interface", interfaceName)
+	}
+	output, err := runRoute(ctx, args...)
 	if err != nil {
-		return fmt.Errorf("failed to add route: %s: %w", string(output), err)
+		return routeCommandError(ctx, "delete", cidr, interfaceName, output, err)
 	}
-
-	// Track this route for cleanup
-	r.routes[cidr] = interfaceName
-
 	return nil
 }
 
-// DeleteRoute removes a route for the specified CIDR block
-func (r *Router) DeleteRoute(cidr string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// routeDestination returns the route command arguments selecting the
+// network of an IPv4 or IPv6 CIDR block
+func routeDestination(cidr string) ([]string, error) {
+	if isIPv6CIDR(cidr) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, err
+		}
+		return []string{"-inet6", "-net", cidr}, nil
+	}
 
-	// Parse CIDR to get network and netmask
 	network, netmask, err := parseCIDR(cidr)
 	if err != nil {
-		return fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+		return nil, err
 	}
+	return []string{"-net", network, "-netmask", netmask}, nil
+}
 
-	// Execute: route delete -net <network> -netmask <mask>
-	cmd := exec.Command("route", "delete", "-net", network, "-netmask", netmask)
-	output, err := cmd.CombinedOutput()
+// routeExists reports whether the system has any route for the CIDR block
+func routeExists(ctx context.Context, cidr string) (bool, error) {
+	network, _, err := net.ParseCIDR(cidr)
 	if err != nil {
-		// Ignore "not in table" errors as route may already be removed
-		if strings.Contains(string(output), "not in table") {
-			delete(r.routes, cidr)
-			return nil
-		}
-		return fmt.Errorf("failed to delete route: %s: %w", string(output), err)
+		return false, err
+	}
+
+	// Use 'route get' to check if route exists
+	output, err := runRoute(ctx, routeGetArgs(network.String())...)
+	if err != nil {
+		return false, nil // Route doesn't exist
 	}
+	return len(output) > 0, nil
+}
 
-	// Remove from tracking
-	delete(r.routes, cidr)
+// privileged runs the route changes in the helper, if set
+var privileged *helper.Client
 
-	return nil
+// UseHelper has the privileged helper change the routes, for a process not
+// running as root
+func UseHelper(c *helper.Client) {
+	privileged = c
 }
 
-// Cleanup removes all routes managed by this router
-func (r *Router) Cleanup() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// runRoute runs the route command, killing it when ctx is done. Changes go
+// to the privileged helper if set.
+func runRoute(ctx context.Context, args ...string) (string, error) {
+	if privileged != nil && routeVerb(args) != "get" {
+		return privileged.Route(args...)
+	}
+	return routeCommand(ctx, args...)
+}
 
-	var errors []string
+// routeCommand runs route with args, whose command must be add, delete or
+// get, and returns its output
+func routeCommand(ctx context.Context, args ...string) (string, error) {
+	if !slices.Contains([]string{"add", "delete", "get"}, routeVerb(args)) {
+		return "", fmt.Errorf("unsupported route command %q", strings.Join(args, " "))
+	}
+	output, err := exec.CommandContext(ctx, "route", args...).CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
 
-	for cidr := range r.routes {
-		network, netmask, err := parseCIDR(cidr)
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("invalid CIDR %s: %v", cidr, err))
+// ParseInterfaceRoute parses the arguments of a route command adding or
+// deleting the route for a CIDR block to an interface, as addRoute and
+// deleteRoute make them for the privileged helper. Anything else, such as
+// a gateway, -ifscope, a host or default route, is rejected. It returns
+// the command, the CIDR block and the interface.
+func ParseInterfaceRoute(args []string) (verb, cidr, interfaceName string, err error) {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "delete") {
+		return "", "", "", fmt.Errorf("only route add and delete are allowed")
+	}
+	verb = args[0]
+
+	var ipv6 bool
+	var network, netmask string
+	for i := 1; i < len(args); i++ {
+		option := args[i]
+		if option == "-inet6" {
+			ipv6 = true
 			continue
 		}
-
-		cmd := exec.Command("route", "delete", "-net", network, "-netmask", netmask)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			// Ignore "not in table" errors
-			if !strings.Contains(string(output), "not in table") {
-				errors = append(errors, fmt.Sprintf("failed to delete route %s: %s", cidr, string(output)))
-			}
+		if !slices.Contains([]string{"-net", "-netmask", "-interface"}, option) {
+			return "", "", "", fmt.Errorf("route argument %q is not allowed", option)
+		}
+		if i+1 == len(args) {
+			return "", "", "", fmt.Errorf("missing value of %s", option)
+		}
+		i++
+		switch option {
+		case "-net":
+			network = args[i]
+		case "-netmask":
+			netmask = args[i]
+		case "-interface":
+			interfaceName = args[i]
 		}
 	}
-
-	// Clear the tracked routes
-	r.routes = make(map[string]string)
-
-	if len(errors) > 0 {
-		return fmt.Errorf("errors during cleanup: %s", strings.Join(errors, "; "))
+	if network == "" || interfaceName == "" {
+		return "", "", "", fmt.Errorf("a destination network (-net) and -interface are required")
 	}
 
-	return nil
+	var prefix *net.IPNet
+	if ipv6 {
+		if netmask != "" {
+			return "", "", "", fmt.Errorf("-netmask is not allowed with -inet6")
+		}
+		_, prefix, err = net.ParseCIDR(network)
+		if err != nil || prefix.IP.To4() != nil {
+			return "", "", "", fmt.Errorf("invalid IPv6 destination %q", network)
+		}
+	} else {
+		ip := net.ParseIP(network).To4()
+		mask := net.ParseIP(netmask).To4()
+		if ip == nil || mask == nil {
+			return "", "", "", fmt.Errorf("invalid IPv4 destination %q with netmask %q", network, netmask)
+		}
+		ones, bits := net.IPMask(mask).Size()
+		if bits == 0 {
+			return "", "", "", fmt.Errorf("invalid netmask %q", netmask)
+		}
+		prefix = &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	}
+	if ones, _ := prefix.Mask.Size(); ones == 0 {
+		return "", "", "", fmt.Errorf("the default route may not be changed")
+	}
+	return verb, prefix.String(), interfaceName, nil
 }
 
-// ListRoutes returns all routes managed by this router
-func (r *Router) ListRoutes() map[string]string {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// InterfaceRouteCommand adds or deletes (verb) the route for a CIDR block
+// to an interface and returns the output of route
+func InterfaceRouteCommand(ctx context.Context, verb, cidr, interfaceName string) (string, error) {
+	dest, err := routeDestination(cidr)
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{verb}, dest...)
+	return routeCommand(ctx, append(args, "-interface", interfaceName)...)
+}
 
-	// Return a copy to avoid race conditions
-	routes := make(map[string]string, len(r.routes))
-	for k, v := range r.routes {
-		routes[k] = v
+// routeVerb returns the command of route arguments, after its options
+func routeVerb(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
 	}
+	return ""
+}
 
-	return routes
+// routeCommandError classifies a failed route command
+func routeCommandError(ctx context.Context, op, cidr, interfaceName, output string, err error) *RouteError {
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case strings.Contains(output, "File exists"):
+		err = fmt.Errorf("%w: %w", ErrRouteExists, err)
+	case strings.Contains(output, "not in table"):
+		err = fmt.Errorf("%w: %w", ErrRouteNotFound, err)
+	}
+	return &RouteError{Op: op, CIDR: cidr, Interface: interfaceName, Output: output, Err: err}
 }
 
 // parseCIDR converts CIDR notation to network and netmask
@@ -181,20 +278,218 @@ func prefixToNetmask(prefix string) string {
 	return masks[prefix]
 }
 
-// VerifyRoute checks if a route exists in the system routing table
-func (r *Router) VerifyRoute(cidr string) (bool, error) {
-	network, _, err := parseCIDR(cidr)
+// RouteInterface returns the interface the system would use to reach the
+// given destination address (as reported by 'route -n get')
+func RouteInterface(destination string) (string, error) {
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+
+	output, err := runRoute(ctx, routeGetArgs(destination)...)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("route lookup for %s failed: %s: %w", destination, output, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "interface:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "interface:")), nil
+		}
+	}
+
+	return "", fmt.Errorf("no interface found in route lookup for %s", destination)
+}
+
+// RouteNextHop returns the interface and gateway the system would use to
+// reach the given destination address (as reported by 'route -n get')
+func RouteNextHop(destination string) (NextHop, error) {
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+
+	output, err := runRoute(ctx, routeGetArgs(destination)...)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return NextHop{}, fmt.Errorf("route lookup for %s failed: %s: %w", destination, output, err)
+	}
+
+	var hop NextHop
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "interface":
+			hop.Interface = strings.TrimSpace(value)
+		case "gateway":
+			hop.Gateway = strings.TrimSpace(value)
+		}
+	}
+	if hop.Interface == "" {
+		return NextHop{}, fmt.Errorf("no interface found in route lookup for %s", destination)
+	}
+	return hop, nil
+}
+
+// DefaultNextHop returns the interface and gateway of the system's IPv4 or
+// IPv6 default route: the first default entry of 'netstat -rn' not scoped
+// to an interface. ('route -n get default' would report routes such as
+// 0.0.0.0/1 that override it.)
+func DefaultNextHop(ipv6 bool) (NextHop, error) {
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+
+	family := "inet"
+	if ipv6 {
+		family = "inet6"
+	}
+	output, err := exec.CommandContext(ctx, "netstat", "-rn", "-f", family).Output()
+	if err != nil {
+		return NextHop{}, fmt.Errorf("failed to read routing table: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "default" || strings.Contains(fields[2], "I") {
+			continue
+		}
+		hop := NextHop{Interface: fields[3], Gateway: fields[1]}
+		if strings.HasPrefix(hop.Gateway, "link#") {
+			hop.Gateway = ""
+		}
+		return hop, nil
+	}
+	return NextHop{}, fmt.Errorf("no default route")
+}
+
+// routeGetArgs returns the arguments of 'route -n get' for an IPv4 or IPv6
+// destination address
+func routeGetArgs(destination string) []string {
+	if strings.Contains(destination, ":") {
+		return []string{"-n", "get", "-inet6", destination}
+	}
+	return []string{"-n", "get", destination}
+}
+
+// VerifyRouteInterface checks that traffic for the CIDR block is routed
+// through the given interface
+func VerifyRouteInterface(cidr, interfaceName string) (bool, error) {
+	network, _, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return false, err
 	}
 
-	// Use 'route get' to check if route exists
-	cmd := exec.Command("route", "get", network)
-	output, err := cmd.CombinedOutput()
+	iface, err := RouteInterface(network.String())
 	if err != nil {
-		return false, nil // Route doesn't exist
+		return false, nil // No route at all
 	}
 
-	// Check if the output contains our interface
-	return len(output) > 0, nil
+	return iface == interfaceName, nil
+}
+
+// SystemRoutes returns the IPv4 and IPv6 routes of the system routing table
+// (parsed from 'netstat -rn -f inet' and 'netstat -rn -f inet6')
+func SystemRoutes() ([]SystemRoute, error) {
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+
+	var routes []SystemRoute
+	for _, family := range []string{"inet", "inet6"} {
+		output, err := exec.CommandContext(ctx, "netstat", "-rn", "-f", family).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing table: %w", err)
+		}
+
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] == "Destination" || fields[0] == "default" {
+				continue
+			}
+
+			parse := parseNetstatDestination
+			if family == "inet6" {
+				parse = parseNetstat6Destination
+			}
+			dest, err := parse(fields[0])
+			if err != nil {
+				continue
+			}
+
+			routes = append(routes, SystemRoute{
+				Destination: dest,
+				Gateway:     fields[1],
+				Interface:   fields[3],
+			})
+		}
+	}
+
+	return routes, nil
+}
+
+// parseNetstatDestination parses the abbreviated destinations printed by
+// macOS netstat: "10/8", "10.1/16", "192.168.1" (implicit /24) or
+// "192.168.1.5" (host route)
+func parseNetstatDestination(dest string) (*net.IPNet, error) {
+	// Strip scope suffixes such as "%utun3"
+	if i := strings.Index(dest, "%"); i >= 0 {
+		dest = dest[:i]
+	}
+
+	addr, prefix, hasPrefix := strings.Cut(dest, "/")
+	octets := strings.Split(addr, ".")
+	if len(octets) == 0 || len(octets) > 4 {
+		return nil, fmt.Errorf("invalid destination %q", dest)
+	}
+
+	ones := 8 * len(octets)
+	if hasPrefix {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 0 || n > 32 {
+			return nil, fmt.Errorf("invalid prefix in %q", dest)
+		}
+		ones = n
+	}
+
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+
+	ip := net.ParseIP(strings.Join(octets, ".")).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid destination %q", dest)
+	}
+
+	mask := net.CIDRMask(ones, 32)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// parseNetstat6Destination parses the IPv6 destinations printed by macOS
+// netstat: "fd00::/64", "fe80::%utun3/64" or "2001:db8::1" (host route)
+func parseNetstat6Destination(dest string) (*net.IPNet, error) {
+	addr, prefix, hasPrefix := strings.Cut(dest, "/")
+	// Strip scope suffixes such as "%utun3", keeping the prefix
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid destination %q", dest)
+	}
+
+	ones := 128
+	if hasPrefix {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 0 || n > 128 {
+			return nil, fmt.Errorf("invalid prefix in %q", dest)
+		}
+		ones = n
+	}
+
+	mask := net.CIDRMask(ones, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
 }
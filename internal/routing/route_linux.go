@@ -0,0 +1,241 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink requests are answered by the kernel without blocking, so the
+// context is only checked before each operation.
+
+// addRoute adds a route for cidr to the interface, or via the gateway on
+// the interface if one is given, via netlink
+func addRoute(ctx context.Context, cidr, interfaceName, gateway string) error {
+	if err := ctx.Err(); err != nil {
+		return &RouteError{Op: "add", CIDR: cidr, Interface: interfaceName, Gateway: gateway, Err: err}
+	}
+
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return &RouteError{Op: "add", CIDR: cidr, Interface: interfaceName, Gateway: gateway, Err: fmt.Errorf("%w: %w", ErrInvalidCIDR, err)}
+	}
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		return &RouteError{Op: "add", CIDR: cidr, Interface: interfaceName, Gateway: gateway, Err: fmt.Errorf("%w: %w", ErrInterfaceNotFound, err)}
+	}
+
+	// Equivalent of: ip route add <cidr> dev <interface>
+	// or, via a gateway: ip route add <cidr> via <gateway> dev <interface>
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if gateway != "" {
+		route.Gw = net.ParseIP(gateway)
+		route.Scope = netlink.SCOPE_UNIVERSE
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			err = fmt.Errorf("%w: %w", ErrRouteExists, err)
+		}
+		return &RouteError{Op: "add", CIDR: cidr, Interface: interfaceName, Gateway: gateway, Err: err}
+	}
+	return nil
+}
+
+// deleteRoute removes the route for cidr (on interfaceName, if known). A
+// route whose interface is already gone was removed by the kernel with it.
+func deleteRoute(ctx context.Context, cidr, interfaceName string) error {
+	if err := ctx.Err(); err != nil {
+		return &RouteError{Op: "delete", CIDR: cidr, Interface: interfaceName, Err: err}
+	}
+
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return &RouteError{Op: "delete", CIDR: cidr, Interface: interfaceName, Err: fmt.Errorf("%w: %w", ErrInvalidCIDR, err)}
+	}
+
+	// Scope "nowhere" matches routes of any scope, like 'ip route del'
+	route := &netlink.Route{Dst: dst, Scope: netlink.SCOPE_NOWHERE}
+	if interfaceName != "" {
+		if link, err := netlink.LinkByName(interfaceName); err == nil {
+			route.LinkIndex = link.Attrs().Index
+		} else {
+			// The kernel removed the interface and its routes with it
+			return nil
+		}
+	}
+
+	if err := netlink.RouteDel(route); err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			err = fmt.Errorf("%w: %w", ErrRouteNotFound, err)
+		}
+		return &RouteError{Op: "delete", CIDR: cidr, Interface: interfaceName, Err: err}
+	}
+	return nil
+}
+
+// routeExists reports whether the system has any route for the CIDR block
+func routeExists(ctx context.Context, cidr string) (bool, error) {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return false, nil // Route doesn't exist
+	}
+
+	return len(routes) > 0, nil
+}
+
+// RouteInterface returns the interface the system would use to reach the
+// given destination address (as reported by 'ip route get')
+func RouteInterface(destination string) (string, error) {
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return "", fmt.Errorf("invalid destination address %s", destination)
+	}
+
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return "", fmt.Errorf("route lookup for %s failed: %w", destination, err)
+	}
+
+	for _, route := range routes {
+		if name := linkName(route.LinkIndex); name != "" {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no interface found in route lookup for %s", destination)
+}
+
+// RouteNextHop returns the interface and gateway the system would use to
+// reach the given destination address (as reported by 'ip route get')
+func RouteNextHop(destination string) (NextHop, error) {
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return NextHop{}, fmt.Errorf("invalid destination address %s", destination)
+	}
+
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return NextHop{}, fmt.Errorf("route lookup for %s failed: %w", destination, err)
+	}
+
+	for _, route := range routes {
+		if name := linkName(route.LinkIndex); name != "" {
+			hop := NextHop{Interface: name}
+			if route.Gw != nil {
+				hop.Gateway = route.Gw.String()
+			}
+			return hop, nil
+		}
+	}
+
+	return NextHop{}, fmt.Errorf("no interface found in route lookup for %s", destination)
+}
+
+// DefaultNextHop returns the interface and gateway of the system's IPv4 or
+// IPv6 default route of the main table, the one with the lowest metric if
+// there are several
+func DefaultNextHop(ipv6 bool) (NextHop, error) {
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return NextHop{}, fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	var best *netlink.Route
+	for i, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if linkName(route.LinkIndex) == "" {
+			continue
+		}
+		if best == nil || route.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return NextHop{}, fmt.Errorf("no default route")
+	}
+
+	hop := NextHop{Interface: linkName(best.LinkIndex)}
+	if best.Gw != nil {
+		hop.Gateway = best.Gw.String()
+	}
+	return hop, nil
+}
+
+// VerifyRouteInterface checks that traffic for the CIDR block is routed
+// through the given interface
+func VerifyRouteInterface(cidr, interfaceName string) (bool, error) {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	iface, err := RouteInterface(ip.String())
+	if err != nil {
+		return false, nil // No route at all
+	}
+
+	return iface == interfaceName, nil
+}
+
+// SystemRoutes returns the IPv4 and IPv6 routes of the main routing table
+func SystemRoutes() ([]SystemRoute, error) {
+	list, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing table: %w", err)
+	}
+
+	var routes []SystemRoute
+	for _, route := range list {
+		// Skip the default route, like the darwin implementation
+		if route.Dst == nil || route.Dst.IP.IsUnspecified() {
+			continue
+		}
+
+		gateway := "link"
+		if route.Gw != nil {
+			gateway = route.Gw.String()
+		}
+
+		routes = append(routes, SystemRoute{
+			Destination: route.Dst,
+			Gateway:     gateway,
+			Interface:   linkName(route.LinkIndex),
+		})
+	}
+
+	return routes, nil
+}
+
+// linkName returns the name of the interface with the given index, or ""
+func linkName(index int) string {
+	if index == 0 {
+		return ""
+	}
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return ""
+	}
+	return link.Attrs().Name
+}
@@ -0,0 +1,286 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds a single routing table operation when the context
+// has no deadline of its own
+const DefaultTimeout = 10 * time.Second
+
+// Errors wrapped by RouteError, for use with errors.Is
+var (
+	ErrInvalidCIDR       = errors.New("invalid CIDR")
+	ErrRouteExists       = errors.New("route already exists")
+	ErrRouteNotFound     = errors.New("route not found")
+	ErrInterfaceNotFound = errors.New("interface not found")
+)
+
+// RouteError describes a failed routing table operation. A timed out or
+// cancelled operation wraps the context error.
+type RouteError struct {
+	Op        string // "add", "delete" or "get"
+	CIDR      string
+	Interface string // may be empty
+	Gateway   string // next-hop address, empty for interface-scoped routes
+	Output    string // output of the route command, if any
+	Err       error
+}
+
+// Error describes the failed operation
+func (e *RouteError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to %s route %s", e.Op, e.CIDR)
+	if e.Gateway != "" {
+		fmt.Fprintf(&b, " via %s", e.Gateway)
+	}
+	if e.Interface != "" {
+		fmt.Fprintf(&b, " on %s", e.Interface)
+	}
+	if e.Output != "" {
+		fmt.Fprintf(&b, ": %s", e.Output)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	return b.String()
+}
+
+// Unwrap returns the underlying error
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// RouteResult is the outcome of a bulk operation for one CIDR block
+type RouteResult struct {
+	CIDR string
+	Err  error
+}
+
+// RouteResults are the per-route outcomes of a bulk operation
+type RouteResults []RouteResult
+
+// Succeeded returns the CIDR blocks the operation succeeded for
+func (rs RouteResults) Succeeded() []string {
+	var cidrs []string
+	for _, r := range rs {
+		if r.Err == nil {
+			cidrs = append(cidrs, r.CIDR)
+		}
+	}
+	return cidrs
+}
+
+// Failed returns the results of the routes the operation failed for
+func (rs RouteResults) Failed() RouteResults {
+	var failed RouteResults
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Err joins the errors of all failed routes, or returns nil
+func (rs RouteResults) Err() error {
+	var errs []error
+	for _, r := range rs.Failed() {
+		errs = append(errs, r.Err)
+	}
+	return errors.Join(errs...)
+}
+
+// Router manages the routing table entries added by ssm-proxy. The mutex
+// only guards the set of tracked routes; it is never held while the routing
+// table is changed, so a slow operation does not block the others.
+type Router struct {
+	routes    map[string]string // CIDR -> interface mapping
+	gateway   string            // next hop for all routes, empty for interface routes
+	overrides map[string]string // CIDR -> gateway or ViaInterface
+	mu        sync.Mutex
+}
+
+// NewRouter creates a new router instance
+func NewRouter() *Router {
+	return &Router{
+		routes:    make(map[string]string),
+		overrides: make(map[string]string),
+	}
+}
+
+// AddRoute adds a route for the specified CIDR block to the given interface
+func (r *Router) AddRoute(cidr, interfaceName string) error {
+	return r.AddRouteContext(context.Background(), cidr, interfaceName)
+}
+
+// AddRouteContext adds a route for the specified CIDR block to the given
+// interface (via the gateway, if one applies to the CIDR block), giving up
+// when ctx is done (or after DefaultTimeout)
+func (r *Router) AddRouteContext(ctx context.Context, cidr, interfaceName string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	if err := addRoute(ctx, cidr, interfaceName, r.Gateway(cidr)); err != nil {
+		return err
+	}
+
+	// Track this route for cleanup
+	r.mu.Lock()
+	r.routes[cidr] = interfaceName
+	r.mu.Unlock()
+	return nil
+}
+
+// AdoptRouteContext replaces the route for a CIDR block left by someone
+// else, e.g. a session whose process died, with one to the given interface
+// and tracks it like an added route
+func (r *Router) AdoptRouteContext(ctx context.Context, cidr, interfaceName string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	if err := deleteRoute(ctx, cidr, ""); err != nil && !errors.Is(err, ErrRouteNotFound) {
+		return err
+	}
+	return r.AddRouteContext(ctx, cidr, interfaceName)
+}
+
+// DeleteRoute removes a route for the specified CIDR block
+func (r *Router) DeleteRoute(cidr string) error {
+	return r.DeleteRouteContext(context.Background(), cidr)
+}
+
+// DeleteRouteContext removes a route for the specified CIDR block, giving up
+// when ctx is done (or after DefaultTimeout). A route that no longer
+// exists is not an error.
+func (r *Router) DeleteRouteContext(ctx context.Context, cidr string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	r.mu.Lock()
+	interfaceName := r.routes[cidr]
+	r.mu.Unlock()
+
+	if err := deleteRoute(ctx, cidr, interfaceName); err != nil && !errors.Is(err, ErrRouteNotFound) {
+		return err
+	}
+
+	// Remove from tracking
+	r.mu.Lock()
+	delete(r.routes, cidr)
+	r.mu.Unlock()
+	return nil
+}
+
+// DeleteSystemRoute removes a route of the system routing table that no
+// Router tracks, such as one left by a process that died. A route that no
+// longer exists is not an error.
+func DeleteSystemRoute(ctx context.Context, cidr, interfaceName string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	if err := deleteRoute(ctx, cidr, interfaceName); err != nil && !errors.Is(err, ErrRouteNotFound) {
+		return err
+	}
+	return nil
+}
+
+// AddRoutes adds a route for each CIDR block to the given interface. It
+// continues past failures and reports the outcome for every route, so the
+// caller can decide whether to roll back the ones that were added.
+func (r *Router) AddRoutes(ctx context.Context, cidrs []string, interfaceName string) RouteResults {
+	results := make(RouteResults, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		results = append(results, RouteResult{CIDR: cidr, Err: r.AddRouteContext(ctx, cidr, interfaceName)})
+	}
+	return results
+}
+
+// DeleteRoutes removes the route for each CIDR block, continuing past
+// failures, and reports the outcome for every route
+func (r *Router) DeleteRoutes(ctx context.Context, cidrs []string) RouteResults {
+	results := make(RouteResults, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		results = append(results, RouteResult{CIDR: cidr, Err: r.DeleteRouteContext(ctx, cidr)})
+	}
+	return results
+}
+
+// Cleanup removes all routes managed by this router
+func (r *Router) Cleanup() error {
+	return r.CleanupContext(context.Background())
+}
+
+// CleanupContext removes all routes managed by this router. Routes that
+// could not be removed are forgotten as well, so Cleanup is not retried.
+func (r *Router) CleanupContext(ctx context.Context) error {
+	routes := r.ListRoutes()
+
+	cidrs := make([]string, 0, len(routes))
+	for cidr := range routes {
+		cidrs = append(cidrs, cidr)
+	}
+	results := r.DeleteRoutes(ctx, cidrs)
+
+	// Clear the tracked routes
+	r.mu.Lock()
+	for _, cidr := range cidrs {
+		delete(r.routes, cidr)
+	}
+	r.mu.Unlock()
+
+	if failed := results.Failed(); len(failed) > 0 {
+		var errs []string
+		for _, f := range failed {
+			errs = append(errs, f.Err.Error())
+		}
+		return fmt.Errorf("errors during cleanup: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ListRoutes returns all routes managed by this router
+func (r *Router) ListRoutes() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Return a copy to avoid race conditions
+	routes := make(map[string]string, len(r.routes))
+	for k, v := range r.routes {
+		routes[k] = v
+	}
+
+	return routes
+}
+
+// VerifyRoute checks if a route exists in the system routing table. For a
+// route added by this router, it checks that traffic for the CIDR block
+// still goes through the interface the route was added to.
+func (r *Router) VerifyRoute(cidr string) (bool, error) {
+	r.mu.Lock()
+	iface, tracked := r.routes[cidr]
+	r.mu.Unlock()
+	if tracked {
+		return VerifyRouteInterface(cidr, iface)
+	}
+
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+	return routeExists(ctx, cidr)
+}
+
+// withTimeout applies DefaultTimeout to ctx unless it has a deadline
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultTimeout)
+}
+
+// isIPv6CIDR reports whether cidr is an IPv6 CIDR block
+func isIPv6CIDR(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
@@ -2,155 +2,311 @@ package session
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/store"
 )
 
+// ErrSessionExists is returned when a session name is already in use
+var ErrSessionExists = errors.New("session already exists")
+
+// maxAutoSuffix bounds the number of suffixed names tried by CreateUnique
+const maxAutoSuffix = 100
+
+// validName matches filesystem-safe session names
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
 // Session represents an active SSM proxy session
 type Session struct {
+	ID         int64     `json:"id,omitempty"`
 	Name       string    `json:"name"`
 	InstanceID string    `json:"instance_id"`
 	SessionID  string    `json:"session_id"`
+	Region     string    `json:"region,omitempty"`   // "" for the default region
+	RoleARN    string    `json:"role_arn,omitempty"` // role assumed for the session
 	TunDevice  string    `json:"tun_device"`
 	TunIP      string    `json:"tun_ip"`
+	SOCKSAddr  string    `json:"socks_addr,omitempty"`
 	CIDRBlocks []string  `json:"cidr_blocks"`
+	Routes     []string  `json:"routes,omitempty"` // installed routes, if different from CIDRBlocks
 	StartedAt  time.Time `json:"started_at"`
 	PID        int       `json:"pid"`
+
+	// Health as last reported by the owning process
+	TunnelUp        bool          `json:"tunnel_up"`
+	HealthCheckedAt time.Time     `json:"health_checked_at"`
+	HealthError     string        `json:"health_error,omitempty"` // failed layer and reason
+	HealthInterval  time.Duration `json:"health_interval,omitempty"`
+
+	// Route and DNS configuration drift seen by the health monitor
+	Drift DriftCounts `json:"drift"`
+}
+
+// DriftCounts counts routes and DNS resolver configuration found changed
+// behind the session's back, and how many of those were repaired
+type DriftCounts struct {
+	RoutesDrifted  int `json:"routes_drifted"`
+	RoutesRepaired int `json:"routes_repaired"`
+	DNSDrifted     int `json:"dns_drifted"`
+	DNSRepaired    int `json:"dns_repaired"`
+}
+
+// Any reports whether any drift was seen
+func (d DriftCounts) Any() bool {
+	return d.RoutesDrifted > 0 || d.DNSDrifted > 0
 }
 
-// Manager manages session state persistence
+// Manager manages session state persistence in the SQLite state store
 type Manager struct {
-	stateDir string
-	mu       sync.RWMutex
+	dbPath    string
+	legacyDir string
+	store     *store.Store
+	openErr   error
+	once      sync.Once
+	mu        sync.Mutex
 }
 
-// NewManager creates a new session manager
+// NewManager creates a new session manager backed by the default state store
 func NewManager() *Manager {
 	return &Manager{
-		stateDir: getStateDir(),
+		dbPath:    store.DefaultPath(),
+		legacyDir: getLegacyStateDir(),
 	}
 }
 
-// Save saves a session to disk
-func (m *Manager) Save(sess *Session) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// Store returns the underlying state store, opening it on first use
+func (m *Manager) Store() (*store.Store, error) {
+	m.once.Do(func() {
+		m.store, m.openErr = store.Open(m.dbPath)
+		if m.openErr == nil {
+			m.importLegacySessions()
+		}
+	})
+	return m.store, m.openErr
+}
 
-	// Ensure state directory exists
-	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
-		return fmt.Errorf("failed to create state directory: %w", err)
+// Close closes the underlying state store
+func (m *Manager) Close() error {
+	if m.store != nil {
+		return m.store.Close()
 	}
+	return nil
+}
 
-	// Serialize session to JSON
-	data, err := json.MarshalIndent(sess, "", "  ")
+// Save persists a session. Sessions that were created through Create or
+// CreateUnique are updated in place; otherwise any active session with the
+// same name is ended (as "replaced") and a new record is inserted.
+func (m *Manager) Save(sess *Session) error {
+	st, err := m.Store()
 	if err != nil {
-		return fmt.Errorf("failed to marshal session: %w", err)
+		return err
 	}
 
-	// Write to file
-	filename := filepath.Join(m.stateDir, sess.Name+".json")
-	if err := os.WriteFile(filename, data, 0600); err != nil {
-		return fmt.Errorf("failed to write session file: %w", err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := toRecord(sess)
+	if sess.ID != 0 {
+		return st.UpdateSession(rec)
 	}
 
+	if err := st.EndActiveSession(sess.Name, time.Now(), "replaced"); err != nil {
+		return err
+	}
+	if err := st.InsertSession(rec); err != nil {
+		return err
+	}
+	sess.ID = rec.ID
 	return nil
 }
 
-// Get retrieves a session by name
-func (m *Manager) Get(name string) (*Session, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	filename := filepath.Join(m.stateDir, name+".json")
+// Create atomically registers a new session, failing with ErrSessionExists
+// if an active session with the same name is already registered
+func (m *Manager) Create(sess *Session) error {
+	if err := ValidateName(sess.Name); err != nil {
+		return err
+	}
 
-	// Read file
-	data, err := os.ReadFile(filename)
+	st, err := m.Store()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("session not found: %s", name)
-		}
-		return nil, fmt.Errorf("failed to read session file: %w", err)
+		return err
 	}
 
-	// Deserialize
-	var sess Session
-	if err := json.Unmarshal(data, &sess); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
-	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return &sess, nil
+	return m.insertLocked(st, sess)
 }
 
-// ListAll lists all active sessions
-func (m *Manager) ListAll() ([]*Session, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	// Ensure state directory exists
-	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create state directory: %w", err)
+// CreateUnique registers a new session, appending a numeric suffix to the
+// name ("-2", "-3", ...) until an unused name is found. The chosen name is
+// stored back into sess.Name.
+func (m *Manager) CreateUnique(sess *Session) error {
+	if err := ValidateName(sess.Name); err != nil {
+		return err
 	}
 
-	// Read directory
-	entries, err := os.ReadDir(m.stateDir)
+	st, err := m.Store()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read state directory: %w", err)
+		return err
 	}
 
-	var sessions []*Session
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	base := sess.Name
+	for i := 1; i <= maxAutoSuffix; i++ {
+		if i > 1 {
+			sess.Name = fmt.Sprintf("%s-%d", base, i)
 		}
 
-		// Skip non-JSON files
-		if filepath.Ext(entry.Name()) != ".json" {
-			continue
+		err := m.insertLocked(st, sess)
+		if err == nil {
+			return nil
 		}
+		if !errors.Is(err, ErrSessionExists) {
+			return err
+		}
+	}
 
-		// Read and parse session file
-		filename := filepath.Join(m.stateDir, entry.Name())
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			continue // Skip files we can't read
+	sess.Name = base
+	return fmt.Errorf("could not find a free session name based on %s: %w", base, ErrSessionExists)
+}
+
+// insertLocked inserts the session, relying on the store's unique index on
+// active names so concurrent starts cannot claim the same name.
+// Caller must hold m.mu.
+func (m *Manager) insertLocked(st *store.Store, sess *Session) error {
+	rec := toRecord(sess)
+	if err := st.InsertSession(rec); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return fmt.Errorf("%w: %s", ErrSessionExists, sess.Name)
 		}
+		return err
+	}
+	sess.ID = rec.ID
+	return nil
+}
 
-		var sess Session
-		if err := json.Unmarshal(data, &sess); err != nil {
-			continue // Skip files we can't parse
+// Get retrieves an active session by name
+func (m *Manager) Get(name string) (*Session, error) {
+	st, err := m.Store()
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := st.ActiveSession(name)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, fmt.Errorf("session not found: %s", name)
 		}
+		return nil, err
+	}
 
-		sessions = append(sessions, &sess)
+	return fromRecord(rec), nil
+}
+
+// ListAll lists all active sessions, most recent first
+func (m *Manager) ListAll() ([]*Session, error) {
+	st, err := m.Store()
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort by start time (most recent first)
-	sortSessionsByStartTime(sessions)
+	records, err := st.ActiveSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(records))
+	for _, rec := range records {
+		sessions = append(sessions, fromRecord(rec))
+	}
 
 	return sessions, nil
 }
 
-// Remove removes a session from disk
+// Remove marks a session as ended. The record is kept for history.
 func (m *Manager) Remove(name string) error {
+	return m.End(name, "stopped")
+}
+
+// End marks the active session with the given name as ended with a reason
+func (m *Manager) End(name, reason string) error {
+	st, err := m.Store()
+	if err != nil {
+		return err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	filename := filepath.Join(m.stateDir, name+".json")
+	return st.EndActiveSession(name, time.Now(), reason)
+}
 
-	// Remove file
-	if err := os.Remove(filename); err != nil {
-		if os.IsNotExist(err) {
-			return nil // Already removed
-		}
-		return fmt.Errorf("failed to remove session file: %w", err)
+// RecordTraffic stores the latest traffic totals of a session
+func (m *Manager) RecordTraffic(sess *Session, packetsTX, packetsRX, bytesTX, bytesRX uint64) error {
+	if sess.ID == 0 {
+		return fmt.Errorf("session %s has not been saved", sess.Name)
 	}
 
+	st, err := m.Store()
+	if err != nil {
+		return err
+	}
+
+	return st.UpdateTraffic(sess.ID, packetsTX, packetsRX, bytesTX, bytesRX)
+}
+
+// RecordHealth stores the tunnel health observed by the owning process.
+// healthError describes the failed check, "" if the tunnel is healthy.
+func (m *Manager) RecordHealth(sess *Session, tunnelUp bool, healthError string) error {
+	if sess.ID == 0 {
+		return fmt.Errorf("session %s has not been saved", sess.Name)
+	}
+
+	st, err := m.Store()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := st.UpdateHealth(sess.ID, tunnelUp, healthError, now); err != nil {
+		return err
+	}
+	sess.TunnelUp = tunnelUp
+	sess.HealthError = healthError
+	sess.HealthCheckedAt = now
+	return nil
+}
+
+// RecordDrift stores the configuration drift counts observed by the owning
+// process
+func (m *Manager) RecordDrift(sess *Session, drift DriftCounts) error {
+	if sess.ID == 0 {
+		return fmt.Errorf("session %s has not been saved", sess.Name)
+	}
+
+	st, err := m.Store()
+	if err != nil {
+		return err
+	}
+
+	if err := st.UpdateDrift(sess.ID, store.DriftCounts(drift)); err != nil {
+		return err
+	}
+	sess.Drift = drift
 	return nil
 }
 
-// RemoveStale removes sessions for processes that are no longer running
+// RemoveStale ends sessions for processes that are no longer running
 func (m *Manager) RemoveStale() ([]string, error) {
 	sessions, err := m.ListAll()
 	if err != nil {
@@ -161,7 +317,7 @@ func (m *Manager) RemoveStale() ([]string, error) {
 	for _, sess := range sessions {
 		// Check if process is still running
 		if !isProcessRunning(sess.PID) {
-			if err := m.Remove(sess.Name); err == nil {
+			if err := m.End(sess.Name, "stale"); err == nil {
 				removed = append(removed, sess.Name)
 			}
 		}
@@ -170,10 +326,9 @@ func (m *Manager) RemoveStale() ([]string, error) {
 	return removed, nil
 }
 
-// Exists checks if a session exists
+// Exists checks if an active session exists
 func (m *Manager) Exists(name string) bool {
-	filename := filepath.Join(m.stateDir, name+".json")
-	_, err := os.Stat(filename)
+	_, err := m.Get(name)
 	return err == nil
 }
 
@@ -186,12 +341,147 @@ func (m *Manager) Count() (int, error) {
 	return len(sessions), nil
 }
 
-// getStateDir returns the directory where session state is stored
-func getStateDir() string {
-	// Try to use ~/.ssm-proxy/sessions
+// importLegacySessions moves session JSON files written by older versions
+// into the state store so that upgrading does not orphan running sessions
+func (m *Manager) importLegacySessions() {
+	entries, err := os.ReadDir(m.legacyDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		filename := filepath.Join(m.legacyDir, entry.Name())
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			continue // Skip files we can't read
+		}
+
+		var sess Session
+		if err := json.Unmarshal(data, &sess); err != nil {
+			continue // Skip files we can't parse
+		}
+
+		rec := toRecord(&sess)
+		if err := m.store.InsertSession(rec); err != nil && !errors.Is(err, store.ErrConflict) {
+			continue
+		}
+		os.Remove(filename)
+	}
+
+	// Remove the legacy directory once it is empty (best effort)
+	os.Remove(m.legacyDir)
+}
+
+// LegacyFiles returns the session JSON files of older versions that could
+// not be imported into the state store: unreadable ones, or ones whose
+// session name was taken
+func (m *Manager) LegacyFiles() []string {
+	entries, err := os.ReadDir(m.legacyDir)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			files = append(files, filepath.Join(m.legacyDir, entry.Name()))
+		}
+	}
+	return files
+}
+
+// RemoveLegacyFile removes a session JSON file of an older version, and
+// the legacy directory once it is empty
+func (m *Manager) RemoveLegacyFile(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", filename, err)
+	}
+	os.Remove(m.legacyDir)
+	return nil
+}
+
+// toRecord converts a Session to a store record
+func toRecord(sess *Session) *store.SessionRecord {
+	return &store.SessionRecord{
+		ID:         sess.ID,
+		Name:       sess.Name,
+		InstanceID: sess.InstanceID,
+		SessionID:  sess.SessionID,
+		Region:     sess.Region,
+		RoleARN:    sess.RoleARN,
+		TunDevice:  sess.TunDevice,
+		TunIP:      sess.TunIP,
+		SOCKSAddr:  sess.SOCKSAddr,
+		CIDRBlocks: sess.CIDRBlocks,
+		Routes:     sess.Routes,
+		PID:        sess.PID,
+		StartedAt:  sess.StartedAt,
+
+		HealthInterval: sess.HealthInterval,
+	}
+}
+
+// fromRecord converts a store record to a Session
+func fromRecord(rec *store.SessionRecord) *Session {
+	return &Session{
+		ID:         rec.ID,
+		Name:       rec.Name,
+		InstanceID: rec.InstanceID,
+		SessionID:  rec.SessionID,
+		Region:     rec.Region,
+		RoleARN:    rec.RoleARN,
+		TunDevice:  rec.TunDevice,
+		TunIP:      rec.TunIP,
+		SOCKSAddr:  rec.SOCKSAddr,
+		CIDRBlocks: rec.CIDRBlocks,
+		Routes:     rec.Routes,
+		StartedAt:  rec.StartedAt,
+		PID:        rec.PID,
+
+		TunnelUp:        rec.TunnelUp,
+		HealthCheckedAt: rec.HealthCheckedAt,
+		HealthError:     rec.HealthError,
+		HealthInterval:  rec.HealthInterval,
+		Drift:           DriftCounts(rec.Drift),
+	}
+}
+
+// InstalledRoutes returns the routes installed for the session: Routes if
+// recorded, otherwise the requested CIDR blocks
+func (s *Session) InstalledRoutes() []string {
+	if len(s.Routes) > 0 {
+		return s.Routes
+	}
+	return s.CIDRBlocks
+}
+
+// ValidateName checks that a session name is safe to use as a file name.
+// Names must start with a letter or digit, contain only letters, digits,
+// '.', '_' or '-', and be at most 64 characters long.
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("session name must not be empty")
+	}
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid session name %q: use up to 64 letters, digits, '.', '_' or '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// IsRunning reports whether the process owning the session is still alive
+func (s *Session) IsRunning() bool {
+	return isProcessRunning(s.PID)
+}
+
+// getLegacyStateDir returns the directory where older versions stored
+// session JSON files
+func getLegacyStateDir() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
-		// Fallback to /tmp if can't get home dir
 		return "/tmp/ssm-proxy/sessions"
 	}
 
@@ -211,19 +501,6 @@ func isProcessRunning(pid int) bool {
 
 	// Send signal 0 to check if process exists
 	// This doesn't actually send a signal, just checks if we can
-	err = process.Signal(os.Signal(nil))
-	return err == nil
-}
-
-// sortSessionsByStartTime sorts sessions by start time (most recent first)
-func sortSessionsByStartTime(sessions []*Session) {
-	// Simple bubble sort (fine for small number of sessions)
-	n := len(sessions)
-	for i := 0; i < n-1; i++ {
-		for j := 0; j < n-i-1; j++ {
-			if sessions[j].StartedAt.Before(sessions[j+1].StartedAt) {
-				sessions[j], sessions[j+1] = sessions[j+1], sessions[j]
-			}
-		}
-	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
 }
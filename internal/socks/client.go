@@ -0,0 +1,35 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dial connects to addr (host:port) through the SOCKS5 proxy at proxyAddr.
+// The proxy connection itself is returned, so it can be half-closed.
+func Dial(ctx context.Context, proxyAddr, addr string) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+	}
+	d, ok := dialer.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+	})
+	if !ok {
+		return dialer.Dial("tcp", addr)
+	}
+
+	var netDialer net.Dialer
+	conn, err := netDialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	if _, err := d.DialWithConn(ctx, conn, "tcp", addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,241 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/connset"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	version5 = 0x05
+
+	authNone         = 0x00
+	authNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySucceeded          = 0x00
+	replyGeneralFailure     = 0x01
+	replyNetworkUnreachable = 0x03
+	replyHostUnreachable    = 0x04
+	replyConnectionRefused  = 0x05
+	replyCommandUnsupported = 0x07
+	replyAddressUnsupported = 0x08
+)
+
+// DefaultHandshakeTimeout bounds the greeting and request of a client
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Server is a SOCKS5 server supporting the CONNECT command without
+// authentication, like OpenSSH's dynamic forwarding (ssh -D). Other
+// commands, such as UDP ASSOCIATE, are refused.
+type Server struct {
+	// Dial opens the connection to a requested destination (host:port)
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// HandshakeTimeout bounds reading a client's greeting and request
+	// (DefaultHandshakeTimeout if zero)
+	HandshakeTimeout time.Duration
+
+	conns connset.Set
+}
+
+// Serve accepts and serves clients until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept SOCKS5 client: %w", err)
+		}
+
+		if !s.conns.Track(conn) {
+			conn.Close()
+			return nil
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes all connections and waits until they are released by their
+// handlers. The listener passed to Serve must be closed separately.
+func (s *Server) Close() {
+	s.conns.Close()
+}
+
+// serveConn handles one client: handshake, CONNECT, then relaying
+func (s *Server) serveConn(client net.Conn) {
+	defer s.conns.Untrack(client)
+
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	client.SetDeadline(time.Now().Add(timeout))
+
+	addr, err := handshake(client)
+	if err != nil {
+		log.Debugf("SOCKS5 handshake from %s failed: %v", client.RemoteAddr(), err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	remote, err := s.Dial(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		log.Debugf("SOCKS5 connect to %s failed: %v", addr, err)
+		writeReply(client, dialErrorReply(err))
+		return
+	}
+	if !s.conns.Track(remote) {
+		remote.Close()
+		return
+	}
+	defer s.conns.Untrack(remote)
+
+	if err := writeReply(client, replySucceeded); err != nil {
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	Relay(client, remote)
+}
+
+// handshake reads the client's greeting and CONNECT request and returns the
+// requested destination. Unsupported requests are answered with an error
+// reply.
+func handshake(conn net.Conn) (string, error) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, authNone) < 0 {
+		conn.Write([]byte{version5, authNoAcceptable})
+		return "", fmt.Errorf("client does not offer unauthenticated access")
+	}
+	if _, err := conn.Write([]byte{version5, authNone}); err != nil {
+		return "", err
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch request[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if request[3] == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeReply(conn, replyAddressUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	if request[1] != cmdConnect {
+		writeReply(conn, replyCommandUnsupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeReply sends a reply with an unspecified bound address
+func writeReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{version5, reply, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// dialErrorReply maps a dial error to the closest SOCKS5 reply, so clients
+// can tell a refused connection from an unreachable host
+func dialErrorReply(err error) byte {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "refused"):
+		return replyConnectionRefused
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "host is unreachable"):
+		return replyHostUnreachable
+	case strings.Contains(msg, "network is unreachable"):
+		return replyNetworkUnreachable
+	}
+	return replyGeneralFailure
+}
+
+// Relay copies data in both directions until both are closed, passing an
+// EOF on as a half-close
+func Relay(client, remote net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(remote, client)
+		closeWrite(remote)
+	}()
+
+	io.Copy(client, remote)
+	closeWrite(client)
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, or closes it if it
+// cannot be half-closed
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// SetLogger sets the logger of the SOCKS5 servers
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+}
@@ -0,0 +1,200 @@
+package ssm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The data channel of a session carries AgentMessages, the binary messages
+// ssm-agent and session-manager-plugin exchange. Integers are big-endian:
+//
+//	offset  size  field
+//	     0     4  HeaderLength (116, the offset of PayloadLength)
+//	     4    32  MessageType, padded with spaces
+//	    36     4  SchemaVersion
+//	    40     8  CreatedDate, milliseconds since the epoch
+//	    48     8  SequenceNumber
+//	    56     8  Flags
+//	    64    16  MessageId, a UUID with its two halves swapped
+//	    80    32  PayloadDigest, the SHA-256 of Payload
+//	   112     4  PayloadType
+//	   116     4  PayloadLength
+//	   120     n  Payload
+const (
+	messageTypeOffset    = 4
+	messageTypeLength    = 32
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIDOffset      = 64
+	payloadDigestOffset  = 80
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+	payloadOffset        = 120
+
+	// agentMessageSchemaVersion is the SchemaVersion of the messages sent
+	agentMessageSchemaVersion = 1
+)
+
+// Payload types of stream data messages
+const (
+	PayloadTypeOutput               uint32 = 1
+	PayloadTypeError                uint32 = 2
+	PayloadTypeSize                 uint32 = 3
+	PayloadTypeParameter            uint32 = 4
+	PayloadTypeHandshakeRequest     uint32 = 5
+	PayloadTypeHandshakeResponse    uint32 = 6
+	PayloadTypeHandshakeComplete    uint32 = 7
+	PayloadTypeEncChallengeRequest  uint32 = 8
+	PayloadTypeEncChallengeResponse uint32 = 9
+	PayloadTypeFlag                 uint32 = 10
+	PayloadTypeStdErr               uint32 = 11
+	PayloadTypeExitCode             uint32 = 12
+)
+
+// Message flags
+const (
+	FlagData uint64 = 0
+	FlagSYN  uint64 = 1
+	FlagFIN  uint64 = 2
+	FlagACK  uint64 = 3
+)
+
+// payloadTypeNames names the payload types in message descriptions
+var payloadTypeNames = map[uint32]string{
+	PayloadTypeOutput:               "output",
+	PayloadTypeError:                "error",
+	PayloadTypeSize:                 "size",
+	PayloadTypeParameter:            "parameter",
+	PayloadTypeHandshakeRequest:     "handshake_request",
+	PayloadTypeHandshakeResponse:    "handshake_response",
+	PayloadTypeHandshakeComplete:    "handshake_complete",
+	PayloadTypeEncChallengeRequest:  "enc_challenge_request",
+	PayloadTypeEncChallengeResponse: "enc_challenge_response",
+	PayloadTypeFlag:                 "flag",
+	PayloadTypeStdErr:               "stderr",
+	PayloadTypeExitCode:             "exit_code",
+}
+
+// AgentMessage is a message of the Session Manager data channel
+type AgentMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      uuid.UUID
+	PayloadType    uint32
+	Payload        []byte
+}
+
+// newAgentMessage creates a message of type messageType with a new ID
+func newAgentMessage(messageType string, seq int64, flags uint64, payloadType uint32, payload []byte) *AgentMessage {
+	return &AgentMessage{
+		MessageType:    messageType,
+		SchemaVersion:  agentMessageSchemaVersion,
+		CreatedDate:    time.Now(),
+		SequenceNumber: seq,
+		Flags:          flags,
+		MessageID:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+}
+
+// MarshalBinary encodes the message, computing its payload digest
+func (m *AgentMessage) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("message type %q too long", m.MessageType)
+	}
+
+	buf := make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(buf, payloadLengthOffset)
+	copy(buf[messageTypeOffset:], m.MessageType)
+	for i := messageTypeOffset + len(m.MessageType); i < schemaVersionOffset; i++ {
+		buf[i] = ' '
+	}
+	binary.BigEndian.PutUint32(buf[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(buf[createdDateOffset:], uint64(m.CreatedDate.UnixMilli()))
+	binary.BigEndian.PutUint64(buf[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[flagsOffset:], m.Flags)
+	putMessageID(buf[messageIDOffset:], m.MessageID)
+	digest := sha256.Sum256(m.Payload)
+	copy(buf[payloadDigestOffset:], digest[:])
+	binary.BigEndian.PutUint32(buf[payloadTypeOffset:], m.PayloadType)
+	binary.BigEndian.PutUint32(buf[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(buf[payloadOffset:], m.Payload)
+	return buf, nil
+}
+
+// ParseAgentMessage decodes a message of the data channel and checks its
+// payload against the digest
+func ParseAgentMessage(data []byte) (*AgentMessage, error) {
+	if len(data) < payloadOffset {
+		return nil, fmt.Errorf("message too short: %d bytes", len(data))
+	}
+
+	// PayloadLength follows the header, wherever a later schema ends it
+	headerLength := int(binary.BigEndian.Uint32(data))
+	if headerLength < payloadTypeOffset+4 || headerLength+4 > len(data) {
+		return nil, fmt.Errorf("invalid header length: %d", headerLength)
+	}
+	payloadLength := int(binary.BigEndian.Uint32(data[headerLength:]))
+	start := headerLength + 4
+	if payloadLength > len(data)-start {
+		return nil, fmt.Errorf("payload length %d exceeds the message (%d bytes)", payloadLength, len(data)-start)
+	}
+
+	m := &AgentMessage{
+		MessageType:    strings.TrimRight(string(data[messageTypeOffset:schemaVersionOffset]), " \x00"),
+		SchemaVersion:  binary.BigEndian.Uint32(data[schemaVersionOffset:]),
+		CreatedDate:    time.UnixMilli(int64(binary.BigEndian.Uint64(data[createdDateOffset:]))),
+		SequenceNumber: int64(binary.BigEndian.Uint64(data[sequenceNumberOffset:])),
+		Flags:          binary.BigEndian.Uint64(data[flagsOffset:]),
+		MessageID:      getMessageID(data[messageIDOffset:]),
+		PayloadType:    binary.BigEndian.Uint32(data[payloadTypeOffset:]),
+		Payload:        data[start : start+payloadLength],
+	}
+
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], data[payloadDigestOffset:payloadTypeOffset]) {
+		return nil, fmt.Errorf("payload digest mismatch in %s message seq=%d", m.MessageType, m.SequenceNumber)
+	}
+	return m, nil
+}
+
+// putMessageID writes a message ID the way the agent does: the least
+// significant half of the UUID first
+func putMessageID(b []byte, id uuid.UUID) {
+	copy(b[:8], id[8:])
+	copy(b[8:16], id[:8])
+}
+
+// getMessageID reads a message ID written by putMessageID
+func getMessageID(b []byte) uuid.UUID {
+	var id uuid.UUID
+	copy(id[8:], b[:8])
+	copy(id[:8], b[8:16])
+	return id
+}
+
+// String summarizes the message: type, sequence number and, for stream
+// data, payload type and size
+func (m *AgentMessage) String() string {
+	s := fmt.Sprintf("%s seq=%d", m.MessageType, m.SequenceNumber)
+	if m.MessageType != MessageTypeInputStreamData && m.MessageType != MessageTypeOutputStreamData {
+		return s
+	}
+	name, ok := payloadTypeNames[m.PayloadType]
+	if !ok {
+		name = fmt.Sprintf("payload type %d", m.PayloadType)
+	}
+	return fmt.Sprintf("%s %s %d bytes", s, name, len(m.Payload))
+}
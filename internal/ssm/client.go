@@ -3,13 +3,13 @@ package ssm
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,11 +19,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/gorilla/websocket"
 	awsclient "github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/ratelog"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.New()
 
+// hotLog throttles the messages logged for every message of a session, so
+// that a misbehaving stream does not flood the log
+var hotLog = ratelog.New(log, ratelog.DefaultInterval)
+
 // Session Manager protocol constants
 const (
 	MessageSchemaVersion = "1.0"
@@ -34,6 +40,8 @@ const (
 	MessageTypeAgentSessionState = "agent_session_state"
 	MessageTypeChannelClosed     = "channel_closed"
 	MessageTypeAcknowledge       = "acknowledge"
+	MessageTypeStartPublication  = "start_publication"
+	MessageTypePausePublication  = "pause_publication"
 
 	// Session states
 	SessionStateConnected   = "Connected"
@@ -47,6 +55,9 @@ type Client struct {
 	ssmClient  *ssm.Client
 	instanceID string
 	region     string
+	timeout    time.Duration
+	keepAlive  time.Duration
+	recorder   *record.Writer // nil: messages are not recorded
 }
 
 // Session represents an active SSM session with WebSocket connection
@@ -59,26 +70,41 @@ type Session struct {
 	conn        *websocket.Conn
 	closed      atomic.Bool
 	startTime   time.Time
-	lastActive  time.Time
-	sequenceNum atomic.Int64
+	lastActive  time.Time // something was received, guarded by mu
+	lastSent    time.Time // a message was sent, guarded by mu
+	keepAlive   time.Duration
+	sequenceNum atomic.Int64 // of the next input_stream_data message
 	readChan    chan []byte
 	writeChan   chan []byte
 	errorChan   chan error
 	closeChan   chan struct{}
+	readDone    chan struct{} // closed when readLoop exits
+	recorder    *record.Writer
 	mu          sync.RWMutex
-}
 
-// SessionMessage represents a Session Manager protocol message
-type SessionMessage struct {
-	MessageSchemaVersion string                 `json:"MessageSchemaVersion"`
-	MessageType          string                 `json:"MessageType"`
-	MessageId            string                 `json:"MessageId,omitempty"`
-	SequenceNumber       int64                  `json:"SequenceNumber"`
-	Flags                int64                  `json:"Flags"`
-	Payload              string                 `json:"Payload,omitempty"`
-	PayloadType          int                    `json:"PayloadType,omitempty"`
-	CreatedDate          string                 `json:"CreatedDate,omitempty"`
-	Content              map[string]interface{} `json:"Content,omitempty"`
+	// Data channel state: writeMu serializes websocket writes, seqMu keeps
+	// stream data messages in sequence order on the websocket
+	writeMu  sync.Mutex
+	seqMu    sync.Mutex
+	sent     *sendBuffer
+	received reorderBuffer // used by readLoop only
+	pubMu    sync.Mutex
+	pubCh    chan struct{} // closed while the agent accepts stream data
+
+	// Handshake state; handshakeErr is guarded by mu
+	handshakeDone chan struct{}
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	// Read state, guarded by readMu (held for the duration of a Read)
+	readMu  sync.Mutex
+	pending []byte // unread remainder of the last received chunk
+
+	// Read deadline, guarded by deadlineMu. deadlineCh is closed and
+	// replaced whenever the deadline changes to wake a blocked Read.
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	deadlineCh   chan struct{}
 }
 
 // NewClient creates a new SSM client for the specified instance
@@ -88,9 +114,24 @@ func NewClient(ctx context.Context, awsClient *awsclient.Client, instanceID stri
 		ssmClient:  awsClient.SSMClient(),
 		instanceID: instanceID,
 		region:     awsClient.Region(),
+		timeout:    45 * time.Second,
+		keepAlive:  DefaultKeepAlive,
 	}, nil
 }
 
+// SetTimeout sets the WebSocket handshake timeout for new sessions
+func (c *Client) SetTimeout(d time.Duration) {
+	if d > 0 {
+		c.timeout = d
+	}
+}
+
+// SetRecorder records the messages of new sessions into w, a recording of
+// record.KindMessages. The session token is redacted.
+func (c *Client) SetRecorder(w *record.Writer) {
+	c.recorder = w
+}
+
 // StartSession starts a new SSM session and establishes WebSocket connection
 func (c *Client) StartSession(ctx context.Context, name string) (*Session, error) {
 	// Start SSM session using AWS-StartInteractiveCommand
@@ -102,6 +143,27 @@ func (c *Client) StartSession(ctx context.Context, name string) (*Session, error
 		},
 	}
 
+	return c.startSession(ctx, input)
+}
+
+// StartPortSession starts a session that carries a byte stream to a TCP
+// port on the instance (AWS-StartSSHSession), e.g. port 22 for an
+// in-process SSH client. The session can be used as a net.Conn.
+func (c *Client) StartPortSession(ctx context.Context, port int) (*Session, error) {
+	input := &ssm.StartSessionInput{
+		Target:       aws.String(c.instanceID),
+		DocumentName: aws.String("AWS-StartSSHSession"),
+		Parameters: map[string][]string{
+			"portNumber": {strconv.Itoa(port)},
+		},
+	}
+
+	return c.startSession(ctx, input)
+}
+
+// startSession starts an SSM session and establishes its WebSocket
+// connection
+func (c *Client) startSession(ctx context.Context, input *ssm.StartSessionInput) (*Session, error) {
 	result, err := c.ssmClient.StartSession(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start SSM session: %w", err)
@@ -134,11 +196,21 @@ func (c *Client) StartSession(ctx context.Context, name string) (*Session, error
 		client:     c,
 		startTime:  time.Now(),
 		lastActive: time.Now(),
+		lastSent:   time.Now(),
+		keepAlive:  c.keepAlive,
 		readChan:   make(chan []byte, 100),
 		writeChan:  make(chan []byte, 100),
 		errorChan:  make(chan error, 10),
 		closeChan:  make(chan struct{}),
+		readDone:   make(chan struct{}),
+		deadlineCh: make(chan struct{}),
+		recorder:   c.recorder,
+		sent:       newSendBuffer(),
+		pubCh:      make(chan struct{}),
+
+		handshakeDone: make(chan struct{}),
 	}
+	close(session.pubCh)
 
 	// Establish WebSocket connection with SigV4 authentication
 	if err := session.connect(ctx); err != nil {
@@ -151,9 +223,22 @@ func (c *Client) StartSession(ctx context.Context, name string) (*Session, error
 		return nil, fmt.Errorf("failed to send opening handshake: %w", err)
 	}
 
+	// Pongs to the keepalive pings show the connection is alive
+	session.conn.SetPongHandler(func(string) error {
+		session.markActive()
+		return nil
+	})
+
 	// Start message processing goroutines
 	go session.readLoop()
 	go session.writeLoop()
+	go session.keepAliveLoop()
+	go session.resendLoop()
+
+	if err := session.awaitHandshake(c.timeout); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("handshake with the SSM agent failed: %w", err)
+	}
 
 	log.Info("SSM session WebSocket connected successfully")
 
@@ -193,7 +278,7 @@ func (s *Session) connect(ctx context.Context) error {
 
 	// Create WebSocket dialer
 	dialer := websocket.Dialer{
-		HandshakeTimeout: 45 * time.Second,
+		HandshakeTimeout: s.client.timeout,
 	}
 
 	// Connect WebSocket
@@ -212,50 +297,9 @@ func (s *Session) connect(ctx context.Context) error {
 	return nil
 }
 
-// sendOpeningHandshake sends the initial handshake message with the token
-// AWS Session Manager requires an opening handshake to establish the data channel
-func (s *Session) sendOpeningHandshake() error {
-	log.WithFields(logrus.Fields{
-		"session_id": s.sessionID,
-		"has_token":  s.tokenValue != "",
-	}).Debug("Sending opening handshake")
-
-	// AWS Session Manager protocol expects the token in a channel_open request
-	// The token must be in the Content field for the data channel to be established
-	handshake := SessionMessage{
-		MessageSchemaVersion: MessageSchemaVersion,
-		MessageType:          "input_stream_data",
-		SequenceNumber:       0,
-		Flags:                3, // SYN flag to open channel
-		Content: map[string]interface{}{
-			"TokenValue": s.tokenValue,
-		},
-	}
-
-	// Marshal to JSON
-	jsonData, err := json.Marshal(handshake)
-	if err != nil {
-		return fmt.Errorf("failed to marshal handshake: %w", err)
-	}
-
-	log.Debugf("Sending handshake message with token in Content field")
-
-	// Send handshake message
-	if err := s.conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-		return fmt.Errorf("failed to send handshake: %w", err)
-	}
-
-	log.Debug("Opening handshake sent, waiting for acknowledgment...")
-
-	// Wait a bit for the handshake to be processed
-	// The server should respond with an acknowledgment
-	time.Sleep(200 * time.Millisecond)
-
-	return nil
-}
-
 // readLoop continuously reads messages from WebSocket
 func (s *Session) readLoop() {
+	defer close(s.readDone)
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorf("Panic in readLoop: %v", r)
@@ -283,62 +327,79 @@ func (s *Session) readLoop() {
 			return
 		}
 
-		// Parse Session Manager message
-		var msg SessionMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Errorf("Failed to parse message: %v", err)
+		s.recorder.Record(record.Inbound, message)
+
+		msg, err := ParseAgentMessage(message)
+		if err != nil {
+			hotLog.Errorf("Skipping session message: %v", err)
 			continue
 		}
 
-		s.lastActive = time.Now()
-
-		// Handle different message types
-		switch msg.MessageType {
-		case MessageTypeOutputStreamData:
-			// Decode payload and send to read channel
-			if msg.Payload != "" {
-				data, err := base64.StdEncoding.DecodeString(msg.Payload)
-				if err != nil {
-					log.Errorf("Failed to decode payload: %v", err)
-					continue
-				}
+		s.markActive()
 
-				// Skip empty packets
-				if len(data) > 0 {
-					select {
-					case s.readChan <- data:
-					case <-s.closeChan:
-						return
-					default:
-						log.Warn("Read channel full, dropping packet")
-					}
-				}
-			}
+		if !s.handleMessage(msg) {
+			return
+		}
+	}
+}
 
-		case MessageTypeAgentSessionState:
-			// Log session state changes
-			if content, ok := msg.Content["SessionState"].(string); ok {
-				log.Debugf("Session state: %s", content)
-				if content == SessionStateTerminated || content == SessionStateTerminating {
-					return
-				}
+// handleMessage handles a message from the agent. It reports whether to
+// carry on reading.
+func (s *Session) handleMessage(msg *AgentMessage) bool {
+	switch msg.MessageType {
+	case MessageTypeOutputStreamData:
+		// Duplicates are acknowledged again: the first acknowledgement
+		// may have been lost
+		if err := s.acknowledge(msg); err != nil {
+			hotLog.Warnf("Failed to acknowledge message: %v", err)
+		}
+		for _, m := range s.received.add(msg) {
+			if !s.handleStreamData(m) {
+				return false
 			}
+		}
+		return true
 
-		case MessageTypeChannelClosed:
-			log.Info("Channel closed by remote")
-			return
+	case MessageTypeAcknowledge:
+		s.handleAcknowledge(msg)
+		return true
 
-		case MessageTypeAcknowledge:
-			// Acknowledgment received
-			log.Debugf("Received acknowledge for sequence %d", msg.SequenceNumber)
-			// Check if this is the handshake acknowledgment (sequence 0)
-			if msg.SequenceNumber == 0 {
-				log.Info("Handshake acknowledged by server")
-			}
+	case MessageTypeStartPublication, MessageTypePausePublication:
+		s.setPublishing(msg.MessageType == MessageTypeStartPublication)
+		return true
+	}
+	return !endsSession(msg)
+}
 
-		default:
-			log.Debugf("Unhandled message type: %s", msg.MessageType)
+// handleStreamData handles a stream data message in sequence order: the
+// handshake, or data for the reader. It reports whether to carry on
+// reading.
+func (s *Session) handleStreamData(msg *AgentMessage) bool {
+	switch msg.PayloadType {
+	case PayloadTypeHandshakeRequest:
+		if err := s.handleHandshakeRequest(msg); err != nil {
+			s.setHandshakeError(err)
 		}
+		return true
+	case PayloadTypeHandshakeComplete:
+		s.handleHandshakeComplete(msg)
+		return true
+	case PayloadTypeOutput:
+		// Agents without a handshake start with the data
+		s.handshakeOnce.Do(func() { close(s.handshakeDone) })
+	}
+
+	// Skip empty packets. The data is a stream, so a slow reader holds up
+	// the session instead of losing data.
+	data := streamData(msg)
+	if len(data) == 0 {
+		return true
+	}
+	select {
+	case s.readChan <- data:
+		return true
+	case <-s.closeChan:
+		return false
 	}
 }
 
@@ -359,58 +420,138 @@ func (s *Session) writeLoop() {
 				return
 			}
 
-			// Create Session Manager message
-			seqNum := s.sequenceNum.Add(1)
-			msg := SessionMessage{
-				MessageSchemaVersion: MessageSchemaVersion,
-				MessageType:          MessageTypeInputStreamData,
-				SequenceNumber:       seqNum,
-				Flags:                0,
-				Payload:              base64.StdEncoding.EncodeToString(data),
-				PayloadType:          1,
+			if len(data) == 0 {
+				log.Debugf("Sending keepalive: seq=%d", s.sequenceNum.Load())
+			} else {
+				log.Debugf("Sending packet: seq=%d, size=%d bytes", s.sequenceNum.Load(), len(data))
 			}
 
-			log.Debugf("Sending packet: seq=%d, size=%d bytes", seqNum, len(data))
-
-			// Marshal to JSON
-			jsonData, err := json.Marshal(msg)
-			if err != nil {
-				log.Errorf("Failed to marshal message: %v", err)
-				continue
+			// An empty chunk is sent as a message without payload
+			for first := true; first || len(data) > 0; first = false {
+				chunk := data[:min(len(data), streamChunkSize)]
+				data = data[len(chunk):]
+				if err := s.sendStream(PayloadTypeOutput, chunk, true); err != nil {
+					if s.closed.Load() {
+						return
+					}
+					log.Errorf("WebSocket write error: %v", err)
+					s.errorChan <- err
+					return
+				}
 			}
+		}
+	}
+}
 
-			// Write to WebSocket
-			if err := s.conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-				log.Errorf("WebSocket write error: %v", err)
-				s.errorChan <- err
-				return
+// Read reads data from the SSM session. It blocks until data is available,
+// the session ends (io.EOF) or the read deadline passes
+// (os.ErrDeadlineExceeded).
+func (s *Session) Read(p []byte) (int, error) {
+	return s.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read but also returns ctx.Err() once ctx is done
+func (s *Session) ReadContext(ctx context.Context, p []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	// Serve what is left of a chunk that did not fit the previous buffer
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if s.closed.Load() {
+			return 0, io.EOF
+		}
+
+		deadline, deadlineChanged := s.readDeadlineState()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
 			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
 
-			s.lastActive = time.Now()
+		n, retry, err := s.waitRead(ctx, p, timeout, deadlineChanged)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !retry {
+			return n, err
 		}
 	}
 }
 
-// Read reads data from the SSM session
-func (s *Session) Read(p []byte) (int, error) {
-	if s.closed.Load() {
-		return 0, io.EOF
-	}
+// waitRead blocks for a single read event. retry is true if the deadline
+// was changed and the caller must wait again with the new deadline.
+func (s *Session) waitRead(ctx context.Context, p []byte, timeout <-chan time.Time,
+	deadlineChanged <-chan struct{}) (n int, retry bool, err error) {
 
 	select {
 	case data := <-s.readChan:
-		n := copy(p, data)
-		return n, nil
+		return s.consume(p, data), false, nil
 	case err := <-s.errorChan:
-		return 0, err
+		return 0, false, err
+	case <-s.readDone:
+		// Hand out anything still buffered before reporting EOF
+		select {
+		case data := <-s.readChan:
+			return s.consume(p, data), false, nil
+		default:
+			return 0, false, io.EOF
+		}
 	case <-s.closeChan:
-		return 0, io.EOF
-	case <-time.After(100 * time.Millisecond):
-		// Timeout to prevent blocking indefinitely
-		return 0, nil
+		return 0, false, io.EOF
+	case <-ctx.Done():
+		return 0, false, ctx.Err()
+	case <-timeout:
+		return 0, false, os.ErrDeadlineExceeded
+	case <-deadlineChanged:
+		return 0, true, nil
 	}
 }
 
+// consume copies a received chunk into p, keeping the remainder for the
+// next Read. Must be called with readMu held.
+func (s *Session) consume(p, data []byte) int {
+	n := copy(p, data)
+	s.pending = data[n:]
+	return n
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+// A zero value disables the deadline. Changing the deadline wakes up a
+// blocked Read, so SetReadDeadline(time.Now()) can be used to interrupt it.
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+
+	s.readDeadline = t
+	close(s.deadlineCh)
+	s.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// readDeadlineState returns the current read deadline and a channel that is
+// closed when it changes
+func (s *Session) readDeadlineState() (time.Time, <-chan struct{}) {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+	return s.readDeadline, s.deadlineCh
+}
+
 // Write writes data to the SSM session
 func (s *Session) Write(p []byte) (int, error) {
 	if s.closed.Load() {
@@ -451,17 +592,14 @@ func (s *Session) InstanceID() string {
 	return s.instanceID
 }
 
-// IsHealthy checks if the session is still healthy
+// IsHealthy reports whether the session is open and the service was heard
+// from (data or a pong to the keepalive pings) within the last few
+// keepalive intervals
 func (s *Session) IsHealthy() bool {
 	if s.closed.Load() {
 		return false
 	}
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// Check if session has been active recently (within 2 minutes)
-	return time.Since(s.lastActive) < 2*time.Minute
+	return time.Since(s.LastActive()) < keepAliveCountMax*s.keepAlive
 }
 
 // Close closes the SSM session
@@ -478,8 +616,10 @@ func (s *Session) Close() error {
 	// Close WebSocket connection
 	if s.conn != nil {
 		// Send close message
+		s.writeMu.Lock()
 		err := s.conn.WriteMessage(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		s.writeMu.Unlock()
 		if err != nil {
 			log.Warnf("Failed to send close message: %v", err)
 		}
@@ -491,15 +631,11 @@ func (s *Session) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	input := &ssm.TerminateSessionInput{
-		SessionId: aws.String(s.sessionID),
-	}
-
-	_, err := s.client.ssmClient.TerminateSession(ctx, input)
-	if err != nil {
+	if err := s.client.TerminateSession(ctx, s.sessionID); err != nil {
 		log.Warnf("Failed to terminate SSM session: %v", err)
 	}
 
+	hotLog.Flush()
 	log.Info("SSM session closed")
 	return nil
 }
@@ -509,69 +645,15 @@ func (s *Session) Uptime() time.Duration {
 	return time.Since(s.startTime)
 }
 
-// LastActive returns when the session was last active
+// LastActive returns when something was last received from the service
 func (s *Session) LastActive() time.Time {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.lastActive
 }
 
-// EncapsulatePacket wraps an IP packet with protocol framing for transmission
-func EncapsulatePacket(packet []byte) []byte {
-	// Protocol format:
-	// [4 bytes: magic] [4 bytes: length] [N bytes: packet]
-	const magicNumber uint32 = 0x53534D50 // "SSMP" in hex
-
-	header := make([]byte, 8)
-	// Write magic number (big-endian)
-	header[0] = byte((magicNumber >> 24) & 0xFF)
-	header[1] = byte((magicNumber >> 16) & 0xFF)
-	header[2] = byte((magicNumber >> 8) & 0xFF)
-	header[3] = byte(magicNumber & 0xFF)
-	// Write length (big-endian)
-	length := uint32(len(packet))
-	header[4] = byte((length >> 24) & 0xFF)
-	header[5] = byte((length >> 16) & 0xFF)
-	header[6] = byte((length >> 8) & 0xFF)
-	header[7] = byte(length & 0xFF)
-
-	// Combine header and packet
-	frame := make([]byte, len(header)+len(packet))
-	copy(frame, header)
-	copy(frame[8:], packet)
-
-	return frame
-}
-
-// DecapsulatePacket extracts an IP packet from protocol framing
-func DecapsulatePacket(reader io.Reader) ([]byte, error) {
-	const magicNumber uint32 = 0x53534D50 // "SSMP" in hex
-
-	// Read header (8 bytes)
-	header := make([]byte, 8)
-	_, err := io.ReadFull(reader, header)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %w", err)
-	}
-
-	// Verify magic number
-	magic := uint32(header[0])<<24 | uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
-	if magic != magicNumber {
-		return nil, fmt.Errorf("invalid magic number: 0x%x", magic)
-	}
-
-	// Read length
-	length := uint32(header[4])<<24 | uint32(header[5])<<16 | uint32(header[6])<<8 | uint32(header[7])
-	if length > 65535 {
-		return nil, fmt.Errorf("packet too large: %d bytes", length)
-	}
-
-	// Read packet data
-	packet := make([]byte, length)
-	_, err = io.ReadFull(reader, packet)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read packet: %w", err)
-	}
-
-	return packet, nil
+// SetLogger sets the logger for SSM sessions
+func SetLogger(logger *logrus.Logger) {
+	log = logger
+	hotLog.SetLogger(logger)
 }
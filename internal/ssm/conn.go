@@ -0,0 +1,45 @@
+package ssm
+
+import (
+	"net"
+	"time"
+)
+
+// Session implements net.Conn, so stream sessions (StartPortSession) can
+// carry protocols such as SSH
+var _ net.Conn = (*Session)(nil)
+
+// sessionAddr is the address of one end of a session
+type sessionAddr string
+
+// Network returns "ssm"
+func (a sessionAddr) Network() string {
+	return "ssm"
+}
+
+// String returns the session or instance ID
+func (a sessionAddr) String() string {
+	return string(a)
+}
+
+// LocalAddr returns the session ID
+func (s *Session) LocalAddr() net.Addr {
+	return sessionAddr(s.sessionID)
+}
+
+// RemoteAddr returns the target instance ID
+func (s *Session) RemoteAddr() net.Addr {
+	return sessionAddr(s.instanceID)
+}
+
+// SetDeadline sets the read deadline. Writes are queued and bounded by
+// their own timeout.
+func (s *Session) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is a no-op, writes are queued and bounded by their own
+// timeout
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,387 @@
+package ssm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+)
+
+// Stream data is delivered reliably on top of the websocket: every
+// input_stream_data and output_stream_data message carries a sequence
+// number and is acknowledged by the other side. Unacknowledged messages are
+// resent, and received messages are handed out in sequence order. The
+// limits match session-manager-plugin's.
+const (
+	// streamChunkSize is the most payload sent in one message
+	streamChunkSize = 1024
+
+	// sendWindow is how many sent messages may be unacknowledged before
+	// writes wait
+	sendWindow = 10000
+
+	// reorderWindow is how many messages received ahead of sequence are
+	// kept until the ones before them arrive
+	reorderWindow = 10000
+
+	// resendInterval is how often unacknowledged messages are checked
+	resendInterval = 100 * time.Millisecond
+
+	// resendMaxAttempts is how often a message is resent before the
+	// session is given up (5 minutes at the maximum timeout)
+	resendMaxAttempts = 300
+
+	// Retransmission timeout, estimated from the round-trip times of the
+	// acknowledgements like TCP does (RFC 6298)
+	defaultRoundTripTime = 100 * time.Millisecond
+	minResendTimeout     = 200 * time.Millisecond
+	maxResendTimeout     = time.Second
+	clockGranularity     = 10 * time.Millisecond
+)
+
+// acknowledgeContent is the payload of an acknowledge message
+type acknowledgeContent struct {
+	MessageType         string `json:"AcknowledgedMessageType"`
+	MessageID           string `json:"AcknowledgedMessageId"`
+	SequenceNumber      int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage bool   `json:"IsSequentialMessage"`
+}
+
+// channelClosedContent is the payload of a channel_closed message
+type channelClosedContent struct {
+	MessageID string `json:"MessageId"`
+	SessionID string `json:"SessionId"`
+	Output    string `json:"Output"`
+}
+
+// sessionStateContent is the payload of an agent_session_state message
+type sessionStateContent struct {
+	SessionState string `json:"SessionState"`
+}
+
+// unacked is a sent message waiting for its acknowledgement
+type unacked struct {
+	seq      int64
+	frame    []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// sendBuffer holds the sent messages until they are acknowledged and
+// estimates the retransmission timeout
+type sendBuffer struct {
+	window chan struct{} // a slot per unacknowledged message
+
+	mu      sync.Mutex
+	pending []*unacked // in sequence order
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+}
+
+// newSendBuffer creates an empty send buffer
+func newSendBuffer() *sendBuffer {
+	return &sendBuffer{
+		window: make(chan struct{}, sendWindow),
+		srtt:   defaultRoundTripTime,
+		rto:    minResendTimeout,
+	}
+}
+
+// add records a sent message. Its window slot must have been taken.
+func (b *sendBuffer) add(seq int64, frame []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, &unacked{seq: seq, frame: frame, sentAt: time.Now(), attempts: 1})
+}
+
+// ack removes the acknowledged message seq and frees its window slot. It
+// reports whether the message was pending.
+func (b *sendBuffer) ack(seq int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, u := range b.pending {
+		if u.seq != seq {
+			continue
+		}
+		// Resent messages do not tell which copy was acknowledged
+		if u.attempts == 1 {
+			b.updateTimeout(time.Since(u.sentAt))
+		}
+		b.pending = append(b.pending[:i], b.pending[i+1:]...)
+		<-b.window
+		return true
+	}
+	return false
+}
+
+// updateTimeout folds a round-trip time into the retransmission timeout.
+// Must be called with mu held.
+func (b *sendBuffer) updateTimeout(rtt time.Duration) {
+	diff := b.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	b.rttvar = (3*b.rttvar + diff) / 4
+	b.srtt = (7*b.srtt + rtt) / 8
+	b.rto = b.srtt + max(clockGranularity, 4*b.rttvar)
+	b.rto = min(max(b.rto, minResendTimeout), maxResendTimeout)
+}
+
+// due returns the frames of the messages whose acknowledgement is overdue,
+// counting them as resent, or an error if one was resent too often
+func (b *sendBuffer) due() ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var frames [][]byte
+	now := time.Now()
+	for _, u := range b.pending {
+		if now.Sub(u.sentAt) < b.rto {
+			continue
+		}
+		if u.attempts > resendMaxAttempts {
+			return nil, fmt.Errorf("message seq=%d not acknowledged after %d attempts", u.seq, u.attempts)
+		}
+		u.attempts++
+		u.sentAt = now
+		frames = append(frames, u.frame)
+	}
+	return frames, nil
+}
+
+// reorderBuffer puts the agent's stream data messages in sequence order
+type reorderBuffer struct {
+	next    int64
+	pending map[int64]*AgentMessage
+}
+
+// add returns m and the buffered messages following it if m is the next in
+// sequence. Otherwise it returns nothing: a message ahead of sequence is
+// kept until the ones before it arrive, a duplicate is dropped.
+func (b *reorderBuffer) add(m *AgentMessage) []*AgentMessage {
+	switch {
+	case m.SequenceNumber < b.next:
+		return nil
+	case m.SequenceNumber > b.next:
+		if b.pending == nil {
+			b.pending = make(map[int64]*AgentMessage)
+		}
+		if len(b.pending) < reorderWindow {
+			b.pending[m.SequenceNumber] = m
+		}
+		return nil
+	}
+
+	ready := []*AgentMessage{m}
+	b.next++
+	for {
+		next, ok := b.pending[b.next]
+		if !ok {
+			return ready
+		}
+		delete(b.pending, b.next)
+		ready = append(ready, next)
+		b.next++
+	}
+}
+
+// writeFrame writes an encoded message to the websocket. Writes are
+// serialized, as the websocket allows a single writer.
+func (s *Session) writeFrame(frame []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return err
+	}
+	s.recorder.Record(record.Outbound, frame)
+	return nil
+}
+
+// sendStream sends payload as the next input_stream_data message and keeps
+// it until it is acknowledged. If wait is set, it first waits for the
+// publication to be allowed and for room in the send window; control
+// messages sent from readLoop, which processes the acknowledgements, must
+// not wait.
+func (s *Session) sendStream(payloadType uint32, payload []byte, wait bool) error {
+	if wait {
+		select {
+		case <-s.publishing():
+		case <-s.closeChan:
+			return fmt.Errorf("session is closed")
+		}
+		select {
+		case s.sent.window <- struct{}{}:
+		case <-s.closeChan:
+			return fmt.Errorf("session is closed")
+		}
+	} else {
+		select {
+		case s.sent.window <- struct{}{}:
+		default:
+			return fmt.Errorf("send window full")
+		}
+	}
+
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+
+	seq := s.sequenceNum.Add(1) - 1
+	msg := newAgentMessage(MessageTypeInputStreamData, seq, FlagData, payloadType, payload)
+	frame, err := msg.MarshalBinary()
+	if err != nil {
+		<-s.sent.window
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	s.sent.add(seq, frame)
+	if err := s.writeFrame(frame); err != nil {
+		return err
+	}
+	s.markSent()
+	return nil
+}
+
+// acknowledge acknowledges a stream data message from the agent
+func (s *Session) acknowledge(m *AgentMessage) error {
+	content, err := json.Marshal(acknowledgeContent{
+		MessageType:         m.MessageType,
+		MessageID:           m.MessageID.String(),
+		SequenceNumber:      m.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode acknowledgement: %w", err)
+	}
+	frame, err := newAgentMessage(MessageTypeAcknowledge, 0, FlagACK, 0, content).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode acknowledgement: %w", err)
+	}
+	return s.writeFrame(frame)
+}
+
+// handleAcknowledge releases the message an acknowledgement is for
+func (s *Session) handleAcknowledge(m *AgentMessage) {
+	var content acknowledgeContent
+	if err := json.Unmarshal(m.Payload, &content); err != nil {
+		hotLog.Errorf("Skipping acknowledgement: %v", err)
+		return
+	}
+	if !s.sent.ack(content.SequenceNumber) {
+		log.Debugf("Duplicate acknowledgement for seq=%d", content.SequenceNumber)
+	}
+}
+
+// resendLoop resends the messages the agent did not acknowledge in time
+func (s *Session) resendLoop() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case <-s.readDone:
+			return
+		case <-ticker.C:
+		}
+
+		frames, err := s.sent.due()
+		if err != nil {
+			log.Errorf("Giving up SSM session: %v", err)
+			s.fail(err)
+			return
+		}
+		for _, frame := range frames {
+			log.Debug("Resending unacknowledged message")
+			if err := s.writeFrame(frame); err != nil {
+				hotLog.Warnf("Failed to resend message: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// fail ends the session because of err, which Read returns
+func (s *Session) fail(err error) {
+	select {
+	case s.errorChan <- err:
+	default:
+	}
+	s.conn.Close()
+}
+
+// publishing returns a channel that is closed while the agent accepts
+// stream data
+func (s *Session) publishing() <-chan struct{} {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+	return s.pubCh
+}
+
+// setPublishing pauses or resumes the stream data sent to the agent, as
+// asked by pause_publication and start_publication messages
+func (s *Session) setPublishing(on bool) {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+
+	select {
+	case <-s.pubCh:
+		if !on {
+			log.Debug("Agent paused publication")
+			s.pubCh = make(chan struct{})
+		}
+	default:
+		if on {
+			log.Debug("Agent resumed publication")
+			close(s.pubCh)
+		}
+	}
+}
+
+// streamData returns the payload a stream data message delivers to the
+// reader, logging the control payloads that are not handled elsewhere
+func streamData(m *AgentMessage) []byte {
+	switch m.PayloadType {
+	case PayloadTypeOutput:
+		return m.Payload
+	case PayloadTypeError, PayloadTypeStdErr:
+		log.Warnf("Agent error output: %s", m.Payload)
+	case PayloadTypeExitCode:
+		log.Debugf("Agent exit code: %s", m.Payload)
+	default:
+		log.Debugf("Unhandled payload type %d", m.PayloadType)
+	}
+	return nil
+}
+
+// endsSession logs a control message from the agent and reports whether
+// it ends the session
+func endsSession(m *AgentMessage) bool {
+	switch m.MessageType {
+	case MessageTypeAgentSessionState:
+		var content sessionStateContent
+		if err := json.Unmarshal(m.Payload, &content); err == nil {
+			log.Debugf("Session state: %s", content.SessionState)
+			if content.SessionState == SessionStateTerminated || content.SessionState == SessionStateTerminating {
+				return true
+			}
+		}
+
+	case MessageTypeChannelClosed:
+		var content channelClosedContent
+		if err := json.Unmarshal(m.Payload, &content); err == nil && content.Output != "" {
+			log.Infof("Channel closed by remote: %s", content.Output)
+		} else {
+			log.Info("Channel closed by remote")
+		}
+		return true
+
+	default:
+		log.Debugf("Unhandled message type: %s", m.MessageType)
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package ssm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+	"github.com/sirupsen/logrus"
+)
+
+// clientVersion is the session-manager-plugin version reported to the
+// agent. Agents multiplex port sessions for plugins from 1.1.70 on, so it
+// stays below that to get the plain byte stream.
+const clientVersion = "1.1.61.0"
+
+// Client actions the agent requests in the handshake
+const (
+	actionKMSEncryption = "KMSEncryption"
+	actionSessionType   = "SessionType"
+)
+
+// Outcomes of a requested client action
+const (
+	actionStatusSuccess     = 1
+	actionStatusFailed      = 2
+	actionStatusUnsupported = 3
+)
+
+// openDataChannelInput is the first message on the websocket, a text
+// message authenticating the data channel with the session token
+type openDataChannelInput struct {
+	MessageSchemaVersion string `json:"MessageSchemaVersion"`
+	RequestID            string `json:"RequestId"`
+	TokenValue           string `json:"TokenValue"`
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string `json:"ClientVersion"`
+}
+
+// handshakeRequest is the payload of the agent's handshake request
+type handshakeRequest struct {
+	AgentVersion           string                  `json:"AgentVersion"`
+	RequestedClientActions []requestedClientAction `json:"RequestedClientActions"`
+}
+
+// requestedClientAction is an action the agent asks the client to take
+type requestedClientAction struct {
+	ActionType       string          `json:"ActionType"`
+	ActionParameters json.RawMessage `json:"ActionParameters"`
+}
+
+// sessionTypeParameters are the parameters of the SessionType action
+type sessionTypeParameters struct {
+	SessionType string `json:"SessionType"`
+}
+
+// handshakeResponse is the payload of the client's handshake response
+type handshakeResponse struct {
+	ClientVersion          string                  `json:"ClientVersion"`
+	ProcessedClientActions []processedClientAction `json:"ProcessedClientActions"`
+	Errors                 []string                `json:"Errors"`
+}
+
+// processedClientAction reports the outcome of a requested client action
+type processedClientAction struct {
+	ActionType   string `json:"ActionType"`
+	ActionStatus int    `json:"ActionStatus"`
+	Error        string `json:"Error,omitempty"`
+}
+
+// handshakeComplete is the payload of the agent's handshake complete
+type handshakeComplete struct {
+	HandshakeTimeToComplete time.Duration `json:"HandshakeTimeToComplete"`
+	CustomerMessage         string        `json:"CustomerMessage"`
+}
+
+// sendOpeningHandshake opens the data channel with the session token.
+// The agent then starts the handshake on the stream.
+func (s *Session) sendOpeningHandshake() error {
+	log.WithFields(logrus.Fields{
+		"session_id": s.sessionID,
+		"has_token":  s.tokenValue != "",
+	}).Debug("Sending opening handshake")
+
+	input := openDataChannelInput{
+		MessageSchemaVersion: MessageSchemaVersion,
+		RequestID:            uuid.NewString(),
+		TokenValue:           s.tokenValue,
+		ClientID:             uuid.NewString(),
+		ClientVersion:        clientVersion,
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake: %w", err)
+	}
+
+	// The token is a credential for the session; recordings are shared to
+	// report bugs
+	if s.recorder != nil {
+		input.TokenValue = "REDACTED"
+		if redacted, err := json.Marshal(input); err == nil {
+			s.recorder.Record(record.Outbound, redacted)
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+	return nil
+}
+
+// handleHandshakeRequest takes the client actions the agent requests and
+// reports their outcome. Encrypted sessions are not supported: the agent
+// ends them after the response.
+func (s *Session) handleHandshakeRequest(m *AgentMessage) error {
+	var req handshakeRequest
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		return fmt.Errorf("failed to parse handshake request: %w", err)
+	}
+	log.Debugf("Handshake request from agent %s", req.AgentVersion)
+
+	resp := handshakeResponse{ClientVersion: clientVersion, Errors: []string{}}
+	for _, action := range req.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType, ActionStatus: actionStatusSuccess}
+		switch action.ActionType {
+		case actionSessionType:
+			var params sessionTypeParameters
+			if err := json.Unmarshal(action.ActionParameters, &params); err != nil {
+				processed.ActionStatus = actionStatusFailed
+				processed.Error = fmt.Sprintf("invalid session type parameters: %v", err)
+				break
+			}
+			log.Debugf("Session type: %s", params.SessionType)
+		case actionKMSEncryption:
+			processed.ActionStatus = actionStatusFailed
+			processed.Error = "KMS encryption is not supported by ssm-proxy"
+			s.setHandshakeError(fmt.Errorf("the session requires KMS encryption, which ssm-proxy does not support; " +
+				"disable KMS encryption in the Session Manager preferences"))
+		default:
+			processed.ActionStatus = actionStatusUnsupported
+			processed.Error = fmt.Sprintf("unsupported action %s", action.ActionType)
+		}
+		if processed.Error != "" {
+			resp.Errors = append(resp.Errors, processed.Error)
+		}
+		resp.ProcessedClientActions = append(resp.ProcessedClientActions, processed)
+	}
+
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake response: %w", err)
+	}
+	if err := s.sendStream(PayloadTypeHandshakeResponse, payload, false); err != nil {
+		return fmt.Errorf("failed to send handshake response: %w", err)
+	}
+	return nil
+}
+
+// handleHandshakeComplete records that the agent completed the handshake
+func (s *Session) handleHandshakeComplete(m *AgentMessage) {
+	var complete handshakeComplete
+	if err := json.Unmarshal(m.Payload, &complete); err != nil {
+		hotLog.Errorf("Skipping handshake complete: %v", err)
+	}
+	if complete.CustomerMessage != "" {
+		log.Info(complete.CustomerMessage)
+	}
+	log.Debugf("Handshake completed in %s", complete.HandshakeTimeToComplete)
+	s.handshakeOnce.Do(func() { close(s.handshakeDone) })
+}
+
+// setHandshakeError records why the handshake failed and stops waiting
+// for it
+func (s *Session) setHandshakeError(err error) {
+	s.mu.Lock()
+	s.handshakeErr = err
+	s.mu.Unlock()
+	s.handshakeOnce.Do(func() { close(s.handshakeDone) })
+}
+
+// awaitHandshake waits for the agent to complete the handshake. Agents
+// before 3.0 do not perform one: the session is used once they send data
+// or the timeout passes.
+func (s *Session) awaitHandshake(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.handshakeDone:
+	case <-timer.C:
+		log.Debug("Agent did not perform a handshake, continuing without")
+		return nil
+	case <-s.readDone:
+		return fmt.Errorf("session closed during handshake")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.handshakeErr
+}
@@ -0,0 +1,79 @@
+package ssm
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultKeepAlive is the keepalive interval of sessions by default
+const DefaultKeepAlive = 30 * time.Second
+
+// keepAliveCountMax is how many keepalive intervals a session may go
+// without hearing from the service before it counts as unhealthy (like
+// ssh's ServerAliveCountMax)
+const keepAliveCountMax = 3
+
+// SetKeepAlive sets the keepalive interval of new sessions (--keep-alive)
+func (c *Client) SetKeepAlive(d time.Duration) {
+	if d > 0 {
+		c.keepAlive = d
+	}
+}
+
+// keepAliveLoop keeps an idle session from being dropped by the service.
+// Every interval it sends a WebSocket ping, answered by the service with a
+// pong that counts as activity, and a flag-0 stream message without payload
+// if nothing was sent since the previous interval.
+func (s *Session) keepAliveLoop() {
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+
+	lastTick := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-s.closeChan:
+			return
+		case <-s.readDone:
+			return
+		case now = <-ticker.C:
+		}
+		idle := !s.lastSentAt().After(lastTick)
+		lastTick = now
+
+		if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.keepAlive)); err != nil {
+			hotLog.Warnf("Failed to send WebSocket ping: %v", err)
+			continue
+		}
+
+		if idle {
+			// writeLoop sends an empty chunk as a message without payload
+			select {
+			case s.writeChan <- nil:
+			default:
+			}
+		}
+	}
+}
+
+// markActive records that something was received from the service
+func (s *Session) markActive() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+// markSent records that a message was sent to the service
+func (s *Session) markSent() {
+	s.mu.Lock()
+	s.lastSent = time.Now()
+	s.mu.Unlock()
+}
+
+// lastSentAt returns when a message was last sent to the service
+func (s *Session) lastSentAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSent
+}
@@ -0,0 +1,88 @@
+package ssm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+)
+
+// ReplayResult summarizes a replayed recording of Session Manager messages
+type ReplayResult struct {
+	// Received counts the messages from the agent by type
+	Received map[string]int
+	// Sent counts the messages to the agent, which are not replayed
+	Sent int
+	// StreamBytes is the stream data the session delivered
+	StreamBytes int64
+	// Errors are the messages that could not be handled, by record number
+	// (counting from 1)
+	Errors map[int]error
+	// EndedAt is the record that ended the session (0: not ended); later
+	// messages from the agent are counted in AfterEnd
+	EndedAt  int
+	AfterEnd int
+}
+
+// ReplayMessages feeds the agent's messages of a recording through the
+// session's message handling, as if received over the websocket, and
+// writes the stream data the session delivers to out (nil to discard).
+// It returns an error only if the recording cannot be read; messages that
+// cannot be handled are reported in the result.
+func ReplayMessages(r *record.Reader, out io.Writer) (*ReplayResult, error) {
+	if r.Kind() != record.KindMessages {
+		return nil, fmt.Errorf("recording holds %s, not messages", r.Kind())
+	}
+	if out == nil {
+		out = io.Discard
+	}
+
+	result := &ReplayResult{Received: make(map[string]int), Errors: make(map[int]error)}
+	var received reorderBuffer
+	for n := 1; ; n++ {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read record %d: %w", n, err)
+		}
+
+		if rec.Direction == record.Outbound {
+			result.Sent++
+			continue
+		}
+		if result.EndedAt > 0 {
+			result.AfterEnd++
+			continue
+		}
+
+		msg, err := ParseAgentMessage(rec.Data)
+		if err != nil {
+			result.Errors[n] = err
+			continue
+		}
+		result.Received[msg.MessageType]++
+
+		switch msg.MessageType {
+		case MessageTypeOutputStreamData:
+			// Delivered in sequence order, as by the session
+			for _, m := range received.add(msg) {
+				data := streamData(m)
+				if len(data) == 0 {
+					continue
+				}
+				if _, err := out.Write(data); err != nil {
+					return result, fmt.Errorf("failed to write stream data: %w", err)
+				}
+				result.StreamBytes += int64(len(data))
+			}
+		case MessageTypeAcknowledge, MessageTypeStartPublication, MessageTypePausePublication:
+		default:
+			if endsSession(msg) {
+				result.EndedAt = n
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ssm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// sessionIDPattern matches SSM session IDs: the name of the IAM user or role
+// session that started it, and a random hex suffix
+var sessionIDPattern = regexp.MustCompile(`^.+-[0-9a-f]{17,}$`)
+
+// IsSessionID reports whether s looks like an SSM session ID, rather than
+// e.g. the session name older versions stored in its place
+func IsSessionID(s string) bool {
+	return sessionIDPattern.MatchString(s)
+}
+
+// FindSession returns the ID of the newest active session to the client's
+// instance with the document that was started at or after since, for
+// sessions started by another program (e.g. the aws CLI)
+func (c *Client) FindSession(ctx context.Context, document string, since time.Time) (string, error) {
+	input := &ssm.DescribeSessionsInput{
+		State: types.SessionStateActive,
+		Filters: []types.SessionFilter{
+			{Key: types.SessionFilterKeyTargetId, Value: aws.String(c.instanceID)},
+			{Key: types.SessionFilterKeyInvokedAfter, Value: aws.String(since.UTC().Format(time.RFC3339))},
+		},
+	}
+
+	var newest types.Session
+	paginator := ssm.NewDescribeSessionsPaginator(c.ssmClient, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to describe SSM sessions: %w", err)
+		}
+		for _, s := range page.Sessions {
+			started := aws.ToTime(s.StartDate)
+			// The filter only has a granularity of seconds
+			if aws.ToString(s.DocumentName) != document || started.Before(since.Truncate(time.Second)) {
+				continue
+			}
+			if newest.SessionId == nil || started.After(aws.ToTime(newest.StartDate)) {
+				newest = s
+			}
+		}
+	}
+
+	if newest.SessionId == nil {
+		return "", fmt.Errorf("no active %s session to %s since %s", document, c.instanceID, since.Format(time.RFC3339))
+	}
+	return aws.ToString(newest.SessionId), nil
+}
+
+// TerminateSession ends an SSM session, so that Session Manager and
+// CloudTrail show it ended and it stops counting against the session
+// limits. Sessions that already ended are not an error.
+func (c *Client) TerminateSession(ctx context.Context, sessionID string) error {
+	input := &ssm.TerminateSessionInput{
+		SessionId: aws.String(sessionID),
+	}
+	if _, err := c.ssmClient.TerminateSession(ctx, input); err != nil {
+		return fmt.Errorf("failed to terminate SSM session %s: %w", sessionID, err)
+	}
+	return nil
+}
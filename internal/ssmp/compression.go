@@ -0,0 +1,151 @@
+package ssmp
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compression is how the packet of a frame is encoded. Each packet is
+// compressed on its own, so a lost frame does not affect the next. There
+// is no zstd: the standard library has none, and the agent is kept free of
+// dependencies; deflate takes its place for a better ratio.
+type Compression uint8
+
+const (
+	// CompressionNone sends packets as they are
+	CompressionNone Compression = 0
+	// CompressionLZ4 is fast with a moderate ratio
+	CompressionLZ4 Compression = 1
+	// CompressionDeflate compresses better at more CPU
+	CompressionDeflate Compression = 2
+
+	// CompressionAuto is a writer setting: compress the way the peer does
+	CompressionAuto Compression = 0xff
+)
+
+// Bits of the flags byte carrying the compression of the frame and the
+// capabilities of its sender: the encodings it can decode
+const (
+	compressionShift  = 1
+	compressionMask   = 0x3 << compressionShift
+	capabilitiesShift = 4
+
+	// supportedCapabilities are the encodings this package decodes
+	supportedCapabilities = 1<<(capabilitiesShift+CompressionLZ4) | 1<<(capabilitiesShift+CompressionDeflate)
+)
+
+// minCompressSize is the smallest packet worth compressing; headers of
+// small packets (ACKs) do not compress
+const minCompressSize = 64
+
+// ParseCompression parses a --compression value: off, lz4, deflate or
+// auto
+func ParseCompression(s string) (Compression, error) {
+	switch strings.ToLower(s) {
+	case "off", "none", "":
+		return CompressionNone, nil
+	case "lz4":
+		return CompressionLZ4, nil
+	case "deflate":
+		return CompressionDeflate, nil
+	case "auto":
+		return CompressionAuto, nil
+	}
+	return 0, fmt.Errorf("invalid compression %q (must be off, lz4, deflate or auto)", s)
+}
+
+// String returns the name of the compression
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "off"
+	case CompressionLZ4:
+		return "lz4"
+	case CompressionDeflate:
+		return "deflate"
+	case CompressionAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("compression %d", c)
+}
+
+// capability returns the capability bit of an encoding
+func (c Compression) capability() uint8 {
+	return 1 << (capabilitiesShift + c)
+}
+
+// compressor compresses packets, reusing its buffers
+type compressor struct {
+	buf   []byte
+	out   bytes.Buffer
+	flate *flate.Writer
+}
+
+// compress returns packet encoded with c, or nil if that does not make it
+// smaller. The result is valid until the next call.
+func (z *compressor) compress(c Compression, packet []byte) []byte {
+	switch c {
+	case CompressionLZ4:
+		z.buf = lz4Compress(z.buf[:0], packet)
+	case CompressionDeflate:
+		z.out.Reset()
+		if z.flate == nil {
+			z.flate, _ = flate.NewWriter(&z.out, flate.BestSpeed)
+		} else {
+			z.flate.Reset(&z.out)
+		}
+		z.flate.Write(packet)
+		z.flate.Close()
+		z.buf = append(z.buf[:0], z.out.Bytes()...)
+	default:
+		return nil
+	}
+	if len(z.buf) >= len(packet) {
+		return nil
+	}
+	return z.buf
+}
+
+// decompressor decodes compressed packets, reusing its buffers
+type decompressor struct {
+	buf   []byte
+	in    bytes.Reader
+	flate io.ReadCloser
+}
+
+// decompress decodes payload, encoded with c. The result is valid until
+// the next call.
+func (z *decompressor) decompress(c Compression, payload []byte) ([]byte, error) {
+	switch c {
+	case CompressionLZ4:
+		packet, err := lz4Decompress(z.buf[:0], payload, MaxPacketSize)
+		if err != nil {
+			return nil, err
+		}
+		z.buf = packet
+		return packet, nil
+
+	case CompressionDeflate:
+		z.in.Reset(payload)
+		if z.flate == nil {
+			z.flate = flate.NewReader(&z.in)
+		} else {
+			z.flate.(flate.Resetter).Reset(&z.in, nil)
+		}
+		if cap(z.buf) < MaxPacketSize+1 {
+			z.buf = make([]byte, MaxPacketSize+1)
+		}
+		n, err := io.ReadFull(z.flate, z.buf[:MaxPacketSize+1])
+		switch {
+		case err == nil:
+			return nil, fmt.Errorf("deflated packet larger than %d bytes", MaxPacketSize)
+		case err != io.ErrUnexpectedEOF && err != io.EOF:
+			return nil, err
+		}
+		return z.buf[:n], nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", c)
+}
@@ -0,0 +1,157 @@
+package ssmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A compressor of the LZ4 block format (no frame format: a frame carries
+// one packet), greedy with a single hash table like LZ4's fast mode. It is
+// implemented here to keep the agent free of dependencies.
+
+const (
+	lz4MinMatch     = 4
+	lz4HashLog      = 12
+	lz4LastLiterals = 5  // the block ends with at least this many literals
+	lz4MFLimit      = 12 // no match starts this close to the end
+	lz4MaxOffset    = 65535
+)
+
+var errLZ4Corrupt = errors.New("corrupt lz4 block")
+
+// lz4Hash hashes the 4 bytes at the start of a possible match
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4Compress appends the LZ4 block of src to dst
+func lz4Compress(dst, src []byte) []byte {
+	var table [1 << lz4HashLog]int32 // position+1 of the last occurrence
+
+	anchor, i := 0, 0
+	for i < len(src)-lz4MFLimit {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		length := lz4MinMatch
+		for i+length < len(src)-lz4LastLiterals && src[ref+length] == src[i+length] {
+			length++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends a sequence: literals followed by a match of
+// length at offset, or the literals alone ending the block if length is 0
+func lz4AppendSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if length == 0 {
+		return dst
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if length-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, length-lz4MinMatch-15)
+	}
+	return dst
+}
+
+// lz4AppendLength appends the continuation bytes of a length
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4Decompress appends the data of an LZ4 block to dst, failing if it
+// would grow beyond limit bytes
+func lz4Decompress(dst, src []byte, limit int) ([]byte, error) {
+	start := len(dst)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, next, err := lz4ReadLength(src, i)
+			if err != nil {
+				return nil, err
+			}
+			literals += n
+			i = next
+		}
+		if literals > len(src)-i || len(dst)-start+literals > limit {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			return dst, nil
+		}
+
+		if len(src)-i < 2 {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst)-start {
+			return nil, errLZ4Corrupt
+		}
+
+		length := int(token & 15)
+		if length == 15 {
+			n, next, err := lz4ReadLength(src, i)
+			if err != nil {
+				return nil, err
+			}
+			length += n
+			i = next
+		}
+		length += lz4MinMatch
+		if len(dst)-start+length > limit {
+			return nil, errLZ4Corrupt
+		}
+		// The match may overlap the bytes it produces
+		for pos := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[pos])
+			pos++
+		}
+	}
+	return nil, errLZ4Corrupt
+}
+
+// lz4ReadLength reads the continuation bytes of a length at i, returning
+// the length and the position after it
+func lz4ReadLength(src []byte, i int) (int, int, error) {
+	n := 0
+	for {
+		if i >= len(src) || n > MaxPacketSize {
+			return 0, 0, errLZ4Corrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
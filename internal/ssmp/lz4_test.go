@@ -0,0 +1,149 @@
+package ssmp
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// lz4Samples are packets of the kinds the tunnel carries, and ones at the
+// edges of the block format
+func lz4Samples() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, MaxPacketSize)
+	rng.Read(random)
+
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: internal.example.com\r\n\r\n"), 40)
+	mixed := append(append([]byte{}, random[:300]...), bytes.Repeat([]byte{0}, 1000)...)
+	mixed = append(mixed, random[300:600]...)
+
+	return map[string][]byte{
+		"empty":            {},
+		"one byte":         {42},
+		"below match":      []byte("abcdefghijk"),
+		"text":             text,
+		"random":           random[:1400],
+		"zeros":            make([]byte, 1500),
+		"overlapping":      bytes.Repeat([]byte("ab"), 700),
+		"long literals":    random[:300],
+		"long match":       bytes.Repeat([]byte{7}, 4000),
+		"mixed":            mixed,
+		"max size":         random,
+		"max size zeros":   make([]byte, MaxPacketSize),
+		"ends with match":  append(random[:20:20], random[:20]...),
+		"far offset":       append(append([]byte{}, random[:65400]...), random[:100]...)[:MaxPacketSize],
+		"last literals":    append(bytes.Repeat([]byte("abcd"), 10), 'x', 'y', 'z'),
+		"match at mflimit": append(random[:16:16], random[:16]...),
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for name, packet := range lz4Samples() {
+		t.Run(name, func(t *testing.T) {
+			block := lz4Compress(nil, packet)
+			got, err := lz4Decompress(nil, block, MaxPacketSize)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(got, packet) {
+				t.Fatalf("round trip changed the packet: got %d bytes, want %d", len(got), len(packet))
+			}
+		})
+	}
+}
+
+func TestLZ4Compresses(t *testing.T) {
+	packet := bytes.Repeat([]byte("0123456789"), 150)
+	if block := lz4Compress(nil, packet); len(block) > len(packet)/10 {
+		t.Errorf("compressed %d repetitive bytes to %d", len(packet), len(block))
+	}
+}
+
+func TestLZ4DecompressAppends(t *testing.T) {
+	packet := bytes.Repeat([]byte("xyz"), 100)
+	prefix := []byte("prefix")
+	got, err := lz4Decompress(append([]byte{}, prefix...), lz4Compress(nil, packet), MaxPacketSize)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if !bytes.Equal(got, append(prefix, packet...)) {
+		t.Errorf("decompress did not append to dst")
+	}
+}
+
+func TestLZ4DecompressMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+		limit int
+	}{
+		{"empty block", []byte{}, MaxPacketSize},
+		{"truncated literals", []byte{0x50, 'a', 'b'}, MaxPacketSize},
+		{"truncated offset", []byte{0x40, 'a', 'b', 'c', 'd', 0x01}, MaxPacketSize},
+		{"truncated literal length", []byte{0xf0}, MaxPacketSize},
+		{"truncated match length", []byte{0x4f, 'a', 'b', 'c', 'd', 0x04, 0x00}, MaxPacketSize},
+		{"unterminated literal length", append([]byte{0xf0}, bytes.Repeat([]byte{255}, 10)...), MaxPacketSize},
+		{"zero offset", []byte{0x40, 'a', 'b', 'c', 'd', 0x00, 0x00, 0x00}, MaxPacketSize},
+		{"offset past the output", []byte{0x40, 'a', 'b', 'c', 'd', 0x05, 0x00, 0x00}, MaxPacketSize},
+		{"offset before any output", []byte{0x00, 0x01, 0x00, 0x00}, MaxPacketSize},
+		{"oversized literal run", append([]byte{0xf0, 255, 255, 10}, make([]byte, 100)...), MaxPacketSize},
+		{"literal run past the limit", append([]byte{0xf0, 1}, make([]byte, 16)...), 10},
+		{"match past the limit", []byte{0x4f, 'a', 'b', 'c', 'd', 0x01, 0x00, 200, 0x00}, 100},
+		{"endless length", append([]byte{0x4f, 'a', 'b', 'c', 'd', 0x01, 0x00}, bytes.Repeat([]byte{255}, 300)...), MaxPacketSize},
+		{"match without end literals", []byte{0x40, 'a', 'b', 'c', 'd', 0x04, 0x00}, MaxPacketSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lz4Decompress(nil, tt.block, tt.limit)
+			if !errors.Is(err, errLZ4Corrupt) {
+				t.Fatalf("decompress = %d bytes, %v; want errLZ4Corrupt", len(got), err)
+			}
+		})
+	}
+}
+
+// A truncated block fails, or ends at a sequence boundary with a prefix of
+// the packet
+func TestLZ4DecompressTruncated(t *testing.T) {
+	packet := append(bytes.Repeat([]byte("header "), 30), lz4Samples()["random"][:200]...)
+	block := lz4Compress(nil, packet)
+	for n := 0; n < len(block); n++ {
+		got, err := lz4Decompress(nil, block[:n], MaxPacketSize)
+		if err == nil && !bytes.HasPrefix(packet, got) {
+			t.Fatalf("block truncated to %d bytes decompressed to something else than a prefix", n)
+		}
+		if err == nil && len(got) == len(packet) {
+			t.Fatalf("block truncated to %d bytes decompressed to the whole packet", n)
+		}
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	for _, packet := range lz4Samples() {
+		if len(packet) < 4096 {
+			f.Add(lz4Compress(nil, packet))
+		}
+	}
+	f.Add([]byte{0x40, 'a', 'b', 'c', 'd', 0x05, 0x00, 0x00})
+	f.Add([]byte{0xf0, 255, 255, 10})
+	f.Add([]byte{0x1f, 'a', 0x01, 0x00, 255, 255, 255, 10, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var z decompressor
+		for _, c := range []Compression{CompressionLZ4, CompressionDeflate} {
+			packet, err := z.decompress(c, data)
+			if err == nil && len(packet) > MaxPacketSize {
+				t.Fatalf("%s: decompressed to %d bytes, more than %d", c, len(packet), MaxPacketSize)
+			}
+		}
+
+		// Any packet survives a round trip
+		if len(data) <= MaxPacketSize {
+			got, err := lz4Decompress(nil, lz4Compress(nil, data), MaxPacketSize)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("round trip of %d bytes failed: %v", len(data), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,413 @@
+// Package ssmp implements the framing of IP packets between ssm-proxy and
+// ssm-proxy-agent over an SSM session. The session is a byte stream, so
+// every packet is preceded by a header that lets the receiver find it,
+// check it and notice packets that went missing:
+//
+//	offset  size  field
+//	     0     4  magic "SSM2"
+//	     4     1  flags: FlagReset (bit 0), compression of the payload
+//	              (bits 1-2) and capabilities of the sender (bits 4-7)
+//	     5     1  header check, the low byte of the CRC-32C of bytes 4 and 6-11
+//	     6     2  payload length
+//	     8     4  sequence number, per direction
+//	    12     4  CRC-32C of bytes 4-11 and the payload
+//	    16     n  payload: the packet, compressed or not
+//
+// The capabilities are the compressions the sender can decode. A writer
+// compresses packets only with a compression the peer advertised in the
+// frames it sent, so peers that differ in what they support interoperate.
+//
+// A receiver that finds a bad magic number, header or CRC skips ahead to
+// the next magic number instead of losing the stream; the header check
+// keeps it from waiting for the payload of a header that is not one. Lost
+// and corrupted packets are not retransmitted: the session itself is
+// reliable, and the connections inside the tunnel recover from a lost
+// packet like from one lost on a network.
+//
+// The package only depends on the standard library, as the agent is
+// copied to instances and kept small.
+package ssmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+const (
+	// Magic starts every frame ("SSM2")
+	Magic uint32 = 0x53534D32
+
+	// legacyMagic started the frames of the first version, which had no
+	// sequence number or CRC ("SSMP")
+	legacyMagic uint32 = 0x53534D50
+
+	// HeaderSize is the size of a frame header
+	HeaderSize = 16
+
+	// MaxPacketSize is the largest packet a frame carries
+	MaxPacketSize = 65535
+
+	// FlagReset marks the first frame of a sender: the sequence starts
+	// over, e.g. after the agent restarted
+	FlagReset uint8 = 1 << 0
+
+	// readBufferSize is the input buffer, room for the largest frame plus
+	// the start of the next one
+	readBufferSize = 2 * (HeaderSize + MaxPacketSize)
+)
+
+// ErrLegacyFraming is returned when the peer sends frames of the first
+// version of the protocol, i.e. it needs to be updated
+var ErrLegacyFraming = errors.New("peer uses the old frame format without sequence numbers; update ssm-proxy and ssm-proxy-agent to the same version")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// headerCheck computes the check byte of a frame header
+func headerCheck(header []byte) byte {
+	crc := crc32.Update(0, crcTable, header[4:5])
+	return byte(crc32.Update(crc, crcTable, header[6:12]))
+}
+
+// checksum computes the CRC of a frame from its header and packet
+func checksum(header, packet []byte) uint32 {
+	crc := crc32.Update(0, crcTable, header[4:12])
+	return crc32.Update(crc, crcTable, packet)
+}
+
+// Writer frames the packets of one direction
+type Writer struct {
+	seq   uint32
+	reset bool
+
+	compression Compression
+	peer        *Reader // of the other direction; nil: do not compress
+	z           compressor
+
+	packetBytes  atomic.Uint64
+	payloadBytes atomic.Uint64
+}
+
+// WriterStats counts the bytes a writer framed
+type WriterStats struct {
+	// PacketBytes are the packets before compression
+	PacketBytes uint64
+	// PayloadBytes are the frame payloads sent for them
+	PayloadBytes uint64
+}
+
+// NewWriter creates a writer starting a new sequence
+func NewWriter() *Writer {
+	return &Writer{reset: true}
+}
+
+// ResumeWriter creates a writer continuing the sequence of a previous one
+// at seq, e.g. after a handoff between agent workers
+func ResumeWriter(seq uint32) *Writer {
+	return &Writer{seq: seq}
+}
+
+// Sequence returns the sequence number of the next frame
+func (w *Writer) Sequence() uint32 {
+	return w.seq
+}
+
+// SetCompression sets how packets are compressed; CompressionAuto uses
+// the compression of the peer's frames
+func (w *Writer) SetCompression(c Compression) {
+	w.compression = c
+}
+
+// Negotiate lets the writer compress packets, with the compressions the
+// peer advertises in the frames read by r
+func (w *Writer) Negotiate(r *Reader) {
+	w.peer = r
+}
+
+// Stats returns the counts of the bytes framed so far
+func (w *Writer) Stats() WriterStats {
+	return WriterStats{PacketBytes: w.packetBytes.Load(), PayloadBytes: w.payloadBytes.Load()}
+}
+
+// Encode turns the n-byte packet after the header space of frame into the
+// next frame and returns the frame's size. frame must have room for the
+// header and the packet.
+func (w *Writer) Encode(frame []byte, n int) int {
+	header, payload := frame[:HeaderSize], frame[HeaderSize:HeaderSize+n]
+
+	flags := uint8(supportedCapabilities)
+	if w.reset {
+		flags |= FlagReset
+		w.reset = false
+	}
+	if c := w.negotiated(); c != CompressionNone && n >= minCompressSize {
+		if compressed := w.z.compress(c, payload); compressed != nil {
+			payload = payload[:copy(payload, compressed)]
+			flags |= uint8(c) << compressionShift
+		}
+	}
+	w.packetBytes.Add(uint64(n))
+	w.payloadBytes.Add(uint64(len(payload)))
+
+	binary.BigEndian.PutUint32(header[0:4], Magic)
+	header[4] = flags
+	binary.BigEndian.PutUint16(header[6:8], uint16(len(payload)))
+	binary.BigEndian.PutUint32(header[8:12], w.seq)
+	header[5] = headerCheck(header)
+	binary.BigEndian.PutUint32(header[12:16], checksum(header, payload))
+	w.seq++
+	return HeaderSize + len(payload)
+}
+
+// negotiated returns the compression to use for the next packet
+func (w *Writer) negotiated() Compression {
+	if w.peer == nil || w.compression == CompressionNone {
+		return CompressionNone
+	}
+	flags, ok := w.peer.peerFlags()
+	if !ok {
+		return CompressionNone
+	}
+	c := w.compression
+	if c == CompressionAuto {
+		c = Compression(flags&compressionMask) >> compressionShift
+	}
+	if c == CompressionNone || flags&c.capability() == 0 {
+		return CompressionNone
+	}
+	return c
+}
+
+// Frame returns packet framed as the next frame
+func (w *Writer) Frame(packet []byte) []byte {
+	frame := make([]byte, HeaderSize+len(packet))
+	copy(frame[HeaderSize:], packet)
+	return frame[:w.Encode(frame, len(packet))]
+}
+
+// ReaderStats counts the frames a reader dropped
+type ReaderStats struct {
+	// Corrupt frames failed the CRC check or decompression
+	Corrupt uint64
+	// Lost packets are the gaps in the sequence
+	Lost uint64
+	// Duplicates were received before
+	Duplicates uint64
+	// SkippedBytes were dropped to find the next frame
+	SkippedBytes uint64
+}
+
+// Reader reads the packets of one direction from a byte stream. Bytes of
+// a frame that has not been read completely stay buffered, so they can be
+// handed off with Pending.
+type Reader struct {
+	r   io.Reader
+	buf []byte
+
+	// Next expected sequence number; synced is set once a frame was read
+	expected uint32
+	synced   bool
+
+	// Logf, if set, reports dropped frames
+	Logf func(format string, args ...any)
+
+	// flags of the last frame read, with flagsSeen set once there is one
+	flags atomic.Uint32
+	z     decompressor
+
+	corrupt    atomic.Uint64
+	lost       atomic.Uint64
+	duplicates atomic.Uint64
+	skipped    atomic.Uint64
+}
+
+// NewReader creates a reader of the frames in r, taking the sequence from
+// the first frame
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ResumeReader creates a reader continuing where a previous one stopped:
+// pending holds the bytes it had buffered and expected the next sequence
+// number
+func ResumeReader(r io.Reader, pending []byte, expected uint32) *Reader {
+	return &Reader{r: r, buf: pending, expected: expected, synced: true}
+}
+
+// Pending returns the buffered bytes of a frame that was not read
+// completely
+func (f *Reader) Pending() []byte {
+	return f.buf
+}
+
+// Expected returns the next sequence number the reader expects
+func (f *Reader) Expected() uint32 {
+	return f.expected
+}
+
+// flagsSeen marks Reader.flags as set
+const flagsSeen = 1 << 8
+
+// peerFlags returns the flags of the last frame read, if any
+func (f *Reader) peerFlags() (uint8, bool) {
+	flags := f.flags.Load()
+	return uint8(flags), flags&flagsSeen != 0
+}
+
+// PeerCompression returns the compression of the last frame read
+func (f *Reader) PeerCompression() Compression {
+	flags, _ := f.peerFlags()
+	return Compression(flags&compressionMask) >> compressionShift
+}
+
+// Stats returns the counts of the frames dropped so far
+func (f *Reader) Stats() ReaderStats {
+	return ReaderStats{
+		Corrupt:      f.corrupt.Load(),
+		Lost:         f.lost.Load(),
+		Duplicates:   f.duplicates.Load(),
+		SkippedBytes: f.skipped.Load(),
+	}
+}
+
+// ReadPacket returns the next packet, decompressed. The packet is valid
+// until the next call.
+func (f *Reader) ReadPacket() ([]byte, error) {
+	for {
+		if err := f.fill(HeaderSize); err != nil {
+			return nil, err
+		}
+
+		magic := binary.BigEndian.Uint32(f.buf[0:4])
+		if magic == legacyMagic && !f.synced {
+			return nil, ErrLegacyFraming
+		}
+		if magic != Magic || f.buf[5] != headerCheck(f.buf) {
+			if err := f.skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		flags := f.buf[4]
+		length := int(binary.BigEndian.Uint16(f.buf[6:8]))
+		seq := binary.BigEndian.Uint32(f.buf[8:12])
+		if err := f.fill(HeaderSize + length); err != nil {
+			return nil, err
+		}
+
+		end := HeaderSize + length
+		packet := f.buf[HeaderSize:end:end]
+		if checksum(f.buf, packet) != binary.BigEndian.Uint32(f.buf[12:16]) {
+			// A damaged frame, or a payload that happened to contain the
+			// magic number
+			f.corrupt.Add(1)
+			f.logf("Dropped frame with bad checksum (seq %d, %d bytes)", seq, length)
+			if err := f.skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Later reads only append after the frame, so the packet can be
+		// returned without copying
+		f.buf = f.buf[end:]
+
+		if !f.accept(seq, flags) {
+			continue
+		}
+		f.flags.Store(uint32(flags) | flagsSeen)
+
+		if c := Compression(flags&compressionMask) >> compressionShift; c != CompressionNone {
+			var err error
+			if packet, err = f.z.decompress(c, packet); err != nil {
+				f.corrupt.Add(1)
+				f.logf("Dropped frame that failed to decompress (seq %d, %s): %v", seq, c, err)
+				continue
+			}
+		}
+		return packet, nil
+	}
+}
+
+// accept checks the sequence number of a valid frame and reports whether
+// to deliver it
+func (f *Reader) accept(seq uint32, flags uint8) bool {
+	if !f.synced || flags&FlagReset != 0 {
+		f.synced = true
+		f.expected = seq + 1
+		return true
+	}
+
+	switch diff := int32(seq - f.expected); {
+	case diff == 0:
+	case diff > 0:
+		f.lost.Add(uint64(diff))
+		f.logf("Lost %d packets before seq %d", diff, seq)
+	default:
+		f.duplicates.Add(1)
+		f.logf("Dropped duplicate packet (seq %d, expected %d)", seq, f.expected)
+		return false
+	}
+	f.expected = seq + 1
+	return true
+}
+
+// skip drops input up to the next occurrence of the magic number after
+// the start of the buffer
+func (f *Reader) skip() error {
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], Magic)
+
+	skipped, from := 0, 1
+	for {
+		if i := bytes.Index(f.buf[from:], magic[:]); i >= 0 {
+			skipped += from + i
+			f.buf = f.buf[from+i:]
+			break
+		}
+		from = 0
+		// Keep a possible prefix of the magic number
+		keep := min(len(f.buf), len(magic)-1)
+		skipped += len(f.buf) - keep
+		f.buf = f.buf[len(f.buf)-keep:]
+		if err := f.fill(len(f.buf) + 1); err != nil {
+			f.skipped.Add(uint64(skipped))
+			return err
+		}
+	}
+	f.skipped.Add(uint64(skipped))
+	f.logf("Skipped %d bytes to resynchronize the packet stream", skipped)
+	return nil
+}
+
+// fill reads until buf holds at least n bytes
+func (f *Reader) fill(n int) error {
+	if cap(f.buf) < n {
+		buf := make([]byte, len(f.buf), max(n, readBufferSize))
+		copy(buf, f.buf)
+		f.buf = buf
+	}
+
+	for len(f.buf) < n {
+		read, err := f.r.Read(f.buf[len(f.buf):cap(f.buf)])
+		f.buf = f.buf[:len(f.buf)+read]
+		if err != nil {
+			if err == io.EOF && len(f.buf) > 0 && len(f.buf) < n {
+				return fmt.Errorf("read packet: %w", io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// logf reports a dropped frame, if a logger is set
+func (f *Reader) logf(format string, args ...any) {
+	if f.Logf != nil {
+		f.Logf(format, args...)
+	}
+}
@@ -0,0 +1,310 @@
+package ssmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// testPackets returns n packets of different sizes, none containing the
+// magic number
+func testPackets(n int) [][]byte {
+	rng := rand.New(rand.NewSource(int64(n)))
+	sizes := []int{0, 1, 40, 1400, 60, MaxPacketSize, 576, 9000}
+	packets := make([][]byte, n)
+	for i := range packets {
+		packet := make([]byte, sizes[i%len(sizes)])
+		rng.Read(packet)
+		packets[i] = bytes.ReplaceAll(packet, []byte("SSM"), []byte("ssm"))
+	}
+	return packets
+}
+
+// frameAt returns packet framed with sequence number seq
+func frameAt(seq uint32, packet []byte) []byte {
+	return ResumeWriter(seq).Frame(packet)
+}
+
+// readAll reads the packets of r until the end of the stream, copying them
+func readAll(t *testing.T, r *Reader) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for {
+		packet, err := r.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket: %v", err)
+		}
+		packets = append(packets, append([]byte{}, packet...))
+	}
+}
+
+// samePackets fails the test if got differs from want
+func samePackets(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d packets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d: got %d bytes, want %d (%x...)", i, len(got[i]), len(want[i]), want[i][:min(len(want[i]), 8)])
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	packets := testPackets(16)
+	w := NewWriter()
+	var stream bytes.Buffer
+	for _, packet := range packets {
+		stream.Write(w.Frame(packet))
+	}
+	if w.Sequence() != uint32(len(packets)) {
+		t.Errorf("writer sequence %d after %d frames", w.Sequence(), len(packets))
+	}
+
+	// Reads of a byte at a time find the same frames
+	for name, in := range map[string]io.Reader{
+		"whole":    bytes.NewReader(stream.Bytes()),
+		"one byte": iotest.OneByteReader(bytes.NewReader(stream.Bytes())),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewReader(in)
+			samePackets(t, readAll(t, r), packets)
+			if stats := r.Stats(); stats != (ReaderStats{}) {
+				t.Errorf("reader stats %+v after a clean stream", stats)
+			}
+			if r.Expected() != uint32(len(packets)) {
+				t.Errorf("reader expects seq %d, want %d", r.Expected(), len(packets))
+			}
+		})
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	frame := NewWriter().Frame([]byte("packet"))
+	if len(frame) != HeaderSize+6 {
+		t.Fatalf("frame of %d bytes, want %d", len(frame), HeaderSize+6)
+	}
+	if binary.BigEndian.Uint32(frame[0:4]) != Magic {
+		t.Errorf("frame starts with %q, want SSM2", frame[0:4])
+	}
+	if frame[4]&FlagReset == 0 {
+		t.Error("first frame of a writer without FlagReset")
+	}
+	if next := ResumeWriter(7).Frame(nil); next[4]&FlagReset != 0 || binary.BigEndian.Uint32(next[8:12]) != 7 {
+		t.Errorf("resumed writer frame: flags %#x, seq %d; want no reset, seq 7", next[4], binary.BigEndian.Uint32(next[8:12]))
+	}
+}
+
+func TestRoundTripCompressed(t *testing.T) {
+	compressible := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 30)
+	for _, c := range []Compression{CompressionLZ4, CompressionDeflate, CompressionAuto} {
+		t.Run(c.String(), func(t *testing.T) {
+			// The peer's frames tell the writer what it decodes and, for
+			// auto, how it compresses
+			w := NewWriter()
+			w.SetCompression(c)
+			w.Negotiate(peerReader(t, CompressionDeflate, compressible))
+			packets := [][]byte{compressible, []byte("small"), compressible}
+			var stream bytes.Buffer
+			for _, packet := range packets {
+				stream.Write(w.Frame(packet))
+			}
+
+			samePackets(t, readAll(t, NewReader(&stream)), packets)
+			if stats := w.Stats(); stats.PayloadBytes >= stats.PacketBytes {
+				t.Errorf("%s: %d payload bytes for %d packet bytes", c, stats.PayloadBytes, stats.PacketBytes)
+			}
+		})
+	}
+}
+
+// peerReader returns a reader that read a frame of packet compressed with
+// c, as the reader of the peer's frames
+func peerReader(t *testing.T, c Compression, packet []byte) *Reader {
+	t.Helper()
+	// The peer compresses once it read a frame of ours
+	ours := NewReader(bytes.NewReader(NewWriter().Frame(nil)))
+	if _, err := ours.ReadPacket(); err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	peer := NewWriter()
+	peer.SetCompression(c)
+	peer.Negotiate(ours)
+
+	r := NewReader(bytes.NewReader(peer.Frame(packet)))
+	if _, err := r.ReadPacket(); err != nil {
+		t.Fatalf("ReadPacket of the peer's frame: %v", err)
+	}
+	if r.PeerCompression() != c {
+		t.Fatalf("peer compressed with %s, want %s", r.PeerCompression(), c)
+	}
+	return r
+}
+
+func TestNoCompressionBeforePeer(t *testing.T) {
+	packet := bytes.Repeat([]byte{1}, 1000)
+	w := NewWriter()
+	w.SetCompression(CompressionLZ4)
+	w.Negotiate(NewReader(bytes.NewReader(nil)))
+	if frame := w.Frame(packet); len(frame) != HeaderSize+len(packet) {
+		t.Errorf("compressed before the peer advertised what it decodes (%d bytes)", len(frame))
+	}
+}
+
+// A corrupted byte anywhere in a frame drops that frame only
+func TestCorruptedByte(t *testing.T) {
+	packets := testPackets(3)
+	packets[1] = []byte("the packet in the middle, whose frame is corrupted")
+	frames := [][]byte{frameAt(0, packets[0]), frameAt(1, packets[1]), frameAt(2, packets[2])}
+
+	for pos := range frames[1] {
+		t.Run(fmt.Sprintf("byte %d", pos), func(t *testing.T) {
+			corrupted := append([]byte{}, frames[1]...)
+			corrupted[pos] ^= 0x40
+
+			stream := bytes.Join([][]byte{frames[0], corrupted, frames[2]}, nil)
+			r := NewReader(bytes.NewReader(stream))
+			samePackets(t, readAll(t, r), [][]byte{packets[0], packets[2]})
+
+			stats := r.Stats()
+			if stats.Lost != 1 {
+				t.Errorf("lost %d packets, want 1", stats.Lost)
+			}
+			if stats.Corrupt == 0 && stats.SkippedBytes == 0 {
+				t.Error("the corrupted frame was not counted")
+			}
+		})
+	}
+}
+
+func TestResync(t *testing.T) {
+	packets := testPackets(3)
+	garbage := []byte("garbage SSM2 before the frame, with a magic number in it")
+	stream := bytes.Join([][]byte{garbage, frameAt(0, packets[0]), garbage[:3], frameAt(1, packets[1]), frameAt(2, packets[2])}, nil)
+
+	r := NewReader(iotest.HalfReader(bytes.NewReader(stream)))
+	samePackets(t, readAll(t, r), packets)
+	if stats := r.Stats(); stats.SkippedBytes != uint64(len(garbage)+3) || stats.Lost != 0 {
+		t.Errorf("stats %+v, want %d skipped bytes and nothing lost", stats, len(garbage)+3)
+	}
+}
+
+func TestLegacyFraming(t *testing.T) {
+	legacy := []byte{'S', 'S', 'M', 'P', 0, 4, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0}
+	if _, err := NewReader(bytes.NewReader(legacy)).ReadPacket(); !errors.Is(err, ErrLegacyFraming) {
+		t.Errorf("ReadPacket of a legacy frame: %v, want ErrLegacyFraming", err)
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	frame := frameAt(0, []byte("a packet cut short"))
+	for _, n := range []int{HeaderSize - 1, HeaderSize + 3} {
+		_, err := NewReader(bytes.NewReader(frame[:n])).ReadPacket()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("ReadPacket of %d of %d bytes: %v, want io.ErrUnexpectedEOF", n, len(frame), err)
+		}
+	}
+}
+
+// The sequence numbers of the frames in a stream decide which packets are
+// delivered and what is counted as lost or duplicate. A number up to 2^31
+// ahead of the expected one is a gap, further ahead it is taken for an old
+// frame, so the window wraps around with the sequence.
+func TestSequence(t *testing.T) {
+	const half = 1 << 31
+	tests := []struct {
+		name       string
+		seqs       []uint32
+		reset      int // index of the frame sent with FlagReset, -1 for none
+		delivered  []int
+		lost       uint64
+		duplicates uint64
+		expected   uint32
+	}{
+		{"in order", []uint32{0, 1, 2, 3}, -1, []int{0, 1, 2, 3}, 0, 0, 4},
+		{"first frame sets the sequence", []uint32{100, 101}, -1, []int{0, 1}, 0, 0, 102},
+		{"gap", []uint32{0, 1, 5, 6}, -1, []int{0, 1, 2, 3}, 3, 0, 7},
+		{"duplicate", []uint32{0, 1, 1, 2}, -1, []int{0, 1, 3}, 0, 1, 3},
+		{"old frame", []uint32{5, 6, 7, 2}, -1, []int{0, 1, 2}, 0, 1, 8},
+		{"reordered", []uint32{0, 2, 1, 3}, -1, []int{0, 1, 3}, 1, 1, 4},
+		{"reset", []uint32{5, 6, 0, 1}, 2, []int{0, 1, 2, 3}, 0, 0, 2},
+		{"wraparound", []uint32{1<<32 - 2, 1<<32 - 1, 0, 1}, -1, []int{0, 1, 2, 3}, 0, 0, 2},
+		{"gap over wraparound", []uint32{1<<32 - 1, 2}, -1, []int{0, 1}, 2, 0, 3},
+		{"largest gap", []uint32{10, 11, 12 + half - 1}, -1, []int{0, 1, 2}, half - 1, 0, 12 + half},
+		{"beyond the window", []uint32{10, 11, 12 + half}, -1, []int{0, 1}, 0, 1, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			var want [][]byte
+			for i, seq := range tt.seqs {
+				packet := []byte(fmt.Sprintf("packet %d", i))
+				if i == tt.reset {
+					stream.Write(NewWriter().Frame(packet))
+				} else {
+					stream.Write(frameAt(seq, packet))
+				}
+				for _, d := range tt.delivered {
+					if d == i {
+						want = append(want, packet)
+					}
+				}
+			}
+
+			r := NewReader(&stream)
+			samePackets(t, readAll(t, r), want)
+			stats := r.Stats()
+			if stats.Lost != tt.lost || stats.Duplicates != tt.duplicates {
+				t.Errorf("lost %d, duplicates %d; want %d, %d", stats.Lost, stats.Duplicates, tt.lost, tt.duplicates)
+			}
+			if r.Expected() != tt.expected {
+				t.Errorf("expects seq %d, want %d", r.Expected(), tt.expected)
+			}
+		})
+	}
+}
+
+// A reader and writer handed off mid-stream continue the sequence without
+// losing the frame that was partly read
+func TestResume(t *testing.T) {
+	packets := testPackets(4)
+	w := NewWriter()
+	var first bytes.Buffer
+	first.Write(w.Frame(packets[0]))
+	first.Write(w.Frame(packets[1]))
+	third := w.Frame(packets[2])
+	first.Write(third[:HeaderSize+5])
+
+	r := NewReader(&first)
+	samePackets(t, [][]byte{mustRead(t, r), mustRead(t, r)}, packets[:2])
+	if _, err := r.ReadPacket(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadPacket of a partial frame: %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	w2 := ResumeWriter(w.Sequence())
+	rest := bytes.NewBuffer(append(append([]byte{}, third[HeaderSize+5:]...), w2.Frame(packets[3])...))
+	r2 := ResumeReader(rest, r.Pending(), r.Expected())
+	samePackets(t, readAll(t, r2), packets[2:])
+	if stats := r2.Stats(); stats != (ReaderStats{}) {
+		t.Errorf("resumed reader stats %+v, want none dropped", stats)
+	}
+}
+
+// mustRead reads the next packet of r, copying it
+func mustRead(t *testing.T, r *Reader) []byte {
+	t.Helper()
+	packet, err := r.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	return append([]byte{}, packet...)
+}
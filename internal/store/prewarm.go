@@ -0,0 +1,101 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PrewarmRecord describes a prewarmed SSM/SSH channel kept open by a
+// background `ssm-proxy prewarm` process
+type PrewarmRecord struct {
+	Name       string
+	PID        int
+	InstanceID string
+	SOCKSAddr  string
+	Ready      bool
+	StartedAt  time.Time
+	ExpiresAt  time.Time // zero if the channel never expires
+}
+
+const prewarmColumns = `name, pid, instance_id, socks_addr, ready, started_at, expires_at`
+
+// SavePrewarm inserts or replaces a prewarm record
+func (s *Store) SavePrewarm(rec *PrewarmRecord) error {
+	var expiresAt sql.NullInt64
+	if !rec.ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: toUnix(rec.ExpiresAt), Valid: true}
+	}
+
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO prewarms (`+prewarmColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rec.Name, rec.PID, rec.InstanceID, rec.SOCKSAddr, rec.Ready,
+		toUnix(rec.StartedAt), expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save prewarm %s: %w", rec.Name, err)
+	}
+	return nil
+}
+
+// Prewarm returns the prewarm record with the given name
+func (s *Store) Prewarm(name string) (*PrewarmRecord, error) {
+	row := s.db.QueryRow(`SELECT `+prewarmColumns+` FROM prewarms WHERE name = ?`, name)
+	rec, err := scanPrewarm(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: prewarm %s", ErrNotFound, name)
+	}
+	return rec, err
+}
+
+// Prewarms returns all prewarm records ordered by name
+func (s *Store) Prewarms() ([]*PrewarmRecord, error) {
+	rows, err := s.db.Query(`SELECT ` + prewarmColumns + ` FROM prewarms ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prewarms: %w", err)
+	}
+	defer rows.Close()
+
+	var records []*PrewarmRecord
+	for rows.Next() {
+		rec, err := scanPrewarm(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// DeletePrewarm removes a prewarm record. Only the record owned by pid is
+// removed, so a replaced channel is never deleted by its predecessor; pid 0
+// removes the record unconditionally.
+func (s *Store) DeletePrewarm(name string, pid int) error {
+	_, err := s.db.Exec(`DELETE FROM prewarms WHERE name = ? AND (? = 0 OR pid = ?)`, name, pid, pid)
+	if err != nil {
+		return fmt.Errorf("failed to delete prewarm %s: %w", name, err)
+	}
+	return nil
+}
+
+// scanPrewarm scans a single prewarm row
+func scanPrewarm(row scanner) (*PrewarmRecord, error) {
+	var rec PrewarmRecord
+	var startedAt int64
+	var expiresAt sql.NullInt64
+
+	err := row.Scan(&rec.Name, &rec.PID, &rec.InstanceID, &rec.SOCKSAddr, &rec.Ready,
+		&startedAt, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan prewarm: %w", err)
+	}
+
+	rec.StartedAt = fromUnix(startedAt)
+	if expiresAt.Valid {
+		rec.ExpiresAt = fromUnix(expiresAt.Int64)
+	}
+	return &rec, nil
+}
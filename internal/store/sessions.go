@@ -0,0 +1,263 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionRecord is a row in the sessions table. Active sessions have a zero
+// EndedAt; ended sessions are kept for history and reporting.
+type SessionRecord struct {
+	ID         int64
+	Name       string
+	InstanceID string
+	SessionID  string
+	Region     string // "" for the default region
+	RoleARN    string // role assumed for the session, if any
+	TunDevice  string
+	TunIP      string
+	SOCKSAddr  string
+	CIDRBlocks []string
+	Routes     []string
+	PID        int
+	StartedAt  time.Time
+	EndedAt    time.Time
+	EndReason  string
+	PacketsTX  uint64
+	PacketsRX  uint64
+	BytesTX    uint64
+	BytesRX    uint64
+
+	// Health as last reported by the owning process
+	TunnelUp        bool
+	HealthCheckedAt time.Time
+	HealthError     string        // failed layer and reason, "" if healthy
+	HealthInterval  time.Duration // how often the process checks health
+
+	// Configuration drift seen by the health monitor
+	Drift DriftCounts
+}
+
+// DriftCounts counts routes and DNS resolver configuration found changed
+// behind the session's back, and how many of those were repaired
+type DriftCounts struct {
+	RoutesDrifted  int
+	RoutesRepaired int
+	DNSDrifted     int
+	DNSRepaired    int
+}
+
+// Active reports whether the session has not ended yet
+func (r *SessionRecord) Active() bool {
+	return r.EndedAt.IsZero()
+}
+
+// HistoryFilter narrows down SessionHistory results
+type HistoryFilter struct {
+	Since      time.Time // only sessions started at or after Since
+	Until      time.Time // only sessions started before Until
+	InstanceID string
+	Limit      int // 0 = unlimited
+}
+
+const sessionColumns = `id, name, instance_id, session_id, tun_device, tun_ip, cidr_blocks, pid,
+	started_at, ended_at, end_reason, packets_tx, packets_rx, bytes_tx, bytes_rx,
+	tunnel_up, health_checked_at, routes, socks_addr, health_error, health_interval_ms,
+	routes_drifted, routes_repaired, dns_drifted, dns_repaired, region, role_arn`
+
+// InsertSession inserts a new active session and sets rec.ID. It returns
+// ErrConflict if an active session with the same name already exists.
+func (s *Store) InsertSession(rec *SessionRecord) error {
+	res, err := s.db.Exec(`INSERT INTO sessions
+		(name, instance_id, session_id, tun_device, tun_ip, socks_addr, cidr_blocks, routes, pid, started_at,
+		health_interval_ms, region, role_arn)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Name, rec.InstanceID, rec.SessionID, rec.TunDevice, rec.TunIP, rec.SOCKSAddr,
+		strings.Join(rec.CIDRBlocks, ","), strings.Join(rec.Routes, ","), rec.PID, toUnix(rec.StartedAt),
+		rec.HealthInterval.Milliseconds(), rec.Region, rec.RoleARN)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("%w: active session %s", ErrConflict, rec.Name)
+		}
+		return fmt.Errorf("failed to insert session: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to read session id: %w", err)
+	}
+	rec.ID = id
+	return nil
+}
+
+// UpdateSession updates the descriptive fields of an existing session
+func (s *Store) UpdateSession(rec *SessionRecord) error {
+	res, err := s.db.Exec(`UPDATE sessions SET
+		name = ?, instance_id = ?, session_id = ?, tun_device = ?, tun_ip = ?, socks_addr = ?,
+		cidr_blocks = ?, routes = ?, pid = ?, started_at = ?, health_interval_ms = ?, region = ?, role_arn = ?
+		WHERE id = ?`,
+		rec.Name, rec.InstanceID, rec.SessionID, rec.TunDevice, rec.TunIP, rec.SOCKSAddr,
+		strings.Join(rec.CIDRBlocks, ","), strings.Join(rec.Routes, ","), rec.PID, toUnix(rec.StartedAt),
+		rec.HealthInterval.Milliseconds(), rec.Region, rec.RoleARN, rec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: session id %d", ErrNotFound, rec.ID)
+	}
+	return nil
+}
+
+// UpdateTraffic stores the latest traffic totals for a session
+func (s *Store) UpdateTraffic(id int64, packetsTX, packetsRX, bytesTX, bytesRX uint64) error {
+	_, err := s.db.Exec(`UPDATE sessions SET packets_tx = ?, packets_rx = ?, bytes_tx = ?, bytes_rx = ? WHERE id = ?`,
+		int64(packetsTX), int64(packetsRX), int64(bytesTX), int64(bytesRX), id)
+	if err != nil {
+		return fmt.Errorf("failed to update session traffic: %w", err)
+	}
+	return nil
+}
+
+// UpdateHealth stores the tunnel health reported by the session's process.
+// healthError describes the failed check, "" if the tunnel is healthy.
+func (s *Store) UpdateHealth(id int64, tunnelUp bool, healthError string, checkedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE sessions SET tunnel_up = ?, health_error = ?, health_checked_at = ? WHERE id = ?`,
+		tunnelUp, healthError, toUnix(checkedAt), id)
+	if err != nil {
+		return fmt.Errorf("failed to update session health: %w", err)
+	}
+	return nil
+}
+
+// UpdateDrift stores the configuration drift counts of a session
+func (s *Store) UpdateDrift(id int64, drift DriftCounts) error {
+	_, err := s.db.Exec(`UPDATE sessions SET routes_drifted = ?, routes_repaired = ?, dns_drifted = ?, dns_repaired = ?
+		WHERE id = ?`,
+		drift.RoutesDrifted, drift.RoutesRepaired, drift.DNSDrifted, drift.DNSRepaired, id)
+	if err != nil {
+		return fmt.Errorf("failed to update session drift: %w", err)
+	}
+	return nil
+}
+
+// EndActiveSession marks the active session with the given name as ended.
+// It is a no-op if no such session is active.
+func (s *Store) EndActiveSession(name string, endedAt time.Time, reason string) error {
+	_, err := s.db.Exec(`UPDATE sessions SET ended_at = ?, end_reason = ? WHERE name = ? AND ended_at IS NULL`,
+		toUnix(endedAt), reason, name)
+	if err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	return nil
+}
+
+// ActiveSession returns the active session with the given name
+func (s *Store) ActiveSession(name string) (*SessionRecord, error) {
+	row := s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE name = ? AND ended_at IS NULL`, name)
+	rec, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: session %s", ErrNotFound, name)
+	}
+	return rec, err
+}
+
+// ActiveSessions returns all active sessions, most recent first
+func (s *Store) ActiveSessions() ([]*SessionRecord, error) {
+	return s.querySessions(`SELECT ` + sessionColumns + ` FROM sessions WHERE ended_at IS NULL ORDER BY started_at DESC`)
+}
+
+// SessionHistory returns sessions (active and ended) matching the filter,
+// most recent first
+func (s *Store) SessionHistory(filter HistoryFilter) ([]*SessionRecord, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE 1=1`
+	var args []interface{}
+
+	if !filter.Since.IsZero() {
+		query += ` AND started_at >= ?`
+		args = append(args, toUnix(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND started_at < ?`
+		args = append(args, toUnix(filter.Until))
+	}
+	if filter.InstanceID != "" {
+		query += ` AND instance_id = ?`
+		args = append(args, filter.InstanceID)
+	}
+	query += ` ORDER BY started_at DESC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, filter.Limit)
+	}
+
+	return s.querySessions(query, args...)
+}
+
+// querySessions runs a session query and scans all rows
+func (s *Store) querySessions(query string, args ...interface{}) ([]*SessionRecord, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var records []*SessionRecord
+	for rows.Next() {
+		rec, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSession scans a single session row
+func scanSession(row scanner) (*SessionRecord, error) {
+	var rec SessionRecord
+	var cidrs, routes string
+	var startedAt int64
+	var endedAt, healthCheckedAt sql.NullInt64
+	var packetsTX, packetsRX, bytesTX, bytesRX int64
+	var healthIntervalMS int64
+
+	err := row.Scan(&rec.ID, &rec.Name, &rec.InstanceID, &rec.SessionID, &rec.TunDevice, &rec.TunIP,
+		&cidrs, &rec.PID, &startedAt, &endedAt, &rec.EndReason, &packetsTX, &packetsRX, &bytesTX, &bytesRX,
+		&rec.TunnelUp, &healthCheckedAt, &routes, &rec.SOCKSAddr, &rec.HealthError, &healthIntervalMS,
+		&rec.Drift.RoutesDrifted, &rec.Drift.RoutesRepaired, &rec.Drift.DNSDrifted, &rec.Drift.DNSRepaired,
+		&rec.Region, &rec.RoleARN)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan session: %w", err)
+	}
+
+	if cidrs != "" {
+		rec.CIDRBlocks = strings.Split(cidrs, ",")
+	}
+	if routes != "" {
+		rec.Routes = strings.Split(routes, ",")
+	}
+	rec.StartedAt = fromUnix(startedAt)
+	if endedAt.Valid {
+		rec.EndedAt = fromUnix(endedAt.Int64)
+	}
+	if healthCheckedAt.Valid {
+		rec.HealthCheckedAt = fromUnix(healthCheckedAt.Int64)
+	}
+	rec.HealthInterval = time.Duration(healthIntervalMS) * time.Millisecond
+	rec.PacketsTX = uint64(packetsTX)
+	rec.PacketsRX = uint64(packetsRX)
+	rec.BytesTX = uint64(bytesTX)
+	rec.BytesRX = uint64(bytesRX)
+
+	return &rec, nil
+}
@@ -0,0 +1,249 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver (no CGO)
+)
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when an insert violates a uniqueness constraint
+var ErrConflict = errors.New("conflict")
+
+// Store is the persistent SQLite-backed state store for sessions and stats
+type Store struct {
+	db   *sql.DB
+	path string
+}
+
+// migrations are applied in order; the index+1 is the schema version.
+// Never edit an existing migration - append a new one instead.
+var migrations = []string{
+	// 1: sessions and durable counters
+	`CREATE TABLE sessions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		name        TEXT    NOT NULL,
+		instance_id TEXT    NOT NULL DEFAULT '',
+		session_id  TEXT    NOT NULL DEFAULT '',
+		tun_device  TEXT    NOT NULL DEFAULT '',
+		tun_ip      TEXT    NOT NULL DEFAULT '',
+		cidr_blocks TEXT    NOT NULL DEFAULT '',
+		pid         INTEGER NOT NULL DEFAULT 0,
+		started_at  INTEGER NOT NULL,
+		ended_at    INTEGER,
+		end_reason  TEXT    NOT NULL DEFAULT '',
+		packets_tx  INTEGER NOT NULL DEFAULT 0,
+		packets_rx  INTEGER NOT NULL DEFAULT 0,
+		bytes_tx    INTEGER NOT NULL DEFAULT 0,
+		bytes_rx    INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX sessions_active_name ON sessions(name) WHERE ended_at IS NULL;
+	CREATE INDEX sessions_started_at ON sessions(started_at);
+	CREATE TABLE counters (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL DEFAULT 0
+	);`,
+
+	// 2: tunnel health reported by the running process
+	`ALTER TABLE sessions ADD COLUMN tunnel_up INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN health_checked_at INTEGER;`,
+
+	// 3: routes actually installed (may differ from cidr_blocks when split)
+	`ALTER TABLE sessions ADD COLUMN routes TEXT NOT NULL DEFAULT '';`,
+
+	// 4: local SOCKS5 address of the session's tunnel
+	`ALTER TABLE sessions ADD COLUMN socks_addr TEXT NOT NULL DEFAULT '';`,
+
+	// 5: prewarmed SSM/SSH channels
+	`CREATE TABLE prewarms (
+		name        TEXT PRIMARY KEY,
+		pid         INTEGER NOT NULL DEFAULT 0,
+		instance_id TEXT    NOT NULL DEFAULT '',
+		socks_addr  TEXT    NOT NULL DEFAULT '',
+		ready       INTEGER NOT NULL DEFAULT 0,
+		started_at  INTEGER NOT NULL,
+		expires_at  INTEGER
+	);`,
+
+	// 6: which health-check layer failed, and how often health is checked
+	`ALTER TABLE sessions ADD COLUMN health_error TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN health_interval_ms INTEGER NOT NULL DEFAULT 0;`,
+
+	// 7: route and DNS configuration drift seen by the health monitor
+	`ALTER TABLE sessions ADD COLUMN routes_drifted INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN routes_repaired INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN dns_drifted INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN dns_repaired INTEGER NOT NULL DEFAULT 0;`,
+
+	// 8: AWS region and role of sessions in another region or account
+	`ALTER TABLE sessions ADD COLUMN region TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN role_arn TEXT NOT NULL DEFAULT '';`,
+}
+
+// DefaultPath returns the default database location (~/.ssm-proxy/state.db)
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// Fallback to /tmp if can't get home dir
+		return "/tmp/ssm-proxy/state.db"
+	}
+	return filepath.Join(home, ".ssm-proxy", "state.db")
+}
+
+// Open opens (creating if needed) the database at path and applies any
+// pending migrations
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	// WAL lets `status` read while a running session writes; busy_timeout
+	// covers the short write windows of concurrent processes.
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db, path: path}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// The database may contain instance IDs and network layout
+	os.Chmod(path, 0600)
+
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Path returns the database file path
+func (s *Store) Path() string {
+	return s.path
+}
+
+// DB returns the underlying database handle
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// migrate applies all pending schema migrations, each inside a
+// transaction. Processes opening a new store at the same time (e.g. start
+// and status) take turns: each migration starts with BEGIN IMMEDIATE,
+// which waits for the write lock, and reads the schema version under it,
+// so a migration another process already applied is skipped.
+func (s *Store) migrate() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open state database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	for {
+		done, err := migrateOnce(ctx, conn)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateOnce applies the next pending migration, if any, under the write
+// lock; it reports whether the schema was already up to date
+func migrateOnce(ctx context.Context, conn *sql.Conn) (bool, error) {
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return false, fmt.Errorf("failed to lock state database for migration: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, `ROLLBACK`)
+		}
+	}()
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current >= len(migrations) {
+		return true, nil
+	}
+
+	version := current + 1
+	if _, err := conn.ExecContext(ctx, migrations[version-1]); err != nil {
+		return false, fmt.Errorf("failed to apply migration %d: %w", version, err)
+	}
+	if _, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+		return false, fmt.Errorf("failed to record migration %d: %w", version, err)
+	}
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return false, fmt.Errorf("failed to commit migration %d: %w", version, err)
+	}
+	committed = true
+	return false, nil
+}
+
+// AddCounters atomically adds the given deltas to named durable counters
+func (s *Store) AddCounters(deltas map[string]uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for name, delta := range deltas {
+		_, err := tx.Exec(`INSERT INTO counters (name, value) VALUES (?, ?)
+			ON CONFLICT(name) DO UPDATE SET value = value + excluded.value`, name, int64(delta))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update counter %s: %w", name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Counters returns all durable counters
+func (s *Store) Counters() (map[string]uint64, error) {
+	rows, err := s.db.Query(`SELECT name, value FROM counters`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query counters: %w", err)
+	}
+	defer rows.Close()
+
+	counters := make(map[string]uint64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan counter: %w", err)
+		}
+		counters[name] = uint64(value)
+	}
+	return counters, rows.Err()
+}
+
+// toUnix converts a time to the stored representation (unix nanoseconds)
+func toUnix(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+// fromUnix converts a stored timestamp back into a time.Time
+func fromUnix(v int64) time.Time {
+	return time.Unix(0, v)
+}
@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// Failure is the class of a tunnel failure, which decides how (and whether)
+// the tunnel is reconnected
+type Failure string
+
+const (
+	// FailureAuth is a missing, expired or invalid AWS credential, which
+	// may be renewed while the tunnel waits (e.g. 'aws sso login')
+	FailureAuth Failure = "auth"
+
+	// FailureAccessDenied is a credential that is not allowed to start the
+	// session; retrying does not help
+	FailureAccessDenied Failure = "access-denied"
+
+	// FailureThrottled is an AWS API rate limit
+	FailureThrottled Failure = "throttled"
+
+	// FailureTarget is an instance that is not connected to SSM, e.g. while
+	// it reboots
+	FailureTarget Failure = "target"
+
+	// FailureNetwork is any other failure, usually a network blip
+	FailureNetwork Failure = "network"
+)
+
+// Failures are all failure classes, in the order they are matched
+var Failures = []Failure{FailureAuth, FailureAccessDenied, FailureThrottled, FailureTarget, FailureNetwork}
+
+// failureMarkers are the AWS error codes and message fragments of each
+// class. Errors of the aws CLI (the ssh transport's proxy command) only
+// reach us as text, so messages are matched as well as codes.
+var failureMarkers = map[Failure][]string{
+	FailureAuth: {
+		"ExpiredToken", "InvalidClientTokenId", "UnrecognizedClientException",
+		"SignatureDoesNotMatch", "InvalidSignature", "security token included in the request is expired",
+		"failed to refresh cached credentials", "no valid credential", "SSO session", "token has expired",
+	},
+	FailureAccessDenied: {
+		"AccessDenied", "UnauthorizedOperation", "not authorized to perform",
+	},
+	FailureThrottled: {
+		"Throttl", "TooManyRequests", "RequestLimitExceeded", "Rate exceeded", "SlowDown",
+	},
+	FailureTarget: {
+		"TargetNotConnected", "InvalidInstanceId", "EC2InstanceNotFound", "EC2InstanceStateInvalid",
+		"EC2InstanceUnavailable", "is not connected",
+	},
+}
+
+// ParseFailure parses a failure class name
+func ParseFailure(s string) (Failure, error) {
+	for _, f := range Failures {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	names := make([]string, len(Failures))
+	for i, f := range Failures {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("invalid failure class %q (expected %s)", s, strings.Join(names, ", "))
+}
+
+// Classify returns the class of a failure to start or keep up a tunnel
+func Classify(err error) Failure {
+	if err == nil {
+		return FailureNetwork
+	}
+
+	text := err.Error()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		text = apiErr.ErrorCode() + " " + text
+	}
+
+	for _, f := range Failures {
+		for _, marker := range failureMarkers[f] {
+			if strings.Contains(text, marker) {
+				return f
+			}
+		}
+	}
+	return FailureNetwork
+}
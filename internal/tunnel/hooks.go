@@ -0,0 +1,33 @@
+package tunnel
+
+import "github.com/aws/aws-sdk-go-v2/aws"
+
+// Hooks for the integration tests, which stand in for what LocalStack does
+// not emulate: they run the ssh transport against a container running sshd.
+// They are nil otherwise.
+var (
+	// SSHProxyCommandHook, if set, returns the ProxyCommand ssh reaches the
+	// instance with, in place of the SSM session started by ssmCommand
+	SSHProxyCommandHook func(ssmCommand string) string
+
+	// PushSSHKeyHook, if set, authorizes publicKey for user on the
+	// instance in place of EC2 Instance Connect
+	PushSSHKeyHook func(instanceID, user, publicKey string) error
+)
+
+// sshProxyCommand returns the ProxyCommand ssh reaches the instance with:
+// the SSM session started by ssmCommand
+func sshProxyCommand(ssmCommand string) string {
+	if SSHProxyCommandHook != nil {
+		return SSHProxyCommandHook(ssmCommand)
+	}
+	return ssmCommand
+}
+
+// pushSSHKey authorizes publicKey for user on the instance
+func pushSSHKey(cfg aws.Config, instanceID, availabilityZone, user, publicKey string) error {
+	if PushSSHKeyHook != nil {
+		return PushSSHKeyHook(instanceID, user, publicKey)
+	}
+	return SendSSHPublicKeyToInstance(cfg, instanceID, availabilityZone, user, publicKey)
+}
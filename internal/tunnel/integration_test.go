@@ -0,0 +1,219 @@
+//go:build integration
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// The integration tests run the ssh transport against the container
+// running sshd of scripts/integration/run.sh (make integration), which
+// sets SSM_PROXY_IT_SSH_ADDR to its address and SSM_PROXY_IT_KEYS_DIR to
+// the directory of its authorized_keys. The web server behind it is at
+// itWebAddr.
+
+// itWebAddr is the web server on the container's network
+const itWebAddr = "172.30.99.10:80"
+
+// itInstanceID is the instance the tunnels are for; ssh never reaches it
+// through SSM
+const itInstanceID = "i-0123456789abcdef0"
+
+// sshFixture returns the address of the sshd container and the path of its
+// authorized_keys, and points ssh at the container until the test ends.
+// Keys pushed with authorize are added to authorized_keys.
+func sshFixture(t *testing.T, authorize bool) (addr, authorizedKeys string) {
+	t.Helper()
+	addr = os.Getenv("SSM_PROXY_IT_SSH_ADDR")
+	dir := os.Getenv("SSM_PROXY_IT_KEYS_DIR")
+	if addr == "" || dir == "" {
+		t.Skip("SSM_PROXY_IT_SSH_ADDR or SSM_PROXY_IT_KEYS_DIR is not set (run: sudo make integration)")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("invalid SSM_PROXY_IT_SSH_ADDR %q: %v", addr, err)
+	}
+	authorizedKeys = filepath.Join(dir, "authorized_keys")
+
+	SSHProxyCommandHook = func(string) string {
+		return fmt.Sprintf("nc %s %s", host, port)
+	}
+	PushSSHKeyHook = func(instanceID, user, publicKey string) error {
+		if instanceID != itInstanceID || user != DefaultSSHUser {
+			return fmt.Errorf("key pushed for %s@%s", user, instanceID)
+		}
+		if !authorize {
+			return nil
+		}
+		f, err := os.OpenFile(authorizedKeys, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, strings.TrimSpace(publicKey))
+		return err
+	}
+	t.Cleanup(func() {
+		SSHProxyCommandHook = nil
+		PushSSHKeyHook = nil
+	})
+	return addr, authorizedKeys
+}
+
+// freePort returns a free TCP port of 127.0.0.1
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// getThroughSOCKS fetches http://addr/ through the SOCKS5 proxy at
+// socksAddr and returns the response's Server header
+func getThroughSOCKS(socksAddr, addr string) (string, error) {
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		return "", err
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "GET / HTTP/1.0\r\nHost: %s\r\n\r\n", addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	return resp.Header.Get("Server"), nil
+}
+
+func TestSSHTunnel(t *testing.T) {
+	_, authorizedKeys := sshFixture(t, true)
+
+	tun := NewSSHTunnel(SSHTunnelConfig{
+		InstanceID:     itInstanceID,
+		Region:         "us-east-1",
+		SOCKSPort:      freePort(t),
+		TempKey:        true,
+		NonInteractive: true,
+		ConnectTimeout: 15 * time.Second,
+	})
+	if err := tun.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer tun.Stop()
+
+	// The temporary key is the one pushed to the instance
+	keys, err := os.ReadFile(authorizedKeys)
+	if err != nil {
+		t.Fatalf("failed to read authorized_keys: %v", err)
+	}
+	privateKeyPath := tun.keyPair.PrivateKeyPath
+	if !strings.Contains(string(keys), strings.TrimSpace(tun.keyPair.PublicKey)) {
+		t.Errorf("the temporary key is not in authorized_keys")
+	}
+
+	if !tun.IsRunning() {
+		t.Fatal("tunnel not running after Start")
+	}
+	server, err := getThroughSOCKS(tun.SOCKSAddr(), itWebAddr)
+	if err != nil {
+		t.Fatalf("no response from %s through the tunnel: %v", itWebAddr, err)
+	}
+	if !strings.Contains(server, "nginx") {
+		t.Errorf("response from %s through the tunnel is from %q, want nginx", itWebAddr, server)
+	}
+
+	if err := tun.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if tun.IsRunning() {
+		t.Error("tunnel still running after Stop")
+	}
+	if _, err := os.Stat(privateKeyPath); !os.IsNotExist(err) {
+		t.Errorf("temporary key %s left behind after Stop (%v)", privateKeyPath, err)
+	}
+	if err := tun.TestConnection(context.Background()); err == nil {
+		t.Error("SOCKS port still accepting after Stop")
+	}
+}
+
+func TestSSHTunnelRestart(t *testing.T) {
+	sshFixture(t, true)
+
+	tun := NewSSHTunnel(SSHTunnelConfig{
+		InstanceID:     itInstanceID,
+		Region:         "us-east-1",
+		SOCKSPort:      freePort(t),
+		TempKey:        true,
+		NonInteractive: true,
+		ConnectTimeout: 15 * time.Second,
+	})
+	if err := tun.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer tun.Stop()
+
+	// A failed ssh process is noticed, and the tunnel can be started again
+	if err := tun.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tun.IsRunning() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if tun.IsRunning() {
+		t.Fatal("tunnel still running after its ssh process was killed")
+	}
+
+	if err := tun.Start(context.Background()); err != nil {
+		t.Fatalf("Start after Disconnect: %v", err)
+	}
+	if _, err := getThroughSOCKS(tun.SOCKSAddr(), itWebAddr); err != nil {
+		t.Errorf("no response from %s through the restarted tunnel: %v", itWebAddr, err)
+	}
+}
+
+func TestSSHTunnelUnauthorizedKey(t *testing.T) {
+	sshFixture(t, false)
+
+	tun := NewSSHTunnel(SSHTunnelConfig{
+		InstanceID:     itInstanceID,
+		Region:         "us-east-1",
+		SOCKSPort:      freePort(t),
+		TempKey:        true,
+		NonInteractive: true,
+		ConnectTimeout: 5 * time.Second,
+	})
+	err := tun.Start(context.Background())
+	if err == nil {
+		tun.Stop()
+		t.Fatal("Start succeeded with a key the instance does not accept")
+	}
+	if tun.IsRunning() {
+		t.Error("tunnel running after a failed Start")
+	}
+}
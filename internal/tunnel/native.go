@@ -0,0 +1,356 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	awsclient "github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/socks"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// keepAliveCountMax is the number of unanswered SSH keepalives after which
+// the connection is considered dead (like ssh's ServerAliveCountMax)
+const keepAliveCountMax = 3
+
+// NativeTunnel provides the same SOCKS5 proxy as SSHTunnel without the ssh
+// and aws binaries: the SSH connection runs in process over an SSM session
+// to the instance's port 22 (AWS-StartSSHSession), and dynamic forwarding
+// is served by a local SOCKS5 server.
+type NativeTunnel struct {
+	config SSHTunnelConfig
+
+	mu       sync.RWMutex
+	running  bool
+	session  *ssm.Session
+	client   *ssh.Client
+	listener net.Listener
+	server   *socks.Server
+	keyPair  *SSHKeyPair
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+// NewNativeTunnel creates a new in-process tunnel manager
+func NewNativeTunnel(config SSHTunnelConfig) *NativeTunnel {
+	return &NativeTunnel{config: config.withDefaults()}
+}
+
+// Start opens the SSM session, connects the SSH client over it and starts
+// serving SOCKS5 on the local port
+func (t *NativeTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return fmt.Errorf("SSH tunnel already running")
+	}
+
+	// A previous run's temporary key is not reused for a restart
+	if t.keyPair != nil {
+		t.keyPair.Cleanup()
+		t.keyPair = nil
+	}
+
+	sshLog.WithFields(logrus.Fields{
+		"instance_id": t.config.InstanceID,
+		"region":      t.config.Region,
+		"socks_port":  t.config.SOCKSPort,
+	}).Info("Starting in-process SSH tunnel over SSM")
+
+	signer, keyPair, err := loadSSHSigner(t.config.TempKey)
+	if err != nil {
+		return err
+	}
+	t.keyPair = keyPair
+
+	if err := t.connect(ctx, signer); err != nil {
+		if t.keyPair != nil {
+			t.keyPair.Cleanup()
+			t.keyPair = nil
+		}
+		return err
+	}
+
+	t.running = true
+	t.stopCh = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.serve(t.session, t.client, t.listener, t.server, t.stopCh, t.done)
+	go t.keepAlive(t.client, t.stopCh)
+
+	sshLog.Info("SSH tunnel started successfully")
+	return nil
+}
+
+// connect pushes the public key, opens the SSM session, runs the SSH
+// handshake over it and listens on the SOCKS5 port. Must be called with mu
+// held.
+func (t *NativeTunnel) connect(ctx context.Context, signer ssh.Signer) error {
+	// Send SSH public key to instance via EC2 Instance Connect
+	publicKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if !awsclient.UsesInstanceConnect(t.config.InstanceID) {
+		if t.keyPair != nil {
+			return errNoInstanceConnect(t.config.InstanceID)
+		}
+		sshLog.Infof("%s has no EC2 Instance Connect, expecting the SSH key to be authorized there", t.config.InstanceID)
+	} else {
+		sshLog.Info("Sending SSH public key to instance via EC2 Instance Connect...")
+		err := pushSSHKey(t.config.AWSConfig, t.config.InstanceID, t.config.AvailabilityZone, t.config.SSHUser, publicKey)
+		if err != nil {
+			return fmt.Errorf("failed to send SSH key via Instance Connect: %w", err)
+		}
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, t.config.ConnectTimeout)
+	defer cancel()
+
+	ssmClient, err := ssm.NewClient(connectCtx, awsclient.NewClientFromConfig(t.config.AWSConfig), t.config.InstanceID)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %w", err)
+	}
+	ssmClient.SetTimeout(t.config.ConnectTimeout)
+	ssmClient.SetKeepAlive(t.config.KeepAlive)
+	ssmClient.SetRecorder(t.config.Recorder)
+
+	session, err := ssmClient.StartPortSession(connectCtx, 22)
+	if err != nil {
+		return fmt.Errorf("failed to open SSM session to port 22: %w", err)
+	}
+
+	// The SSH handshake is bounded by the connect timeout, like ssh's
+	// ConnectTimeout
+	session.SetDeadline(time.Now().Add(t.config.ConnectTimeout))
+	conn, chans, reqs, err := ssh.NewClientConn(session, t.config.InstanceID, &ssh.ClientConfig{
+		User: t.config.SSHUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// Instance host keys are not known in advance (StrictHostKeyChecking=no)
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         t.config.ConnectTimeout,
+	})
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("SSH handshake over SSM failed: %w", err)
+	}
+	session.SetDeadline(time.Time{})
+	client := ssh.NewClient(conn, chans, reqs)
+
+	listener, err := net.Listen("tcp", t.SOCKSAddr())
+	if err != nil {
+		client.Close()
+		session.Close()
+		return fmt.Errorf("failed to listen on SOCKS5 port %d: %w", t.config.SOCKSPort, err)
+	}
+
+	t.session = session
+	t.client = client
+	t.listener = listener
+	t.server = &socks.Server{Dial: client.DialContext, HandshakeTimeout: t.config.ConnectTimeout}
+	return nil
+}
+
+// serve runs the SOCKS5 server until the SSH connection ends, then tears
+// the run down, terminating its SSM session
+func (t *NativeTunnel) serve(session *ssm.Session, client *ssh.Client, listener net.Listener, server *socks.Server,
+	stopCh <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	go server.Serve(listener)
+	err := client.Wait()
+
+	listener.Close()
+	server.Close()
+	session.Close()
+
+	t.mu.Lock()
+	if t.client == client {
+		t.running = false
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-stopCh:
+		// Intentional stop
+		sshLog.Info("SSH tunnel stopped")
+	default:
+		// Unexpected exit
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			sshLog.Errorf("SSH tunnel exited unexpectedly: %v", err)
+		} else {
+			sshLog.Warn("SSH tunnel exited unexpectedly")
+		}
+	}
+}
+
+// keepAlive sends SSH keepalive requests every KeepAlive interval and
+// closes the connection after keepAliveCountMax of them go unanswered
+func (t *NativeTunnel) keepAlive(client *ssh.Client, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(t.config.KeepAlive)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case <-stopCh:
+			return
+		case err := <-replied:
+			if err != nil {
+				// The connection is gone, serve tears the run down
+				return
+			}
+			missed = 0
+			continue
+		case <-time.After(t.config.KeepAlive):
+		}
+
+		missed++
+		sshLog.Warnf("SSH keepalive unanswered (%d/%d)", missed, keepAliveCountMax)
+		if missed >= keepAliveCountMax {
+			sshLog.Error("SSH server not responding, closing the tunnel")
+			client.Close()
+			return
+		}
+	}
+}
+
+// Disconnect drops the SSM session as if it had failed, for fault
+// injection: the tunnel goes down without being stopped, so it is detected
+// and reconnected like a real failure
+func (t *NativeTunnel) Disconnect() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.running {
+		return fmt.Errorf("SSH tunnel is not running")
+	}
+	return t.session.Close()
+}
+
+// Stop closes the SOCKS5 listener, the SSH connection and the SSM session
+func (t *NativeTunnel) Stop() error {
+	t.mu.Lock()
+
+	if !t.running {
+		t.mu.Unlock()
+		return nil
+	}
+
+	sshLog.Info("Stopping SSH tunnel")
+	close(t.stopCh)
+	t.client.Close()
+	done := t.done
+	t.mu.Unlock()
+
+	// Wait for serve to finish (with timeout)
+	select {
+	case <-done:
+		sshLog.Debug("SSH tunnel stopped cleanly")
+	case <-time.After(5 * time.Second):
+		sshLog.Warn("Timeout waiting for SSH tunnel to stop")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var err error
+	if t.session != nil {
+		if closeErr := t.session.Close(); closeErr != nil {
+			err = fmt.Errorf("failed to close SSM session: %w", closeErr)
+		}
+		t.session = nil
+	}
+
+	// Clean up temporary SSH keys
+	if t.keyPair != nil {
+		if err := t.keyPair.Cleanup(); err != nil {
+			sshLog.Warnf("Failed to cleanup temporary SSH keys: %v", err)
+		}
+		t.keyPair = nil
+	}
+
+	t.running = false
+	return err
+}
+
+// IsRunning returns whether the SSH connection is up
+func (t *NativeTunnel) IsRunning() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.running
+}
+
+// SOCKSAddr returns the SOCKS5 proxy address
+func (t *NativeTunnel) SOCKSAddr() string {
+	return fmt.Sprintf("127.0.0.1:%d", t.config.SOCKSPort)
+}
+
+// SessionID returns the ID of the SSM session carrying the SSH connection,
+// "" while there is none
+func (t *NativeTunnel) SessionID() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.session == nil {
+		return ""
+	}
+	return t.session.SessionID()
+}
+
+// loadSSHSigner returns the signer for the user's SSH key, or for a new
+// temporary key pair (returned for cleanup) if there is none or tempKey is
+// set
+func loadSSHSigner(tempKey bool) (ssh.Signer, *SSHKeyPair, error) {
+	if !tempKey {
+		if existingKey, exists := CheckExistingSSHKey(); exists {
+			sshLog.Infof("Using existing SSH key: %s", existingKey)
+			signer, err := parseSSHPrivateKey(existingKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load existing key (use --temp-key for passphrase-protected keys): %w", err)
+			}
+			return signer, nil, nil
+		}
+		sshLog.Info("No existing SSH key found, generating temporary key pair")
+	} else {
+		sshLog.Info("Generating temporary SSH key pair (--temp-key flag set)")
+	}
+
+	keyPair, err := GenerateTemporarySSHKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate temporary SSH key: %w", err)
+	}
+	signer, err := parseSSHPrivateKey(keyPair.PrivateKeyPath)
+	if err != nil {
+		keyPair.Cleanup()
+		return nil, nil, err
+	}
+	return signer, keyPair, nil
+}
+
+// parseSSHPrivateKey reads a private key file
+func parseSSHPrivateKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key (supported formats: OpenSSH, PEM RSA, PEM PKCS8): %w", err)
+	}
+	return signer, nil
+}
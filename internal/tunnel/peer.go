@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PeerAddress returns the address at the other end of the TUN device's
+// point-to-point link: the other host address in the subnet of ipAddr
+// ("169.254.169.1/30" -> 169.254.169.2). It is used as the next hop for
+// gateway routes.
+func PeerAddress(ipAddr string) (net.IP, error) {
+	ip, network, err := net.ParseCIDR(ipAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address format, expected x.x.x.x/y: %w", err)
+	}
+	ip = ip.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", ipAddr)
+	}
+
+	ones, bits := network.Mask.Size()
+	if ones > 31 {
+		return nil, fmt.Errorf("%s has no room for a peer address (use a /31 or larger subnet)", ipAddr)
+	}
+
+	local := binary.BigEndian.Uint32(ip)
+	first := binary.BigEndian.Uint32(network.IP.To4())
+	last := first | (1<<(bits-ones) - 1)
+	if ones < 31 {
+		// Skip the network and broadcast addresses
+		first++
+		last--
+	}
+
+	for candidate := first; candidate <= last; candidate++ {
+		if candidate != local {
+			peer := make(net.IP, 4)
+			binary.BigEndian.PutUint32(peer, candidate)
+			return peer, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no room for a peer address", ipAddr)
+}
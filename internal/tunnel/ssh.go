@@ -5,17 +5,50 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsclient "github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/record"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
 	"github.com/sirupsen/logrus"
 )
 
 var sshLog = logrus.New()
 
+// childCredential is the user ssh runs as, nil for that of this process
+var childCredential *syscall.Credential
+
+// SetChildCredential has ssh, and the temporary key it reads, belong to
+// the user uid and gid from the start, so that a process dropping its root
+// privileges to that user can still stop and restart it
+func SetChildCredential(uid, gid uint32) {
+	childCredential = &syscall.Credential{Uid: uid, Gid: gid}
+}
+
+// childCredentialForStart returns the credential to start ssh with: none
+// once this process no longer runs as root, when ssh runs as its user anyway
+func childCredentialForStart() *syscall.Credential {
+	if childCredential == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	return childCredential
+}
+
+// sshSessionDocument is the SSM document of the sessions carrying SSH
+const sshSessionDocument = "AWS-StartSSHSession"
+
+// DefaultSSHUser is the user logged in as on the instance, that of Amazon
+// Linux
+const DefaultSSHUser = "ec2-user"
+
 // SSHTunnel manages an SSH tunnel with dynamic SOCKS5 forwarding over SSM
 type SSHTunnel struct {
 	instanceID       string
@@ -32,6 +65,15 @@ type SSHTunnel struct {
 	sshUser          string
 	keyPair          *SSHKeyPair
 	tempKey          bool
+	nonInteractive   bool
+	keepAlive        time.Duration
+	connectTimeout   time.Duration
+	compression      bool
+	credentialsEnv   bool
+
+	// sessionID is the SSM session the aws CLI started for the current or
+	// last run, "" until it is looked up
+	sessionID string
 }
 
 // SSHTunnelConfig holds configuration for SSH tunnel
@@ -44,16 +86,54 @@ type SSHTunnelConfig struct {
 	SOCKSPort        int
 	SSHUser          string
 	TempKey          bool
+
+	// KeepAlive is the SSH ServerAliveInterval (rounded up to whole seconds)
+	KeepAlive time.Duration
+
+	// ConnectTimeout bounds the SSH connection and the wait for the SOCKS5
+	// port to come up
+	ConnectTimeout time.Duration
+
+	// NonInteractive prevents ssh and its ProxyCommand from ever prompting
+	// (password, passphrase, MFA) by enabling BatchMode and detaching them
+	// from the controlling terminal
+	NonInteractive bool
+
+	// Compression enables SSH compression (ssh transport only; Go's SSH
+	// client does not compress)
+	Compression bool
+
+	// CredentialsEnv passes the credentials of AWSConfig to the aws CLI
+	// running the SSM session through its environment instead of naming
+	// AWSProfile, for credentials the CLI cannot get itself, such as those
+	// of a role assumed with an MFA code (ssh transport only)
+	CredentialsEnv bool
+
+	// Recorder records the SSM session's messages (native transport only;
+	// the ssh transport's session runs in the session-manager-plugin)
+	Recorder *record.Writer
 }
 
-// NewSSHTunnel creates a new SSH tunnel manager
-func NewSSHTunnel(config SSHTunnelConfig) *SSHTunnel {
+// withDefaults returns the configuration with unset fields defaulted
+func (config SSHTunnelConfig) withDefaults() SSHTunnelConfig {
 	if config.SOCKSPort == 0 {
 		config.SOCKSPort = 1080 // Default SOCKS5 port
 	}
 	if config.SSHUser == "" {
-		config.SSHUser = "ec2-user" // Default for Amazon Linux
+		config.SSHUser = DefaultSSHUser
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = 30 * time.Second
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 30 * time.Second
 	}
+	return config
+}
+
+// NewSSHTunnel creates a new SSH tunnel manager
+func NewSSHTunnel(config SSHTunnelConfig) *SSHTunnel {
+	config = config.withDefaults()
 
 	return &SSHTunnel{
 		instanceID:       config.InstanceID,
@@ -64,8 +144,11 @@ func NewSSHTunnel(config SSHTunnelConfig) *SSHTunnel {
 		socksPort:        config.SOCKSPort,
 		sshUser:          config.SSHUser,
 		tempKey:          config.TempKey,
-		stopCh:           make(chan struct{}),
-		stoppedCh:        make(chan struct{}),
+		nonInteractive:   config.NonInteractive,
+		keepAlive:        config.KeepAlive,
+		connectTimeout:   config.ConnectTimeout,
+		compression:      config.Compression,
+		credentialsEnv:   config.CredentialsEnv,
 	}
 }
 
@@ -78,6 +161,19 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 		return fmt.Errorf("SSH tunnel already running")
 	}
 
+	// A previous run's temporary key is not reused for a restart
+	if t.keyPair != nil {
+		t.keyPair.Cleanup()
+		t.keyPair = nil
+	}
+
+	// Nor is the SSM session of a run whose ssh process died: it would stay
+	// active until it times out
+	if t.sessionID != "" {
+		t.terminateSession(t.sessionID)
+		t.sessionID = ""
+	}
+
 	sshLog.WithFields(logrus.Fields{
 		"instance_id": t.instanceID,
 		"region":      t.region,
@@ -117,9 +213,14 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	}
 
 	// Send SSH public key to instance via EC2 Instance Connect
-	sshLog.Info("Sending SSH public key to instance via EC2 Instance Connect...")
-	err = SendSSHPublicKeyToInstance(t.awsConfig, t.instanceID, t.availabilityZone, t.sshUser, publicKey)
-	if err != nil {
+	if !awsclient.UsesInstanceConnect(t.instanceID) {
+		if t.keyPair != nil {
+			t.keyPair.Cleanup()
+			t.keyPair = nil
+			return errNoInstanceConnect(t.instanceID)
+		}
+		sshLog.Infof("%s has no EC2 Instance Connect, expecting %s to be authorized there", t.instanceID, privateKeyPath)
+	} else if err := pushSSHKey(t.awsConfig, t.instanceID, t.availabilityZone, t.sshUser, publicKey); err != nil {
 		if t.keyPair != nil {
 			t.keyPair.Cleanup()
 		}
@@ -131,10 +232,18 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	}
 
 	// Build SSH command with SSM ProxyCommand
-	proxyCommand := fmt.Sprintf("aws ssm start-session --target %s --document-name AWS-StartSSHSession --parameters 'portNumber=%%p' --region %s",
-		t.instanceID, t.region)
-
-	if t.awsProfile != "" {
+	proxyCommand := fmt.Sprintf("aws ssm start-session --target %s --document-name %s --parameters 'portNumber=%%p' --region %s",
+		t.instanceID, sshSessionDocument, t.region)
+
+	var env []string
+	if t.credentialsEnv {
+		if env, err = t.credentialsEnviron(ctx); err != nil {
+			if t.keyPair != nil {
+				t.keyPair.Cleanup()
+			}
+			return err
+		}
+	} else if t.awsProfile != "" {
 		proxyCommand += fmt.Sprintf(" --profile %s", t.awsProfile)
 	}
 
@@ -144,16 +253,28 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 		"-i", privateKeyPath, // Use the SSH private key
 		"-o", "StrictHostKeyChecking=no", // Don't check host keys
 		"-o", "UserKnownHostsFile=/dev/null", // Don't save known hosts
-		"-o", "ServerAliveInterval=30", // Keep connection alive
+		"-o", fmt.Sprintf("ServerAliveInterval=%d", wholeSeconds(t.keepAlive)), // Keep connection alive
 		"-o", "ServerAliveCountMax=3", // Max missed keepalives
-		"-o", "ConnectTimeout=10", // Connection timeout (shorter since key is fresh)
-		"-o", fmt.Sprintf("ProxyCommand=%s", proxyCommand),
-		fmt.Sprintf("%s@%s", t.sshUser, t.instanceID),
+		"-o", fmt.Sprintf("ConnectTimeout=%d", wholeSeconds(t.connectTimeout)), // Connection timeout
+		"-o", fmt.Sprintf("ProxyCommand=%s", sshProxyCommand(proxyCommand)),
 	}
+	if t.nonInteractive {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	if t.compression {
+		args = append(args, "-o", "Compression=yes")
+	}
+	args = append(args, fmt.Sprintf("%s@%s", t.sshUser, t.instanceID))
 
 	sshLog.Debugf("SSH command: ssh %s", strings.Join(args, " "))
 
 	t.cmd = exec.CommandContext(ctx, "ssh", args...)
+	t.cmd.Env = env
+	t.cmd.SysProcAttr = &syscall.SysProcAttr{Credential: childCredentialForStart()}
+	if t.nonInteractive {
+		// Without a controlling terminal nothing can open /dev/tty to prompt
+		t.cmd.SysProcAttr.Setsid = true
+	}
 
 	// Capture stderr for debugging
 	stderr, errPipe := t.cmd.StderrPipe()
@@ -165,6 +286,7 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	}
 
 	// Start SSH command
+	startedAt := time.Now()
 	if err := t.cmd.Start(); err != nil {
 		if t.keyPair != nil {
 			t.keyPair.Cleanup()
@@ -190,7 +312,7 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	}()
 
 	// Wait for SOCKS5 port to be available
-	if err := t.waitForSOCKS(ctx, 30*time.Second); err != nil {
+	if err := t.waitForSOCKS(ctx, t.connectTimeout); err != nil {
 		t.cmd.Process.Kill()
 		if t.keyPair != nil {
 			t.keyPair.Cleanup()
@@ -200,13 +322,22 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 
 	t.running = true
 
-	// Monitor SSH process
-	go t.monitor()
+	// Monitor SSH process; each run gets its own stop channels so that the
+	// tunnel can be restarted
+	t.stopCh = make(chan struct{})
+	t.stoppedCh = make(chan struct{})
+	go t.monitor(t.cmd, t.stopCh, t.stoppedCh)
+	go t.findSession(t.cmd, startedAt)
 
 	sshLog.Info("SSH tunnel started successfully")
 	return nil
 }
 
+// wholeSeconds rounds d up to whole seconds, as ssh options take integers
+func wholeSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
 // waitForSOCKS waits for the SOCKS5 port to become available
 func (t *SSHTunnel) waitForSOCKS(ctx context.Context, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
@@ -233,18 +364,20 @@ func (t *SSHTunnel) waitForSOCKS(ctx context.Context, timeout time.Duration) err
 }
 
 // monitor monitors the SSH process and handles cleanup
-func (t *SSHTunnel) monitor() {
-	defer close(t.stoppedCh)
+func (t *SSHTunnel) monitor(cmd *exec.Cmd, stopCh <-chan struct{}, stoppedCh chan<- struct{}) {
+	defer close(stoppedCh)
 
 	// Wait for SSH process to exit
-	err := t.cmd.Wait()
+	err := cmd.Wait()
 
 	t.mu.Lock()
-	t.running = false
+	if t.cmd == cmd {
+		t.running = false
+	}
 	t.mu.Unlock()
 
 	select {
-	case <-t.stopCh:
+	case <-stopCh:
 		// Intentional stop
 		sshLog.Info("SSH tunnel stopped")
 	default:
@@ -257,12 +390,24 @@ func (t *SSHTunnel) monitor() {
 	}
 }
 
+// Disconnect kills the ssh process as if it had failed, for fault
+// injection: the tunnel goes down without being stopped, so it is detected
+// and reconnected like a real failure
+func (t *SSHTunnel) Disconnect() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.running || t.cmd == nil || t.cmd.Process == nil {
+		return fmt.Errorf("SSH tunnel is not running")
+	}
+	return t.cmd.Process.Kill()
+}
+
 // Stop stops the SSH tunnel
 func (t *SSHTunnel) Stop() error {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 
 	if !t.running {
+		t.mu.Unlock()
 		return nil
 	}
 
@@ -283,14 +428,27 @@ func (t *SSHTunnel) Stop() error {
 		}
 	}
 
+	// The monitor takes the lock when the process exits, so wait unlocked
+	stoppedCh := t.stoppedCh
+	t.mu.Unlock()
+
 	// Wait for monitor to finish (with timeout)
 	select {
-	case <-t.stoppedCh:
+	case <-stoppedCh:
 		sshLog.Debug("SSH tunnel stopped cleanly")
 	case <-time.After(5 * time.Second):
 		sshLog.Warn("Timeout waiting for SSH tunnel to stop")
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Killing the aws CLI leaves its SSM session active
+	if t.sessionID != "" {
+		t.terminateSession(t.sessionID)
+		t.sessionID = ""
+	}
+
 	// Clean up temporary SSH keys
 	if t.keyPair != nil {
 		if err := t.keyPair.Cleanup(); err != nil {
@@ -303,6 +461,82 @@ func (t *SSHTunnel) Stop() error {
 	return nil
 }
 
+// SessionID returns the ID of the SSM session the aws CLI started, "" while
+// it is not known
+func (t *SSHTunnel) SessionID() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.sessionID
+}
+
+// findSession looks up the SSM session the aws CLI started for the ssh
+// process cmd, which only the session-manager-plugin knows the ID of
+func (t *SSHTunnel) findSession(cmd *exec.Cmd, startedAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	client, err := ssm.NewClient(ctx, awsclient.NewClientFromConfig(t.awsConfig), t.instanceID)
+	if err == nil {
+		var id string
+		if id, err = client.FindSession(ctx, sshSessionDocument, startedAt); err == nil {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.cmd != cmd || !t.running {
+				// Stopped or restarted meanwhile: the session is over
+				t.terminateSession(id)
+				return
+			}
+			t.sessionID = id
+			sshLog.Infof("SSM session: %s", id)
+			return
+		}
+	}
+	sshLog.Debugf("Failed to look up the SSM session: %v", err)
+}
+
+// IsSSHProcess reports whether a command line is that of the ssh process
+// of an ssh transport tunnel (its aws CLI proxy command exits with it)
+func IsSSHProcess(args []string) bool {
+	return len(args) > 0 && filepath.Base(args[0]) == "ssh" &&
+		slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, sshSessionDocument) })
+}
+
+// credentialsEnviron returns the environment of the ssh process with the
+// current credentials of the AWS config added for the aws CLI. They are
+// fetched again on every start, so a reconnect gets refreshed ones.
+func (t *SSHTunnel) credentialsEnviron(ctx context.Context) ([]string, error) {
+	creds, err := t.awsConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	env := append(os.Environ(),
+		"AWS_ACCESS_KEY_ID="+creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY="+creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN="+creds.SessionToken,
+		"AWS_REGION="+t.region,
+	)
+	// A profile in the environment would not be used, but is confusing
+	return slices.DeleteFunc(env, func(v string) bool {
+		return strings.HasPrefix(v, "AWS_PROFILE=")
+	}), nil
+}
+
+// terminateSession ends an SSM session started by the aws CLI
+func (t *SSHTunnel) terminateSession(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := ssm.NewClient(ctx, awsclient.NewClientFromConfig(t.awsConfig), t.instanceID)
+	if err == nil {
+		err = client.TerminateSession(ctx, id)
+	}
+	if err != nil {
+		sshLog.Warnf("Failed to terminate SSM session: %v", err)
+		return
+	}
+	sshLog.Debugf("Terminated SSM session %s", id)
+}
+
 // IsRunning returns whether the SSH tunnel is running
 func (t *SSHTunnel) IsRunning() bool {
 	t.mu.RLock()
@@ -335,3 +569,8 @@ func (t *SSHTunnel) TestConnection(ctx context.Context) error {
 
 	return nil
 }
+
+// SetLogger sets the logger for the SSH tunnels
+func SetLogger(logger *logrus.Logger) {
+	sshLog = logger
+}
@@ -59,6 +59,16 @@ func GenerateTemporarySSHKey() (*SSHKeyPair, error) {
 	}
 	privateKeyFile.Close()
 
+	// ssh may run as another user (see SetChildCredential)
+	if cred := childCredentialForStart(); cred != nil {
+		for _, path := range []string{tempDir, privateKeyPath} {
+			if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+				os.RemoveAll(tempDir)
+				return nil, fmt.Errorf("failed to set owner of temporary SSH key: %w", err)
+			}
+		}
+	}
+
 	// Generate OpenSSH public key
 	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
 	if err != nil {
@@ -86,6 +96,14 @@ func (k *SSHKeyPair) Cleanup() error {
 	return nil
 }
 
+// errNoInstanceConnect is returned for a generated key on a target without
+// EC2 Instance Connect (managed instances, ECS tasks): nothing could
+// authorize it there
+func errNoInstanceConnect(instanceID string) error {
+	return fmt.Errorf("%s does not support EC2 Instance Connect, so a temporary SSH key cannot be sent to it: "+
+		"add a key from ~/.ssh to the SSH user's authorized_keys on it and do not use --temp-key", instanceID)
+}
+
 // SendSSHPublicKeyToInstance sends the SSH public key to an EC2 instance using Instance Connect
 func SendSSHPublicKeyToInstance(cfg aws.Config, instanceID, availabilityZone, osUser, publicKey string) error {
 	client := ec2instanceconnect.NewFromConfig(cfg)
@@ -3,11 +3,15 @@ package tunnel
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"unsafe"
 
+	"github.com/sbkg0002/ssm-proxy/internal/helper"
 	"golang.org/x/sys/unix"
 )
 
@@ -16,6 +20,9 @@ const (
 	SYSPROTO_CONTROL  = 2
 	UTUN_OPT_IFNAME   = 2
 	UTUN_CONTROL_NAME = "com.apple.net.utun_control"
+
+	// DeviceNamePrefix is the name prefix of the utun devices we create
+	DeviceNamePrefix = "utun"
 )
 
 // TunDevice represents a macOS utun device
@@ -23,14 +30,44 @@ type TunDevice struct {
 	name string
 	fd   *os.File
 	mtu  int
+	ip   string // local address, set by Configure
+
+	closed atomic.Bool
+}
+
+// privileged runs the operations that need root in the helper, if set
+var privileged *helper.Client
+
+// UseHelper has the privileged helper create the utun devices and configure
+// them, for a process not running as root
+func UseHelper(c *helper.Client) {
+	privileged = c
 }
 
 // CreateTUN creates a new utun device on macOS
 func CreateTUN() (*TunDevice, error) {
+	open := OpenTUN
+	if privileged != nil {
+		open = privileged.CreateTUN
+	}
+	fd, name, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &TunDevice{
+		name: name,
+		fd:   fd,
+		mtu:  1500,
+	}, nil
+}
+
+// OpenTUN creates a new utun device and returns it, open and non-blocking,
+// and its name
+func OpenTUN() (*os.File, string, error) {
 	// Open the utun control socket
 	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, SYSPROTO_CONTROL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create utun socket: %w", err)
+		return nil, "", fmt.Errorf("failed to create utun socket: %w", err)
 	}
 
 	// Find the utun control ID
@@ -40,7 +77,7 @@ func CreateTUN() (*TunDevice, error) {
 	err = unix.IoctlCtlInfo(fd, ctlInfo)
 	if err != nil {
 		unix.Close(fd)
-		return nil, fmt.Errorf("failed to get utun control info: %w", err)
+		return nil, "", fmt.Errorf("failed to get utun control info: %w", err)
 	}
 
 	// Connect to utun control (auto-assigns utun number)
@@ -52,21 +89,24 @@ func CreateTUN() (*TunDevice, error) {
 	err = unix.Connect(fd, sc)
 	if err != nil {
 		unix.Close(fd)
-		return nil, fmt.Errorf("failed to connect to utun control: %w", err)
+		return nil, "", fmt.Errorf("failed to connect to utun control: %w", err)
 	}
 
 	// Get the assigned utun device name
 	name, err := getDeviceName(fd)
 	if err != nil {
 		unix.Close(fd)
-		return nil, err
+		return nil, "", err
 	}
 
-	return &TunDevice{
-		name: name,
-		fd:   os.NewFile(uintptr(fd), name),
-		mtu:  1500,
-	}, nil
+	// Non-blocking mode lets the Go runtime poller interrupt a pending Read
+	// when the device is closed
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, "", fmt.Errorf("failed to set utun device non-blocking: %w", err)
+	}
+
+	return os.NewFile(uintptr(fd), name), name, nil
 }
 
 // getDeviceName retrieves the utun device name from the socket
@@ -113,41 +153,72 @@ func (t *TunDevice) Configure(ipAddr string, mtu int) error {
 
 	// Set IP address using ifconfig
 	// ifconfig utun2 169.254.169.1 169.254.169.1 netmask 255.255.255.252
-	cmd := exec.Command("ifconfig", t.name, ip, ip)
-	output, err := cmd.CombinedOutput()
+	output, err := Ifconfig(t.name, ip, ip)
 	if err != nil {
-		return fmt.Errorf("failed to set IP address: %s: %w", string(output), err)
+		return fmt.Errorf("failed to set IP address: %s: %w", output, err)
 	}
 
 	// Set MTU
-	cmd = exec.Command("ifconfig", t.name, "mtu", fmt.Sprintf("%d", mtu))
-	output, err = cmd.CombinedOutput()
+	output, err = Ifconfig(t.name, "mtu", fmt.Sprintf("%d", mtu))
 	if err != nil {
-		return fmt.Errorf("failed to set MTU: %s: %w", string(output), err)
+		return fmt.Errorf("failed to set MTU: %s: %w", output, err)
 	}
 
 	// Bring interface up
-	cmd = exec.Command("ifconfig", t.name, "up")
-	output, err = cmd.CombinedOutput()
+	output, err = Ifconfig(t.name, "up")
 	if err != nil {
-		return fmt.Errorf("failed to bring interface up: %s: %w", string(output), err)
+		return fmt.Errorf("failed to bring interface up: %s: %w", output, err)
 	}
 
+	t.ip = ip
 	t.mtu = mtu
 	return nil
 }
 
+// ConfigureIPv6 adds an IPv6 address (e.g. "fd73:736d:7072::1/64") to the
+// utun device, so that traffic to routed IPv6 prefixes has a source
+// address. Must be called after Configure.
+func (t *TunDevice) ConfigureIPv6(ipAddr string) error {
+	ip, prefix, ok := strings.Cut(ipAddr, "/")
+	if !ok || !strings.Contains(ip, ":") {
+		return fmt.Errorf("invalid IPv6 address format, expected x:x::x/y")
+	}
+
+	// ifconfig utun2 inet6 fd73:736d:7072::1 prefixlen 64
+	output, err := Ifconfig(t.name, "inet6", ip, "prefixlen", prefix)
+	if err != nil {
+		return fmt.Errorf("failed to set IPv6 address: %s: %w", output, err)
+	}
+	return nil
+}
+
+// SetPeer sets the destination address of the point-to-point link, so
+// that routes via the peer as gateway go through the utun device. Must be
+// called after Configure.
+func (t *TunDevice) SetPeer(peer string) error {
+	if t.ip == "" {
+		return fmt.Errorf("TUN device %s is not configured", t.name)
+	}
+
+	// ifconfig utun2 169.254.169.1 169.254.169.2
+	output, err := Ifconfig(t.name, t.ip, peer)
+	if err != nil {
+		return fmt.Errorf("failed to set peer address: %s: %w", output, err)
+	}
+	return nil
+}
+
 // Read reads an IP packet from the utun device
 func (t *TunDevice) Read(buf []byte) (int, error) {
 	// macOS utun prepends 4-byte protocol header (AF_INET or AF_INET6)
 	n, err := t.fd.Read(buf)
 	if err != nil {
-		return 0, fmt.Errorf("read from tun device failed: %w", err)
+		return 0, ioError("read", err)
 	}
 
 	// Need at least 4 bytes for the protocol header
 	if n < 4 {
-		return 0, fmt.Errorf("packet too small: %d bytes", n)
+		return 0, &IOError{Op: "read", Err: fmt.Errorf("packet too small: %d bytes", n), Temporary: true}
 	}
 
 	// Skip the 4-byte protocol header and move packet data to start of buffer
@@ -178,19 +249,22 @@ func (t *TunDevice) Write(packet []byte) (int, error) {
 	// Write to device
 	n, err := t.fd.Write(buf)
 	if err != nil {
-		return 0, fmt.Errorf("write to tun device failed: %w", err)
+		return 0, ioError("write", err)
 	}
 
 	// Return actual packet bytes written (excluding header)
 	return n - 4, nil
 }
 
-// Close closes the TUN device
+// Close closes the TUN device. Pending and later reads and writes fail
+// with ErrClosed; closing again is a no-op.
 func (t *TunDevice) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
 	if t.fd != nil {
 		// Bring interface down
-		cmd := exec.Command("ifconfig", t.name, "down")
-		_ = cmd.Run() // Best effort
+		_, _ = Ifconfig(t.name, "down") // Best effort
 
 		return t.fd.Close()
 	}
@@ -209,9 +283,8 @@ func (t *TunDevice) MTU() int {
 
 // SetMTU sets the MTU of the device
 func (t *TunDevice) SetMTU(mtu int) error {
-	cmd := exec.Command("ifconfig", t.name, "mtu", fmt.Sprintf("%d", mtu))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set MTU: %s: %w", string(output), err)
+	if output, err := Ifconfig(t.name, "mtu", fmt.Sprintf("%d", mtu)); err != nil {
+		return fmt.Errorf("failed to set MTU: %s: %w", output, err)
 	}
 	t.mtu = mtu
 	return nil
@@ -224,3 +297,69 @@ func (t *TunDevice) FileDescriptor() int {
 	}
 	return int(t.fd.Fd())
 }
+
+// Ifconfig runs ifconfig with args on the device name, in the privileged
+// helper if set, and returns its output
+func Ifconfig(name string, args ...string) (string, error) {
+	if privileged != nil {
+		return privileged.Ifconfig(name, args...)
+	}
+	output, err := exec.Command("ifconfig", append([]string{name}, args...)...).CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+// linkLocal is the range of the TUN addresses given by --local-ip by
+// default, which other VPNs' utun devices do not use
+var linkLocal = netip.MustParsePrefix("169.254.0.0/16")
+
+// Devices returns the names of the utun devices on the system that may be
+// ours: those with a link-local IPv4 address, in use or not
+func Devices() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	var names []string
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, DeviceNamePrefix) && len(linkLocalAddrs(&iface)) > 0 {
+			names = append(names, iface.Name)
+		}
+	}
+	return names, nil
+}
+
+// RemoveDevice takes a utun device left behind down and removes its
+// link-local addresses, and with them its routes. macOS destroys the
+// device itself once the process holding it exits.
+func RemoveDevice(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", name, err)
+	}
+	for _, addr := range linkLocalAddrs(iface) {
+		if output, err := Ifconfig(name, "inet", addr.String(), "-alias"); err != nil {
+			return fmt.Errorf("failed to remove address %s from %s: %s: %w", addr, name, output, err)
+		}
+	}
+	if output, err := Ifconfig(name, "down"); err != nil {
+		return fmt.Errorf("failed to bring %s down: %s: %w", name, output, err)
+	}
+	return nil
+}
+
+// linkLocalAddrs returns the link-local IPv4 addresses of an interface
+func linkLocalAddrs(iface *net.Interface) []netip.Addr {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var local []netip.Addr
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err == nil && linkLocal.Contains(prefix.Addr()) {
+			local = append(local, prefix.Addr())
+		}
+	}
+	return local
+}
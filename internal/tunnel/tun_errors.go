@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrClosed is returned by Read and Write once the TUN device is closed.
+// Packet loops should stop quietly when they see it.
+var ErrClosed = errors.New("tun device closed")
+
+// IOError is a failed read from or write to the TUN device. A temporary
+// error only affects the current packet; the device can still be used.
+type IOError struct {
+	Op        string // "read" or "write"
+	Err       error
+	Temporary bool
+}
+
+// Error describes the failed operation
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s %s tun device failed: %v", e.Op, ioPreposition(e.Op), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// IsTemporary reports whether err is a TUN I/O error after which the
+// device can still be used, e.g. an interrupted call or a full queue
+func IsTemporary(err error) bool {
+	var ioErr *IOError
+	return errors.As(err, &ioErr) && ioErr.Temporary
+}
+
+// ioError classifies an error from reading or writing the device
+func ioError(op string, err error) error {
+	switch {
+	case errors.Is(err, os.ErrClosed), errors.Is(err, unix.EBADF), errors.Is(err, io.EOF):
+		return ErrClosed
+	case errors.Is(err, unix.EINTR), errors.Is(err, unix.EAGAIN),
+		errors.Is(err, unix.ENOBUFS), errors.Is(err, unix.ENOMEM):
+		// Interrupted, or the queue is full: retry or drop the packet
+		return &IOError{Op: op, Err: err, Temporary: true}
+	case op == "write" && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EMSGSIZE)):
+		// The kernel rejected this packet, not the device
+		return &IOError{Op: op, Err: err, Temporary: true}
+	}
+	return &IOError{Op: op, Err: err}
+}
+
+// ioPreposition returns "from" for reads and "to" for writes
+func ioPreposition(op string) string {
+	if op == "read" {
+		return "from"
+	}
+	return "to"
+}
@@ -0,0 +1,234 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// tunClonePath is the Linux TUN/TAP clone device
+	tunClonePath = "/dev/net/tun"
+
+	// DeviceNamePrefix is the name prefix of the TUN devices we create
+	DeviceNamePrefix = "ssmtun"
+)
+
+// TunDevice represents a Linux TUN device
+type TunDevice struct {
+	name string
+	fd   *os.File
+	mtu  int
+
+	closed atomic.Bool
+}
+
+// CreateTUN creates a new TUN device on Linux
+func CreateTUN() (*TunDevice, error) {
+	fd, err := unix.Open(tunClonePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", tunClonePath, err)
+	}
+
+	// The kernel replaces %d with the next free unit number
+	ifr, err := unix.NewIfreq(DeviceNamePrefix + "%d")
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to prepare TUN request: %w", err)
+	}
+
+	// IFF_NO_PI: packets are plain IP, without the 4-byte packet info header
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+
+	// Non-blocking mode lets the Go runtime poller interrupt a pending Read
+	// when the device is closed
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set TUN device non-blocking: %w", err)
+	}
+
+	name := ifr.Name()
+	return &TunDevice{
+		name: name,
+		fd:   os.NewFile(uintptr(fd), name),
+		mtu:  1500,
+	}, nil
+}
+
+// Configure configures the TUN device with IP address and MTU via netlink
+func (t *TunDevice) Configure(ipAddr string, mtu int) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", t.name, err)
+	}
+
+	// Parse IP address (should be in format "169.254.169.1/30")
+	addr, err := netlink.ParseAddr(ipAddr)
+	if err != nil {
+		return fmt.Errorf("invalid IP address format, expected x.x.x.x/y: %w", err)
+	}
+
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+
+	// The forwarder only handles IPv4; keep the kernel from sending IPv6
+	// router solicitations and MLD reports into the tunnel (best effort)
+	_ = os.WriteFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", t.name), []byte("1"), 0644)
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+
+	t.mtu = mtu
+	return nil
+}
+
+// ConfigureIPv6 adds an IPv6 address (e.g. "fd73:736d:7072::1/64") to the
+// TUN device, re-enabling IPv6 on it, so that traffic to routed IPv6
+// prefixes has a source address. Must be called after Configure.
+func (t *TunDevice) ConfigureIPv6(ipAddr string) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", t.name, err)
+	}
+
+	addr, err := netlink.ParseAddr(ipAddr)
+	if err != nil || addr.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 address format, expected x:x::x/y")
+	}
+
+	if err := os.WriteFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", t.name), []byte("0"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IPv6 on %s: %w", t.name, err)
+	}
+
+	// Nothing else is on the link, skip duplicate address detection so the
+	// address can be used right away
+	addr.Flags = unix.IFA_F_NODAD
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to set IPv6 address: %w", err)
+	}
+	return nil
+}
+
+// SetPeer is a no-op on Linux: the subnet configured on the device is
+// on-link, so any address in it can be used as a gateway without setting a
+// point-to-point peer
+func (t *TunDevice) SetPeer(peer string) error {
+	return nil
+}
+
+// Read reads an IP packet from the TUN device
+func (t *TunDevice) Read(buf []byte) (int, error) {
+	n, err := t.fd.Read(buf)
+	if err != nil {
+		return 0, ioError("read", err)
+	}
+	return n, nil
+}
+
+// Write writes an IP packet to the TUN device
+func (t *TunDevice) Write(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, fmt.Errorf("empty packet")
+	}
+
+	n, err := t.fd.Write(packet)
+	if err != nil {
+		return 0, ioError("write", err)
+	}
+	return n, nil
+}
+
+// Close closes the TUN device. The kernel removes the (non-persistent)
+// device, together with its addresses and routes, once it is closed.
+// Pending and later reads and writes fail with ErrClosed; closing again is
+// a no-op.
+func (t *TunDevice) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+	if t.fd != nil {
+		// Bring interface down
+		if link, err := netlink.LinkByName(t.name); err == nil {
+			_ = netlink.LinkSetDown(link) // Best effort
+		}
+
+		return t.fd.Close()
+	}
+	return nil
+}
+
+// Name returns the device name (e.g., "ssmtun0")
+func (t *TunDevice) Name() string {
+	return t.name
+}
+
+// MTU returns the MTU of the device
+func (t *TunDevice) MTU() int {
+	return t.mtu
+}
+
+// SetMTU sets the MTU of the device
+func (t *TunDevice) SetMTU(mtu int) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", t.name, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+	t.mtu = mtu
+	return nil
+}
+
+// FileDescriptor returns the underlying file descriptor. Note that this
+// switches it back to blocking mode, so Close no longer interrupts a Read.
+func (t *TunDevice) FileDescriptor() int {
+	if t.fd == nil {
+		return -1
+	}
+	return int(t.fd.Fd())
+}
+
+// Devices returns the names of the TUN and WireGuard devices on the system
+// that may be ours (named DeviceNamePrefix* or WireGuardNamePrefix*), in
+// use or not. A WireGuard device outlives the process that created it.
+func Devices() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+
+	var names []string
+	for _, link := range links {
+		if name := link.Attrs().Name; strings.HasPrefix(name, DeviceNamePrefix) || strings.HasPrefix(name, WireGuardNamePrefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// RemoveDevice deletes a TUN device left behind, with its routes
+func RemoveDevice(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
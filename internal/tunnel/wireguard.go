@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuardPeer is the one peer of a WireGuard device
+type WireGuardPeer struct {
+	PublicKey  string // base64, as printed by wg
+	Endpoint   netip.AddrPort
+	AllowedIPs []string
+	Keepalive  time.Duration // 0 for none
+}
+
+// GenerateWireGuardKey returns a new WireGuard private key and its public
+// key, base64 encoded like 'wg genkey' and 'wg pubkey' print them
+func GenerateWireGuardKey() (private, public string, err error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", "", fmt.Errorf("failed to generate WireGuard key: %w", err)
+	}
+	// Clamped as curve25519 private keys are
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	pub, err := curve25519.X25519(key[:], curve25519.Basepoint)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to derive WireGuard public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Name returns the device name (e.g., "ssmwg0")
+func (d *WireGuardDevice) Name() string {
+	return d.name
+}
+
+// SetKeys gives the device its private key and its peer. The private key
+// is passed to wg on stdin, so it never shows up in a process list.
+func (d *WireGuardDevice) SetKeys(privateKey string, peer WireGuardPeer) error {
+	args := []string{"set", d.name, "private-key", "/dev/stdin",
+		"peer", peer.PublicKey,
+		"endpoint", peer.Endpoint.String(),
+		"allowed-ips", strings.Join(peer.AllowedIPs, ","),
+	}
+	if peer.Keepalive > 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(int(peer.Keepalive.Seconds())))
+	}
+
+	cmd := exec.Command("wg", args...)
+	cmd.Stdin = strings.NewReader(privateKey + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to configure WireGuard device %s: %s: %w", d.name, strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// LatestHandshake returns when the device last completed a handshake with
+// its peer, the zero time if it never did
+func (d *WireGuardDevice) LatestHandshake() (time.Time, error) {
+	output, err := exec.Command("wg", "show", d.name, "latest-handshakes").CombinedOutput()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query WireGuard device %s: %s: %w", d.name, strings.TrimSpace(string(output)), err)
+	}
+
+	// One "<public key>\t<unix time>" line per peer
+	var latest time.Time
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if sec, err := strconv.ParseInt(fields[1], 10, 64); err == nil && sec > 0 {
+			if t := time.Unix(sec, 0); t.After(latest) {
+				latest = t
+			}
+		}
+	}
+	return latest, nil
+}
+
+// lookWG checks that the wg tool is installed
+func lookWG() error {
+	if _, err := exec.LookPath("wg"); err != nil {
+		return fmt.Errorf("the wg tool is not installed (install wireguard-tools): %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// wireGuardStartTimeout is how long wireguard-go gets to create its utun
+// device
+const wireGuardStartTimeout = 5 * time.Second
+
+// WireGuardDevice represents a utun device run by wireguard-go on macOS,
+// which has no WireGuard in the kernel
+type WireGuardDevice struct {
+	name string
+	ip   string // local address, set by Configure
+	cmd  *exec.Cmd
+	done chan struct{} // closed when wireguard-go exits
+}
+
+// CreateWireGuard starts wireguard-go, in the foreground as our child, on
+// a new utun device
+func CreateWireGuard() (*WireGuardDevice, error) {
+	if err := lookWG(); err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("wireguard-go"); err != nil {
+		return nil, fmt.Errorf("wireguard-go is not installed (brew install wireguard-go wireguard-tools): %w", err)
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("wireguard-go needs root")
+	}
+
+	dir, err := os.MkdirTemp("", "ssm-proxy-wg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	nameFile := filepath.Join(dir, "name")
+
+	// wireguard-go writes the name of the utun device it got to
+	// WG_TUN_NAME_FILE, as wg-quick has it do
+	cmd := exec.Command("wireguard-go", "-f", "utun")
+	cmd.Env = append(os.Environ(), "WG_TUN_NAME_FILE="+nameFile)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start wireguard-go: %w", err)
+	}
+	d := &WireGuardDevice{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(d.done)
+	}()
+
+	deadline := time.After(wireGuardStartTimeout)
+	for d.name == "" {
+		select {
+		case <-d.done:
+			return nil, fmt.Errorf("wireguard-go exited: %s", cmd.ProcessState)
+		case <-deadline:
+			d.Close()
+			return nil, fmt.Errorf("wireguard-go did not create a utun device within %s", wireGuardStartTimeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if data, err := os.ReadFile(nameFile); err == nil {
+			d.name = strings.TrimSpace(string(data))
+		}
+	}
+	return d, nil
+}
+
+// Configure configures the device with IP address and MTU and brings it
+// up, like TunDevice.Configure
+func (d *WireGuardDevice) Configure(ipAddr string, mtu int) error {
+	ip, _, ok := strings.Cut(ipAddr, "/")
+	if !ok {
+		return fmt.Errorf("invalid IP address format, expected x.x.x.x/y")
+	}
+
+	if output, err := Ifconfig(d.name, ip, ip); err != nil {
+		return fmt.Errorf("failed to set IP address: %s: %w", output, err)
+	}
+	if output, err := Ifconfig(d.name, "mtu", fmt.Sprintf("%d", mtu)); err != nil {
+		return fmt.Errorf("failed to set MTU: %s: %w", output, err)
+	}
+	if output, err := Ifconfig(d.name, "up"); err != nil {
+		return fmt.Errorf("failed to bring interface up: %s: %w", output, err)
+	}
+
+	d.ip = ip
+	return nil
+}
+
+// SetPeer sets the destination address of the point-to-point link, so
+// that routes via the peer as gateway go through the device. Must be
+// called after Configure.
+func (d *WireGuardDevice) SetPeer(peer string) error {
+	if d.ip == "" {
+		return fmt.Errorf("WireGuard device %s is not configured", d.name)
+	}
+	if output, err := Ifconfig(d.name, d.ip, peer); err != nil {
+		return fmt.Errorf("failed to set peer address: %s: %w", output, err)
+	}
+	return nil
+}
+
+// Close stops wireguard-go, which destroys the utun device, and waits for
+// it to exit
+func (d *WireGuardDevice) Close() error {
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	if err := d.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop wireguard-go: %w", err)
+	}
+	select {
+	case <-d.done:
+	case <-time.After(wireGuardStartTimeout):
+		d.cmd.Process.Kill()
+		<-d.done
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// WireGuardNamePrefix is the name prefix of the WireGuard devices we
+// create
+const WireGuardNamePrefix = "ssmwg"
+
+// WireGuardDevice represents a kernel WireGuard device on Linux
+type WireGuardDevice struct {
+	name string
+}
+
+// CreateWireGuard creates a kernel WireGuard device, named
+// WireGuardNamePrefix with the first free number
+func CreateWireGuard() (*WireGuardDevice, error) {
+	if err := lookWG(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 256; i++ {
+		name := fmt.Sprintf("%s%d", WireGuardNamePrefix, i)
+		if _, err := netlink.LinkByName(name); err == nil {
+			continue
+		}
+		err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}})
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create WireGuard device (is the wireguard kernel module available?): %w", err)
+		}
+		return &WireGuardDevice{name: name}, nil
+	}
+	return nil, fmt.Errorf("no free WireGuard device name")
+}
+
+// Configure configures the device with IP address and MTU via netlink and
+// brings it up
+func (d *WireGuardDevice) Configure(ipAddr string, mtu int) error {
+	link, err := netlink.LinkByName(d.name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", d.name, err)
+	}
+
+	addr, err := netlink.ParseAddr(ipAddr)
+	if err != nil {
+		return fmt.Errorf("invalid IP address format, expected x.x.x.x/y: %w", err)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+	return nil
+}
+
+// SetPeer is a no-op on Linux: the subnet configured on the device is
+// on-link, as for TunDevice
+func (d *WireGuardDevice) SetPeer(peer string) error {
+	return nil
+}
+
+// Close deletes the device, together with its addresses and routes
+func (d *WireGuardDevice) Close() error {
+	link, err := netlink.LinkByName(d.name)
+	if err != nil {
+		return nil // Already gone
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", d.name, err)
+	}
+	return nil
+}
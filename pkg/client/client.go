@@ -0,0 +1,321 @@
+// Package client establishes ssm-proxy tunnels from Go programs, without
+// running the ssm-proxy binary: Connect finds the instance, opens an SSH
+// tunnel over SSM Session Manager (in process), creates a TUN device,
+// routes the CIDR blocks into it and forwards their traffic through the
+// tunnel. The returned Session reports statistics, manages routes, resolves
+// names through the tunnel and shuts everything down again.
+//
+//	sess, err := client.Connect(ctx, client.Options{
+//		InstanceID: "i-0123456789abcdef0",
+//		CIDRs:      []string{"10.0.0.0/16"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer sess.Close()
+//
+// Creating TUN devices and routes requires root (or CAP_NET_ADMIN on
+// Linux). Sessions are not registered with the ssm-proxy state store, so
+// 'ssm-proxy status' and 'ssm-proxy stop' do not see them.
+//
+// The exported API follows semantic versioning with the ssm-proxy module,
+// like pkg/tun2socks.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/aws"
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/netutil"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/internal/ssm"
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+	"github.com/sbkg0002/ssm-proxy/pkg/tun2socks"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// Transports of the SSH tunnel
+const (
+	// TransportNative runs SSH and the SSM session in process (default)
+	TransportNative = "native"
+	// TransportSSH runs the ssh binary with 'aws ssm start-session' as its
+	// ProxyCommand
+	TransportSSH = "ssh"
+)
+
+// Defaults of Options
+const (
+	DefaultLocalIP = "169.254.169.1/30"
+	DefaultMTU     = 1500
+	DefaultSSHUser = "ec2-user"
+)
+
+// Options configures a session
+type Options struct {
+	// InstanceID or InstanceTag (Key=Value, matching exactly one running
+	// instance) selects the instance the tunnel goes through
+	InstanceID  string
+	InstanceTag string
+
+	// Profile and Region select the AWS credentials and region (default:
+	// the SDK's defaults, e.g. AWS_PROFILE and AWS_REGION)
+	Profile string
+	Region  string
+
+	// Role, if set, is assumed with the profile's credentials for all AWS
+	// calls. A role requiring MFA needs its TokenProvider.
+	Role *aws.AssumeRole
+
+	// CIDRs are the blocks routed through the tunnel. More can be added
+	// with Session.AddRoute.
+	CIDRs []string
+
+	// LocalIP is the TUN device's address (default DefaultLocalIP) and MTU
+	// its MTU (default DefaultMTU)
+	LocalIP string
+	MTU     int
+
+	// DNSServer (host:port, reached through the tunnel) answers the DNS
+	// queries sent into the TUN device for DNSDomains (all if empty) and
+	// those of Session.LookupHost. With ConfigureSystemResolver and
+	// DNSDomains, the system resolver sends queries for DNSDomains to it.
+	DNSServer               string
+	DNSDomains              []string
+	ConfigureSystemResolver bool
+
+	// Transport is TransportNative (default) or TransportSSH
+	Transport string
+
+	// SSHUser is the user on the instance (default DefaultSSHUser);
+	// TempKey uses a key pair generated for this session instead of ~/.ssh
+	SSHUser string
+	TempKey bool
+
+	// KeepAlive is the SSH keep-alive interval (default 30s), DialTimeout
+	// bounds connecting the tunnel and each connection through it (default
+	// 30s)
+	KeepAlive   time.Duration
+	DialTimeout time.Duration
+}
+
+// Instance is the EC2 instance a session's tunnel goes through
+type Instance struct {
+	ID               string
+	Name             string
+	PrivateIP        string
+	AvailabilityZone string
+	VpcID            string
+}
+
+// withDefaults returns the options with unset fields defaulted
+func (o Options) withDefaults() Options {
+	if o.LocalIP == "" {
+		o.LocalIP = DefaultLocalIP
+	}
+	if o.MTU == 0 {
+		o.MTU = DefaultMTU
+	}
+	if o.Transport == "" {
+		o.Transport = TransportNative
+	}
+	if o.SSHUser == "" {
+		o.SSHUser = DefaultSSHUser
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = 30 * time.Second
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// validate checks the options before anything is set up
+func (o Options) validate() error {
+	if (o.InstanceID == "") == (o.InstanceTag == "") {
+		return errors.New("exactly one of InstanceID and InstanceTag is required")
+	}
+	if o.InstanceTag != "" {
+		if key, _, ok := strings.Cut(o.InstanceTag, "="); !ok || key == "" {
+			return fmt.Errorf("invalid InstanceTag %q (expected Key=Value)", o.InstanceTag)
+		}
+	}
+	for _, cidr := range o.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR block %q: %w", cidr, err)
+		}
+	}
+	if o.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(o.DNSServer); err != nil {
+			return fmt.Errorf("invalid DNSServer %q (expected host:port): %w", o.DNSServer, err)
+		}
+	}
+	if o.Transport != TransportNative && o.Transport != TransportSSH {
+		return fmt.Errorf("invalid Transport %q (expected %s or %s)", o.Transport, TransportNative, TransportSSH)
+	}
+	return nil
+}
+
+// tunnelTransport is the SSH tunnel of a session
+type tunnelTransport interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	SOCKSAddr() string
+}
+
+// Connect establishes a session. ctx bounds connecting only; the session
+// runs until Close. If any step fails, the ones before it are undone.
+func Connect(ctx context.Context, options Options) (sess *Session, err error) {
+	options = options.withDefaults()
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Session{options: options, done: make(chan struct{})}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	awsClient, err := aws.NewClientWithRole(ctx, options.Profile, options.Region, options.Role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS client: %w", err)
+	}
+	instance, err := findInstance(ctx, awsClient, options)
+	if err != nil {
+		return nil, err
+	}
+	s.instance = Instance{
+		ID:               instance.InstanceID,
+		Name:             instance.Name,
+		PrivateIP:        instance.PrivateIP,
+		AvailabilityZone: instance.AvailabilityZone,
+		VpcID:            instance.VpcID,
+	}
+
+	// SSH tunnel with dynamic SOCKS5 forwarding over SSM
+	socksPort, err := netutil.FreeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free SOCKS5 port: %w", err)
+	}
+	config := tunnel.SSHTunnelConfig{
+		InstanceID:       instance.InstanceID,
+		Region:           awsClient.Region(),
+		AWSProfile:       options.Profile,
+		AWSConfig:        awsClient.Config(),
+		AvailabilityZone: instance.AvailabilityZone,
+		SOCKSPort:        socksPort,
+		CredentialsEnv:   options.Role != nil,
+		SSHUser:          options.SSHUser,
+		TempKey:          options.TempKey,
+		NonInteractive:   true,
+		KeepAlive:        options.KeepAlive,
+		ConnectTimeout:   options.DialTimeout,
+	}
+	var transport tunnelTransport = tunnel.NewNativeTunnel(config)
+	if options.Transport == TransportSSH {
+		transport = tunnel.NewSSHTunnel(config)
+	}
+	if err := transport.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start SSH tunnel: %w", err)
+	}
+	s.tunnel = transport
+
+	dialer, err := proxy.SOCKS5("tcp", transport.SOCKSAddr(), nil, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+	}
+	s.dialer = dialer.(proxy.ContextDialer)
+
+	// TUN device and the translator forwarding its packets into the tunnel
+	s.device, err = tun2socks.OpenTUN(options.LocalIP, options.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	translatorOptions := tun2socks.Options{
+		SOCKSAddr:   transport.SOCKSAddr(),
+		DialTimeout: options.DialTimeout,
+		Gateway:     s.device.Peer(),
+	}
+	if options.DNSServer != "" {
+		translatorOptions.DNS = &tun2socks.DNSOptions{Server: options.DNSServer, Domains: options.DNSDomains}
+	}
+	s.translator, err = tun2socks.New(s.device, translatorOptions)
+	if err != nil {
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if err := s.translator.Start(runCtx); err != nil {
+		return nil, fmt.Errorf("failed to start packet forwarder: %w", err)
+	}
+
+	s.router = routing.NewRouter()
+	results := s.router.AddRoutes(ctx, options.CIDRs, s.device.Name())
+	if err := results.Err(); err != nil {
+		return nil, fmt.Errorf("failed to add %d of %d routes: %w", len(results.Failed()), len(results), err)
+	}
+
+	if options.ConfigureSystemResolver && options.DNSServer != "" && len(options.DNSDomains) > 0 {
+		resolver := dns.NewSystemResolverConfig(options.DNSDomains, options.DNSServer)
+		resolver.SetInterface(s.device.Name())
+		if err := resolver.Setup(); err != nil {
+			return nil, fmt.Errorf("failed to configure system DNS resolver: %w", err)
+		}
+		s.systemResolver = resolver
+	}
+
+	s.startedAt = time.Now()
+	return s, nil
+}
+
+// findInstance looks up the instance of the options and checks that the
+// tunnel can go through it
+func findInstance(ctx context.Context, awsClient *aws.Client, options Options) (*aws.Instance, error) {
+	var instance *aws.Instance
+	if options.InstanceID != "" {
+		var err error
+		if instance, err = awsClient.GetInstance(ctx, options.InstanceID); err != nil {
+			return nil, fmt.Errorf("failed to find instance: %w", err)
+		}
+	} else {
+		key, value, _ := strings.Cut(options.InstanceTag, "=")
+		instances, err := awsClient.FindInstancesByTag(ctx, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find instances: %w", err)
+		}
+		switch len(instances) {
+		case 0:
+			return nil, fmt.Errorf("no instances found with tag %s", options.InstanceTag)
+		case 1:
+			instance = instances[0]
+		default:
+			return nil, fmt.Errorf("multiple instances found with tag %s, use InstanceID to specify", options.InstanceTag)
+		}
+	}
+
+	if instance.State != "running" {
+		return nil, fmt.Errorf("instance %s is not running (state: %s)", instance.InstanceID, instance.State)
+	}
+	if !instance.SSMConnected {
+		return nil, fmt.Errorf("SSM Agent is not connected on instance %s", instance.InstanceID)
+	}
+	return instance, nil
+}
+
+// SetLogger sets the logger of all sessions, including their tunnels and
+// packet forwarders (by default, info level to stderr)
+func SetLogger(logger *logrus.Logger) {
+	tun2socks.SetLogger(logger)
+	tunnel.SetLogger(logger)
+	ssm.SetLogger(logger)
+}
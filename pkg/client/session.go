@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/routing"
+	"github.com/sbkg0002/ssm-proxy/pkg/tun2socks"
+	"golang.org/x/net/proxy"
+)
+
+// Stats are a session's traffic counters
+type Stats = tun2socks.Stats
+
+// Session is an established tunnel. Its methods are safe for concurrent
+// use.
+type Session struct {
+	options   Options
+	instance  Instance
+	startedAt time.Time
+
+	tunnel         tunnelTransport
+	dialer         proxy.ContextDialer
+	device         *tun2socks.TUN
+	translator     *tun2socks.Translator
+	cancel         context.CancelFunc
+	router         *routing.Router
+	systemResolver *dns.SystemResolverConfig
+
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+// Instance returns the instance the tunnel goes through
+func (s *Session) Instance() Instance {
+	return s.instance
+}
+
+// Device returns the name of the TUN device
+func (s *Session) Device() string {
+	return s.device.Name()
+}
+
+// SOCKSAddr returns the local SOCKS5 proxy of the tunnel
+func (s *Session) SOCKSAddr() string {
+	return s.tunnel.SOCKSAddr()
+}
+
+// StartedAt returns when the session was established
+func (s *Session) StartedAt() time.Time {
+	return s.startedAt
+}
+
+// Alive reports whether the tunnel to the instance is up. A session whose
+// tunnel went down should be closed and connected again.
+func (s *Session) Alive() bool {
+	return s.tunnel.IsRunning()
+}
+
+// Stats returns the traffic counters
+func (s *Session) Stats() Stats {
+	return s.translator.Stats()
+}
+
+// Routes returns the CIDR blocks routed through the tunnel
+func (s *Session) Routes() []string {
+	return slices.Sorted(maps.Keys(s.router.ListRoutes()))
+}
+
+// AddRoute routes another CIDR block through the tunnel
+func (s *Session) AddRoute(ctx context.Context, cidr string) error {
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return fmt.Errorf("invalid CIDR block %q: %w", cidr, err)
+	}
+	return s.router.AddRouteContext(ctx, cidr, s.device.Name())
+}
+
+// RemoveRoute stops routing a CIDR block through the tunnel
+func (s *Session) RemoveRoute(ctx context.Context, cidr string) error {
+	if _, ok := s.router.ListRoutes()[cidr]; !ok {
+		return fmt.Errorf("%s is not routed through the tunnel", cidr)
+	}
+	return s.router.DeleteRouteContext(ctx, cidr)
+}
+
+// DialContext connects to address (host:port, TCP only) through the
+// tunnel, whether or not it is routed there
+func (s *Session) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s is not supported through the tunnel", network)
+	}
+	return s.dialer.DialContext(ctx, network, address)
+}
+
+// LookupHost resolves host with Options.DNSServer, through the tunnel
+func (s *Session) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if s.options.DNSServer == "" {
+		return nil, errors.New("no DNSServer configured")
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return s.DialContext(ctx, "tcp", s.options.DNSServer)
+		},
+	}
+	return resolver.LookupHost(ctx, host)
+}
+
+// Done is closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close shuts the session down: the system resolver is restored, the TUN
+// device and the routes through it are removed and the tunnel is stopped.
+// Every step is attempted even if one fails; the failures are returned
+// together. Calling Close again returns the same result.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		var errs []error
+		if s.cancel != nil {
+			s.cancel()
+		}
+
+		// Local applications are told their connections ended while the
+		// device is still open; it is closed before the translator, so
+		// that its pending read returns
+		if s.translator != nil {
+			s.translator.ResetConnections()
+		}
+		if s.device != nil {
+			if err := s.device.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close TUN device: %w", err))
+			}
+		}
+		if s.translator != nil {
+			if err := s.translator.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to stop packet forwarder: %w", err))
+			}
+		}
+		if s.systemResolver != nil {
+			if err := s.systemResolver.Cleanup(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to restore system DNS resolver: %w", err))
+			}
+		}
+		if s.router != nil {
+			if err := s.router.Cleanup(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove routes: %w", err))
+			}
+		}
+		if s.tunnel != nil {
+			if err := s.tunnel.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to stop SSH tunnel: %w", err))
+			}
+		}
+
+		s.closeErr = errors.Join(errs...)
+		close(s.done)
+	})
+	return s.closeErr
+}
@@ -0,0 +1,38 @@
+// Package tun2socks translates the IP packets of a TUN device into TCP
+// connections through a SOCKS5 proxy, the way ssm-proxy forwards traffic
+// into an SSM tunnel. Applications keep using plain IP: TCP streams are
+// terminated by a userspace network stack and relayed, DNS queries can be
+// answered through the proxy, ICMP echo requests are answered by probing
+// the destination, and other UDP is relayed via SOCKS5 UDP ASSOCIATE.
+//
+// A minimal embedding opens a TUN device, routes a range into it and starts
+// a translator:
+//
+//	dev, err := tun2socks.OpenTUN("169.254.169.1/30", 1500)
+//	if err != nil {
+//		return err
+//	}
+//	defer dev.Close()
+//	// ... route 10.0.0.0/16 via dev.Name() ...
+//
+//	t, err := tun2socks.New(dev, tun2socks.Options{SOCKSAddr: "127.0.0.1:1080"})
+//	if err != nil {
+//		return err
+//	}
+//	if err := t.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer t.Stop()
+//
+// Instead of a SOCKS5 proxy, Options.Dialer can open the connections, e.g.
+// an SSH client's Dial or a custom transport; any Device (not only a TUN
+// device opened here) can supply the packets.
+//
+// # Compatibility
+//
+// The exported API of this package follows semantic versioning with the
+// ssm-proxy module: within a major version, identifiers are not removed or
+// changed incompatibly, and new Options fields default to the previous
+// behavior when left zero. Everything under internal/ may change at any
+// time.
+package tun2socks
@@ -0,0 +1,70 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sbkg0002/ssm-proxy/internal/tunnel"
+)
+
+// TUN is a TUN device (ssmtunN on Linux, utunN on macOS), a Device.
+// Creating one requires root (or CAP_NET_ADMIN on Linux).
+type TUN struct {
+	dev  *tunnel.TunDevice
+	peer net.IP
+}
+
+// OpenTUN creates a TUN device with the IPv4 address (x.x.x.x/y, e.g.
+// "169.254.169.1/30") and MTU, and brings it up. Routes into it are left
+// to the caller, e.g. via Peer() or the interface name.
+func OpenTUN(address string, mtu int) (*TUN, error) {
+	peer, err := tunnel.PeerAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := tunnel.CreateTUN()
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.Configure(address, mtu); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to configure TUN device: %w", err)
+	}
+	if err := dev.SetPeer(peer.String()); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to set TUN peer address: %w", err)
+	}
+	return &TUN{dev: dev, peer: peer}, nil
+}
+
+// Name returns the interface name
+func (t *TUN) Name() string {
+	return t.dev.Name()
+}
+
+// MTU returns the MTU
+func (t *TUN) MTU() int {
+	return t.dev.MTU()
+}
+
+// Peer returns the other end of the device's point-to-point link, usable
+// as the next hop of routes and as Options.Gateway
+func (t *TUN) Peer() net.IP {
+	return t.peer
+}
+
+// Read reads one IP packet
+func (t *TUN) Read(packet []byte) (int, error) {
+	return t.dev.Read(packet)
+}
+
+// Write writes one IP packet
+func (t *TUN) Write(packet []byte) (int, error) {
+	return t.dev.Write(packet)
+}
+
+// Close removes the device (and the routes through it)
+func (t *TUN) Close() error {
+	return t.dev.Close()
+}
@@ -0,0 +1,206 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/sbkg0002/ssm-proxy/internal/dns"
+	"github.com/sbkg0002/ssm-proxy/internal/forwarder"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPingPorts are the TCP ports probed to answer pings by default
+var DefaultPingPorts = slices.Clone(forwarder.DefaultPingPorts)
+
+// DefaultPriorityPorts are preferred over bulk transfers with
+// Options.FairScheduling by default
+var DefaultPriorityPorts = slices.Clone(forwarder.DefaultPriorityPorts)
+
+// Device supplies the IP packets to translate and takes the replies. Each
+// Read returns one IPv4 or IPv6 packet; Read should return io.EOF or
+// os.ErrClosed once the device is closed.
+type Device interface {
+	Read(packet []byte) (int, error)
+	Write(packet []byte) (int, error)
+	MTU() int
+}
+
+// Dialer opens connections to destinations
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Options configures a Translator
+type Options struct {
+	// SOCKSAddr is the SOCKS5 proxy (host:port) connections are opened
+	// through. Required unless Dialer is set.
+	SOCKSAddr string
+
+	// Dialer, if set, opens the TCP connections (and those to the DNS
+	// server) instead of a SOCKS5 proxy. UDP other than DNS is dropped then.
+	Dialer Dialer
+
+	// DNS, if set, answers DNS queries sent into the device through the
+	// proxy
+	DNS *DNSOptions
+
+	// DialTimeout bounds opening a connection to a destination (default 30s)
+	DialTimeout time.Duration
+
+	// PingPorts are the TCP ports probed to answer pings (default
+	// DefaultPingPorts); DisablePing drops pings instead
+	PingPorts   []int
+	DisablePing bool
+
+	// Gateway is the next hop of gateway routes through the device, e.g.
+	// its point-to-point peer. Packets for it are answered locally.
+	Gateway net.IP
+
+	// FairScheduling makes TCP flows take turns sending, so bulk transfers
+	// do not hold up other flows; flows to PriorityPorts (default
+	// DefaultPriorityPorts) get larger turns
+	FairScheduling bool
+	PriorityPorts  []int
+}
+
+// DNSOptions configures answering DNS queries through the proxy
+type DNSOptions struct {
+	// Server is the DNS server (host:port) reached through the proxy, e.g.
+	// an AWS VPC resolver at 169.254.169.253:53. Queries are sent over TCP.
+	Server string
+
+	// Fallbacks are further DNS servers, asked in turn when Server (or the
+	// one before) fails
+	Fallbacks []string
+
+	// Domains are the suffixes resolved through the proxy; other queries
+	// pass unchanged. Empty resolves all queries through the proxy.
+	Domains []string
+
+	// Timeout bounds each query (default 5s)
+	Timeout time.Duration
+}
+
+// Stats are a Translator's traffic counters
+type Stats struct {
+	PacketsTX uint64 // from the device
+	PacketsRX uint64 // to the device
+	BytesTX   uint64
+	BytesRX   uint64
+	ErrorsTX  uint64
+	ErrorsRX  uint64
+
+	// TCP connections relayed right now, and the most at any one time
+	ConnsActive uint64
+	ConnsPeak   uint64
+}
+
+// Translator forwards a device's packets through a SOCKS5 proxy or dialer
+type Translator struct {
+	t *forwarder.TunToSOCKS
+}
+
+// New creates a translator for the device. It does not read from the
+// device until Start.
+func New(device Device, options Options) (*Translator, error) {
+	if device == nil {
+		return nil, errors.New("no device")
+	}
+
+	var dnsConfig *dns.Config
+	if options.DNS != nil {
+		if options.DNS.Server == "" {
+			return nil, errors.New("no DNS server")
+		}
+		dnsConfig = &dns.Config{
+			Resolvers: append([]string{options.DNS.Server}, options.DNS.Fallbacks...),
+			Domains:   options.DNS.Domains,
+			Timeout:   options.DNS.Timeout,
+		}
+	}
+
+	var t *forwarder.TunToSOCKS
+	var err error
+	switch {
+	case options.Dialer != nil:
+		t, err = forwarder.NewTunToDialer(device, options.Dialer, dnsConfig)
+	case options.SOCKSAddr != "":
+		t, err = forwarder.NewTunToSOCKS(device, options.SOCKSAddr, dnsConfig)
+	default:
+		return nil, errors.New("either SOCKSAddr or Dialer is required")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create translator: %w", err)
+	}
+
+	t.SetDialTimeout(options.DialTimeout)
+	switch {
+	case options.DisablePing:
+		t.SetPingPorts(nil)
+	case len(options.PingPorts) > 0:
+		t.SetPingPorts(options.PingPorts)
+	default:
+		t.SetPingPorts(DefaultPingPorts)
+	}
+	if options.FairScheduling {
+		priorityPorts := options.PriorityPorts
+		if priorityPorts == nil {
+			priorityPorts = DefaultPriorityPorts
+		}
+		t.SetScheduler(forwarder.NewScheduler(forwarder.DefaultQuantum, priorityPorts))
+	}
+	t.SetGatewayAddress(options.Gateway)
+
+	return &Translator{t: t}, nil
+}
+
+// Start starts reading packets from the device and relaying them. The
+// translator runs until Stop or until ctx is done.
+func (t *Translator) Start(ctx context.Context) error {
+	return t.t.Start(ctx)
+}
+
+// Stop closes all relayed connections and stops the translator. Closing
+// the device first ends a pending read at once.
+func (t *Translator) Stop() error {
+	return t.t.Stop()
+}
+
+// CloseFlows closes the TCP connections relayed right now (new ones are
+// still accepted) and returns how many were closed
+func (t *Translator) CloseFlows() int {
+	return t.t.CloseFlows()
+}
+
+// ResetConnections resets the relayed TCP connections, writing the RSTs to
+// the device so local applications see them end, and returns how many it
+// reset. Call it before closing the device on shutdown.
+func (t *Translator) ResetConnections() int {
+	return t.t.ResetConnections(nil)
+}
+
+// Stats returns the traffic counters
+func (t *Translator) Stats() Stats {
+	s := t.t.GetStats()
+	return Stats{
+		PacketsTX:   s.PacketsTX,
+		PacketsRX:   s.PacketsRX,
+		BytesTX:     s.BytesTX,
+		BytesRX:     s.BytesRX,
+		ErrorsTX:    s.ErrorsTX,
+		ErrorsRX:    s.ErrorsRX,
+		ConnsActive: s.ConnsActive,
+		ConnsPeak:   s.ConnsPeak,
+	}
+}
+
+// SetLogger sets the logger of all translators and their DNS resolvers
+// (by default, info level to stderr)
+func SetLogger(logger *logrus.Logger) {
+	forwarder.SetLogger(logger)
+	dns.SetLogger(logger)
+}
@@ -0,0 +1,68 @@
+#!/bin/bash
+#
+# End-to-end tests without an AWS account (make integration)
+#
+# Starts the fixtures and runs the tests built with -tags integration
+# against them: LocalStack serves the AWS APIs and a container running sshd
+# stands in for the instance, with a web server and a DNS server behind it.
+# The tests stand in for what LocalStack does not emulate through the test
+# hooks of internal/aws and internal/tunnel. The start flow test runs
+# ssm-proxy in a network namespace, so its routes and TUN device do not
+# touch the host.
+#
+# Requires root, docker (with compose), ssh, nc, dig and curl. Arguments are
+# passed to go test, e.g. -run TestStartFlow.
+#
+
+set -euo pipefail
+
+cd "$(dirname "$0")"
+ROOT="$(cd ../.. && pwd)"
+
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+NC='\033[0m' # No Color
+
+log_info() {
+    echo -e "${GREEN}✓${NC} $1"
+}
+
+fail() {
+    echo -e "${RED}✗${NC} $1" >&2
+    exit 1
+}
+
+cleanup() {
+    IT_KEYS_DIR="$WORK/keys" docker compose down --volumes --remove-orphans >/dev/null 2>&1 || true
+    rm -rf "$WORK"
+}
+
+if [ "$(id -u)" != "0" ]; then
+    echo "Error: the integration tests require root (network namespace, TUN device)"
+    echo "Run: sudo make integration"
+    exit 1
+fi
+for tool in docker ssh nc dig curl; do
+    command -v "$tool" >/dev/null || { echo "Error: $tool not found"; exit 1; }
+done
+
+WORK="$(mktemp -d)"
+chmod 755 "$WORK" # sshd reads the keys as ec2-user
+trap cleanup EXIT
+
+# Fixtures
+mkdir -p "$WORK/keys"
+touch "$WORK/keys/authorized_keys"
+chmod 666 "$WORK/keys/authorized_keys"
+export IT_KEYS_DIR="$WORK/keys"
+docker compose up --detach --build --wait >/dev/null || fail "fixtures did not start"
+log_info "Started LocalStack, sshd, web and DNS containers"
+
+# Tests
+export SSM_PROXY_IT_ENDPOINT="http://127.0.0.1:4566"
+export SSM_PROXY_IT_SSH_ADDR="127.0.0.1:2222"
+export SSM_PROXY_IT_KEYS_DIR="$WORK/keys"
+(cd "$ROOT" && go test -tags integration -count=1 "$@" ./...) || fail "integration tests failed"
+
+echo ""
+log_info "Integration tests passed"